@@ -0,0 +1,138 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package gossip
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Callback is invoked with the key and value of each info added to
+// the infostore, whether locally or by gossip from peers, and with a
+// nil value for each info deleted. Infos which expire aren't reported.
+type Callback func(key string, val interface{})
+
+// A callback is a registered Callback, together with the queue of
+// invocations yet to be run. Each callback runs its invocations in
+// order in a goroutine of its own, so that slow callbacks don't hold
+// up gossip, and callbacks may query the gossip instance.
+type callback struct {
+	pattern string
+	fn      Callback
+	mu      sync.Mutex // Protects the fields below
+	cond    *sync.Cond // Signaled on changes to pending or closed
+	pending []*info    // Infos to report, in order
+	closed  bool       // Set when the callback is unregistered
+}
+
+// newCallback allocates a callback running fn for keys matching
+// pattern and starts its goroutine.
+func newCallback(pattern string, fn Callback) *callback {
+	cb := &callback{pattern: pattern, fn: fn}
+	cb.cond = sync.NewCond(&cb.mu)
+	go cb.run()
+	return cb
+}
+
+// matches returns whether key matches the callback's pattern. As for
+// RegisterInfoType, a pattern ending in "*" matches keys beginning
+// with the preceding prefix; other patterns match a single key.
+func (cb *callback) matches(key string) bool {
+	if strings.HasSuffix(cb.pattern, "*") {
+		return strings.HasPrefix(key, strings.TrimSuffix(cb.pattern, "*"))
+	}
+	return key == cb.pattern
+}
+
+// enqueue queues the report of i.
+func (cb *callback) enqueue(i *info) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.pending = append(cb.pending, i)
+	cb.cond.Signal()
+}
+
+// close stops the callback; queued reports are dropped.
+func (cb *callback) close() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.closed = true
+	cb.cond.Signal()
+}
+
+// run invokes the callback for each queued report until closed.
+func (cb *callback) run() {
+	for {
+		cb.mu.Lock()
+		for len(cb.pending) == 0 && !cb.closed {
+			cb.cond.Wait()
+		}
+		if cb.closed {
+			cb.mu.Unlock()
+			return
+		}
+		pending := cb.pending
+		cb.pending = nil
+		cb.mu.Unlock()
+		for _, i := range pending {
+			cb.fn(i.Key, i.Val)
+		}
+	}
+}
+
+// runCallbacks queues the report of i to each callback whose pattern
+// matches its key.
+func (is *infoStore) runCallbacks(i *info) {
+	for _, cb := range is.callbacks {
+		if cb.matches(i.Key) {
+			cb.enqueue(i)
+		}
+	}
+}
+
+// RegisterCallback registers fn to be invoked with the key and value
+// of each info whose key matches pattern as it's added or deleted, so
+// that components needn't poll GetInfo for changes. A pattern ending
+// in "*" matches keys beginning with the preceding prefix; other
+// patterns match a single key. fn is invoked at once for each
+// matching info already present. Invocations are made in order, from
+// a goroutine of the callback's own, and may safely call back into the
+// gossip instance. Returns a function which unregisters the callback.
+func (g *Gossip) RegisterCallback(pattern string, fn Callback) func() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	cb := newCallback(pattern, fn)
+	now := time.Now().UnixNano()
+	g.is.visitInfos(nil, func(i *info) error {
+		if !i.Deleted && !i.expired(now) && cb.matches(i.Key) {
+			cb.enqueue(i)
+		}
+		return nil
+	})
+	g.is.callbacks = append(g.is.callbacks, cb)
+	return func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		for j, c := range g.is.callbacks {
+			if c == cb {
+				g.is.callbacks = append(g.is.callbacks[:j], g.is.callbacks[j+1:]...)
+				cb.close()
+				break
+			}
+		}
+	}
+}
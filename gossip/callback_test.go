@@ -0,0 +1,80 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package gossip
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestCallbacks verifies callbacks are invoked in order for existing
+// and new infos matching their patterns, including deletions and
+// infos gossiped from peers, and not once unregistered.
+func TestCallbacks(t *testing.T) {
+	local, remote, lserver, rserver := startGossip(t)
+	defer lserver.Close()
+	defer rserver.Close()
+	defer local.stop()
+	defer remote.stop()
+	remote.AddInfo("cb-a", "existing", time.Hour)
+	remote.AddInfo("other", "ignored", time.Hour)
+
+	var mu sync.Mutex
+	var calls []string
+	record := func(key string, val interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, fmt.Sprintf("%s=%v", key, val))
+		// Callbacks may call back into gossip.
+		remote.GetInfo(key)
+	}
+	seen := func(n int) func() bool {
+		return func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(calls) >= n
+		}
+	}
+	unregister := remote.RegisterCallback("cb-*", record)
+	remote.AddInfo("cb-b", "new", time.Hour)
+	remote.AddInfo("cb-exact", int64(1), time.Hour)
+	remote.DeleteInfo("cb-a")
+	waitFor(seen(4), "local callbacks", t)
+
+	// Infos gossiped from a peer are reported.
+	local.AddInfo("cb-c", "gossiped", time.Hour)
+	c := newClient(remote.is.NodeAddr)
+	done := make(chan *client, 1)
+	go c.start(local, done)
+	defer func() {
+		c.close()
+		<-done
+	}()
+	waitFor(seen(5), "gossiped callback", t)
+
+	unregister()
+	remote.AddInfo("cb-d", "unreported", time.Hour)
+	time.Sleep(10 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	exp := []string{"cb-a=existing", "cb-b=new", "cb-exact=1", "cb-a=<nil>", "cb-c=gossiped"}
+	if !reflect.DeepEqual(calls, exp) {
+		t.Errorf("expected callbacks %q; got %q", exp, calls)
+	}
+}
@@ -103,6 +103,10 @@ func (c *client) gossip(g *Gossip) error {
 			return util.Errorf("stopping outgoing client %s; already have incoming", c.addr)
 		}
 
+		if err := g.checkLink(c.addr, c.closer); err != nil {
+			return err
+		}
+
 		// Compute the delta of local node's infostore to send with request.
 		g.mu.Lock()
 		delta := g.is.delta(c.addr, localMaxSeq)
@@ -120,6 +124,7 @@ func (c *client) gossip(g *Gossip) error {
 		}
 		reply := new(GossipResponse)
 		gossipCall := c.rpcClient.Go("Gossip.Gossip", args, reply, nil)
+		g.counters.recordSent(delta)
 		select {
 		case <-gossipCall.Done:
 			if gossipCall.Error != nil {
@@ -134,6 +139,11 @@ func (c *client) gossip(g *Gossip) error {
 			return util.Errorf("timeout after: %v", *GossipInterval*10)
 		}
 
+		// The reply is lost if the link went down while awaiting it.
+		if err := g.checkLink(c.addr, c.closer); err != nil {
+			return err
+		}
+
 		// Handle remote forwarding.
 		if reply.Alternate != nil {
 			glog.Infof("received forward from %+v to %+v", c.addr, reply.Alternate)
@@ -147,10 +157,12 @@ func (c *client) gossip(g *Gossip) error {
 			glog.V(1).Infof("received gossip reply delta from %s: %s", c.addr, reply.Delta)
 			g.mu.Lock()
 			freshCount := g.is.combine(reply.Delta)
+			g.counters.recordReceived(reply.Delta, freshCount)
 			if freshCount > 0 {
 				c.lastFresh = now
 			}
 			remoteMaxSeq = reply.Delta.MaxSeq
+			g.members.update(g.is)
 
 			// If we have the sentinel gossip, we're considered connected.
 			g.checkHasConnected()
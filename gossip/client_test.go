@@ -80,3 +80,37 @@ func TestClientGossip(t *testing.T) {
 		t.Errorf("expected client disconnect after remote close")
 	}
 }
+
+// TestClientGossipDeletion verifies a deleted info is removed from
+// the peers which learned of it.
+func TestClientGossipDeletion(t *testing.T) {
+	defer func(interval time.Duration) { *GossipInterval = interval }(*GossipInterval)
+	*GossipInterval = 10 * time.Millisecond
+	local, remote, lserver, rserver := startGossip(t)
+	defer lserver.Close()
+	defer rserver.Close()
+	defer local.stop()
+	defer remote.stop()
+	local.AddInfo("local-key", "local value", time.Hour)
+
+	c := newClient(remote.is.NodeAddr)
+	done := make(chan *client, 1)
+	go c.start(local, done)
+	// Stop the client before the gossip interval is restored.
+	defer func() {
+		c.close()
+		<-done
+	}()
+
+	waitFor(func() bool {
+		_, err := remote.GetInfo("local-key")
+		return err == nil
+	}, "gossip of info", t)
+	if err := local.DeleteInfo("local-key"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(func() bool {
+		_, err := remote.GetInfo("local-key")
+		return err != nil
+	}, "gossip of tombstone", t)
+}
@@ -46,5 +46,23 @@ Gossip.RegisterGroup(). Info objects are added to groups if their key
 matches. Info can be queried for single-valued keys via
 Gossip.GetInfo. Sorted values for groups are queried via
 Gossip.GetGroupInfos().
+
+The type of the values of a key, or of keys sharing a prefix, may be
+registered via RegisterInfoType(). Infos of registered keys with
+values of other types are refused, whether added locally or gossiped
+by peers, so that values may be read without type assertions via
+typed accessors such as Gossip.GetInfoAs() and Gossip.GetNodeAddr().
+Infos are deleted via Gossip.DeleteInfo(), which gossips a tombstone.
+Rather than polling Gossip.GetInfo() for changes, components may
+register callbacks via Gossip.RegisterCallback(), invoked as infos
+whose keys match a pattern are added or deleted.
+
+The addresses of a node's peers are persisted via the Storage set
+with Gossip.SetStorage(); after a restart, the node bootstraps via
+the peers it knew as well as its configured bootstrap hosts.
+
+Each node gossips a NodeDescriptor. The members of the cluster are
+listed via Gossip.Nodes(); changes to membership are reported to
+subscribers via Gossip.SubscribeMembership().
 */
 package gossip
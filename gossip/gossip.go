@@ -38,8 +38,11 @@ the system with minimal total hops. The algorithm is as follows:
       outgoing connections, goto #1.
 
    b. If any gossip was received at > maxToleratedHops and num
-      connected peers < maxPeers, choose random peer from those
-      originating info > maxToleratedHops, start it, and goto #2.
+      connected peers < maxPeers, choose the peer originating the most
+      info > maxToleratedHops (at random, if several do), start it, and
+      goto #2. maxPeers grows logarithmically with the count of nodes,
+      up to MaxPeers; peers in excess of maxPeers are culled, least
+      useful first.
 
    c. If sentinelGossip is missing or expired, node is considered
       partitioned; goto #1.
@@ -61,6 +64,7 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cockroachdb/cockroach/rpc"
@@ -78,8 +82,13 @@ var (
 )
 
 const (
-	// MaxPeers is the maximum number of connected gossip peers.
+	// MaxPeers is the maximum number of connected gossip peers, in
+	// each direction. Smaller clusters are bounded to fewer peers; see
+	// infoStore.maxPeers.
 	MaxPeers = 10
+	// minPeers is the least bound on the number of connected gossip
+	// peers, in each direction, however small the cluster.
+	minPeers = 3
 	// defaultNodeCount is the default number of nodes in the gossip
 	// network. The actual count of nodes in the cluster is gossiped
 	// by the range which contains node statistics.
@@ -111,8 +120,18 @@ type Gossip struct {
 	disconnected chan *client       // Channel of disconnected clients
 	exited       chan error         // Channel to signal exit
 	stalled      *sync.Cond         // Indicates bootstrap is required
+	linkFilter   LinkFilter         // Simulated network conditions; nil if none
+	storage      Storage            // Storage of bootstrap info; nil if none
+	persisted    string             // Key of the peer addresses last persisted
 }
 
+// A LinkFilter is consulted by a gossip client as it sends each
+// request to the peer at addr and again as it receives the reply. It
+// returns the latency to impose on the message, and false if the peer
+// is unreachable, in which case the message is lost. Link filters simulate network
+// conditions, such as partitions, in tests and simulations.
+type LinkFilter func(addr net.Addr) (latency time.Duration, ok bool)
+
 // New creates an instance of a gossip node.
 func New() *Gossip {
 	g := &Gossip{
@@ -145,14 +164,66 @@ func (g *Gossip) SetInterval(interval time.Duration) {
 	g.interval = interval
 }
 
+// SetLinkFilter sets the filter consulted for each message exchanged
+// with a peer; nil to remove it.
+func (g *Gossip) SetLinkFilter(filter LinkFilter) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.linkFilter = filter
+}
+
+// checkLink applies the link filter, if any, to a message to or from
+// the peer at addr, sleeping for the simulated latency. Returns an error
+// if the peer is unreachable, after waiting out a gossip interval so
+// that attempts to reconnect don't spin.
+func (g *Gossip) checkLink(addr net.Addr, closer <-chan struct{}) error {
+	g.mu.Lock()
+	filter, interval := g.linkFilter, g.interval
+	g.mu.Unlock()
+	if filter == nil {
+		return nil
+	}
+	latency, ok := filter(addr)
+	if !ok {
+		latency = interval
+	}
+	select {
+	case <-time.After(latency):
+	case <-closer:
+	}
+	if !ok {
+		return util.Errorf("link to %s is down", addr)
+	}
+	return nil
+}
+
 // AddInfo adds or updates an info object. Returns an error if info
-// couldn't be added.
+// couldn't be added, including if val isn't of the type registered
+// for key; see RegisterInfoType.
 func (g *Gossip) AddInfo(key string, val interface{}, ttl time.Duration) error {
+	if err := checkInfoType(key, val); err != nil {
+		return err
+	}
 	g.mu.Lock()
 	defer g.mu.Unlock()
 	err := g.is.addInfo(g.is.newInfo(key, val, ttl))
 	if err == nil {
 		g.checkHasConnected()
+		g.members.update(g.is)
+	}
+	return err
+}
+
+// DeleteInfo deletes the info of key, gossiping a tombstone so that
+// the info is removed from every node of the network. The info may be
+// added anew, superseding the tombstone. Returns an error if the
+// deletion is older than the current info or tombstone of key.
+func (g *Gossip) DeleteInfo(key string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	err := g.is.addInfo(g.is.newTombstone(key))
+	if err == nil {
+		g.members.update(g.is)
 	}
 	return err
 }
@@ -245,20 +316,42 @@ func (g *Gossip) Stop() <-chan error {
 	for _, addr := range g.outgoing.asSlice() {
 		g.closeClient(addr)
 	}
+	// Stop the goroutines of registered callbacks.
+	g.mu.Lock()
+	for _, cb := range g.is.callbacks {
+		cb.close()
+	}
+	g.is.callbacks = nil
+	g.mu.Unlock()
 	return g.exited
 }
 
 // maxToleratedHops computes the maximum number of hops which the
 // gossip network should allow when optimally configured. It's based
-// on the level of fanout (MaxPeers) and the count of nodes in the
-// cluster.
+// on the level of fanout (the bound on peers) and the count of nodes
+// in the cluster.
 func (g *Gossip) maxToleratedHops() uint32 {
 	// Get info directly as we have mutex held here.
-	var nodeCount = int64(defaultNodeCount)
-	if info := g.is.getInfo(KeyNodeCount); info != nil {
-		nodeCount = info.Val.(int64)
+	nodeCount, maxPeers := g.is.nodeCount(), g.is.maxPeers()
+	return uint32(math.Ceil(math.Log(float64(nodeCount))/math.Log(float64(maxPeers))))*2 + 1
+}
+
+// cullOutgoing closes the least useful outgoing clients in excess of
+// maxPeers, as when the bound on peers shrinks with the count of
+// nodes. Clients already closing aren't counted.
+func (g *Gossip) cullOutgoing(maxPeers int) {
+	g.clientsMu.Lock()
+	open := g.outgoing.filter(func(a net.Addr) bool {
+		_, ok := g.clients[a.String()]
+		return ok
+	})
+	g.clientsMu.Unlock()
+	for open.len() > maxPeers {
+		addr := g.is.leastUseful(open)
+		glog.Infof("closing least useful client %+v to bound gossip peers at %d", addr, maxPeers)
+		g.closeClient(addr)
+		open.removeAddr(addr)
 	}
-	return uint32(math.Ceil(math.Log(float64(nodeCount))/math.Log(float64(MaxPeers))))*2 + 1
 }
 
 // hasIncoming returns whether the server has an incoming gossip
@@ -343,14 +436,16 @@ func (g *Gossip) bootstrap() {
 	}
 }
 
-// manage manages outgoing clients. Periodically, the infostore is
-// scanned for infos with hop count exceeding maxToleratedHops()
-// threshold. If the number of outgoing clients doesn't exceed
-// MaxPeers, a new gossip client is connected to a randomly selected
-// peer beyond maxToleratedHops threshold. Otherwise, the least useful
-// peer node is cut off to make room for a replacement. Disconnected
-// clients are processed via the disconnected channel and taken out of
-// the outgoing address set. If there are no longer any outgoing
+// manage manages outgoing clients. Periodically, outgoing clients in
+// excess of the bound on peers for the cluster's size are culled, and
+// the infostore is scanned for infos with hop count exceeding
+// maxToleratedHops() threshold. If the number of outgoing clients is
+// within the bound, a new gossip client is connected to the peer
+// beyond maxToleratedHops threshold originating the most such infos;
+// see infoStore.bestSource. Otherwise, the least useful peer node is
+// cut off to make room for a replacement. Disconnected clients are
+// processed via the disconnected channel and taken out of the
+// outgoing address set. If there are no longer any outgoing
 // connections or the sentinel gossip is unavailable, the bootstrapper
 // is notified via the stalled conditional variable.
 func (g *Gossip) manage() {
@@ -376,13 +471,25 @@ func (g *Gossip) manage() {
 
 		case <-checkTimeout:
 			g.mu.Lock()
+			// Purge expired infos and tombstones, so that infos which
+			// are no longer gossiped, such as those of departed nodes,
+			// don't linger in memory.
+			if count := g.is.purge(); count > 0 {
+				glog.V(1).Infof("purged %d expired gossip info(s)", count)
+				g.members.update(g.is)
+			}
+			g.maybePersistBootstrap()
+			maxPeers := g.is.maxPeers()
+			g.cullOutgoing(maxPeers)
 			// Check whether the graph needs to be tightened to
 			// accommodate distant infos.
-			distant := g.filterExtant(g.is.distant(g.maxToleratedHops()))
+			maxHops := g.maxToleratedHops()
+			distant := g.filterExtant(g.is.distant(maxHops))
 			if distant.len() > 0 {
-				// If we have space, start a client immediately.
-				if g.outgoing.len() < MaxPeers {
-					g.startClient(distant.selectRandom())
+				// If we have space, start a client immediately, toward
+				// the source of the most distant infos.
+				if g.outgoing.len() < maxPeers {
+					g.startClient(g.is.bestSource(distant, maxHops))
 				} else {
 					// Otherwise, find least useful peer and close it. Make sure
 					// here that we only consider outgoing clients which are
@@ -476,6 +583,7 @@ func (g *Gossip) checkHasConnected() {
 // The client is added to the outgoing address set and launched in
 // a goroutine.
 func (g *Gossip) startClient(addr net.Addr) {
+	atomic.AddInt64(&g.counters.clientsStarted, 1)
 	c := newClient(addr)
 	g.outgoing.addAddr(c.addr)
 	g.clientsMu.Lock()
@@ -41,6 +41,7 @@ type info struct {
 	Timestamp int64       // Wall time at origination (Unix-nanos)
 	TTLStamp  int64       // Wall time before info is discarded (Unix-nanos)
 	Hops      uint32      // Number of hops from originator
+	Deleted   bool        // True for a tombstone recording the deletion of Key
 	NodeAddr  net.Addr    // Originating node in "host:port" format
 	peerAddr  net.Addr    // Proximate peer which passed us the info
 	seq       int64       // Sequence number for incremental updates
@@ -26,6 +26,7 @@ import (
 	"time"
 
 	"github.com/cockroachdb/cockroach/util"
+	"github.com/golang/glog"
 )
 
 // infoStore objects manage maps of Info and maps of Info Group
@@ -39,13 +40,20 @@ import (
 //
 // infoStores are not thread safe.
 type infoStore struct {
-	Infos    infoMap  // Map from key to info
-	Groups   groupMap // Map from key prefix to groups of infos
-	NodeAddr net.Addr // Address of node owning this info store: "host:port"
-	MaxSeq   int64    // Maximum sequence number inserted
-	seqGen   int64    // Sequence generator incremented each time info is added
+	Infos      infoMap     // Map from key to info
+	Groups     groupMap    // Map from key prefix to groups of infos
+	Tombstones infoMap     // Map from key to tombstone of deleted info
+	NodeAddr   net.Addr    // Address of node owning this info store: "host:port"
+	MaxSeq     int64       // Maximum sequence number inserted
+	seqGen     int64       // Sequence generator incremented each time info is added
+	callbacks  []*callback // Callbacks reporting added and deleted infos
 }
 
+// tombstoneTTL is the minimum time-to-live of a tombstone: long
+// enough for the deletion to reach every node of the network before
+// the tombstone is purged. Var for testing.
+var tombstoneTTL = 10 * time.Minute
+
 // monotonicUnixNano returns a monotonically increasing value for
 // nanoseconds in Unix time. Since equal times are ignored with
 // updates to infos, we're careful to avoid incorrectly ignoring a
@@ -82,7 +90,11 @@ func (is *infoStore) String() string {
 	}, func(i *info) error {
 		buf.WriteString(prepend)
 		prepend = ", "
-		buf.WriteString(fmt.Sprintf("info %q: %+v", i.Key, i.Val))
+		if i.Deleted {
+			buf.WriteString(fmt.Sprintf("tombstone %q", i.Key))
+		} else {
+			buf.WriteString(fmt.Sprintf("info %q: %+v", i.Key, i.Val))
+		}
 		return nil
 	})
 	return buf.String()
@@ -107,9 +119,10 @@ var (
 // in "host:port" format.
 func newInfoStore(nodeAddr net.Addr) *infoStore {
 	return &infoStore{
-		Infos:    infoMap{},
-		Groups:   groupMap{},
-		NodeAddr: nodeAddr,
+		Infos:      infoMap{},
+		Groups:     groupMap{},
+		Tombstones: infoMap{},
+		NodeAddr:   nodeAddr,
 	}
 }
 
@@ -133,6 +146,21 @@ func (is *infoStore) newInfo(key string, val interface{}, ttl time.Duration) *in
 	}
 }
 
+// newTombstone allocates and returns a tombstone recording the
+// deletion of key. The tombstone lives for tombstoneTTL, or until the
+// info it deletes would have expired if that's later, so that copies
+// of the info elsewhere in the network can't outlive it and be
+// gossiped anew.
+func (is *infoStore) newTombstone(key string) *info {
+	i := is.newInfo(key, nil, tombstoneTTL)
+	i.Deleted = true
+	if existing := is.getInfo(key); existing != nil && existing.TTLStamp > i.TTLStamp &&
+		existing.TTLStamp != math.MaxInt64 {
+		i.TTLStamp = existing.TTLStamp
+	}
+	return i
+}
+
 // getInfo returns an info object by key or nil if it doesn't exist.
 func (is *infoStore) getInfo(key string) *info {
 	if group := is.belongsToGroup(key); group != nil {
@@ -181,8 +209,21 @@ func (is *infoStore) registerGroup(g *group) error {
 // info is added to that group (prefix is defined by prefix of string up
 // until last period '.'). Otherwise, the info is added to the infos map.
 //
+// A tombstone removes an older info of its key and is kept in the
+// tombstones map, to be gossiped in turn; an info older than the
+// tombstone of its key is refused.
+//
 // Returns nil if info was added; error otherwise.
 func (is *infoStore) addInfo(i *info) error {
+	if i.Deleted {
+		return is.addTombstone(i)
+	}
+	if tombstone, ok := is.Tombstones[i.Key]; ok {
+		if i.Timestamp <= tombstone.Timestamp {
+			return util.Errorf("info %+v older than tombstone %+v", i, tombstone)
+		}
+		delete(is.Tombstones, i.Key)
+	}
 	// If the prefix matches a group, add to group.
 	if group := is.belongsToGroup(i.Key); group != nil {
 		if err := group.addInfo(i); err != nil {
@@ -191,6 +232,7 @@ func (is *infoStore) addInfo(i *info) error {
 		if i.seq > is.MaxSeq {
 			is.MaxSeq = i.seq
 		}
+		is.runCallbacks(i)
 		return nil
 	}
 	// Only replace an existing info if new timestamp is greater, or if
@@ -206,9 +248,62 @@ func (is *infoStore) addInfo(i *info) error {
 	if i.seq > is.MaxSeq {
 		is.MaxSeq = i.seq
 	}
+	is.runCallbacks(i)
+	return nil
+}
+
+// addTombstone adds or updates the tombstone i, removing the info of
+// its key if older. Returns nil if the tombstone was added; error
+// otherwise.
+func (is *infoStore) addTombstone(i *info) error {
+	if existing, ok := is.Tombstones[i.Key]; ok {
+		if i.Timestamp < existing.Timestamp ||
+			(i.Timestamp == existing.Timestamp && i.Hops >= existing.Hops) {
+			return util.Errorf("tombstone %+v older than current tombstone %+v", i, existing)
+		}
+	}
+	if group := is.belongsToGroup(i.Key); group != nil {
+		if existing, ok := group.Infos[i.Key]; ok {
+			if existing.Timestamp >= i.Timestamp {
+				return util.Errorf("tombstone %+v older than current group info %+v", i, existing)
+			}
+			group.removeInternal(existing)
+		}
+	} else if existing, ok := is.Infos[i.Key]; ok {
+		if existing.Timestamp >= i.Timestamp {
+			return util.Errorf("tombstone %+v older than current info %+v", i, existing)
+		}
+		delete(is.Infos, i.Key)
+	}
+	is.Tombstones[i.Key] = i
+	if i.seq > is.MaxSeq {
+		is.MaxSeq = i.seq
+	}
+	is.runCallbacks(i)
 	return nil
 }
 
+// purge removes expired infos and tombstones, which are otherwise
+// removed only as they're encountered, returning the count removed.
+func (is *infoStore) purge() int {
+	now := time.Now().UnixNano()
+	var count int
+	for _, g := range is.Groups {
+		n := len(g.Infos)
+		g.compact()
+		count += n - len(g.Infos)
+	}
+	for _, m := range []infoMap{is.Infos, is.Tombstones} {
+		for key, i := range m {
+			if i.expired(now) {
+				delete(m, key)
+				count++
+			}
+		}
+	}
+	return count
+}
+
 // infoCount returns the count of infos stored in groups and the
 // non-group infos map. This is really just an approximation as
 // we don't check whether infos are expired.
@@ -240,7 +335,8 @@ func (is *infoStore) maxHops() uint32 {
 // turn. After each group is visited, the visitInfo function is run
 // against each of its infos.  Finally, after all groups have been
 // visitied, the visitInfo function is run against each non-group info
-// in turn. Be sure to skip over any expired infos.
+// and then each tombstone in turn. Be sure to skip over any expired
+// infos.
 func (is *infoStore) visitInfos(visitGroup func(*group) error, visitInfo func(*info) error) error {
 	now := time.Now().UnixNano()
 	for _, g := range is.Groups {
@@ -263,13 +359,15 @@ func (is *infoStore) visitInfos(visitGroup func(*group) error, visitInfo func(*i
 	}
 
 	if visitInfo != nil {
-		for _, i := range is.Infos {
-			if i.expired(now) {
-				delete(is.Infos, i.Key)
-				continue
-			}
-			if err := visitInfo(i); err != nil {
-				return err
+		for _, m := range []infoMap{is.Infos, is.Tombstones} {
+			for _, i := range m {
+				if i.expired(now) {
+					delete(m, i.Key)
+					continue
+				}
+				if err := visitInfo(i); err != nil {
+					return err
+				}
 			}
 		}
 	}
@@ -281,7 +379,9 @@ func (is *infoStore) visitInfos(visitGroup func(*group) error, visitInfo func(*i
 // The sequence numbers on all info objects are reset using the info
 // store's sequence generator. All hop distances on infos are
 // incremented to indicate they've arrived from an external source.
-// Returns the count of "fresh" infos in the provided delta.
+// Infos whose values aren't of the types registered for their keys
+// are discarded. Returns the count of "fresh" infos in the provided
+// delta.
 func (is *infoStore) combine(delta *infoStore) int {
 	// combine group info. If the group doesn't yet exist, register
 	// it. Extract the infos from the group and combine them
@@ -295,6 +395,10 @@ func (is *infoStore) combine(delta *infoStore) int {
 		}
 		return nil
 	}, func(i *info) error {
+		if err := checkInfoType(i.Key, i.Val); err != nil {
+			glog.Warningf("discarding info from %s: %v", delta.NodeAddr, err)
+			return nil
+		}
 		is.seqGen++
 		i.seq = is.seqGen
 		i.Hops++
@@ -355,6 +459,57 @@ func (is *infoStore) distant(maxHops uint32) *addrSet {
 	return addrs
 }
 
+// bestSource returns the address, from amongst addrs, of the node
+// originating the most infos with hops exceeding maxHops; connecting
+// to it directly brings the most distant infos closest. Ties are
+// broken at random, so that nodes don't all converge on the same
+// peer. Returns nil if addrs is empty.
+func (is *infoStore) bestSource(addrs *addrSet, maxHops uint32) net.Addr {
+	if addrs.len() == 0 {
+		return nil
+	}
+	counts := map[string]int{}
+	var most int
+	is.visitInfos(nil, func(i *info) error {
+		if i.Hops > maxHops && addrs.hasAddr(i.NodeAddr) {
+			key := i.NodeAddr.String()
+			if counts[key]++; counts[key] > most {
+				most = counts[key]
+			}
+		}
+		return nil
+	})
+	return addrs.filter(func(a net.Addr) bool {
+		return counts[a.String()] == most
+	}).selectRandom()
+}
+
+// nodeCount returns the count of nodes in the cluster, as gossiped, or
+// defaultNodeCount if it isn't yet known.
+func (is *infoStore) nodeCount() int64 {
+	if info := is.getInfo(KeyNodeCount); info != nil {
+		if count := info.Val.(int64); count > 0 {
+			return count
+		}
+	}
+	return defaultNodeCount
+}
+
+// maxPeers returns the bound on the number of connected gossip peers,
+// in each direction, for the cluster's size: the base-2 logarithm of
+// the count of nodes, within [minPeers, MaxPeers]. The bound keeps
+// the overhead of gossip sublinear in the size of the cluster.
+func (is *infoStore) maxPeers() int {
+	peers := int(math.Ceil(math.Log2(float64(is.nodeCount()))))
+	if peers < minPeers {
+		return minPeers
+	}
+	if peers > MaxPeers {
+		return MaxPeers
+	}
+	return peers
+}
+
 // leastUseful determines which node from amongst the node addresses
 // listed in addrs is currently contributing the least. Returns nil
 // if addrs is empty.
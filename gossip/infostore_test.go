@@ -434,6 +434,65 @@ func TestInfoStoreDistant(t *testing.T) {
 	}
 }
 
+// TestInfoStoreBestSource verifies the source of the most distant
+// infos is selected, with ties broken at random.
+func TestInfoStoreBestSource(t *testing.T) {
+	addrs := []testAddr{
+		"<addr1>",
+		"<addr2>",
+		"<addr3>",
+	}
+	is := newInfoStore(emptyAddr)
+	set := newAddrSet(3)
+	if is.bestSource(set, 0) != nil {
+		t.Error("not expecting an address from an empty set")
+	}
+	// addrs[0] and addrs[1] originate two distant infos each and
+	// addrs[2] one.
+	for i, src := range []int{0, 0, 1, 1, 2} {
+		inf := is.newInfo(fmt.Sprintf("b.%d", i), float64(i), time.Second)
+		inf.Hops = 3
+		inf.NodeAddr = addrs[src]
+		is.addInfo(inf)
+	}
+	for _, addr := range addrs {
+		set.addAddr(addr)
+	}
+	chosen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		chosen[is.bestSource(set, 2).String()] = true
+	}
+	if len(chosen) != 2 || !chosen[string(addrs[0])] || !chosen[string(addrs[1])] {
+		t.Errorf("expected random choice of %s and %s; got %v", addrs[0], addrs[1], chosen)
+	}
+}
+
+// TestInfoStoreMaxPeers verifies the bound on peers grows
+// logarithmically with the count of nodes, within limits.
+func TestInfoStoreMaxPeers(t *testing.T) {
+	is := newInfoStore(emptyAddr)
+	if peers := is.maxPeers(); peers != MaxPeers {
+		t.Errorf("expected %d peers with unknown node count; got %d", MaxPeers, peers)
+	}
+	testCases := []struct {
+		nodes int64
+		peers int
+	}{
+		{1, minPeers},
+		{3, minPeers},
+		{10, 4},
+		{100, 7},
+		{1000, MaxPeers},
+		{100000, MaxPeers},
+	}
+	for _, test := range testCases {
+		is.addInfo(is.newInfo(KeyNodeCount, test.nodes, time.Hour))
+		if peers := is.maxPeers(); peers != test.peers {
+			t.Errorf("%d nodes: expected %d peers; got %d", test.nodes, test.peers, peers)
+		}
+	}
+}
+
 // TestLeastUseful verifies that the least-contributing peer address
 // can be determined.
 func TestLeastUseful(t *testing.T) {
@@ -479,3 +538,89 @@ func TestLeastUseful(t *testing.T) {
 		t.Error("expecting addrs[1] as least useful")
 	}
 }
+
+// TestInfoStoreTombstones verifies a tombstone removes the info of its
+// key, group or not, refuses older infos, is gossiped via deltas and
+// is superseded by a newer info.
+func TestInfoStoreTombstones(t *testing.T) {
+	is1 := newInfoStore(emptyAddr)
+	if err := is1.registerGroup(newGroup("a", 10, MinGroup)); err != nil {
+		t.Fatal(err)
+	}
+	stale := is1.newInfo("b", float64(1), time.Hour)
+	for _, i := range []*info{is1.newInfo("a.a", float64(1), time.Hour), stale} {
+		if err := is1.addInfo(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	is2 := newInfoStore(testAddr("peer"))
+	is2.combine(is1.delta(testAddr("peer"), 0))
+	if is2.getInfo("a.a") == nil || is2.getInfo("b") == nil {
+		t.Fatal("expected infos to be combined")
+	}
+
+	for _, key := range []string{"a.a", "b"} {
+		deleted := is1.getInfo(key)
+		tombstone := is1.newTombstone(key)
+		if err := is1.addInfo(tombstone); err != nil {
+			t.Fatal(err)
+		}
+		if is1.getInfo(key) != nil {
+			t.Errorf("expected info %q to be deleted", key)
+		}
+		if tombstone.TTLStamp != deleted.TTLStamp {
+			t.Errorf("expected tombstone %q to live as long as the info it deletes", key)
+		}
+	}
+	if len(is1.getGroupInfos("a")) != 0 {
+		t.Error("expected group info to be deleted")
+	}
+	staleCopy := *stale
+	if err := is1.addInfo(&staleCopy); err == nil {
+		t.Error("expected info older than tombstone to be refused")
+	}
+
+	// The tombstones are gossiped, deleting the infos of the peer.
+	if fresh := is2.combine(is1.delta(testAddr("peer"), 0)); fresh != 2 {
+		t.Errorf("expected 2 fresh tombstones; got %d", fresh)
+	}
+	if is2.getInfo("a.a") != nil || is2.getInfo("b") != nil || len(is2.Tombstones) != 2 {
+		t.Errorf("expected peer infos to be deleted: %s", is2)
+	}
+
+	// A newer info supersedes the tombstone.
+	if err := is1.addInfo(is1.newInfo("b", float64(2), time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if is1.getInfo("b") == nil || is1.Tombstones["b"] != nil {
+		t.Error("expected newer info to supersede tombstone")
+	}
+}
+
+// TestInfoStorePurge verifies expired infos and tombstones are purged.
+func TestInfoStorePurge(t *testing.T) {
+	defer func(ttl time.Duration) { tombstoneTTL = ttl }(tombstoneTTL)
+	tombstoneTTL = time.Millisecond
+	is := newInfoStore(emptyAddr)
+	if err := is.registerGroup(newGroup("a", 10, MinGroup)); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []*info{
+		is.newInfo("a.a", float64(1), time.Millisecond),
+		is.newInfo("a.b", float64(2), time.Hour),
+		is.newInfo("b", float64(1), time.Millisecond),
+		is.newInfo("c", float64(1), 0),
+		is.newTombstone("d"),
+	} {
+		if err := is.addInfo(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(2 * time.Millisecond)
+	if count := is.purge(); count != 3 {
+		t.Errorf("expected 3 infos purged; got %d", count)
+	}
+	if is.infoCount() != 2 || len(is.Tombstones) != 0 {
+		t.Errorf("expected unexpired infos to remain: %s", is)
+	}
+}
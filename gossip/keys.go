@@ -25,6 +25,10 @@ const (
 	// The value is a string UUID for the cluster.
 	KeyClusterID = "cluster-id"
 
+	// KeyClusterVersion is the feature version of the cluster. The
+	// value is an int.
+	KeyClusterVersion = "cluster-version"
+
 	// KeyConfigAccounting is the accounting configuration map.
 	KeyConfigAccounting = "accounting"
 
@@ -34,11 +38,21 @@ const (
 	// KeyConfigZone is the zone configuration map.
 	KeyConfigZone = "zones"
 
-	// KeyMaxAvailCapacityPrefix is the key prefix for gossiping available
-	// store capacity. The suffix is composed of:
-	// <datacenter>-<hex node ID>-<hex store ID>. The value is a
-	// storage.StoreAttributes struct.
-	KeyMaxAvailCapacityPrefix = "max-avail-capacity-"
+	// KeyConfigCompression is the compression dictionary map.
+	KeyConfigCompression = "compression"
+
+	// KeyConfigTTL is the TTL configuration map.
+	KeyConfigTTL = "ttls"
+
+	// KeyConfigFreeze is the map of frozen key spans.
+	KeyConfigFreeze = "freezes"
+
+	// KeyStorePrefix is the key prefix for gossiping store
+	// descriptors. The actual key is suffixed with a period and the
+	// hexadecimal node and store IDs, joined by a hyphen, so that the
+	// descriptors of all stores form a group. The value is a
+	// storage.StoreDescriptor struct. E.g. store.1f-2
+	KeyStorePrefix = "store"
 
 	// KeyNodeCount is the count of gossip nodes in the network.  The
 	// value is an int64 containing the count of nodes in the cluster.
@@ -46,12 +60,18 @@ const (
 	//   number of node ids being gossiped.
 	KeyNodeCount = "node-count"
 
-	// KeyNodeIDPrefix is the key prefix for gossiping node id
-	// addresses. The actual key is suffixed with the hexadecimal
-	// representation of the node id and the value is the host:port
-	// string address of the node. E.g. node-1bfa: fwd56.sjcb1:24001
+	// KeyNodeIDPrefix is the key prefix for gossiping node
+	// descriptors. The actual key is suffixed with the hexadecimal
+	// representation of the node id and the value is a NodeDescriptor
+	// struct, holding the address of the node. E.g. node-1bfa
 	KeyNodeIDPrefix = "node-"
 
+	// KeyNodeLivenessPrefix is the key prefix for gossiping the
+	// liveness records of nodes. The actual key is suffixed with the
+	// hexadecimal representation of the node id and the value is a
+	// storage.NodeLiveness struct. E.g. liveness-1bfa
+	KeyNodeLivenessPrefix = "liveness-"
+
 	// KeySentinel is a key for gossip which must not expire or else the
 	// node considers itself partitioned and will retry with bootstrap hosts.
 	KeySentinel = KeyClusterID
@@ -67,3 +87,16 @@ const (
 func MakeNodeIDGossipKey(nodeID int32) string {
 	return KeyNodeIDPrefix + strconv.FormatInt(int64(nodeID), 16)
 }
+
+// MakeNodeLivenessKey returns the gossip key for the liveness record
+// of the node with ID nodeID.
+func MakeNodeLivenessKey(nodeID int32) string {
+	return KeyNodeLivenessPrefix + strconv.FormatInt(int64(nodeID), 16)
+}
+
+// MakeStoreKey returns the gossip key for the descriptor of the store
+// with ID storeID on node nodeID; store IDs are unique per node.
+func MakeStoreKey(nodeID, storeID int32) string {
+	return KeyStorePrefix + "." + strconv.FormatInt(int64(nodeID), 16) + "-" +
+		strconv.FormatInt(int64(storeID), 16)
+}
@@ -0,0 +1,171 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package gossip
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// membershipEventBuffer is the capacity of each subscription's
+// channel of membership events.
+const membershipEventBuffer = 64
+
+// A NodeDescriptor describes a node of the cluster: its address and
+// its place in the physical topology. Each node gossips its own
+// descriptor, keyed by MakeNodeIDGossipKey, at a regular interval;
+// the descriptor of a node which stops gossiping expires.
+type NodeDescriptor struct {
+	NodeID     int32
+	Address    net.Addr
+	Datacenter string
+	PDU        string
+	Rack       string
+}
+
+// A Member is a node of the cluster, as known to this node via
+// gossip.
+type Member struct {
+	NodeDescriptor
+	LastHeard time.Time // Wall time at which the node last gossiped its descriptor
+}
+
+// MembershipEventType distinguishes nodes joining and leaving.
+type MembershipEventType int
+
+const (
+	// NodeJoined indicates a node's descriptor was learned of.
+	NodeJoined MembershipEventType = iota
+	// NodeLeft indicates a node's descriptor expired or was deleted.
+	NodeLeft
+)
+
+// A MembershipEvent reports a node joining or leaving the cluster,
+// as seen by this node.
+type MembershipEvent struct {
+	Type   MembershipEventType
+	Member Member
+}
+
+// membership tracks the members of the cluster, as described by the
+// node descriptors of an infostore, notifying subscribers of changes.
+// membership is not thread safe.
+type membership struct {
+	members map[int32]Member
+	subs    map[chan MembershipEvent]struct{}
+}
+
+// newMembership allocates and returns an empty membership.
+func newMembership() *membership {
+	return &membership{
+		members: map[int32]Member{},
+		subs:    map[chan MembershipEvent]struct{}{},
+	}
+}
+
+// update refreshes the members from the node descriptors of is,
+// notifying subscribers of nodes which joined or left since the last
+// update.
+func (m *membership) update(is *infoStore) {
+	current := map[int32]Member{}
+	now := time.Now().UnixNano()
+	for key, i := range is.Infos {
+		desc, ok := i.Val.(NodeDescriptor)
+		if !ok || !strings.HasPrefix(key, KeyNodeIDPrefix) || i.expired(now) {
+			continue
+		}
+		current[desc.NodeID] = Member{NodeDescriptor: desc, LastHeard: time.Unix(0, i.Timestamp)}
+	}
+	for nodeID, member := range m.members {
+		if _, ok := current[nodeID]; !ok {
+			m.notify(MembershipEvent{Type: NodeLeft, Member: member})
+		}
+	}
+	for nodeID, member := range current {
+		if _, ok := m.members[nodeID]; !ok {
+			m.notify(MembershipEvent{Type: NodeJoined, Member: member})
+		}
+	}
+	m.members = current
+}
+
+// notify sends event to each subscriber. Events are dropped for
+// subscribers whose channels are full.
+func (m *membership) notify(event MembershipEvent) {
+	for ch := range m.subs {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// list returns the members, sorted by node ID.
+func (m *membership) list() []Member {
+	members := make([]Member, 0, len(m.members))
+	for _, member := range m.members {
+		members = append(members, member)
+	}
+	sort.Sort(membersByNodeID(members))
+	return members
+}
+
+// membersByNodeID implements sort.Interface for members, ordering
+// by node ID.
+type membersByNodeID []Member
+
+func (m membersByNodeID) Len() int           { return len(m) }
+func (m membersByNodeID) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m membersByNodeID) Less(i, j int) bool { return m[i].NodeID < m[j].NodeID }
+
+// Nodes returns the nodes of the cluster known to this node, sorted
+// by node ID: those whose descriptors have been gossiped and haven't
+// expired or been deleted.
+func (g *Gossip) Nodes() []Member {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.members.update(g.is)
+	return g.members.list()
+}
+
+// SubscribeMembership returns a channel of events reporting nodes
+// joining and leaving the cluster, and a function which cancels the
+// subscription, closing the channel. Nodes known at the time of
+// subscription are reported as having joined. A subscriber which
+// falls behind misses events, and should resynchronize via Nodes.
+func (g *Gossip) SubscribeMembership() (<-chan MembershipEvent, func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.members.update(g.is)
+	ch := make(chan MembershipEvent, membershipEventBuffer)
+	for _, member := range g.members.list() {
+		select {
+		case ch <- MembershipEvent{Type: NodeJoined, Member: member}:
+		default:
+		}
+	}
+	g.members.subs[ch] = struct{}{}
+	return ch, func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if _, ok := g.members.subs[ch]; ok {
+			delete(g.members.subs, ch)
+			close(ch)
+		}
+	}
+}
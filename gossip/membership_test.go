@@ -0,0 +1,85 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package gossip
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// expectEvent verifies the next event of ch is of type typ for the
+// node with ID nodeID.
+func expectEvent(t *testing.T, ch <-chan MembershipEvent, typ MembershipEventType, nodeID int32) {
+	select {
+	case event := <-ch:
+		if event.Type != typ || event.Member.NodeID != nodeID {
+			t.Errorf("expected event %d for node %d; got %+v", typ, nodeID, event)
+		}
+	default:
+		t.Errorf("expected event %d for node %d", typ, nodeID)
+	}
+}
+
+// TestMembership verifies the nodes whose descriptors are gossiped
+// are listed and that subscribers learn of nodes joining and leaving,
+// by deletion or expiration.
+func TestMembership(t *testing.T) {
+	g := New()
+	addNode := func(nodeID int32, ttl time.Duration) {
+		desc := NodeDescriptor{NodeID: nodeID, Address: util.CreateTestAddr("tcp"), Datacenter: "dc1"}
+		if err := g.AddInfo(MakeNodeIDGossipKey(nodeID), desc, ttl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addNode(2, time.Hour)
+	addNode(1, time.Hour)
+	// The node count shares the prefix of node descriptors.
+	if err := g.AddInfo(KeyNodeCount, int64(2), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	nodes := g.Nodes()
+	if len(nodes) != 2 || nodes[0].NodeID != 1 || nodes[1].NodeID != 2 {
+		t.Fatalf("expected nodes 1 and 2; got %+v", nodes)
+	}
+	if nodes[0].Datacenter != "dc1" || time.Since(nodes[0].LastHeard) > time.Minute {
+		t.Errorf("expected descriptor and recent last-heard time; got %+v", nodes[0])
+	}
+
+	events, cancel := g.SubscribeMembership()
+	expectEvent(t, events, NodeJoined, 1)
+	expectEvent(t, events, NodeJoined, 2)
+	addNode(3, time.Millisecond)
+	expectEvent(t, events, NodeJoined, 3)
+	// Regossiping a known node's descriptor isn't an event.
+	addNode(1, time.Hour)
+	if err := g.DeleteInfo(MakeNodeIDGossipKey(2)); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, events, NodeLeft, 2)
+	time.Sleep(2 * time.Millisecond)
+	if nodes := g.Nodes(); len(nodes) != 1 || nodes[0].NodeID != 1 {
+		t.Errorf("expected only node 1; got %+v", nodes)
+	}
+	expectEvent(t, events, NodeLeft, 3)
+
+	cancel()
+	if _, ok := <-events; ok {
+		t.Error("expected channel to be closed on cancellation")
+	}
+	cancel()
+}
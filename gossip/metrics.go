@@ -0,0 +1,121 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package gossip
+
+import (
+	"encoding/gob"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics reports the activity of a gossip node and the state of its
+// infostore, for diagnosing slow convergence of the gossip network.
+type Metrics struct {
+	InfosSent      int64 // Infos, including tombstones, sent to peers
+	InfosReceived  int64 // Infos, including tombstones, received from peers
+	InfosFresh     int64 // Infos received which were new to this node
+	BytesSent      int64 // Encoded size of the deltas sent to peers
+	BytesReceived  int64 // Encoded size of the deltas received from peers
+	ClientsStarted int64 // Outgoing clients started
+	Outgoing       int   // Connected outgoing clients
+	Incoming       int   // Connected incoming clients
+	MaxPeers       int   // Bound on peers, in each direction, for the cluster's size
+	// Hops counts the infos of the infostore by the number of gossip
+	// exchanges separating them from their source.
+	Hops map[uint32]int
+	// Staleness is the time since each info of the infostore, by key,
+	// was created at its source.
+	Staleness map[string]time.Duration
+}
+
+// counters accumulates the activity reported by Metrics. Counters are
+// updated atomically.
+type counters struct {
+	infosSent, infosReceived, infosFresh int64
+	bytesSent, bytesReceived             int64
+	clientsStarted                       int64
+}
+
+// countingWriter counts the bytes written to it, discarding them.
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// deltaSize returns the count of infos, including tombstones, and the
+// encoded size of delta, which may be nil.
+func deltaSize(delta *infoStore) (int64, int64) {
+	if delta == nil {
+		return 0, 0
+	}
+	var infos int64
+	delta.visitInfos(nil, func(i *info) error {
+		infos++
+		return nil
+	})
+	var w countingWriter
+	if err := gob.NewEncoder(&w).Encode(delta); err != nil {
+		return infos, 0
+	}
+	return infos, int64(w)
+}
+
+// recordSent counts the infos and bytes of delta, sent to a peer.
+func (c *counters) recordSent(delta *infoStore) {
+	infos, bytes := deltaSize(delta)
+	atomic.AddInt64(&c.infosSent, infos)
+	atomic.AddInt64(&c.bytesSent, bytes)
+}
+
+// recordReceived counts the infos and bytes of delta, received from a
+// peer, of which fresh infos were new.
+func (c *counters) recordReceived(delta *infoStore, fresh int) {
+	infos, bytes := deltaSize(delta)
+	atomic.AddInt64(&c.infosReceived, infos)
+	atomic.AddInt64(&c.bytesReceived, bytes)
+	atomic.AddInt64(&c.infosFresh, int64(fresh))
+}
+
+// Metrics returns the metrics of the gossip node.
+func (g *Gossip) Metrics() Metrics {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	m := Metrics{
+		InfosSent:      atomic.LoadInt64(&g.counters.infosSent),
+		InfosReceived:  atomic.LoadInt64(&g.counters.infosReceived),
+		InfosFresh:     atomic.LoadInt64(&g.counters.infosFresh),
+		BytesSent:      atomic.LoadInt64(&g.counters.bytesSent),
+		BytesReceived:  atomic.LoadInt64(&g.counters.bytesReceived),
+		ClientsStarted: atomic.LoadInt64(&g.counters.clientsStarted),
+		Outgoing:       g.outgoing.len(),
+		Incoming:       g.incoming.len(),
+		MaxPeers:       g.is.maxPeers(),
+		Hops:           map[uint32]int{},
+		Staleness:      map[string]time.Duration{},
+	}
+	now := time.Now().UnixNano()
+	g.is.visitInfos(nil, func(i *info) error {
+		if i.Deleted || i.expired(now) {
+			return nil
+		}
+		m.Hops[i.Hops]++
+		m.Staleness[i.Key] = time.Duration(now - i.Timestamp)
+		return nil
+	})
+	return m
+}
@@ -0,0 +1,63 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package gossip
+
+import (
+	"testing"
+	"time"
+)
+
+// TestMetrics verifies the infos and bytes exchanged by a client and
+// server are counted on each side, and that the hops and staleness of
+// infos are reported.
+func TestMetrics(t *testing.T) {
+	local, remote, lserver, rserver := startGossip(t)
+	defer lserver.Close()
+	defer rserver.Close()
+	defer local.stop()
+	defer remote.stop()
+	local.AddInfo("local-key", "local value", time.Hour)
+	remote.AddInfo("remote-key", "remote value", time.Hour)
+
+	c := newClient(remote.is.NodeAddr)
+	done := make(chan *client, 1)
+	go c.start(local, done)
+	defer func() {
+		c.close()
+		<-done
+	}()
+	waitFor(func() bool {
+		_, lerr := local.GetInfo("remote-key")
+		_, rerr := remote.GetInfo("local-key")
+		return lerr == nil && rerr == nil
+	}, "exchange of infos", t)
+
+	lm, rm := local.Metrics(), remote.Metrics()
+	for _, m := range []Metrics{lm, rm} {
+		if m.InfosSent < 1 || m.InfosReceived < 1 || m.InfosFresh != 1 || m.BytesSent == 0 || m.BytesReceived == 0 {
+			t.Errorf("expected infos and bytes counted each way; got %+v", m)
+		}
+		if m.Hops[0] != 1 || m.Hops[1] != 1 {
+			t.Errorf("expected one local and one gossiped info; got hops %v", m.Hops)
+		}
+	}
+	if s, ok := lm.Staleness["remote-key"]; !ok || s <= 0 || s > time.Second {
+		t.Errorf("expected staleness of gossiped info; got %v", lm.Staleness)
+	}
+	if rm.Incoming != 1 {
+		t.Errorf("expected one incoming client at remote; got %d", rm.Incoming)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package gossip
+
+import (
+	"encoding/gob"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// init registers the types of the node count and of node
+// descriptors. Packages gossiping other infos register their types
+// likewise.
+func init() {
+	RegisterInfoType(KeyNodeCount, int64(0))
+	RegisterInfoType(KeyNodeIDPrefix+"*", NodeDescriptor{})
+}
+
+// infoTypes maps key patterns to the types of their infos' values.
+var infoTypes = struct {
+	sync.RWMutex
+	exact    map[string]reflect.Type
+	prefixes map[string]reflect.Type
+}{
+	exact:    map[string]reflect.Type{},
+	prefixes: map[string]reflect.Type{},
+}
+
+// RegisterInfoType registers the type of prototype as the type of the
+// values of infos whose keys match pattern. A pattern ending in "*"
+// matches keys beginning with the preceding prefix; other patterns
+// match a single key. A nil pointer to an interface registers the
+// interface, to be implemented by values. Concrete types are also
+// registered with gob, the wire format of gossip, under their
+// package-qualified names.
+//
+// Infos of registered keys must carry values of the registered type:
+// others are refused when added locally and discarded on arrival from
+// peers, so that typed accessors such as GetInfoAs never fail on a
+// value of an unexpected type.
+func RegisterInfoType(pattern string, prototype interface{}) {
+	t := reflect.TypeOf(prototype)
+	if t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Interface {
+		t = t.Elem()
+	} else {
+		gob.Register(prototype)
+	}
+	infoTypes.Lock()
+	defer infoTypes.Unlock()
+	if strings.HasSuffix(pattern, "*") {
+		infoTypes.prefixes[strings.TrimSuffix(pattern, "*")] = t
+	} else {
+		infoTypes.exact[pattern] = t
+	}
+}
+
+// infoType returns the registered type of the values of key, or nil
+// if none is registered. An exact match takes precedence over the
+// longest matching prefix.
+func infoType(key string) reflect.Type {
+	infoTypes.RLock()
+	defer infoTypes.RUnlock()
+	if t, ok := infoTypes.exact[key]; ok {
+		return t
+	}
+	var match string
+	var t reflect.Type
+	for prefix, pt := range infoTypes.prefixes {
+		if strings.HasPrefix(key, prefix) && len(prefix) >= len(match) {
+			match, t = prefix, pt
+		}
+	}
+	return t
+}
+
+// checkInfoType returns an error if val isn't of the type registered
+// for key. Tombstones, which carry no value, always pass.
+func checkInfoType(key string, val interface{}) error {
+	t := infoType(key)
+	if t == nil || val == nil {
+		return nil
+	}
+	if vt := reflect.TypeOf(val); !vt.AssignableTo(t) {
+		return util.Errorf("info %q has value of type %s; expected %s", key, vt, t)
+	}
+	return nil
+}
+
+// GetInfoAs sets the value pointed to by ptr to the value of the info
+// of key, returning an error if the key doesn't exist or has expired,
+// or if its value isn't assignable to the value pointed to.
+func (g *Gossip) GetInfoAs(key string, ptr interface{}) error {
+	pv := reflect.ValueOf(ptr)
+	if pv.Kind() != reflect.Ptr || pv.IsNil() {
+		return util.Errorf("expected non-nil pointer to receive info %q; got %T", key, ptr)
+	}
+	val, err := g.GetInfo(key)
+	if err != nil {
+		return err
+	}
+	v := reflect.ValueOf(val)
+	if !v.IsValid() || !v.Type().AssignableTo(pv.Elem().Type()) {
+		return util.Errorf("info %q has value of type %T; expected %s", key, val, pv.Elem().Type())
+	}
+	pv.Elem().Set(v)
+	return nil
+}
+
+// GetNodeAddr returns the address of the node with ID nodeID, per
+// its gossiped descriptor.
+func (g *Gossip) GetNodeAddr(nodeID int32) (net.Addr, error) {
+	var desc NodeDescriptor
+	if err := g.GetInfoAs(MakeNodeIDGossipKey(nodeID), &desc); err != nil {
+		return nil, err
+	}
+	return desc.Address, nil
+}
+
+// GetNodeDescriptor returns the gossiped descriptor of the node with
+// ID nodeID, including its declared locality.
+func (g *Gossip) GetNodeDescriptor(nodeID int32) (NodeDescriptor, error) {
+	var desc NodeDescriptor
+	err := g.GetInfoAs(MakeNodeIDGossipKey(nodeID), &desc)
+	return desc, err
+}
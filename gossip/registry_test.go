@@ -0,0 +1,95 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package gossip
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// testLocation is a struct type registered for test infos.
+type testLocation struct {
+	Host string
+	Port int
+}
+
+func init() {
+	RegisterInfoType("test-location", testLocation{})
+	RegisterInfoType("test-count-*", int64(0))
+}
+
+// TestInfoTypes verifies infos of registered keys are refused unless
+// their values are of the registered type, locally or from peers,
+// and that typed accessors return their values.
+func TestInfoTypes(t *testing.T) {
+	g := New()
+	if err := g.AddInfo("test-location", "host:1", time.Hour); err == nil {
+		t.Error("expected info of unregistered type to be refused")
+	}
+	if err := g.AddInfo("test-count-a", 1, time.Hour); err == nil {
+		t.Error("expected info of key matching pattern to be refused with unregistered type")
+	}
+	if err := g.AddInfo("test-location", testLocation{"host", 1}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	var loc testLocation
+	if err := g.GetInfoAs("test-location", &loc); err != nil || loc.Host != "host" {
+		t.Errorf("expected typed info; got %+v, %v", loc, err)
+	}
+	var count int64
+	if err := g.GetInfoAs("test-location", &count); err == nil {
+		t.Error("expected error getting info as the wrong type")
+	}
+	if err := g.GetInfoAs("test-location", loc); err == nil {
+		t.Error("expected error getting info into a non-pointer")
+	}
+
+	addr := util.CreateTestAddr("tcp")
+	if err := g.AddInfo(MakeNodeIDGossipKey(1), NodeDescriptor{NodeID: 1, Address: addr}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.AddInfo(MakeNodeIDGossipKey(2), addr, time.Hour); err == nil {
+		t.Error("expected node address without descriptor to be refused")
+	}
+	if a, err := g.GetNodeAddr(1); err != nil || a.String() != addr.String() {
+		t.Errorf("expected node address %s; got %v, %v", addr, a, err)
+	}
+	if _, err := g.GetNodeAddr(2); err == nil {
+		t.Error("expected error getting address of unknown node")
+	}
+
+	// Infos of the wrong type arriving from a peer are discarded.
+	peer := newInfoStore(testAddr("peer"))
+	for _, i := range []*info{
+		peer.newInfo("test-count-a", "one", time.Hour),
+		peer.newInfo("test-count-b", int64(2), time.Hour),
+	} {
+		if err := peer.addInfo(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fresh := g.is.combine(peer.delta(testAddr("local"), 0)); fresh != 1 {
+		t.Errorf("expected 1 fresh info; got %d", fresh)
+	}
+	if err := g.GetInfoAs("test-count-b", &count); err != nil || count != 2 {
+		t.Errorf("expected count 2; got %d, %v", count, err)
+	}
+	if _, err := g.GetInfo("test-count-a"); err == nil {
+		t.Error("expected info of the wrong type to be discarded")
+	}
+}
@@ -37,6 +37,8 @@ type server struct {
 	mu            sync.Mutex          // Mutex protects is (infostore) & incoming
 	ready         *sync.Cond          // Broadcasts wakeup to waiting gossip requests
 	is            *infoStore          // The backing infostore
+	members       *membership         // Members of the cluster, per the infostore
+	counters      counters            // Counts of gossip activity; see Metrics
 	closed        bool                // True if server was closed
 	incoming      *addrSet            // Incoming client addresses
 	clientAddrMap map[string]net.Addr // Incoming client's local address -> client's server address
@@ -46,6 +48,7 @@ type server struct {
 func newServer(interval time.Duration) *server {
 	s := &server{
 		is:            newInfoStore(nil),
+		members:       newMembership(),
 		interval:      interval,
 		incoming:      newAddrSet(MaxPeers),
 		clientAddrMap: make(map[string]net.Addr),
@@ -63,8 +66,13 @@ func (s *server) Gossip(args *GossipRequest, reply *GossipResponse) error {
 
 	// If there is no more capacity to accept incoming clients, return
 	// a random already-being-serviced incoming client as an alternate.
+	// Incoming clients are bounded at twice the bound on outgoing
+	// peers for the cluster's size, leaving slack for the many nodes
+	// which bootstrap via the same few hosts. Clients already being
+	// serviced aren't forwarded should the bound shrink; each node
+	// culls its own outgoing clients instead.
 	if !s.incoming.hasAddr(args.Addr) {
-		if !s.incoming.hasSpace() {
+		if !s.incoming.hasSpace() || s.incoming.len() >= 2*s.is.maxPeers() {
 			reply.Alternate = s.incoming.selectRandom()
 			return nil
 		}
@@ -78,7 +86,9 @@ func (s *server) Gossip(args *GossipRequest, reply *GossipResponse) error {
 	// Update infostore with gossipped infos.
 	if args.Delta != nil {
 		glog.V(1).Infof("received delta infostore from client %s: %s", args.Addr, args.Delta)
-		s.is.combine(args.Delta)
+		fresh := s.is.combine(args.Delta)
+		s.counters.recordReceived(args.Delta, fresh)
+		s.members.update(s.is)
 	}
 	// If requested max sequence is not -1, wait for gossip interval to expire.
 	if args.MaxSeq != -1 {
@@ -100,6 +110,7 @@ func (s *server) Gossip(args *GossipRequest, reply *GossipResponse) error {
 			}
 		}
 		reply.Delta = delta
+		s.counters.recordSent(delta)
 		glog.Infof("gossip: client %s sent %d info(s)", args.Addr, delta.infoCount())
 	}
 	return nil
@@ -0,0 +1,302 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+/*
+Package simulation runs networks of gossip nodes within a single
+process, under simulated network conditions, so that changes to the
+gossip protocol can be validated without real clusters.
+
+Each node serves gossip via its own RPC server, listening on a unix
+domain or tcp socket. Nodes may be subjected to latency, partitioned
+from one another, and replaced by new nodes to simulate churn. Every
+cycle, each node gossips an info keyed by its address; the network
+has converged once every node has the infos of every other node.
+
+	n := simulation.NewNetwork(simulation.Options{Nodes: 10})
+	defer n.Stop()
+	cycles, ok := n.RunUntilConverged(20)
+*/
+package simulation
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/rpc"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/golang/glog"
+)
+
+// Options configures a simulated network.
+type Options struct {
+	Nodes          int           // Count of nodes
+	Network        string        // "unix" or "tcp"; defaults to "unix"
+	GossipInterval time.Duration // Compressed gossip interval; defaults to 10ms
+	// SentinelTTL is the time-to-live of the sentinel info, gossiped
+	// by the first node every cycle. Nodes which lose the sentinel,
+	// as when partitioned from the first node, rebootstrap. Defaults
+	// to five gossip intervals.
+	SentinelTTL time.Duration
+	// Latency is imposed on every gossip exchange.
+	Latency time.Duration
+	// Bootstraps is the count of nodes each new node bootstraps from,
+	// chosen from the live nodes; defaults to three.
+	Bootstraps int
+}
+
+// A Node is a gossip node of a simulated network.
+type Node struct {
+	*gossip.Gossip
+	Addr   net.Addr
+	server *rpc.Server
+}
+
+// A Network is a simulated network of gossip nodes.
+type Network struct {
+	opts Options
+
+	mu        sync.Mutex       // Protects the fields below
+	nodes     []*Node          // Live nodes, the first of which gossips the sentinel
+	partition map[string]int   // Partition of each node, by address; nil if none
+	cycle     int              // Cycles run
+	stopped   map[string]*Node // Nodes removed by churn, by address
+}
+
+// NewNetwork starts a simulated network of opts.Nodes nodes.
+func NewNetwork(opts Options) *Network {
+	if opts.Network == "" {
+		opts.Network = "unix"
+	}
+	if opts.GossipInterval == 0 {
+		opts.GossipInterval = 10 * time.Millisecond
+	}
+	if opts.SentinelTTL == 0 {
+		opts.SentinelTTL = 5 * opts.GossipInterval
+	}
+	if opts.Bootstraps == 0 {
+		opts.Bootstraps = 3
+	}
+	n := &Network{opts: opts, stopped: map[string]*Node{}}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	servers := make([]*rpc.Server, opts.Nodes)
+	var addrs []net.Addr
+	for i := range servers {
+		servers[i] = n.newServer()
+		addrs = append(addrs, servers[i].Addr())
+	}
+	bootstraps := addrs
+	if len(bootstraps) > opts.Bootstraps {
+		bootstraps = bootstraps[:opts.Bootstraps]
+	}
+	for i, server := range servers {
+		node := n.startNode(server, bootstraps)
+		if i == 0 {
+			node.AddInfo(gossip.KeyNodeCount, int64(opts.Nodes), time.Hour)
+		}
+	}
+	return n
+}
+
+// newServer starts an RPC server on a new address.
+func (n *Network) newServer() *rpc.Server {
+	server := rpc.NewServer(util.CreateTestAddr(n.opts.Network))
+	if err := server.Start(); err != nil {
+		glog.Fatal(err)
+	}
+	return server
+}
+
+// startNode starts a gossip node served by server, bootstrapping from
+// bootstraps, and adds it to the live nodes.
+func (n *Network) startNode(server *rpc.Server, bootstraps []net.Addr) *Node {
+	node := &Node{Gossip: gossip.New(), Addr: server.Addr(), server: server}
+	node.SetBootstrap(bootstraps)
+	node.SetInterval(n.opts.GossipInterval)
+	node.SetLinkFilter(n.linkFilter(node.Addr))
+	node.Start(server)
+	n.nodes = append(n.nodes, node)
+	return node
+}
+
+// linkFilter returns the link filter of the node at addr, imposing
+// the network's latency and partition.
+func (n *Network) linkFilter(addr net.Addr) gossip.LinkFilter {
+	return func(peer net.Addr) (time.Duration, bool) {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if _, ok := n.stopped[peer.String()]; ok {
+			return 0, false
+		}
+		if n.partition != nil && n.partition[addr.String()] != n.partition[peer.String()] {
+			return 0, false
+		}
+		return n.opts.Latency, true
+	}
+}
+
+// Nodes returns the live nodes.
+func (n *Network) Nodes() []*Node {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]*Node(nil), n.nodes...)
+}
+
+// Partition partitions the network into groups of the live nodes,
+// specified by their indexes in Nodes. Nodes in different groups
+// can't gossip with each other; nodes in no group are isolated. A new
+// partition replaces any previous one.
+func (n *Network) Partition(groups ...[]int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.partition = map[string]int{}
+	for i, node := range n.nodes {
+		n.partition[node.Addr.String()] = -1 - i
+	}
+	for g, group := range groups {
+		for _, i := range group {
+			n.partition[n.nodes[i].Addr.String()] = g
+		}
+	}
+}
+
+// Heal removes the partition, if any.
+func (n *Network) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.partition = nil
+}
+
+// Churn stops count randomly selected live nodes, other than the
+// first, which gossips the sentinel, and starts as many new nodes,
+// each bootstrapping from randomly selected surviving nodes. New
+// nodes share the partition of the first node.
+func (n *Network) Churn(count int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for i := 0; i < count && len(n.nodes) > 1; i++ {
+		j := 1 + rand.Intn(len(n.nodes)-1)
+		node := n.nodes[j]
+		n.nodes = append(n.nodes[:j], n.nodes[j+1:]...)
+		n.stopped[node.Addr.String()] = node
+		node.server.Close()
+		node.Stop()
+	}
+	for i := 0; i < count; i++ {
+		var bootstraps []net.Addr
+		for _, j := range rand.Perm(len(n.nodes)) {
+			if len(bootstraps) == n.opts.Bootstraps {
+				break
+			}
+			bootstraps = append(bootstraps, n.nodes[j].Addr)
+		}
+		node := n.startNode(n.newServer(), bootstraps)
+		if n.partition != nil {
+			n.partition[node.Addr.String()] = n.partition[n.nodes[0].Addr.String()]
+		}
+	}
+}
+
+// Cycle runs a single cycle of the simulation, waiting out a gossip
+// interval, after which the first node gossips the sentinel and every
+// node gossips its info.
+func (n *Network) Cycle() {
+	time.Sleep(n.opts.GossipInterval)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.cycle++
+	n.nodes[0].AddInfo(gossip.KeySentinel, int64(n.cycle), n.opts.SentinelTTL)
+	for _, node := range n.nodes {
+		node.AddInfo(node.Addr.String(), int64(n.cycle), time.Hour)
+	}
+}
+
+// Converged returns whether every live node has the infos of every
+// other live node.
+func (n *Network) Converged() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.converged(n.nodes)
+}
+
+// converged returns whether each of nodes has the infos of each of
+// the others.
+func (n *Network) converged(nodes []*Node) bool {
+	for _, node := range nodes {
+		for _, other := range nodes {
+			if _, err := node.GetInfo(other.Addr.String()); err != nil {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// RunUntilConverged runs cycles until the network converges, returning
+// the count of cycles run, or false if the network doesn't converge
+// within maxCycles cycles.
+func (n *Network) RunUntilConverged(maxCycles int) (int, bool) {
+	for cycle := 1; cycle <= maxCycles; cycle++ {
+		n.Cycle()
+		if n.Converged() {
+			return cycle, true
+		}
+	}
+	return maxCycles, false
+}
+
+// FanOut summarizes the gossip connections of the live nodes.
+type FanOut struct {
+	MaxOutgoing int     // Most outgoing connections of any node
+	MaxIncoming int     // Most incoming connections of any node
+	MeanPeers   float64 // Mean count of connections per node
+}
+
+// FanOut returns a summary of the gossip connections of the live
+// nodes.
+func (n *Network) FanOut() FanOut {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var f FanOut
+	var peers int
+	for _, node := range n.nodes {
+		out, in := len(node.Outgoing()), len(node.Incoming())
+		if out > f.MaxOutgoing {
+			f.MaxOutgoing = out
+		}
+		if in > f.MaxIncoming {
+			f.MaxIncoming = in
+		}
+		peers += out + in
+	}
+	if len(n.nodes) > 0 {
+		f.MeanPeers = float64(peers) / float64(len(n.nodes))
+	}
+	return f
+}
+
+// Stop stops every live node.
+func (n *Network) Stop() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, node := range n.nodes {
+		node.server.Close()
+		node.Stop()
+	}
+	n.nodes = nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package simulation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+)
+
+// maxCycles bounds the cycles the tests allow for convergence.
+const maxCycles = 100
+
+// TestConvergence verifies a network converges, with and without
+// latency, and that no node exceeds the gossip fan-out.
+func TestConvergence(t *testing.T) {
+	for _, latency := range []time.Duration{0, 5 * time.Millisecond} {
+		n := NewNetwork(Options{Nodes: 10, Latency: latency})
+		cycles, ok := n.RunUntilConverged(maxCycles)
+		if !ok {
+			t.Errorf("latency %s: expected convergence within %d cycles", latency, maxCycles)
+		}
+		t.Logf("latency %s: converged in %d cycles", latency, cycles)
+		if f := n.FanOut(); f.MaxOutgoing > gossip.MaxPeers || f.MaxIncoming > gossip.MaxPeers {
+			t.Errorf("latency %s: expected fan-out of at most %d; got %+v", latency, gossip.MaxPeers, f)
+		}
+		n.Stop()
+	}
+}
+
+// TestPartition verifies infos gossiped within one side of a
+// partition don't reach the other until the partition heals.
+func TestPartition(t *testing.T) {
+	n := NewNetwork(Options{Nodes: 8})
+	defer n.Stop()
+	if _, ok := n.RunUntilConverged(maxCycles); !ok {
+		t.Fatalf("expected convergence within %d cycles", maxCycles)
+	}
+	// The first group holds the bootstrap nodes.
+	n.Partition([]int{0, 1, 2, 3}, []int{4, 5, 6, 7})
+	nodes := n.Nodes()
+	if err := nodes[0].AddInfo("probe", int64(1), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// received returns whether each of nodes[lo:hi] has the probe.
+	received := func(lo, hi int) bool {
+		for _, node := range nodes[lo:hi] {
+			if _, err := node.GetInfo("probe"); err != nil {
+				return false
+			}
+		}
+		return true
+	}
+	for cycle := 0; !received(0, 4); cycle++ {
+		if cycle == maxCycles {
+			t.Fatalf("expected probe to reach first group within %d cycles", maxCycles)
+		}
+		n.Cycle()
+	}
+	for _, node := range nodes[4:] {
+		if _, err := node.GetInfo("probe"); err == nil {
+			t.Errorf("expected probe not to cross partition to %s", node.Addr)
+		}
+	}
+	n.Heal()
+	for cycle := 0; !received(4, 8); cycle++ {
+		if cycle == maxCycles {
+			t.Fatalf("expected probe to reach second group within %d cycles of healing", maxCycles)
+		}
+		n.Cycle()
+	}
+}
+
+// TestChurn verifies the network converges as nodes are replaced.
+func TestChurn(t *testing.T) {
+	n := NewNetwork(Options{Nodes: 10})
+	defer n.Stop()
+	if _, ok := n.RunUntilConverged(maxCycles); !ok {
+		t.Fatalf("expected convergence within %d cycles", maxCycles)
+	}
+	for i := 0; i < 3; i++ {
+		n.Churn(2)
+		if len(n.Nodes()) != 10 {
+			t.Fatalf("expected 10 live nodes; got %d", len(n.Nodes()))
+		}
+		if _, ok := n.RunUntilConverged(maxCycles); !ok {
+			t.Fatalf("churn %d: expected convergence within %d cycles", i, maxCycles)
+		}
+	}
+}
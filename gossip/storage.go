@@ -0,0 +1,148 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package gossip
+
+import (
+	"net"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// maxPersistedAddrs is the maximum number of peer addresses persisted
+// as bootstrap info.
+const maxPersistedAddrs = 2 * MaxPeers
+
+// BootstrapInfo holds the addresses of gossip peers recently known to
+// a node, persisted so that the node may rejoin the gossip network via
+// them after a restart, should its configured bootstrap hosts be down.
+type BootstrapInfo struct {
+	Addresses []net.Addr // Peer addresses, most recently known first
+	Timestamp int64      // Time persisted, in nanoseconds since the epoch
+}
+
+// Storage persists bootstrap info between instantiations of a gossip
+// node, as to the node's local stores.
+type Storage interface {
+	// ReadBootstrapInfo reads the bootstrap info last written, leaving
+	// info unmodified if none has been.
+	ReadBootstrapInfo(info *BootstrapInfo) error
+	// WriteBootstrapInfo writes the bootstrap info.
+	WriteBootstrapInfo(info *BootstrapInfo) error
+}
+
+// SetStorage sets the storage of bootstrap info. The peer addresses
+// previously persisted are added to the bootstrap hosts, and the
+// addresses of peers are persisted in turn as they change.
+func (g *Gossip) SetStorage(storage Storage) error {
+	var info BootstrapInfo
+	if err := storage.ReadBootstrapInfo(&info); err != nil {
+		return err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.storage = storage
+	g.persisted = addrsKey(info.Addresses)
+	var added int
+	for _, addr := range info.Addresses {
+		if (g.is.NodeAddr != nil && addr.String() == g.is.NodeAddr.String()) || g.bootstraps.hasAddr(addr) {
+			continue
+		}
+		g.bootstraps.addAddr(addr)
+		added++
+	}
+	if added > 0 {
+		glog.Infof("added %d persisted peer address(es) to gossip bootstrap hosts", added)
+		// Wake the bootstrapper, which may be waiting on bootstrap hosts.
+		g.stalled.Signal()
+	}
+	return nil
+}
+
+// maybePersistBootstrap persists the addresses of peers if they've
+// changed since last persisted: connected peers first, followed by the
+// nodes of the cluster most recently heard from, up to
+// maxPersistedAddrs in all.
+func (g *Gossip) maybePersistBootstrap() {
+	if g.storage == nil {
+		return
+	}
+	seen := map[string]struct{}{}
+	var addrs []net.Addr
+	add := func(addr net.Addr) {
+		if addr == nil || len(addrs) == maxPersistedAddrs {
+			return
+		}
+		if _, ok := seen[addr.String()]; ok || (g.is.NodeAddr != nil && addr.String() == g.is.NodeAddr.String()) {
+			return
+		}
+		seen[addr.String()] = struct{}{}
+		addrs = append(addrs, addr)
+	}
+	for _, set := range []*addrSet{g.outgoing, g.incoming} {
+		peers := set.asSlice()
+		sort.Sort(addrsByString(peers))
+		for _, addr := range peers {
+			add(addr)
+		}
+	}
+	members := g.members.list()
+	sort.Stable(membersByLastHeard(members))
+	for _, member := range members {
+		add(member.Address)
+	}
+	key := addrsKey(addrs)
+	if len(addrs) == 0 || key == g.persisted {
+		return
+	}
+	if err := g.storage.WriteBootstrapInfo(&BootstrapInfo{Addresses: addrs, Timestamp: time.Now().UnixNano()}); err != nil {
+		glog.Warningf("unable to persist gossip bootstrap info: %v", err)
+		return
+	}
+	g.persisted = key
+}
+
+// addrsKey returns a string identifying the set of addrs, regardless
+// of their order.
+func addrsKey(addrs []net.Addr) string {
+	strs := make([]string, len(addrs))
+	for i, addr := range addrs {
+		strs[i] = addr.String()
+	}
+	sort.Strings(strs)
+	var key string
+	for _, s := range strs {
+		key += s + ","
+	}
+	return key
+}
+
+// addrsByString implements sort.Interface for addresses, ordering by
+// their string forms.
+type addrsByString []net.Addr
+
+func (a addrsByString) Len() int           { return len(a) }
+func (a addrsByString) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a addrsByString) Less(i, j int) bool { return a[i].String() < a[j].String() }
+
+// membersByLastHeard implements sort.Interface for members, ordering
+// the most recently heard from first.
+type membersByLastHeard []Member
+
+func (m membersByLastHeard) Len() int           { return len(m) }
+func (m membersByLastHeard) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m membersByLastHeard) Less(i, j int) bool { return m[i].LastHeard.After(m[j].LastHeard) }
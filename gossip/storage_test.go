@@ -0,0 +1,71 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package gossip
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testStorage holds bootstrap info in memory, counting writes.
+type testStorage struct {
+	info   BootstrapInfo
+	writes int
+}
+
+func (s *testStorage) ReadBootstrapInfo(info *BootstrapInfo) error {
+	*info = s.info
+	return nil
+}
+
+func (s *testStorage) WriteBootstrapInfo(info *BootstrapInfo) error {
+	s.info = *info
+	s.writes++
+	return nil
+}
+
+// TestGossipStorage verifies persisted peer addresses are added to
+// the bootstrap hosts, and that the addresses of connected peers and
+// cluster members are persisted when they change.
+func TestGossipStorage(t *testing.T) {
+	self, peer, member := testAddr("<self>"), testAddr("<peer>"), testAddr("<member>")
+	g := New()
+	g.is.NodeAddr = self
+	storage := &testStorage{info: BootstrapInfo{Addresses: []net.Addr{self, peer}, Timestamp: 1}}
+	if err := g.SetStorage(storage); err != nil {
+		t.Fatal(err)
+	}
+	if !g.bootstraps.hasAddr(peer) || g.bootstraps.hasAddr(self) {
+		t.Errorf("expected persisted peer, but not own address, as bootstrap host; got %v", g.bootstraps.asSlice())
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.outgoing.addAddr(peer)
+	g.is.addInfo(g.is.newInfo(MakeNodeIDGossipKey(2), NodeDescriptor{NodeID: 2, Address: member}, time.Hour))
+	g.members.update(g.is)
+	g.maybePersistBootstrap()
+	exp := []net.Addr{peer, member}
+	if storage.writes != 1 || !reflect.DeepEqual(storage.info.Addresses, exp) {
+		t.Errorf("expected addresses %v persisted once; got %v in %d writes", exp, storage.info.Addresses, storage.writes)
+	}
+	g.maybePersistBootstrap()
+	if storage.writes != 1 {
+		t.Errorf("expected unchanged addresses not to be persisted again; got %d writes", storage.writes)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/cockroachdb/cockroach/rpc"
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// verifyTimeout bounds the read with which the outcome of an
+// ambiguous write is verified.
+const verifyTimeout = 5 * time.Second
+
+// An AmbiguousResultError indicates a write failed after it was sent,
+// by timing out or losing its connection, so that it may or may not
+// have been applied. Rather than retry the write, which the caller
+// may not intend if it was applied, the client surfaces the
+// ambiguity.
+//
+// Where the write is idempotent, as are puts and deletes, the client
+// reads back the key to verify the outcome. Verified reports whether
+// it did so, and Applied whether the key was found as the write would
+// have left it. A write which isn't observed may still have been
+// applied and since overwritten; callers requiring certainty should
+// retry idempotent writes and inspect non-idempotent ones, such as
+// increments, by their own means.
+type AmbiguousResultError struct {
+	Method   string
+	Key      storage.Key
+	Cause    error // The failure of the write's RPC
+	Verified bool  // Whether the outcome was verified by reading back the key
+	Applied  bool  // If verified, whether the write's effect was observed
+}
+
+// Error implements the error interface.
+func (e *AmbiguousResultError) Error() string {
+	outcome := "unverified"
+	if e.Verified && e.Applied {
+		outcome = "verified applied"
+	} else if e.Verified {
+		outcome = "not observed by read-back"
+	}
+	return fmt.Sprintf("%s to %q may or may not have been applied (%s): %v", e.Method, e.Key, outcome, e.Cause)
+}
+
+// ambiguousResult returns an AmbiguousResultError if err indicates
+// that the mutation method, with arguments args, failed in flight.
+// Returns nil otherwise.
+func ambiguousResult(method string, args interface{}, err error) *AmbiguousResultError {
+	if se, ok := err.(rpc.SendError); !ok || !se.Ambiguous || !isMutation(method, args) {
+		return nil
+	}
+	var key storage.Key
+	if keyVal := reflect.Indirect(reflect.ValueOf(args)).FieldByName("Key"); keyVal.IsValid() {
+		key, _ = keyVal.Interface().(storage.Key)
+	}
+	return &AmbiguousResultError{Method: method, Key: key, Cause: err}
+}
+
+// verifyWrite reads back the key written by args via get, if the
+// write was a put or a delete, to verify the outcome of the ambiguous
+// write described by e. Values are compared as sent and stored, so
+// get mustn't decompress them. The outcome remains unverified if the
+// read fails or doesn't complete within verifyTimeout.
+func verifyWrite(get func(*storage.GetRequest) <-chan *storage.GetResponse, args interface{}, e *AmbiguousResultError) {
+	var expBytes []byte // The value the write leaves, nil if a deletion
+	switch t := args.(type) {
+	case *storage.PutRequest:
+		expBytes = append([]byte{}, t.Value.Bytes...)
+	case *storage.DeleteRequest:
+	default:
+		return
+	}
+	select {
+	case reply := <-get(&storage.GetRequest{Key: e.Key}):
+		if reply.Error != nil {
+			return
+		}
+		e.Verified = true
+		if expBytes == nil {
+			e.Applied = reply.Value.Bytes == nil
+		} else {
+			e.Applied = bytes.Equal(reply.Value.Bytes, expBytes)
+		}
+	case <-time.After(verifyTimeout):
+	}
+}
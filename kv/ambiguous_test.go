@@ -0,0 +1,80 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/rpc"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// TestAmbiguousResult verifies only mutations which failed in flight
+// are reported as ambiguous.
+func TestAmbiguousResult(t *testing.T) {
+	inFlight := rpc.SendError{Ambiguous: true}
+	testCases := []struct {
+		method string
+		args   interface{}
+		err    error
+		expAmb bool
+	}{
+		{"Node.Put", &storage.PutRequest{Key: storage.Key("a")}, inFlight, true},
+		{"Node.Increment", &storage.IncrementRequest{Key: storage.Key("a")}, inFlight, true},
+		{"Node.Get", &storage.GetRequest{Key: storage.Key("a")}, inFlight, false},
+		{"Node.Put", &storage.PutRequest{Key: storage.Key("a")}, rpc.SendError{}, false},
+		{"Node.Put", &storage.PutRequest{Key: storage.Key("a")}, util.Errorf("failed"), false},
+		{"Node.Put", &storage.PutRequest{Key: storage.Key("a")}, nil, false},
+	}
+	for i, test := range testCases {
+		ambErr := ambiguousResult(test.method, test.args, test.err)
+		if (ambErr != nil) != test.expAmb {
+			t.Errorf("%d: expected ambiguous %t; got %v", i, test.expAmb, ambErr)
+		} else if ambErr != nil && !bytes.Equal(ambErr.Key, storage.Key("a")) {
+			t.Errorf("%d: expected key \"a\"; got %q", i, ambErr.Key)
+		}
+	}
+}
+
+// TestVerifyWrite verifies the outcome of ambiguous puts and deletes
+// is verified by reading back their keys, while other writes are left
+// unverified.
+func TestVerifyWrite(t *testing.T) {
+	db := startServer().db
+	key := storage.Key("ambiguous-verify")
+	if pr := <-db.Put(&storage.PutRequest{Key: key, Value: storage.Value{Bytes: []byte("v")}}); pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	testCases := []struct {
+		args                interface{}
+		expVerified, expApp bool
+	}{
+		{&storage.PutRequest{Key: key, Value: storage.Value{Bytes: []byte("v")}}, true, true},
+		{&storage.PutRequest{Key: key, Value: storage.Value{Bytes: []byte("w")}}, true, false},
+		{&storage.DeleteRequest{Key: key}, true, false},
+		{&storage.DeleteRequest{Key: storage.Key("ambiguous-missing")}, true, true},
+		{&storage.IncrementRequest{Key: key, Increment: 1}, false, false},
+	}
+	for i, test := range testCases {
+		ambErr := ambiguousResult("Node.Put", test.args, rpc.SendError{Ambiguous: true})
+		verifyWrite(db.Get, test.args, ambErr)
+		if ambErr.Verified != test.expVerified || ambErr.Applied != test.expApp {
+			t.Errorf("%d: expected verified %t, applied %t; got %+v", i, test.expVerified, test.expApp, ambErr)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// A Batch collects reads and writes of keys, which may reside in any
+// number of ranges, to be sent together by RunBatch. Unlike a
+// transaction, a batch isn't atomic: each call succeeds or fails on
+// its own.
+type Batch struct {
+	calls []batchCall
+}
+
+// A batchCall is a single read or write of a Batch.
+type batchCall struct {
+	method string // Get, Put or Delete
+	key    storage.Key
+	value  storage.Value
+}
+
+// Get adds a read of key to the batch.
+func (b *Batch) Get(key storage.Key) {
+	b.calls = append(b.calls, batchCall{method: "Get", key: key})
+}
+
+// Put adds a write of value to key to the batch.
+func (b *Batch) Put(key storage.Key, value storage.Value) {
+	b.calls = append(b.calls, batchCall{method: "Put", key: key, value: value})
+}
+
+// Delete adds a deletion of key to the batch.
+func (b *Batch) Delete(key storage.Key) {
+	b.calls = append(b.calls, batchCall{method: "Delete", key: key})
+}
+
+// Len returns the number of calls in the batch.
+func (b *Batch) Len() int {
+	return len(b.calls)
+}
+
+// A BatchResult is the outcome of one of the calls of a Batch.
+type BatchResult struct {
+	Index int           // Position of the call in the batch
+	Key   storage.Key   // The key read or written
+	Value storage.Value // The value read, for Gets
+	Error error
+}
+
+// BatchOptions holds options for RunBatch.
+type BatchOptions struct {
+	// Budget, if positive, is the latency budget of the batch. Once it
+	// elapses, sub-batches stop sending calls and RunBatch returns a
+	// PartialBatchError without waiting for outstanding calls.
+	Budget time.Duration
+	// MaxConcurrent limits the number of sub-batches in flight; zero
+	// to send all sub-batches at once.
+	MaxConcurrent int
+}
+
+// A PartialBatchError is returned by RunBatch if its latency budget
+// elapsed before every call completed. The indexes of the batch's
+// calls are reported by outcome. Abandoned calls were sent, but their
+// replies weren't awaited; abandoned writes may yet be applied.
+type PartialBatchError struct {
+	Budget    time.Duration
+	Succeeded []int // Calls which completed successfully
+	Failed    []int // Calls which completed with an error
+	Abandoned []int // Calls sent but not completed within the budget
+	Unsent    []int // Calls not sent
+}
+
+// Error implements the error interface.
+func (e *PartialBatchError) Error() string {
+	return fmt.Sprintf("batch latency budget of %s exhausted: %d calls succeeded, %d failed, %d abandoned, %d unsent",
+		e.Budget, len(e.Succeeded), len(e.Failed), len(e.Abandoned), len(e.Unsent))
+}
+
+// Call states, as tracked by RunBatch.
+const (
+	batchCallUnsent = iota
+	batchCallSent
+	batchCallDone
+)
+
+// RunBatch sends the calls of b via db, returning a result for each
+// call in batch order. Calls are divided into per-range sub-batches,
+// which are sent concurrently; the calls of each sub-batch are sent
+// in order, so that calls of the same key, which always share a
+// sub-batch, take effect in order. Errors of individual calls are set
+// in their results. If the latency budget elapses first, the results
+// of calls which didn't complete carry an error, and a
+// PartialBatchError is returned.
+func RunBatch(db DB, b *Batch, opts BatchOptions) ([]BatchResult, error) {
+	var deadline <-chan time.Time
+	if opts.Budget > 0 {
+		timer := time.NewTimer(opts.Budget)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	results := make([]BatchResult, len(b.calls))
+	for i, call := range b.calls {
+		results[i] = BatchResult{Index: i, Key: call.key}
+	}
+	groups := batchGroups(db, b.calls)
+	limit := opts.MaxConcurrent
+	if limit <= 0 || limit > len(groups) {
+		limit = len(groups)
+	}
+
+	// mu protects results, states and aborted, which the sub-batches
+	// update as they send calls and receive replies.
+	var mu sync.Mutex
+	states := make([]int, len(b.calls))
+	aborted := false
+	abort := make(chan struct{})
+	completed := make(chan struct{}, len(b.calls))
+	go func() {
+		sem := make(chan struct{}, limit)
+		for _, group := range groups {
+			select {
+			case sem <- struct{}{}:
+			case <-abort:
+				return
+			}
+			go func(group []int) {
+				defer func() { <-sem }()
+				for _, i := range group {
+					mu.Lock()
+					if aborted {
+						mu.Unlock()
+						return
+					}
+					states[i] = batchCallSent
+					mu.Unlock()
+					result := sendBatchCall(db, b.calls[i])
+					mu.Lock()
+					if !aborted {
+						states[i] = batchCallDone
+						results[i].Value, results[i].Error = result.Value, result.Error
+						completed <- struct{}{}
+					}
+					mu.Unlock()
+				}
+			}(group)
+		}
+	}()
+
+	for range b.calls {
+		select {
+		case <-completed:
+		case <-deadline:
+			mu.Lock()
+			defer mu.Unlock()
+			aborted = true
+			close(abort)
+			return results, partialBatch(opts.Budget, results, states)
+		}
+	}
+	return results, nil
+}
+
+// sendBatchCall sends call via db and returns its outcome.
+func sendBatchCall(db DB, call batchCall) BatchResult {
+	switch call.method {
+	case "Get":
+		reply := <-db.Get(&storage.GetRequest{Key: call.key})
+		return BatchResult{Value: reply.Value, Error: reply.Error}
+	case "Put":
+		reply := <-db.Put(&storage.PutRequest{Key: call.key, Value: call.value})
+		return BatchResult{Error: reply.Error}
+	case "Delete":
+		reply := <-db.Delete(&storage.DeleteRequest{Key: call.key})
+		return BatchResult{Error: reply.Error}
+	}
+	return BatchResult{Error: util.Errorf("unknown batch call %s", call.method)}
+}
+
+// partialBatch returns the PartialBatchError of a batch whose budget
+// elapsed with its calls in states, setting an error in the results
+// of the calls which didn't complete.
+func partialBatch(budget time.Duration, results []BatchResult, states []int) *PartialBatchError {
+	err := &PartialBatchError{Budget: budget}
+	for i, state := range states {
+		switch {
+		case state == batchCallDone && results[i].Error == nil:
+			err.Succeeded = append(err.Succeeded, i)
+		case state == batchCallDone:
+			err.Failed = append(err.Failed, i)
+		case state == batchCallSent:
+			err.Abandoned = append(err.Abandoned, i)
+			results[i].Error = util.Errorf("batch latency budget of %s exhausted awaiting call", budget)
+		default:
+			err.Unsent = append(err.Unsent, i)
+			results[i].Error = util.Errorf("batch latency budget of %s exhausted before call was sent", budget)
+		}
+	}
+	return err
+}
+
+// batchGroups divides the calls into sub-batches, returning the
+// indexes of the calls of each in batch order. A DistDB groups calls
+// by the range holding their keys, looking up each range once;
+// other DBs, and calls whose ranges can't be looked up, are grouped
+// by key.
+func batchGroups(db DB, calls []batchCall) [][]int {
+	order := make([]int, len(calls))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Stable(batchCallsByKey{calls, order})
+	dist, _ := db.(*DistDB)
+	var groups [][]int
+	var prevKey, endKey storage.Key
+	for n, i := range order {
+		key := calls[i].key
+		switch {
+		case n > 0 && bytes.Equal(key, prevKey):
+			// Calls of the same key share a sub-batch.
+		case n > 0 && endKey != nil && bytes.Compare(key, endKey) < 0:
+			// The key is within the previous key's range.
+		default:
+			endKey = nil
+			if dist != nil {
+				if _, end, err := dist.lookupRange(key); err == nil {
+					endKey = end
+				}
+			}
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], i)
+		prevKey = key
+	}
+	for _, group := range groups {
+		sort.Ints(group)
+	}
+	return groups
+}
+
+// batchCallsByKey implements sort.Interface for the indexes of a
+// batch's calls, ordering by key.
+type batchCallsByKey struct {
+	calls []batchCall
+	order []int
+}
+
+func (b batchCallsByKey) Len() int      { return len(b.order) }
+func (b batchCallsByKey) Swap(i, j int) { b.order[i], b.order[j] = b.order[j], b.order[i] }
+func (b batchCallsByKey) Less(i, j int) bool {
+	return bytes.Compare(b.calls[b.order[i]].key, b.calls[b.order[j]].key) < 0
+}
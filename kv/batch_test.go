@@ -0,0 +1,106 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// slowGetDB delays reads of key until release is closed.
+type slowGetDB struct {
+	DB
+	key     string
+	release chan struct{}
+}
+
+// Get implements the DB interface.
+func (db *slowGetDB) Get(args *storage.GetRequest) <-chan *storage.GetResponse {
+	if string(args.Key) == db.key {
+		<-db.release
+	}
+	return db.DB.Get(args)
+}
+
+// TestRunBatch verifies each call's result is returned in batch order
+// and that calls of the same key take effect in order.
+func TestRunBatch(t *testing.T) {
+	db := newTestLocalDB(storage.KeyMax)
+	put(t, db, "a", "old")
+	b := &Batch{}
+	for i := 0; i < 10; i++ {
+		b.Put(storage.Key(fmt.Sprintf("key%d", i)), storage.Value{Bytes: []byte(fmt.Sprintf("value%d", i))})
+	}
+	b.Get(storage.Key("a"))
+	b.Put(storage.Key("a"), storage.Value{Bytes: []byte("new")})
+	b.Get(storage.Key("a"))
+	b.Delete(storage.Key("key0"))
+	results, err := RunBatch(db, b, BatchOptions{MaxConcurrent: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != b.Len() {
+		t.Fatalf("expected %d results; got %d", b.Len(), len(results))
+	}
+	for i, result := range results {
+		if result.Index != i || result.Error != nil {
+			t.Errorf("%d: unexpected result %+v", i, result)
+		}
+	}
+	if v := string(results[10].Value.Bytes); v != "old" {
+		t.Errorf("expected read before write of same key to see %q; got %q", "old", v)
+	}
+	if v := string(results[12].Value.Bytes); v != "new" {
+		t.Errorf("expected read after write of same key to see %q; got %q", "new", v)
+	}
+	if gr := <-db.Get(&storage.GetRequest{Key: storage.Key("key0")}); gr.Value.Bytes != nil {
+		t.Errorf("expected key0 deleted; got %q", gr.Value.Bytes)
+	}
+}
+
+// TestRunBatchBudget verifies a batch whose budget elapses returns a
+// PartialBatchError detailing which calls succeeded, and that the
+// calls following an abandoned call in its sub-batch aren't sent.
+func TestRunBatchBudget(t *testing.T) {
+	db := &slowGetDB{DB: newTestLocalDB(storage.KeyMax), key: "slow", release: make(chan struct{})}
+	defer close(db.release)
+	b := &Batch{}
+	b.Put(storage.Key("a"), storage.Value{Bytes: []byte("value")})
+	b.Get(storage.Key("slow"))
+	b.Put(storage.Key("slow"), storage.Value{Bytes: []byte("value")})
+	b.Get(storage.Key("b"))
+	results, err := RunBatch(db, b, BatchOptions{Budget: 50 * time.Millisecond})
+	pbe, ok := err.(*PartialBatchError)
+	if !ok {
+		t.Fatalf("expected partial batch error; got %v", err)
+	}
+	exp := &PartialBatchError{Budget: 50 * time.Millisecond, Succeeded: []int{0, 3}, Abandoned: []int{1}, Unsent: []int{2}}
+	if !reflect.DeepEqual(pbe, exp) {
+		t.Errorf("expected %+v; got %+v", exp, pbe)
+	}
+	for _, i := range []int{1, 2} {
+		if results[i].Error == nil {
+			t.Errorf("%d: expected error for incomplete call", i)
+		}
+	}
+	if gr := <-db.DB.Get(&storage.GetRequest{Key: storage.Key("slow")}); gr.Value.Bytes != nil {
+		t.Errorf("expected unsent write not to be applied; got %q", gr.Value.Bytes)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// DefaultBulkBatchBytes is the default size of the batches of rows a
+// BulkWriter sends in each request.
+const DefaultBulkBatchBytes = 1 << 20
+
+// A BulkWriter ingests a stream of key/value pairs sorted by key, as
+// when restoring a backup or loading a dataset. Rows are buffered and
+// sent in batches via InternalBulkWrite requests. Each request is
+// routed to the range containing its first row, which writes the
+// rows it contains and leaves the remainder to be sent on to the
+// following range. A BulkWriter is not safe for concurrent use.
+type BulkWriter struct {
+	db         DB
+	batchBytes int                // Buffered bytes which trigger a flush
+	rows       []storage.KeyValue // Buffered rows
+	bytes      int                // Size of buffered rows
+	lastKey    storage.Key        // Most recently added key
+	written    int64              // Rows written to date
+}
+
+// NewBulkWriter returns a BulkWriter which writes to db in batches of
+// approximately batchBytes.
+func NewBulkWriter(db DB, batchBytes int) *BulkWriter {
+	return &BulkWriter{db: db, batchBytes: batchBytes}
+}
+
+// Add buffers the key/value pair for writing, flushing buffered rows
+// if the batch size has been reached. Keys must be added in strictly
+// increasing order.
+func (bw *BulkWriter) Add(key storage.Key, value storage.Value) error {
+	if bw.lastKey != nil && bytes.Compare(key, bw.lastKey) <= 0 {
+		return util.Errorf("bulk write keys must be strictly increasing: %q follows %q", key, bw.lastKey)
+	}
+	bw.lastKey = key
+	bw.rows = append(bw.rows, storage.KeyValue{Key: key, Value: value})
+	bw.bytes += len(key) + len(value.Bytes)
+	if bw.bytes >= bw.batchBytes {
+		return bw.Flush()
+	}
+	return nil
+}
+
+// Flush writes all buffered rows, sending as many requests as there
+// are ranges spanned by the rows.
+func (bw *BulkWriter) Flush() error {
+	for len(bw.rows) > 0 {
+		reply := <-bw.db.InternalBulkWrite(&storage.InternalBulkWriteRequest{Rows: bw.rows})
+		if reply.Error != nil {
+			return reply.Error
+		}
+		if reply.Written == 0 {
+			return util.Errorf("bulk write of %q made no progress", bw.rows[0].Key)
+		}
+		bw.rows = bw.rows[reply.Written:]
+		bw.written += int64(reply.Written)
+	}
+	bw.rows, bw.bytes = nil, 0
+	return nil
+}
+
+// Written returns the number of rows written to date.
+func (bw *BulkWriter) Written() int64 {
+	return bw.written
+}
@@ -0,0 +1,85 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// newTestLocalDB returns a LocalDB over a range spanning [KeyMin, end).
+func newTestLocalDB(end storage.Key) *LocalDB {
+	meta := storage.RangeMetadata{RangeID: 1, StartKey: storage.KeyMin, EndKey: end}
+	return NewLocalDB(storage.NewRange(meta, storage.NewInMem(1<<20), nil, nil))
+}
+
+// TestBulkWriter verifies rows are written in batches and readable
+// afterwards.
+func TestBulkWriter(t *testing.T) {
+	db := newTestLocalDB(storage.KeyMax)
+	bw := NewBulkWriter(db, 64)
+	for i := 0; i < 100; i++ {
+		key := storage.Key(fmt.Sprintf("key%03d", i))
+		if err := bw.Add(key, storage.Value{Bytes: []byte(fmt.Sprintf("value%d", i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if bw.Written() != 100 {
+		t.Errorf("expected 100 rows written; got %d", bw.Written())
+	}
+	gr := <-db.Get(&storage.GetRequest{Key: storage.Key("key042")})
+	if gr.Error != nil || !bytes.Equal(gr.Value.Bytes, []byte("value42")) {
+		t.Errorf("expected value42; got %q, %v", gr.Value.Bytes, gr.Error)
+	}
+}
+
+// TestBulkWriterUnsorted verifies out of order keys are rejected.
+func TestBulkWriterUnsorted(t *testing.T) {
+	bw := NewBulkWriter(newTestLocalDB(storage.KeyMax), DefaultBulkBatchBytes)
+	if err := bw.Add(storage.Key("b"), storage.Value{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if err := bw.Add(storage.Key(key), storage.Value{}); err == nil {
+			t.Errorf("expected error adding %q after %q", key, "b")
+		}
+	}
+}
+
+// TestBulkWriterRangeBoundary verifies a range writes only the rows
+// it contains. As a LocalDB has a single range, rows beyond it can't
+// be written.
+func TestBulkWriterRangeBoundary(t *testing.T) {
+	db := newTestLocalDB(storage.Key("m"))
+	bw := NewBulkWriter(db, DefaultBulkBatchBytes)
+	for _, key := range []string{"a", "b", "x"} {
+		if err := bw.Add(storage.Key(key), storage.Value{Bytes: []byte("v")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bw.Flush(); err == nil {
+		t.Error("expected error writing row beyond range")
+	}
+	if bw.Written() != 2 {
+		t.Errorf("expected 2 rows written; got %d", bw.Written())
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"fmt"
+	"hash/crc32"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// DefaultChunkSize is the default size of the chunks in which
+// PutLarge stores values.
+const DefaultChunkSize = 1 << 20
+
+// A ChunkManifest is stored at the key of a large value written by
+// PutLarge. It describes the chunks holding the value.
+type ChunkManifest struct {
+	Generation int64  // Distinguishes chunks of successive values
+	Chunks     int    // Number of chunks
+	Size       int64  // Total size of the value
+	Checksum   uint32 // CRC-32 (IEEE) of the value
+}
+
+// chunkKey returns the key of the i'th chunk of the specified
+// generation of the large value at key. Chunk keys sort immediately
+// after key and in order of generation and index; applications must
+// not write keys of this form themselves.
+func chunkKey(key storage.Key, generation int64, i int) storage.Key {
+	return storage.MakeKey(key, storage.Key(fmt.Sprintf("\x00chunk-%016x-%08x", generation, i)))
+}
+
+// PutLarge stores value at key, split into chunks of chunkSize bytes,
+// for values too large to be written in a single request. The chunks
+// are written first, with a manifest stored at key last. Chunks are
+// keyed by a new generation each time, so the manifest write replaces
+// the value all at once: readers see either the previous value or the
+// new one. Chunks of the previous value are deleted afterwards. A
+// failed PutLarge may leave unreferenced chunks behind.
+func PutLarge(db DB, key storage.Key, value []byte, chunkSize int) error {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	var prev ChunkManifest
+	hasPrev, _, err := GetI(db, key, &prev)
+	if err != nil {
+		return err
+	}
+	manifest := ChunkManifest{
+		Generation: time.Now().UnixNano(),
+		Chunks:     (len(value) + chunkSize - 1) / chunkSize,
+		Size:       int64(len(value)),
+		Checksum:   crc32.ChecksumIEEE(value),
+	}
+	bw := NewBulkWriter(db, chunkSize)
+	for i := 0; i < manifest.Chunks; i++ {
+		end := (i + 1) * chunkSize
+		if end > len(value) {
+			end = len(value)
+		}
+		if err := bw.Add(chunkKey(key, manifest.Generation, i), storage.Value{Bytes: value[i*chunkSize : end]}); err != nil {
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if err := PutI(db, key, manifest); err != nil {
+		return err
+	}
+	if hasPrev {
+		return deleteChunks(db, key, prev)
+	}
+	return nil
+}
+
+// GetLarge returns the value stored at key by PutLarge, reassembled
+// from its chunks. Returns false if there's no value at key.
+func GetLarge(db DB, key storage.Key) ([]byte, bool, error) {
+	var manifest ChunkManifest
+	ok, _, err := GetI(db, key, &manifest)
+	if err != nil || !ok {
+		return nil, ok, err
+	}
+	keys := make([]storage.Key, manifest.Chunks)
+	for i := range keys {
+		keys[i] = chunkKey(key, manifest.Generation, i)
+	}
+	value := make([]byte, 0, manifest.Size)
+	for result := range MultiGet(db, keys, MultiGetOptions{Ordered: true, MaxConcurrent: 4}) {
+		if result.Error != nil {
+			err = result.Error
+		}
+		value = append(value, result.Value.Bytes...)
+	}
+	if err != nil {
+		return nil, true, err
+	}
+	// A missing chunk means the value was replaced or deleted while
+	// being read.
+	if int64(len(value)) != manifest.Size || crc32.ChecksumIEEE(value) != manifest.Checksum {
+		return nil, true, util.Errorf("large value at %q changed while being read", key)
+	}
+	return value, true, nil
+}
+
+// DeleteLarge deletes the value stored at key by PutLarge, removing
+// the manifest before the chunks.
+func DeleteLarge(db DB, key storage.Key) error {
+	var manifest ChunkManifest
+	ok, _, err := GetI(db, key, &manifest)
+	if err != nil || !ok {
+		return err
+	}
+	if reply := <-db.Delete(&storage.DeleteRequest{Key: key}); reply.Error != nil {
+		return reply.Error
+	}
+	return deleteChunks(db, key, manifest)
+}
+
+// deleteChunks deletes the chunks described by manifest.
+func deleteChunks(db DB, key storage.Key, manifest ChunkManifest) error {
+	for i := 0; i < manifest.Chunks; i++ {
+		if reply := <-db.Delete(&storage.DeleteRequest{Key: chunkKey(key, manifest.Generation, i)}); reply.Error != nil {
+			return reply.Error
+		}
+	}
+	return nil
+}
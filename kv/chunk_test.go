@@ -0,0 +1,61 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// TestLargeValues verifies large values are stored in chunks,
+// reassembled on read, and that replacing or deleting them removes
+// their chunks.
+func TestLargeValues(t *testing.T) {
+	db := newTestLocalDB(storage.KeyMax)
+	key := storage.Key("large")
+	countRows := func() int {
+		sr := <-db.Scan(&storage.ScanRequest{StartKey: key, EndKey: storage.PrefixEndKey(key), MaxResults: 100})
+		if sr.Error != nil {
+			t.Fatal(sr.Error)
+		}
+		return len(sr.Rows)
+	}
+	for _, size := range []int{1000, 250} {
+		value := bytes.Repeat([]byte{byte(size)}, size)
+		if err := PutLarge(db, key, value, 100); err != nil {
+			t.Fatal(err)
+		}
+		got, ok, err := GetLarge(db, key)
+		if !ok || err != nil || !bytes.Equal(got, value) {
+			t.Fatalf("expected %d byte value; got %d bytes, %t, %v", size, len(got), ok, err)
+		}
+		// The manifest plus the chunks of only the current value.
+		if rows, exp := countRows(), 1+(size+99)/100; rows != exp {
+			t.Errorf("expected %d rows; got %d", exp, rows)
+		}
+	}
+	if err := DeleteLarge(db, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := GetLarge(db, key); ok || err != nil {
+		t.Errorf("expected value deleted; got %t, %v", ok, err)
+	}
+	if rows := countRows(); rows != 0 {
+		t.Errorf("expected chunks deleted; got %d rows", rows)
+	}
+}
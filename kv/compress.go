@@ -0,0 +1,77 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/golang/glog"
+)
+
+// compression returns the compression options for a request with
+// header: those of the request, if set, and otherwise the client's.
+func (db *DistDB) compression(header *storage.RequestHeader) storage.CompressionOptions {
+	if header.Compression != nil {
+		return *header.Compression
+	}
+	return db.opts.Compression
+}
+
+// compressPut returns args with its value compressed according to co,
+// using the gossiped compression dictionary for its key, if any.
+// Values smaller than the request threshold are left uncompressed.
+// The args are copied if modified.
+func (db *DistDB) compressPut(args *storage.PutRequest, co storage.CompressionOptions) *storage.PutRequest {
+	if len(args.Value.Bytes) < co.RequestThreshold {
+		return args
+	}
+	value, err := storage.GossipedCompressionDicts(db.gossip).CompressCodec(args.Key, args.Value, co.Codec)
+	if err != nil {
+		glog.Warningf("sending value for key %q uncompressed: %v", args.Key, err)
+		return args
+	}
+	if value.DictVersion == 0 {
+		return args
+	}
+	compressed := *args
+	compressed.Value = value
+	return &compressed
+}
+
+// compressedGet sends a Get which accepts a value compressed
+// according to co in reply, decompressing it using the gossiped
+// compression dictionaries. Should the value be compressed with a
+// dictionary not yet gossiped to this client, the Get is resent
+// without accepting compression.
+func (db *DistDB) compressedGet(args *storage.GetRequest, co storage.CompressionOptions) <-chan *storage.GetResponse {
+	c := make(chan *storage.GetResponse, 1)
+	go func() {
+		accepting := *args
+		accepting.AcceptCompressed = true
+		accepting.Compression = &co
+		reply := <-db.routeRPC(args.Key, "Node.Get", &accepting, &storage.GetResponse{}).(chan *storage.GetResponse)
+		if reply.Error == nil {
+			value, err := storage.GossipedCompressionDicts(db.gossip).Decompress(args.Key, reply.Value)
+			if err != nil {
+				glog.Warningf("resending get uncompressed: %v", err)
+				reply = <-db.routeRPC(args.Key, "Node.Get", args, &storage.GetResponse{}).(chan *storage.GetResponse)
+			} else {
+				reply.Value = value
+			}
+		}
+		c <- reply
+	}()
+	return c
+}
@@ -0,0 +1,63 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// TestCompressPut verifies values are compressed according to the
+// client's compression options unless overridden by the request, and
+// only if at least as large as the request threshold.
+func TestCompressPut(t *testing.T) {
+	db := NewDBWithOptions(gossip.New(), DistDBOptions{
+		Compression: storage.CompressionOptions{Codec: storage.CompressionDeflate, RequestThreshold: 64},
+	})
+	defer db.Close()
+	value := bytes.Repeat([]byte("compressible"), 8)
+	testCases := []struct {
+		value          []byte
+		override       *storage.CompressionOptions
+		expDictVersion int32
+	}{
+		{value, nil, storage.DictVersionNone},
+		{value[:63], nil, 0},
+		{value, &storage.CompressionOptions{Codec: storage.CompressionNone}, 0},
+		{value[:63], &storage.CompressionOptions{Codec: storage.CompressionDeflate}, storage.DictVersionNone},
+	}
+	for i, test := range testCases {
+		args := &storage.PutRequest{
+			RequestHeader: storage.RequestHeader{Compression: test.override},
+			Key:           storage.Key("a"),
+			Value:         storage.Value{Bytes: test.value},
+		}
+		co := db.compression(&args.RequestHeader)
+		sent := args
+		if co.Enabled() {
+			sent = db.compressPut(args, co)
+		}
+		if sent.Value.DictVersion != test.expDictVersion {
+			t.Errorf("%d: expected dictionary version %d; got %d", i, test.expDictVersion, sent.Value.DictVersion)
+		}
+		if args.Value.DictVersion != 0 {
+			t.Errorf("%d: expected request args to be unmodified", i)
+		}
+	}
+}
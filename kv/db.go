@@ -21,8 +21,11 @@ import (
 	"bytes"
 	"encoding/gob"
 	"fmt"
+	"math/rand"
 	"net"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cockroachdb/cockroach/gossip"
@@ -38,14 +41,29 @@ type DB interface {
 	Get(args *storage.GetRequest) <-chan *storage.GetResponse
 	Put(args *storage.PutRequest) <-chan *storage.PutResponse
 	Increment(args *storage.IncrementRequest) <-chan *storage.IncrementResponse
+	Append(args *storage.AppendRequest) <-chan *storage.AppendResponse
+	GetByteRange(args *storage.GetByteRangeRequest) <-chan *storage.GetByteRangeResponse
 	Delete(args *storage.DeleteRequest) <-chan *storage.DeleteResponse
 	DeleteRange(args *storage.DeleteRangeRequest) <-chan *storage.DeleteRangeResponse
 	Scan(args *storage.ScanRequest) <-chan *storage.ScanResponse
 	EndTransaction(args *storage.EndTransactionRequest) <-chan *storage.EndTransactionResponse
 	AccumulateTS(args *storage.AccumulateTSRequest) <-chan *storage.AccumulateTSResponse
+	GetTSBlock(args *storage.GetTSBlockRequest) <-chan *storage.GetTSBlockResponse
 	ReapQueue(args *storage.ReapQueueRequest) <-chan *storage.ReapQueueResponse
 	EnqueueUpdate(args *storage.EnqueueUpdateRequest) <-chan *storage.EnqueueUpdateResponse
 	EnqueueMessage(args *storage.EnqueueMessageRequest) <-chan *storage.EnqueueMessageResponse
+	AckQueue(args *storage.AckQueueRequest) <-chan *storage.AckQueueResponse
+	InternalBulkWrite(args *storage.InternalBulkWriteRequest) <-chan *storage.InternalBulkWriteResponse
+	InternalPushTxn(args *storage.InternalPushTxnRequest) <-chan *storage.InternalPushTxnResponse
+	InternalResolveIntent(args *storage.InternalResolveIntentRequest) <-chan *storage.InternalResolveIntentResponse
+	InternalTxnResolved(args *storage.InternalTxnResolvedRequest) <-chan *storage.InternalTxnResolvedResponse
+	InternalWatch(args *storage.InternalWatchRequest) <-chan *storage.InternalWatchResponse
+	Watch(start, end storage.Key) *Watcher
+	InternalResolvedTimestamp(args *storage.InternalResolvedTimestampRequest) <-chan *storage.InternalResolvedTimestampResponse
+	AdminSplit(args *storage.AdminSplitRequest) <-chan *storage.AdminSplitResponse
+	AdminMerge(args *storage.AdminMergeRequest) <-chan *storage.AdminMergeResponse
+	AdminTransferLease(args *storage.AdminTransferLeaseRequest) <-chan *storage.AdminTransferLeaseResponse
+	AdminCompact(args *storage.AdminCompactRequest) <-chan *storage.AdminCompactResponse
 }
 
 // GetI fetches the value at the specified key and deserializes it
@@ -55,7 +73,19 @@ type DB interface {
 // found for the requested key; false otherwise. An error is returned
 // on error fetching from underlying storage or deserializing value.
 func GetI(db DB, key storage.Key, value interface{}) (bool, int64, error) {
-	gr := <-db.Get(&storage.GetRequest{Key: key})
+	return GetAtI(db, key, value, 0)
+}
+
+// GetAtI is like GetI, but reads the version of the value current at
+// the specified timestamp, in nanoseconds since the epoch: the latest
+// written at or before it, which remains readable until garbage
+// collected once superseded for its zone's GC TTL. A zero timestamp
+// reads the latest version.
+func GetAtI(db DB, key storage.Key, value interface{}, timestamp int64) (bool, int64, error) {
+	gr := <-db.Get(&storage.GetRequest{
+		RequestHeader: storage.RequestHeader{Timestamp: timestamp},
+		Key:           key,
+	})
 	if gr.Error != nil {
 		return false, 0, gr.Error
 	}
@@ -68,6 +98,18 @@ func GetI(db DB, key storage.Key, value interface{}) (bool, int64, error) {
 	return true, gr.Value.Timestamp, nil
 }
 
+// scan sends args via db.Scan. DistDB doesn't yet scan, returning a
+// nil channel; rather than blocking forever, the reply then fails
+// with a NotImplementedError.
+func scan(db DB, args *storage.ScanRequest) <-chan *storage.ScanResponse {
+	if c := db.Scan(args); c != nil {
+		return c
+	}
+	c := make(chan *storage.ScanResponse, 1)
+	c <- &storage.ScanResponse{ResponseHeader: storage.ResponseHeader{Error: &NotImplementedError{Method: "Node.Scan"}}}
+	return c
+}
+
 // PutI sets the given key to the serialized byte string of the value
 // provided. Uses current time and default expiration.
 func PutI(db DB, key storage.Key, value interface{}) error {
@@ -148,31 +190,182 @@ func BootstrapConfigs(db DB) error {
 // UpdateRangeLocations updates the range locations metadata for the
 // range specified by the meta parameter. This always involves a write
 // to "meta2", and may require a write to "meta1", in the event that
-// meta.EndKey is a "meta2" key (prefixed by KeyMeta2Prefix).
+// the range holds "meta2" records; see meta1KeyForRange.
+//
+// All range addressing records reside in the first range, so the
+// records are written by a single bulk write command, which the range
+// executes without interleaving other commands; lookups never observe
+// meta1 and meta2 records which disagree. Retryable failures are
+// retried by the DB.
 func UpdateRangeLocations(db DB, meta storage.RangeMetadata, locations storage.RangeLocations) error {
-	// TODO(spencer): a lot more work here to actually implement this.
-
-	// Write meta2.
-	if err := PutI(db, storage.MakeKey(storage.KeyMeta2Prefix, meta.EndKey), locations); err != nil {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(locations); err != nil {
 		return err
 	}
+	value := storage.Value{Bytes: buf.Bytes(), Timestamp: time.Now().UnixNano()}
+	var rows []storage.KeyValue
+	if meta1Key, ok := meta1KeyForRange(meta); ok {
+		rows = append(rows, storage.KeyValue{Key: meta1Key, Value: value})
+	}
+	rows = append(rows, storage.KeyValue{Key: storage.MakeKey(storage.KeyMeta2Prefix, meta.EndKey), Value: value})
+	reply := <-db.InternalBulkWrite(&storage.InternalBulkWriteRequest{Rows: rows})
+	if reply.Error != nil {
+		return reply.Error
+	}
+	if reply.Written != len(rows) {
+		return util.Errorf("wrote %d of %d addressing records for range %d", reply.Written, len(rows), meta.RangeID)
+	}
 	return nil
 }
 
+// meta1KeyForRange returns the meta1 key addressing the range, if the
+// range holds meta2 records. Meta1 records are keyed by the end of the
+// span of meta2 keys held by the range, stripped of KeyMeta2Prefix; a
+// range holding all meta2 keys from its start onward is keyed by
+// KeyMax.
+func meta1KeyForRange(meta storage.RangeMetadata) (storage.Key, bool) {
+	if bytes.Compare(meta.StartKey, storage.PrefixEndKey(storage.KeyMeta2Prefix)) >= 0 ||
+		bytes.Compare(meta.EndKey, storage.KeyMeta2Prefix) <= 0 {
+		return nil, false
+	}
+	if bytes.HasPrefix(meta.EndKey, storage.KeyMeta2Prefix) {
+		return storage.MakeKey(storage.KeyMeta1Prefix, meta.EndKey[len(storage.KeyMeta2Prefix):]), true
+	}
+	return storage.MakeKey(storage.KeyMeta1Prefix, storage.KeyMax), true
+}
+
 // A DistDB provides methods to access Cockroach's monolithic,
 // distributed key value store. Each method invocation triggers a
 // lookup or lookups to find replica metadata for implicated key
 // ranges. RPCs are sent to one or more of the replicas to satisfy
-// the method invocation.
+// the method invocation. A DistDB is a "smart" client: it joins the
+// gossip network and caches range metadata. Clients which prefer
+// simplicity to the lowest latency may use a ProxyDB instead.
 type DistDB struct {
 	// gossip provides up-to-date information about the start of the
 	// key range, used to find the replica metadata for arbitrary key
 	// ranges.
 	gossip *gossip.Gossip
-	// rangeCache caches replica metadata for key ranges. The cache is
-	// filled while servicing read and write requests to the key value
-	// store.
-	rangeCache util.LRUCache
+	// rangeCache caches the locations of ranges, as looked up while
+	// servicing requests, if the DistDB follows range changes; nil
+	// otherwise. See DistDBOptions.FollowRangeChanges.
+	rangeCache *rangeCache
+	// rangeFeed keeps rangeCache up to date; nil unless following
+	// range changes.
+	rangeFeed *RangeFeed
+	// metrics aggregates latencies and counts of requests.
+	metrics *Metrics
+	// tracer receives trace events; it includes metrics and the
+	// Tracer supplied to SetTracer, if any.
+	tracer Tracer
+	// opts are the options with which the DistDB was created.
+	opts DistDBOptions
+	// roundRobin counts requests for OrderRoundRobin.
+	roundRobin int64
+	// leaderMu protects leaders.
+	leaderMu sync.Mutex
+	// leaders caches the replica which most recently served a request
+	// for each range, by replica set, for OrderLeaderFirst.
+	leaders *util.LRUCache
+	// closeMu protects closed and addrs.
+	closeMu sync.Mutex
+	// closed is set by Close; requests sent after are refused.
+	closed bool
+	// closer is closed by Close to abandon outstanding requests.
+	closer chan struct{}
+	// addrs holds the addresses of nodes to which RPCs have been sent,
+	// whose client connections are released by Close.
+	addrs map[string]net.Addr
+	// wg tracks outstanding requests, which Close waits for.
+	wg sync.WaitGroup
+	// txns tracks the writes of open transactions to enforce the
+	// limits on transaction size.
+	txns *txnWrites
+	// clock is the hybrid logical clock whose readings are sent with
+	// requests, updated with the readings of replies. See SetClock.
+	clock *util.Clock
+}
+
+// DistDBOptions holds options for creating a DistDB.
+type DistDBOptions struct {
+	// Priority is set in the header of requests which don't specify a
+	// priority of their own. Clients typically use the priority of
+	// their user's Permission.
+	Priority float32
+	// User is set in the header of requests which don't specify a user
+	// of their own; nodes check the requests against the user's
+	// permissions.
+	User string
+	// Client identifies the application, by convention as
+	// "name/version", in the header of requests which don't specify a
+	// client of their own. Nodes report load and sampled writes by
+	// client.
+	Client string
+	// Internal flags requests as internal, permitting them to write
+	// keys reserved for the system, such as range addressing records
+	// and configs; see storage.IsReservedKey. Intended only for nodes'
+	// own clients.
+	Internal bool
+	// ReadOnly configures the client to refuse to send requests which
+	// modify data; such requests fail with a ReadOnlyError without
+	// being sent. Intended for services, such as analytics dashboards,
+	// which must be unable to modify data.
+	ReadOnly bool
+	// FirstRangeTimeout, if positive, makes NewDBWithOptions block
+	// until the first range's metadata has been gossiped or the timeout
+	// elapses, so that early requests needn't wait for gossip. Services
+	// which prefer fast startup leave it zero; the metadata then
+	// arrives in the background as gossip connects, and requests sent
+	// before then wait for it.
+	FirstRangeTimeout time.Duration
+	// Compression controls compressing values on the wire, using the
+	// compression dictionaries of their key prefixes, as gossiped. It
+	// may be overridden per request via RequestHeader.Compression.
+	// Values are sent uncompressed by default, and are otherwise
+	// compressed by nodes when stored.
+	Compression storage.CompressionOptions
+	// ReplicaOrder is the order in which the replicas of a range are
+	// tried when sending requests. Defaults to OrderRandom.
+	ReplicaOrder ReplicaOrder
+	// Datacenter and Rack are the locality of the client, for
+	// OrderLocality. Nodes declare theirs via the -datacenter and -rack
+	// flags. Clients which leave them empty are considered remote from
+	// every node.
+	Datacenter string
+	Rack       string
+	// QuorumReads configures the client to send Get requests to a
+	// quorum of each range's replicas, returning the most recent of
+	// their values; replicas which disagree are logged and counted in
+	// Metrics.Divergences. Quorum reads are slower than reads from the
+	// leader alone, and are intended for verification tools and for
+	// investigating suspected inconsistencies. See QuorumGet.
+	QuorumReads bool
+	// ReadConsistency is the consistency of reads which don't specify
+	// one of their own. INCONSISTENT and BOUNDED reads may be served by
+	// any replica, rather than the lease holder alone, spreading read
+	// load; combined with OrderNearest, reads are served by nearby
+	// replicas. Defaults to CONSISTENT. See storage.ReadConsistency.
+	ReadConsistency storage.ReadConsistency
+	// MaxStaleness bounds the staleness of BOUNDED reads: each reflects
+	// every write made at least MaxStaleness before it was sent.
+	// Replicas whose data isn't as recent redirect reads to the lease
+	// holder, so the bound should exceed the nodes'
+	// closed_timestamp_interval plus storage.MaxClockOffset.
+	MaxStaleness time.Duration
+	// FollowRangeChanges configures the client to cache the locations
+	// of ranges, kept up to date by a RangeFeed, so that requests
+	// needn't look up their ranges and are routed to ranges' new
+	// locations as they split, merge and move, rather than after
+	// failing. Intended for long-lived clients; each such client
+	// continually polls the first range for changes. Cached locations
+	// are also discarded when requests routed by them fail.
+	FollowRangeChanges bool
+	// SendNext, if set, is the strategy for sending requests to other
+	// replicas of a range while awaiting a reply. By default, requests
+	// are sent to another replica after each second without a reply.
+	// Counts of speculative sends are reported by rpc.GetSendNextStats.
+	SendNext     *rpc.SendNextStrategy
+	experimental map[string]bool // Enabled experimental features
 }
 
 // Default constants for timeouts.
@@ -183,6 +376,10 @@ const (
 	maxRetryBackoff        = 30 * time.Second
 )
 
+// leaderCacheSize is the number of ranges for which the DistDB
+// remembers the replica which last served a request.
+const leaderCacheSize = 1 << 10
+
 // A firstRangeMissingErr indicates that the first range has not yet
 // been gossipped. This will be the case for a node which hasn't yet
 // joined the gossip network.
@@ -202,38 +399,286 @@ type noNodeAddrsAvailErr struct {
 // CanRetry implements the Retryable interface.
 func (n noNodeAddrsAvailErr) CanRetry() bool { return true }
 
+// A ReadOnlyError indicates a read-only client refused to send a
+// request which would modify data.
+type ReadOnlyError struct {
+	Method string
+}
+
+// Error implements the error interface.
+func (e *ReadOnlyError) Error() string {
+	return fmt.Sprintf("%s refused by read-only client", e.Method)
+}
+
+// A ClosedError indicates a request was abandoned or refused because
+// the DistDB which was to send it has been closed.
+type ClosedError struct {
+	Method string
+}
+
+// Error implements the error interface.
+func (e *ClosedError) Error() string {
+	return fmt.Sprintf("%s abandoned by closed client", e.Method)
+}
+
+// A NotImplementedError indicates a request the DB doesn't yet
+// support.
+type NotImplementedError struct {
+	Method string
+}
+
+// Error implements the error interface.
+func (e *NotImplementedError) Error() string {
+	return fmt.Sprintf("%s not implemented", e.Method)
+}
+
+// readOnlyMethods is the set of RPC methods which never modify data.
+var readOnlyMethods = map[string]bool{
+	"Node.Contains":            true,
+	"Node.Get":                 true,
+	"Node.GetByteRange":        true,
+	"Node.GetTSBlock":          true,
+	"Node.Scan":                true,
+	"Node.InternalRangeLookup": true,
+	"Node.InternalWatch":       true,
+
+	"Node.InternalResolvedTimestamp": true,
+}
+
+// followerReadMethods is the set of RPC methods whose reads may be
+// served by replicas other than the lease holder, as configured by
+// DistDBOptions.ReadConsistency. Internal reads, which must see the
+// range's latest data, aren't included.
+var followerReadMethods = map[string]bool{
+	"Node.Contains":     true,
+	"Node.Get":          true,
+	"Node.GetByteRange": true,
+	"Node.Scan":         true,
+}
+
+// isMutation returns whether sending method with args may modify
+// data. Ending a transaction modifies data only if it has write
+// intents to resolve.
+func isMutation(method string, args interface{}) bool {
+	if et, ok := args.(*storage.EndTransactionRequest); ok {
+		return len(et.Keys) > 0
+	}
+	return !readOnlyMethods[method]
+}
+
+// withCmdID returns a copy of args with a new client command ID set
+// in the header, if one isn't set already. The ID is fixed before any
+// retries, allowing ranges to recognize and skip duplicate
+// executions; the copy ensures reuse of args by the caller isn't
+// mistaken for a duplicate.
+func withCmdID(args storage.Request) storage.Request {
+	args = args.Clone()
+	if header := args.Header(); header.CmdID.IsEmpty() {
+		header.CmdID = storage.ClientCmdID{
+			WallTime: time.Now().UnixNano(),
+			Random:   rand.Int63(),
+		}
+	}
+	return args
+}
+
 // NewDB returns a key-value datastore client which connects to the
 // Cockroach cluster via the supplied gossip instance.
 func NewDB(gossip *gossip.Gossip) *DistDB {
-	return &DistDB{gossip: gossip}
+	return NewDBWithOptions(gossip, DistDBOptions{})
+}
+
+// NewDBWithOptions returns a key-value datastore client which
+// connects to the Cockroach cluster via the supplied gossip instance
+// and is configured according to opts.
+func NewDBWithOptions(gossip *gossip.Gossip, opts DistDBOptions) *DistDB {
+	// Copy the enabled features so that subsequent changes to opts
+	// don't affect, or race with, the DistDB.
+	experimental := map[string]bool{}
+	for feature, enabled := range opts.experimental {
+		experimental[feature] = enabled
+	}
+	opts.experimental = experimental
+	metrics := NewMetrics()
+	db := &DistDB{
+		gossip:  gossip,
+		metrics: metrics,
+		tracer:  metrics,
+		opts:    opts,
+		leaders: util.NewLRUCache(leaderCacheSize),
+		closer:  make(chan struct{}),
+		addrs:   map[string]net.Addr{},
+		txns:    newTxnWrites(storage.MaxTxnKeys, storage.MaxTxnBytes),
+		clock:   util.NewClock(util.UnixNano, 0),
+	}
+	if opts.FirstRangeTimeout > 0 {
+		if err := db.WaitForFirstRange(opts.FirstRangeTimeout); err != nil {
+			glog.Warningf("continuing without first range: %v", err)
+		}
+	}
+	if opts.FollowRangeChanges {
+		db.rangeCache = &rangeCache{}
+		db.rangeFeed = newRangeFeed(db)
+		go db.followRangeChanges(db.rangeFeed)
+	}
+	return db
+}
+
+// WaitForFirstRange blocks until the first range's metadata has been
+// gossiped, returning an error if it isn't available within timeout.
+func (db *DistDB) WaitForFirstRange(timeout time.Duration) error {
+	arrived := make(chan struct{}, 1)
+	unregister := db.gossip.RegisterCallback(gossip.KeyFirstRangeMetadata, func(_ string, val interface{}) {
+		if val != nil {
+			select {
+			case arrived <- struct{}{}:
+			default:
+			}
+		}
+	})
+	defer unregister()
+	select {
+	case <-arrived:
+		return nil
+	case <-time.After(timeout):
+		return firstRangeMissingErr{util.Errorf("first range metadata not gossiped within %s", timeout)}
+	}
+}
+
+// SetTracer sets a Tracer to receive events for requests sent by the
+// DistDB in addition to those aggregated in its Metrics. It must be
+// called before the DistDB is used.
+func (db *DistDB) SetTracer(t Tracer) {
+	db.tracer = multiTracer{db.metrics, t}
+}
+
+// SetClock sets the hybrid logical clock whose readings are sent with
+// requests, replacing the DistDB's own. Nodes share their clock with
+// their client, so that their requests to other nodes propagate it.
+// It must be called before the DistDB is used.
+func (db *DistDB) SetClock(clock *util.Clock) {
+	db.clock = clock
+}
+
+// updateClock updates the DistDB's clock with the clock reading of
+// the serving node in the reply.
+func (db *DistDB) updateClock(reply storage.Response) {
+	if err := db.clock.Update(reply.Header().ClockReading); err != nil {
+		glog.Warningf("ignoring reply clock reading: %v", err)
+	}
+}
+
+// Metrics returns the latencies and counts of requests sent by the
+// DistDB. The returned value is live and may be published via
+// expvar; use Metrics.Snapshot to inspect its fields.
+func (db *DistDB) Metrics() *Metrics {
+	return db.metrics
+}
+
+// Close shuts down the DistDB. Requests which haven't completed are
+// abandoned, their replies carrying a ClosedError, and those sent
+// after Close fail likewise without being sent. Once outstanding
+// requests have finished, the RPC client connections to the nodes
+// they were sent to are closed. Watchers aren't closed; their owners
+// must close them.
+func (db *DistDB) Close() {
+	db.closeMu.Lock()
+	if db.closed {
+		db.closeMu.Unlock()
+		return
+	}
+	db.closed = true
+	close(db.closer)
+	db.closeMu.Unlock()
+	if db.rangeFeed != nil {
+		db.rangeFeed.Close()
+	}
+	// Closing connections fails RPCs in flight, so that range lookups
+	// and sends don't wait for their timeouts.
+	db.closeClients()
+	db.wg.Wait()
+	db.closeClients()
+}
+
+// isClosed returns whether Close has been invoked.
+func (db *DistDB) isClosed() bool {
+	db.closeMu.Lock()
+	defer db.closeMu.Unlock()
+	return db.closed
+}
+
+// closeClients closes the client connections to nodes to which RPCs
+// have been sent.
+func (db *DistDB) closeClients() {
+	db.closeMu.Lock()
+	defer db.closeMu.Unlock()
+	for _, addr := range db.addrs {
+		rpc.CloseClient(addr)
+	}
+}
+
+// startRequest registers an outstanding request, which must be
+// completed via db.wg.Done. Returns false without registering if the
+// DistDB is closed.
+func (db *DistDB) startRequest() bool {
+	db.closeMu.Lock()
+	defer db.closeMu.Unlock()
+	if db.closed {
+		return false
+	}
+	db.wg.Add(1)
+	return true
 }
 
 func (db *DistDB) nodeIDToAddr(nodeID int32) (net.Addr, error) {
-	nodeIDKey := gossip.MakeNodeIDGossipKey(nodeID)
-	info, err := db.gossip.GetInfo(nodeIDKey)
-	if info == nil || err != nil {
+	addr, err := db.gossip.GetNodeAddr(nodeID)
+	if err != nil {
 		return nil, util.Errorf("Unable to lookup address for node: %v. Error: %v", nodeID, err)
 	}
-	return info.(net.Addr), nil
+	return addr, nil
 }
 
 // lookupRangeMetadataFirstLevel issues an InternalRangeLookup request
 // to the first-level range metadata table. This always chooses from
 // amongst the first range metadata replicas (these are gossipped).
 func (db *DistDB) lookupRangeMetadataFirstLevel(key storage.Key) (*storage.RangeLocations, error) {
-	info, err := db.gossip.GetInfo(gossip.KeyFirstRangeMetadata)
+	locations, err := storage.GetFirstRangeLocations(db.gossip)
 	if err != nil {
 		return nil, firstRangeMissingErr{err}
 	}
-	replicas := info.(storage.RangeLocations).Replicas
-	metadataKey := storage.MakeKey(storage.KeyMeta1Prefix, key)
+	replicas := locations.Replicas
+	reply, err := db.sendRangeLookup(replicas, storage.MakeKey(storage.KeyMeta1Prefix, key))
+	if err != nil {
+		return nil, err
+	}
+	return &reply.Locations, nil
+}
+
+// sendRangeLookup looks up metadataKey via the replicas of the range
+// holding it. A lookup answered by a replica which isn't the raft
+// leader or lease holder is redirected as the reply's error directs,
+// if possible; otherwise, the retryable error is returned.
+func (db *DistDB) sendRangeLookup(replicas []storage.Replica, metadataKey storage.Key) (*storage.InternalRangeLookupResponse, error) {
 	args := &storage.InternalRangeLookupRequest{Key: metadataKey}
 	replyChan := make(chan *storage.InternalRangeLookupResponse, len(replicas))
-	if err = db.sendRPC(replicas, "Node.InternalRangeLookup", args, replyChan); err != nil {
+	if err := db.sendRPC(replicas, "Node.InternalRangeLookup", args, replyChan); err != nil {
 		return nil, err
 	}
 	reply := <-replyChan
-	return &reply.Locations, nil
+	db.updateClock(reply)
+	if target, ok := redirectTarget(reply.Error); ok {
+		db.noteLeader(replicas, target)
+		replyChan = make(chan *storage.InternalRangeLookupResponse, 1)
+		if err := db.sendRPC([]storage.Replica{target}, "Node.InternalRangeLookup", args, replyChan); err != nil {
+			return nil, err
+		}
+		reply = <-replyChan
+		db.updateClock(reply)
+	}
+	if reply.Error != nil {
+		return nil, reply.Error
+	}
+	return reply, nil
 }
 
 // lookupRangeMetadata first looks up the specified key in the first
@@ -241,97 +686,381 @@ func (db *DistDB) lookupRangeMetadataFirstLevel(key storage.Key) (*storage.Range
 // second level of range metadata to yield the set of replicas where
 // the key resides. This process is retried in a loop until the key's
 // replicas are located or a non-retryable error is encountered.
+//
+// Range metadata keys always reside in the first range, whose
+// replicas are gossiped.
 func (db *DistDB) lookupRangeMetadata(key storage.Key) (*storage.RangeLocations, error) {
+	locations, _, err := db.lookupRange(key)
+	return locations, err
+}
+
+// lookupRange implements lookupRangeMetadata, additionally returning
+// the end key of the range. The end key of the first range, which
+// holds range metadata keys, isn't known and is returned nil. Ranges
+// are looked up in the range cache first, if the DistDB has one.
+func (db *DistDB) lookupRange(key storage.Key) (*storage.RangeLocations, storage.Key, error) {
+	if bytes.HasPrefix(key, storage.KeyMetaPrefix) {
+		locations, err := storage.GetFirstRangeLocations(db.gossip)
+		if err != nil {
+			return nil, nil, firstRangeMissingErr{err}
+		}
+		return &locations, nil, nil
+	}
+	var generation int64
+	if db.rangeCache != nil {
+		if locations, endKey, ok := db.rangeCache.lookup(key); ok {
+			return locations, endKey, nil
+		}
+		generation = db.rangeCache.currentGeneration()
+	}
 	firstLevelMeta, err := db.lookupRangeMetadataFirstLevel(key)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	metadataKey := storage.MakeKey(storage.KeyMeta2Prefix, key)
-	args := &storage.InternalRangeLookupRequest{Key: metadataKey}
-	replyChan := make(chan *storage.InternalRangeLookupResponse, len(firstLevelMeta.Replicas))
-	if err = db.sendRPC(firstLevelMeta.Replicas, "Node.InternalRangeLookup", args, replyChan); err != nil {
-		return nil, err
+	reply, err := db.sendRangeLookup(firstLevelMeta.Replicas, storage.MakeKey(storage.KeyMeta2Prefix, key))
+	if err != nil {
+		return nil, nil, err
 	}
-	reply := <-replyChan
-	return &reply.Locations, nil
+	endKey := bytes.TrimPrefix(reply.EndKey, storage.KeyMeta2Prefix)
+	if db.rangeCache != nil {
+		db.rangeCache.add(reply.Locations, endKey, generation)
+	}
+	return &reply.Locations, endKey, nil
 }
 
 // sendRPC sends one or more RPCs to replicas from the supplied
 // storage.Replica slice. First, replicas which have gossipped
 // addresses are corraled and then sent via rpc.Send, with requirement
 // that one RPC to a server must succeed.
-func (db *DistDB) sendRPC(replicas []storage.Replica, method string, args, replyChanI interface{}) error {
+func (db *DistDB) sendRPC(replicas []storage.Replica, method string, args storage.Request, replyChanI interface{}) error {
+	return db.sendRPCN(replicas, method, args, replyChanI, 1)
+}
+
+// sendRPCN is like sendRPC, but requires RPCs to n servers to
+// succeed.
+func (db *DistDB) sendRPCN(replicas []storage.Replica, method string, args storage.Request, replyChanI interface{}, n int) error {
 	if len(replicas) == 0 {
 		return util.Errorf("%s: replicas set is empty", method)
 	}
 	// Build a map from replica address (if gossipped) to args struct
 	// with replica set in header.
 	argsMap := map[net.Addr]interface{}{}
-	for _, replica := range replicas {
+	var order []net.Addr
+	for _, replica := range db.orderReplicas(replicas) {
 		addr, err := db.nodeIDToAddr(replica.NodeID)
 		if err != nil {
 			glog.V(1).Infof("node %d address is not gossipped", replica.NodeID)
 			continue
 		}
-		// Copy the args value and set the replica in the header.
-		argsVal := reflect.New(reflect.TypeOf(args).Elem())
-		reflect.Indirect(argsVal).Set(reflect.Indirect(reflect.ValueOf(args)))
-		reflect.Indirect(argsVal).FieldByName("Replica").Set(reflect.ValueOf(replica))
-		argsMap[addr] = argsVal.Interface()
+		if db.opts.ReplicaOrder != OrderRandom {
+			order = append(order, addr)
+		}
+		// Copy the args value and set the replica in the header, along
+		// with the client's default priority, user and client name if
+		// none were specified, its internal flag and, for reads, its
+		// read consistency.
+		replicaArgs := args.Clone()
+		replicaArgs.SetReplica(replica)
+		header := replicaArgs.Header()
+		if header.Priority == 0 {
+			header.Priority = db.opts.Priority
+		}
+		if header.User == "" {
+			header.User = db.opts.User
+		}
+		if header.Client == "" {
+			header.Client = db.opts.Client
+		}
+		if db.opts.Internal {
+			header.Internal = true
+		}
+		if followerReadMethods[method] {
+			db.setReadConsistency(header)
+		}
+		header.ClockReading = db.clock.Now()
+		argsMap[addr] = replicaArgs
 	}
 	if len(argsMap) == 0 {
 		return noNodeAddrsAvailErr{util.Errorf("%s: no replica node addresses available via gossip", method)}
 	}
+	db.closeMu.Lock()
+	if db.closed {
+		db.closeMu.Unlock()
+		return &ClosedError{Method: method}
+	}
+	for addr := range argsMap {
+		db.addrs[addr.String()] = addr
+	}
+	db.closeMu.Unlock()
 	rpcOpts := rpc.Options{
-		N:               1,
+		N:               n,
 		SendNextTimeout: defaultSendNextTimeout,
+		SendNext:        db.opts.SendNext,
 		Timeout:         defaultRPCTimeout,
+		Order:           order,
 	}
 	return rpc.Send(argsMap, method, replyChanI, rpcOpts)
 }
 
+// setReadConsistency sets the client's read consistency in header, if
+// it doesn't specify one, along with the MinTimestamp of BOUNDED reads
+// which don't specify one either.
+func (db *DistDB) setReadConsistency(header *storage.RequestHeader) {
+	if header.ReadConsistency == storage.CONSISTENT {
+		header.ReadConsistency = db.opts.ReadConsistency
+	}
+	if header.ReadConsistency == storage.BOUNDED && header.MinTimestamp == 0 {
+		header.MinTimestamp = db.clock.Now() - int64(db.opts.MaxStaleness)
+	}
+}
+
+// orderReplicas returns a copy of replicas, ordered according to the
+// DistDB's ReplicaOrder.
+func (db *DistDB) orderReplicas(replicas []storage.Replica) ReplicaSlice {
+	rs := append(ReplicaSlice(nil), replicas...)
+	switch db.opts.ReplicaOrder {
+	case OrderNearest:
+		rs.SortByLatency(func(replica storage.Replica) (time.Duration, bool) {
+			addr, err := db.nodeIDToAddr(replica.NodeID)
+			if err != nil {
+				return 0, false
+			}
+			return rpc.LatencyOf(addr)
+		})
+	case OrderLocality:
+		rs.SortByLocality(db.localityScore)
+	case OrderRoundRobin:
+		rs.Rotate(int(atomic.AddInt64(&db.roundRobin, 1)))
+	case OrderLeaderFirst:
+		rs.Shuffle()
+		db.leaderMu.Lock()
+		leader, ok := db.leaders.Get(replicaSetKey(replicas))
+		db.leaderMu.Unlock()
+		if ok {
+			if i := rs.FindReplica(leader.(storage.Replica).NodeID, leader.(storage.Replica).StoreID); i >= 0 {
+				rs.MoveToFront(i)
+			}
+		}
+	}
+	return rs
+}
+
+// localityScore returns 2 for replicas on nodes in the client's rack,
+// 1 for those in its datacenter and 0 for others, or for nodes whose
+// descriptors haven't been gossiped.
+func (db *DistDB) localityScore(replica storage.Replica) int {
+	if db.opts.Datacenter == "" {
+		return 0
+	}
+	desc, err := db.gossip.GetNodeDescriptor(replica.NodeID)
+	if err != nil || desc.Datacenter != db.opts.Datacenter {
+		return 0
+	}
+	if db.opts.Rack != "" && desc.Rack == db.opts.Rack {
+		return 2
+	}
+	return 1
+}
+
+// noteLeader records replica as having served a request for the range
+// with the specified replicas, for OrderLeaderFirst.
+func (db *DistDB) noteLeader(replicas []storage.Replica, replica storage.Replica) {
+	if db.opts.ReplicaOrder != OrderLeaderFirst {
+		return
+	}
+	db.leaderMu.Lock()
+	defer db.leaderMu.Unlock()
+	db.leaders.Add(replicaSetKey(replicas), replica)
+}
+
+// sendTracedRPC sends an RPC via sendRPC, tracing the attempt and the
+// replica which served it. On success, returns the reply, which is a
+// value of the element type of chanType. If the DistDB is closed
+// before the RPC completes, returns a ClosedError without waiting for
+// it.
+func (db *DistDB) sendTracedRPC(replicas []storage.Replica, method string, args storage.Request,
+	chanType reflect.Type) (storage.Response, error) {
+	start := time.Now()
+	replyChan := reflect.MakeChan(chanType, len(replicas))
+	errChan := make(chan error, 1)
+	// The caller's registration keeps Close waiting until the send
+	// finishes, so that connections it opens are released.
+	db.wg.Add(1)
+	go func() {
+		defer db.wg.Done()
+		errChan <- db.sendRPC(replicas, method, args, replyChan.Interface())
+	}()
+	var err error
+	select {
+	case err = <-errChan:
+	case <-db.closer:
+		err = &ClosedError{Method: method}
+	}
+	if err != nil {
+		db.tracer.RPC(method, storage.Replica{}, time.Since(start), err)
+		return nil, err
+	}
+	replyVal, _ := replyChan.Recv()
+	reply := replyVal.Interface().(storage.Response)
+	db.updateClock(reply)
+	header := reply.Header()
+	db.tracer.RPC(method, header.Replica, time.Since(start), header.Error)
+	if header.Error == nil {
+		db.noteLeader(replicas, header.Replica)
+	}
+	return reply, nil
+}
+
+// redirectTarget returns the replica to which a request refused with
+// err should be redirected: the raft leader for a NotLeaderError, if
+// known, or the lease holder for a NotLeaseHolderError.
+func redirectTarget(err error) (storage.Replica, bool) {
+	switch t := err.(type) {
+	case *storage.NotLeaderError:
+		if t.Leader != nil {
+			return *t.Leader, true
+		}
+	case *storage.NotLeaseHolderError:
+		return *t.LeaseHolder, true
+	}
+	return storage.Replica{}, false
+}
+
+// replyError returns the error set in the header of the reply.
+func replyError(reply storage.Response) error {
+	return reply.Header().Error
+}
+
 // routeRPC looks up the appropriate range based on the supplied key
 // and sends the RPC according to the specified options. routeRPC
 // sends asynchronously and returns a channel which receives the reply
 // struct when the call is complete. Returns a channel of the same
 // type as "reply".
-func (db *DistDB) routeRPC(key storage.Key, method string, args, reply interface{}) interface{} {
+func (db *DistDB) routeRPC(key storage.Key, method string, args storage.Request, reply storage.Response) interface{} {
+	return db.routeRPCForRead(key, method, args, reply, false)
+}
+
+// routeRPCForRead is routeRPC, but if forRead is true, the request is
+// sent on behalf of a read and so exempt from the refusal of
+// mutations by a read-only client; see resolveWriteIntent.
+func (db *DistDB) routeRPCForRead(key storage.Key, method string, args storage.Request, reply storage.Response, forRead bool) interface{} {
 	chanVal := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, reflect.TypeOf(reply)), 1)
+	started := db.startRequest()
 
 	go func() {
-		retryOpts := util.RetryOptions{
-			Tag:         fmt.Sprintf("routing %s rpc", method),
-			Backoff:     retryBackoff,
-			MaxBackoff:  maxRetryBackoff,
-			Constant:    2,
-			MaxAttempts: 0, // retry indefinitely
+		if started {
+			defer db.wg.Done()
+		}
+		start := time.Now()
+		var resp storage.Response
+		var err error
+		mutation := isMutation(method, args)
+		if mutation {
+			args = withCmdID(args)
+		}
+		if !started {
+			err = &ClosedError{Method: method}
+		} else if db.opts.ReadOnly && mutation && !forRead {
+			err = &ReadOnlyError{Method: method}
+		} else if feature, ok := experimentalMethods[method]; ok {
+			err = db.checkExperimental(feature)
+		}
+		if err == nil {
+			err = db.txns.admit(args)
 		}
-		err := util.RetryWithBackoff(retryOpts, func() (bool, error) {
-			rangeMeta, err := db.lookupRangeMetadata(key)
-			if err == nil {
-				err = db.sendRPC(rangeMeta.Replicas, method, args, chanVal.Interface())
+		if err == nil {
+			retryOpts := util.RetryOptions{
+				Tag:         fmt.Sprintf("routing %s rpc", method),
+				Backoff:     retryBackoff,
+				MaxBackoff:  maxRetryBackoff,
+				Constant:    2,
+				MaxAttempts: 0, // retry indefinitely
+				Stopper:     db.closer,
 			}
-			if err != nil {
-				// If retryable, allow outer loop to retry.
-				if retryErr, ok := err.(util.Retryable); ok && retryErr.CanRetry() {
-					glog.Warningf("failed to invoke %s: %v", method, err)
-					return false, nil
+			err = util.RetryWithBackoff(retryOpts, func() (bool, error) {
+				lookupStart := time.Now()
+				rangeMeta, err := db.lookupRangeMetadata(key)
+				db.tracer.RangeLookup(key, time.Since(lookupStart), err)
+				if err == nil {
+					resp, err = db.sendTracedRPC(rangeMeta.Replicas, method, args, chanVal.Type())
+				}
+				// A replica which isn't the raft leader redirects the
+				// request to the leader, if known, or to the replica
+				// holding the range's lease; if the leader is also
+				// unknown to it, the NotLeaderError is retried below.
+				if err == nil {
+					if target, ok := redirectTarget(replyError(resp)); ok {
+						db.noteLeader(rangeMeta.Replicas, target)
+						resp, err = db.sendTracedRPC([]storage.Replica{target}, method, args, chanVal.Type())
+					}
+				}
+				// A request blocked by another transaction's write intent
+				// pushes the transaction and, once it has ended, resolves
+				// the intent and resends the request.
+				for err == nil {
+					wiErr, ok := replyError(resp).(*storage.WriteIntentError)
+					if !ok {
+						break
+					}
+					if err = db.resolveWriteIntent(args, wiErr, !mutation); err == nil {
+						db.tracer.Retry(method, wiErr)
+						resp, err = db.sendTracedRPC(rangeMeta.Replicas, method, args, chanVal.Type())
+					}
 				}
-				// TODO(spencer): check error here; we need to clear this
-				// segment of range cache and retry if the range wasn't found.
+				if err == nil {
+					// Retryable errors in the reply, such as a busy node,
+					// are backed off and retried like failed sends.
+					if replyErr, ok := replyError(resp).(util.Retryable); ok && replyErr.CanRetry() {
+						err = replyErr.(error)
+					}
+				}
+				if ambErr := ambiguousResult(method, args, err); ambErr != nil {
+					return true, ambErr
+				}
+				if err != nil {
+					// The range may have moved; it's looked up afresh.
+					if db.rangeCache != nil {
+						db.rangeCache.evict(key)
+					}
+					// If retryable, allow outer loop to retry.
+					if retryErr, ok := err.(util.Retryable); ok && retryErr.CanRetry() {
+						glog.Warningf("failed to invoke %s: %v", method, err)
+						db.tracer.Retry(method, err)
+						// A throttling node's hint of when it will have
+						// capacity replaces the generic backoff.
+						if busyErr, ok := err.(*storage.ServerBusyError); ok && busyErr.RetryAfter > 0 {
+							return false, util.RetryAfter(busyErr.RetryAfter)
+						}
+						return false, nil
+					}
+				}
+				return true, err
+			})
+			if err != nil && db.isClosed() {
+				err = &ClosedError{Method: method}
 			}
-			return true, err
-		})
+			if ambErr, ok := err.(*AmbiguousResultError); ok {
+				verifyWrite(db.rawGet, args, ambErr)
+			}
+		}
 		if err != nil {
-			replyVal := reflect.ValueOf(reply)
-			reflect.Indirect(replyVal).FieldByName("Error").Set(reflect.ValueOf(err))
-			chanVal.Send(replyVal)
+			reply.Header().Error = err
+			resp = reply
 		}
+		db.tracer.Method(method, time.Since(start), replyError(resp))
+		chanVal.Send(reflect.ValueOf(resp))
 	}()
 
 	return chanVal.Interface()
 }
 
+// rawGet gets the value at the key as stored, without decompressing
+// it.
+func (db *DistDB) rawGet(args *storage.GetRequest) <-chan *storage.GetResponse {
+	return db.routeRPC(args.Key, "Node.Get",
+		args, &storage.GetResponse{}).(chan *storage.GetResponse)
+}
+
 // Contains checks for the existence of a key.
 func (db *DistDB) Contains(args *storage.ContainsRequest) <-chan *storage.ContainsResponse {
 	return db.routeRPC(args.Key, "Node.Contains",
@@ -340,12 +1069,21 @@ func (db *DistDB) Contains(args *storage.ContainsRequest) <-chan *storage.Contai
 
 // Get .
 func (db *DistDB) Get(args *storage.GetRequest) <-chan *storage.GetResponse {
+	if db.opts.QuorumReads {
+		return db.quorumGet(args)
+	}
+	if co := db.compression(&args.RequestHeader); co.Enabled() {
+		return db.compressedGet(args, co)
+	}
 	return db.routeRPC(args.Key, "Node.Get",
 		args, &storage.GetResponse{}).(chan *storage.GetResponse)
 }
 
 // Put .
 func (db *DistDB) Put(args *storage.PutRequest) <-chan *storage.PutResponse {
+	if co := db.compression(&args.RequestHeader); co.Enabled() {
+		args = db.compressPut(args, co)
+	}
 	return db.routeRPC(args.Key, "Node.Put",
 		args, &storage.PutResponse{}).(chan *storage.PutResponse)
 }
@@ -356,6 +1094,18 @@ func (db *DistDB) Increment(args *storage.IncrementRequest) <-chan *storage.Incr
 		args, &storage.IncrementResponse{}).(chan *storage.IncrementResponse)
 }
 
+// Append .
+func (db *DistDB) Append(args *storage.AppendRequest) <-chan *storage.AppendResponse {
+	return db.routeRPC(args.Key, "Node.Append",
+		args, &storage.AppendResponse{}).(chan *storage.AppendResponse)
+}
+
+// GetByteRange .
+func (db *DistDB) GetByteRange(args *storage.GetByteRangeRequest) <-chan *storage.GetByteRangeResponse {
+	return db.routeRPC(args.Key, "Node.GetByteRange",
+		args, &storage.GetByteRangeResponse{}).(chan *storage.GetByteRangeResponse)
+}
+
 // Delete .
 func (db *DistDB) Delete(args *storage.DeleteRequest) <-chan *storage.DeleteResponse {
 	return db.routeRPC(args.Key, "Node.Delete",
@@ -375,10 +1125,10 @@ func (db *DistDB) Scan(args *storage.ScanRequest) <-chan *storage.ScanResponse {
 	return nil
 }
 
-// EndTransaction .
+// EndTransaction is sent to the range holding the transaction's
+// record, which records its outcome.
 func (db *DistDB) EndTransaction(args *storage.EndTransactionRequest) <-chan *storage.EndTransactionResponse {
-	// TODO(spencer): multiple keys here...
-	return db.routeRPC(args.Keys[0], "Node.EndTransaction",
+	return db.routeRPC(storage.TxnRecordKey(args.TxID), "Node.EndTransaction",
 		args, &storage.EndTransactionResponse{}).(chan *storage.EndTransactionResponse)
 }
 
@@ -391,11 +1141,20 @@ func (db *DistDB) AccumulateTS(args *storage.AccumulateTSRequest) <-chan *storag
 		args, &storage.AccumulateTSResponse{}).(chan *storage.AccumulateTSResponse)
 }
 
-// ReapQueue scans and deletes messages from a recipient message
-// queue. ReapQueueRequest invocations must be part of an extant
-// transaction or they fail. Returns the reaped queue messsages, up to
-// the requested maximum. If fewer than the maximum were returned,
-// then the queue is empty.
+// GetTSBlock reads the time series accumulated by AccumulateTS at a
+// run of adjacent keys within a single range. See GetTSBlocks for
+// reading spans which cross ranges.
+func (db *DistDB) GetTSBlock(args *storage.GetTSBlockRequest) <-chan *storage.GetTSBlockResponse {
+	return db.routeRPC(args.StartKey, "Node.GetTSBlock",
+		args, &storage.GetTSBlockResponse{}).(chan *storage.GetTSBlockResponse)
+}
+
+// ReapQueue delivers messages from a recipient message queue, in the
+// order enqueued, hiding them from other reapers until their
+// visibility timeout elapses. Returns the reaped queue messages, up
+// to the requested maximum. If fewer than the maximum were returned,
+// then no more messages are visible. Messages must be acknowledged
+// via AckQueue once processed, or they're delivered again.
 func (db *DistDB) ReapQueue(args *storage.ReapQueueRequest) <-chan *storage.ReapQueueResponse {
 	return db.routeRPC(args.Inbox, "Node.ReapQueue",
 		args, &storage.ReapQueueResponse{}).(chan *storage.ReapQueueResponse)
@@ -412,3 +1171,168 @@ func (db *DistDB) EnqueueMessage(args *storage.EnqueueMessageRequest) <-chan *st
 	return db.routeRPC(args.Inbox, "Node.EnqueueMessage",
 		args, &storage.EnqueueMessageResponse{}).(chan *storage.EnqueueMessageResponse)
 }
+
+// AckQueue deletes reaped messages from a recipient message queue.
+func (db *DistDB) AckQueue(args *storage.AckQueueRequest) <-chan *storage.AckQueueResponse {
+	return db.routeRPC(args.Inbox, "Node.AckQueue",
+		args, &storage.AckQueueResponse{}).(chan *storage.AckQueueResponse)
+}
+
+// InternalBulkWrite writes the leading rows of args.Rows which fall
+// within the range containing the first row. See BulkWriter. A request
+// without rows writes nothing and isn't sent.
+func (db *DistDB) InternalBulkWrite(args *storage.InternalBulkWriteRequest) <-chan *storage.InternalBulkWriteResponse {
+	if len(args.Rows) == 0 {
+		replyChan := make(chan *storage.InternalBulkWriteResponse, 1)
+		replyChan <- &storage.InternalBulkWriteResponse{}
+		return replyChan
+	}
+	return db.routeRPC(args.Rows[0].Key, "Node.InternalBulkWrite",
+		args, &storage.InternalBulkWriteResponse{}).(chan *storage.InternalBulkWriteResponse)
+}
+
+// InternalPushTxn pushes the transaction whose record is at args.Key
+// on behalf of a request blocked by one of its write intents.
+func (db *DistDB) InternalPushTxn(args *storage.InternalPushTxnRequest) <-chan *storage.InternalPushTxnResponse {
+	return db.routeRPC(args.Key, "Node.InternalPushTxn",
+		args, &storage.InternalPushTxnResponse{}).(chan *storage.InternalPushTxnResponse)
+}
+
+// InternalResolveIntent resolves the write intent on args.Key of an
+// ended transaction.
+func (db *DistDB) InternalResolveIntent(args *storage.InternalResolveIntentRequest) <-chan *storage.InternalResolveIntentResponse {
+	return db.routeRPC(args.Key, "Node.InternalResolveIntent",
+		args, &storage.InternalResolveIntentResponse{}).(chan *storage.InternalResolveIntentResponse)
+}
+
+// InternalTxnResolved marks the write intents of an ended transaction
+// resolved, so that its record may be garbage collected.
+func (db *DistDB) InternalTxnResolved(args *storage.InternalTxnResolvedRequest) <-chan *storage.InternalTxnResolvedResponse {
+	return db.routeRPC(args.Key, "Node.InternalTxnResolved",
+		args, &storage.InternalTxnResolvedResponse{}).(chan *storage.InternalTxnResolvedResponse)
+}
+
+// resolveWriteIntent pushes the transaction whose write intent,
+// described by wiErr, blocked the request args and, once the
+// transaction has ended, resolves the intent so the request may be
+// retried. The push aborts the transaction if the request's
+// transaction priority is higher; otherwise it fails with a
+// retryable TransactionPushError, and is retried until the
+// transaction ends. If forRead is true, args is a read, which even a
+// read-only client may complete by pushing and resolving.
+func (db *DistDB) resolveWriteIntent(args storage.Request, wiErr *storage.WriteIntentError, forRead bool) error {
+	header := args.Header()
+	pushArgs := &storage.InternalPushTxnRequest{
+		RequestHeader:   storage.RequestHeader{TxnPriority: header.TxnPriority},
+		Key:             storage.TxnRecordKey(wiErr.TxnID),
+		PusheeTxID:      wiErr.TxnID,
+		PusheePriority:  wiErr.TxnPriority,
+		PusheeTimestamp: wiErr.Timestamp,
+	}
+	start := time.Now()
+	pushReply := <-db.routeRPCForRead(pushArgs.Key, "Node.InternalPushTxn",
+		pushArgs, &storage.InternalPushTxnResponse{}, forRead).(chan *storage.InternalPushTxnResponse)
+	db.tracer.Push(wiErr.TxnID, time.Since(start), pushReply.Pushee.Status, pushReply.Error)
+	if pushReply.Error != nil {
+		return pushReply.Error
+	}
+	resolveArgs := &storage.InternalResolveIntentRequest{
+		Key:        wiErr.Key,
+		IntentTxID: wiErr.TxnID,
+		Commit:     pushReply.Pushee.Status == storage.TxnCommitted,
+	}
+	resolveReply := <-db.routeRPCForRead(resolveArgs.Key, "Node.InternalResolveIntent",
+		resolveArgs, &storage.InternalResolveIntentResponse{}, forRead).(chan *storage.InternalResolveIntentResponse)
+	return resolveReply.Error
+}
+
+// InternalWatch polls for change events from the range containing
+// args.StartKey. See Watch.
+func (db *DistDB) InternalWatch(args *storage.InternalWatchRequest) <-chan *storage.InternalWatchResponse {
+	return db.routeRPC(args.StartKey, "Node.InternalWatch",
+		args, &storage.InternalWatchResponse{}).(chan *storage.InternalWatchResponse)
+}
+
+// Watch returns a Watcher which delivers change events for keys in
+// [start, end), following the span across range splits.
+func (db *DistDB) Watch(start, end storage.Key) *Watcher {
+	return newWatcher(db, start, end)
+}
+
+// InternalResolvedTimestamp returns the resolved timestamp of the
+// range containing args.Key. See SafeTimestamp.
+func (db *DistDB) InternalResolvedTimestamp(args *storage.InternalResolvedTimestampRequest) <-chan *storage.InternalResolvedTimestampResponse {
+	return db.routeRPC(args.Key, "Node.InternalResolvedTimestamp",
+		args, &storage.InternalResolvedTimestampResponse{}).(chan *storage.InternalResolvedTimestampResponse)
+}
+
+// AdminSplit splits the range containing args.SplitKey at that key.
+// The split is coordinated by the node holding the range.
+func (db *DistDB) AdminSplit(args *storage.AdminSplitRequest) <-chan *storage.AdminSplitResponse {
+	return db.routeRPC(args.SplitKey, "Node.AdminSplit",
+		args, &storage.AdminSplitResponse{}).(chan *storage.AdminSplitResponse)
+}
+
+// AdminMerge merges the range containing args.Key with the range
+// which immediately follows it. The merge is coordinated by the node
+// holding the range.
+func (db *DistDB) AdminMerge(args *storage.AdminMergeRequest) <-chan *storage.AdminMergeResponse {
+	return db.routeRPC(args.Key, "Node.AdminMerge",
+		args, &storage.AdminMergeResponse{}).(chan *storage.AdminMergeResponse)
+}
+
+// AdminTransferLease transfers the lease of the range containing
+// args.Key to args.Target. The request is routed to the lease holder.
+func (db *DistDB) AdminTransferLease(args *storage.AdminTransferLeaseRequest) <-chan *storage.AdminTransferLeaseResponse {
+	return db.routeRPC(args.Key, "Node.AdminTransferLease",
+		args, &storage.AdminTransferLeaseResponse{}).(chan *storage.AdminTransferLeaseResponse)
+}
+
+// AdminCompact compacts the span from args.StartKey to args.EndKey of
+// the range containing args.StartKey. Unlike other requests, it's sent
+// to every replica of the range, as each compacts its own storage; the
+// reply carries the first error of any replica.
+func (db *DistDB) AdminCompact(args *storage.AdminCompactRequest) <-chan *storage.AdminCompactResponse {
+	replyChan := make(chan *storage.AdminCompactResponse, 1)
+	go func() {
+		start := time.Now()
+		reply := db.compactReplicas(args)
+		db.tracer.Method("Node.AdminCompact", time.Since(start), reply.Error)
+		replyChan <- reply
+	}()
+	return replyChan
+}
+
+// compactReplicas sends args to each replica of the range containing
+// args.StartKey and combines their replies.
+func (db *DistDB) compactReplicas(args *storage.AdminCompactRequest) *storage.AdminCompactResponse {
+	method := "Node.AdminCompact"
+	reply := &storage.AdminCompactResponse{}
+	if !db.startRequest() {
+		reply.Error = &ClosedError{Method: method}
+		return reply
+	}
+	defer db.wg.Done()
+	rangeMeta, err := db.lookupRangeMetadata(args.StartKey)
+	if err != nil {
+		reply.Error = err
+		return reply
+	}
+	replicas := rangeMeta.Replicas
+	replyChan := make(chan *storage.AdminCompactResponse, len(replicas))
+	if err := db.sendRPCN(replicas, method, args, replyChan, len(replicas)); err != nil {
+		reply.Error = err
+		return reply
+	}
+	for range replicas {
+		r := <-replyChan
+		db.updateClock(r)
+		if r.Error != nil && reply.Error == nil {
+			reply.Error = r.Error
+		}
+		if r.RowsCompacted > reply.RowsCompacted {
+			reply.RowsCompacted = r.RowsCompacted
+		}
+	}
+	return reply
+}
@@ -0,0 +1,220 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// TestReadOnlyClient verifies a read-only client fails mutations
+// with a ReadOnlyError without sending them.
+func TestReadOnlyClient(t *testing.T) {
+	db := NewDBWithOptions(gossip.New(), DistDBOptions{ReadOnly: true})
+	putReply := <-db.Put(&storage.PutRequest{Key: storage.Key("a")})
+	if _, ok := putReply.Error.(*ReadOnlyError); !ok {
+		t.Errorf("expected read-only error; got %v", putReply.Error)
+	}
+	incReply := <-db.Increment(&storage.IncrementRequest{Key: storage.Key("a"), Increment: 1})
+	if _, ok := incReply.Error.(*ReadOnlyError); !ok {
+		t.Errorf("expected read-only error; got %v", incReply.Error)
+	}
+}
+
+// TestIsMutation verifies classification of methods which modify data.
+func TestIsMutation(t *testing.T) {
+	testCases := []struct {
+		method string
+		args   interface{}
+		expMut bool
+	}{
+		{"Node.Get", &storage.GetRequest{}, false},
+		{"Node.Scan", &storage.ScanRequest{}, false},
+		{"Node.Put", &storage.PutRequest{}, true},
+		{"Node.EnqueueMessage", &storage.EnqueueMessageRequest{}, true},
+		{"Node.EndTransaction", &storage.EndTransactionRequest{}, false},
+		{"Node.EndTransaction", &storage.EndTransactionRequest{Keys: []storage.Key{storage.Key("a")}}, true},
+		{"Node.Unknown", &storage.GetRequest{}, true},
+	}
+	for i, test := range testCases {
+		if mut := isMutation(test.method, test.args); mut != test.expMut {
+			t.Errorf("%d: expected %s mutation=%t; got %t", i, test.method, test.expMut, mut)
+		}
+	}
+}
+
+// TestSetReadConsistency verifies the client's read consistency is set
+// in headers which don't specify one, with the MinTimestamp of
+// BOUNDED reads trailing the client's clock by MaxStaleness.
+func TestSetReadConsistency(t *testing.T) {
+	db := NewDBWithOptions(gossip.New(), DistDBOptions{ReadConsistency: storage.BOUNDED, MaxStaleness: 10 * time.Second})
+	defer db.Close()
+	header := &storage.RequestHeader{}
+	before := time.Now().UnixNano()
+	db.setReadConsistency(header)
+	if header.ReadConsistency != storage.BOUNDED {
+		t.Errorf("expected bounded read; got %d", header.ReadConsistency)
+	}
+	if min := header.MinTimestamp; min < before-int64(10*time.Second) || min > time.Now().UnixNano()-int64(10*time.Second) {
+		t.Errorf("expected min timestamp to trail the clock by 10s; got %d", min)
+	}
+	header = &storage.RequestHeader{ReadConsistency: storage.INCONSISTENT}
+	db.setReadConsistency(header)
+	if header.ReadConsistency != storage.INCONSISTENT || header.MinTimestamp != 0 {
+		t.Errorf("expected header's own consistency kept; got %+v", header)
+	}
+}
+
+// TestWaitForFirstRange verifies clients may wait, up to a deadline,
+// for the first range to be gossiped.
+func TestWaitForFirstRange(t *testing.T) {
+	g := gossip.New()
+	db := NewDBWithOptions(g, DistDBOptions{FirstRangeTimeout: 10 * time.Millisecond})
+	if err := db.WaitForFirstRange(10 * time.Millisecond); err == nil {
+		t.Error("expected error waiting for first range")
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		if err := g.AddInfo(gossip.KeyFirstRangeMetadata, storage.RangeLocations{}, time.Hour); err != nil {
+			t.Error(err)
+		}
+	}()
+	if err := db.WaitForFirstRange(time.Second); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestWarmUpWithoutFirstRange verifies warming up fails promptly if
+// ranges can't be resolved.
+func TestWarmUpWithoutFirstRange(t *testing.T) {
+	db := NewDB(gossip.New())
+	defer db.Close()
+	if _, err := db.WarmUp([]KeySpan{{storage.Key("a"), storage.Key("b")}}, time.Second); err == nil {
+		t.Error("expected error warming up without first range")
+	}
+}
+
+// TestDistDBBulkWriteNoRows verifies a bulk write without rows writes
+// nothing rather than being routed.
+func TestDistDBBulkWriteNoRows(t *testing.T) {
+	db := NewDB(gossip.New())
+	defer db.Close()
+	select {
+	case reply := <-db.InternalBulkWrite(&storage.InternalBulkWriteRequest{}):
+		if reply.Error != nil || reply.Written != 0 {
+			t.Errorf("expected nothing written; got %d written, %v", reply.Written, reply.Error)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("bulk write without rows was routed")
+	}
+}
+
+// TestDistDBClose verifies closing a DistDB abandons requests which
+// are being retried and refuses requests sent afterwards.
+func TestDistDBClose(t *testing.T) {
+	db := NewDB(gossip.New())
+	// Without the first range gossiped, the request retries until the
+	// DistDB is closed.
+	replyChan := db.Get(&storage.GetRequest{Key: storage.Key("a")})
+	time.Sleep(10 * time.Millisecond)
+	db.Close()
+	select {
+	case reply := <-replyChan:
+		if _, ok := reply.Error.(*ClosedError); !ok {
+			t.Errorf("expected closed error; got %v", reply.Error)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request not abandoned by close")
+	}
+	reply := <-db.Put(&storage.PutRequest{Key: storage.Key("a")})
+	if _, ok := reply.Error.(*ClosedError); !ok {
+		t.Errorf("expected closed error; got %v", reply.Error)
+	}
+	// Closing again is a no-op.
+	db.Close()
+}
+
+// TestGetAtI verifies reads at a timestamp return the version current
+// at that time, including versions superseded since, and nothing
+// before the key was written.
+func TestGetAtI(t *testing.T) {
+	db := newTestLocalDB(storage.KeyMax)
+	key := storage.Key("a")
+	var timestamps []int64
+	for _, v := range []string{"v1", "v2"} {
+		if err := PutI(db, key, v); err != nil {
+			t.Fatal(err)
+		}
+		var value string
+		ok, ts, err := GetI(db, key, &value)
+		if !ok || err != nil || value != v {
+			t.Fatalf("expected to read %q; got %t, %q, %v", v, ok, value, err)
+		}
+		timestamps = append(timestamps, ts)
+	}
+	for i, exp := range []string{"v1", "v2"} {
+		var value string
+		if ok, ts, err := GetAtI(db, key, &value, timestamps[i]); !ok || err != nil || value != exp || ts != timestamps[i] {
+			t.Errorf("expected %q at %d; got %t, %q at %d, %v", exp, timestamps[i], ok, value, ts, err)
+		}
+	}
+	var value string
+	if ok, _, err := GetAtI(db, key, &value, timestamps[1]-1); !ok || err != nil || value != "v1" {
+		t.Errorf("expected superseded version before the latest write; got %t, %q, %v", ok, value, err)
+	}
+	if ok, _, err := GetAtI(db, key, &value, timestamps[0]-1); ok || err != nil {
+		t.Errorf("expected no value before the first write; got %t, %v", ok, err)
+	}
+}
+
+// TestUpdateRangeLocations verifies meta1 records are written along
+// with meta2 records for ranges holding meta2 keys.
+func TestUpdateRangeLocations(t *testing.T) {
+	locations := storage.RangeLocations{StartKey: storage.KeyMin, Replicas: []storage.Replica{{NodeID: 1}}}
+	testCases := []struct {
+		start, end storage.Key
+		meta1Key   storage.Key // Empty if no meta1 record is expected
+	}{
+		{storage.Key("a"), storage.Key("b"), nil},
+		{storage.KeyMin, storage.Key("a"), storage.MakeKey(storage.KeyMeta1Prefix, storage.KeyMax)},
+		{storage.KeyMin, storage.MakeKey(storage.KeyMeta2Prefix, storage.Key("m")), storage.MakeKey(storage.KeyMeta1Prefix, storage.Key("m"))},
+	}
+	for i, test := range testCases {
+		db := newTestLocalDB(storage.KeyMax)
+		meta := storage.RangeMetadata{RangeID: 1, StartKey: test.start, EndKey: test.end}
+		if err := UpdateRangeLocations(db, meta, locations); err != nil {
+			t.Fatal(err)
+		}
+		var stored storage.RangeLocations
+		if ok, _, err := GetI(db, storage.MakeKey(storage.KeyMeta2Prefix, test.end), &stored); !ok || err != nil {
+			t.Errorf("%d: expected meta2 record; got %t, %v", i, ok, err)
+		}
+		meta1 := <-db.Scan(&storage.ScanRequest{StartKey: storage.KeyMeta1Prefix,
+			EndKey: storage.PrefixEndKey(storage.KeyMeta1Prefix), MaxResults: 10})
+		if meta1.Error != nil {
+			t.Fatal(meta1.Error)
+		}
+		if test.meta1Key == nil && len(meta1.Rows) != 0 {
+			t.Errorf("%d: expected no meta1 record; got %q", i, meta1.Rows[0].Key)
+		} else if test.meta1Key != nil && (len(meta1.Rows) != 1 || !bytes.Equal(meta1.Rows[0].Key, test.meta1Key)) {
+			t.Errorf("%d: expected meta1 record %q; got %v", i, test.meta1Key, meta1.Rows)
+		}
+	}
+}
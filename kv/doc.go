@@ -27,6 +27,12 @@ Package kv implements the logic necessary to locate appropriate nodes
 based on keys being read or written. In some cases, requests may span
 a range of keys, in which case multiple RPCs may be sent out.
 
+Clients choose between two modes of routing. A ProxyDB is a thin
+client which sends every request to any one of a set of gateway
+nodes; the gateway locates the range and forwards the request. A
+DistDB is a smart client which locates ranges itself, saving the
+extra hop at the cost of joining the gossip network.
+
 The API is asynchronous and meant to be exploited as such. If an
 operation requires fetching multiple keys to satisfy a computation,
 they should be fetched in parallel and only when all are in flight
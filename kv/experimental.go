@@ -0,0 +1,113 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/cockroachdb/cockroach/gossip"
+)
+
+// experimentalFeatures maps each experimental feature to the minimum
+// cluster version (see storage.ClusterVersion) which supports it.
+// Request types and behaviors which are not yet stable are registered
+// here as they're added; they ship disabled and must be explicitly
+// enabled per client via DistDBOptions.EnableExperimental.
+var experimentalFeatures = map[string]int{
+	FeatureAppend:     2,
+	FeatureTimeSeries: 3,
+}
+
+// experimentalMethods maps RPC methods which are experimental to the
+// feature which must be enabled to send them.
+var experimentalMethods = map[string]string{
+	"Node.Append":       FeatureAppend,
+	"Node.GetByteRange": FeatureAppend,
+	"Node.GetTSBlock":   FeatureTimeSeries,
+}
+
+// FeatureAppend is the experimental feature enabling Append and
+// GetByteRange.
+const FeatureAppend = "append"
+
+// FeatureTimeSeries is the experimental feature enabling GetTSBlock,
+// and so the reads of time series by GetTSBlocks and QueryTimeSeries.
+// AccumulateTS predates the feature and isn't gated by it.
+const FeatureTimeSeries = "timeseries"
+
+// ExperimentalFeatures returns the sorted names of all experimental
+// features known to this client.
+func ExperimentalFeatures() []string {
+	var features []string
+	for feature := range experimentalFeatures {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+	return features
+}
+
+// An ExperimentalFeatureError indicates an experimental feature was
+// used without being enabled or isn't supported by the cluster.
+type ExperimentalFeatureError struct {
+	Feature string
+	Reason  string
+}
+
+// Error implements the error interface.
+func (e *ExperimentalFeatureError) Error() string {
+	return fmt.Sprintf("experimental feature %q unavailable: %s", e.Feature, e.Reason)
+}
+
+// EnableExperimental enables the named experimental feature for
+// clients created with these options. Returns an error if the
+// feature is unknown.
+func (opts *DistDBOptions) EnableExperimental(feature string) error {
+	if _, ok := experimentalFeatures[feature]; !ok {
+		return &ExperimentalFeatureError{Feature: feature, Reason: "unknown feature"}
+	}
+	if opts.experimental == nil {
+		opts.experimental = map[string]bool{}
+	}
+	opts.experimental[feature] = true
+	return nil
+}
+
+// checkExperimental returns an error if the named feature is not
+// enabled for this client or if the cluster version, as gossiped by
+// the first range, predates the feature.
+func (db *DistDB) checkExperimental(feature string) error {
+	if !db.opts.experimental[feature] {
+		return &ExperimentalFeatureError{Feature: feature, Reason: "not enabled for client"}
+	}
+	info, err := db.gossip.GetInfo(gossip.KeyClusterVersion)
+	if err != nil {
+		return &ExperimentalFeatureError{Feature: feature, Reason: "cluster version unknown"}
+	}
+	if version, minVersion := info.(int), experimentalFeatures[feature]; version < minVersion {
+		return &ExperimentalFeatureError{
+			Feature: feature,
+			Reason:  fmt.Sprintf("cluster version %d; requires %d", version, minVersion),
+		}
+	}
+	return nil
+}
+
+// Experimental returns whether the named experimental feature is
+// enabled for this client and supported by the cluster.
+func (db *DistDB) Experimental(feature string) bool {
+	return db.checkExperimental(feature) == nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// testFeature is an experimental feature registered for the duration
+// of a test by registerTestFeature.
+const testFeature = "test-feature"
+
+// registerTestFeature registers testFeature, supported from cluster
+// version 1, and returns a function which unregisters it.
+func registerTestFeature() func() {
+	experimentalFeatures[testFeature] = 1
+	return func() { delete(experimentalFeatures, testFeature) }
+}
+
+// TestEnableExperimental verifies only known features may be enabled.
+func TestEnableExperimental(t *testing.T) {
+	defer registerTestFeature()()
+	opts := DistDBOptions{}
+	if err := opts.EnableExperimental("no-such-feature"); err == nil {
+		t.Error("expected error enabling unknown feature")
+	}
+	for _, feature := range ExperimentalFeatures() {
+		if err := opts.EnableExperimental(feature); err != nil {
+			t.Errorf("unable to enable feature %q: %v", feature, err)
+		}
+	}
+}
+
+// TestCheckExperimental verifies experimental features are available
+// only when enabled and supported by the gossiped cluster version.
+func TestCheckExperimental(t *testing.T) {
+	defer registerTestFeature()()
+	g := gossip.New()
+	opts := DistDBOptions{}
+	if err := opts.EnableExperimental(testFeature); err != nil {
+		t.Fatal(err)
+	}
+	db := NewDBWithOptions(g, opts)
+	// Changes to opts after creation don't affect the DistDB.
+	opts.experimental[testFeature] = false
+	disabledDB := NewDB(g)
+
+	// Cluster version hasn't been gossiped.
+	if db.Experimental(testFeature) {
+		t.Error("expected feature unavailable without cluster version")
+	}
+	// Cluster version predates feature.
+	if err := g.AddInfo(gossip.KeyClusterVersion, 0, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if db.Experimental(testFeature) {
+		t.Error("expected feature unavailable with old cluster version")
+	}
+	if err := g.AddInfo(gossip.KeyClusterVersion, storage.ClusterVersion, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if !db.Experimental(testFeature) {
+		t.Error("expected feature available")
+	}
+	if disabledDB.Experimental(testFeature) {
+		t.Error("expected feature unavailable for client which didn't enable it")
+	}
+}
+
+// TestExperimentalMethodGating verifies experimental methods fail
+// with an ExperimentalFeatureError unless enabled.
+func TestExperimentalMethodGating(t *testing.T) {
+	defer registerTestFeature()()
+	experimentalMethods["Node.Experiment"] = testFeature
+	defer delete(experimentalMethods, "Node.Experiment")
+
+	db := NewDB(gossip.New())
+	reply := <-db.routeRPC(storage.Key("a"), "Node.Experiment",
+		&storage.GetRequest{}, &storage.GetResponse{}).(chan *storage.GetResponse)
+	if _, ok := reply.Error.(*ExperimentalFeatureError); !ok {
+		t.Errorf("expected experimental feature error; got %v", reply.Error)
+	}
+	// The rejected request is traced like any other failure.
+	if mm, ok := db.Metrics().Snapshot().Methods["Node.Experiment"]; !ok || mm.Errors != 1 {
+		t.Errorf("expected failed request in metrics; got %+v", mm)
+	}
+}
+
+// TestTimeSeriesGating verifies FeatureTimeSeries gates reads of time
+// series blocks but not AccumulateTS, which predates it.
+func TestTimeSeriesGating(t *testing.T) {
+	if feature := experimentalMethods["Node.GetTSBlock"]; feature != FeatureTimeSeries {
+		t.Errorf("expected GetTSBlock gated by %q; got %q", FeatureTimeSeries, feature)
+	}
+	if feature, ok := experimentalMethods["Node.AccumulateTS"]; ok {
+		t.Errorf("expected AccumulateTS ungated; got %q", feature)
+	}
+}
@@ -0,0 +1,376 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/golang/glog"
+)
+
+// Default failover timings.
+const (
+	defaultFailoverAfter = 30 * time.Second
+	defaultReplyTimeout  = 5 * time.Second
+)
+
+// FailoverOptions configures when a FailoverDB fails over to its
+// standby.
+type FailoverOptions struct {
+	// FailoverAfter is how long the primary must remain unreachable
+	// before reads are served by the standby. Defaults to 30s.
+	FailoverAfter time.Duration
+	// ReplyTimeout is how long a request may await the primary's reply
+	// before the primary is considered unreachable. Defaults to 5s.
+	ReplyTimeout time.Duration
+	// OnModeChange, if not nil, is invoked with true when the DB fails
+	// over to the standby and with false when it returns to the
+	// primary.
+	OnModeChange func(degraded bool)
+}
+
+// A DegradedError indicates that a FailoverDB refused a write because
+// the primary has been unreachable since Since and reads are being
+// served by the standby.
+type DegradedError struct {
+	Method string
+	Since  time.Time
+}
+
+// Error implements the error interface.
+func (e *DegradedError) Error() string {
+	return fmt.Sprintf("%s refused: primary unreachable since %s; serving reads from standby",
+		e.Method, e.Since.Format(time.RFC3339))
+}
+
+// A FailoverDB sends requests to a primary DB, failing over to a
+// standby DB, such as a DistDB gossiping with a secondary seed list
+// or a standby cluster, if the primary is unreachable for longer than
+// FailoverOptions.FailoverAfter. The primary is unreachable while
+// its replies take longer than FailoverOptions.ReplyTimeout; any
+// reply, even an error, shows it's reachable.
+//
+// While failed over, the DB is degraded: reads are served by the
+// standby, whose data may be stale, and writes fail with a
+// DegradedError without being sent. A probe of the primary detects
+// its recovery, after which requests return to it. Applications learn
+// of the degraded mode via Degraded, FailoverOptions.OnModeChange and
+// the errors of refused writes. Watches are always served by the
+// primary.
+type FailoverDB struct {
+	primary, standby DB
+	opts             FailoverOptions
+
+	mu               sync.Mutex
+	unreachableSince time.Time // Zero while the primary is reachable
+	degraded         bool
+}
+
+// NewFailoverDB returns a FailoverDB which fails over from primary to
+// standby according to opts.
+func NewFailoverDB(primary, standby DB, opts FailoverOptions) *FailoverDB {
+	if opts.FailoverAfter <= 0 {
+		opts.FailoverAfter = defaultFailoverAfter
+	}
+	if opts.ReplyTimeout <= 0 {
+		opts.ReplyTimeout = defaultReplyTimeout
+	}
+	return &FailoverDB{primary: primary, standby: standby, opts: opts}
+}
+
+// Degraded returns whether reads are being served by the standby and,
+// if so, the time since which the primary has been unreachable.
+func (f *FailoverDB) Degraded() (bool, time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.degraded, f.unreachableSince
+}
+
+// noteUnreachable records that the primary failed to reply in time,
+// failing over to the standby once it's been unreachable for
+// FailoverAfter.
+func (f *FailoverDB) noteUnreachable() {
+	f.mu.Lock()
+	now := time.Now()
+	if f.unreachableSince.IsZero() {
+		f.unreachableSince = now
+	}
+	failover := !f.degraded && now.Sub(f.unreachableSince) >= f.opts.FailoverAfter
+	if failover {
+		f.degraded = true
+		glog.Warningf("primary unreachable since %s; failing over to standby for reads", f.unreachableSince)
+	}
+	f.mu.Unlock()
+	if failover {
+		go f.probe()
+		if f.opts.OnModeChange != nil {
+			f.opts.OnModeChange(true)
+		}
+	}
+}
+
+// noteReachable records a reply from the primary, returning to it if
+// failed over.
+func (f *FailoverDB) noteReachable() {
+	f.mu.Lock()
+	f.unreachableSince = time.Time{}
+	recovered := f.degraded
+	if recovered {
+		f.degraded = false
+		glog.Infof("primary reachable; returning from standby")
+	}
+	f.mu.Unlock()
+	if recovered && f.opts.OnModeChange != nil {
+		f.opts.OnModeChange(false)
+	}
+}
+
+// probe sends a request to the primary while failed over, noting it
+// reachable once the request completes. The primary retries the
+// request until it's reachable.
+func (f *FailoverDB) probe() {
+	<-f.primary.Contains(&storage.ContainsRequest{Key: storage.KeyMin})
+	f.noteReachable()
+}
+
+// await returns a channel, of the same type as primaryChan, which
+// receives the primary's reply. The primary is noted unreachable each
+// time ReplyTimeout elapses without a reply. If standby is not nil
+// and the DB fails over while awaiting the reply, the reply sent by
+// standby is received instead.
+func (f *FailoverDB) await(primaryChan interface{}, standby func() interface{}) interface{} {
+	primaryVal := reflect.ValueOf(primaryChan)
+	chanVal := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, primaryVal.Type().Elem()), 1)
+	go func() {
+		for {
+			timer := time.NewTimer(f.opts.ReplyTimeout)
+			chosen, reply, _ := reflect.Select([]reflect.SelectCase{
+				{Dir: reflect.SelectRecv, Chan: primaryVal},
+				{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(timer.C)},
+			})
+			timer.Stop()
+			if chosen == 0 {
+				f.noteReachable()
+				chanVal.Send(reply)
+				return
+			}
+			f.noteUnreachable()
+			if degraded, _ := f.Degraded(); degraded && standby != nil {
+				reply, _ := reflect.ValueOf(standby()).Recv()
+				chanVal.Send(reply)
+				return
+			}
+		}
+	}()
+	return chanVal.Interface()
+}
+
+// read sends a read to the standby if failed over and otherwise to
+// the primary, falling back to the standby if the DB fails over while
+// awaiting the primary's reply.
+func (f *FailoverDB) read(primary, standby func() interface{}) interface{} {
+	if degraded, _ := f.Degraded(); degraded {
+		return standby()
+	}
+	return f.await(primary(), standby)
+}
+
+// write sends a write to the primary unless failed over, in which
+// case reply is sent carrying a DegradedError.
+func (f *FailoverDB) write(method string, reply interface{}, primary func() interface{}) interface{} {
+	degraded, since := f.Degraded()
+	if !degraded {
+		return f.await(primary(), nil)
+	}
+	replyVal := reflect.ValueOf(reply)
+	reflect.Indirect(replyVal).FieldByName("Error").Set(reflect.ValueOf(&DegradedError{Method: method, Since: since}))
+	chanVal := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, replyVal.Type()), 1)
+	chanVal.Send(replyVal)
+	return chanVal.Interface()
+}
+
+// Contains is a read.
+func (f *FailoverDB) Contains(args *storage.ContainsRequest) <-chan *storage.ContainsResponse {
+	return f.read(
+		func() interface{} { return f.primary.Contains(args) },
+		func() interface{} { return f.standby.Contains(args) },
+	).(chan *storage.ContainsResponse)
+}
+
+// Get is a read.
+func (f *FailoverDB) Get(args *storage.GetRequest) <-chan *storage.GetResponse {
+	return f.read(
+		func() interface{} { return f.primary.Get(args) },
+		func() interface{} { return f.standby.Get(args) },
+	).(chan *storage.GetResponse)
+}
+
+// GetByteRange is a read.
+func (f *FailoverDB) GetByteRange(args *storage.GetByteRangeRequest) <-chan *storage.GetByteRangeResponse {
+	return f.read(
+		func() interface{} { return f.primary.GetByteRange(args) },
+		func() interface{} { return f.standby.GetByteRange(args) },
+	).(chan *storage.GetByteRangeResponse)
+}
+
+// Scan is a read.
+func (f *FailoverDB) Scan(args *storage.ScanRequest) <-chan *storage.ScanResponse {
+	return f.read(
+		func() interface{} { return f.primary.Scan(args) },
+		func() interface{} { return f.standby.Scan(args) },
+	).(chan *storage.ScanResponse)
+}
+
+// Put is a write.
+func (f *FailoverDB) Put(args *storage.PutRequest) <-chan *storage.PutResponse {
+	return f.write("Put", &storage.PutResponse{},
+		func() interface{} { return f.primary.Put(args) }).(chan *storage.PutResponse)
+}
+
+// Increment is a write.
+func (f *FailoverDB) Increment(args *storage.IncrementRequest) <-chan *storage.IncrementResponse {
+	return f.write("Increment", &storage.IncrementResponse{},
+		func() interface{} { return f.primary.Increment(args) }).(chan *storage.IncrementResponse)
+}
+
+// Append is a write.
+func (f *FailoverDB) Append(args *storage.AppendRequest) <-chan *storage.AppendResponse {
+	return f.write("Append", &storage.AppendResponse{},
+		func() interface{} { return f.primary.Append(args) }).(chan *storage.AppendResponse)
+}
+
+// Delete is a write.
+func (f *FailoverDB) Delete(args *storage.DeleteRequest) <-chan *storage.DeleteResponse {
+	return f.write("Delete", &storage.DeleteResponse{},
+		func() interface{} { return f.primary.Delete(args) }).(chan *storage.DeleteResponse)
+}
+
+// DeleteRange is a write.
+func (f *FailoverDB) DeleteRange(args *storage.DeleteRangeRequest) <-chan *storage.DeleteRangeResponse {
+	return f.write("DeleteRange", &storage.DeleteRangeResponse{},
+		func() interface{} { return f.primary.DeleteRange(args) }).(chan *storage.DeleteRangeResponse)
+}
+
+// EndTransaction is a write.
+func (f *FailoverDB) EndTransaction(args *storage.EndTransactionRequest) <-chan *storage.EndTransactionResponse {
+	return f.write("EndTransaction", &storage.EndTransactionResponse{},
+		func() interface{} { return f.primary.EndTransaction(args) }).(chan *storage.EndTransactionResponse)
+}
+
+// AccumulateTS is a write.
+func (f *FailoverDB) AccumulateTS(args *storage.AccumulateTSRequest) <-chan *storage.AccumulateTSResponse {
+	return f.write("AccumulateTS", &storage.AccumulateTSResponse{},
+		func() interface{} { return f.primary.AccumulateTS(args) }).(chan *storage.AccumulateTSResponse)
+}
+
+// GetTSBlock is a read.
+func (f *FailoverDB) GetTSBlock(args *storage.GetTSBlockRequest) <-chan *storage.GetTSBlockResponse {
+	return f.read(
+		func() interface{} { return f.primary.GetTSBlock(args) },
+		func() interface{} { return f.standby.GetTSBlock(args) },
+	).(chan *storage.GetTSBlockResponse)
+}
+
+// ReapQueue is a write.
+func (f *FailoverDB) ReapQueue(args *storage.ReapQueueRequest) <-chan *storage.ReapQueueResponse {
+	return f.write("ReapQueue", &storage.ReapQueueResponse{},
+		func() interface{} { return f.primary.ReapQueue(args) }).(chan *storage.ReapQueueResponse)
+}
+
+// EnqueueUpdate is a write.
+func (f *FailoverDB) EnqueueUpdate(args *storage.EnqueueUpdateRequest) <-chan *storage.EnqueueUpdateResponse {
+	return f.write("EnqueueUpdate", &storage.EnqueueUpdateResponse{},
+		func() interface{} { return f.primary.EnqueueUpdate(args) }).(chan *storage.EnqueueUpdateResponse)
+}
+
+// EnqueueMessage is a write.
+func (f *FailoverDB) EnqueueMessage(args *storage.EnqueueMessageRequest) <-chan *storage.EnqueueMessageResponse {
+	return f.write("EnqueueMessage", &storage.EnqueueMessageResponse{},
+		func() interface{} { return f.primary.EnqueueMessage(args) }).(chan *storage.EnqueueMessageResponse)
+}
+
+// AckQueue is a write.
+func (f *FailoverDB) AckQueue(args *storage.AckQueueRequest) <-chan *storage.AckQueueResponse {
+	return f.write("AckQueue", &storage.AckQueueResponse{},
+		func() interface{} { return f.primary.AckQueue(args) }).(chan *storage.AckQueueResponse)
+}
+
+// InternalBulkWrite is a write.
+func (f *FailoverDB) InternalBulkWrite(args *storage.InternalBulkWriteRequest) <-chan *storage.InternalBulkWriteResponse {
+	return f.write("InternalBulkWrite", &storage.InternalBulkWriteResponse{},
+		func() interface{} { return f.primary.InternalBulkWrite(args) }).(chan *storage.InternalBulkWriteResponse)
+}
+
+// InternalPushTxn is a write.
+func (f *FailoverDB) InternalPushTxn(args *storage.InternalPushTxnRequest) <-chan *storage.InternalPushTxnResponse {
+	return f.write("InternalPushTxn", &storage.InternalPushTxnResponse{},
+		func() interface{} { return f.primary.InternalPushTxn(args) }).(chan *storage.InternalPushTxnResponse)
+}
+
+// InternalResolveIntent is a write.
+func (f *FailoverDB) InternalResolveIntent(args *storage.InternalResolveIntentRequest) <-chan *storage.InternalResolveIntentResponse {
+	return f.write("InternalResolveIntent", &storage.InternalResolveIntentResponse{},
+		func() interface{} { return f.primary.InternalResolveIntent(args) }).(chan *storage.InternalResolveIntentResponse)
+}
+
+// InternalTxnResolved is a write.
+func (f *FailoverDB) InternalTxnResolved(args *storage.InternalTxnResolvedRequest) <-chan *storage.InternalTxnResolvedResponse {
+	return f.write("InternalTxnResolved", &storage.InternalTxnResolvedResponse{},
+		func() interface{} { return f.primary.InternalTxnResolved(args) }).(chan *storage.InternalTxnResolvedResponse)
+}
+
+// AdminSplit is a write.
+func (f *FailoverDB) AdminSplit(args *storage.AdminSplitRequest) <-chan *storage.AdminSplitResponse {
+	return f.write("AdminSplit", &storage.AdminSplitResponse{},
+		func() interface{} { return f.primary.AdminSplit(args) }).(chan *storage.AdminSplitResponse)
+}
+
+// AdminMerge is a write.
+func (f *FailoverDB) AdminMerge(args *storage.AdminMergeRequest) <-chan *storage.AdminMergeResponse {
+	return f.write("AdminMerge", &storage.AdminMergeResponse{},
+		func() interface{} { return f.primary.AdminMerge(args) }).(chan *storage.AdminMergeResponse)
+}
+
+// AdminTransferLease is a write.
+func (f *FailoverDB) AdminTransferLease(args *storage.AdminTransferLeaseRequest) <-chan *storage.AdminTransferLeaseResponse {
+	return f.write("AdminTransferLease", &storage.AdminTransferLeaseResponse{},
+		func() interface{} { return f.primary.AdminTransferLease(args) }).(chan *storage.AdminTransferLeaseResponse)
+}
+
+// AdminCompact is sent to the primary; compaction doesn't change the
+// data the secondary mirrors.
+func (f *FailoverDB) AdminCompact(args *storage.AdminCompactRequest) <-chan *storage.AdminCompactResponse {
+	return f.primary.AdminCompact(args)
+}
+
+// InternalWatch is sent to the primary.
+func (f *FailoverDB) InternalWatch(args *storage.InternalWatchRequest) <-chan *storage.InternalWatchResponse {
+	return f.primary.InternalWatch(args)
+}
+
+// Watch watches the primary.
+func (f *FailoverDB) Watch(start, end storage.Key) *Watcher {
+	return f.primary.Watch(start, end)
+}
+
+// InternalResolvedTimestamp is sent to the primary.
+func (f *FailoverDB) InternalResolvedTimestamp(args *storage.InternalResolvedTimestampRequest) <-chan *storage.InternalResolvedTimestampResponse {
+	return f.primary.InternalResolvedTimestamp(args)
+}
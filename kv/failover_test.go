@@ -0,0 +1,129 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// An unreachableDB withholds replies to Contains, Get and Put while
+// blocked, simulating an unreachable cluster.
+type unreachableDB struct {
+	DB
+	mu      sync.Mutex
+	blocked chan struct{} // Closed to unblock; nil if not blocked
+}
+
+func (u *unreachableDB) block() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.blocked = make(chan struct{})
+}
+
+func (u *unreachableDB) unblock() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	close(u.blocked)
+	u.blocked = nil
+}
+
+// wait blocks until the DB is unblocked.
+func (u *unreachableDB) wait() {
+	u.mu.Lock()
+	blocked := u.blocked
+	u.mu.Unlock()
+	if blocked != nil {
+		<-blocked
+	}
+}
+
+func (u *unreachableDB) Contains(args *storage.ContainsRequest) <-chan *storage.ContainsResponse {
+	c := make(chan *storage.ContainsResponse, 1)
+	go func() { u.wait(); c <- <-u.DB.Contains(args) }()
+	return c
+}
+
+func (u *unreachableDB) Get(args *storage.GetRequest) <-chan *storage.GetResponse {
+	c := make(chan *storage.GetResponse, 1)
+	go func() { u.wait(); c <- <-u.DB.Get(args) }()
+	return c
+}
+
+func (u *unreachableDB) Put(args *storage.PutRequest) <-chan *storage.PutResponse {
+	c := make(chan *storage.PutResponse, 1)
+	go func() { u.wait(); c <- <-u.DB.Put(args) }()
+	return c
+}
+
+// TestFailoverDB verifies reads fail over to the standby once the
+// primary has been unreachable for long enough, that writes are
+// refused meanwhile, and that requests return to the primary once
+// it's reachable.
+func TestFailoverDB(t *testing.T) {
+	primary := &unreachableDB{DB: newTestLocalDB(storage.KeyMax)}
+	standby := newTestLocalDB(storage.KeyMax)
+	put(t, primary, "a", "primary")
+	put(t, standby, "a", "standby")
+	modes := make(chan bool, 10)
+	f := NewFailoverDB(primary, standby, FailoverOptions{
+		FailoverAfter: 20 * time.Millisecond,
+		ReplyTimeout:  5 * time.Millisecond,
+		OnModeChange:  func(degraded bool) { modes <- degraded },
+	})
+	get := func() string {
+		gr := <-f.Get(&storage.GetRequest{Key: storage.Key("a")})
+		if gr.Error != nil {
+			t.Fatal(gr.Error)
+		}
+		return string(gr.Value.Bytes)
+	}
+
+	if v := get(); v != "primary" {
+		t.Errorf("expected primary value; got %q", v)
+	}
+	primary.block()
+	if v := get(); v != "standby" {
+		t.Errorf("expected standby value once failed over; got %q", v)
+	}
+	if degraded := <-modes; !degraded {
+		t.Error("expected failover to be reported")
+	}
+	if degraded, since := f.Degraded(); !degraded || since.IsZero() {
+		t.Errorf("expected degraded mode; got %t since %s", degraded, since)
+	}
+	pr := <-f.Put(&storage.PutRequest{Key: storage.Key("a"), Value: storage.Value{Bytes: []byte("b")}})
+	if _, ok := pr.Error.(*DegradedError); !ok {
+		t.Errorf("expected write to be refused while degraded; got %v", pr.Error)
+	}
+
+	primary.unblock()
+	select {
+	case degraded := <-modes:
+		if degraded {
+			t.Error("expected recovery to be reported")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected recovery once primary reachable")
+	}
+	if v := get(); v != "primary" {
+		t.Errorf("expected primary value after recovery; got %q", v)
+	}
+	put(t, f, "a", "c")
+}
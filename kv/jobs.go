@@ -0,0 +1,257 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/golang/glog"
+)
+
+// Types of long-running jobs. Each node runs jobs of the types for
+// which it has a registered runner.
+const (
+	JobTypeBackup        = "backup"
+	JobTypeRestore       = "restore"
+	JobTypeImport        = "import"
+	JobTypeRevert        = "revert"
+	JobTypeIndexBackfill = "index-backfill"
+)
+
+// maxListJobs is the maximum number of jobs returned by ListJobs.
+const maxListJobs = 1 << 16
+
+// listJobsBatchSize is the number of jobs ListJobs reads concurrently.
+const listJobsBatchSize = 100
+
+// JobStatus is the state of a job.
+type JobStatus string
+
+// Job states. A running job is executed by the node which adopted
+// it; paused jobs await resumption. The remaining states are
+// terminal.
+const (
+	JobRunning   JobStatus = "running"
+	JobPaused    JobStatus = "paused"
+	JobCanceled  JobStatus = "canceled"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+)
+
+// Terminal returns true if the job has finished, whether successfully
+// or not.
+func (s JobStatus) Terminal() bool {
+	return s == JobCanceled || s == JobSucceeded || s == JobFailed
+}
+
+// A Job is the record of a long-running operation, stored at
+// MakeJobKey(ID). A running job is owned by the node which last
+// heartbeat it; if the heartbeat lapses, another node adopts the job
+// and resumes it from its last checkpoint.
+type Job struct {
+	ID          int64
+	Type        string    // Selects the runner which executes the job
+	Description string    // Human-readable description
+	Status      JobStatus // Current state
+	Progress    float64   // Fraction complete, from 0 to 1
+	Payload     []byte    // Type-specific parameters
+	Checkpoint  []byte    // Type-specific state from which to resume
+	Error       string    // Reason for failure, if Status is JobFailed
+	NodeID      int32     // Node running the job; 0 if unowned
+	Heartbeat   int64     // Time of the owner's last heartbeat, in nanoseconds
+	Created     int64     // Creation time, in nanoseconds since the epoch
+	Modified    int64     // Time of the last update, in nanoseconds
+}
+
+// MakeJobKey returns the key of the record of the job with id. Keys
+// sort in order of job ID.
+func MakeJobKey(id int64) storage.Key {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(id))
+	return storage.MakeKey(storage.KeyJobPrefix, b[:])
+}
+
+// CreateJob records a new running job of the specified type, to be
+// adopted by a node with a runner for the type. Returns the new job.
+func CreateJob(db DB, typ, description string, payload []byte) (*Job, error) {
+	ir := <-db.Increment(&storage.IncrementRequest{
+		Key:       storage.KeyJobIDGenerator,
+		Increment: 1,
+	})
+	if ir.Error != nil {
+		return nil, util.Errorf("unable to allocate job ID: %v", ir.Error)
+	}
+	now := time.Now().UnixNano()
+	job := &Job{
+		ID:          ir.NewValue,
+		Type:        typ,
+		Description: description,
+		Status:      JobRunning,
+		Payload:     payload,
+		Created:     now,
+		Modified:    now,
+	}
+	if err := PutI(db, MakeJobKey(job.ID), job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// GetJob returns the job with id.
+func GetJob(db DB, id int64) (*Job, error) {
+	job := &Job{}
+	ok, _, err := GetI(db, MakeJobKey(id), job)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, util.Errorf("job %d not found", id)
+	}
+	return job, nil
+}
+
+// ListJobs returns all jobs in order of ID, up to the most recent
+// maxListJobs. Jobs are read by ID, up to the last ID allocated,
+// rather than by scanning, so that they may be read via any DB.
+func ListJobs(db DB) ([]*Job, error) {
+	gr := <-db.Get(&storage.GetRequest{Key: storage.KeyJobIDGenerator})
+	if gr.Error != nil {
+		return nil, gr.Error
+	}
+	var maxID int64
+	if len(gr.Value.Bytes) > 0 {
+		var n int
+		if maxID, n = binary.Varint(gr.Value.Bytes); n <= 0 {
+			return nil, util.Errorf("unable to decode job ID generator %q", gr.Value.Bytes)
+		}
+	}
+	minID := int64(1)
+	if maxID >= maxListJobs {
+		glog.Warningf("listing only the last %d of %d jobs", maxListJobs, maxID)
+		minID = maxID - maxListJobs + 1
+	}
+	var jobs []*Job
+	// Read jobs in batches of concurrent gets.
+	for start := minID; start <= maxID; start += listJobsBatchSize {
+		var replies []<-chan *storage.GetResponse
+		for id := start; id <= maxID && id < start+listJobsBatchSize; id++ {
+			replies = append(replies, db.Get(&storage.GetRequest{Key: MakeJobKey(id)}))
+		}
+		for i, reply := range replies {
+			gr := <-reply
+			if gr.Error != nil {
+				return nil, gr.Error
+			}
+			if len(gr.Value.Bytes) == 0 {
+				continue
+			}
+			job := &Job{}
+			if err := gob.NewDecoder(bytes.NewBuffer(gr.Value.Bytes)).Decode(job); err != nil {
+				return nil, util.Errorf("unable to decode job %d: %v", start+int64(i), err)
+			}
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, nil
+}
+
+// UpdateJob reads the job with id, applies fn to it and writes it
+// back, conditional on the job being unchanged since it was read. If
+// it was updated concurrently, fn is applied anew to the job as
+// updated, so that no update is lost and fn sees the latest job. If
+// fn returns an error, the job is left unchanged and the error
+// returned.
+func UpdateJob(db DB, id int64, fn func(job *Job) error) (*Job, error) {
+	key := MakeJobKey(id)
+	for {
+		gr := <-db.Get(&storage.GetRequest{Key: key})
+		if gr.Error != nil {
+			return nil, gr.Error
+		}
+		if len(gr.Value.Bytes) == 0 {
+			return nil, util.Errorf("job %d not found", id)
+		}
+		job := &Job{}
+		if err := gob.NewDecoder(bytes.NewBuffer(gr.Value.Bytes)).Decode(job); err != nil {
+			return nil, util.Errorf("unable to decode job %d: %v", id, err)
+		}
+		if err := fn(job); err != nil {
+			return nil, err
+		}
+		job.Modified = time.Now().UnixNano()
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(job); err != nil {
+			return nil, err
+		}
+		pr := <-db.Put(&storage.PutRequest{
+			Key:      key,
+			Value:    storage.Value{Bytes: buf.Bytes(), Timestamp: job.Modified},
+			ExpValue: &storage.Value{Bytes: gr.Value.Bytes},
+		})
+		if pr.Error == nil {
+			return job, nil
+		}
+		// The actual value is returned only if the job was updated
+		// since it was read; read it again.
+		if pr.ActualValue == nil {
+			return nil, pr.Error
+		}
+	}
+}
+
+// PauseJob pauses the running job with id. The node running it stops
+// at its next heartbeat or progress update.
+func PauseJob(db DB, id int64) error {
+	_, err := UpdateJob(db, id, func(job *Job) error {
+		if job.Status != JobRunning {
+			return util.Errorf("job %d is %s; only running jobs can be paused", id, job.Status)
+		}
+		job.Status = JobPaused
+		return nil
+	})
+	return err
+}
+
+// ResumeJob resumes the paused job with id. The job is adopted anew
+// and resumes from its last checkpoint.
+func ResumeJob(db DB, id int64) error {
+	_, err := UpdateJob(db, id, func(job *Job) error {
+		if job.Status != JobPaused {
+			return util.Errorf("job %d is %s; only paused jobs can be resumed", id, job.Status)
+		}
+		job.Status = JobRunning
+		job.NodeID, job.Heartbeat = 0, 0
+		return nil
+	})
+	return err
+}
+
+// CancelJob cancels the running or paused job with id.
+func CancelJob(db DB, id int64) error {
+	_, err := UpdateJob(db, id, func(job *Job) error {
+		if job.Status.Terminal() {
+			return util.Errorf("job %d has already finished (%s)", id, job.Status)
+		}
+		job.Status = JobCanceled
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,113 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// TestJobLifecycle verifies jobs are created with increasing IDs,
+// listed in order and moved between states only by valid
+// transitions.
+func TestJobLifecycle(t *testing.T) {
+	db := newTestLocalDB(storage.KeyMax)
+	for i, typ := range []string{JobTypeBackup, JobTypeImport} {
+		job, err := CreateJob(db, typ, "test "+typ, []byte("payload"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.ID != int64(i+1) || job.Status != JobRunning {
+			t.Errorf("%d: unexpected new job %+v", i, job)
+		}
+	}
+	jobs, err := ListJobs(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 || jobs[0].Type != JobTypeBackup || jobs[1].Type != JobTypeImport {
+		t.Fatalf("unexpected jobs %+v", jobs)
+	}
+
+	if err := ResumeJob(db, 1); err == nil {
+		t.Error("expected resuming a running job to fail")
+	}
+	if _, err := UpdateJob(db, 1, func(job *Job) error {
+		job.NodeID, job.Heartbeat = 3, 100
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := PauseJob(db, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := PauseJob(db, 1); err == nil {
+		t.Error("expected pausing a paused job to fail")
+	}
+	if err := ResumeJob(db, 1); err != nil {
+		t.Fatal(err)
+	}
+	job, err := GetJob(db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != JobRunning || job.NodeID != 0 || job.Heartbeat != 0 {
+		t.Errorf("expected resumed job to be running and unowned; got %+v", job)
+	}
+	if err := CancelJob(db, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := CancelJob(db, 1); err == nil {
+		t.Error("expected canceling a canceled job to fail")
+	}
+	if _, err := GetJob(db, 3); err == nil {
+		t.Error("expected missing job to fail")
+	}
+}
+
+// TestUpdateJobConflict verifies an update of a job updated since it
+// was read is applied anew to the job as updated, losing neither.
+func TestUpdateJobConflict(t *testing.T) {
+	db := newTestLocalDB(storage.KeyMax)
+	created, err := CreateJob(db, JobTypeImport, "import", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	job, err := UpdateJob(db, created.ID, func(job *Job) error {
+		calls++
+		if calls == 1 {
+			if _, err := UpdateJob(db, created.ID, func(job *Job) error {
+				job.Progress += 0.25
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		job.Progress += 0.5
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 || job.Progress != 0.75 {
+		t.Errorf("expected update to be reapplied to the concurrent update; got %d calls, %+v", calls, job)
+	}
+	if job, err := GetJob(db, created.ID); err != nil || job.Progress != 0.75 {
+		t.Errorf("expected both updates to be written; got %+v, %v", job, err)
+	}
+}
@@ -0,0 +1,339 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// A Keyspace is a DB confined to the keys beneath a prefix, allowing
+// applications to share a cluster without keeping track of prefixes
+// themselves. Keys in requests are prefixed on the way in and keys in
+// replies are stripped of the prefix on the way out. Within a
+// Keyspace, KeyMin and KeyMax denote the start and end of the prefix.
+type Keyspace struct {
+	db     DB
+	prefix storage.Key
+}
+
+// NewKeyspace returns a Keyspace for the keys in db beneath prefix.
+func NewKeyspace(db DB, prefix storage.Key) *Keyspace {
+	return &Keyspace{db: db, prefix: prefix}
+}
+
+// key returns the key in the underlying DB for key.
+func (k *Keyspace) key(key storage.Key) storage.Key {
+	if bytes.Equal(key, storage.KeyMax) {
+		return storage.PrefixEndKey(k.prefix)
+	}
+	return storage.MakeKey(k.prefix, key)
+}
+
+// keys returns the keys in the underlying DB for keys.
+func (k *Keyspace) keys(keys []storage.Key) []storage.Key {
+	prefixed := make([]storage.Key, len(keys))
+	for i, key := range keys {
+		prefixed[i] = k.key(key)
+	}
+	return prefixed
+}
+
+// strip inverts key for a key in the underlying DB. Keys preceding the
+// prefix map to KeyMin and keys following it to KeyMax.
+func (k *Keyspace) strip(key storage.Key) storage.Key {
+	if bytes.HasPrefix(key, k.prefix) {
+		return key[len(k.prefix):]
+	}
+	if bytes.Compare(key, k.prefix) < 0 {
+		return storage.KeyMin
+	}
+	return storage.KeyMax
+}
+
+// Contains .
+func (k *Keyspace) Contains(args *storage.ContainsRequest) <-chan *storage.ContainsResponse {
+	prefixed := *args
+	prefixed.Key = k.key(args.Key)
+	return k.db.Contains(&prefixed)
+}
+
+// Get .
+func (k *Keyspace) Get(args *storage.GetRequest) <-chan *storage.GetResponse {
+	prefixed := *args
+	prefixed.Key = k.key(args.Key)
+	return k.db.Get(&prefixed)
+}
+
+// Put .
+func (k *Keyspace) Put(args *storage.PutRequest) <-chan *storage.PutResponse {
+	prefixed := *args
+	prefixed.Key = k.key(args.Key)
+	return k.db.Put(&prefixed)
+}
+
+// Increment .
+func (k *Keyspace) Increment(args *storage.IncrementRequest) <-chan *storage.IncrementResponse {
+	prefixed := *args
+	prefixed.Key = k.key(args.Key)
+	return k.db.Increment(&prefixed)
+}
+
+// Append .
+func (k *Keyspace) Append(args *storage.AppendRequest) <-chan *storage.AppendResponse {
+	prefixed := *args
+	prefixed.Key = k.key(args.Key)
+	return k.db.Append(&prefixed)
+}
+
+// GetByteRange .
+func (k *Keyspace) GetByteRange(args *storage.GetByteRangeRequest) <-chan *storage.GetByteRangeResponse {
+	prefixed := *args
+	prefixed.Key = k.key(args.Key)
+	return k.db.GetByteRange(&prefixed)
+}
+
+// Delete .
+func (k *Keyspace) Delete(args *storage.DeleteRequest) <-chan *storage.DeleteResponse {
+	prefixed := *args
+	prefixed.Key = k.key(args.Key)
+	return k.db.Delete(&prefixed)
+}
+
+// DeleteRange deletes the span within the keyspace; an empty end key
+// deletes through the end of the keyspace.
+func (k *Keyspace) DeleteRange(args *storage.DeleteRangeRequest) <-chan *storage.DeleteRangeResponse {
+	prefixed := *args
+	prefixed.StartKey = k.key(args.StartKey)
+	if len(args.EndKey) == 0 {
+		prefixed.EndKey = k.key(storage.KeyMax)
+	} else {
+		prefixed.EndKey = k.key(args.EndKey)
+	}
+	return k.db.DeleteRange(&prefixed)
+}
+
+// Scan scans the span within the keyspace, stripping the prefix from
+// the keys of returned rows and intents.
+func (k *Keyspace) Scan(args *storage.ScanRequest) <-chan *storage.ScanResponse {
+	prefixed := *args
+	prefixed.StartKey, prefixed.EndKey = k.key(args.StartKey), k.key(args.EndKey)
+	replyChan := scan(k.db, &prefixed)
+	c := make(chan *storage.ScanResponse, 1)
+	go func() {
+		reply := <-replyChan
+		for i := range reply.Rows {
+			reply.Rows[i].Key = k.strip(reply.Rows[i].Key)
+		}
+		for i := range reply.Intents {
+			reply.Intents[i].Key = k.strip(reply.Intents[i].Key)
+		}
+		if reply.ResumeKey != nil {
+			reply.ResumeKey = k.strip(reply.ResumeKey)
+		}
+		c <- reply
+	}()
+	return c
+}
+
+// EndTransaction .
+func (k *Keyspace) EndTransaction(args *storage.EndTransactionRequest) <-chan *storage.EndTransactionResponse {
+	prefixed := *args
+	prefixed.Keys = k.keys(args.Keys)
+	return k.db.EndTransaction(&prefixed)
+}
+
+// AccumulateTS .
+func (k *Keyspace) AccumulateTS(args *storage.AccumulateTSRequest) <-chan *storage.AccumulateTSResponse {
+	prefixed := *args
+	prefixed.Key = k.key(args.Key)
+	return k.db.AccumulateTS(&prefixed)
+}
+
+// GetTSBlock reads the time series of a span within the keyspace,
+// stripping the prefix from the returned keys.
+func (k *Keyspace) GetTSBlock(args *storage.GetTSBlockRequest) <-chan *storage.GetTSBlockResponse {
+	prefixed := *args
+	prefixed.StartKey, prefixed.EndKey = k.key(args.StartKey), k.key(args.EndKey)
+	replyChan := k.db.GetTSBlock(&prefixed)
+	c := make(chan *storage.GetTSBlockResponse, 1)
+	go func() {
+		reply := <-replyChan
+		for i := range reply.Keys {
+			reply.Keys[i] = k.strip(reply.Keys[i])
+		}
+		if reply.ResumeKey != nil {
+			reply.ResumeKey = k.strip(reply.ResumeKey)
+		}
+		c <- reply
+	}()
+	return c
+}
+
+// ReapQueue .
+func (k *Keyspace) ReapQueue(args *storage.ReapQueueRequest) <-chan *storage.ReapQueueResponse {
+	prefixed := *args
+	prefixed.Inbox = k.key(args.Inbox)
+	return k.db.ReapQueue(&prefixed)
+}
+
+// EnqueueUpdate prefixes the keys of the enqueued update. Updates of
+// types which the keyspace doesn't recognize are sent unchanged.
+func (k *Keyspace) EnqueueUpdate(args *storage.EnqueueUpdateRequest) <-chan *storage.EnqueueUpdateResponse {
+	prefixed := *args
+	switch t := args.Update.(type) {
+	case *storage.PutRequest:
+		update := *t
+		update.Key = k.key(t.Key)
+		prefixed.Update = &update
+	case *storage.IncrementRequest:
+		update := *t
+		update.Key = k.key(t.Key)
+		prefixed.Update = &update
+	case *storage.DeleteRequest:
+		update := *t
+		update.Key = k.key(t.Key)
+		prefixed.Update = &update
+	case *storage.DeleteRangeRequest:
+		update := *t
+		update.StartKey, update.EndKey = k.key(t.StartKey), k.key(t.EndKey)
+		prefixed.Update = &update
+	}
+	return k.db.EnqueueUpdate(&prefixed)
+}
+
+// EnqueueMessage .
+func (k *Keyspace) EnqueueMessage(args *storage.EnqueueMessageRequest) <-chan *storage.EnqueueMessageResponse {
+	prefixed := *args
+	prefixed.Inbox = k.key(args.Inbox)
+	return k.db.EnqueueMessage(&prefixed)
+}
+
+// AckQueue .
+func (k *Keyspace) AckQueue(args *storage.AckQueueRequest) <-chan *storage.AckQueueResponse {
+	prefixed := *args
+	prefixed.Inbox = k.key(args.Inbox)
+	return k.db.AckQueue(&prefixed)
+}
+
+// InternalBulkWrite .
+func (k *Keyspace) InternalBulkWrite(args *storage.InternalBulkWriteRequest) <-chan *storage.InternalBulkWriteResponse {
+	prefixed := *args
+	prefixed.Rows = make([]storage.KeyValue, len(args.Rows))
+	for i, row := range args.Rows {
+		prefixed.Rows[i] = storage.KeyValue{Key: k.key(row.Key), Value: row.Value}
+	}
+	return k.db.InternalBulkWrite(&prefixed)
+}
+
+// InternalPushTxn passes through unprefixed, as transaction records
+// are system keys.
+func (k *Keyspace) InternalPushTxn(args *storage.InternalPushTxnRequest) <-chan *storage.InternalPushTxnResponse {
+	return k.db.InternalPushTxn(args)
+}
+
+// InternalResolveIntent .
+func (k *Keyspace) InternalResolveIntent(args *storage.InternalResolveIntentRequest) <-chan *storage.InternalResolveIntentResponse {
+	prefixed := *args
+	prefixed.Key = k.key(args.Key)
+	return k.db.InternalResolveIntent(&prefixed)
+}
+
+// InternalTxnResolved passes through unprefixed, as transaction
+// records are system keys.
+func (k *Keyspace) InternalTxnResolved(args *storage.InternalTxnResolvedRequest) <-chan *storage.InternalTxnResolvedResponse {
+	return k.db.InternalTxnResolved(args)
+}
+
+// InternalWatch watches the span within the keyspace, stripping the
+// prefix from the keys of returned events and from the end key of
+// the watched range.
+func (k *Keyspace) InternalWatch(args *storage.InternalWatchRequest) <-chan *storage.InternalWatchResponse {
+	prefixed := *args
+	prefixed.StartKey, prefixed.EndKey = k.key(args.StartKey), k.key(args.EndKey)
+	replyChan := k.db.InternalWatch(&prefixed)
+	c := make(chan *storage.InternalWatchResponse, 1)
+	go func() {
+		reply := <-replyChan
+		for i := range reply.Events {
+			reply.Events[i].Key = k.strip(reply.Events[i].Key)
+		}
+		if reply.EndKey != nil {
+			reply.EndKey = k.strip(reply.EndKey)
+		}
+		c <- reply
+	}()
+	return c
+}
+
+// Watch returns a Watcher for changes to keys in [start, end) within
+// the keyspace.
+func (k *Keyspace) Watch(start, end storage.Key) *Watcher {
+	return newWatcher(k, start, end)
+}
+
+// InternalResolvedTimestamp returns the resolved timestamp of the
+// range containing the key within the keyspace, stripping the prefix
+// from the range's end key.
+func (k *Keyspace) InternalResolvedTimestamp(args *storage.InternalResolvedTimestampRequest) <-chan *storage.InternalResolvedTimestampResponse {
+	prefixed := *args
+	prefixed.Key = k.key(args.Key)
+	replyChan := k.db.InternalResolvedTimestamp(&prefixed)
+	c := make(chan *storage.InternalResolvedTimestampResponse, 1)
+	go func() {
+		reply := <-replyChan
+		if reply.EndKey != nil {
+			reply.EndKey = k.strip(reply.EndKey)
+		}
+		c <- reply
+	}()
+	return c
+}
+
+// AdminSplit .
+func (k *Keyspace) AdminSplit(args *storage.AdminSplitRequest) <-chan *storage.AdminSplitResponse {
+	prefixed := *args
+	prefixed.SplitKey = k.key(args.SplitKey)
+	return k.db.AdminSplit(&prefixed)
+}
+
+// AdminMerge .
+func (k *Keyspace) AdminMerge(args *storage.AdminMergeRequest) <-chan *storage.AdminMergeResponse {
+	prefixed := *args
+	prefixed.Key = k.key(args.Key)
+	return k.db.AdminMerge(&prefixed)
+}
+
+// AdminCompact compacts the span within the keyspace; an empty end
+// key compacts through the end of the keyspace.
+func (k *Keyspace) AdminCompact(args *storage.AdminCompactRequest) <-chan *storage.AdminCompactResponse {
+	prefixed := *args
+	prefixed.StartKey = k.key(args.StartKey)
+	if len(args.EndKey) == 0 {
+		prefixed.EndKey = k.key(storage.KeyMax)
+	} else {
+		prefixed.EndKey = k.key(args.EndKey)
+	}
+	return k.db.AdminCompact(&prefixed)
+}
+
+// AdminTransferLease .
+func (k *Keyspace) AdminTransferLease(args *storage.AdminTransferLeaseRequest) <-chan *storage.AdminTransferLeaseResponse {
+	prefixed := *args
+	prefixed.Key = k.key(args.Key)
+	return k.db.AdminTransferLease(&prefixed)
+}
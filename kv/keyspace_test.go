@@ -0,0 +1,66 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// TestKeyspace verifies keyspaces sharing a DB are isolated from one
+// another and that scans return keys without the prefix.
+func TestKeyspace(t *testing.T) {
+	db := newTestLocalDB(storage.KeyMax)
+	app1, app2 := NewKeyspace(db, storage.Key("app1/")), NewKeyspace(db, storage.Key("app2/"))
+	put(t, app1, "a", "1a")
+	put(t, app1, "b", "1b")
+	put(t, app2, "a", "2a")
+
+	gr := <-app2.Get(&storage.GetRequest{Key: storage.Key("a")})
+	if gr.Error != nil || string(gr.Value.Bytes) != "2a" {
+		t.Errorf("expected 2a; got %q, %v", gr.Value.Bytes, gr.Error)
+	}
+	if cr := <-db.Contains(&storage.ContainsRequest{Key: storage.Key("app1/a")}); cr.Error != nil || !cr.Exists {
+		t.Errorf("expected prefixed key in underlying DB; got %t, %v", cr.Exists, cr.Error)
+	}
+
+	sr := <-app1.Scan(&storage.ScanRequest{StartKey: storage.KeyMin, EndKey: storage.KeyMax, MaxResults: 10})
+	if sr.Error != nil {
+		t.Fatal(sr.Error)
+	}
+	if len(sr.Rows) != 2 || string(sr.Rows[0].Key) != "a" || string(sr.Rows[1].Key) != "b" {
+		t.Errorf("expected keys a and b; got %v", sr.Rows)
+	}
+}
+
+// TestKeyspaceScanNotImplemented verifies a scan of a keyspace over a
+// DistDB, which doesn't yet scan, fails rather than blocking.
+func TestKeyspaceScanNotImplemented(t *testing.T) {
+	db := NewDB(gossip.New())
+	defer db.Close()
+	ks := NewKeyspace(db, storage.Key("app/"))
+	select {
+	case sr := <-ks.Scan(&storage.ScanRequest{StartKey: storage.KeyMin, EndKey: storage.KeyMax}):
+		if _, ok := sr.Error.(*NotImplementedError); !ok {
+			t.Errorf("expected not implemented error; got %v", sr.Error)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("scan blocked")
+	}
+}
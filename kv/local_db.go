@@ -21,6 +21,7 @@ import (
 	"reflect"
 
 	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
 )
 
 // A LocalDB provides methods to access only a local, in-memory key
@@ -74,6 +75,18 @@ func (db *LocalDB) Increment(args *storage.IncrementRequest) <-chan *storage.Inc
 		args, &storage.IncrementResponse{}).(chan *storage.IncrementResponse)
 }
 
+// Append passes through to local range.
+func (db *LocalDB) Append(args *storage.AppendRequest) <-chan *storage.AppendResponse {
+	return db.invokeMethod("Append",
+		args, &storage.AppendResponse{}).(chan *storage.AppendResponse)
+}
+
+// GetByteRange passes through to local range.
+func (db *LocalDB) GetByteRange(args *storage.GetByteRangeRequest) <-chan *storage.GetByteRangeResponse {
+	return db.invokeMethod("GetByteRange",
+		args, &storage.GetByteRangeResponse{}).(chan *storage.GetByteRangeResponse)
+}
+
 // Delete passes through to local range.
 func (db *LocalDB) Delete(args *storage.DeleteRequest) <-chan *storage.DeleteResponse {
 	return db.invokeMethod("Delete",
@@ -104,6 +117,12 @@ func (db *LocalDB) AccumulateTS(args *storage.AccumulateTSRequest) <-chan *stora
 		args, &storage.AccumulateTSResponse{}).(chan *storage.AccumulateTSResponse)
 }
 
+// GetTSBlock passes through to local range.
+func (db *LocalDB) GetTSBlock(args *storage.GetTSBlockRequest) <-chan *storage.GetTSBlockResponse {
+	return db.invokeMethod("GetTSBlock",
+		args, &storage.GetTSBlockResponse{}).(chan *storage.GetTSBlockResponse)
+}
+
 // ReapQueue passes through to local range.
 func (db *LocalDB) ReapQueue(args *storage.ReapQueueRequest) <-chan *storage.ReapQueueResponse {
 	return db.invokeMethod("ReapQueue",
@@ -121,3 +140,90 @@ func (db *LocalDB) EnqueueMessage(args *storage.EnqueueMessageRequest) <-chan *s
 	return db.invokeMethod("EnqueueMessage",
 		args, &storage.EnqueueMessageResponse{}).(chan *storage.EnqueueMessageResponse)
 }
+
+// AckQueue passes through to local range.
+func (db *LocalDB) AckQueue(args *storage.AckQueueRequest) <-chan *storage.AckQueueResponse {
+	return db.invokeMethod("AckQueue",
+		args, &storage.AckQueueResponse{}).(chan *storage.AckQueueResponse)
+}
+
+// InternalBulkWrite passes through to local range.
+func (db *LocalDB) InternalBulkWrite(args *storage.InternalBulkWriteRequest) <-chan *storage.InternalBulkWriteResponse {
+	return db.invokeMethod("InternalBulkWrite",
+		args, &storage.InternalBulkWriteResponse{}).(chan *storage.InternalBulkWriteResponse)
+}
+
+// InternalPushTxn passes through to local range.
+func (db *LocalDB) InternalPushTxn(args *storage.InternalPushTxnRequest) <-chan *storage.InternalPushTxnResponse {
+	return db.invokeMethod("InternalPushTxn",
+		args, &storage.InternalPushTxnResponse{}).(chan *storage.InternalPushTxnResponse)
+}
+
+// InternalResolveIntent passes through to local range.
+func (db *LocalDB) InternalResolveIntent(args *storage.InternalResolveIntentRequest) <-chan *storage.InternalResolveIntentResponse {
+	return db.invokeMethod("InternalResolveIntent",
+		args, &storage.InternalResolveIntentResponse{}).(chan *storage.InternalResolveIntentResponse)
+}
+
+// InternalTxnResolved passes through to local range.
+func (db *LocalDB) InternalTxnResolved(args *storage.InternalTxnResolvedRequest) <-chan *storage.InternalTxnResolvedResponse {
+	return db.invokeMethod("InternalTxnResolved",
+		args, &storage.InternalTxnResolvedResponse{}).(chan *storage.InternalTxnResolvedResponse)
+}
+
+// InternalWatch passes through to local range.
+func (db *LocalDB) InternalWatch(args *storage.InternalWatchRequest) <-chan *storage.InternalWatchResponse {
+	return db.invokeMethod("InternalWatch",
+		args, &storage.InternalWatchResponse{}).(chan *storage.InternalWatchResponse)
+}
+
+// Watch returns a Watcher which delivers change events for keys in
+// [start, end).
+func (db *LocalDB) Watch(start, end storage.Key) *Watcher {
+	return newWatcher(db, start, end)
+}
+
+// InternalResolvedTimestamp passes through to local range.
+func (db *LocalDB) InternalResolvedTimestamp(args *storage.InternalResolvedTimestampRequest) <-chan *storage.InternalResolvedTimestampResponse {
+	return db.invokeMethod("InternalResolvedTimestamp",
+		args, &storage.InternalResolvedTimestampResponse{}).(chan *storage.InternalResolvedTimestampResponse)
+}
+
+// AdminSplit is not supported by a LocalDB, which comprises a single
+// range.
+func (db *LocalDB) AdminSplit(args *storage.AdminSplitRequest) <-chan *storage.AdminSplitResponse {
+	replyChan := make(chan *storage.AdminSplitResponse, 1)
+	replyChan <- &storage.AdminSplitResponse{
+		ResponseHeader: storage.ResponseHeader{Error: util.Error("local DB does not support splits")},
+	}
+	return replyChan
+}
+
+// AdminMerge is not supported by a LocalDB, which comprises a single
+// range.
+func (db *LocalDB) AdminMerge(args *storage.AdminMergeRequest) <-chan *storage.AdminMergeResponse {
+	replyChan := make(chan *storage.AdminMergeResponse, 1)
+	replyChan <- &storage.AdminMergeResponse{
+		ResponseHeader: storage.ResponseHeader{Error: util.Error("local DB does not support merges")},
+	}
+	return replyChan
+}
+
+// AdminCompact compacts the span of the local range.
+func (db *LocalDB) AdminCompact(args *storage.AdminCompactRequest) <-chan *storage.AdminCompactResponse {
+	replyChan := make(chan *storage.AdminCompactResponse, 1)
+	reply := &storage.AdminCompactResponse{}
+	reply.RowsCompacted, reply.Error = db.rng.Compact(args.StartKey, args.EndKey)
+	replyChan <- reply
+	return replyChan
+}
+
+// AdminTransferLease is not supported by a LocalDB, whose range has a
+// single replica.
+func (db *LocalDB) AdminTransferLease(args *storage.AdminTransferLeaseRequest) <-chan *storage.AdminTransferLeaseResponse {
+	replyChan := make(chan *storage.AdminTransferLeaseResponse, 1)
+	replyChan <- &storage.AdminTransferLeaseResponse{
+		ResponseHeader: storage.ResponseHeader{Error: util.Error("local DB does not support lease transfers")},
+	}
+	return replyChan
+}
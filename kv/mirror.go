@@ -0,0 +1,272 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+	"reflect"
+	"sync/atomic"
+
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/golang/glog"
+)
+
+// MirrorOptions configures the requests a MirrorDB duplicates.
+type MirrorOptions struct {
+	// Prefix selects the keys whose requests are mirrored.
+	Prefix storage.Key
+	// ShadowPrefix, if non-nil, replaces Prefix in the keys of mirrored
+	// requests. This allows mirroring to a separate prefix of the same
+	// cluster.
+	ShadowPrefix storage.Key
+	// MirrorWrites enables mirroring of Put, Increment, Append and
+	// Delete in addition to reads. Mirrored writes are shadow writes: their
+	// results are compared but never affect the client.
+	MirrorWrites bool
+	// OnMismatch, if not nil, is invoked for each mismatched reply.
+	OnMismatch func(m Mismatch)
+}
+
+// A Mismatch describes a mirrored request whose shadow reply differed
+// from the primary reply.
+type Mismatch struct {
+	Method  string
+	Key     storage.Key // Primary key of the request
+	Primary interface{} // Reply from the primary DB
+	Shadow  interface{} // Reply from the shadow DB
+}
+
+// A MirrorDB sends requests to a primary DB and duplicates requests
+// for keys with a configured prefix to a shadow DB, such as a second
+// cluster running a new version. Clients always receive the primary
+// reply; shadow replies are compared against it in the background
+// and mismatches are counted and reported. Requests which aren't
+// mirrored pass directly through to the primary DB.
+type MirrorDB struct {
+	DB
+	shadow     DB
+	opts       MirrorOptions
+	mirrored   int64 // Requests mirrored; accessed atomically
+	mismatches int64 // Mismatched replies; accessed atomically
+}
+
+// NewMirrorDB returns a MirrorDB which mirrors requests from primary
+// to shadow according to opts.
+func NewMirrorDB(primary, shadow DB, opts MirrorOptions) *MirrorDB {
+	return &MirrorDB{DB: primary, shadow: shadow, opts: opts}
+}
+
+// Stats returns the number of requests mirrored and the number of
+// those whose replies mismatched. Comparisons complete in the
+// background, so counts may lag replies received by clients.
+func (m *MirrorDB) Stats() (mirrored, mismatches int64) {
+	return atomic.LoadInt64(&m.mirrored), atomic.LoadInt64(&m.mismatches)
+}
+
+// shadowKey returns the key to use for key in a mirrored request and
+// whether the request should be mirrored at all.
+func (m *MirrorDB) shadowKey(key storage.Key) (storage.Key, bool) {
+	if !bytes.HasPrefix(key, m.opts.Prefix) {
+		return nil, false
+	}
+	if m.opts.ShadowPrefix == nil {
+		return key, true
+	}
+	return storage.MakeKey(m.opts.ShadowPrefix, key[len(m.opts.Prefix):]), true
+}
+
+// primaryKey inverts shadowKey for keys returned by the shadow DB.
+func (m *MirrorDB) primaryKey(key storage.Key) storage.Key {
+	if m.opts.ShadowPrefix == nil || !bytes.HasPrefix(key, m.opts.ShadowPrefix) {
+		return key
+	}
+	return storage.MakeKey(m.opts.Prefix, key[len(m.opts.ShadowPrefix):])
+}
+
+// mirror returns a channel, of the same type as primaryChan, which
+// receives the primary reply. Once the shadow reply is received from
+// shadowChan, the two are compared with equal and a mismatch is
+// reported if they differ.
+func (m *MirrorDB) mirror(method string, key storage.Key, primaryChan, shadowChan interface{},
+	equal func(primary, shadow interface{}) bool) interface{} {
+	atomic.AddInt64(&m.mirrored, 1)
+	primaryVal := reflect.ValueOf(primaryChan)
+	chanVal := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, primaryVal.Type().Elem()), 1)
+	go func() {
+		primary, _ := primaryVal.Recv()
+		chanVal.Send(primary)
+		shadow, _ := reflect.ValueOf(shadowChan).Recv()
+		if !equal(primary.Interface(), shadow.Interface()) {
+			atomic.AddInt64(&m.mismatches, 1)
+			glog.Warningf("mirrored %s %q mismatched: primary %+v, shadow %+v",
+				method, key, primary.Interface(), shadow.Interface())
+			if m.opts.OnMismatch != nil {
+				m.opts.OnMismatch(Mismatch{method, key, primary.Interface(), shadow.Interface()})
+			}
+		}
+	}()
+	return chanVal.Interface()
+}
+
+// errorsMatch returns whether both or neither of the replies failed.
+func errorsMatch(primary, shadow *storage.ResponseHeader) bool {
+	return (primary.Error == nil) == (shadow.Error == nil)
+}
+
+// Contains mirrors the request if args.Key has the mirrored prefix.
+func (m *MirrorDB) Contains(args *storage.ContainsRequest) <-chan *storage.ContainsResponse {
+	key, ok := m.shadowKey(args.Key)
+	if !ok {
+		return m.DB.Contains(args)
+	}
+	shadowArgs := *args
+	shadowArgs.Key = key
+	return m.mirror("Contains", args.Key, m.DB.Contains(args), m.shadow.Contains(&shadowArgs),
+		func(p, s interface{}) bool {
+			pr, sr := p.(*storage.ContainsResponse), s.(*storage.ContainsResponse)
+			return errorsMatch(&pr.ResponseHeader, &sr.ResponseHeader) && pr.Exists == sr.Exists
+		}).(chan *storage.ContainsResponse)
+}
+
+// Get mirrors the request if args.Key has the mirrored prefix.
+func (m *MirrorDB) Get(args *storage.GetRequest) <-chan *storage.GetResponse {
+	key, ok := m.shadowKey(args.Key)
+	if !ok {
+		return m.DB.Get(args)
+	}
+	shadowArgs := *args
+	shadowArgs.Key = key
+	return m.mirror("Get", args.Key, m.DB.Get(args), m.shadow.Get(&shadowArgs),
+		func(p, s interface{}) bool {
+			pr, sr := p.(*storage.GetResponse), s.(*storage.GetResponse)
+			return errorsMatch(&pr.ResponseHeader, &sr.ResponseHeader) && bytes.Equal(pr.Value.Bytes, sr.Value.Bytes)
+		}).(chan *storage.GetResponse)
+}
+
+// GetByteRange mirrors the request if args.Key has the mirrored
+// prefix.
+func (m *MirrorDB) GetByteRange(args *storage.GetByteRangeRequest) <-chan *storage.GetByteRangeResponse {
+	key, ok := m.shadowKey(args.Key)
+	if !ok {
+		return m.DB.GetByteRange(args)
+	}
+	shadowArgs := *args
+	shadowArgs.Key = key
+	return m.mirror("GetByteRange", args.Key, m.DB.GetByteRange(args), m.shadow.GetByteRange(&shadowArgs),
+		func(p, s interface{}) bool {
+			pr, sr := p.(*storage.GetByteRangeResponse), s.(*storage.GetByteRangeResponse)
+			return errorsMatch(&pr.ResponseHeader, &sr.ResponseHeader) &&
+				pr.Length == sr.Length && bytes.Equal(pr.Bytes, sr.Bytes)
+		}).(chan *storage.GetByteRangeResponse)
+}
+
+// Scan mirrors the request if the scanned span lies within the
+// mirrored prefix.
+func (m *MirrorDB) Scan(args *storage.ScanRequest) <-chan *storage.ScanResponse {
+	start, ok := m.shadowKey(args.StartKey)
+	if !ok {
+		return scan(m.DB, args)
+	}
+	end, ok := m.shadowKey(args.EndKey)
+	if !ok {
+		if !bytes.Equal(args.EndKey, storage.PrefixEndKey(m.opts.Prefix)) {
+			return scan(m.DB, args)
+		}
+		shadowPrefix := m.opts.ShadowPrefix
+		if shadowPrefix == nil {
+			shadowPrefix = m.opts.Prefix
+		}
+		end = storage.PrefixEndKey(shadowPrefix)
+	}
+	shadowArgs := *args
+	shadowArgs.StartKey, shadowArgs.EndKey = start, end
+	return m.mirror("Scan", args.StartKey, scan(m.DB, args), scan(m.shadow, &shadowArgs),
+		func(p, s interface{}) bool {
+			pr, sr := p.(*storage.ScanResponse), s.(*storage.ScanResponse)
+			if !errorsMatch(&pr.ResponseHeader, &sr.ResponseHeader) || len(pr.Rows) != len(sr.Rows) {
+				return false
+			}
+			for i := range pr.Rows {
+				if !bytes.Equal(pr.Rows[i].Key, m.primaryKey(sr.Rows[i].Key)) ||
+					!bytes.Equal(pr.Rows[i].Value.Bytes, sr.Rows[i].Value.Bytes) {
+					return false
+				}
+			}
+			return true
+		}).(chan *storage.ScanResponse)
+}
+
+// Put mirrors the request if writes are mirrored and args.Key has
+// the mirrored prefix.
+func (m *MirrorDB) Put(args *storage.PutRequest) <-chan *storage.PutResponse {
+	key, ok := m.shadowKey(args.Key)
+	if !ok || !m.opts.MirrorWrites {
+		return m.DB.Put(args)
+	}
+	shadowArgs := *args
+	shadowArgs.Key = key
+	return m.mirror("Put", args.Key, m.DB.Put(args), m.shadow.Put(&shadowArgs),
+		func(p, s interface{}) bool {
+			return errorsMatch(&p.(*storage.PutResponse).ResponseHeader, &s.(*storage.PutResponse).ResponseHeader)
+		}).(chan *storage.PutResponse)
+}
+
+// Increment mirrors the request if writes are mirrored and args.Key
+// has the mirrored prefix.
+func (m *MirrorDB) Increment(args *storage.IncrementRequest) <-chan *storage.IncrementResponse {
+	key, ok := m.shadowKey(args.Key)
+	if !ok || !m.opts.MirrorWrites {
+		return m.DB.Increment(args)
+	}
+	shadowArgs := *args
+	shadowArgs.Key = key
+	return m.mirror("Increment", args.Key, m.DB.Increment(args), m.shadow.Increment(&shadowArgs),
+		func(p, s interface{}) bool {
+			pr, sr := p.(*storage.IncrementResponse), s.(*storage.IncrementResponse)
+			return errorsMatch(&pr.ResponseHeader, &sr.ResponseHeader) && pr.NewValue == sr.NewValue
+		}).(chan *storage.IncrementResponse)
+}
+
+// Append mirrors the request if writes are mirrored and args.Key has
+// the mirrored prefix.
+func (m *MirrorDB) Append(args *storage.AppendRequest) <-chan *storage.AppendResponse {
+	key, ok := m.shadowKey(args.Key)
+	if !ok || !m.opts.MirrorWrites {
+		return m.DB.Append(args)
+	}
+	shadowArgs := *args
+	shadowArgs.Key = key
+	return m.mirror("Append", args.Key, m.DB.Append(args), m.shadow.Append(&shadowArgs),
+		func(p, s interface{}) bool {
+			pr, sr := p.(*storage.AppendResponse), s.(*storage.AppendResponse)
+			return errorsMatch(&pr.ResponseHeader, &sr.ResponseHeader) && pr.NewLength == sr.NewLength
+		}).(chan *storage.AppendResponse)
+}
+
+// Delete mirrors the request if writes are mirrored and args.Key has
+// the mirrored prefix.
+func (m *MirrorDB) Delete(args *storage.DeleteRequest) <-chan *storage.DeleteResponse {
+	key, ok := m.shadowKey(args.Key)
+	if !ok || !m.opts.MirrorWrites {
+		return m.DB.Delete(args)
+	}
+	shadowArgs := *args
+	shadowArgs.Key = key
+	return m.mirror("Delete", args.Key, m.DB.Delete(args), m.shadow.Delete(&shadowArgs),
+		func(p, s interface{}) bool {
+			return errorsMatch(&p.(*storage.DeleteResponse).ResponseHeader, &s.(*storage.DeleteResponse).ResponseHeader)
+		}).(chan *storage.DeleteResponse)
+}
@@ -0,0 +1,139 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// put writes value to key in db, failing the test on error.
+func put(t *testing.T, db DB, key, value string) {
+	pr := <-db.Put(&storage.PutRequest{Key: storage.Key(key), Value: storage.Value{Bytes: []byte(value)}})
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+}
+
+// TestMirrorDBReads verifies reads within the mirrored prefix are
+// compared against the shadow DB and mismatches reported.
+func TestMirrorDBReads(t *testing.T) {
+	primary, shadow := newTestLocalDB(storage.KeyMax), newTestLocalDB(storage.KeyMax)
+	mismatches := make(chan Mismatch, 10)
+	m := NewMirrorDB(primary, shadow, MirrorOptions{
+		Prefix:     storage.Key("/db1/"),
+		OnMismatch: func(mm Mismatch) { mismatches <- mm },
+	})
+	put(t, primary, "/db1/a", "a")
+	put(t, shadow, "/db1/a", "a")
+	put(t, primary, "/db1/b", "b")
+	put(t, shadow, "/db1/b", "B")
+
+	if gr := <-m.Get(&storage.GetRequest{Key: storage.Key("/db1/a")}); string(gr.Value.Bytes) != "a" {
+		t.Errorf("expected primary value; got %q", gr.Value.Bytes)
+	}
+	if gr := <-m.Get(&storage.GetRequest{Key: storage.Key("/db1/b")}); string(gr.Value.Bytes) != "b" {
+		t.Errorf("expected primary value; got %q", gr.Value.Bytes)
+	}
+	select {
+	case mm := <-mismatches:
+		if mm.Method != "Get" || string(mm.Key) != "/db1/b" {
+			t.Errorf("unexpected mismatch %+v", mm)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected mismatch for /db1/b")
+	}
+	// Reads outside the prefix aren't mirrored.
+	<-m.Get(&storage.GetRequest{Key: storage.Key("/db2/a")})
+	if err := util.IsTrueWithin(func() bool {
+		mirrored, mismatched := m.Stats()
+		return mirrored == 2 && mismatched == 1
+	}, 100*time.Millisecond); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestMirrorDBShadowPrefix verifies mirrored writes and scans are
+// rewritten to the shadow prefix.
+func TestMirrorDBShadowPrefix(t *testing.T) {
+	db := newTestLocalDB(storage.KeyMax)
+	m := NewMirrorDB(db, db, MirrorOptions{
+		Prefix:       storage.Key("/db1/"),
+		ShadowPrefix: storage.Key("/shadow/"),
+		MirrorWrites: true,
+	})
+	put(t, m, "/db1/a", "a")
+	put(t, m, "/db1/b", "b")
+	gr := <-db.Get(&storage.GetRequest{Key: storage.Key("/shadow/b")})
+	if string(gr.Value.Bytes) != "b" {
+		t.Errorf("expected shadow write; got %q", gr.Value.Bytes)
+	}
+	sr := <-m.Scan(&storage.ScanRequest{
+		StartKey:   storage.Key("/db1/"),
+		EndKey:     storage.PrefixEndKey(storage.Key("/db1/")),
+		MaxResults: 10,
+	})
+	if len(sr.Rows) != 2 {
+		t.Errorf("expected 2 rows; got %+v", sr.Rows)
+	}
+	if err := util.IsTrueWithin(func() bool {
+		mirrored, mismatched := m.Stats()
+		return mirrored == 3 && mismatched == 0
+	}, 100*time.Millisecond); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestMirrorDBScanNotImplemented verifies mirrored scans of a DistDB,
+// which doesn't yet scan, fail rather than blocking, whether it's the
+// primary or the shadow.
+func TestMirrorDBScanNotImplemented(t *testing.T) {
+	distDB := NewDB(gossip.New())
+	defer distDB.Close()
+	localDB := newTestLocalDB(storage.KeyMax)
+	mismatches := make(chan Mismatch, 1)
+	opts := MirrorOptions{
+		Prefix:     storage.Key("/db1/"),
+		OnMismatch: func(mm Mismatch) { mismatches <- mm },
+	}
+	args := &storage.ScanRequest{StartKey: storage.Key("/db1/"), EndKey: storage.PrefixEndKey(storage.Key("/db1/"))}
+
+	select {
+	case sr := <-NewMirrorDB(distDB, localDB, opts).Scan(args):
+		if _, ok := sr.Error.(*NotImplementedError); !ok {
+			t.Errorf("expected not implemented error; got %v", sr.Error)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("scan of primary blocked")
+	}
+	<-mismatches
+
+	if sr := <-NewMirrorDB(localDB, distDB, opts).Scan(args); sr.Error != nil {
+		t.Fatal(sr.Error)
+	}
+	select {
+	case mm := <-mismatches:
+		if _, ok := mm.Shadow.(*storage.ScanResponse).Error.(*NotImplementedError); !ok {
+			t.Errorf("expected shadow to fail with not implemented error; got %+v", mm.Shadow)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("scan of shadow blocked")
+	}
+}
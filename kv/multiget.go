@@ -0,0 +1,83 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import "github.com/cockroachdb/cockroach/storage"
+
+// A MultiGetResult is the outcome of reading one of the keys of a
+// MultiGet.
+type MultiGetResult struct {
+	Index int         // Position of the key in the keys passed to MultiGet
+	Key   storage.Key // The key read
+	Value storage.Value
+	Error error
+}
+
+// MultiGetOptions holds options for MultiGet.
+type MultiGetOptions struct {
+	// Ordered delivers results in the order of the requested keys.
+	// Otherwise, results are delivered as soon as each read completes.
+	Ordered bool
+	// MaxConcurrent limits the number of reads in flight; zero to read
+	// all keys at once.
+	MaxConcurrent int
+}
+
+// MultiGet reads the specified keys, which may reside in any number
+// of ranges, concurrently. Results are streamed on the returned
+// channel as reads complete, rather than once the slowest completes,
+// so callers may start processing early. The channel is closed after
+// the result for every key has been delivered.
+func MultiGet(db DB, keys []storage.Key, opts MultiGetOptions) <-chan MultiGetResult {
+	out := make(chan MultiGetResult, len(keys))
+	limit := opts.MaxConcurrent
+	if limit <= 0 || limit > len(keys) {
+		limit = len(keys)
+	}
+	completed := make(chan MultiGetResult, len(keys))
+	go func() {
+		sem := make(chan struct{}, limit)
+		for i, key := range keys {
+			sem <- struct{}{}
+			go func(i int, key storage.Key) {
+				reply := <-db.Get(&storage.GetRequest{Key: key})
+				<-sem
+				completed <- MultiGetResult{Index: i, Key: key, Value: reply.Value, Error: reply.Error}
+			}(i, key)
+		}
+	}()
+	go func() {
+		defer close(out)
+		// In ordered mode, results which complete ahead of their
+		// predecessors are held until the predecessors complete.
+		held := map[int]MultiGetResult{}
+		next := 0
+		for range keys {
+			result := <-completed
+			if !opts.Ordered {
+				out <- result
+				continue
+			}
+			held[result.Index] = result
+			for r, ok := held[next]; ok; r, ok = held[next] {
+				out <- r
+				delete(held, next)
+				next++
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,59 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// TestMultiGet verifies every key's result is delivered, in request
+// order when ordered, and that the channel is then closed.
+func TestMultiGet(t *testing.T) {
+	db := newTestLocalDB(storage.KeyMax)
+	var keys []storage.Key
+	for i := 0; i < 20; i++ {
+		key := storage.Key(fmt.Sprintf("key%02d", i))
+		if i%2 == 0 {
+			put(t, db, string(key), fmt.Sprintf("value%d", i))
+		}
+		keys = append(keys, key)
+	}
+	for _, opts := range []MultiGetOptions{{}, {Ordered: true}, {Ordered: true, MaxConcurrent: 3}} {
+		seen := map[int]bool{}
+		next := 0
+		for result := range MultiGet(db, keys, opts) {
+			if result.Error != nil {
+				t.Fatal(result.Error)
+			}
+			if opts.Ordered && result.Index != next {
+				t.Errorf("%+v: expected result %d; got %d", opts, next, result.Index)
+			}
+			next++
+			seen[result.Index] = true
+			if exp := fmt.Sprintf("value%d", result.Index); result.Index%2 == 0 && string(result.Value.Bytes) != exp {
+				t.Errorf("%+v: expected %q for %q; got %q", opts, exp, result.Key, result.Value.Bytes)
+			} else if result.Index%2 == 1 && result.Value.Bytes != nil {
+				t.Errorf("%+v: expected no value for %q; got %q", opts, result.Key, result.Value.Bytes)
+			}
+		}
+		if len(seen) != len(keys) {
+			t.Errorf("%+v: expected %d results; got %d", opts, len(keys), len(seen))
+		}
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+
+	"github.com/cockroachdb/cockroach/rpc"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/golang/glog"
+)
+
+// A ProxyDB is a thin client which sends each request to any one of
+// a set of gateway nodes. The gateway looks up the range holding the
+// request's key and forwards the request to it, returning the reply.
+// Unlike a DistDB, a ProxyDB needs neither gossip nor range metadata,
+// at the cost of an extra hop for requests whose ranges the gateway
+// doesn't hold. Services sensitive to latency should opt in to a
+// DistDB, which routes requests itself.
+type ProxyDB struct {
+	gateways []net.Addr
+}
+
+// NewProxyDB returns a thin client which sends requests via the nodes
+// at the supplied gateway addresses.
+func NewProxyDB(gateways []net.Addr) *ProxyDB {
+	return &ProxyDB{gateways: append([]net.Addr(nil), gateways...)}
+}
+
+// sendRPC sends the request args to a gateway for routing, retrying
+// with backoff on retryable errors, such as when no gateway is
+// reachable. sendRPC sends asynchronously and returns a channel of
+// the same type as reply which receives the reply.
+func (db *ProxyDB) sendRPC(method string, args storage.Request, reply storage.Response) interface{} {
+	chanVal := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, reflect.TypeOf(reply)), 1)
+
+	go func() {
+		// The command ID is set before proxying, so that retries via
+		// another gateway aren't executed twice.
+		if isMutation(method, args) {
+			args = withCmdID(args)
+		}
+		var resp storage.Response
+		retryOpts := util.RetryOptions{
+			Tag:         fmt.Sprintf("proxying %s rpc", method),
+			Backoff:     retryBackoff,
+			MaxBackoff:  maxRetryBackoff,
+			Constant:    2,
+			MaxAttempts: 0, // retry indefinitely
+		}
+		err := util.RetryWithBackoff(retryOpts, func() (bool, error) {
+			argsMap := map[net.Addr]interface{}{}
+			for _, addr := range db.gateways {
+				proxyArgs := args.Clone()
+				proxyArgs.Header().Proxy = true
+				argsMap[addr] = proxyArgs
+			}
+			replyChan := reflect.MakeChan(chanVal.Type(), len(db.gateways))
+			err := rpc.Send(argsMap, method, replyChan.Interface(), rpc.Options{
+				N:               1,
+				SendNextTimeout: defaultSendNextTimeout,
+				Timeout:         defaultRPCTimeout,
+			})
+			if err == nil {
+				replyVal, _ := replyChan.Recv()
+				resp = replyVal.Interface().(storage.Response)
+				if replyErr, ok := replyError(resp).(util.Retryable); ok && replyErr.CanRetry() {
+					err = replyErr.(error)
+				}
+			}
+			if ambErr := ambiguousResult(method, args, err); ambErr != nil {
+				return true, ambErr
+			}
+			if retryErr, ok := err.(util.Retryable); ok && retryErr.CanRetry() {
+				glog.Warningf("failed to proxy %s: %v", method, err)
+				return false, nil
+			}
+			return true, err
+		})
+		if ambErr, ok := err.(*AmbiguousResultError); ok {
+			verifyWrite(db.Get, args, ambErr)
+		}
+		if err != nil {
+			reply.Header().Error = err
+			resp = reply
+		}
+		chanVal.Send(reflect.ValueOf(resp))
+	}()
+
+	return chanVal.Interface()
+}
+
+// Contains .
+func (db *ProxyDB) Contains(args *storage.ContainsRequest) <-chan *storage.ContainsResponse {
+	return db.sendRPC("Node.Contains",
+		args, &storage.ContainsResponse{}).(chan *storage.ContainsResponse)
+}
+
+// Get .
+func (db *ProxyDB) Get(args *storage.GetRequest) <-chan *storage.GetResponse {
+	return db.sendRPC("Node.Get",
+		args, &storage.GetResponse{}).(chan *storage.GetResponse)
+}
+
+// Put .
+func (db *ProxyDB) Put(args *storage.PutRequest) <-chan *storage.PutResponse {
+	return db.sendRPC("Node.Put",
+		args, &storage.PutResponse{}).(chan *storage.PutResponse)
+}
+
+// Increment .
+func (db *ProxyDB) Increment(args *storage.IncrementRequest) <-chan *storage.IncrementResponse {
+	return db.sendRPC("Node.Increment",
+		args, &storage.IncrementResponse{}).(chan *storage.IncrementResponse)
+}
+
+// Append .
+func (db *ProxyDB) Append(args *storage.AppendRequest) <-chan *storage.AppendResponse {
+	return db.sendRPC("Node.Append",
+		args, &storage.AppendResponse{}).(chan *storage.AppendResponse)
+}
+
+// GetByteRange .
+func (db *ProxyDB) GetByteRange(args *storage.GetByteRangeRequest) <-chan *storage.GetByteRangeResponse {
+	return db.sendRPC("Node.GetByteRange",
+		args, &storage.GetByteRangeResponse{}).(chan *storage.GetByteRangeResponse)
+}
+
+// Delete .
+func (db *ProxyDB) Delete(args *storage.DeleteRequest) <-chan *storage.DeleteResponse {
+	return db.sendRPC("Node.Delete",
+		args, &storage.DeleteResponse{}).(chan *storage.DeleteResponse)
+}
+
+// DeleteRange .
+func (db *ProxyDB) DeleteRange(args *storage.DeleteRangeRequest) <-chan *storage.DeleteRangeResponse {
+	return db.sendRPC("Node.DeleteRange",
+		args, &storage.DeleteRangeResponse{}).(chan *storage.DeleteRangeResponse)
+}
+
+// Scan .
+func (db *ProxyDB) Scan(args *storage.ScanRequest) <-chan *storage.ScanResponse {
+	return db.sendRPC("Node.Scan",
+		args, &storage.ScanResponse{}).(chan *storage.ScanResponse)
+}
+
+// EndTransaction .
+func (db *ProxyDB) EndTransaction(args *storage.EndTransactionRequest) <-chan *storage.EndTransactionResponse {
+	return db.sendRPC("Node.EndTransaction",
+		args, &storage.EndTransactionResponse{}).(chan *storage.EndTransactionResponse)
+}
+
+// AccumulateTS .
+func (db *ProxyDB) AccumulateTS(args *storage.AccumulateTSRequest) <-chan *storage.AccumulateTSResponse {
+	return db.sendRPC("Node.AccumulateTS",
+		args, &storage.AccumulateTSResponse{}).(chan *storage.AccumulateTSResponse)
+}
+
+// GetTSBlock .
+func (db *ProxyDB) GetTSBlock(args *storage.GetTSBlockRequest) <-chan *storage.GetTSBlockResponse {
+	return db.sendRPC("Node.GetTSBlock",
+		args, &storage.GetTSBlockResponse{}).(chan *storage.GetTSBlockResponse)
+}
+
+// ReapQueue .
+func (db *ProxyDB) ReapQueue(args *storage.ReapQueueRequest) <-chan *storage.ReapQueueResponse {
+	return db.sendRPC("Node.ReapQueue",
+		args, &storage.ReapQueueResponse{}).(chan *storage.ReapQueueResponse)
+}
+
+// EnqueueUpdate .
+func (db *ProxyDB) EnqueueUpdate(args *storage.EnqueueUpdateRequest) <-chan *storage.EnqueueUpdateResponse {
+	return db.sendRPC("Node.EnqueueUpdate",
+		args, &storage.EnqueueUpdateResponse{}).(chan *storage.EnqueueUpdateResponse)
+}
+
+// EnqueueMessage .
+func (db *ProxyDB) EnqueueMessage(args *storage.EnqueueMessageRequest) <-chan *storage.EnqueueMessageResponse {
+	return db.sendRPC("Node.EnqueueMessage",
+		args, &storage.EnqueueMessageResponse{}).(chan *storage.EnqueueMessageResponse)
+}
+
+// AckQueue .
+func (db *ProxyDB) AckQueue(args *storage.AckQueueRequest) <-chan *storage.AckQueueResponse {
+	return db.sendRPC("Node.AckQueue",
+		args, &storage.AckQueueResponse{}).(chan *storage.AckQueueResponse)
+}
+
+// InternalBulkWrite .
+func (db *ProxyDB) InternalBulkWrite(args *storage.InternalBulkWriteRequest) <-chan *storage.InternalBulkWriteResponse {
+	return db.sendRPC("Node.InternalBulkWrite",
+		args, &storage.InternalBulkWriteResponse{}).(chan *storage.InternalBulkWriteResponse)
+}
+
+// InternalPushTxn .
+func (db *ProxyDB) InternalPushTxn(args *storage.InternalPushTxnRequest) <-chan *storage.InternalPushTxnResponse {
+	return db.sendRPC("Node.InternalPushTxn",
+		args, &storage.InternalPushTxnResponse{}).(chan *storage.InternalPushTxnResponse)
+}
+
+// InternalResolveIntent .
+func (db *ProxyDB) InternalResolveIntent(args *storage.InternalResolveIntentRequest) <-chan *storage.InternalResolveIntentResponse {
+	return db.sendRPC("Node.InternalResolveIntent",
+		args, &storage.InternalResolveIntentResponse{}).(chan *storage.InternalResolveIntentResponse)
+}
+
+// InternalTxnResolved .
+func (db *ProxyDB) InternalTxnResolved(args *storage.InternalTxnResolvedRequest) <-chan *storage.InternalTxnResolvedResponse {
+	return db.sendRPC("Node.InternalTxnResolved",
+		args, &storage.InternalTxnResolvedResponse{}).(chan *storage.InternalTxnResolvedResponse)
+}
+
+// InternalWatch .
+func (db *ProxyDB) InternalWatch(args *storage.InternalWatchRequest) <-chan *storage.InternalWatchResponse {
+	return db.sendRPC("Node.InternalWatch",
+		args, &storage.InternalWatchResponse{}).(chan *storage.InternalWatchResponse)
+}
+
+// Watch returns a Watcher which delivers change events for keys in
+// [start, end).
+func (db *ProxyDB) Watch(start, end storage.Key) *Watcher {
+	return newWatcher(db, start, end)
+}
+
+// InternalResolvedTimestamp .
+func (db *ProxyDB) InternalResolvedTimestamp(args *storage.InternalResolvedTimestampRequest) <-chan *storage.InternalResolvedTimestampResponse {
+	return db.sendRPC("Node.InternalResolvedTimestamp",
+		args, &storage.InternalResolvedTimestampResponse{}).(chan *storage.InternalResolvedTimestampResponse)
+}
+
+// AdminSplit .
+func (db *ProxyDB) AdminSplit(args *storage.AdminSplitRequest) <-chan *storage.AdminSplitResponse {
+	return db.sendRPC("Node.AdminSplit",
+		args, &storage.AdminSplitResponse{}).(chan *storage.AdminSplitResponse)
+}
+
+// AdminMerge .
+func (db *ProxyDB) AdminMerge(args *storage.AdminMergeRequest) <-chan *storage.AdminMergeResponse {
+	return db.sendRPC("Node.AdminMerge",
+		args, &storage.AdminMergeResponse{}).(chan *storage.AdminMergeResponse)
+}
+
+// AdminCompact .
+func (db *ProxyDB) AdminCompact(args *storage.AdminCompactRequest) <-chan *storage.AdminCompactResponse {
+	return db.sendRPC("Node.AdminCompact",
+		args, &storage.AdminCompactResponse{}).(chan *storage.AdminCompactResponse)
+}
+
+// AdminTransferLease .
+func (db *ProxyDB) AdminTransferLease(args *storage.AdminTransferLeaseRequest) <-chan *storage.AdminTransferLeaseResponse {
+	return db.sendRPC("Node.AdminTransferLease",
+		args, &storage.AdminTransferLeaseResponse{}).(chan *storage.AdminTransferLeaseResponse)
+}
@@ -0,0 +1,112 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/golang/glog"
+)
+
+// A QuorumRead is the result of reading a key from a quorum of the
+// replicas of its range.
+type QuorumRead struct {
+	// Reply is the reply holding the most recent value read, by
+	// timestamp.
+	Reply *storage.GetResponse
+	// Replies holds the reply of each replica read, which identifies
+	// the replica which served it.
+	Replies []*storage.GetResponse
+	// Divergent is set if the replicas read disagree on the value.
+	Divergent bool
+}
+
+// QuorumGet reads the key specified by args from a majority of the
+// replicas of its range, which serve the read from their own data
+// whether or not they're the raft leader. The replies are compared:
+// the most recent value is returned in the result's Reply, and the
+// result is marked divergent if any replica's value differs.
+//
+// A replica which hasn't yet applied the latest writes to the range
+// legitimately returns an older value, so divergence indicates an
+// inconsistency only if it persists once writes have quiesced.
+func (db *DistDB) QuorumGet(args *storage.GetRequest) (*QuorumRead, error) {
+	method := "Node.Get"
+	if !db.startRequest() {
+		return nil, &ClosedError{Method: method}
+	}
+	defer db.wg.Done()
+	rangeMeta, err := db.lookupRangeMetadata(args.Key)
+	if err != nil {
+		return nil, err
+	}
+	replicas := rangeMeta.Replicas
+	quorum := len(replicas)/2 + 1
+	quorumArgs := *args
+	quorumArgs.AnyReplica = true
+	replyChan := make(chan *storage.GetResponse, len(replicas))
+	if err := db.sendRPCN(replicas, method, &quorumArgs, replyChan, quorum); err != nil {
+		return nil, err
+	}
+	read := &QuorumRead{}
+	for i := 0; i < quorum; i++ {
+		reply := <-replyChan
+		db.updateClock(reply)
+		if reply.Error != nil {
+			return nil, reply.Error
+		}
+		read.Replies = append(read.Replies, reply)
+		if read.Reply == nil || reply.Value.Timestamp > read.Reply.Value.Timestamp {
+			read.Reply = reply
+		}
+	}
+	for _, reply := range read.Replies {
+		if reply.Value.Timestamp != read.Reply.Value.Timestamp || !bytes.Equal(reply.Value.Bytes, read.Reply.Value.Bytes) {
+			read.Divergent = true
+		}
+	}
+	if read.Divergent {
+		db.metrics.mu.Lock()
+		db.metrics.Divergences++
+		db.metrics.mu.Unlock()
+		for _, reply := range read.Replies {
+			glog.Warningf("quorum read of %q diverged: replica %+v returned %q at %d",
+				args.Key, reply.Replica, reply.Value.Bytes, reply.Value.Timestamp)
+		}
+	}
+	return read, nil
+}
+
+// quorumGet performs a Get as a quorum read for the QuorumReads
+// option, returning the most recent value read.
+func (db *DistDB) quorumGet(args *storage.GetRequest) <-chan *storage.GetResponse {
+	replyChan := make(chan *storage.GetResponse, 1)
+	go func() {
+		start := time.Now()
+		read, err := db.QuorumGet(args)
+		reply := &storage.GetResponse{}
+		if err != nil {
+			reply.Error = err
+		} else {
+			reply = read.Reply
+		}
+		db.tracer.Method("Node.Get", time.Since(start), reply.Error)
+		replyChan <- reply
+	}()
+	return replyChan
+}
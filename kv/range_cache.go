@@ -0,0 +1,216 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sort"
+	"sync"
+
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/golang/glog"
+)
+
+// rangeCacheSize is the number of ranges whose locations a DistDB
+// caches; the cache is cleared when full.
+const rangeCacheSize = 1 << 16
+
+// A RangeChange is a change to the addressing record of a range, as
+// written when the range splits, merges or its replicas move.
+type RangeChange struct {
+	// EndKey is the end key of the range, by which its addressing
+	// record is keyed.
+	EndKey storage.Key
+	// Locations are the range's start key and replicas; empty if the
+	// record was removed.
+	Locations storage.RangeLocations
+	// Removed is set if the record was removed, as when the range was
+	// merged into its predecessor.
+	Removed bool
+	// Resync is set if changes were lost, as when the feed fell
+	// behind; all cached locations should be discarded. EndKey and
+	// Locations are unset.
+	Resync bool
+}
+
+// A RangeFeed delivers changes to the addressing records of ranges,
+// so that long-lived clients may keep their caches of range locations
+// up to date rather than discovering changes via request errors. The
+// feed watches the second level of range addressing records; see
+// Watcher for its delivery guarantees.
+type RangeFeed struct {
+	watcher *Watcher
+	changes chan RangeChange
+}
+
+// newRangeFeed returns a RangeFeed delivering changes made via db
+// after the feed is created.
+func newRangeFeed(db DB) *RangeFeed {
+	f := &RangeFeed{
+		watcher: newWatcher(db, storage.KeyMeta2Prefix, storage.PrefixEndKey(storage.KeyMeta2Prefix)),
+		changes: make(chan RangeChange, 100),
+	}
+	go f.translate()
+	return f
+}
+
+// Changes returns the channel on which range changes are delivered.
+// The channel is closed after the feed is closed.
+func (f *RangeFeed) Changes() <-chan RangeChange {
+	return f.changes
+}
+
+// Close stops the feed.
+func (f *RangeFeed) Close() {
+	f.watcher.Close()
+}
+
+// translate delivers the watcher's events as range changes until the
+// watcher's events channel is closed. Records which can't be decoded
+// are delivered as removals, so that they're no longer relied on.
+func (f *RangeFeed) translate() {
+	defer close(f.changes)
+	for ev := range f.watcher.Events() {
+		change := RangeChange{Resync: true}
+		if ev.Op != storage.ChangeResync {
+			change = RangeChange{EndKey: bytes.TrimPrefix(ev.Key, storage.KeyMeta2Prefix)}
+			if ev.Op == storage.ChangeDelete {
+				change.Removed = true
+			} else if err := gob.NewDecoder(bytes.NewReader(ev.Value.Bytes)).Decode(&change.Locations); err != nil {
+				glog.Warningf("unable to decode addressing record %q: %v", ev.Key, err)
+				change.Removed = true
+			}
+		}
+		select {
+		case f.changes <- change:
+		case <-f.watcher.closer:
+			return
+		}
+	}
+}
+
+// A cachedRange holds the locations of the range ending at endKey.
+type cachedRange struct {
+	endKey    storage.Key
+	locations storage.RangeLocations
+}
+
+// A rangeCache caches the locations of ranges, ordered by end key.
+// Each change to the cached ranges advances the cache's generation,
+// so that lookups which raced with a change aren't cached.
+type rangeCache struct {
+	mu         sync.Mutex
+	ranges     []cachedRange // Sorted by end key; spans don't overlap
+	generation int64
+}
+
+// search returns the index of the first cached range ending after key.
+func (rc *rangeCache) search(key storage.Key) int {
+	return sort.Search(len(rc.ranges), func(i int) bool {
+		return bytes.Compare(rc.ranges[i].endKey, key) > 0
+	})
+}
+
+// lookup returns the locations and end key of the cached range
+// containing key, if any.
+func (rc *rangeCache) lookup(key storage.Key) (*storage.RangeLocations, storage.Key, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	i := rc.search(key)
+	if i == len(rc.ranges) || bytes.Compare(rc.ranges[i].locations.StartKey, key) > 0 {
+		return nil, nil, false
+	}
+	locations := rc.ranges[i].locations
+	return &locations, rc.ranges[i].endKey, true
+}
+
+// currentGeneration returns the cache's generation, to be passed to
+// add with the results of a lookup begun after.
+func (rc *rangeCache) currentGeneration() int64 {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.generation
+}
+
+// add caches the locations of the range ending at endKey, as looked
+// up at generation, replacing cached ranges which overlap it. The
+// locations aren't cached if the cache has changed since generation.
+func (rc *rangeCache) add(locations storage.RangeLocations, endKey storage.Key, generation int64) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if generation != rc.generation {
+		return
+	}
+	rc.replace(locations, endKey)
+}
+
+// replace caches the locations of the range ending at endKey,
+// removing cached ranges which overlap it. Requires mu.
+func (rc *rangeCache) replace(locations storage.RangeLocations, endKey storage.Key) {
+	start := rc.search(locations.StartKey)
+	end := start
+	for end < len(rc.ranges) && bytes.Compare(rc.ranges[end].locations.StartKey, endKey) < 0 {
+		end++
+	}
+	if len(rc.ranges)-(end-start) >= rangeCacheSize {
+		rc.ranges, start, end = nil, 0, 0
+	}
+	entry := cachedRange{endKey: endKey, locations: locations}
+	rc.ranges = append(rc.ranges[:start], append([]cachedRange{entry}, rc.ranges[end:]...)...)
+}
+
+// evict removes the cached range containing key, if any.
+func (rc *rangeCache) evict(key storage.Key) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.generation++
+	if i := rc.search(key); i < len(rc.ranges) && bytes.Compare(rc.ranges[i].locations.StartKey, key) <= 0 {
+		rc.ranges = append(rc.ranges[:i], rc.ranges[i+1:]...)
+	}
+}
+
+// apply updates the cache with change.
+func (rc *rangeCache) apply(change RangeChange) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.generation++
+	switch {
+	case change.Resync:
+		rc.ranges = nil
+	case change.Removed:
+		if i := rc.search(change.EndKey); i > 0 && bytes.Equal(rc.ranges[i-1].endKey, change.EndKey) {
+			rc.ranges = append(rc.ranges[:i-1], rc.ranges[i:]...)
+		}
+	default:
+		rc.replace(change.Locations, change.EndKey)
+	}
+}
+
+// followRangeChanges applies the changes delivered by feed to the
+// DistDB's range cache until the feed is closed.
+func (db *DistDB) followRangeChanges(feed *RangeFeed) {
+	for change := range feed.Changes() {
+		glog.V(1).Infof("range ending at %q changed: %+v", change.EndKey, change)
+		db.rangeCache.apply(change)
+	}
+}
+
+// WatchRangeChanges returns a RangeFeed which delivers changes to the
+// addressing records of ranges. The caller must close the feed.
+func (db *DistDB) WatchRangeChanges() *RangeFeed {
+	return newRangeFeed(db)
+}
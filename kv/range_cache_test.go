@@ -0,0 +1,109 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// locationsOn returns the locations of a range starting at start with
+// a replica on node nodeID.
+func locationsOn(start string, nodeID int32) storage.RangeLocations {
+	return storage.RangeLocations{StartKey: storage.Key(start), Replicas: []storage.Replica{{NodeID: nodeID}}}
+}
+
+// expectCached verifies the cached range containing key is on node
+// nodeID and ends at endKey, or that no range containing key is
+// cached if nodeID is zero.
+func expectCached(t *testing.T, rc *rangeCache, key string, nodeID int32, endKey string) {
+	locations, end, ok := rc.lookup(storage.Key(key))
+	if nodeID == 0 {
+		if ok {
+			t.Errorf("expected no cached range containing %q; got %+v", key, locations)
+		}
+		return
+	}
+	if !ok || locations.Replicas[0].NodeID != nodeID || string(end) != endKey {
+		t.Errorf("expected range containing %q on node %d ending at %q; got %+v ending at %q",
+			key, nodeID, endKey, locations, end)
+	}
+}
+
+// TestRangeCache verifies cached ranges are replaced by the ranges
+// which overlap them, and that changes to the cache prevent the
+// results of concurrent lookups from being cached.
+func TestRangeCache(t *testing.T) {
+	rc := &rangeCache{}
+	rc.add(locationsOn("", 1), storage.Key("m"), rc.currentGeneration())
+	rc.add(locationsOn("m", 2), storage.KeyMax, rc.currentGeneration())
+	expectCached(t, rc, "a", 1, "m")
+	expectCached(t, rc, "m", 2, string(storage.KeyMax))
+
+	// A split replaces the range with its halves.
+	rc.apply(RangeChange{EndKey: storage.Key("f"), Locations: locationsOn("", 3)})
+	expectCached(t, rc, "a", 3, "f")
+	expectCached(t, rc, "g", 0, "")
+	rc.apply(RangeChange{EndKey: storage.Key("m"), Locations: locationsOn("f", 4)})
+	expectCached(t, rc, "g", 4, "m")
+	expectCached(t, rc, "z", 2, string(storage.KeyMax))
+
+	// A merge replaces both ranges and removes the subsumed record.
+	rc.apply(RangeChange{EndKey: storage.KeyMax, Locations: locationsOn("f", 5)})
+	rc.apply(RangeChange{EndKey: storage.Key("m"), Removed: true})
+	expectCached(t, rc, "g", 5, string(storage.KeyMax))
+	expectCached(t, rc, "z", 5, string(storage.KeyMax))
+
+	// A lookup begun before a change isn't cached.
+	generation := rc.currentGeneration()
+	rc.evict(storage.Key("a"))
+	expectCached(t, rc, "a", 0, "")
+	rc.add(locationsOn("", 6), storage.Key("f"), generation)
+	expectCached(t, rc, "a", 0, "")
+
+	rc.apply(RangeChange{Resync: true})
+	expectCached(t, rc, "z", 0, "")
+}
+
+// TestRangeFeed verifies changes to range addressing records are
+// delivered by a RangeFeed.
+func TestRangeFeed(t *testing.T) {
+	db := newTestLocalDB(storage.KeyMax)
+	feed := newRangeFeed(db)
+	defer feed.Close()
+	// Wait for the initial poll to establish the starting point.
+	time.Sleep(10 * time.Millisecond)
+	meta := storage.RangeMetadata{RangeID: 2, StartKey: storage.Key("a"), EndKey: storage.Key("b")}
+	if err := UpdateRangeLocations(db, meta, locationsOn("a", 2)); err != nil {
+		t.Fatal(err)
+	}
+	if dr := <-db.Delete(&storage.DeleteRequest{Key: storage.MakeKey(storage.KeyMeta2Prefix, storage.Key("b"))}); dr.Error != nil {
+		t.Fatal(dr.Error)
+	}
+	for _, removed := range []bool{false, true} {
+		select {
+		case change := <-feed.Changes():
+			if string(change.EndKey) != "b" || change.Removed != removed ||
+				(!removed && (string(change.Locations.StartKey) != "a" || change.Locations.Replicas[0].NodeID != 2)) {
+				t.Errorf("unexpected change %+v", change)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for change (removed=%t)", removed)
+		}
+	}
+}
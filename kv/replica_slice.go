@@ -0,0 +1,163 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// A ReplicaOrder is a policy for ordering the replicas of a range
+// when sending it a request. The first replica in order is sent the
+// request first; others are tried if it fails or is slow to respond.
+type ReplicaOrder int
+
+const (
+	// OrderRandom tries replicas in random order, spreading load
+	// evenly. This is the default.
+	OrderRandom ReplicaOrder = iota
+	// OrderNearest tries replicas in order of increasing latency, as
+	// measured by RPC heartbeats to their nodes, so that reads prefer
+	// local replicas. Replicas with unmeasured latency are tried last.
+	OrderNearest
+	// OrderRoundRobin rotates the first replica tried with each
+	// request.
+	OrderRoundRobin
+	// OrderLeaderFirst tries the replica which most recently served a
+	// request for the range first, falling back to random order. As
+	// requests are served by the raft leader, this avoids forwarding.
+	OrderLeaderFirst
+	// OrderLocality tries replicas on nodes in the client's rack first,
+	// then those in its datacenter, then the others, in random order
+	// within each, per the localities nodes declare in their gossiped
+	// descriptors. See DistDBOptions.Datacenter and Rack.
+	OrderLocality
+)
+
+// A ReplicaSlice is a slice of replicas which may be reordered
+// according to a ReplicaOrder.
+type ReplicaSlice []storage.Replica
+
+// Shuffle randomly permutes the replicas.
+func (rs ReplicaSlice) Shuffle() {
+	for i, j := range rand.Perm(len(rs)) {
+		rs[i], rs[j] = rs[j], rs[i]
+	}
+}
+
+// Rotate rotates the replicas left by n, so that the replica at n%len
+// comes first.
+func (rs ReplicaSlice) Rotate(n int) {
+	if len(rs) == 0 {
+		return
+	}
+	n %= len(rs)
+	rotated := append(append(ReplicaSlice(nil), rs[n:]...), rs[:n]...)
+	copy(rs, rotated)
+}
+
+// FindReplica returns the index of the replica on the specified node
+// and store, or -1 if there's none.
+func (rs ReplicaSlice) FindReplica(nodeID, storeID int32) int {
+	for i := range rs {
+		if rs[i].NodeID == nodeID && rs[i].StoreID == storeID {
+			return i
+		}
+	}
+	return -1
+}
+
+// MoveToFront moves the replica at index i to the front, preserving
+// the order of the others.
+func (rs ReplicaSlice) MoveToFront(i int) {
+	replica := rs[i]
+	copy(rs[1:i+1], rs[:i])
+	rs[0] = replica
+}
+
+// SortByLatency stably sorts the replicas by the latency returned for
+// each. Replicas for which latency returns false sort last.
+func (rs ReplicaSlice) SortByLatency(latency func(storage.Replica) (time.Duration, bool)) {
+	latencies := make([]time.Duration, len(rs))
+	for i := range rs {
+		if l, ok := latency(rs[i]); ok {
+			latencies[i] = l
+		} else {
+			latencies[i] = -1
+		}
+	}
+	sort.Stable(replicasByLatency{rs, latencies})
+}
+
+// SortByLocality orders the replicas by decreasing score, as returned
+// for each, in random order among replicas with equal scores.
+func (rs ReplicaSlice) SortByLocality(score func(storage.Replica) int) {
+	rs.Shuffle()
+	scores := make([]int, len(rs))
+	for i := range rs {
+		scores[i] = score(rs[i])
+	}
+	sort.Stable(replicasByScore{rs, scores})
+}
+
+// replicasByScore implements sort.Interface, ordering replicas by
+// decreasing score.
+type replicasByScore struct {
+	replicas ReplicaSlice
+	scores   []int
+}
+
+func (rs replicasByScore) Len() int { return len(rs.replicas) }
+func (rs replicasByScore) Swap(i, j int) {
+	rs.replicas[i], rs.replicas[j] = rs.replicas[j], rs.replicas[i]
+	rs.scores[i], rs.scores[j] = rs.scores[j], rs.scores[i]
+}
+func (rs replicasByScore) Less(i, j int) bool { return rs.scores[i] > rs.scores[j] }
+
+// replicasByLatency implements sort.Interface, ordering replicas by
+// latency; negative latencies are unknown and sort last.
+type replicasByLatency struct {
+	replicas  ReplicaSlice
+	latencies []time.Duration
+}
+
+func (rl replicasByLatency) Len() int { return len(rl.replicas) }
+func (rl replicasByLatency) Swap(i, j int) {
+	rl.replicas[i], rl.replicas[j] = rl.replicas[j], rl.replicas[i]
+	rl.latencies[i], rl.latencies[j] = rl.latencies[j], rl.latencies[i]
+}
+func (rl replicasByLatency) Less(i, j int) bool {
+	li, lj := rl.latencies[i], rl.latencies[j]
+	if li < 0 || lj < 0 {
+		return lj < 0 && li >= 0
+	}
+	return li < lj
+}
+
+// replicaSetKey returns a key identifying the set of replicas of a
+// range, regardless of their order, for caching range leaders.
+func replicaSetKey(replicas []storage.Replica) string {
+	keys := make([]string, len(replicas))
+	for i, r := range replicas {
+		keys[i] = fmt.Sprintf("%d/%d/%d", r.NodeID, r.StoreID, r.RangeID)
+	}
+	sort.Strings(keys)
+	return fmt.Sprint(keys)
+}
@@ -0,0 +1,124 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// makeReplicas returns replicas on nodes with the specified IDs.
+func makeReplicas(nodeIDs ...int32) ReplicaSlice {
+	var rs ReplicaSlice
+	for _, nodeID := range nodeIDs {
+		rs = append(rs, storage.Replica{NodeID: nodeID, StoreID: nodeID})
+	}
+	return rs
+}
+
+// nodeIDs returns the node IDs of replicas, in order.
+func nodeIDs(rs ReplicaSlice) []int32 {
+	var ids []int32
+	for _, r := range rs {
+		ids = append(ids, r.NodeID)
+	}
+	return ids
+}
+
+// TestReplicaSlice verifies the reordering operations of ReplicaSlice.
+func TestReplicaSlice(t *testing.T) {
+	rs := makeReplicas(1, 2, 3, 4)
+	rs.Rotate(5)
+	if ids := nodeIDs(rs); !reflect.DeepEqual(ids, []int32{2, 3, 4, 1}) {
+		t.Errorf("unexpected rotation: %v", ids)
+	}
+	rs.MoveToFront(rs.FindReplica(4, 4))
+	if ids := nodeIDs(rs); !reflect.DeepEqual(ids, []int32{4, 2, 3, 1}) {
+		t.Errorf("unexpected order after move to front: %v", ids)
+	}
+	if i := rs.FindReplica(4, 5); i != -1 {
+		t.Errorf("expected no replica on store 5; got %d", i)
+	}
+	latencies := map[int32]time.Duration{1: time.Millisecond, 3: 10 * time.Millisecond}
+	rs.SortByLatency(func(r storage.Replica) (time.Duration, bool) {
+		l, ok := latencies[r.NodeID]
+		return l, ok
+	})
+	if ids := nodeIDs(rs); !reflect.DeepEqual(ids, []int32{1, 3, 4, 2}) {
+		t.Errorf("unexpected order by latency: %v", ids)
+	}
+	rs.Shuffle()
+	if len(rs) != 4 || rs.FindReplica(2, 2) < 0 {
+		t.Errorf("expected shuffle to permute replicas; got %v", nodeIDs(rs))
+	}
+}
+
+// TestOrderReplicas verifies the round-robin and leader-first
+// policies, and that ordering doesn't modify the supplied replicas.
+func TestOrderReplicas(t *testing.T) {
+	replicas := makeReplicas(1, 2, 3)
+	db := NewDBWithOptions(nil, DistDBOptions{ReplicaOrder: OrderRoundRobin})
+	first := map[int32]int{}
+	for i := 0; i < 6; i++ {
+		first[db.orderReplicas(replicas)[0].NodeID]++
+	}
+	if !reflect.DeepEqual(first, map[int32]int{1: 2, 2: 2, 3: 2}) {
+		t.Errorf("expected round robin to rotate evenly; got %v", first)
+	}
+	if ids := nodeIDs(replicas); !reflect.DeepEqual(ids, []int32{1, 2, 3}) {
+		t.Errorf("expected replicas unmodified; got %v", ids)
+	}
+
+	db = NewDBWithOptions(nil, DistDBOptions{ReplicaOrder: OrderLeaderFirst})
+	db.noteLeader(replicas, replicas[2])
+	// The leader is found regardless of the order of the replica set.
+	reordered := makeReplicas(2, 3, 1)
+	for i := 0; i < 10; i++ {
+		if leader := db.orderReplicas(reordered)[0]; leader.NodeID != 3 {
+			t.Fatalf("expected leader first; got %+v", leader)
+		}
+	}
+}
+
+// TestOrderLocality verifies replicas in the client's rack are tried
+// first, then those in its datacenter, then the others.
+func TestOrderLocality(t *testing.T) {
+	g := gossip.New()
+	localities := []struct{ dc, rack string }{{"b", "x"}, {"a", "y"}, {"a", "x"}, {"c", "x"}}
+	for i, l := range localities {
+		desc := gossip.NodeDescriptor{NodeID: int32(i + 1), Datacenter: l.dc, Rack: l.rack}
+		if err := g.AddInfo(gossip.MakeNodeIDGossipKey(desc.NodeID), desc, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db := NewDBWithOptions(g, DistDBOptions{ReplicaOrder: OrderLocality, Datacenter: "a", Rack: "x"})
+	// Node 5 has no gossiped descriptor and is considered remote.
+	replicas := makeReplicas(1, 2, 3, 4, 5)
+	for i := 0; i < 20; i++ {
+		ids := nodeIDs(db.orderReplicas(replicas))
+		if ids[0] != 3 || ids[1] != 2 {
+			t.Fatalf("expected nodes 3 then 2 first; got %v", ids)
+		}
+		remote := map[int32]bool{ids[2]: true, ids[3]: true, ids[4]: true}
+		if !reflect.DeepEqual(remote, map[int32]bool{1: true, 4: true, 5: true}) {
+			t.Fatalf("expected remote nodes last; got %v", ids)
+		}
+	}
+}
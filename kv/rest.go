@@ -67,12 +67,26 @@ func dbKey(path string) (storage.Key, error) {
 	return nil, err
 }
 
+// reservedKeyError refuses a write of key, replying with an error, if
+// it's reserved for the system. The REST server shares its node's
+// client, which may write reserved keys, so it refuses them itself.
+func reservedKeyError(w http.ResponseWriter, key storage.Key) bool {
+	if storage.IsReservedKey(key) {
+		http.Error(w, fmt.Sprintf("key %q is reserved for internal use", key), http.StatusForbidden)
+		return true
+	}
+	return false
+}
+
 func (s *RESTServer) handlePutAction(w http.ResponseWriter, r *http.Request) {
 	key, err := dbKey(r.URL.Path)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if reservedKeyError(w, key) {
+		return
+	}
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -111,6 +125,9 @@ func (s *RESTServer) handleDeleteAction(w http.ResponseWriter, r *http.Request)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if reservedKeyError(w, key) {
+		return
+	}
 	dr := <-s.db.Delete(&storage.DeleteRequest{Key: key})
 	if dr.Error != nil {
 		http.Error(w, dr.Error.Error(), http.StatusInternalServerError)
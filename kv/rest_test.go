@@ -49,6 +49,8 @@ func TestRESTEndpoints(t *testing.T) {
 		{"GET", "Hello, 世界", "", "is cool", 200},
 		{"DELETE", "Hello, 世界", "", "", 200},
 		{"GET", "Hello, 世界", "", "key not found\n", 404},
+		{"PUT", "%00zone", "clobbered", "key \"\\x00zone\" is reserved for internal use\n", 403},
+		{"DELETE", "%00%00meta2%FF", "", "key \"\\x00\\x00meta2\\xff\" is reserved for internal use\n", 403},
 	}
 
 	for i, c := range testCases {
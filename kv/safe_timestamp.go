@@ -0,0 +1,54 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// SafeTimestamp returns a timestamp, in nanoseconds since the epoch,
+// at and below which all writes to keys in [start, end) have been
+// resolved: the minimum of the resolved timestamps of the ranges
+// spanning the keys. Each range closes its resolved timestamp when
+// reporting it, moving later writes past it, so versioned reads at
+// the timestamp, as via GetAtI, see the same values however late
+// they're made and whichever client makes them, until the versions
+// they read are garbage collected. Independent clients, such as the
+// workers of a distributed export, may thus share a consistent
+// snapshot by agreeing on a timestamp obtained once.
+func SafeTimestamp(db DB, start, end storage.Key) (int64, error) {
+	if bytes.Compare(start, end) >= 0 {
+		return 0, util.Errorf("invalid span %q-%q", start, end)
+	}
+	var safe int64
+	for key := start; bytes.Compare(key, end) < 0; {
+		reply := <-db.InternalResolvedTimestamp(&storage.InternalResolvedTimestampRequest{Key: key})
+		if reply.Error != nil {
+			return 0, reply.Error
+		}
+		if bytes.Compare(reply.EndKey, key) <= 0 {
+			return 0, util.Errorf("range ending at %q does not contain %q", reply.EndKey, key)
+		}
+		if bytes.Equal(key, start) || reply.Timestamp < safe {
+			safe = reply.Timestamp
+		}
+		key = reply.EndKey
+	}
+	return safe, nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// TestSafeTimestamp verifies the safe timestamp of a span trails the
+// clock and is held below the write intents within it.
+func TestSafeTimestamp(t *testing.T) {
+	db := newTestLocalDB(storage.KeyMax)
+	safe, err := SafeTimestamp(db, storage.Key("a"), storage.Key("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UnixNano()
+	if safe <= 0 || safe > now-int64(storage.MaxClockOffset) {
+		t.Errorf("expected safe timestamp to trail %d; got %d", now, safe)
+	}
+
+	pr := <-db.Put(&storage.PutRequest{
+		RequestHeader: storage.RequestHeader{TxID: "txn1", Timestamp: safe + 1000},
+		Key:           storage.Key("a"),
+		Value:         storage.Value{Bytes: []byte("value")},
+	})
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	time.Sleep(time.Millisecond)
+	if ts, err := SafeTimestamp(db, storage.Key("a"), storage.Key("b")); err != nil || ts != safe+999 {
+		t.Errorf("expected safe timestamp %d below intent; got %d, %v", safe+999, ts, err)
+	}
+
+	if _, err := SafeTimestamp(db, storage.Key("b"), storage.Key("a")); err == nil {
+		t.Error("expected error for invalid span")
+	}
+}
+
+// TestSafeTimestampReads verifies versioned reads at the safe timestamp
+// don't see writes made after it was obtained, even those stamped at
+// or before it.
+func TestSafeTimestampReads(t *testing.T) {
+	db := newTestLocalDB(storage.KeyMax)
+	if pr := <-db.Put(&storage.PutRequest{
+		Key:   storage.Key("a"),
+		Value: storage.Value{Bytes: []byte("before"), Timestamp: time.Now().UnixNano() - 2*int64(storage.MaxClockOffset)},
+	}); pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	safe, err := SafeTimestamp(db, storage.Key("a"), storage.Key("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pr := <-db.Put(&storage.PutRequest{
+		RequestHeader: storage.RequestHeader{Timestamp: safe},
+		Key:           storage.Key("a"),
+		Value:         storage.Value{Bytes: []byte("after")},
+	}); pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	if br := <-db.InternalBulkWrite(&storage.InternalBulkWriteRequest{Rows: []storage.KeyValue{
+		{Key: storage.Key("b"), Value: storage.Value{Bytes: []byte("after"), Timestamp: safe - 1}},
+	}}); br.Error != nil {
+		t.Fatal(br.Error)
+	}
+
+	if gr := <-db.Get(&storage.GetRequest{
+		RequestHeader: storage.RequestHeader{Timestamp: safe},
+		Key:           storage.Key("a"),
+	}); gr.Error != nil || string(gr.Value.Bytes) != "before" {
+		t.Errorf("expected read at safe timestamp to see value before it; got %q, %v", gr.Value.Bytes, gr.Error)
+	}
+	if gr := <-db.Get(&storage.GetRequest{
+		RequestHeader: storage.RequestHeader{Timestamp: safe},
+		Key:           storage.Key("b"),
+	}); gr.Error != nil || gr.Value.Bytes != nil {
+		t.Errorf("expected no value for b at safe timestamp; got %q, %v", gr.Value.Bytes, gr.Error)
+	}
+	gr := <-db.Get(&storage.GetRequest{Key: storage.Key("a")})
+	if gr.Error != nil || string(gr.Value.Bytes) != "after" || gr.Value.Timestamp <= safe {
+		t.Errorf("expected later write moved past safe timestamp %d; got %q at %d, %v", safe, gr.Value.Bytes, gr.Value.Timestamp, gr.Error)
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// A Codec serializes values of the types registered with a
+// SchemaRegistry. Codecs for other serializations, such as protocol
+// buffers, may be supplied by implementing this interface.
+type Codec interface {
+	// Name identifies the codec; registrations of the same prefix
+	// conflict if their codecs' names differ.
+	Name() string
+	// Encode serializes value.
+	Encode(value interface{}) ([]byte, error)
+	// Decode deserializes b into value, which is a pointer.
+	Decode(b []byte, value interface{}) error
+}
+
+// GobCodec is the Codec for values serialized with encoding/gob, as
+// written by PutI.
+type GobCodec struct{}
+
+// Name implements Codec.
+func (GobCodec) Name() string { return "gob" }
+
+// Encode implements Codec.
+func (GobCodec) Encode(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode implements Codec.
+func (GobCodec) Decode(b []byte, value interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(value)
+}
+
+// A schemaEntry maps a key prefix to the type and codec of the values
+// stored under it.
+type schemaEntry struct {
+	prefix storage.Key
+	typ    reflect.Type
+	codec  Codec
+}
+
+// A SchemaRegistry maps key prefixes to the types of the values stored
+// under them and the codecs with which they're serialized, so that
+// values may be decoded without the caller knowing their type, as by
+// tooling displaying arbitrary keys. Like the configuration maps, the
+// longest registered prefix of a key determines its type.
+type SchemaRegistry struct {
+	mu      sync.RWMutex
+	entries []schemaEntry // Sorted by prefix
+}
+
+// NewSchemaRegistry returns an empty SchemaRegistry.
+func NewSchemaRegistry() *SchemaRegistry {
+	return &SchemaRegistry{}
+}
+
+// DefaultSchemaRegistry maps the prefixes of system keys to the types
+// of their values. Applications may register their own prefixes.
+var DefaultSchemaRegistry = NewSchemaRegistry()
+
+func init() {
+	for _, e := range []struct {
+		prefix storage.Key
+		value  interface{}
+	}{
+		{storage.KeyMeta1Prefix, storage.RangeLocations{}},
+		{storage.KeyMeta2Prefix, storage.RangeLocations{}},
+		{storage.KeyConfigAccountingPrefix, storage.AcctConfig{}},
+		{storage.KeyConfigPermissionPrefix, storage.PermConfig{}},
+		{storage.KeyConfigZonePrefix, storage.ZoneConfig{}},
+		{storage.KeyConfigCompressionPrefix, storage.CompressionConfig{}},
+		{storage.KeyConfigTTLPrefix, storage.TTLConfig{}},
+		{storage.KeyConfigFreezePrefix, storage.FreezeConfig{}},
+		{storage.KeyJobPrefix, Job{}},
+	} {
+		if err := DefaultSchemaRegistry.Register(e.prefix, e.value, GobCodec{}); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Register maps prefix to the type of value, which may be a pointer to
+// the type, serialized with codec. Registering a prefix again with the
+// same type and codec has no effect; registering it with a different
+// type or codec is an error. Prefixes of registered prefixes may be
+// registered with other types, applying to their remaining keys.
+func (sr *SchemaRegistry) Register(prefix storage.Key, value interface{}, codec Codec) error {
+	if value == nil || codec == nil {
+		return util.Errorf("prefix %q: a type and codec must be specified", prefix)
+	}
+	typ := reflect.TypeOf(value)
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	i := sort.Search(len(sr.entries), func(i int) bool {
+		return bytes.Compare(sr.entries[i].prefix, prefix) >= 0
+	})
+	if i < len(sr.entries) && bytes.Equal(sr.entries[i].prefix, prefix) {
+		e := sr.entries[i]
+		if e.typ != typ || e.codec.Name() != codec.Name() {
+			return util.Errorf("prefix %q is registered as %s with codec %s; can't register %s with codec %s",
+				prefix, e.typ, e.codec.Name(), typ, codec.Name())
+		}
+		return nil
+	}
+	entry := schemaEntry{prefix: append(storage.Key(nil), prefix...), typ: typ, codec: codec}
+	sr.entries = append(sr.entries[:i], append([]schemaEntry{entry}, sr.entries[i:]...)...)
+	return nil
+}
+
+// Lookup returns the type and codec of the values stored at key,
+// as registered for its longest registered prefix. Returns false if
+// no prefix of key is registered.
+func (sr *SchemaRegistry) Lookup(key storage.Key) (reflect.Type, Codec, bool) {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+	for i := len(sr.entries) - 1; i >= 0; i-- {
+		if bytes.HasPrefix(key, sr.entries[i].prefix) {
+			return sr.entries[i].typ, sr.entries[i].codec, true
+		}
+	}
+	return nil, nil, false
+}
+
+// Decode deserializes b, as stored at key, into a new value of the
+// type registered for key and returns a pointer to it.
+func (sr *SchemaRegistry) Decode(key storage.Key, b []byte) (interface{}, error) {
+	typ, codec, ok := sr.Lookup(key)
+	if !ok {
+		return nil, util.Errorf("no type is registered for key %q", key)
+	}
+	value := reflect.New(typ).Interface()
+	if err := codec.Decode(b, value); err != nil {
+		return nil, util.Errorf("unable to decode value of key %q as %s: %v", key, typ, err)
+	}
+	return value, nil
+}
+
+// Render returns a human-readable rendering of b, as stored at key:
+// its decoded fields if key's type is registered and the value
+// decodes, and otherwise the quoted bytes.
+func (sr *SchemaRegistry) Render(key storage.Key, b []byte) string {
+	if len(b) == 0 {
+		return fmt.Sprintf("%q", b)
+	}
+	value, err := sr.Decode(key, b)
+	if err != nil {
+		return fmt.Sprintf("%q", b)
+	}
+	return fmt.Sprintf("%+v", reflect.ValueOf(value).Elem().Interface())
+}
+
+// GetI is like the package's GetI, but decodes the value into a new
+// value of the type registered for key and returns a pointer to it.
+func (sr *SchemaRegistry) GetI(db DB, key storage.Key) (interface{}, bool, int64, error) {
+	gr := <-db.Get(&storage.GetRequest{Key: key})
+	if gr.Error != nil {
+		return nil, false, 0, gr.Error
+	}
+	if len(gr.Value.Bytes) == 0 {
+		return nil, false, 0, nil
+	}
+	value, err := sr.Decode(key, gr.Value.Bytes)
+	return value, true, gr.Value.Timestamp, err
+}
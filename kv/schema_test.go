@@ -0,0 +1,99 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// jsonCodec is a codec distinct from GobCodec, for testing conflicts.
+type jsonCodec struct{ GobCodec }
+
+func (jsonCodec) Name() string { return "json" }
+
+// TestSchemaRegistryRegister verifies registrations resolve to the
+// longest registered prefix and conflicting registrations fail.
+func TestSchemaRegistryRegister(t *testing.T) {
+	sr := NewSchemaRegistry()
+	if err := sr.Register(storage.Key("a"), storage.ZoneConfig{}, GobCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sr.Register(storage.Key("ab"), &storage.PermConfig{}, GobCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sr.Register(storage.Key("a"), &storage.ZoneConfig{}, GobCodec{}); err != nil {
+		t.Errorf("expected identical registration to succeed; got %v", err)
+	}
+	if err := sr.Register(storage.Key("a"), storage.PermConfig{}, GobCodec{}); err == nil {
+		t.Error("expected registration of a different type to fail")
+	}
+	if err := sr.Register(storage.Key("a"), storage.ZoneConfig{}, jsonCodec{}); err == nil {
+		t.Error("expected registration of a different codec to fail")
+	}
+	if err := sr.Register(storage.Key("b"), nil, GobCodec{}); err == nil {
+		t.Error("expected registration without a type to fail")
+	}
+
+	testCases := []struct {
+		key   storage.Key
+		typ   reflect.Type
+		found bool
+	}{
+		{storage.Key("a"), reflect.TypeOf(storage.ZoneConfig{}), true},
+		{storage.Key("aa"), reflect.TypeOf(storage.ZoneConfig{}), true},
+		{storage.Key("abc"), reflect.TypeOf(storage.PermConfig{}), true},
+		{storage.Key("b"), nil, false},
+	}
+	for i, test := range testCases {
+		typ, _, found := sr.Lookup(test.key)
+		if found != test.found || typ != test.typ {
+			t.Errorf("%d: expected %s, %t; got %s, %t", i, test.typ, test.found, typ, found)
+		}
+	}
+}
+
+// TestSchemaRegistryGetI verifies values of system keys are decoded
+// into their registered types and rendered.
+func TestSchemaRegistryGetI(t *testing.T) {
+	db := newTestLocalDB(storage.KeyMax)
+	if err := BootstrapConfigs(db); err != nil {
+		t.Fatal(err)
+	}
+	key := storage.MakeKey(storage.KeyConfigZonePrefix, storage.KeyMin)
+	value, ok, _, err := DefaultSchemaRegistry.GetI(db, key)
+	if err != nil || !ok {
+		t.Fatalf("expected zone config; got %t, %v", ok, err)
+	}
+	zone, isZone := value.(*storage.ZoneConfig)
+	if !isZone || zone.RangeMaxBytes != 67108864 {
+		t.Errorf("expected default zone config; got %+v", value)
+	}
+	if _, ok, _, err = DefaultSchemaRegistry.GetI(db, storage.Key("unregistered")); ok || err != nil {
+		t.Errorf("expected missing key not to be found; got %t, %v", ok, err)
+	}
+
+	gr := <-db.Get(&storage.GetRequest{Key: key})
+	if rendered := DefaultSchemaRegistry.Render(key, gr.Value.Bytes); !strings.Contains(rendered, "RangeMaxBytes:67108864") {
+		t.Errorf("unexpected rendering %s", rendered)
+	}
+	if rendered := DefaultSchemaRegistry.Render(storage.Key("unregistered"), []byte("a")); rendered != `"a"` {
+		t.Errorf("expected unregistered value rendered as quoted bytes; got %s", rendered)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// A TSPoint is a count recorded to a time series at a time, in
+// nanoseconds since the epoch.
+type TSPoint struct {
+	Timestamp int64
+	Count     int64
+}
+
+// RecordTimeSeries adds the counts of points to the time series name
+// at each of storage.TSResolutions. Points are merged into the slots
+// containing their timestamps, so that a single AccumulateTS per
+// block and resolution is sent; coarser resolutions thus hold rollups
+// of finer ones. Blocks are pruned by range garbage collection once
+// past their resolution's retention.
+//
+// Resolutions are updated independently: if an error is returned, the
+// points may have been recorded at some resolutions but not others.
+func RecordTimeSeries(db DB, name string, points []TSPoint) error {
+	if name == "" || strings.IndexByte(name, 0) >= 0 {
+		return util.Errorf("invalid time series name %q", name)
+	}
+	var replies []<-chan *storage.AccumulateTSResponse
+	for _, res := range storage.TSResolutions {
+		blocks := map[int64][]int64{}
+		for _, p := range points {
+			blockStart := res.BlockStart(p.Timestamp)
+			slot := int((res.SlotStart(p.Timestamp) - blockStart) / int64(res.Slot))
+			counts := blocks[blockStart]
+			for len(counts) <= slot {
+				counts = append(counts, 0)
+			}
+			counts[slot] += p.Count
+			blocks[blockStart] = counts
+		}
+		for blockStart, counts := range blocks {
+			replies = append(replies, db.AccumulateTS(&storage.AccumulateTSRequest{
+				Key:    storage.MakeTSKey(name, res, blockStart),
+				Counts: counts,
+			}))
+		}
+	}
+	var err error
+	for _, replyChan := range replies {
+		if reply := <-replyChan; reply.Error != nil && err == nil {
+			err = reply.Error
+		}
+	}
+	return err
+}
+
+// A TSQueryResult holds time series read by QueryTimeSeries, aligned
+// to common slots: Series[name][i] is the count of the slot starting
+// at Start + i*Resolution.Slot.
+type TSQueryResult struct {
+	Start      int64
+	Resolution storage.TSResolution
+	Series     map[string][]int64
+}
+
+// QueryTimeSeries reads the time series names at resolution res over
+// the slots overlapping the span of time from start up to end, in
+// nanoseconds since the epoch. Blocks are fetched from whichever
+// ranges hold them and aligned, with slots for which nothing was
+// recorded, including those of pruned blocks, reported as zero.
+// Requires the experimental FeatureTimeSeries of DistDB clients.
+func QueryTimeSeries(db DB, names []string, res storage.TSResolution, start, end int64) (*TSQueryResult, error) {
+	if end <= start {
+		return nil, util.Errorf("invalid time series query span [%d, %d)", start, end)
+	}
+	result := &TSQueryResult{
+		Start:      res.SlotStart(start),
+		Resolution: res,
+		Series:     map[string][]int64{},
+	}
+	slots := int((res.SlotStart(end-1)-result.Start)/int64(res.Slot)) + 1
+	for _, name := range names {
+		counts := make([]int64, slots)
+		startKey := storage.MakeTSKey(name, res, res.BlockStart(start))
+		endKey := storage.MakeKey(storage.MakeTSKey(name, res, res.BlockStart(end-1)), storage.Key{0})
+		block, err := GetTSBlocks(db, startKey, endKey, 0)
+		if err != nil {
+			return nil, err
+		}
+		for i, key := range block.Keys {
+			_, _, blockStart, err := storage.DecodeTSKey(key)
+			if err != nil {
+				return nil, err
+			}
+			offset := int((blockStart - result.Start) / int64(res.Slot))
+			for j, c := range block.Series(i) {
+				if slot := offset + j; slot >= 0 && slot < slots {
+					counts[slot] = c
+				}
+			}
+		}
+		result.Series[name] = counts
+	}
+	return result, nil
+}
+
+// GetTSBlocks reads the time series accumulated by AccumulateTS at
+// the keys from start up to end, which may span ranges, and returns
+// them packed into a single block. Each GetTSBlock request reads up
+// to blockKeys keys, or as many as a single reply allows if blockKeys
+// is 0, and is resumed from where the previous reply stopped.
+func GetTSBlocks(db DB, start, end storage.Key, blockKeys int64) (*storage.GetTSBlockResponse, error) {
+	block := &storage.GetTSBlockResponse{}
+	for key := start; ; {
+		reply := <-db.GetTSBlock(&storage.GetTSBlockRequest{StartKey: key, EndKey: end, MaxKeys: blockKeys})
+		if reply.Error != nil {
+			return nil, reply.Error
+		}
+		block.Keys = append(block.Keys, reply.Keys...)
+		block.Lengths = append(block.Lengths, reply.Lengths...)
+		block.Counts = append(block.Counts, reply.Counts...)
+		if reply.ResumeKey == nil || bytes.Compare(reply.ResumeKey, end) >= 0 {
+			return block, nil
+		}
+		// A reply must make progress; otherwise the range serving it
+		// doesn't hold the keys following it.
+		if bytes.Compare(reply.ResumeKey, key) <= 0 {
+			return nil, util.Errorf("time series block read stalled at %q", key)
+		}
+		key = reply.ResumeKey
+	}
+}
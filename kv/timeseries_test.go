@@ -0,0 +1,114 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// TestGetTSBlocks verifies time series are read in blocks resumed
+// until the end of the requested span.
+func TestGetTSBlocks(t *testing.T) {
+	db := newTestLocalDB(storage.KeyMax)
+	var expKeys []storage.Key
+	for i := 0; i < 10; i++ {
+		key := storage.Key(fmt.Sprintf("ts%02d", i))
+		expKeys = append(expKeys, key)
+		reply := <-db.AccumulateTS(&storage.AccumulateTSRequest{Key: key, Counts: []int64{int64(i), 1}})
+		if reply.Error != nil {
+			t.Fatal(reply.Error)
+		}
+	}
+	block, err := GetTSBlocks(db, storage.Key("ts"), storage.Key("tt"), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(block.Keys, expKeys) {
+		t.Errorf("expected keys %q; got %q", expKeys, block.Keys)
+	}
+	for i := range block.Keys {
+		if series := block.Series(i); !reflect.DeepEqual(series, []int64{int64(i), 1}) {
+			t.Errorf("%d: unexpected series %v", i, series)
+		}
+	}
+
+	// A range which doesn't hold the keys following it stalls the read.
+	if _, err := GetTSBlocks(newTestLocalDB(storage.Key("m")), storage.Key("a"), storage.Key("z"), 0); err == nil {
+		t.Error("expected error reading past the end of the only range")
+	}
+}
+
+// TestRecordAndQueryTimeSeries verifies points are merged into slots
+// at each resolution and that queries align the slots of series
+// spanning several blocks.
+func TestRecordAndQueryTimeSeries(t *testing.T) {
+	db := newTestLocalDB(storage.KeyMax)
+	hour := int64(time.Hour)
+	base := 1000 * hour
+	points := []TSPoint{
+		{Timestamp: base - int64(5*time.Second), Count: 1},
+		{Timestamp: base + int64(1*time.Second), Count: 2},
+		{Timestamp: base + int64(9*time.Second), Count: 3},
+		{Timestamp: base + int64(25*time.Second), Count: 4},
+	}
+	if err := RecordTimeSeries(db, "requests", points); err != nil {
+		t.Fatal(err)
+	}
+	if err := RecordTimeSeries(db, "errors", []TSPoint{{Timestamp: base + int64(15*time.Second), Count: 7}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RecordTimeSeries(db, "bad\x00name", points); err == nil {
+		t.Error("expected error recording series with zero byte in name")
+	}
+
+	res10s, err := storage.LookupTSResolution("10s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := QueryTimeSeries(db, []string{"requests", "errors", "missing"}, res10s, base-int64(10*time.Second), base+int64(30*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Start != base-int64(10*time.Second) {
+		t.Errorf("expected series to start at %d; got %d", base-int64(10*time.Second), result.Start)
+	}
+	expected := map[string][]int64{
+		"requests": {1, 5, 0, 4},
+		"errors":   {0, 0, 7, 0},
+		"missing":  {0, 0, 0, 0},
+	}
+	if !reflect.DeepEqual(result.Series, expected) {
+		t.Errorf("expected series %v; got %v", expected, result.Series)
+	}
+
+	// Coarser resolutions hold rollups of the same points.
+	res1h, err := storage.LookupTSResolution("1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = QueryTimeSeries(db, []string{"requests"}, res1h, base-hour, base+hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []int64{1, 9}; !reflect.DeepEqual(result.Series["requests"], exp) {
+		t.Errorf("expected hourly series %v; got %v", exp, result.Series["requests"])
+	}
+}
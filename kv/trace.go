@@ -0,0 +1,203 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// A Tracer receives events describing the execution of DistDB
+// requests. Implementations must be safe for concurrent use, as
+// events are delivered from the goroutines servicing requests.
+type Tracer interface {
+	// Method is invoked when a request completes, with its total
+	// latency, including range lookups and retries.
+	Method(method string, latency time.Duration, err error)
+	// RPC is invoked for each attempt to send a request to its range,
+	// with the replica which served the request if successful.
+	RPC(method string, replica storage.Replica, latency time.Duration, err error)
+	// Retry is invoked before a request is retried following a
+	// retryable error.
+	Retry(method string, err error)
+	// RangeLookup is invoked for each lookup of range metadata for key.
+	RangeLookup(key storage.Key, latency time.Duration, err error)
+	// Push is invoked for each push of the transaction pushee, whose
+	// write intent blocked a request, with the pushee's status after
+	// the push, or the error if it couldn't be pushed.
+	Push(pushee string, latency time.Duration, status storage.TxnStatus, err error)
+}
+
+// MethodMetrics holds latencies and counts for a single method.
+type MethodMetrics struct {
+	Latency    util.Histogram // End-to-end request latency
+	RPCLatency util.Histogram // Latency of individual RPC attempts
+	Errors     int64          // Requests which failed
+	Retries    int64          // Retried attempts
+}
+
+// Metrics is a Tracer which aggregates DistDB events into latency
+// histograms and counts. A Metrics may be published via expvar, as
+// String returns its contents encoded as JSON.
+type Metrics struct {
+	mu           sync.Mutex
+	Methods      map[string]*MethodMetrics // Metrics by method name
+	RangeLookups util.Histogram            // Range metadata lookup latency
+	LookupErrors int64                     // Failed range metadata lookups
+	Pushes       int64                     // Pushes of transactions blocking requests
+	PushErrors   int64                     // Pushes which failed, as their transactions are pending
+	Replicas     map[string]int64          // Requests served by replica ("node/store")
+	Divergences  int64                     // Quorum reads whose replicas disagreed
+}
+
+// NewMetrics returns an empty Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		Methods:  map[string]*MethodMetrics{},
+		Replicas: map[string]int64{},
+	}
+}
+
+// method returns the metrics for method, creating them if
+// necessary. Requires the lock.
+func (m *Metrics) method(method string) *MethodMetrics {
+	mm, ok := m.Methods[method]
+	if !ok {
+		mm = &MethodMetrics{}
+		m.Methods[method] = mm
+	}
+	return mm
+}
+
+// Method implements the Tracer interface.
+func (m *Metrics) Method(method string, latency time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mm := m.method(method)
+	mm.Latency.Record(latency)
+	if err != nil {
+		mm.Errors++
+	}
+}
+
+// RPC implements the Tracer interface.
+func (m *Metrics) RPC(method string, replica storage.Replica, latency time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.method(method).RPCLatency.Record(latency)
+	if err == nil {
+		m.Replicas[fmt.Sprintf("%d/%d", replica.NodeID, replica.StoreID)]++
+	}
+}
+
+// Retry implements the Tracer interface.
+func (m *Metrics) Retry(method string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.method(method).Retries++
+}
+
+// RangeLookup implements the Tracer interface.
+func (m *Metrics) RangeLookup(key storage.Key, latency time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.RangeLookups.Record(latency)
+	if err != nil {
+		m.LookupErrors++
+	}
+}
+
+// Push implements the Tracer interface.
+func (m *Metrics) Push(pushee string, latency time.Duration, status storage.TxnStatus, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Pushes++
+	if err != nil {
+		m.PushErrors++
+	}
+}
+
+// Snapshot returns a copy of the metrics which is safe to inspect
+// while requests continue to be traced.
+func (m *Metrics) Snapshot() *Metrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := NewMetrics()
+	for method, mm := range m.Methods {
+		s.Methods[method] = &MethodMetrics{
+			Latency:    mm.Latency.Copy(),
+			RPCLatency: mm.RPCLatency.Copy(),
+			Errors:     mm.Errors,
+			Retries:    mm.Retries,
+		}
+	}
+	s.RangeLookups = m.RangeLookups.Copy()
+	s.LookupErrors = m.LookupErrors
+	s.Pushes = m.Pushes
+	s.PushErrors = m.PushErrors
+	s.Divergences = m.Divergences
+	for replica, count := range m.Replicas {
+		s.Replicas[replica] = count
+	}
+	return s
+}
+
+// String returns the metrics as JSON, implementing expvar.Var.
+func (m *Metrics) String() string {
+	b, err := json.Marshal(m.Snapshot())
+	if err != nil {
+		return fmt.Sprintf("%q", err.Error())
+	}
+	return string(b)
+}
+
+// multiTracer delivers events to each of a slice of tracers.
+type multiTracer []Tracer
+
+func (mt multiTracer) Method(method string, latency time.Duration, err error) {
+	for _, t := range mt {
+		t.Method(method, latency, err)
+	}
+}
+
+func (mt multiTracer) RPC(method string, replica storage.Replica, latency time.Duration, err error) {
+	for _, t := range mt {
+		t.RPC(method, replica, latency, err)
+	}
+}
+
+func (mt multiTracer) Retry(method string, err error) {
+	for _, t := range mt {
+		t.Retry(method, err)
+	}
+}
+
+func (mt multiTracer) RangeLookup(key storage.Key, latency time.Duration, err error) {
+	for _, t := range mt {
+		t.RangeLookup(key, latency, err)
+	}
+}
+
+func (mt multiTracer) Push(pushee string, latency time.Duration, status storage.TxnStatus, err error) {
+	for _, t := range mt {
+		t.Push(pushee, latency, status, err)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// TestMetrics verifies trace events are aggregated by method and
+// replica and that snapshots are isolated from subsequent events.
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+	replica := storage.Replica{NodeID: 2, StoreID: 3}
+	m.RangeLookup(storage.Key("a"), time.Millisecond, nil)
+	m.Retry("Node.Get", util.Error("retry"))
+	m.RPC("Node.Get", storage.Replica{}, 2*time.Millisecond, util.Error("failed"))
+	m.RPC("Node.Get", replica, time.Millisecond, nil)
+	m.Method("Node.Get", 5*time.Millisecond, nil)
+	m.Method("Node.Put", time.Millisecond, util.Error("failed"))
+
+	s := m.Snapshot()
+	m.Method("Node.Get", time.Millisecond, nil)
+
+	get := s.Methods["Node.Get"]
+	if get.Latency.Count != 1 || get.RPCLatency.Count != 2 || get.Retries != 1 || get.Errors != 0 {
+		t.Errorf("unexpected Node.Get metrics: %+v", get)
+	}
+	if put := s.Methods["Node.Put"]; put.Errors != 1 {
+		t.Errorf("expected one Node.Put error; got %+v", put)
+	}
+	if s.RangeLookups.Count != 1 {
+		t.Errorf("expected one range lookup; got %d", s.RangeLookups.Count)
+	}
+	if count := s.Replicas["2/3"]; count != 1 {
+		t.Errorf("expected one request served by replica 2/3; got %d", count)
+	}
+
+	// Verify the expvar representation is valid JSON.
+	var decoded map[string]interface{}
+	if err := json.Unmarshal([]byte(m.String()), &decoded); err != nil {
+		t.Errorf("expected metrics to encode as JSON: %v", err)
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"sync"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/golang/glog"
+)
+
+// txnWrites tracks the writes of transactions sent via a DistDB, so
+// that writes which would exceed storage.MaxTxnKeys or
+// storage.MaxTxnBytes fail before being sent. A transaction is
+// tracked from its first write until its EndTransaction is sent.
+type txnWrites struct {
+	mu       sync.Mutex
+	maxKeys  int
+	maxBytes int64
+	txns     map[string]*txnSize
+}
+
+// txnSize holds the keys and bytes written by a transaction.
+type txnSize struct {
+	keys  map[string]struct{}
+	bytes int64
+}
+
+// newTxnWrites returns a txnWrites enforcing the specified limits.
+func newTxnWrites(maxKeys int, maxBytes int64) *txnWrites {
+	return &txnWrites{
+		maxKeys:  maxKeys,
+		maxBytes: maxBytes,
+		txns:     map[string]*txnSize{},
+	}
+}
+
+// admit records the writes of args, if it's part of a transaction.
+// Returns a TxnTooLargeError without recording the writes if they
+// would exceed the limits. Ending a transaction stops tracking it.
+func (tw *txnWrites) admit(args storage.Request) error {
+	txID := args.Header().TxID
+	if txID == "" {
+		return nil
+	}
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if _, ok := args.(*storage.EndTransactionRequest); ok {
+		delete(tw.txns, txID)
+		return nil
+	}
+	keys, size := writeSize(args)
+	if len(keys) == 0 {
+		return nil
+	}
+	ts, ok := tw.txns[txID]
+	if !ok {
+		ts = &txnSize{keys: map[string]struct{}{}}
+	}
+	newKeys := 0
+	for _, key := range keys {
+		if _, ok := ts.keys[string(key)]; !ok {
+			newKeys++
+		}
+	}
+	if len(ts.keys)+newKeys > tw.maxKeys || ts.bytes+size > tw.maxBytes {
+		return &storage.TxnTooLargeError{TxID: txID, Keys: len(ts.keys) + newKeys, Bytes: ts.bytes + size}
+	}
+	for _, key := range keys {
+		ts.keys[string(key)] = struct{}{}
+	}
+	ts.bytes += size
+	tw.txns[txID] = ts
+	return nil
+}
+
+// writeSize returns the keys written by the request args and the
+// bytes of keys and values it writes. A DeleteRange counts as a write
+// of its start key, as the keys it deletes aren't known in advance.
+func writeSize(args interface{}) ([]storage.Key, int64) {
+	switch t := args.(type) {
+	case *storage.PutRequest:
+		return []storage.Key{t.Key}, int64(len(t.Key) + len(t.Value.Bytes))
+	case *storage.IncrementRequest:
+		return []storage.Key{t.Key}, int64(len(t.Key) + binary.MaxVarintLen64)
+	case *storage.AppendRequest:
+		return []storage.Key{t.Key}, int64(len(t.Key) + len(t.Value.Bytes))
+	case *storage.DeleteRequest:
+		return []storage.Key{t.Key}, int64(len(t.Key))
+	case *storage.DeleteRangeRequest:
+		return []storage.Key{t.StartKey}, int64(len(t.StartKey) + len(t.EndKey))
+	case *storage.AccumulateTSRequest:
+		return []storage.Key{t.Key}, int64(len(t.Key) + 8*len(t.Counts))
+	case *storage.EnqueueMessageRequest:
+		return []storage.Key{t.Inbox}, int64(len(t.Inbox) + len(t.Message.Bytes))
+	case *storage.InternalBulkWriteRequest:
+		keys := make([]storage.Key, len(t.Rows))
+		var size int64
+		for i, row := range t.Rows {
+			keys[i] = row.Key
+			size += int64(len(row.Key) + len(row.Value.Bytes))
+		}
+		return keys, size
+	}
+	return nil, 0
+}
+
+// UpdateJournal records the progress of an update applied with
+// ApplyChunked.
+type UpdateJournal struct {
+	ID      string // Identifies the update
+	Applied int    // Leading rows written by completed chunks
+	Total   int    // Rows in the update
+}
+
+// ApplyChunked writes rows, an update which may be too large for a
+// single transaction, in chunks within the transaction limits. The
+// progress of the update, identified by id, is recorded at journalKey
+// after each chunk, so that an interrupted update resumes where it
+// left off when ApplyChunked is invoked again with the same id and
+// rows. Each chunk is written, with its journal entry, in a
+// transaction, so that the journal reflects exactly the chunks
+// written. The journal is deleted once all rows are written.
+func ApplyChunked(db DB, journalKey storage.Key, id string, rows []storage.KeyValue) error {
+	return applyChunked(db, journalKey, id, rows, storage.MaxTxnKeys, storage.MaxTxnBytes)
+}
+
+// applyChunked implements ApplyChunked with the specified limits on
+// the keys and bytes of each chunk, including its journal entry.
+func applyChunked(db DB, journalKey storage.Key, id string, rows []storage.KeyValue, maxKeys int, maxBytes int64) error {
+	journal := UpdateJournal{ID: id, Total: len(rows)}
+	var existing UpdateJournal
+	ok, _, err := GetI(db, journalKey, &existing)
+	if err != nil {
+		return err
+	}
+	if ok {
+		if existing.ID != id || existing.Total != len(rows) {
+			return util.Errorf("journal %q records update %q of %d rows; can't apply %q of %d rows",
+				journalKey, existing.ID, existing.Total, id, len(rows))
+		}
+		journal = existing
+	}
+	// Reserve room in each chunk for the journal entry.
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&journal); err != nil {
+		return err
+	}
+	journalBytes := int64(len(journalKey) + buf.Len())
+	for journal.Applied < len(rows) {
+		end, size := journal.Applied, journalBytes
+		for end < len(rows) && end-journal.Applied < maxKeys-1 {
+			rowBytes := int64(len(rows[end].Key) + len(rows[end].Value.Bytes))
+			if end > journal.Applied && size+rowBytes > maxBytes {
+				break
+			}
+			size += rowBytes
+			end++
+		}
+		next := journal
+		next.Applied = end
+		if err := applyChunk(db, journalKey, &next, rows[journal.Applied:end]); err != nil {
+			return util.Errorf("failed to apply rows %d-%d of update %q: %v", journal.Applied, end, id, err)
+		}
+		journal = next
+	}
+	if reply := <-db.Delete(&storage.DeleteRequest{Key: journalKey}); reply.Error != nil {
+		return reply.Error
+	}
+	return nil
+}
+
+// applyChunk writes rows and journal, the update's progress once
+// they're written, in a new transaction. If a write fails, the
+// transaction is aborted.
+func applyChunk(db DB, journalKey storage.Key, journal *UpdateJournal, rows []storage.KeyValue) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(journal); err != nil {
+		return err
+	}
+	header := storage.RequestHeader{TxID: uuid.New()}
+	writes := append([]storage.KeyValue{{Key: journalKey, Value: storage.Value{Bytes: buf.Bytes()}}}, rows...)
+	keys := make([]storage.Key, len(writes))
+	for i, row := range writes {
+		keys[i] = row.Key
+	}
+	if err := putRows(db, header, writes); err != nil {
+		if abortErr := endChunk(db, header, keys, false); abortErr != nil {
+			glog.Warningf("failed to abort transaction %q: %v", header.TxID, abortErr)
+		}
+		return err
+	}
+	return endChunk(db, header, keys, true)
+}
+
+// endChunk commits or aborts the transaction of a chunk which wrote
+// keys, and resolves its write intents, so that the next chunk's
+// transaction may write the journal again.
+func endChunk(db DB, header storage.RequestHeader, keys []storage.Key, commit bool) error {
+	if reply := <-db.EndTransaction(&storage.EndTransactionRequest{RequestHeader: header, Commit: commit, Keys: keys}); reply.Error != nil {
+		return reply.Error
+	}
+	for _, key := range keys {
+		reply := <-db.InternalResolveIntent(&storage.InternalResolveIntentRequest{Key: key, IntentTxID: header.TxID, Commit: commit})
+		if reply.Error != nil {
+			return reply.Error
+		}
+	}
+	return nil
+}
+
+// putRows writes rows in parallel with the specified header,
+// returning the first error.
+func putRows(db DB, header storage.RequestHeader, rows []storage.KeyValue) error {
+	replies := make([]<-chan *storage.PutResponse, len(rows))
+	for i, row := range rows {
+		replies[i] = db.Put(&storage.PutRequest{RequestHeader: header, Key: row.Key, Value: row.Value})
+	}
+	var err error
+	for i, replyChan := range replies {
+		if reply := <-replyChan; reply.Error != nil && err == nil {
+			err = util.Errorf("failed to write %q: %v", rows[i].Key, reply.Error)
+		}
+	}
+	return err
+}
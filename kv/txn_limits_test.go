@@ -0,0 +1,142 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// TestTxnWrites verifies writes beyond the key or byte limits of a
+// transaction are refused, and that ending a transaction resets it.
+func TestTxnWrites(t *testing.T) {
+	tw := newTxnWrites(2, 20)
+	put := func(txID, key string, value string) error {
+		return tw.admit(&storage.PutRequest{
+			RequestHeader: storage.RequestHeader{TxID: txID},
+			Key:           storage.Key(key),
+			Value:         storage.Value{Bytes: []byte(value)},
+		})
+	}
+	if err := put("", "a", "value which exceeds the transaction byte limit"); err != nil {
+		t.Errorf("expected non-transactional write to be unlimited; got %v", err)
+	}
+	for _, key := range []string{"a", "b", "a"} {
+		if err := put("txn", key, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := put("txn", "c", "v"); err == nil {
+		t.Error("expected third key to exceed key limit")
+	} else if _, ok := err.(*storage.TxnTooLargeError); !ok {
+		t.Errorf("expected transaction too large error; got %v", err)
+	}
+	if err := put("txn", "b", "0123456789abcdef"); err == nil {
+		t.Error("expected write to exceed byte limit")
+	}
+	if err := tw.admit(&storage.EndTransactionRequest{RequestHeader: storage.RequestHeader{TxID: "txn"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := put("txn", "c", "v"); err != nil {
+		t.Errorf("expected ended transaction to be reset; got %v", err)
+	}
+}
+
+// TestApplyChunked verifies a large update is written in chunks and
+// resumes from its journal.
+func TestApplyChunked(t *testing.T) {
+	db := newTestLocalDB(storage.KeyMax)
+	journalKey := storage.Key("journal")
+	var rows []storage.KeyValue
+	for i := 0; i < 25; i++ {
+		rows = append(rows, storage.KeyValue{
+			Key:   storage.Key(fmt.Sprintf("key-%02d", i)),
+			Value: storage.Value{Bytes: []byte("value")},
+		})
+	}
+	// Simulate an update interrupted after its first 10 rows; only
+	// the remainder is written on resumption.
+	if err := PutI(db, journalKey, &UpdateJournal{ID: "update", Applied: 10, Total: len(rows)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyChunked(db, journalKey, "other", rows, 4, 1<<10); err == nil {
+		t.Error("expected journal of another update to prevent applying")
+	}
+	if err := applyChunked(db, journalKey, "update", rows, 4, 1<<10); err != nil {
+		t.Fatal(err)
+	}
+	for i, row := range rows {
+		reply := <-db.Contains(&storage.ContainsRequest{Key: row.Key})
+		if reply.Error != nil || reply.Exists != (i >= 10) {
+			t.Errorf("%d: expected exists=%t; got %t, %v", i, i >= 10, reply.Exists, reply.Error)
+		}
+	}
+	if reply := <-db.Contains(&storage.ContainsRequest{Key: journalKey}); reply.Exists {
+		t.Error("expected journal deleted on completion")
+	}
+}
+
+// TestApplyChunkedAtomic verifies each chunk is written with its
+// journal entry atomically: a chunk which fails to be written leaves
+// neither its rows nor its progress, and is rewritten on resumption.
+func TestApplyChunkedAtomic(t *testing.T) {
+	db := newTestLocalDB(storage.KeyMax)
+	journalKey := storage.Key("journal")
+	var rows []storage.KeyValue
+	for i := 0; i < 9; i++ {
+		rows = append(rows, storage.KeyValue{
+			Key:   storage.Key(fmt.Sprintf("key-%02d", i)),
+			Value: storage.Value{Bytes: []byte("value")},
+		})
+	}
+	// The intent of another transaction on a row of the second chunk
+	// fails its write.
+	other := storage.RequestHeader{TxID: "other"}
+	if reply := <-db.Put(&storage.PutRequest{RequestHeader: other, Key: rows[4].Key, Value: storage.Value{Bytes: []byte("other")}}); reply.Error != nil {
+		t.Fatal(reply.Error)
+	}
+	if err := applyChunked(db, journalKey, "update", rows, 4, 1<<10); err == nil {
+		t.Fatal("expected chunk blocked by write intent to fail")
+	}
+	var journal UpdateJournal
+	if ok, _, err := GetI(db, journalKey, &journal); err != nil || !ok || journal.Applied != 3 {
+		t.Errorf("expected journal of first chunk; got %+v, %t, %v", journal, ok, err)
+	}
+	for i, row := range rows {
+		if i == 4 {
+			continue
+		}
+		reply := <-db.Contains(&storage.ContainsRequest{Key: row.Key})
+		if reply.Error != nil || reply.Exists != (i < 3) {
+			t.Errorf("%d: expected exists=%t; got %t, %v", i, i < 3, reply.Exists, reply.Error)
+		}
+	}
+
+	if err := endChunk(db, other, []storage.Key{rows[4].Key}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyChunked(db, journalKey, "update", rows, 4, 1<<10); err != nil {
+		t.Fatal(err)
+	}
+	for i, row := range rows {
+		reply := <-db.Get(&storage.GetRequest{Key: row.Key})
+		if reply.Error != nil || string(reply.Value.Bytes) != "value" {
+			t.Errorf("%d: expected row written; got %q, %v", i, reply.Value.Bytes, reply.Error)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// Kinds of events recorded by a TxnRecorder.
+const (
+	TxnEventLookup = "lookup" // Range metadata lookup
+	TxnEventRPC    = "rpc"    // Attempt to send a request to its range
+	TxnEventRetry  = "retry"  // Retry following a retryable error
+	TxnEventMethod = "method" // Completed request
+	TxnEventPush   = "push"   // Push of a transaction blocking a request
+)
+
+// Statuses of a transaction in a TxnReport.
+const (
+	TxnStatusPending = "pending" // EndTransaction not yet completed
+	TxnStatusEnded   = "ended"   // EndTransaction succeeded
+	TxnStatusFailed  = "failed"  // EndTransaction failed
+)
+
+// A TxnEvent is an entry in the timeline of a TxnReport.
+type TxnEvent struct {
+	Offset  time.Duration   // Time since the recorder was created
+	Kind    string          // One of the TxnEvent* kinds
+	Method  string          // Method; empty for lookups and pushes
+	Key     storage.Key     // Looked up key; set only for lookups
+	Replica storage.Replica // Replica and range which served an RPC
+	Pushee  string          // ID of the pushed transaction; set only for pushes
+	Outcome string          // Pushee's status after a successful push
+	Latency time.Duration   // Latency of the lookup, RPC, push or request
+	Error   string          // Error message, if any
+}
+
+// A TxnReport describes the execution of a transaction's requests,
+// for diagnosing slow or repeatedly retried transactions.
+type TxnReport struct {
+	Start    time.Time     // Creation time of the recorder
+	Duration time.Duration // Time from Start until EndTransaction completed, or until now
+	Status   string        // One of the TxnStatus* statuses
+	Error    string        // EndTransaction error, if Status is TxnStatusFailed
+	Requests int           // Completed requests
+	Retries  int           // Retried attempts
+	Pushes   int           // Pushes of conflicting transactions
+	Events   []TxnEvent    // Timeline of events, in order of occurrence
+}
+
+// A TxnRecorder is a Tracer which records a timeline of the requests
+// sent on behalf of a single transaction. The recorder attributes
+// every event it receives to the transaction, so it should be set on
+// a DistDB used exclusively by that transaction. Pushes of the
+// transactions whose write intents blocked its requests are recorded
+// with their outcomes: the pushee committed or aborted, or the push's
+// error if the pushee couldn't be aborted.
+type TxnRecorder struct {
+	mu     sync.Mutex
+	report TxnReport
+	end    time.Time // Completion of EndTransaction; zero if pending
+}
+
+// NewTxnRecorder returns a new recorder with an empty timeline.
+func NewTxnRecorder() *TxnRecorder {
+	return &TxnRecorder{
+		report: TxnReport{Start: time.Now(), Status: TxnStatusPending},
+	}
+}
+
+// record appends an event to the timeline.
+func (tr *TxnRecorder) record(e TxnEvent, err error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	e.Offset = time.Since(tr.report.Start)
+	if err != nil {
+		e.Error = err.Error()
+	}
+	tr.report.Events = append(tr.report.Events, e)
+	switch e.Kind {
+	case TxnEventRetry:
+		tr.report.Retries++
+	case TxnEventPush:
+		tr.report.Pushes++
+	case TxnEventMethod:
+		tr.report.Requests++
+		if e.Method == "Node.EndTransaction" {
+			tr.end = time.Now()
+			tr.report.Status, tr.report.Error = TxnStatusEnded, e.Error
+			if err != nil {
+				tr.report.Status = TxnStatusFailed
+			}
+		}
+	}
+}
+
+// Method implements the Tracer interface.
+func (tr *TxnRecorder) Method(method string, latency time.Duration, err error) {
+	tr.record(TxnEvent{Kind: TxnEventMethod, Method: method, Latency: latency}, err)
+}
+
+// RPC implements the Tracer interface.
+func (tr *TxnRecorder) RPC(method string, replica storage.Replica, latency time.Duration, err error) {
+	tr.record(TxnEvent{Kind: TxnEventRPC, Method: method, Replica: replica, Latency: latency}, err)
+}
+
+// Retry implements the Tracer interface.
+func (tr *TxnRecorder) Retry(method string, err error) {
+	tr.record(TxnEvent{Kind: TxnEventRetry, Method: method}, err)
+}
+
+// RangeLookup implements the Tracer interface.
+func (tr *TxnRecorder) RangeLookup(key storage.Key, latency time.Duration, err error) {
+	tr.record(TxnEvent{Kind: TxnEventLookup, Key: key, Latency: latency}, err)
+}
+
+// Push implements the Tracer interface.
+func (tr *TxnRecorder) Push(pushee string, latency time.Duration, status storage.TxnStatus, err error) {
+	e := TxnEvent{Kind: TxnEventPush, Pushee: pushee, Latency: latency}
+	if err == nil {
+		e.Outcome = status.String()
+	}
+	tr.record(e, err)
+}
+
+// Report returns a copy of the report, which may be retrieved while
+// the transaction is in progress or after it has ended.
+func (tr *TxnRecorder) Report() *TxnReport {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	r := tr.report
+	r.Events = append([]TxnEvent(nil), tr.report.Events...)
+	if tr.end.IsZero() {
+		r.Duration = time.Since(r.Start)
+	} else {
+		r.Duration = tr.end.Sub(r.Start)
+	}
+	return &r
+}
@@ -0,0 +1,82 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// TestTxnRecorder verifies the timeline and summary of a transaction
+// report, and that reports are isolated from subsequent events.
+func TestTxnRecorder(t *testing.T) {
+	tr := NewTxnRecorder()
+	replica := storage.Replica{NodeID: 1, StoreID: 2, RangeID: 3}
+	tr.RangeLookup(storage.Key("a"), time.Millisecond, nil)
+	tr.RPC("Node.Put", storage.Replica{}, time.Millisecond, &storage.GenericError{Message: "unavailable"})
+	tr.Retry("Node.Put", &storage.GenericError{Message: "unavailable"})
+	tr.RPC("Node.Put", replica, time.Millisecond, nil)
+	tr.Method("Node.Put", 5*time.Millisecond, nil)
+
+	r := tr.Report()
+	if r.Status != TxnStatusPending || r.Requests != 1 || r.Retries != 1 || len(r.Events) != 5 {
+		t.Errorf("unexpected report: %+v", r)
+	}
+	if e := r.Events[3]; e.Kind != TxnEventRPC || e.Replica != replica || e.Error != "" {
+		t.Errorf("unexpected rpc event: %+v", e)
+	}
+	if e := r.Events[1]; e.Error != "unavailable" {
+		t.Errorf("expected failed rpc event; got %+v", e)
+	}
+
+	tr.Method("Node.EndTransaction", time.Millisecond, &storage.GenericError{Message: "aborted"})
+	if len(r.Events) != 5 {
+		t.Errorf("expected report isolated from later events; got %d events", len(r.Events))
+	}
+	r = tr.Report()
+	if r.Status != TxnStatusFailed || r.Error != "aborted" || r.Requests != 2 {
+		t.Errorf("unexpected final report: %+v", r)
+	}
+	if d := tr.Report().Duration; d != r.Duration {
+		t.Errorf("expected duration fixed once ended; got %s, %s", r.Duration, d)
+	}
+}
+
+// TestTxnRecorderPushes verifies pushes of conflicting transactions
+// are recorded with their outcomes.
+func TestTxnRecorderPushes(t *testing.T) {
+	tr := NewTxnRecorder()
+	tr.Push("txn1", time.Millisecond, storage.TxnPending, &storage.GenericError{Message: "pending"})
+	tr.Push("txn1", time.Millisecond, storage.TxnCommitted, nil)
+	tr.Push("txn2", time.Millisecond, storage.TxnAborted, nil)
+
+	r := tr.Report()
+	if r.Pushes != 3 || len(r.Events) != 3 {
+		t.Fatalf("unexpected report: %+v", r)
+	}
+	expected := []TxnEvent{
+		{Kind: TxnEventPush, Pushee: "txn1", Error: "pending"},
+		{Kind: TxnEventPush, Pushee: "txn1", Outcome: "committed"},
+		{Kind: TxnEventPush, Pushee: "txn2", Outcome: "aborted"},
+	}
+	for i, e := range r.Events {
+		if e.Kind != expected[i].Kind || e.Pushee != expected[i].Pushee || e.Outcome != expected[i].Outcome || e.Error != expected[i].Error {
+			t.Errorf("%d: expected push event %+v; got %+v", i, expected[i], e)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// NodeUsage is a node's rollup of usage by account, stored at
+// MakeUsageKey(NodeID). The report covers the ranges for which the
+// node's replicas were raft leaders when it was written, so that
+// summing the rollups of all nodes counts each range once. Counts
+// are cumulative since each range was loaded on its leader; a range
+// whose leadership moved reports the operation counts of its new
+// leader.
+type NodeUsage struct {
+	NodeID  int32
+	Updated int64 // Time of the rollup, in nanoseconds since the epoch
+	Report  storage.UsageReport
+}
+
+// ClusterUsage combines the latest usage rollups of all nodes.
+type ClusterUsage struct {
+	Accounts storage.UsageReport // Usage by account summed over nodes
+	Nodes    []*NodeUsage        // Rollups of each node, in order of node ID
+}
+
+// MakeUsageKey returns the key of the usage rollup of the node with
+// nodeID. Keys sort in order of node ID.
+func MakeUsageKey(nodeID int32) storage.Key {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(nodeID))
+	return storage.MakeKey(storage.KeyUsagePrefix, b[:])
+}
+
+// PutNodeUsage writes the usage rollup of the node with nodeID,
+// replacing its previous rollup.
+func PutNodeUsage(db DB, nodeID int32, report storage.UsageReport) error {
+	return PutI(db, MakeUsageKey(nodeID), &NodeUsage{
+		NodeID:  nodeID,
+		Updated: time.Now().UnixNano(),
+		Report:  report,
+	})
+}
+
+// GetClusterUsage reads the usage rollups of all nodes and sums them
+// by account. Rollups are read by node ID, up to the last ID
+// allocated, rather than by scanning, so that they may be read via
+// any DB. Rollups of nodes which have since left the cluster are
+// included; their Updated times identify them.
+func GetClusterUsage(db DB) (*ClusterUsage, error) {
+	gr := <-db.Get(&storage.GetRequest{Key: storage.KeyNodeIDGenerator})
+	if gr.Error != nil {
+		return nil, gr.Error
+	}
+	var maxNodeID int64
+	if len(gr.Value.Bytes) > 0 {
+		var n int
+		if maxNodeID, n = binary.Varint(gr.Value.Bytes); n <= 0 {
+			return nil, util.Errorf("unable to decode node ID generator %q", gr.Value.Bytes)
+		}
+	}
+	usage := &ClusterUsage{}
+	var reports []storage.UsageReport
+	for nodeID := int32(1); int64(nodeID) <= maxNodeID; nodeID++ {
+		nu := &NodeUsage{}
+		ok, _, err := GetI(db, MakeUsageKey(nodeID), nu)
+		if err != nil {
+			return nil, util.Errorf("unable to read usage rollup of node %d: %v", nodeID, err)
+		}
+		if !ok {
+			continue
+		}
+		usage.Nodes = append(usage.Nodes, nu)
+		reports = append(reports, nu.Report)
+	}
+	usage.Accounts = storage.MergeUsageReports(reports...)
+	return usage, nil
+}
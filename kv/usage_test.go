@@ -0,0 +1,60 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// TestClusterUsage verifies node usage rollups are replaced by later
+// rollups and summed by account, skipping nodes without rollups.
+func TestClusterUsage(t *testing.T) {
+	db := newTestLocalDB(storage.KeyMax)
+	for i := 0; i < 3; i++ {
+		if ir := <-db.Increment(&storage.IncrementRequest{Key: storage.KeyNodeIDGenerator, Increment: 1}); ir.Error != nil {
+			t.Fatal(ir.Error)
+		}
+	}
+	if err := PutNodeUsage(db, 2, storage.UsageReport{{Account: "a", Bytes: 100, Keys: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutNodeUsage(db, 1, storage.UsageReport{{Account: "a", Bytes: 1, Keys: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutNodeUsage(db, 2, storage.UsageReport{
+		{Account: "a", Bytes: 10, Keys: 2, Reads: 3},
+		{Account: storage.AcctSystem, Internal: true, Writes: 4},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	usage, err := GetClusterUsage(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage.Nodes) != 2 || usage.Nodes[0].NodeID != 1 || usage.Nodes[1].NodeID != 2 || usage.Nodes[1].Updated == 0 {
+		t.Fatalf("unexpected node rollups %+v", usage.Nodes)
+	}
+	expected := storage.UsageReport{
+		{Account: "a", Bytes: 11, Keys: 3, Reads: 3},
+		{Account: storage.AcctSystem, Internal: true, Writes: 4},
+	}
+	if !reflect.DeepEqual(usage.Accounts, expected) {
+		t.Errorf("expected %+v; got %+v", expected, usage.Accounts)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+	"net"
+	"time"
+
+	"github.com/cockroachdb/cockroach/rpc"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// maxWarmUpRanges limits the ranges resolved for a single span by
+// WarmUp.
+const maxWarmUpRanges = 1000
+
+// A KeySpan is the span of keys from Start, inclusive, to End,
+// exclusive.
+type KeySpan struct {
+	Start, End storage.Key
+}
+
+// WarmUp prepares the DistDB for traffic to the specified hot key
+// spans, so that the first requests after a deploy don't pay for
+// connection setup. The ranges overlapping each span are resolved
+// and connections dialed to the nodes holding their replicas, as
+// well as to the nodes holding the first range, which serves range
+// lookups. At most maxWarmUpRanges ranges are resolved per span.
+// Returns the locations of the resolved ranges once all connections
+// are ready, or an error if resolution fails or connections aren't
+// ready within timeout. A DistDB which follows range changes caches
+// the resolved locations.
+func (db *DistDB) WarmUp(spans []KeySpan, timeout time.Duration) ([]storage.RangeLocations, error) {
+	var ranges []storage.RangeLocations
+	var replicas []storage.Replica
+	for _, span := range spans {
+		key := span.Start
+		for i := 0; i < maxWarmUpRanges; i++ {
+			locations, endKey, err := db.lookupRange(key)
+			if err != nil {
+				return nil, util.Errorf("unable to resolve range containing %q: %v", key, err)
+			}
+			ranges = append(ranges, *locations)
+			replicas = append(replicas, locations.Replicas...)
+			if endKey == nil || bytes.Compare(endKey, span.End) >= 0 {
+				break
+			}
+			key = endKey
+		}
+	}
+	if locations, err := storage.GetFirstRangeLocations(db.gossip); err == nil {
+		replicas = append(replicas, locations.Replicas...)
+	}
+
+	// Dial each node once; the connections are shared with requests
+	// subsequently sent to the nodes.
+	addrs := map[string]net.Addr{}
+	for _, replica := range replicas {
+		addr, err := db.nodeIDToAddr(replica.NodeID)
+		if err != nil {
+			return nil, err
+		}
+		addrs[addr.String()] = addr
+	}
+	db.closeMu.Lock()
+	if db.closed {
+		db.closeMu.Unlock()
+		return nil, &ClosedError{Method: "WarmUp"}
+	}
+	for key, addr := range addrs {
+		db.addrs[key] = addr
+	}
+	db.closeMu.Unlock()
+	deadline := time.After(timeout)
+	for _, addr := range addrs {
+		select {
+		case <-rpc.NewClient(addr, nil).Ready:
+		case <-deadline:
+			return nil, util.Errorf("connection to %s not ready within %s", addr, timeout)
+		case <-db.closer:
+			return nil, &ClosedError{Method: "WarmUp"}
+		}
+	}
+	return ranges, nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/golang/glog"
+)
+
+const (
+	// watchPollWait is the time each InternalWatch request waits for
+	// events before returning empty.
+	watchPollWait = 2 * time.Second
+	// watchRetryBackoff is the delay before polling again after an
+	// InternalWatch request fails.
+	watchRetryBackoff = 1 * time.Second
+)
+
+// A Watcher delivers change events for a span of keys. The span is
+// divided into segments, one per range, each of which long-polls its
+// range's event feed via InternalWatch. When a range splits, its
+// segment is divided to follow the new range.
+//
+// Events for a key are delivered in order. Events for keys in
+// different ranges are not ordered with respect to each other. Events
+// may be redelivered when a segment moves to a different range, as on
+// a merge. If events are lost, because the watcher fell behind the
+// range's feed, an event with op ChangeResync is delivered and the
+// application should re-read the span.
+type Watcher struct {
+	db        DB
+	events    chan storage.ChangeEvent
+	closer    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup // Running segments
+}
+
+// newWatcher returns a Watcher for changes to keys in [start, end)
+// made after the watcher is created.
+func newWatcher(db DB, start, end storage.Key) *Watcher {
+	w := &Watcher{
+		db:     db,
+		events: make(chan storage.ChangeEvent, 100),
+		closer: make(chan struct{}),
+	}
+	w.wg.Add(1)
+	go w.watchSegment(start, end, -1)
+	return w
+}
+
+// Events returns the channel on which change events are delivered.
+// The channel is closed after the watcher is closed.
+func (w *Watcher) Events() <-chan storage.ChangeEvent {
+	return w.events
+}
+
+// Close stops the watcher. Outstanding polls complete in the
+// background, after which the events channel is closed.
+func (w *Watcher) Close() {
+	w.closeOnce.Do(func() {
+		close(w.closer)
+		go func() {
+			w.wg.Wait()
+			close(w.events)
+		}()
+	})
+}
+
+// send delivers ev, returning false if the watcher was closed.
+func (w *Watcher) send(ev storage.ChangeEvent) bool {
+	select {
+	case w.events <- ev:
+		return true
+	case <-w.closer:
+		return false
+	}
+}
+
+// watchSegment polls for events in [start, end), beginning after the
+// feed sequence number seq, until the watcher is closed. If the range
+// serving the segment ends before end, the remainder of the span is
+// watched by a new segment.
+func (w *Watcher) watchSegment(start, end storage.Key, seq int64) {
+	defer w.wg.Done()
+	var rangeID int64
+	for {
+		reply := <-w.db.InternalWatch(&storage.InternalWatchRequest{
+			StartKey: start,
+			EndKey:   end,
+			Seq:      seq,
+			RangeID:  rangeID,
+			MaxWait:  int64(watchPollWait),
+		})
+		select {
+		case <-w.closer:
+			return
+		default:
+		}
+		if reply.Error == nil && bytes.Compare(reply.EndKey, start) <= 0 {
+			reply.Error = util.Errorf("range %d ending at %q does not contain %q", reply.RangeID, reply.EndKey, start)
+		}
+		if reply.Error != nil {
+			glog.Warningf("failed to watch %q-%q: %v", start, end, reply.Error)
+			select {
+			case <-time.After(watchRetryBackoff):
+				continue
+			case <-w.closer:
+				return
+			}
+		}
+		if reply.Truncated && !w.send(storage.ChangeEvent{Op: storage.ChangeResync, Key: start}) {
+			return
+		}
+		for _, ev := range reply.Events {
+			if !w.send(ev) {
+				return
+			}
+		}
+		if bytes.Compare(reply.EndKey, end) < 0 {
+			// The initial poll starts watching from now. Once watching,
+			// a range which has split off began with an empty feed, so
+			// its segment starts from the beginning.
+			var nextSeq int64
+			if rangeID == 0 {
+				nextSeq = -1
+			}
+			w.wg.Add(1)
+			go w.watchSegment(reply.EndKey, end, nextSeq)
+			end = reply.EndKey
+		}
+		rangeID, seq = reply.RangeID, reply.Seq
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// TestWatch verifies a watcher receives puts and deletes within its
+// span, and that its events channel is closed after Close.
+func TestWatch(t *testing.T) {
+	db := newTestLocalDB(storage.KeyMax)
+	w := db.Watch(storage.Key("a"), storage.Key("b"))
+	// Wait for the initial poll to establish the starting point.
+	time.Sleep(10 * time.Millisecond)
+	put(t, db, "a1", "v")
+	put(t, db, "c", "v")
+	if dr := <-db.Delete(&storage.DeleteRequest{Key: storage.Key("a1")}); dr.Error != nil {
+		t.Fatal(dr.Error)
+	}
+	for _, expOp := range []storage.ChangeOp{storage.ChangePut, storage.ChangeDelete} {
+		select {
+		case ev := <-w.Events():
+			if ev.Op != expOp || string(ev.Key) != "a1" {
+				t.Errorf("expected op %d on a1; got %+v", expOp, ev)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for op %d", expOp)
+		}
+	}
+	w.Close()
+	for ev := range w.Events() {
+		t.Errorf("unexpected event %+v", ev)
+	}
+}
@@ -27,12 +27,20 @@ func main() {
 	c := commander.Commander{
 		Name: "cockroach",
 		Commands: []*commander.Command{
+			server.CmdCancelJob,
+			server.CmdDebugScan,
+			server.CmdFreeze,
 			server.CmdInit,
 			server.CmdGetZone,
+			server.CmdLsJobs,
 			server.CmdLsZones,
+			server.CmdPauseJob,
+			server.CmdResumeJob,
 			server.CmdRmZone,
 			server.CmdSetZone,
 			server.CmdStart,
+			server.CmdStartLocal,
+			server.CmdUnfreeze,
 			&commander.Command{
 				UsageLine: "listparams",
 				Short:     "list all available parameters and their default values",
@@ -19,6 +19,7 @@ package rpc
 
 import (
 	"fmt"
+	"math/rand"
 	"net"
 	"net/rpc"
 	"sync"
@@ -30,12 +31,35 @@ import (
 
 const (
 	defaultHeartbeatInterval = 3 * time.Second // 3s
+	// defaultIdleTimeout is the duration after which a client which
+	// hasn't been used to send an RPC is closed. It must exceed the
+	// longest RPC timeout.
+	defaultIdleTimeout = 5 * time.Minute
+	// defaultReconnectStagger is the maximum random delay before
+	// reconnecting to an address whose connection failed, so that
+	// clients which lost connections at the same time don't reconnect
+	// at the same time.
+	defaultReconnectStagger = 5 * time.Second
+	// defaultMaxDialsPerSecond limits the rate at which the process
+	// redials connections: reconnects to addresses whose connections
+	// failed, and retries of failed dials. A first dial to an address
+	// isn't limited, so that nodes sharing a process, as in tests and
+	// simulations, don't throttle each other's startup.
+	defaultMaxDialsPerSecond = 50
+	// defaultMaxClients is the maximum number of cached clients, and
+	// so of open connections, per process.
+	defaultMaxClients = 1000
 )
 
 var (
-	clientMu          sync.Mutex         // Protects access to the client cache.
-	clients           map[string]*Client // Cache of RPC clients by server address.
+	clientMu          sync.Mutex           // Protects access to the client cache.
+	clients           map[string]*Client   // Cache of RPC clients by server address.
+	failures          map[string]time.Time // Time of most recent connection failure by address.
 	heartbeatInterval time.Duration
+	idleTimeout       time.Duration
+	reconnectStagger  time.Duration
+	maxClients        int          // Cached clients beyond this evict the least recently used; 0 for no limit
+	dialLimiter       *rateLimiter // Limits the rate of connection attempts
 )
 
 // clientRetryOptions specifies exponential backoff starting
@@ -45,12 +69,18 @@ var clientRetryOptions = util.RetryOptions{
 	MaxBackoff:  30 * time.Second, // max backoff is 30s
 	Constant:    2,                // doubles
 	MaxAttempts: 0,                // indefinite retries
+	Jitter:      0.5,              // vary backoffs to spread out reconnects
 }
 
 // init creates a new client RPC cache.
 func init() {
 	clients = map[string]*Client{}
+	failures = map[string]time.Time{}
 	heartbeatInterval = defaultHeartbeatInterval
+	idleTimeout = defaultIdleTimeout
+	reconnectStagger = defaultReconnectStagger
+	maxClients = defaultMaxClients
+	dialLimiter = newRateLimiter(defaultMaxDialsPerSecond)
 }
 
 // Client is a Cockroach-specific RPC client with an embedded go
@@ -65,6 +95,9 @@ type Client struct {
 	lAddr       net.Addr     // Local address of client
 	healthy     bool
 	closed      bool
+	latency     time.Duration // Round trip time of the last heartbeat
+	offset      RemoteOffset  // Remote clock offset measured by the last heartbeat
+	lastUsed    time.Time     // Time of the most recent RPC, for reaping idle clients
 }
 
 // NewClient returns a client RPC stub for the specified address
@@ -75,6 +108,12 @@ type Client struct {
 // nil to use defaults (i.e. indefinite retries with exponential
 // backoff).
 //
+// Cached clients are shared by all users in the process, so that RPCs
+// reuse warm connections. Clients are evicted from the cache when
+// their heartbeats fail, after they've been idle for the idle timeout,
+// and, least recently used first, when creating a client would exceed
+// the maximum number of cached clients.
+//
 // The Client.Ready channel is closed after the client has connected
 // and completed one successful heartbeat. The Closed channel is
 // closed if the client fails to connect or if the client's Close()
@@ -86,12 +125,31 @@ func NewClient(addr net.Addr, opts *util.RetryOptions) *Client {
 		return c
 	}
 	c := &Client{
-		addr:   addr,
-		Ready:  make(chan struct{}),
-		Closed: make(chan struct{}),
+		addr:     addr,
+		Ready:    make(chan struct{}),
+		Closed:   make(chan struct{}),
+		lastUsed: time.Now(),
+	}
+	var evicted *Client
+	if maxClients > 0 && len(clients) >= maxClients {
+		evicted = leastRecentlyUsed()
 	}
 	clients[c.Addr().String()] = c
+	// Stagger reconnection to an address whose connection recently
+	// failed; many clients likely lost their connections at once.
+	var stagger time.Duration
+	failed, redial := failures[addr.String()]
+	if redial {
+		if reconnectStagger > 0 && time.Since(failed) < reconnectStagger {
+			stagger = time.Duration(rand.Int63n(int64(reconnectStagger)))
+		}
+		delete(failures, addr.String())
+	}
 	clientMu.Unlock()
+	if evicted != nil {
+		glog.Infof("client %s evicted; at maximum of %d clients", evicted.Addr(), maxClients)
+		evicted.Close()
+	}
 
 	// Attempt to dial connection.
 	retryOpts := clientRetryOptions
@@ -101,15 +159,26 @@ func NewClient(addr net.Addr, opts *util.RetryOptions) *Client {
 	retryOpts.Tag = fmt.Sprintf("client %s connection", addr)
 
 	go func() {
+		time.Sleep(stagger)
 		err := util.RetryWithBackoff(retryOpts, func() (bool, error) {
-			// TODO(spencer): use crypto.tls.
-			conn, err := net.Dial(addr.Network(), addr.String())
+			if redial {
+				dialLimiter.wait()
+			}
+			// Any further attempts are retries.
+			redial = true
+			conn, err := dial(addr)
 			if err != nil {
 				glog.Info(err)
 				return false, nil
 			}
+			codec, err := newClientCodec(newFrameConn(conn), getCompression())
+			if err != nil {
+				glog.Info(err)
+				conn.Close()
+				return false, nil
+			}
 			c.mu.Lock()
-			c.Client = rpc.NewClient(conn)
+			c.Client = rpc.NewClientWithCodec(codec)
 			c.lAddr = conn.LocalAddr()
 			c.mu.Unlock()
 
@@ -138,6 +207,22 @@ func NewClient(addr net.Addr, opts *util.RetryOptions) *Client {
 	return c
 }
 
+// leastRecentlyUsed returns the cached client which least recently
+// sent an RPC, or nil if none are cached. clientMu must be held.
+func leastRecentlyUsed() *Client {
+	var lru *Client
+	var lruTime time.Time
+	for _, c := range clients {
+		c.mu.RLock()
+		lastUsed := c.lastUsed
+		c.mu.RUnlock()
+		if lru == nil || lastUsed.Before(lruTime) {
+			lru, lruTime = c, lastUsed
+		}
+	}
+	return lru
+}
+
 // IsConnected returns whether the client is connected.
 func (c *Client) IsConnected() bool {
 	c.mu.Lock()
@@ -175,37 +260,114 @@ func (c *Client) Close() {
 		c.healthy = false
 		c.closed = true
 		close(c.Closed)
-		c.Client.Close()
+		// The client may be closed before it has connected.
+		c.mu.RLock()
+		client := c.Client
+		c.mu.RUnlock()
+		if client != nil {
+			client.Close()
+		}
 	}
 	clientMu.Unlock()
 }
 
+// Go invokes the RPC asynchronously, as rpc.Client.Go does, and
+// marks the client as in use.
+func (c *Client) Go(serviceMethod string, args, reply interface{}, done chan *rpc.Call) *rpc.Call {
+	c.mu.Lock()
+	c.lastUsed = time.Now()
+	client := c.Client
+	c.mu.Unlock()
+	return client.Go(serviceMethod, args, reply, done)
+}
+
+// idle returns whether the client hasn't been used for longer than
+// the idle timeout.
+func (c *Client) idle() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return idleTimeout > 0 && time.Since(c.lastUsed) > idleTimeout
+}
+
 // startHeartbeat sends periodic heartbeats to client. Closes the
-// connection on error. Heartbeats are sent in an infinite loop until
-// an error is encountered.
+// connection on error or once the client is idle. Heartbeats are sent
+// in an infinite loop until the connection is closed.
 func (c *Client) startHeartbeat() {
 	glog.Infof("client %s starting heartbeat", c.Addr())
 	// On heartbeat failure, remove this client from cache. A new
 	// client to this address will be created on the next call to
-	// NewClient().
+	// NewClient(), after a random delay.
 	for {
 		time.Sleep(heartbeatInterval)
+		if c.idle() {
+			glog.Infof("client %s idle; closing", c.Addr())
+			c.Close()
+			break
+		}
 		if err := c.heartbeat(); err != nil {
 			glog.Infof("client %s heartbeat failed: %v; recycling...", c.Addr(), err)
+			clientMu.Lock()
+			failures[c.Addr().String()] = time.Now()
+			clientMu.Unlock()
 			c.Close()
 			break
 		}
 	}
 }
 
+// Latency returns the round trip time of the client's most recent
+// successful heartbeat, or zero if none has succeeded.
+func (c *Client) Latency() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.latency
+}
+
+// LatencyOf returns the heartbeat latency of the cached client for
+// addr. Returns false if there's no cached client or its latency
+// hasn't been measured. Unlike NewClient, never creates a client.
+func LatencyOf(addr net.Addr) (time.Duration, bool) {
+	clientMu.Lock()
+	c, ok := clients[addr.String()]
+	clientMu.Unlock()
+	if !ok {
+		return 0, false
+	}
+	latency := c.Latency()
+	return latency, latency > 0
+}
+
+// CloseClient closes the cached client for addr, if any. Clients are
+// shared by all users in the process; others reconnect on their next
+// use of NewClient.
+func CloseClient(addr net.Addr) {
+	clientMu.Lock()
+	c, ok := clients[addr.String()]
+	clientMu.Unlock()
+	if ok {
+		c.Close()
+	}
+}
+
 // heartbeat sends a single heartbeat RPC.
 func (c *Client) heartbeat() error {
-	call := c.Go("Heartbeat.Ping", &PingRequest{}, &PingResponse{}, nil)
+	start := time.Now()
+	// Heartbeats are sent via the embedded client so that they don't
+	// keep an otherwise idle client open.
+	c.mu.RLock()
+	client := c.Client
+	c.mu.RUnlock()
+	reply := &PingResponse{}
+	call := client.Go("Heartbeat.Ping", &PingRequest{}, reply, nil)
 	select {
 	case <-call.Done:
 		glog.V(1).Infof("client %s heartbeat: %v", c.Addr(), call.Error)
 		c.mu.Lock()
 		c.healthy = true
+		if call.Error == nil {
+			c.latency = time.Since(start)
+			c.offset = measureOffset(start, c.latency, reply.ServerTime)
+		}
 		c.mu.Unlock()
 		return call.Error
 	case <-time.After(heartbeatInterval * 2):
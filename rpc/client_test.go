@@ -37,6 +37,16 @@ func TestClientHeartbeat(t *testing.T) {
 		t.Error("expected cached client to be returned while healthy")
 	}
 	<-c.Ready
+	if latency, ok := LatencyOf(s.Addr()); !ok || latency != c.Latency() {
+		t.Errorf("expected heartbeat latency to be measured; got %s, %t", latency, ok)
+	}
+	// Client and server share a clock.
+	if offset, ok := c.RemoteOffset(); !ok || offset.Exceeds(0) {
+		t.Errorf("expected clock offset within heartbeat latency; got %+v, %t", offset, ok)
+	}
+	if err := CheckRemoteOffsets(0); err != nil {
+		t.Error(err)
+	}
 	s.Close()
 }
 
@@ -63,3 +73,167 @@ func TestClientHeartbeatBadServer(t *testing.T) {
 	}
 	s.Close()
 }
+
+// TestClientIdleReaping verifies an unused client is closed and
+// removed from the cache, while heartbeats alone don't keep it open.
+func TestClientIdleReaping(t *testing.T) {
+	heartbeatInterval = 10 * time.Millisecond
+	idleTimeout = 50 * time.Millisecond
+	defer func() { idleTimeout = defaultIdleTimeout }()
+	addr := util.CreateTestAddr("tcp")
+	s := NewServer(addr)
+	s.Start()
+	defer s.Close()
+	c := NewClient(s.Addr(), nil)
+	<-c.Ready
+	// Keep the client in use for longer than the idle timeout.
+	for i := 0; i < 10; i++ {
+		call := c.Go("Heartbeat.Ping", &PingRequest{}, &PingResponse{}, nil)
+		if err := (<-call.Done).Error; err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-c.Closed:
+		t.Fatal("expected client in use to remain open")
+	default:
+	}
+	select {
+	case <-c.Closed:
+	case <-time.After(time.Second):
+		t.Fatal("expected idle client to be closed")
+	}
+	if c == NewClient(s.Addr(), nil) {
+		t.Error("expected idle client removed from cache")
+	}
+}
+
+// TestClientMaxClients verifies that creating a client beyond the
+// maximum evicts the least recently used cached client.
+func TestClientMaxClients(t *testing.T) {
+	heartbeatInterval = 10 * time.Millisecond
+	// Close clients left by other tests, which would be evicted first.
+	clientMu.Lock()
+	var cached []*Client
+	for _, c := range clients {
+		cached = append(cached, c)
+	}
+	clientMu.Unlock()
+	for _, c := range cached {
+		c.Close()
+	}
+	var servers []*Server
+	for i := 0; i < 3; i++ {
+		s := NewServer(util.CreateTestAddr("tcp"))
+		s.Start()
+		defer s.Close()
+		servers = append(servers, s)
+	}
+	c1 := NewClient(servers[0].Addr(), nil)
+	c2 := NewClient(servers[1].Addr(), nil)
+	<-c1.Ready
+	<-c2.Ready
+	// Use the first client, so that the second is least recently used.
+	call := c1.Go("Heartbeat.Ping", &PingRequest{}, &PingResponse{}, nil)
+	if err := (<-call.Done).Error; err != nil {
+		t.Fatal(err)
+	}
+	maxClients = 2
+	defer func() { maxClients = defaultMaxClients }()
+
+	c3 := NewClient(servers[2].Addr(), nil)
+	defer c3.Close()
+	select {
+	case <-c2.Closed:
+	case <-time.After(time.Second):
+		t.Fatal("expected least recently used client to be evicted")
+	}
+	select {
+	case <-c1.Closed:
+		t.Error("expected recently used client to remain open")
+	default:
+	}
+	if c1 != NewClient(servers[0].Addr(), nil) {
+		t.Error("expected recently used client to remain cached")
+	}
+}
+
+// TestRateLimiter verifies events are spaced by the limiter's
+// interval.
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(100)
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		l.wait()
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected 6 events at 100/s to take at least 50ms; took %s", elapsed)
+	}
+}
+
+// TestClientFirstDialUnlimited verifies first dials to addresses
+// aren't held back by the dial rate limit, which applies only to
+// redials.
+func TestClientFirstDialUnlimited(t *testing.T) {
+	heartbeatInterval = 10 * time.Millisecond
+	dialLimiter = newRateLimiter(1)
+	defer func() { dialLimiter = newRateLimiter(defaultMaxDialsPerSecond) }()
+	// Exhaust the limiter, as a burst of redials would.
+	dialLimiter.wait()
+	for i := 0; i < 3; i++ {
+		s := NewServer(util.CreateTestAddr("tcp"))
+		s.Start()
+		defer s.Close()
+		c := NewClient(s.Addr(), nil)
+		defer c.Close()
+		select {
+		case <-c.Ready:
+		case <-time.After(500 * time.Millisecond):
+			t.Fatalf("expected first dial %d not to be rate limited", i)
+		}
+	}
+}
+
+// stallService is an RPC service whose calls don't return until
+// released.
+type stallService struct {
+	release chan struct{}
+}
+
+// Wait blocks until the service is released.
+func (s *stallService) Wait(args *PingRequest, reply *PingResponse) error {
+	<-s.release
+	return nil
+}
+
+// TestSendInFlightTimeout verifies an RPC which times out after it
+// was sent fails ambiguously, while one which times out before its
+// client is ready doesn't.
+func TestSendInFlightTimeout(t *testing.T) {
+	heartbeatInterval = 10 * time.Millisecond
+	s := NewServer(util.CreateTestAddr("tcp"))
+	stall := &stallService{release: make(chan struct{})}
+	if err := s.RegisterName("Stall", stall); err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	defer s.Close()
+	defer close(stall.release)
+	<-NewClient(s.Addr(), nil).Ready
+
+	opts := Options{N: 1, SendNextTimeout: time.Second, Timeout: 20 * time.Millisecond}
+	argsMap := map[net.Addr]interface{}{s.Addr(): &PingRequest{}}
+	err := Send(argsMap, "Stall.Wait", make(chan *PingResponse, 1), opts)
+	if se, ok := err.(SendError); !ok || !se.Ambiguous {
+		t.Errorf("expected ambiguous send error; got %#v", err)
+	}
+
+	// A client which never becomes ready never sends the RPC.
+	badAddr := util.CreateTestAddr("tcp")
+	argsMap = map[net.Addr]interface{}{badAddr: &PingRequest{}}
+	err = Send(argsMap, "Stall.Wait", make(chan *PingResponse, 1), opts)
+	if se, ok := err.(SendError); !ok || se.Ambiguous {
+		t.Errorf("expected unambiguous send error; got %#v", err)
+	}
+}
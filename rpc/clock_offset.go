@@ -0,0 +1,100 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package rpc
+
+import (
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// A RemoteOffset is an estimate of the offset of a remote clock from
+// the local clock, measured by a heartbeat. The remote clock is
+// presumed to have been read halfway through the heartbeat's round
+// trip, so the true offset lies within Uncertainty of Offset.
+type RemoteOffset struct {
+	Offset      time.Duration // Remote clock reading less the local clock's
+	Uncertainty time.Duration // Half the round trip time of the heartbeat
+	MeasuredAt  time.Time     // Local time of the measurement
+}
+
+// measureOffset returns the offset measured by a heartbeat sent at
+// start which took rtt to return serverTime.
+func measureOffset(start time.Time, rtt time.Duration, serverTime int64) RemoteOffset {
+	return RemoteOffset{
+		Offset:      time.Duration(serverTime - start.Add(rtt/2).UnixNano()),
+		Uncertainty: rtt / 2,
+		MeasuredAt:  start.Add(rtt),
+	}
+}
+
+// Exceeds returns whether the remote clock is certainly offset from
+// the local clock by more than maxOffset, in either direction.
+func (ro RemoteOffset) Exceeds(maxOffset time.Duration) bool {
+	offset := ro.Offset
+	if offset < 0 {
+		offset = -offset
+	}
+	return offset-ro.Uncertainty > maxOffset
+}
+
+// RemoteOffset returns the clock offset measured by the client's most
+// recent successful heartbeat. Returns false if none has succeeded.
+func (c *Client) RemoteOffset() (RemoteOffset, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.offset, !c.offset.MeasuredAt.IsZero()
+}
+
+// RemoteOffsets returns the measured clock offsets of the servers of
+// cached clients, by address.
+func RemoteOffsets() map[string]RemoteOffset {
+	clientMu.Lock()
+	cached := make([]*Client, 0, len(clients))
+	for _, c := range clients {
+		cached = append(cached, c)
+	}
+	clientMu.Unlock()
+	offsets := map[string]RemoteOffset{}
+	for _, c := range cached {
+		if offset, ok := c.RemoteOffset(); ok {
+			offsets[c.Addr().String()] = offset
+		}
+	}
+	return offsets
+}
+
+// CheckRemoteOffsets returns an error if the local clock is certainly
+// offset by more than maxOffset from the clocks of a majority of the
+// servers to which offsets have been measured. A single remote clock
+// beyond maxOffset is presumed faulty itself and is refused by the
+// hybrid logical clock as its readings arrive; when most are beyond
+// it, the local clock is presumed faulty instead, and the node's
+// leases can't be trusted. See util.Clock.
+func CheckRemoteOffsets(maxOffset time.Duration) error {
+	offsets := RemoteOffsets()
+	var exceeded []string
+	for addr, offset := range offsets {
+		if offset.Exceeds(maxOffset) {
+			exceeded = append(exceeded, addr)
+		}
+	}
+	if len(offsets) > 0 && len(exceeded) > len(offsets)/2 {
+		return util.Errorf("local clock offset from %d of %d remote clocks by more than %s: %v",
+			len(exceeded), len(offsets), maxOffset, exceeded)
+	}
+	return nil
+}
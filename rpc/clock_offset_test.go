@@ -0,0 +1,48 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package rpc
+
+import (
+	"testing"
+	"time"
+)
+
+// TestMeasureOffset verifies offsets are estimated from the midpoint
+// of the heartbeat's round trip, within half the round trip.
+func TestMeasureOffset(t *testing.T) {
+	start := time.Unix(100, 0)
+	rtt := 20 * time.Millisecond
+	maxOffset := 100 * time.Millisecond
+	testCases := []struct {
+		serverTime time.Time
+		offset     time.Duration
+		exceeds    bool
+	}{
+		{start.Add(10 * time.Millisecond), 0, false},
+		{start.Add(200 * time.Millisecond), 190 * time.Millisecond, true},
+		{start.Add(-100 * time.Millisecond), -110 * time.Millisecond, false}, // within uncertainty
+		{start.Add(-150 * time.Millisecond), -160 * time.Millisecond, true},
+	}
+	for i, test := range testCases {
+		ro := measureOffset(start, rtt, test.serverTime.UnixNano())
+		if ro.Offset != test.offset || ro.Uncertainty != rtt/2 || !ro.MeasuredAt.Equal(start.Add(rtt)) {
+			t.Errorf("%d: unexpected offset %+v", i, ro)
+		}
+		if ro.Exceeds(maxOffset) != test.exceeds {
+			t.Errorf("%d: expected exceeds %t; got %t", i, test.exceeds, !test.exceeds)
+		}
+	}
+}
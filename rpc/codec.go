@@ -0,0 +1,387 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"net/rpc"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/protobuf"
+	"github.com/golang/glog"
+)
+
+// A Compression is an algorithm compressing the requests and replies
+// sent on a connection.
+type Compression byte
+
+const (
+	// CompressionNone sends messages uncompressed. This is the
+	// default.
+	CompressionNone Compression = iota
+	// CompressionGzip compresses messages with gzip, trading CPU for
+	// network transfer.
+	CompressionGzip
+)
+
+// minCompressSize is the encoded size below which messages aren't
+// compressed, as the savings don't repay the cost.
+const minCompressSize = 1024
+
+var compressionNames = map[Compression]string{
+	CompressionNone: "none",
+	CompressionGzip: "gzip",
+}
+
+// String implements the fmt.Stringer interface.
+func (c Compression) String() string {
+	return compressionNames[c]
+}
+
+// ParseCompression returns the compression named name: "none" or
+// "gzip".
+func ParseCompression(name string) (Compression, error) {
+	for c, n := range compressionNames {
+		if n == name {
+			return c, nil
+		}
+	}
+	return CompressionNone, util.Errorf("unknown compression %q", name)
+}
+
+// CompressionStats holds counts of the messages compressed by the
+// process and the bytes saved.
+type CompressionStats struct {
+	Messages          int64 // Messages sent compressed
+	UncompressedBytes int64 // Encoded size of the messages sent compressed
+	CompressedBytes   int64 // Size of the messages as sent
+}
+
+var (
+	compressionMu       sync.Mutex
+	compression         Compression     // Compression proposed by subsequently connecting clients
+	uncompressedMethods map[string]bool // Methods whose requests and replies are never compressed
+	compressionStats    CompressionStats
+)
+
+func init() {
+	// Heartbeats are small, and their latency is measured.
+	uncompressedMethods = map[string]bool{"Heartbeat.Ping": true}
+}
+
+// SetCompression sets the compression proposed by clients
+// subsequently connecting. Servers accept the compression proposed by
+// each client, compressing both the client's requests and their
+// replies.
+func SetCompression(c Compression) {
+	compressionMu.Lock()
+	defer compressionMu.Unlock()
+	compression = c
+}
+
+// getCompression returns the compression proposed by clients.
+func getCompression() Compression {
+	compressionMu.Lock()
+	defer compressionMu.Unlock()
+	return compression
+}
+
+// DisableCompression opts the requests and replies of method out of
+// compression, for methods whose messages are small or incompressible.
+func DisableCompression(method string) {
+	compressionMu.Lock()
+	defer compressionMu.Unlock()
+	uncompressedMethods[method] = true
+}
+
+// compressible returns whether the messages of method may be
+// compressed.
+func compressible(method string) bool {
+	compressionMu.Lock()
+	defer compressionMu.Unlock()
+	return !uncompressedMethods[method]
+}
+
+// GetCompressionStats returns the counts of messages compressed since
+// the process started.
+func GetCompressionStats() CompressionStats {
+	return CompressionStats{
+		Messages:          atomic.LoadInt64(&compressionStats.Messages),
+		UncompressedBytes: atomic.LoadInt64(&compressionStats.UncompressedBytes),
+		CompressedBytes:   atomic.LoadInt64(&compressionStats.CompressedBytes),
+	}
+}
+
+// proposeCompression writes the compression proposed by the client
+// of conn, which must precede its first request.
+func proposeCompression(conn io.Writer, c Compression) error {
+	_, err := conn.Write([]byte{byte(c)})
+	return err
+}
+
+// acceptCompression reads the compression proposed by the client of
+// conn, returning an error if it's unknown.
+func acceptCompression(conn io.Reader) (Compression, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return CompressionNone, err
+	}
+	c := Compression(b[0])
+	if _, ok := compressionNames[c]; !ok {
+		return CompressionNone, util.Errorf("unknown compression %d proposed", b[0])
+	}
+	return c, nil
+}
+
+// maxMessageSize is the largest encoded header or body accepted;
+// longer lengths are taken to be corrupt.
+const maxMessageSize = 256 << 20
+
+// A header precedes each request and reply body on the wire. Method
+// and Seq correspond to the ServiceMethod and Seq of net/rpc's
+// requests and responses, and Error to the Error of its responses.
+// See proto/rpc.proto.
+type header struct {
+	Method     string `protobuf:"1"`
+	Seq        uint64 `protobuf:"2"`
+	Error      string `protobuf:"3"`
+	Compressed bool   `protobuf:"4"` // The body is compressed
+	Gob        bool   `protobuf:"5"` // The body is gob-encoded
+}
+
+// A codec encodes requests and replies as protocol buffers, so that
+// clients needn't be written in Go. Each header and body is sent
+// prefixed by its length as a varint. Bodies whose types carry
+// protobuf tags, such as the requests and responses of the storage
+// package, are encoded as protocol buffers, and others, such as those
+// of gossip, with gob. Bodies of compressible methods may be
+// compressed. Gob bodies are encoded by a single encoder per
+// direction, so that their types are sent only once per connection,
+// as with net/rpc's own gob codec.
+type codec struct {
+	rwc         io.ReadWriteCloser
+	compression Compression
+	r           *bufio.Reader
+	w           *bufio.Writer
+	header      header // Header of the body to be read next
+	bodyEnc     *gob.Encoder
+	bodyEncBuf  bytes.Buffer
+	bodyDec     *gob.Decoder
+	bodyDecBuf  bytes.Buffer
+}
+
+// newCodec returns a codec for conn, compressing the messages of
+// compressible methods with c.
+func newCodec(conn io.ReadWriteCloser, c Compression) *codec {
+	cd := &codec{
+		rwc:         conn,
+		compression: c,
+		r:           bufio.NewReader(conn),
+		w:           bufio.NewWriter(conn),
+	}
+	cd.bodyEnc = gob.NewEncoder(&cd.bodyEncBuf)
+	cd.bodyDec = gob.NewDecoder(&cd.bodyDecBuf)
+	return cd
+}
+
+// write encodes h and body, or an empty body if body is nil,
+// compressing the body if the codec compresses messages, the method
+// is compressible and the body is large enough.
+func (cd *codec) write(h header, body interface{}) error {
+	var data []byte
+	switch {
+	case body == nil:
+		// The empty body of a failed reply.
+	case protobuf.IsMessage(body):
+		var err error
+		if data, err = protobuf.Marshal(body); err != nil {
+			return err
+		}
+	default:
+		cd.bodyEncBuf.Reset()
+		if err := cd.bodyEnc.Encode(body); err != nil {
+			return err
+		}
+		data = cd.bodyEncBuf.Bytes()
+		h.Gob = true
+	}
+	if cd.compression == CompressionGzip && len(data) >= minCompressSize && compressible(h.Method) {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		atomic.AddInt64(&compressionStats.Messages, 1)
+		atomic.AddInt64(&compressionStats.UncompressedBytes, int64(len(data)))
+		atomic.AddInt64(&compressionStats.CompressedBytes, int64(buf.Len()))
+		data = buf.Bytes()
+		h.Compressed = true
+	}
+	enc, err := protobuf.Marshal(&h)
+	if err != nil {
+		return err
+	}
+	for _, b := range [][]byte{enc, data} {
+		var size [binary.MaxVarintLen64]byte
+		if _, err := cd.w.Write(size[:binary.PutUvarint(size[:], uint64(len(b)))]); err != nil {
+			return err
+		}
+		if _, err := cd.w.Write(b); err != nil {
+			return err
+		}
+	}
+	return cd.w.Flush()
+}
+
+// readMessage reads the next length-prefixed header or body.
+func (cd *codec) readMessage() ([]byte, error) {
+	size, err := binary.ReadUvarint(cd.r)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxMessageSize {
+		return nil, util.Errorf("message length %d exceeds maximum %d", size, maxMessageSize)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(cd.r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// readHeader decodes the next header, retaining it for the body
+// which follows.
+func (cd *codec) readHeader() error {
+	data, err := cd.readMessage()
+	if err != nil {
+		return err
+	}
+	return protobuf.Unmarshal(data, &cd.header)
+}
+
+// readBody decodes the body following the last header read into
+// body. A nil body is discarded, though gob bodies are still decoded
+// to keep the gob stream in step.
+func (cd *codec) readBody(body interface{}) error {
+	data, err := cd.readMessage()
+	if err != nil {
+		return err
+	}
+	if cd.header.Compressed {
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		if data, err = ioutil.ReadAll(r); err != nil {
+			return err
+		}
+	}
+	if cd.header.Gob {
+		cd.bodyDecBuf.Write(data)
+		return cd.bodyDec.Decode(body)
+	}
+	if body == nil {
+		return nil
+	}
+	return protobuf.Unmarshal(data, body)
+}
+
+// Close closes the connection.
+func (cd *codec) Close() error {
+	return cd.rwc.Close()
+}
+
+// clientCodec implements rpc.ClientCodec.
+type clientCodec struct {
+	*codec
+}
+
+// newClientCodec proposes compression c to the server of conn and
+// returns a codec for the connection.
+func newClientCodec(conn io.ReadWriteCloser, c Compression) (rpc.ClientCodec, error) {
+	if err := proposeCompression(conn, c); err != nil {
+		return nil, err
+	}
+	return clientCodec{newCodec(conn, c)}, nil
+}
+
+func (cc clientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	return cc.write(header{Method: r.ServiceMethod, Seq: r.Seq}, body)
+}
+
+func (cc clientCodec) ReadResponseHeader(r *rpc.Response) error {
+	if err := cc.readHeader(); err != nil {
+		return err
+	}
+	r.ServiceMethod, r.Seq, r.Error = cc.header.Method, cc.header.Seq, cc.header.Error
+	return nil
+}
+
+func (cc clientCodec) ReadResponseBody(body interface{}) error {
+	return cc.readBody(body)
+}
+
+// serverCodec implements rpc.ServerCodec.
+type serverCodec struct {
+	*codec
+}
+
+// newServerCodec accepts the compression proposed by the client of
+// conn and returns a codec for the connection.
+func newServerCodec(conn io.ReadWriteCloser) (rpc.ServerCodec, error) {
+	c, err := acceptCompression(conn)
+	if err != nil {
+		return nil, err
+	}
+	return serverCodec{newCodec(conn, c)}, nil
+}
+
+func (sc serverCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := sc.readHeader(); err != nil {
+		return err
+	}
+	r.ServiceMethod, r.Seq = sc.header.Method, sc.header.Seq
+	return nil
+}
+
+func (sc serverCodec) ReadRequestBody(body interface{}) error {
+	return sc.readBody(body)
+}
+
+func (sc serverCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if r.Error != "" {
+		body = nil
+	}
+	if err := sc.write(header{Method: r.ServiceMethod, Seq: r.Seq, Error: r.Error}, body); err != nil {
+		// The stream can't be resumed once an encoding has failed
+		// part way, as net/rpc's own gob codec concludes.
+		glog.Warningf("rpc: failed to encode %s reply: %v", r.ServiceMethod, err)
+		sc.Close()
+		return err
+	}
+	return nil
+}
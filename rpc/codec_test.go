@@ -0,0 +1,174 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package rpc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/protobuf"
+)
+
+// echoService is an RPC service echoing its requests.
+type echoService struct{}
+
+// Echo echoes the request.
+func (echoService) Echo(args *PingRequest, reply *PingResponse) error {
+	reply.Pong = args.Ping
+	return nil
+}
+
+// Skip echoes the request; its messages aren't compressed.
+func (echoService) Skip(args *PingRequest, reply *PingResponse) error {
+	reply.Pong = args.Ping
+	return nil
+}
+
+// TestCompression verifies the requests and replies of connections
+// whose clients propose compression are compressed, except those of
+// methods opted out and those too small to be worth it, and that
+// connections of other clients to the same server aren't.
+func TestCompression(t *testing.T) {
+	heartbeatInterval = 10 * time.Millisecond
+	// Clients are closed and reopened without delay.
+	reconnectStagger = 0
+	defer func() { reconnectStagger = defaultReconnectStagger }()
+	defer SetCompression(CompressionNone)
+	DisableCompression("Echo.Skip")
+	s := NewServer(util.CreateTestAddr("tcp"))
+	if err := s.RegisterName("Echo", echoService{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	large := strings.Repeat("compressible ", 1000)
+	testCases := []struct {
+		compression Compression
+		method      string
+		ping        string
+		compressed  int64 // Messages expected to be compressed
+	}{
+		{CompressionNone, "Echo.Echo", large, 0},
+		{CompressionGzip, "Echo.Echo", large, 2},
+		{CompressionGzip, "Echo.Echo", "small", 0},
+		{CompressionGzip, "Echo.Skip", large, 0},
+	}
+	for i, test := range testCases {
+		SetCompression(test.compression)
+		CloseClient(s.Addr())
+		c := NewClient(s.Addr(), nil)
+		<-c.Ready
+		start := GetCompressionStats()
+		reply := &PingResponse{}
+		if err := (<-c.Go(test.method, &PingRequest{Ping: test.ping}, reply, nil).Done).Error; err != nil {
+			t.Fatal(err)
+		}
+		if reply.Pong != test.ping {
+			t.Errorf("%d: expected echo of %d bytes; got %d", i, len(test.ping), len(reply.Pong))
+		}
+		stats := GetCompressionStats()
+		if n := stats.Messages - start.Messages; n != test.compressed {
+			t.Errorf("%d: expected %d compressed messages; got %d", i, test.compressed, n)
+		}
+		if test.compressed > 0 && stats.CompressedBytes-start.CompressedBytes >= stats.UncompressedBytes-start.UncompressedBytes {
+			t.Errorf("%d: expected compression to save bytes; got %+v", i, stats)
+		}
+		c.Close()
+	}
+}
+
+// TestParseCompression verifies compressions are parsed by name.
+func TestParseCompression(t *testing.T) {
+	for _, c := range []Compression{CompressionNone, CompressionGzip} {
+		if parsed, err := ParseCompression(c.String()); err != nil || parsed != c {
+			t.Errorf("expected %s; got %s, %v", c, parsed, err)
+		}
+	}
+	if _, err := ParseCompression("snappy"); err == nil {
+		t.Error("expected unknown compression to fail to parse")
+	}
+}
+
+// TestCodecMatchesSchema verifies RPC headers and heartbeats match
+// their declarations in proto/rpc.proto.
+func TestCodecMatchesSchema(t *testing.T) {
+	schema, err := ioutil.ReadFile("../proto/rpc.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := protobuf.CheckSchema(string(schema), &header{}, &PingRequest{}, &PingResponse{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestProtoWireFormat verifies a client which encodes its requests
+// by hand, as described by proto/rpc.proto, is served.
+func TestProtoWireFormat(t *testing.T) {
+	s := NewServer(util.CreateTestAddr("tcp"))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	conn, err := dial(s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fc := newFrameConn(conn)
+
+	// No compression, followed by the header and body of a ping.
+	req := []byte{byte(CompressionNone)}
+	method := "Heartbeat.Ping"
+	req = append(req, byte(2+len(method)+2), 0x0a, byte(len(method)))
+	req = append(req, method...)
+	req = append(req, 0x10, 0x07)                                // seq: 7
+	req = append(req, 0x07, 0x0a, 0x05, 'h', 'e', 'l', 'l', 'o') // ping: "hello"
+	if _, err := fc.Write(req); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(fc)
+	var h header
+	reply := &PingResponse{}
+	for _, msg := range []interface{}{&h, reply} {
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			t.Fatal(err)
+		}
+		if err := protobuf.Unmarshal(data, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if h.Method != method || h.Seq != 7 || h.Error != "" || h.Compressed || h.Gob {
+		t.Errorf("unexpected reply header %+v", h)
+	}
+	if reply.Pong != "hello" || reply.ServerTime == 0 {
+		t.Errorf("unexpected reply %+v", reply)
+	}
+}
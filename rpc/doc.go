@@ -17,5 +17,12 @@
 
 /*
 Package rpc provides RPC server and clients specific to Cockroach.
+
+Requests and replies are encoded as protocol buffers, as described by
+proto/rpc.proto, and sent over framed, checksummed connections; see
+codec and frameConn. Each client proposes a compression for its
+connection, which the server accepts; large messages of methods not
+opted out via DisableCompression are compressed in both directions.
+See SetCompression.
 */
 package rpc
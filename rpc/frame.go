@@ -0,0 +1,156 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package rpc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+const (
+	// frameHeaderSize is the size of the header preceding each frame's
+	// payload: the payload length and its CRC32 checksum, both 32-bit
+	// big endian.
+	frameHeaderSize = 8
+	// maxFrameSize is the largest payload sent in a single frame.
+	// Longer writes are split; a header claiming a longer payload is
+	// treated as corrupt.
+	maxFrameSize = 16 << 20
+)
+
+var (
+	corruptFrames   int64 // Frames received with an invalid length or checksum
+	retransmissions int64 // RPCs resent after a corrupt reply
+)
+
+// FrameStats holds counts of transport corruption detected by the
+// process.
+type FrameStats struct {
+	CorruptFrames   int64 // Frames received with an invalid length or checksum
+	Retransmissions int64 // RPCs resent on a new connection after a corrupt reply
+}
+
+// GetFrameStats returns the counts of corrupt frames received and
+// RPCs retransmitted as a result since the process started.
+func GetFrameStats() FrameStats {
+	return FrameStats{
+		CorruptFrames:   atomic.LoadInt64(&corruptFrames),
+		Retransmissions: atomic.LoadInt64(&retransmissions),
+	}
+}
+
+// A CorruptFrameError indicates a frame received on a connection had
+// an invalid length or failed its checksum. The connection is unusable
+// once corruption has been detected, as the frame boundaries which
+// follow can't be trusted.
+type CorruptFrameError struct {
+	Message string
+}
+
+// Error implements the error interface.
+func (e *CorruptFrameError) Error() string {
+	return e.Message
+}
+
+// frameConn wraps a connection, prefixing each write with a header
+// holding its length and checksum, and verifying the header of each
+// frame read. This protects the encoded RPC stream from corruption
+// introduced by faulty hardware or middleboxes, which TCP checksums
+// don't reliably detect.
+type frameConn struct {
+	net.Conn
+	r       *bufio.Reader
+	payload []byte // Unread remainder of the current frame
+	err     error  // Sticky read error
+}
+
+// newFrameConn returns conn wrapped to read and write checksummed
+// frames. Both ends of a connection must be wrapped.
+func newFrameConn(conn net.Conn) *frameConn {
+	return &frameConn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+// Read reads from the payload of the current frame, reading and
+// verifying the next frame once the current one is exhausted.
+func (fc *frameConn) Read(p []byte) (int, error) {
+	for len(fc.payload) == 0 {
+		if fc.err != nil {
+			return 0, fc.err
+		}
+		fc.payload, fc.err = fc.readFrame()
+	}
+	n := copy(p, fc.payload)
+	fc.payload = fc.payload[n:]
+	return n, nil
+}
+
+// readFrame reads the next frame, returning its payload.
+func (fc *frameConn) readFrame() ([]byte, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(fc.r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size > maxFrameSize {
+		return nil, fc.corrupt(fmt.Sprintf("frame length %d exceeds maximum %d", size, maxFrameSize))
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(fc.r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if sum := crc32.ChecksumIEEE(payload); sum != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, fc.corrupt(fmt.Sprintf("frame checksum %08x does not match %08x", sum, binary.BigEndian.Uint32(header[4:8])))
+	}
+	return payload, nil
+}
+
+// corrupt counts a corrupt frame and returns an error describing it.
+func (fc *frameConn) corrupt(msg string) error {
+	atomic.AddInt64(&corruptFrames, 1)
+	return &CorruptFrameError{
+		Message: fmt.Sprintf("corrupt frame from %s: %s", fc.RemoteAddr(), msg),
+	}
+}
+
+// Write writes p as one or more frames. The RPC codecs serialize
+// writes, so frames are never interleaved.
+func (fc *frameConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > maxFrameSize {
+			n = maxFrameSize
+		}
+		frame := make([]byte, frameHeaderSize+n)
+		binary.BigEndian.PutUint32(frame[0:4], uint32(n))
+		binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(p[:n]))
+		copy(frame[frameHeaderSize:], p[:n])
+		if _, err := fc.Conn.Write(frame); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package rpc
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// TestFrameConn verifies data written to a frame conn is read intact
+// from its peer, and that corrupt frames are detected and counted.
+func TestFrameConn(t *testing.T) {
+	client, server := net.Pipe()
+	w, r := newFrameConn(client), newFrameConn(server)
+	data := bytes.Repeat([]byte("cockroach"), 1000)
+	go func() {
+		w.Write(data[:10])
+		w.Write(data[10:])
+		w.Close()
+	}()
+	read, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(read, data) {
+		t.Fatalf("expected %d bytes intact; got %d, %v", len(data), len(read), err)
+	}
+
+	testCases := []struct {
+		name   string
+		mangle func(frame []byte)
+	}{
+		{"payload", func(frame []byte) { frame[frameHeaderSize] ^= 0x01 }},
+		{"checksum", func(frame []byte) { frame[7] ^= 0x80 }},
+		{"length", func(frame []byte) { frame[0] = 0xff }},
+	}
+	for _, test := range testCases {
+		before := GetFrameStats().CorruptFrames
+		client, server := net.Pipe()
+		r := newFrameConn(server)
+		go func() {
+			var buf bytes.Buffer
+			fc := newFrameConn(client)
+			fc.Conn = &bufConn{Conn: client, w: &buf}
+			fc.Write([]byte("hello"))
+			frame := buf.Bytes()
+			test.mangle(frame)
+			client.Write(frame)
+			client.Close()
+		}()
+		if _, err := ioutil.ReadAll(r); err == nil {
+			t.Errorf("%s: expected corruption error", test.name)
+		} else if _, ok := err.(*CorruptFrameError); !ok {
+			t.Errorf("%s: expected corrupt frame error; got %v", test.name, err)
+		}
+		// Unblock the writer, which may not have written the whole frame.
+		r.Close()
+		if after := GetFrameStats().CorruptFrames; after != before+1 {
+			t.Errorf("%s: expected corrupt frame counted; got %d -> %d", test.name, before, after)
+		}
+	}
+}
+
+// bufConn is a net.Conn whose writes are captured in a buffer.
+type bufConn struct {
+	net.Conn
+	w *bytes.Buffer
+}
+
+func (bc *bufConn) Write(p []byte) (int, error) {
+	return bc.w.Write(p)
+}
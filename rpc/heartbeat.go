@@ -17,14 +17,19 @@
 
 package rpc
 
+import "github.com/cockroachdb/cockroach/util"
+
 // A PingRequest specifies the string to echo in response.
 type PingRequest struct {
-	Ping string // Echo this string with PingResponse.
+	Ping string `protobuf:"1"` // Echo this string with PingResponse.
 }
 
-// A PingResponse contains the echoed ping request string.
+// A PingResponse contains the echoed ping request string and a
+// reading of the server's physical clock, from which clients estimate
+// its offset from theirs.
 type PingResponse struct {
-	Pong string // An echo of value sent with PingRequest.
+	Pong       string `protobuf:"1"` // An echo of value sent with PingRequest.
+	ServerTime int64  `protobuf:"2"` // Server wall time in nanoseconds since the epoch
 }
 
 // A HeartbeatService exposes a method to echo its request params.
@@ -33,5 +38,6 @@ type HeartbeatService struct{}
 // Ping echos the contents of the request to the response.
 func (hs *HeartbeatService) Ping(args *PingRequest, reply *PingResponse) error {
 	reply.Pong = args.Ping
+	reply.ServerTime = util.UnixNano()
 	return nil
 }
@@ -0,0 +1,52 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package rpc
+
+import (
+	"sync"
+	"time"
+)
+
+// A rateLimiter spaces events evenly so that no more than a maximum
+// number occur per second.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration // Minimum time between events; 0 for no limit
+	next     time.Time     // Earliest time of the next event
+}
+
+// newRateLimiter returns a rate limiter allowing perSecond events per
+// second, or any number if perSecond isn't positive.
+func newRateLimiter(perSecond int) *rateLimiter {
+	l := &rateLimiter{}
+	if perSecond > 0 {
+		l.interval = time.Second / time.Duration(perSecond)
+	}
+	return l
+}
+
+// wait blocks until the next event is allowed.
+func (l *rateLimiter) wait() {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+	time.Sleep(delay)
+}
@@ -20,7 +20,10 @@ package rpc
 import (
 	"math/rand"
 	"net"
+	"net/rpc"
 	"reflect"
+	"sort"
+	"sync/atomic"
 	"time"
 
 	"github.com/cockroachdb/cockroach/util"
@@ -34,22 +37,46 @@ type Options struct {
 	// N is the number of successful responses required.
 	N int
 	// SendNextTimeout is the duration after which RPCs are sent to
-	// other replicas in a set.
+	// other replicas in a set. Ignored if SendNext is set.
 	SendNextTimeout time.Duration
+	// SendNext, if set, is the strategy for sending RPCs to other
+	// replicas in a set while awaiting replies; see SendNextStrategy.
+	SendNext *SendNextStrategy
 	// Timeout is the maximum duration of an RPC before failure.
 	// 0 for no timeout.
 	Timeout time.Duration
+	// Order, if set, lists replica addresses in order of preference.
+	// Healthy replicas are sent to in this order rather than in random
+	// order; replicas not listed follow those which are.
+	Order []net.Addr
 }
 
 // A SendError indicates that too many RPCs to the replica
 // set failed to achieve requested number of successful responses.
 type SendError struct {
 	error
+	// Ambiguous is set if any of the failed RPCs failed in flight, so
+	// that it may have been executed.
+	Ambiguous bool
 }
 
 // CanRetry implements the Retryable interface.
 func (s SendError) CanRetry() bool { return true }
 
+// An InFlightError indicates an RPC failed after it was sent, by
+// timing out or losing its connection before the reply arrived. The
+// server may or may not have executed it.
+type InFlightError struct {
+	error
+}
+
+// A sendResult is the reply or error of an RPC to one replica, and
+// whether the RPC was sent speculatively.
+type sendResult struct {
+	value       interface{}
+	speculative bool
+}
+
 // Send sends one or more RPCs to clients specified by the keys of
 // argsMap (with corresponding values of the map as arguments)
 // according to availability and the number of required responses
@@ -57,10 +84,12 @@ func (s SendError) CanRetry() bool { return true }
 // channel if successful; otherwise an error is returned on
 // failure. Note that on error, some replies may have been sent on the
 // channel. Send returns an error if the number of errors exceeds the
-// possibility of attaining the required successful responses.
+// possibility of attaining the required successful responses. RPCs
+// are sent via the process-wide cache of clients, reusing their
+// connections; see NewClient.
 func Send(argsMap map[net.Addr]interface{}, method string, replyChanI interface{}, opts Options) error {
-	if opts.N < len(argsMap) {
-		return SendError{util.Errorf("insufficient replicas (%d) to satisfy send request of %d", len(argsMap), opts.N)}
+	if len(argsMap) < opts.N {
+		return SendError{error: util.Errorf("insufficient replicas (%d) to satisfy send request of %d", len(argsMap), opts.N)}
 	}
 
 	// Build the slice of clients.
@@ -76,52 +105,70 @@ func Send(argsMap map[net.Addr]interface{}, method string, replyChanI interface{
 		}
 	}
 
-	// Randomly permute order, but keep known-unhealthy clients
-	// separate.
-	// TODO(spencer): going to need to also sort by affinity; closest
-	// ping time should win. Makes sense to have the rpc client/server
-	// heartbeat measure ping times. With a bit of seasoning, each
-	// node will be able to order the healthy replicas based on latency.
+	// Randomly permute order unless the caller specified a preferred
+	// order, but keep known-unhealthy clients separate.
 	var clients []*Client
 	for _, idx := range rand.Perm(len(healthy)) {
 		clients = append(clients, healthy[idx])
 	}
+	if len(opts.Order) > 0 {
+		orderClients(clients, opts.Order)
+	}
 	for _, idx := range rand.Perm(len(unhealthy)) {
 		clients = append(clients, unhealthy[idx])
 	}
 
 	// Send RPCs to replicas as necessary to achieve opts.N successes.
-	helperChan := make(chan interface{}, len(clients))
+	helperChan := make(chan sendResult, len(clients))
+	snc := newSendNextCall(opts, method)
 	N := opts.N
 	errors := 0
+	inFlight := false
 	successes := 0
 	index := 0
+	speculative := false // Clients started at or after index are speculative
+	withheld := false    // The budget withheld a speculative send
 	for {
 		// Start clients up to N.
 		for ; index < N; index++ {
 			args := argsMap[clients[index].Addr()]
 			if args == nil {
-				helperChan <- util.Errorf("no arguments in map (len %d) for client %s", len(argsMap), clients[index].Addr())
+				helperChan <- sendResult{value: util.Errorf("no arguments in map (len %d) for client %s", len(argsMap), clients[index].Addr())}
 				continue
 			}
 			reply := reflect.New(reflect.TypeOf(replyChanI).Elem().Elem()).Interface()
 			if glog.V(1) {
 				glog.Infof("%s: sending request to %s: %+v", method, clients[index].Addr(), args)
 			}
-			go sendOne(clients[index], opts.Timeout, method, args, reply, helperChan)
+			go func(client *Client, args, reply interface{}, speculative bool) {
+				c := make(chan interface{}, 1)
+				sendOne(client, opts.Timeout, method, args, reply, c)
+				helperChan <- sendResult{value: <-c, speculative: speculative}
+			}(clients[index], args, reply, speculative)
+		}
+		speculative = false
+		var sendNextChan <-chan time.Time
+		if timeout, ok := snc.timeout(); ok && !withheld && N < len(clients) {
+			sendNextChan = time.After(timeout)
 		}
 		// Wait for completions.
 		select {
 		case r := <-helperChan:
-			switch t := r.(type) {
+			switch t := r.value.(type) {
 			case error:
 				errors++
+				if _, ok := t.(InFlightError); ok {
+					inFlight = true
+				}
 				if glog.V(1) {
 					glog.Warningf("%s: error reply: %+v", method, t)
 				}
 				if len(clients)-errors < opts.N {
-					return SendError{util.Errorf("too many errors encountered (%d of %d total): %v",
-						errors, len(clients), t)}
+					return SendError{
+						error: util.Errorf("too many errors encountered (%d of %d total): %v",
+							errors, len(clients), t),
+						Ambiguous: inFlight,
+					}
 				}
 				// Send to additional replicas if available.
 				if N < len(clients) {
@@ -134,13 +181,18 @@ func Send(argsMap map[net.Addr]interface{}, method string, replyChanI interface{
 				}
 				reflect.ValueOf(replyChanI).Send(reflect.ValueOf(t))
 				if successes == opts.N {
+					snc.succeeded(r.speculative)
 					return nil
 				}
 			}
-		case <-time.After(opts.SendNextTimeout):
-			// On successive RPC timeouts, send to additional replicas if available.
-			if N < len(clients) {
+		case <-sendNextChan:
+			// On successive RPC timeouts, send to additional replicas
+			// as the strategy's budget permits.
+			if snc.fire() {
 				N++
+				speculative = true
+			} else {
+				withheld = true
 			}
 		}
 	}
@@ -148,22 +200,82 @@ func Send(argsMap map[net.Addr]interface{}, method string, replyChanI interface{
 	return nil
 }
 
+// orderClients sorts clients by the position of their addresses in
+// order. Clients whose addresses aren't listed keep their relative
+// order and follow those which are.
+func orderClients(clients []*Client, order []net.Addr) {
+	rank := map[string]int{}
+	for i, addr := range order {
+		rank[addr.String()] = i
+	}
+	sort.Stable(clientsByRank{clients, rank})
+}
+
+// clientsByRank implements sort.Interface, ordering clients by rank;
+// clients without a rank sort last.
+type clientsByRank struct {
+	clients []*Client
+	rank    map[string]int
+}
+
+func (cr clientsByRank) Len() int      { return len(cr.clients) }
+func (cr clientsByRank) Swap(i, j int) { cr.clients[i], cr.clients[j] = cr.clients[j], cr.clients[i] }
+func (cr clientsByRank) Less(i, j int) bool {
+	ri, iok := cr.rank[cr.clients[i].Addr().String()]
+	rj, jok := cr.rank[cr.clients[j].Addr().String()]
+	if iok && jok {
+		return ri < rj
+	}
+	return iok && !jok
+}
+
+// maxRetransmits is the number of times an RPC whose reply was
+// corrupted in transit is resent on a new connection.
+const maxRetransmits = 2
+
 // sendOne invokes the specified RPC on the supplied client when the
 // client is ready. On success, the reply is sent on the channel;
-// otherwise an error is sent.
+// otherwise an error is sent, which is an InFlightError if the RPC
+// was sent but no reply arrived. If corruption is detected in the reply,
+// the client's connection is closed and the RPC resent on a new one,
+// within the same timeout.
 func sendOne(client *Client, timeout time.Duration, method string, args, reply interface{}, c chan interface{}) {
-	<-client.Ready
-	call := client.Go(method, args, reply, nil)
-	select {
-	case <-call.Done:
-		if call.Error != nil {
-			c <- call.Error
-		} else {
-			c <- reply
+	timeoutChan := time.After(timeout)
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-client.Ready:
+		case <-client.Closed:
+			c <- util.Errorf("rpc to %s failed as client connection was closed", method)
+			return
+		case <-timeoutChan:
+			c <- util.Errorf("rpc to %s timed out after %s", method, timeout)
+			return
+		}
+		call := client.Go(method, args, reply, nil)
+		select {
+		case <-call.Done:
+			if _, ok := call.Error.(*CorruptFrameError); ok && attempt < maxRetransmits {
+				glog.Warningf("%s: %v; resending on new connection", method, call.Error)
+				atomic.AddInt64(&retransmissions, 1)
+				client.Close()
+				client = NewClient(client.Addr(), nil)
+				// The corrupt reply may have been partially decoded.
+				reply = reflect.New(reflect.TypeOf(reply).Elem()).Interface()
+				continue
+			}
+			if call.Error == rpc.ErrShutdown {
+				// The connection failed with the call pending.
+				c <- InFlightError{call.Error}
+			} else if call.Error != nil {
+				c <- call.Error
+			} else {
+				c <- reply
+			}
+		case <-client.Closed:
+			c <- InFlightError{util.Errorf("rpc to %s failed as client connection was closed", method)}
+		case <-timeoutChan:
+			c <- InFlightError{util.Errorf("rpc to %s timed out after %s", method, timeout)}
 		}
-	case <-client.Closed:
-		c <- util.Errorf("rpc to %s failed as client connection was closed", method)
-	case <-time.After(timeout):
-		c <- util.Errorf("rpc to %s timed out after %s", method, timeout)
+		return
 	}
 }
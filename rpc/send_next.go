@@ -0,0 +1,210 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package rpc
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// SendNextKind selects how a SendNextStrategy decides when to send an
+// RPC speculatively to another replica while awaiting a reply.
+type SendNextKind int
+
+const (
+	// SendNextFixed sends next after a fixed timeout.
+	SendNextFixed SendNextKind = iota
+	// SendNextPercentile sends next once the call has taken longer than
+	// a percentile of recent latencies of its call class.
+	SendNextPercentile
+	// SendNextDisabled never sends speculatively; other replicas are
+	// sent to only on errors.
+	SendNextDisabled
+)
+
+// sendNextSamples is the number of recent latencies of each call class
+// retained to compute percentile-based timeouts.
+const sendNextSamples = 100
+
+// sendNextMinSamples is the number of latencies of a call class which
+// must be observed before its percentile is used; until then, the
+// strategy's Timeout applies.
+const sendNextMinSamples = 20
+
+// A SendNextStrategy governs speculative retries: sending an RPC to
+// another replica of a set while the replicas already sent to have
+// yet to reply, trading extra load for lower tail latency.
+type SendNextStrategy struct {
+	Kind SendNextKind
+	// Timeout is the duration after which a fixed strategy sends next.
+	// A percentile strategy uses it until enough latencies of the call
+	// class have been observed.
+	Timeout time.Duration
+	// Percentile, between 0 and 1, is the fraction of recent latencies
+	// of the call class within which a percentile strategy waits for a
+	// reply before sending next.
+	Percentile float64
+	// Class groups calls for latency percentiles, budgets and stats.
+	// Defaults to the RPC method.
+	Class string
+	// Budget, if positive, is the maximum ratio of speculative sends to
+	// calls in the call class; once exhausted, calls wait on the
+	// replicas already sent to.
+	Budget float64
+}
+
+// SendNextStats holds counts of speculative sends for a call class.
+type SendNextStats struct {
+	Class      string
+	Calls      int64 // Calls sent
+	Fired      int64 // Speculative sends
+	Won        int64 // Calls answered by a speculatively sent replica
+	Suppressed int64 // Speculative sends withheld by the class's budget
+}
+
+// A sendNextClass tracks the latencies and stats of a call class.
+type sendNextClass struct {
+	stats     SendNextStats
+	latencies []time.Duration // Ring buffer of recent latencies
+	next      int             // Index of the next latency to replace
+}
+
+var (
+	sendNextMu      sync.Mutex
+	sendNextClasses = map[string]*sendNextClass{}
+)
+
+// sendNextClassFor returns the state of the named call class, creating
+// it if necessary. Requires sendNextMu.
+func sendNextClassFor(class string) *sendNextClass {
+	c, ok := sendNextClasses[class]
+	if !ok {
+		c = &sendNextClass{stats: SendNextStats{Class: class}}
+		sendNextClasses[class] = c
+	}
+	return c
+}
+
+// GetSendNextStats returns the speculative send counts of each call
+// class since the process started, sorted by class.
+func GetSendNextStats() []SendNextStats {
+	sendNextMu.Lock()
+	defer sendNextMu.Unlock()
+	stats := make([]SendNextStats, 0, len(sendNextClasses))
+	for _, c := range sendNextClasses {
+		stats = append(stats, c.stats)
+	}
+	sort.Sort(sendNextStatsByClass(stats))
+	return stats
+}
+
+// sendNextStatsByClass implements sort.Interface for SendNextStats,
+// ordering by class.
+type sendNextStatsByClass []SendNextStats
+
+func (s sendNextStatsByClass) Len() int           { return len(s) }
+func (s sendNextStatsByClass) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s sendNextStatsByClass) Less(i, j int) bool { return s[i].Class < s[j].Class }
+
+// A sendNextCall applies a strategy to a single call.
+type sendNextCall struct {
+	strategy SendNextStrategy
+	class    string
+	start    time.Time
+}
+
+// newSendNextCall returns the application of opts' strategy to a call
+// of method, counting the call against its class. Options without a
+// strategy send next after their SendNextTimeout.
+func newSendNextCall(opts Options, method string) *sendNextCall {
+	strategy := SendNextStrategy{Kind: SendNextFixed, Timeout: opts.SendNextTimeout}
+	if opts.SendNext != nil {
+		strategy = *opts.SendNext
+	}
+	class := strategy.Class
+	if class == "" {
+		class = method
+	}
+	sendNextMu.Lock()
+	sendNextClassFor(class).stats.Calls++
+	sendNextMu.Unlock()
+	return &sendNextCall{strategy: strategy, class: class, start: time.Now()}
+}
+
+// timeout returns the duration to wait for a reply before sending
+// next, or false if the call doesn't send speculatively.
+func (snc *sendNextCall) timeout() (time.Duration, bool) {
+	switch snc.strategy.Kind {
+	case SendNextDisabled:
+		return 0, false
+	case SendNextPercentile:
+		sendNextMu.Lock()
+		defer sendNextMu.Unlock()
+		c := sendNextClassFor(snc.class)
+		if len(c.latencies) < sendNextMinSamples {
+			return snc.strategy.Timeout, true
+		}
+		sorted := append([]time.Duration(nil), c.latencies...)
+		sort.Sort(durations(sorted))
+		i := int(snc.strategy.Percentile * float64(len(sorted)))
+		if i >= len(sorted) {
+			i = len(sorted) - 1
+		}
+		return sorted[i], true
+	}
+	return snc.strategy.Timeout, true
+}
+
+// fire returns whether the call may send next, counting the
+// speculative send or, if the class's budget is exhausted, its
+// suppression.
+func (snc *sendNextCall) fire() bool {
+	sendNextMu.Lock()
+	defer sendNextMu.Unlock()
+	c := sendNextClassFor(snc.class)
+	if snc.strategy.Budget > 0 && float64(c.stats.Fired+1) > snc.strategy.Budget*float64(c.stats.Calls) {
+		c.stats.Suppressed++
+		return false
+	}
+	c.stats.Fired++
+	return true
+}
+
+// succeeded records the call's latency and whether its reply came
+// from a replica sent to speculatively.
+func (snc *sendNextCall) succeeded(speculative bool) {
+	sendNextMu.Lock()
+	defer sendNextMu.Unlock()
+	c := sendNextClassFor(snc.class)
+	if speculative {
+		c.stats.Won++
+	}
+	latency := time.Since(snc.start)
+	if len(c.latencies) < sendNextSamples {
+		c.latencies = append(c.latencies, latency)
+	} else {
+		c.latencies[c.next] = latency
+		c.next = (c.next + 1) % sendNextSamples
+	}
+}
+
+// durations implements sort.Interface for a slice of durations.
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
@@ -0,0 +1,118 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package rpc
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// fastService is an RPC service whose calls return immediately.
+type fastService struct{}
+
+// Wait returns immediately.
+func (s *fastService) Wait(args *PingRequest, reply *PingResponse) error {
+	return nil
+}
+
+// sendNextStatsFor returns the send next stats of class.
+func sendNextStatsFor(class string) SendNextStats {
+	for _, stats := range GetSendNextStats() {
+		if stats.Class == class {
+			return stats
+		}
+	}
+	return SendNextStats{Class: class}
+}
+
+// TestSendNextStrategies verifies speculative sends are made per the
+// strategy and budget of their call class, and counted.
+func TestSendNextStrategies(t *testing.T) {
+	heartbeatInterval = 10 * time.Millisecond
+	slow := NewServer(util.CreateTestAddr("tcp"))
+	stall := &stallService{release: make(chan struct{})}
+	if err := slow.RegisterName("Stall", stall); err != nil {
+		t.Fatal(err)
+	}
+	slow.Start()
+	defer slow.Close()
+	defer close(stall.release)
+	fast := NewServer(util.CreateTestAddr("tcp"))
+	if err := fast.RegisterName("Stall", &fastService{}); err != nil {
+		t.Fatal(err)
+	}
+	fast.Start()
+	defer fast.Close()
+	<-NewClient(slow.Addr(), nil).Ready
+	<-NewClient(fast.Addr(), nil).Ready
+
+	send := func(strategy SendNextStrategy) {
+		opts := Options{
+			N:        1,
+			SendNext: &strategy,
+			Timeout:  50 * time.Millisecond,
+			Order:    []net.Addr{slow.Addr(), fast.Addr()},
+		}
+		argsMap := map[net.Addr]interface{}{slow.Addr(): &PingRequest{}, fast.Addr(): &PingRequest{}}
+		if err := Send(argsMap, "Stall.Wait", make(chan *PingResponse, 1), opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testCases := []struct {
+		strategy SendNextStrategy
+		calls    int
+		expStats SendNextStats
+	}{
+		{SendNextStrategy{Kind: SendNextFixed, Timeout: 5 * time.Millisecond, Class: "fixed"}, 2,
+			SendNextStats{Class: "fixed", Calls: 2, Fired: 2, Won: 2}},
+		// The fast replica is sent to only once the slow one times out.
+		{SendNextStrategy{Kind: SendNextDisabled, Class: "disabled"}, 1,
+			SendNextStats{Class: "disabled", Calls: 1}},
+		// The first call would exceed the budget; the second wouldn't.
+		{SendNextStrategy{Kind: SendNextFixed, Timeout: 5 * time.Millisecond, Class: "budget", Budget: 0.5}, 2,
+			SendNextStats{Class: "budget", Calls: 2, Fired: 1, Won: 1, Suppressed: 1}},
+	}
+	for i, test := range testCases {
+		for j := 0; j < test.calls; j++ {
+			send(test.strategy)
+		}
+		if stats := sendNextStatsFor(test.strategy.Class); stats != test.expStats {
+			t.Errorf("%d: expected stats %+v; got %+v", i, test.expStats, stats)
+		}
+	}
+}
+
+// TestSendNextPercentile verifies a percentile strategy waits for the
+// percentile of its class's recent latencies, once enough are known.
+func TestSendNextPercentile(t *testing.T) {
+	snc := &sendNextCall{
+		strategy: SendNextStrategy{Kind: SendNextPercentile, Percentile: 0.9, Timeout: time.Second},
+		class:    "percentile",
+	}
+	if timeout, ok := snc.timeout(); !ok || timeout != time.Second {
+		t.Errorf("expected timeout of 1s without latencies; got %s, %t", timeout, ok)
+	}
+	for i := 100; i > 0; i-- {
+		snc.start = time.Now().Add(-time.Duration(i) * time.Millisecond)
+		snc.succeeded(false)
+	}
+	if timeout, ok := snc.timeout(); !ok || timeout < 90*time.Millisecond || timeout > 95*time.Millisecond {
+		t.Errorf("expected timeout of about 91ms; got %s, %t", timeout, ok)
+	}
+}
@@ -62,11 +62,14 @@ func (s *Server) AddCloseCallback(cb func(conn net.Conn)) {
 
 // Start runs the RPC server. After this method returns, the socket
 // will have been bound. Use Server.Addr() to ascertain server address.
+// If a TLS config is set, connections are accepted only from peers
+// which authenticate; see SetTLSConfig.
 func (s *Server) Start() error {
 	ln, err := net.Listen(s.addr.Network(), s.addr.String())
 	if err != nil {
 		return err
 	}
+	ln = NewListener(ln)
 	s.listener = ln
 
 	s.mu.Lock()
@@ -112,7 +115,18 @@ func (s *Server) Close() {
 // serveConn synchronously serves a single connection. When the
 // connection is closed, close callbacks are invoked.
 func (s *Server) serveConn(conn net.Conn) {
-	s.ServeConn(conn)
+	if err := handshake(conn); err != nil {
+		glog.Warningf("rejected connection from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	// Corrupt request frames terminate the connection; clients see
+	// their outstanding RPCs fail and reconnect.
+	if codec, err := newServerCodec(newFrameConn(conn)); err != nil {
+		glog.Warningf("rejected connection from %s: %v", conn.RemoteAddr(), err)
+	} else {
+		s.ServeCodec(codec)
+	}
 	s.mu.Lock()
 	if s.closeCallbacks != nil {
 		for _, cb := range s.closeCallbacks {
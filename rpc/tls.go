@@ -0,0 +1,258 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package rpc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// tlsHandshakeTimeout bounds the TLS handshake of a new connection,
+// so that peers which connect without completing it don't hold
+// connections open.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// TLSStats holds counts of TLS handshakes, for monitoring attempts by
+// unauthenticated peers to connect.
+type TLSStats struct {
+	Accepted   int64 // Incoming connections whose peers authenticated
+	Rejected   int64 // Incoming connections refused as their peers failed to authenticate
+	Unverified int64 // Outgoing connections abandoned as their peers failed to authenticate
+}
+
+var (
+	tlsMu      sync.Mutex
+	tlsConfig  *tls.Config                 // Nil to serve and dial without TLS
+	tlsLoaders map[*tls.Config]*certLoader // Loaders of configs returned by LoadTLSConfig
+	tlsStats   TLSStats
+)
+
+// A certLoader holds the certificate, key and CA certificates of a
+// TLS config, as last loaded from their files.
+type certLoader struct {
+	certFile, keyFile, caFile string
+
+	mu   sync.Mutex
+	cert *tls.Certificate
+	pool *x509.CertPool
+}
+
+// load reads the loader's files, replacing the certificates held only
+// if all are read successfully.
+func (l *certLoader) load() error {
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return util.Errorf("unable to load certificate %s and key %s: %v", l.certFile, l.keyFile, err)
+	}
+	caPEM, err := ioutil.ReadFile(l.caFile)
+	if err != nil {
+		return util.Errorf("unable to read CA certificates: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return util.Errorf("no CA certificates found in %s", l.caFile)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cert, l.pool = &cert, pool
+	return nil
+}
+
+// certificate returns the certificate last loaded.
+func (l *certLoader) certificate() *tls.Certificate {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.cert
+}
+
+// caPool returns the CA certificates last loaded.
+func (l *certLoader) caPool() *x509.CertPool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.pool
+}
+
+// LoadTLSConfig returns a TLS config for peers which authenticate
+// each other with certificates signed by a shared certificate
+// authority. certFile and keyFile hold the PEM-encoded certificate
+// and key of this process; caFile holds the certificates of the
+// authority. Servers require clients to present certificates, and
+// clients verify servers' certificates against the host of the
+// address dialed. The files may be reloaded, to rotate certificates,
+// via ReloadTLSConfig.
+func LoadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	l := &certLoader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return l.certificate(), nil
+		},
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return l.certificate(), nil
+		},
+		RootCAs:    l.caPool(),
+		ClientCAs:  l.caPool(),
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		MinVersion: tls.VersionTLS12,
+	}
+	// Servers verify clients against the CA certificates last loaded;
+	// dial does likewise for servers.
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := config.Clone()
+		c.GetConfigForClient = nil
+		c.ClientCAs = l.caPool()
+		return c, nil
+	}
+	tlsMu.Lock()
+	defer tlsMu.Unlock()
+	if tlsLoaders == nil {
+		tlsLoaders = map[*tls.Config]*certLoader{}
+	}
+	tlsLoaders[config] = l
+	return config, nil
+}
+
+// ReloadTLSConfig reloads the certificate, key and CA certificates of
+// the TLS config set via SetTLSConfig from their files, so that they
+// may be rotated without restarting the process. Servers already
+// started and clients subsequently connecting authenticate with the
+// reloaded certificates; established connections are unaffected. If
+// the files can't be loaded, the certificates in use are kept and an
+// error is returned. Returns an error if TLS is disabled or the config
+// wasn't returned by LoadTLSConfig.
+func ReloadTLSConfig() error {
+	tlsMu.Lock()
+	l, ok := tlsLoaders[tlsConfig]
+	tlsMu.Unlock()
+	if !ok {
+		return util.Errorf("no TLS certificates to reload")
+	}
+	return l.load()
+}
+
+// SetTLSConfig sets the TLS config with which servers subsequently
+// started accept connections, and with which clients subsequently
+// connect, including those of the gossip network. Nil disables TLS.
+// All nodes of a cluster must agree on whether TLS is used.
+func SetTLSConfig(config *tls.Config) {
+	tlsMu.Lock()
+	defer tlsMu.Unlock()
+	tlsConfig = config
+}
+
+// getTLSConfig returns the TLS config, or nil if TLS is disabled.
+func getTLSConfig() *tls.Config {
+	tlsMu.Lock()
+	defer tlsMu.Unlock()
+	return tlsConfig
+}
+
+// GetTLSStats returns the counts of TLS handshakes since the process
+// started.
+func GetTLSStats() TLSStats {
+	tlsMu.Lock()
+	defer tlsMu.Unlock()
+	return tlsStats
+}
+
+// recordHandshake counts the outcome of a TLS handshake via count.
+func recordHandshake(count func(stats *TLSStats)) {
+	tlsMu.Lock()
+	defer tlsMu.Unlock()
+	count(&tlsStats)
+}
+
+// NewListener wraps ln to accept only TLS connections if a TLS config
+// is set, so that servers other than RPC servers, such as the HTTP
+// server, require peers to authenticate likewise.
+func NewListener(ln net.Listener) net.Listener {
+	if config := getTLSConfig(); config != nil {
+		return tls.NewListener(ln, config)
+	}
+	return ln
+}
+
+// NewHTTPClient returns an HTTP client which connects over TLS with
+// config, presenting its certificate and verifying servers'
+// certificates against the CA certificates last loaded.
+func NewHTTPClient(config *tls.Config) *http.Client {
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLSConfig(config)}}
+}
+
+// clientTLSConfig returns a copy of config with which clients verify
+// servers against the CA certificates last loaded.
+func clientTLSConfig(config *tls.Config) *tls.Config {
+	tlsMu.Lock()
+	l, ok := tlsLoaders[config]
+	tlsMu.Unlock()
+	config = config.Clone()
+	if ok {
+		config.RootCAs = l.caPool()
+	}
+	return config
+}
+
+// dial connects to addr, over TLS if a TLS config is set, in which
+// case the peer must authenticate before the connection is returned.
+func dial(addr net.Addr) (net.Conn, error) {
+	conn, err := net.Dial(addr.Network(), addr.String())
+	if err != nil {
+		return nil, err
+	}
+	config := getTLSConfig()
+	if config == nil {
+		return conn, nil
+	}
+	config = clientTLSConfig(config)
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil && config.ServerName == "" {
+		config.ServerName = host
+	}
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		recordHandshake(func(stats *TLSStats) { stats.Unverified++ })
+		return nil, util.Errorf("TLS handshake with %s failed: %v", addr, err)
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// handshake completes the TLS handshake of an incoming connection, if
+// it's a TLS connection, returning an error if the peer fails to
+// authenticate.
+func handshake(conn net.Conn) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		recordHandshake(func(stats *TLSStats) { stats.Rejected++ })
+		return err
+	}
+	recordHandshake(func(stats *TLSStats) { stats.Accepted++ })
+	return tlsConn.SetDeadline(time.Time{})
+}
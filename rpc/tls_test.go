@@ -0,0 +1,301 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package rpc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// testCA is a certificate authority issuing certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// newTestCA creates a self-signed certificate authority.
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns the PEM-encoded certificate and key of a node at
+// 127.0.0.1, signed by the authority.
+func (ca *testCA) issue(t *testing.T) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// write writes a node certificate issued by the authority, its key
+// and the authority's certificate to dir.
+func (ca *testCA) write(t *testing.T, dir string) {
+	certPEM, keyPEM := ca.issue(t)
+	files := map[string][]byte{"node.crt": certPEM, "node.key": keyPEM, "ca.crt": ca.pem}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// config writes a node certificate issued by the authority to dir and
+// returns the TLS config loaded from it by LoadTLSConfig.
+func (ca *testCA) config(t *testing.T, dir string) *tls.Config {
+	ca.write(t, dir)
+	config, err := LoadTLSConfig(filepath.Join(dir, "node.crt"), filepath.Join(dir, "node.key"), filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// TestTLS verifies peers presenting certificates signed by the
+// cluster's authority connect over TLS, and that other peers are
+// refused and counted, whether connecting or being connected to.
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rpc-tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "other"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	config := newTestCA(t).config(t, dir)
+	otherConfig := newTestCA(t).config(t, filepath.Join(dir, "other"))
+	defer SetTLSConfig(nil)
+
+	heartbeatInterval = 10 * time.Millisecond
+	SetTLSConfig(config)
+	s := NewServer(util.CreateTestAddr("tcp"))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// A peer of the cluster connects and heartbeats.
+	start := GetTLSStats()
+	c := NewClient(s.Addr(), nil)
+	defer c.Close()
+	select {
+	case <-c.Ready:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected authenticated client to connect")
+	}
+	if stats := GetTLSStats(); stats.Accepted <= start.Accepted {
+		t.Errorf("expected accepted handshake to be counted; got %+v", stats)
+	}
+
+	// A peer presenting a certificate of another authority is refused
+	// by the server, and refuses the server's certificate in turn.
+	start = GetTLSStats()
+	SetTLSConfig(otherConfig)
+	if _, err := dial(s.Addr()); err == nil {
+		t.Error("expected handshake with server of another authority to fail")
+	}
+	if stats := GetTLSStats(); stats.Unverified != start.Unverified+1 {
+		t.Errorf("expected unverified peer to be counted; got %+v", stats)
+	}
+
+	// A peer trusting the server's authority but presenting a
+	// certificate of another is refused by the server.
+	otherConfig.RootCAs = config.RootCAs
+	conn, err := tls.Dial("tcp", s.Addr().String(), otherConfig)
+	if err == nil {
+		// The server may refuse the certificate only once the client
+		// completes its side of the handshake.
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	if err == nil {
+		t.Error("expected server to refuse certificate of another authority")
+	}
+	if err := util.IsTrueWithin(func() bool {
+		return GetTLSStats().Rejected >= start.Rejected+2
+	}, 500*time.Millisecond); err != nil {
+		t.Errorf("expected rejected peers to be counted: %v; got %+v", err, GetTLSStats())
+	}
+
+	// A peer not using TLS is refused.
+	start = GetTLSStats()
+	SetTLSConfig(nil)
+	plain, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain.Write([]byte("not a handshake"))
+	if _, err := plain.Read(make([]byte, 1)); err == nil {
+		t.Error("expected server to close connection of peer not using TLS")
+	}
+	plain.Close()
+	if err := util.IsTrueWithin(func() bool {
+		return GetTLSStats().Rejected == start.Rejected+1
+	}, 500*time.Millisecond); err != nil {
+		t.Errorf("expected peer not using TLS to be counted: %v; got %+v", err, GetTLSStats())
+	}
+}
+
+// TestTLSReload verifies certificates are rotated by reloading their
+// files, and that files which fail to load leave those in use.
+func TestTLSReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rpc-tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ReloadTLSConfig(); err == nil {
+		t.Error("expected reload to fail with TLS disabled")
+	}
+	oldCA, newCA := newTestCA(t), newTestCA(t)
+	defer SetTLSConfig(nil)
+	SetTLSConfig(oldCA.config(t, dir))
+	s := NewServer(util.CreateTestAddr("tcp"))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Rotate the certificates of both server and client to those of a
+	// new authority; the running server accepts the new client.
+	newCA.write(t, dir)
+	if err := ReloadTLSConfig(); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial(s.Addr())
+	if err != nil {
+		t.Fatalf("expected handshake with rotated certificates to succeed: %v", err)
+	}
+	conn.Close()
+
+	// Files which fail to load leave the rotated certificates in use.
+	if err := ioutil.WriteFile(filepath.Join(dir, "ca.crt"), []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReloadTLSConfig(); err == nil {
+		t.Error("expected reload of invalid CA certificates to fail")
+	}
+	if conn, err = dial(s.Addr()); err != nil {
+		t.Fatalf("expected certificates in use to be kept: %v", err)
+	}
+	conn.Close()
+
+	// A peer presenting a certificate of the old authority is refused.
+	oldDir := filepath.Join(dir, "old")
+	if err := os.Mkdir(oldDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	SetTLSConfig(oldCA.config(t, oldDir))
+	if _, err := dial(s.Addr()); err == nil {
+		t.Error("expected handshake with certificate of old authority to fail")
+	}
+}
+
+// TestTLSHTTP verifies HTTP servers listening via NewListener serve
+// clients created by NewHTTPClient, and refuse clients not using TLS.
+func TestTLSHTTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rpc-tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := newTestCA(t).config(t, dir)
+	defer SetTLSConfig(nil)
+
+	SetTLSConfig(config)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln = NewListener(ln)
+	defer ln.Close()
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	resp, err := NewHTTPClient(config).Get("https://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(b) != "ok" {
+		t.Errorf("expected authenticated client to be served; got %q, %v", b, err)
+	}
+
+	if resp, err := http.Get("http://" + ln.Addr().String()); err == nil {
+		if resp.StatusCode == http.StatusOK {
+			t.Error("expected server to refuse client not using TLS")
+		}
+		resp.Body.Close()
+	}
+}
@@ -18,13 +18,17 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/rpc"
+	"github.com/cockroachdb/cockroach/storage"
 )
 
 const (
@@ -33,6 +37,38 @@ const (
 	adminKeyPrefix = "/_admin/"
 	// zoneKeyPrefix is the prefix for zone configuration changes.
 	zoneKeyPrefix = adminKeyPrefix + "zones"
+	// freezesKeyPrefix is the prefix for freezes of key spans.
+	freezesKeyPrefix = adminKeyPrefix + "freezes"
+	// statsKeyPrefix is the endpoint for verifying range usage stats.
+	statsKeyPrefix = adminKeyPrefix + "stats"
+	// debugScanKeyPrefix is the endpoint for raw scans of local stores.
+	debugScanKeyPrefix = adminKeyPrefix + "debug/scan"
+	// jobsKeyPrefix is the endpoint for listing and managing jobs.
+	jobsKeyPrefix = adminKeyPrefix + "jobs"
+	// cachesKeyPrefix is the endpoint for inspecting and resizing the
+	// caches of local stores.
+	cachesKeyPrefix = adminKeyPrefix + "caches"
+	// slosKeyPrefix is the endpoint for the attainment of latency
+	// objectives.
+	slosKeyPrefix = adminKeyPrefix + "slos"
+	// usageKeyPrefix is the endpoint for usage reports by account.
+	usageKeyPrefix = adminKeyPrefix + "usage"
+	// writesKeyPrefix is the endpoint for sampled writes by key prefix.
+	writesKeyPrefix = adminKeyPrefix + "writes"
+	// clientsKeyPrefix is the endpoint for request stats by client.
+	clientsKeyPrefix = adminKeyPrefix + "clients"
+	// sendNextKeyPrefix is the endpoint for counts of speculative RPC
+	// sends by call class.
+	sendNextKeyPrefix = adminKeyPrefix + "sendnext"
+	// tlsKeyPrefix is the endpoint for counts of TLS handshakes,
+	// including those refused as peers failed to authenticate.
+	tlsKeyPrefix = adminKeyPrefix + "tls"
+	// nodesKeyPrefix is the endpoint for the members of the cluster,
+	// as known via gossip.
+	nodesKeyPrefix = adminKeyPrefix + "nodes"
+	// gossipKeyPrefix is the endpoint for the metrics of the local
+	// gossip node.
+	gossipKeyPrefix = adminKeyPrefix + "gossip"
 )
 
 // A actionHandler is an interface which provides Get, Put & Delete
@@ -46,16 +82,21 @@ type actionHandler interface {
 // A adminServer provides a RESTful HTTP API to administration of
 // the cockroach cluster.
 type adminServer struct {
-	kvDB kv.DB // Key-value database client
-	zone *zoneHandler
+	kvDB   kv.DB // Key-value database client
+	node   *Node // Local node; may be nil
+	zone   *zoneHandler
+	freeze *freezeHandler
 }
 
 // newAdminServer allocates and returns a new REST server for
-// administrative APIs.
-func newAdminServer(kvDB kv.DB) *adminServer {
+// administrative APIs. Endpoints which operate on local stores, such
+// as stats verification, require node.
+func newAdminServer(kvDB kv.DB, node *Node) *adminServer {
 	return &adminServer{
-		kvDB: kvDB,
-		zone: &zoneHandler{kvDB: kvDB},
+		kvDB:   kvDB,
+		node:   node,
+		zone:   &zoneHandler{kvDB: kvDB},
+		freeze: &freezeHandler{kvDB: kvDB},
 	}
 }
 
@@ -69,16 +110,429 @@ func (s *adminServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
 func (s *adminServer) handleZoneAction(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		s.handleGetAction(s.zone, w, r)
+		s.handleGetAction(s.zone, zoneKeyPrefix, w, r)
 	case "PUT", "POST":
-		s.handlePutAction(s.zone, w, r)
+		s.handlePutAction(s.zone, zoneKeyPrefix, w, r)
 	case "DELETE":
-		s.handleDeleteAction(s.zone, w, r)
+		s.handleDeleteAction(s.zone, zoneKeyPrefix, w, r)
 	default:
 		http.Error(w, "Bad Request", http.StatusBadRequest)
 	}
 }
 
+// handleFreezeAction handles actions for freezes of key spans by
+// method.
+func (s *adminServer) handleFreezeAction(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		s.handleGetAction(s.freeze, freezesKeyPrefix, w, r)
+	case "PUT", "POST":
+		s.handlePutAction(s.freeze, freezesKeyPrefix, w, r)
+	case "DELETE":
+		s.handleDeleteAction(s.freeze, freezesKeyPrefix, w, r)
+	default:
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+	}
+}
+
+// handleStatsAction recomputes usage stats for the local node's
+// ranges overlapping the span given by the "start" and "end" query
+// parameters, which default to the entire key space. GET reports
+// drift between maintained and recomputed stats; POST additionally
+// reconciles it. The drift report is returned as JSON.
+func (s *adminServer) handleStatsAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if s.node == nil {
+		http.Error(w, "no local node", http.StatusNotFound)
+		return
+	}
+	start, end := storage.KeyMin, storage.KeyMax
+	if v := r.URL.Query().Get("start"); v != "" {
+		start = storage.Key(v)
+	}
+	if v := r.URL.Query().Get("end"); v != "" {
+		end = storage.Key(v)
+	}
+	drift, err := s.node.VerifyUsage(start, end, r.Method == "POST")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(drift)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// handleCachesAction reports and adjusts the caches of the local
+// node's stores. GET returns the size and hit rate of each store's
+// row and block caches as JSON, keyed by store ID. POST resizes them
+// according to the "row_cache_size" and "block_cache_size" query
+// parameters, for the store given by the "store" query parameter or
+// for all local stores if it's absent; omitted sizes are unchanged.
+func (s *adminServer) handleCachesAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if s.node == nil {
+		http.Error(w, "no local node", http.StatusNotFound)
+		return
+	}
+	if r.Method == "POST" {
+		q := r.URL.Query()
+		var storeID int64
+		rowCacheSize, blockCacheSize := int64(-1), int64(-1)
+		var err error
+		if v := q.Get("store"); v != "" {
+			if storeID, err = strconv.ParseInt(v, 10, 32); err != nil {
+				http.Error(w, "invalid store: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("row_cache_size"); v != "" {
+			if rowCacheSize, err = strconv.ParseInt(v, 10, 64); err != nil || rowCacheSize < 0 {
+				http.Error(w, fmt.Sprintf("invalid row_cache_size %q", v), http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("block_cache_size"); v != "" {
+			if blockCacheSize, err = strconv.ParseInt(v, 10, 64); err != nil || blockCacheSize <= 0 {
+				http.Error(w, fmt.Sprintf("invalid block_cache_size %q", v), http.StatusBadRequest)
+				return
+			}
+		}
+		if err = s.node.SetCacheSizes(int32(storeID), rowCacheSize, blockCacheSize); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	stats, err := s.node.CacheStats()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(stats)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// handleSLOsAction returns the attainment of the local node's latency
+// objectives, with recent violation and recovery events, as JSON.
+func (s *adminServer) handleSLOsAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if s.node == nil {
+		http.Error(w, "no local node", http.StatusNotFound)
+		return
+	}
+	var result struct {
+		SLOs   []SLOStatus
+		Events []SLOEvent
+	}
+	result.SLOs, result.Events = s.node.SLOStatuses()
+	b, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// handleUsageAction returns a usage report by account as JSON. By
+// default, the report sums the latest usage rollups of all nodes and
+// includes each node's rollup. If the "local" query parameter is
+// "true", the current usage of ranges led by the local node is
+// returned instead.
+func (s *adminServer) handleUsageAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	var result interface{}
+	if r.URL.Query().Get("local") == "true" {
+		if s.node == nil {
+			http.Error(w, "no local node", http.StatusNotFound)
+			return
+		}
+		result = s.node.UsageReport()
+	} else {
+		usage, err := kv.GetClusterUsage(s.kvDB)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result = usage
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// handleWritesAction returns the recent writes sampled by the local
+// node for each sampled key prefix as JSON. POST begins sampling the
+// prefix given by the "prefix" query parameter, and DELETE ends it,
+// discarding its samples.
+func (s *adminServer) handleWritesAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" && r.Method != "DELETE" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if s.node == nil {
+		http.Error(w, "no local node", http.StatusNotFound)
+		return
+	}
+	if r.Method != "GET" {
+		prefix := r.URL.Query().Get("prefix")
+		if prefix == "" {
+			http.Error(w, "prefix required", http.StatusBadRequest)
+			return
+		}
+		if r.Method == "POST" {
+			s.node.StartWriteSampling(storage.Key(prefix))
+		} else {
+			s.node.StopWriteSampling(storage.Key(prefix))
+		}
+	}
+	b, err := json.Marshal(s.node.WriteSamples())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// handleClientsAction returns the stats of requests executed by the
+// local node, by client, as JSON.
+func (s *adminServer) handleClientsAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if s.node == nil {
+		http.Error(w, "no local node", http.StatusNotFound)
+		return
+	}
+	b, err := json.Marshal(s.node.ClientStats())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// handleSendNextAction returns the counts of RPCs sent speculatively
+// to other replicas by this process, and of those which won, by call
+// class, as JSON.
+func (s *adminServer) handleSendNextAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	b, err := json.Marshal(rpc.GetSendNextStats())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// handleTLSAction returns the counts of TLS handshakes of RPC
+// connections accepted and refused by this process, as JSON.
+func (s *adminServer) handleTLSAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	b, err := json.Marshal(rpc.GetTLSStats())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// handleNodesAction returns the nodes of the cluster known to the
+// local node via gossip, with their addresses, topology and the times
+// they were last heard from, as JSON.
+func (s *adminServer) handleNodesAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if s.node == nil {
+		http.Error(w, "no local node", http.StatusNotFound)
+		return
+	}
+	b, err := json.Marshal(s.node.gossip.Nodes())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// handleGossipAction returns the metrics of the local node's gossip
+// instance as JSON: counts of infos and bytes exchanged and of
+// connections, and the hops from their sources and staleness of
+// infos, for diagnosing slow gossip convergence.
+func (s *adminServer) handleGossipAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if s.node == nil {
+		http.Error(w, "no local node", http.StatusNotFound)
+		return
+	}
+	b, err := json.Marshal(s.node.gossip.Metrics())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// handleDebugScanAction returns the raw contents of a local store as
+// JSON, via Node.InternalDebugScan. The "store" and "range" query
+// parameters identify the replica; "start", "end" and "max" specify
+// the span and row limit, which default to the entire key space and
+// maxDebugScanResults.
+func (s *adminServer) handleDebugScanAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if s.node == nil {
+		http.Error(w, "no local node", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	storeID, err := strconv.ParseInt(q.Get("store"), 10, 32)
+	if err != nil {
+		http.Error(w, "invalid store: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	rangeID, err := strconv.ParseInt(q.Get("range"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid range: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	args := &storage.InternalDebugScanRequest{
+		RequestHeader: storage.RequestHeader{
+			Replica: storage.Replica{NodeID: s.node.Attributes.NodeID, StoreID: int32(storeID), RangeID: rangeID},
+		},
+		StartKey: storage.KeyMin,
+		EndKey:   storage.KeyMax,
+	}
+	if v := q.Get("start"); v != "" {
+		args.StartKey = storage.Key(v)
+	}
+	if v := q.Get("end"); v != "" {
+		args.EndKey = storage.Key(v)
+	}
+	if v := q.Get("max"); v != "" {
+		if args.MaxResults, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(w, "invalid max: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	reply := &storage.InternalDebugScanResponse{}
+	if err = s.node.InternalDebugScan(args, reply); err == nil {
+		err = reply.Error
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(reply.Rows)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// handleJobsAction lists and manages long-running jobs. GET of the
+// endpoint returns all jobs and GET of "/<id>" a single job, as JSON.
+// POST of "/<id>/pause", "/<id>/resume" or "/<id>/cancel" changes the
+// state of the job.
+func (s *adminServer) handleJobsAction(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, jobsKeyPrefix), "/"), "/")
+	var result interface{}
+	var err error
+	switch {
+	case r.Method == "GET" && parts[0] == "":
+		result, err = kv.ListJobs(s.kvDB)
+	case r.Method == "GET" && len(parts) == 1:
+		var id int64
+		if id, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+			http.Error(w, "invalid job ID: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err = kv.GetJob(s.kvDB, id)
+	case r.Method == "POST" && len(parts) == 2:
+		var id int64
+		if id, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+			http.Error(w, "invalid job ID: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch parts[1] {
+		case "pause":
+			err = kv.PauseJob(s.kvDB, id)
+		case "resume":
+			err = kv.ResumeJob(s.kvDB, id)
+		case "cancel":
+			err = kv.CancelJob(s.kvDB, id)
+		default:
+			http.Error(w, "unknown job action "+parts[1], http.StatusBadRequest)
+			return
+		}
+		if err == nil {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	default:
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
 func unescapePath(path, prefix string) (string, error) {
 	result, err := url.QueryUnescape(strings.TrimPrefix(path, prefix))
 	if err != nil {
@@ -87,8 +541,8 @@ func unescapePath(path, prefix string) (string, error) {
 	return result, nil
 }
 
-func (s *adminServer) handlePutAction(handler actionHandler, w http.ResponseWriter, r *http.Request) {
-	path, err := unescapePath(r.URL.Path, zoneKeyPrefix)
+func (s *adminServer) handlePutAction(handler actionHandler, prefix string, w http.ResponseWriter, r *http.Request) {
+	path, err := unescapePath(r.URL.Path, prefix)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -106,8 +560,8 @@ func (s *adminServer) handlePutAction(handler actionHandler, w http.ResponseWrit
 	w.WriteHeader(http.StatusOK)
 }
 
-func (s *adminServer) handleGetAction(handler actionHandler, w http.ResponseWriter, r *http.Request) {
-	path, err := unescapePath(r.URL.Path, zoneKeyPrefix)
+func (s *adminServer) handleGetAction(handler actionHandler, prefix string, w http.ResponseWriter, r *http.Request) {
+	path, err := unescapePath(r.URL.Path, prefix)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -121,8 +575,8 @@ func (s *adminServer) handleGetAction(handler actionHandler, w http.ResponseWrit
 	fmt.Fprintf(w, "%s", string(b))
 }
 
-func (s *adminServer) handleDeleteAction(handler actionHandler, w http.ResponseWriter, r *http.Request) {
-	path, err := unescapePath(r.URL.Path, zoneKeyPrefix)
+func (s *adminServer) handleDeleteAction(handler actionHandler, prefix string, w http.ResponseWriter, r *http.Request) {
+	path, err := unescapePath(r.URL.Path, prefix)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -36,7 +36,7 @@ func startAdminServer() *httptest.Server {
 	if err != nil {
 		glog.Fatal(err)
 	}
-	admin := newAdminServer(db)
+	admin := newAdminServer(db, nil)
 	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		admin.handleZoneAction(w, r)
 	}))
@@ -0,0 +1,181 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+var (
+	maxInflightRequests = flag.Int("max_inflight_requests", 1024, "maximum number of "+
+		"requests a node executes concurrently; additional requests fail with a server busy error")
+	maxInflightBytes = flag.Int64("max_inflight_bytes", 256<<20, "maximum bytes of memory "+
+		"held by requests a node executes concurrently; additional requests fail with a "+
+		"server busy error")
+)
+
+const (
+	// requestOverhead is the memory attributed to every request, in
+	// addition to the size of its keys and values.
+	requestOverhead = 1 << 10
+	// scanRowBytes is the estimated size of each row a scan may
+	// return, used to reserve memory for scan buffers.
+	scanRowBytes = 256
+	// unboundedScanBytes is the memory reserved for scans which limit
+	// neither their results nor their bytes, and so may return an
+	// entire range: the size beyond which ranges are usually split.
+	unboundedScanBytes = 64 << 20
+	// minRetryAfter and maxRetryAfter bound the retry-after hints of
+	// rejected requests.
+	minRetryAfter = 10 * time.Millisecond
+	maxRetryAfter = 5 * time.Second
+	// releaseIntervalWeight is the weight of each new interval between
+	// releases in the moving average of the intervals.
+	releaseIntervalWeight = 0.2
+)
+
+// A requestBudget limits the number of requests a node executes
+// concurrently and the memory held by them. Requests which would
+// exceed either limit are rejected with a ServerBusyError rather than
+// queued, so that clients back off instead of piling up work on an
+// overloaded node.
+//
+// Rejections carry a hint of when to retry, estimated from the moving
+// average of the interval between releases: the nth request rejected
+// since the last release is told to retry after n intervals. Rejected
+// clients thereby return about as fast as requests complete, rather
+// than all at once when their backoffs happen to expire.
+type requestBudget struct {
+	mu              sync.Mutex
+	maxRequests     int           // Maximum concurrent requests
+	maxBytes        int64         // Maximum memory held by concurrent requests
+	requests        int           // Requests currently executing
+	bytes           int64         // Memory reserved by executing requests
+	rejected        int64         // Requests rejected since creation
+	waiting         int           // Rejected requests awaiting a release
+	lastRelease     time.Time     // Time of the most recent release
+	releaseInterval time.Duration // Moving average of the interval between releases
+}
+
+// newRequestBudget returns a budget allowing up to maxRequests
+// concurrent requests holding up to maxBytes in total.
+func newRequestBudget(maxRequests int, maxBytes int64) *requestBudget {
+	return &requestBudget{
+		maxRequests: maxRequests,
+		maxBytes:    maxBytes,
+	}
+}
+
+// acquire reserves bytes of memory for a request. Reservations larger
+// than the entire budget are reduced to the budget, allowing such a
+// request to execute alone. Returns a ServerBusyError with a
+// retry-after hint if the request can't be admitted; otherwise, release must be invoked with the
+// returned reservation once the request completes.
+func (b *requestBudget) acquire(bytes int64) (int64, error) {
+	if bytes > b.maxBytes {
+		bytes = b.maxBytes
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.requests >= b.maxRequests || b.bytes+bytes > b.maxBytes {
+		b.rejected++
+		b.waiting++
+		return 0, &storage.ServerBusyError{
+			Message:    fmt.Sprintf("node busy: %d requests holding %d bytes in flight", b.requests, b.bytes),
+			RetryAfter: b.retryAfter(),
+		}
+	}
+	b.requests++
+	b.bytes += bytes
+	return bytes, nil
+}
+
+// release returns a reservation made by acquire to the budget.
+func (b *requestBudget) release(bytes int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.requests--
+	b.bytes -= bytes
+	now := time.Now()
+	if !b.lastRelease.IsZero() {
+		interval := float64(now.Sub(b.lastRelease))
+		b.releaseInterval = time.Duration(releaseIntervalWeight*interval +
+			(1-releaseIntervalWeight)*float64(b.releaseInterval))
+	}
+	b.lastRelease = now
+	if b.waiting > 0 {
+		b.waiting--
+	}
+}
+
+// retryAfter returns the hint of when the most recently rejected
+// request should be retried. Requires b.mu be held.
+func (b *requestBudget) retryAfter() time.Duration {
+	d := time.Duration(b.waiting) * b.releaseInterval
+	if d < minRetryAfter {
+		return minRetryAfter
+	}
+	if d > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return d
+}
+
+// requestBytes estimates the memory held while executing the request
+// args: its keys and values when decoded and, for scans, the buffer
+// of results, which for unbounded scans is assumed to hold an entire
+// range.
+func requestBytes(args interface{}) int64 {
+	size := int64(requestOverhead)
+	switch t := args.(type) {
+	case *storage.PutRequest:
+		size += int64(len(t.Key) + len(t.Value.Bytes))
+		if t.ExpValue != nil {
+			size += int64(len(t.ExpValue.Bytes))
+		}
+	case *storage.AppendRequest:
+		size += int64(len(t.Key) + len(t.Value.Bytes))
+	case *storage.ScanRequest:
+		rows := int64(unboundedScanBytes)
+		if t.MaxResults > 0 {
+			rows = t.MaxResults * scanRowBytes
+		}
+		if t.MaxBytes > 0 && t.MaxBytes < rows {
+			rows = t.MaxBytes
+		}
+		size += int64(len(t.StartKey)+len(t.EndKey)) + rows
+	case *storage.GetTSBlockRequest:
+		keys := t.MaxKeys
+		if keys <= 0 || keys > storage.MaxTSBlockKeys {
+			keys = storage.MaxTSBlockKeys
+		}
+		size += int64(len(t.StartKey)+len(t.EndKey)) + keys*scanRowBytes
+	case *storage.InternalDebugScanRequest:
+		size += int64(len(t.StartKey)+len(t.EndKey)) + maxDebugScanResults*scanRowBytes
+	case *storage.InternalBulkWriteRequest:
+		for _, row := range t.Rows {
+			size += int64(len(row.Key) + len(row.Value.Bytes))
+		}
+	case *storage.EnqueueMessageRequest:
+		size += int64(len(t.Inbox) + len(t.Message.Bytes))
+	}
+	return size
+}
@@ -0,0 +1,146 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// TestRequestBudget verifies requests are rejected once either the
+// request or the memory limit is reached.
+func TestRequestBudget(t *testing.T) {
+	b := newRequestBudget(2, 100)
+	r1, err := b.acquire(60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.acquire(50); err == nil {
+		t.Error("expected rejection over memory budget")
+	} else if _, ok := err.(*storage.ServerBusyError); !ok {
+		t.Errorf("expected server busy error; got %v", err)
+	}
+	r2, err := b.acquire(40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.acquire(0); err == nil {
+		t.Error("expected rejection over request limit")
+	}
+	b.release(r1)
+	b.release(r2)
+	// Oversized requests are admitted when the node is otherwise idle.
+	r3, err := b.acquire(1000)
+	if err != nil || r3 != 100 {
+		t.Errorf("expected oversized request reduced to budget; got %d, %v", r3, err)
+	}
+	b.release(r3)
+	if b.requests != 0 || b.bytes != 0 || b.rejected != 2 {
+		t.Errorf("unexpected budget state: %+v", b)
+	}
+}
+
+// TestRequestBudgetRetryAfter verifies rejections are spread over
+// successive intervals between releases, within bounds.
+func TestRequestBudgetRetryAfter(t *testing.T) {
+	b := newRequestBudget(1, 100)
+	r, err := b.acquire(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retryAfter := func() time.Duration {
+		_, err := b.acquire(0)
+		busyErr, ok := err.(*storage.ServerBusyError)
+		if !ok {
+			t.Fatalf("expected server busy error; got %v", err)
+		}
+		return busyErr.RetryAfter
+	}
+	// Without a history of releases, the minimum is hinted.
+	if d := retryAfter(); d != minRetryAfter {
+		t.Errorf("expected %s; got %s", minRetryAfter, d)
+	}
+	b.release(r)
+	b.releaseInterval = 100 * time.Millisecond
+	if _, err := b.acquire(0); err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond} {
+		if d := retryAfter(); d != expected {
+			t.Errorf("%d: expected %s; got %s", i, expected, d)
+		}
+	}
+	b.releaseInterval = time.Minute
+	if d := retryAfter(); d != maxRetryAfter {
+		t.Errorf("expected %s; got %s", maxRetryAfter, d)
+	}
+}
+
+// TestNodeRejectsWhenBusy verifies a node over budget fails requests
+// with a retryable ServerBusyError set in the reply.
+func TestNodeRejectsWhenBusy(t *testing.T) {
+	n := NewNode(nil, nil)
+	n.budget = newRequestBudget(1, 1<<20)
+	reserved, err := n.budget.acquire(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := &storage.ScanResponse{}
+	if err := n.Scan(&storage.ScanRequest{MaxResults: 10}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if retryErr, ok := reply.Error.(util.Retryable); !ok || !retryErr.CanRetry() {
+		t.Errorf("expected retryable server busy error; got %v", reply.Error)
+	}
+	n.budget.release(reserved)
+	// Once admitted, the missing store is reported as usual.
+	if err := n.Scan(&storage.ScanRequest{MaxResults: 10}, &storage.ScanResponse{}); err == nil {
+		t.Error("expected error scanning unknown store")
+	}
+}
+
+// TestNodeBudgetsUnboundedScans verifies a scan which limits neither
+// its results nor its bytes reserves memory for an entire range, so
+// that it's held back by the budget while smaller scans are admitted.
+func TestNodeBudgetsUnboundedScans(t *testing.T) {
+	if b := requestBytes(&storage.ScanRequest{}); b < unboundedScanBytes {
+		t.Errorf("expected unbounded scan to reserve at least %d bytes; got %d", unboundedScanBytes, b)
+	}
+	if b := requestBytes(&storage.ScanRequest{MaxBytes: 1 << 10}); b != requestOverhead+1<<10 {
+		t.Errorf("expected scan limited by bytes to reserve its limit; got %d", b)
+	}
+	n := NewNode(nil, nil)
+	n.budget = newRequestBudget(10, 1<<20)
+	reserved, err := n.budget.acquire(1 << 19)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.budget.release(reserved)
+	reply := &storage.ScanResponse{}
+	if err := n.Scan(&storage.ScanRequest{}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reply.Error.(*storage.ServerBusyError); !ok {
+		t.Errorf("expected unbounded scan to be held back; got %v", reply.Error)
+	}
+	// Once admitted, the missing store is reported as usual.
+	if err := n.Scan(&storage.ScanRequest{MaxResults: 10}, &storage.ScanResponse{}); err == nil {
+		t.Error("expected bounded scan to be admitted")
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// unidentifiedClient is the name under which requests which don't
+// identify their client are tracked.
+const unidentifiedClient = "unidentified"
+
+// ClientStats summarizes the requests a node has executed on behalf
+// of a client, as identified by RequestHeader.Client.
+type ClientStats struct {
+	Client       string
+	Requests     int64 // Requests executed
+	Writes       int64 // Successful writes
+	BytesWritten int64 // Size of the keys and values written
+	LatencyNanos int64 // Total latency of requests executed
+}
+
+// A clientTracker accumulates ClientStats by client, so that
+// operators of clusters shared by many services can attribute load
+// to the services generating it.
+type clientTracker struct {
+	mu      sync.Mutex
+	clients map[string]*ClientStats
+}
+
+// newClientTracker returns an empty client tracker.
+func newClientTracker() *clientTracker {
+	return &clientTracker{clients: map[string]*ClientStats{}}
+}
+
+// get returns the stats of the client, creating them if necessary.
+// Requires mu.
+func (ct *clientTracker) get(client string) *ClientStats {
+	if client == "" {
+		client = unidentifiedClient
+	}
+	cs, ok := ct.clients[client]
+	if !ok {
+		cs = &ClientStats{Client: client}
+		ct.clients[client] = cs
+	}
+	return cs
+}
+
+// recordRequest records a request executed on behalf of client with
+// the given latency.
+func (ct *clientTracker) recordRequest(client string, latency time.Duration) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	cs := ct.get(client)
+	cs.Requests++
+	cs.LatencyNanos += latency.Nanoseconds()
+}
+
+// recordWrite records the successful write of the request args on
+// behalf of client.
+func (ct *clientTracker) recordWrite(client string, args interface{}) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	cs := ct.get(client)
+	cs.Writes++
+	for _, kv := range writtenKeys(args) {
+		cs.BytesWritten += int64(len(kv.Key) + len(kv.Value.Bytes))
+	}
+}
+
+// stats returns the stats of each client, sorted by client.
+func (ct *clientTracker) stats() []ClientStats {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	result := make([]ClientStats, 0, len(ct.clients))
+	for _, cs := range ct.clients {
+		result = append(result, *cs)
+	}
+	sort.Sort(clientStatsByClient(result))
+	return result
+}
+
+// clientStatsByClient sorts ClientStats by client.
+type clientStatsByClient []ClientStats
+
+func (cs clientStatsByClient) Len() int           { return len(cs) }
+func (cs clientStatsByClient) Swap(i, j int)      { cs[i], cs[j] = cs[j], cs[i] }
+func (cs clientStatsByClient) Less(i, j int) bool { return cs[i].Client < cs[j].Client }
+
+// ClientStats returns the stats of the requests the node has
+// executed, by client.
+func (n *Node) ClientStats() []ClientStats {
+	return n.clients.stats()
+}
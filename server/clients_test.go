@@ -0,0 +1,85 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// TestClientTracker verifies requests and writes are accumulated by
+// client, with unidentified clients tracked together.
+func TestClientTracker(t *testing.T) {
+	ct := newClientTracker()
+	ct.recordRequest("svc/1.0", 2*time.Millisecond)
+	ct.recordRequest("svc/1.0", 3*time.Millisecond)
+	ct.recordWrite("svc/1.0", &storage.PutRequest{Key: storage.Key("a"), Value: storage.Value{Bytes: []byte("value")}})
+	ct.recordRequest("", time.Millisecond)
+
+	stats := ct.stats()
+	if len(stats) != 2 {
+		t.Fatalf("expected stats of two clients; got %+v", stats)
+	}
+	expected := ClientStats{Client: "svc/1.0", Requests: 2, Writes: 1, BytesWritten: 6, LatencyNanos: int64(5 * time.Millisecond)}
+	if stats[0] != expected {
+		t.Errorf("expected %+v; got %+v", expected, stats[0])
+	}
+	if stats[1].Client != unidentifiedClient || stats[1].Requests != 1 {
+		t.Errorf("expected one unidentified request; got %+v", stats[1])
+	}
+}
+
+// TestNodeClientStats verifies a node attributes the requests it
+// executes, and the writes it samples, to their clients.
+func TestNodeClientStats(t *testing.T) {
+	*writeSampleRate = 1
+	defer func() { *writeSampleRate = 0.01 }()
+	engine := storage.NewInMem(1 << 20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	addr := util.CreateTestAddr("tcp")
+	server, node := createTestNode(addr, []storage.Engine{engine}, addr, t)
+	defer server.Close()
+
+	node.StartWriteSampling(storage.Key("a"))
+	pr := <-node.kvDB.Put(&storage.PutRequest{
+		RequestHeader: storage.RequestHeader{Client: "svc/1.0"},
+		Key:           storage.Key("a"),
+		Value:         storage.Value{Bytes: []byte("value")},
+	})
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	var found bool
+	for _, cs := range node.ClientStats() {
+		if cs.Client == "svc/1.0" {
+			found = true
+			if cs.Requests != 1 || cs.Writes != 1 || cs.BytesWritten != 6 {
+				t.Errorf("unexpected stats %+v", cs)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("expected stats of client svc/1.0; got %+v", node.ClientStats())
+	}
+	if samples := node.WriteSamples(); len(samples) != 1 || len(samples[0].Samples) != 1 || samples[0].Samples[0].Client != "svc/1.0" {
+		t.Errorf("expected sampled write attributed to svc/1.0; got %+v", samples)
+	}
+}
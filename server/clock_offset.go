@@ -0,0 +1,44 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"flag"
+	"time"
+
+	"github.com/cockroachdb/cockroach/rpc"
+	"github.com/golang/glog"
+)
+
+var clockOffsetCheckInterval = flag.Duration("clock_offset_check_interval", 10*time.Second, "interval "+
+	"at which the clock offsets to other nodes, measured by RPC heartbeats, are checked against the "+
+	"maximum clock offset; 0 disables checking")
+
+// checkClockOffsets logs an error if the local clock is offset from
+// those of most other nodes by more than the clock's maximum offset,
+// and a warning for each other node whose clock certainly is.
+func (n *Node) checkClockOffsets() {
+	maxOffset := n.clock.MaxOffset()
+	for addr, offset := range rpc.RemoteOffsets() {
+		if offset.Exceeds(maxOffset) {
+			glog.Warningf("clock of node at %s offset by %s (+/- %s); maximum offset is %s",
+				addr, offset.Offset, offset.Uncertainty, maxOffset)
+		}
+	}
+	if err := rpc.CheckRemoteOffsets(maxOffset); err != nil {
+		glog.Errorf("local clock presumed faulty: %v", err)
+	}
+}
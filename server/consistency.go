@@ -0,0 +1,174 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"bytes"
+	"flag"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/golang/glog"
+)
+
+var (
+	consistencyCheckInterval = flag.Duration("consistency_check_interval", 10*time.Minute, "interval "+
+		"at which the replicas of ranges led by this node's stores are checksummed and compared; "+
+		"0 disables consistency checking")
+	quarantineDivergentReplicas = flag.Bool("quarantine_divergent_replicas", false, "take replicas "+
+		"whose checksum disagrees with that of a majority of their range's replicas offline for "+
+		"inspection, leaving their data in place")
+)
+
+// checksumRetryOptions bound the wait for a replica to execute the
+// command computing its checksum before the checksum is collected.
+var checksumRetryOptions = util.RetryOptions{
+	Tag:         "collect range checksum",
+	Backoff:     50 * time.Millisecond,
+	MaxBackoff:  1 * time.Second,
+	Constant:    2,
+	MaxAttempts: 10,
+}
+
+// A Divergence is a replica whose checksum disagrees with that of
+// most of its range's replicas or, absent a majority, with that of
+// the range's leader.
+type Divergence struct {
+	RangeID  int64
+	Replica  storage.Replica
+	Checksum []byte
+	Expected []byte
+	Majority bool // A majority of replicas agree on Expected
+}
+
+// checkConsistency checks each range selected by
+// Store.ConsistencyCandidates, logging divergent replicas and, with
+// --quarantine_divergent_replicas, quarantining those outvoted by a
+// majority of their range's replicas.
+func (n *Node) checkConsistency() {
+	stores := n.stores()
+	for _, store := range stores {
+		for _, rangeID := range store.ConsistencyCandidates() {
+			divergences, err := n.checkRangeConsistency(store, rangeID)
+			if err != nil {
+				glog.Warningf("unable to check consistency of range %d on store %s: %v", rangeID, store, err)
+				continue
+			}
+			for _, d := range divergences {
+				glog.Errorf("range %d: replica on node %d, store %d diverged; checksum %x, expected %x",
+					d.RangeID, d.Replica.NodeID, d.Replica.StoreID, d.Checksum, d.Expected)
+				if !*quarantineDivergentReplicas || !d.Majority {
+					continue
+				}
+				if err := n.quarantineReplica(d.Replica); err != nil {
+					glog.Errorf("range %d: failed to quarantine replica on node %d, store %d: %v",
+						d.RangeID, d.Replica.NodeID, d.Replica.StoreID, err)
+				}
+			}
+		}
+	}
+}
+
+// checkRangeConsistency has each replica of the range with the
+// specified ID, which must be led by store, compute a checksum of its
+// data and returns the replicas whose checksums diverge. Replicas
+// whose checksums can't be collected are skipped.
+func (n *Node) checkRangeConsistency(store *storage.Store, rangeID int64) ([]Divergence, error) {
+	rng, err := store.GetRange(rangeID)
+	if err != nil {
+		return nil, err
+	}
+	id, leaderChecksum, err := rng.ComputeChecksum()
+	if err != nil {
+		return nil, err
+	}
+	meta := rng.Metadata()
+	checksums := map[storage.Replica][]byte{}
+	for _, replica := range meta.Replicas.Replicas {
+		if replica.NodeID == store.Ident.NodeID && replica.StoreID == store.Ident.StoreID {
+			checksums[replica] = leaderChecksum
+			continue
+		}
+		checksum, err := n.collectChecksum(replica, id)
+		if err != nil {
+			glog.Warningf("range %d: unable to collect checksum from node %d, store %d: %v",
+				rangeID, replica.NodeID, replica.StoreID, err)
+			continue
+		}
+		checksums[replica] = checksum
+	}
+
+	// Replicas are checked against the checksum of a majority, if any,
+	// or else that of the leader.
+	expected, majority := leaderChecksum, false
+	counts := map[string]int{}
+	for _, checksum := range checksums {
+		if counts[string(checksum)]++; counts[string(checksum)] > len(meta.Replicas.Replicas)/2 {
+			expected, majority = checksum, true
+		}
+	}
+	var divergences []Divergence
+	for replica, checksum := range checksums {
+		if !bytes.Equal(checksum, expected) {
+			divergences = append(divergences, Divergence{
+				RangeID:  rangeID,
+				Replica:  replica,
+				Checksum: checksum,
+				Expected: expected,
+				Majority: majority,
+			})
+		}
+	}
+	return divergences, nil
+}
+
+// collectChecksum returns the checksum with ID id computed by replica,
+// retrying while the replica has yet to compute it.
+func (n *Node) collectChecksum(replica storage.Replica, id int64) ([]byte, error) {
+	var checksum []byte
+	opts := checksumRetryOptions
+	opts.Stopper = n.closer
+	err := util.RetryWithBackoff(opts, func() (bool, error) {
+		args := &storage.InternalChecksumRequest{
+			RequestHeader: storage.RequestHeader{Replica: replica},
+			ChecksumID:    id,
+		}
+		reply := &storage.InternalChecksumResponse{}
+		if err := n.sendToNode(replica.NodeID, "Node.InternalChecksum", args, reply); err != nil {
+			return false, nil
+		}
+		if reply.Error != nil {
+			return false, nil
+		}
+		checksum = reply.Checksum
+		return true, nil
+	})
+	return checksum, err
+}
+
+// quarantineReplica takes replica offline for inspection.
+func (n *Node) quarantineReplica(replica storage.Replica) error {
+	args := &storage.InternalQuarantineReplicaRequest{RequestHeader: storage.RequestHeader{Replica: replica}}
+	reply := &storage.InternalQuarantineReplicaResponse{}
+	if err := n.sendToNode(replica.NodeID, "Node.InternalQuarantineReplica", args, reply); err != nil {
+		return err
+	}
+	if reply.Error != nil {
+		return reply.Error
+	}
+	return nil
+}
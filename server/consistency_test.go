@@ -0,0 +1,102 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// TestNodeCheckConsistency verifies the replicas of a range agree
+// until one replica's data is modified bypassing raft, after which
+// it's reported as divergent.
+func TestNodeCheckConsistency(t *testing.T) {
+	engine := storage.NewInMem(1 << 20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	*gossip.GossipInterval = 10 * time.Millisecond
+	addr1 := util.CreateTestAddr("tcp")
+	server1, node1 := createTestNode(addr1, []storage.Engine{engine}, addr1, t)
+	defer server1.Close()
+	server2, node2 := createTestNode(util.CreateTestAddr("tcp"), []storage.Engine{storage.NewInMem(1 << 20)}, server1.Addr(), t)
+	defer server2.Close()
+	if err := util.IsTrueWithin(func() bool { return node2.getStoreCount() == 1 }, 1*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	db := node1.kvDB.(*kv.DistDB)
+	zone := &storage.ZoneConfig{
+		Replicas:      map[string][]string{"": []string{"MEM", "MEM"}},
+		RangeMinBytes: 1 << 20,
+		RangeMaxBytes: 64 << 20,
+	}
+	if err := kv.PutI(db, storage.MakeKey(storage.KeyConfigZonePrefix, storage.KeyMin), zone); err != nil {
+		t.Fatal(err)
+	}
+	node1.gossipStores()
+	node2.gossipStores()
+	if err := util.IsTrueWithin(func() bool {
+		stores, err := node1.gossip.GetGroupInfos(gossip.KeyStorePrefix)
+		_, addrErr := node1.gossip.GetInfo(gossip.MakeNodeIDGossipKey(node2.Attributes.NodeID))
+		return err == nil && len(stores) == 2 && addrErr == nil
+	}, 1*time.Second); err != nil {
+		t.Fatal("expected node 1 to learn of node 2's store")
+	}
+	if err := util.IsTrueWithin(func() bool {
+		node1.rebalanceReplicas()
+		rng, err := node1.storeMap[1].GetRange(1)
+		return err == nil && len(rng.Metadata().Replicas.Replicas) == 2
+	}, 1*time.Second); err != nil {
+		t.Fatal("expected range to be replicated to node 2")
+	}
+	if ids := node1.storeMap[1].ConsistencyCandidates(); len(ids) != 1 || ids[0] != 1 {
+		t.Fatalf("expected range 1 to be checked; got %v", ids)
+	}
+	// The follower may still be applying the snapshot which added it.
+	if err := util.IsTrueWithin(func() bool {
+		divergences, err := node1.checkRangeConsistency(node1.storeMap[1], 1)
+		return err == nil && len(divergences) == 0
+	}, 2*time.Second); err != nil {
+		t.Fatal("expected replicas to agree")
+	}
+
+	// Overwrite node 2's replica directly, bypassing raft.
+	var rng2 *storage.Range
+	for _, store := range node2.storeMap {
+		rng2, _ = store.GetRange(1)
+	}
+	if rng2 == nil {
+		t.Fatal("expected node 2 to hold a replica of range 1")
+	}
+	pr := &storage.PutResponse{}
+	rng2.Put(&storage.PutRequest{Key: storage.Key("a"), Value: storage.Value{Bytes: []byte("diverged")}}, pr)
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	divergences, err := node1.checkRangeConsistency(node1.storeMap[1], 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without a majority, node 2 is judged against the leader.
+	if len(divergences) != 1 || divergences[0].Replica.NodeID != node2.Attributes.NodeID || divergences[0].Majority {
+		t.Errorf("expected node 2's replica to diverge from the leader; got %+v", divergences)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	commander "code.google.com/p/go-commander"
+	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+var decodeValues = flag.Bool("decode_values", false, "display the values of keys whose prefix "+
+	"has a registered type decoded, rather than as quoted bytes, in the output of debug-scan")
+
+// A CmdDebugScan command displays the raw contents of a store.
+var CmdDebugScan = &commander.Command{
+	UsageLine: "debug-scan [options] <store-id> <range-id> [<start-key> [<end-key>]]",
+	Short:     "displays raw keys and values stored on a node",
+	Long: `
+Displays the keys and values stored in the engine of the store with
+<store-id> on the node at --addr, exactly as stored, from <start-key>
+to <end-key>. Store-local system keys are included. <range-id> must
+identify a range on the store. Keys should be escaped via URL query
+escaping if they contain non-ascii bytes or spaces; they default to
+the entire key space. At most 1000 rows are displayed.
+
+Each row is displayed as the quoted key, followed by the timestamp,
+the compression dictionary version and the quoted value bytes. With
+--decode_values, values of system keys such as range addressing
+records and configs are instead displayed decoded.
+
+The node must have been started with --enable_debug_scan.
+`,
+	Run:  runDebugScan,
+	Flag: *flag.CommandLine,
+}
+
+// runDebugScan invokes the debug scan REST API and displays the rows.
+func runDebugScan(cmd *commander.Command, args []string) {
+	if len(args) < 2 || len(args) > 4 {
+		cmd.Usage()
+		return
+	}
+	q := url.Values{}
+	q.Set("store", args[0])
+	q.Set("range", args[1])
+	for i, param := range []string{"start", "end"} {
+		if len(args) > i+2 {
+			key, err := url.QueryUnescape(args[i+2])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "invalid %s key %q: %v\n", param, args[i+2], err)
+				return
+			}
+			q.Set(param, key)
+		}
+	}
+	req, err := http.NewRequest("GET", kv.HTTPAddr()+debugScanKeyPrefix+"?"+q.Encode(), nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to create request to admin REST endpoint: %v\n", err)
+		return
+	}
+	b, err := sendAdminRequest(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "admin REST request failed: %v\n", err)
+		return
+	}
+	var rows []storage.KeyValue
+	if err = json.Unmarshal(b, &rows); err != nil {
+		fmt.Fprintf(os.Stderr, "unable to parse admin REST response: %v\n", err)
+		return
+	}
+	for _, row := range rows {
+		value := fmt.Sprintf("%q", row.Value.Bytes)
+		if *decodeValues && row.Value.DictVersion == 0 {
+			value = kv.DefaultSchemaRegistry.Render(row.Key, row.Value.Bytes)
+		}
+		fmt.Fprintf(os.Stdout, "%q\t%d\t%d\t%s\n", row.Key, row.Value.Timestamp, row.Value.DictVersion, value)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/golang/glog"
+	yaml "gopkg.in/yaml.v1"
+)
+
+// A FreezeSpec requests a freeze of the span of keys from the start
+// key given by the request path up to EndKey. It's supplied as YAML
+// to the freezes admin endpoint.
+type FreezeSpec struct {
+	EndKey     string `yaml:"end_key"`
+	Reads      bool   `yaml:"reads,omitempty"`
+	Reason     string `yaml:"reason"`
+	TTLSeconds int64  `yaml:"ttl_seconds"`
+}
+
+// A FrozenSpan describes a freeze, as reported by the freezes admin
+// endpoint.
+type FrozenSpan struct {
+	StartKey   string
+	EndKey     string
+	Reads      bool
+	Reason     string
+	Expiration time.Time
+	Expired    bool
+}
+
+// newFrozenSpan returns a description of the freeze of the span
+// starting at startKey, as of now.
+func newFrozenSpan(startKey storage.Key, config *storage.FreezeConfig, now time.Time) FrozenSpan {
+	expiration := time.Unix(0, config.Expiration).UTC()
+	return FrozenSpan{
+		StartKey:   string(startKey),
+		EndKey:     string(config.EndKey),
+		Reads:      config.Reads,
+		Reason:     config.Reason,
+		Expiration: expiration,
+		Expired:    !expiration.After(now),
+	}
+}
+
+// A freezeHandler implements the actionHandler interface for freezes
+// of key spans.
+type freezeHandler struct {
+	kvDB kv.DB // Key-value database client
+}
+
+// Put freezes the span starting at the key given by path, replacing
+// any freeze of a span with the same start key. The body is a YAML
+// FreezeSpec, which must give an end key after the start key, a
+// reason and a positive TTL.
+func (fh *freezeHandler) Put(path string, body []byte, r *http.Request) error {
+	if len(path) == 0 {
+		return util.Errorf("no path specified for freeze Put")
+	}
+	spec := &FreezeSpec{}
+	if err := yaml.Unmarshal(body, spec); err != nil {
+		return util.Errorf("freeze has invalid format: %s: %v", body, err)
+	}
+	startKey := storage.Key(path[1:])
+	if bytes.Compare(storage.Key(spec.EndKey), startKey) <= 0 {
+		return util.Errorf("end key %q must follow start key %q", spec.EndKey, startKey)
+	}
+	if spec.Reason == "" {
+		return util.Errorf("a reason must be given for freezing span [%q, %q)", startKey, spec.EndKey)
+	}
+	if spec.TTLSeconds <= 0 {
+		return util.Errorf("freeze TTL must be positive; got %d", spec.TTLSeconds)
+	}
+	config := &storage.FreezeConfig{
+		EndKey:     storage.Key(spec.EndKey),
+		Reads:      spec.Reads,
+		Reason:     spec.Reason,
+		Expiration: time.Now().Add(time.Duration(spec.TTLSeconds) * time.Second).UnixNano(),
+	}
+	if err := kv.PutI(fh.kvDB, storage.MakeKey(storage.KeyConfigFreezePrefix, startKey), config); err != nil {
+		return err
+	}
+	glog.Infof("froze span [%q, %q) until %s: %s", startKey, spec.EndKey,
+		time.Unix(0, config.Expiration).UTC().Format(time.RFC3339), spec.Reason)
+	return nil
+}
+
+// Get returns the freeze of the span starting at the key given by
+// path or, if path is empty, all freezes, as JSON. Expired freezes
+// are listed until deleted.
+func (fh *freezeHandler) Get(path string, r *http.Request) (body []byte, contentType string, err error) {
+	now := time.Now()
+	var result interface{}
+	if len(path) == 0 {
+		sr := <-fh.kvDB.Scan(&storage.ScanRequest{
+			StartKey:   storage.KeyConfigFreezePrefix,
+			EndKey:     storage.PrefixEndKey(storage.KeyConfigFreezePrefix),
+			MaxResults: maxGetResults,
+		})
+		if sr.Error != nil {
+			return nil, "", sr.Error
+		}
+		spans := []FrozenSpan{}
+		for _, kv := range sr.Rows {
+			config := &storage.FreezeConfig{}
+			if err := gob.NewDecoder(bytes.NewBuffer(kv.Value.Bytes)).Decode(config); err != nil {
+				return nil, "", util.Errorf("unable to decode freeze %q: %v", kv.Key, err)
+			}
+			spans = append(spans, newFrozenSpan(bytes.TrimPrefix(kv.Key, storage.KeyConfigFreezePrefix), config, now))
+		}
+		result = spans
+	} else {
+		startKey := storage.Key(path[1:])
+		config := &storage.FreezeConfig{}
+		ok, _, err := kv.GetI(fh.kvDB, storage.MakeKey(storage.KeyConfigFreezePrefix, startKey), config)
+		if err != nil {
+			return nil, "", err
+		}
+		if !ok {
+			return nil, "", util.Errorf("no freeze found for span starting at %q", startKey)
+		}
+		result = newFrozenSpan(startKey, config, now)
+	}
+	if body, err = json.Marshal(result); err != nil {
+		return nil, "", util.Errorf("unable to format freezes: %v", err)
+	}
+	return body, "application/json", nil
+}
+
+// Delete lifts the freeze of the span starting at the key given by
+// path.
+func (fh *freezeHandler) Delete(path string, r *http.Request) error {
+	if len(path) == 0 {
+		return util.Errorf("no path specified for freeze Delete")
+	}
+	dr := <-fh.kvDB.Delete(&storage.DeleteRequest{Key: storage.MakeKey(storage.KeyConfigFreezePrefix, storage.Key(path[1:]))})
+	if dr.Error != nil {
+		return dr.Error
+	}
+	glog.Infof("lifted freeze of span starting at %q", path[1:])
+	return nil
+}
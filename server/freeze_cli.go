@@ -0,0 +1,115 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	commander "code.google.com/p/go-commander"
+	"github.com/cockroachdb/cockroach/kv"
+	yaml "gopkg.in/yaml.v1"
+)
+
+var freezeReads = flag.Bool("freeze_reads", false, "freeze reads as well as writes to the span "+
+	"frozen by the freeze command")
+
+// A CmdFreeze command freezes access to a key span.
+var CmdFreeze = &commander.Command{
+	UsageLine: "freeze [options] <start-key> <end-key> <ttl> <reason>",
+	Short:     "freezes writes to a key span",
+	Long: `
+Freezes writes to the span of keys from <start-key> up to <end-key>
+for <ttl>, a duration such as "30m", as during a migration or a
+restore into a prefix. With --freeze_reads, reads are frozen too.
+Requests accessing frozen keys fail with an error giving <reason>.
+The keys should be escaped via URL query escaping if they contain
+non-ascii bytes or spaces. The freeze lapses after <ttl> or once
+lifted with unfreeze.
+`,
+	Run:  runFreeze,
+	Flag: *flag.CommandLine,
+}
+
+// runFreeze invokes the REST API with PUT action and the start key
+// as path.
+func runFreeze(cmd *commander.Command, args []string) {
+	if len(args) != 4 {
+		cmd.Usage()
+		return
+	}
+	ttl, err := time.ParseDuration(args[2])
+	if err != nil || ttl < time.Second {
+		fmt.Fprintf(os.Stderr, "invalid freeze TTL %q; must be at least one second\n", args[2])
+		return
+	}
+	body, err := yaml.Marshal(&FreezeSpec{
+		EndKey:     args[1],
+		Reads:      *freezeReads,
+		Reason:     args[3],
+		TTLSeconds: int64(ttl / time.Second),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to encode freeze: %v\n", err)
+		return
+	}
+	req, err := http.NewRequest("PUT", kv.HTTPAddr()+freezesKeyPrefix+"/"+args[0], bytes.NewReader(body))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to create request to admin REST endpoint: %v\n", err)
+		return
+	}
+	if _, err = sendAdminRequest(req); err != nil {
+		fmt.Fprintf(os.Stderr, "admin REST request failed: %v\n", err)
+		return
+	}
+	fmt.Fprintf(os.Stdout, "froze span [%q, %q) for %s\n", args[0], args[1], ttl)
+}
+
+// A CmdUnfreeze command lifts the freeze of a key span.
+var CmdUnfreeze = &commander.Command{
+	UsageLine: "unfreeze [options] <start-key>",
+	Short:     "lifts the freeze of a key span",
+	Long: `
+Lifts the freeze of the span of keys starting at <start-key>. The key
+should be escaped via URL query escaping if it contains non-ascii
+bytes or spaces.
+`,
+	Run:  runUnfreeze,
+	Flag: *flag.CommandLine,
+}
+
+// runUnfreeze invokes the REST API with DELETE action and the start
+// key as path.
+func runUnfreeze(cmd *commander.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		return
+	}
+	req, err := http.NewRequest("DELETE", kv.HTTPAddr()+freezesKeyPrefix+"/"+args[0], nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to create request to admin REST endpoint: %v\n", err)
+		return
+	}
+	if _, err = sendAdminRequest(req); err != nil {
+		fmt.Fprintf(os.Stderr, "admin REST request failed: %v\n", err)
+		return
+	}
+	fmt.Fprintf(os.Stdout, "lifted freeze of span starting at %q\n", args[0])
+}
@@ -0,0 +1,78 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// TestNodeFreeze verifies freezes set via the admin handler refuse
+// writes to the frozen span with a SpanFrozenError until lifted, and
+// that invalid freezes are rejected.
+func TestNodeFreeze(t *testing.T) {
+	engine := storage.NewInMem(1 << 20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	addr := util.CreateTestAddr("tcp")
+	server, node := createTestNode(addr, []storage.Engine{engine}, addr, t)
+	defer server.Close()
+	fh := &freezeHandler{kvDB: node.kvDB}
+
+	for _, body := range []string{
+		"end_key: a\nreason: restore\nttl_seconds: 60\n",
+		"end_key: c\nttl_seconds: 60\n",
+		"end_key: c\nreason: restore\n",
+	} {
+		if err := fh.Put("/b", []byte(body), nil); err == nil {
+			t.Errorf("expected error freezing with %q", body)
+		}
+	}
+	if err := fh.Put("/b", []byte("end_key: c\nreason: restore\nttl_seconds: 60\n"), nil); err != nil {
+		t.Fatal(err)
+	}
+	body, _, err := fh.Get("/b", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var span FrozenSpan
+	if err := json.Unmarshal(body, &span); err != nil || span.EndKey != "c" || span.Reason != "restore" || span.Expired {
+		t.Errorf("unexpected freeze %s: %v", body, err)
+	}
+
+	put := func(key string) error {
+		return (<-node.kvDB.Put(&storage.PutRequest{Key: storage.Key(key), Value: storage.Value{Bytes: []byte("v")}})).Error
+	}
+	if err, ok := put("b1").(*storage.SpanFrozenError); !ok || err.Reason != "restore" {
+		t.Errorf("expected SpanFrozenError writing to frozen span; got %v", err)
+	}
+	if err := put("c"); err != nil {
+		t.Errorf("expected write after frozen span to succeed; got %v", err)
+	}
+	if gr := <-node.kvDB.Get(&storage.GetRequest{Key: storage.Key("b1")}); gr.Error != nil {
+		t.Errorf("expected read of span frozen to writes to succeed; got %v", gr.Error)
+	}
+	if err := fh.Delete("/b", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := put("b1"); err != nil {
+		t.Errorf("expected write after freeze was lifted to succeed; got %v", err)
+	}
+}
@@ -53,8 +53,9 @@ func runInit(cmd *commander.Command, args []string) {
 		return
 	}
 	// Specifying the disk type as HDD may be incorrect, but doesn't
-	// matter for this bootstrap step.
-	engine, err := initEngine(args[0])
+	// matter for this bootstrap step. The few bootstrap writes are
+	// synced, as the cluster can't start without them.
+	engine, err := initEngine(args[0], storage.RocksDBOptions{CacheSize: *cacheSize, SyncWrites: true})
 	if err != nil {
 		glog.Fatal(err)
 	}
@@ -0,0 +1,287 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/golang/glog"
+)
+
+var (
+	// jobHeartbeatInterval is the interval at which a node heartbeats
+	// the jobs it's running and looks for jobs to adopt.
+	jobHeartbeatInterval = 1 * time.Second
+	// jobLeaseDuration is the time since its owner's last heartbeat
+	// after which a running job is adopted by another node.
+	jobLeaseDuration = 10 * time.Second
+)
+
+// errJobStopped is returned by JobContext.Progress when the job is no
+// longer to be run by this node.
+var errJobStopped = util.Errorf("job stopped")
+
+// A JobRunner executes a job, returning nil once it has completed.
+// Runners should resume from jc.Job.Checkpoint, record progress via
+// jc.Progress and return promptly once jc.Stopped is closed.
+type JobRunner func(jc *JobContext) error
+
+// A JobContext is passed to the runner of a job.
+type JobContext struct {
+	Job      *kv.Job // The job, as of its adoption
+	registry *jobRegistry
+	stopOnce sync.Once
+	stopped  chan struct{}
+}
+
+// Progress records the fraction of the job completed and the
+// checkpoint from which to resume it. Returns an error if the job has
+// been paused, canceled or adopted by another node, in which case the
+// runner should return.
+func (jc *JobContext) Progress(fraction float64, checkpoint []byte) error {
+	select {
+	case <-jc.stopped:
+		return errJobStopped
+	default:
+	}
+	_, err := kv.UpdateJob(jc.registry.db, jc.Job.ID, func(job *kv.Job) error {
+		if !jc.registry.owns(job) {
+			return errJobStopped
+		}
+		job.Progress = fraction
+		job.Checkpoint = checkpoint
+		job.Heartbeat = time.Now().UnixNano()
+		return nil
+	})
+	if err == errJobStopped {
+		jc.stop()
+	}
+	return err
+}
+
+// Stopped returns a channel which is closed when the job is paused,
+// canceled or adopted by another node, or the node is stopping.
+func (jc *JobContext) Stopped() <-chan struct{} {
+	return jc.stopped
+}
+
+// stop closes the stopped channel.
+func (jc *JobContext) stop() {
+	jc.stopOnce.Do(func() { close(jc.stopped) })
+}
+
+// A jobRegistry runs jobs on behalf of a node. Each heartbeat
+// interval it heartbeats the jobs it's running, stopping any which
+// were paused, canceled or adopted elsewhere, and adopts running jobs
+// which are unowned or whose owner's heartbeat has lapsed, provided
+// it has a runner for their type.
+type jobRegistry struct {
+	db        kv.DB
+	nodeID    int32
+	closer    chan struct{}
+	startOnce sync.Once
+
+	mu      sync.Mutex
+	runners map[string]JobRunner
+	running map[int64]*JobContext
+	wg      sync.WaitGroup
+}
+
+// newJobRegistry returns a registry which stores jobs in db.
+func newJobRegistry(db kv.DB) *jobRegistry {
+	return &jobRegistry{
+		db:      db,
+		closer:  make(chan struct{}),
+		runners: map[string]JobRunner{},
+		running: map[int64]*JobContext{},
+	}
+}
+
+// register sets the runner for jobs of type typ.
+func (r *jobRegistry) register(typ string, runner JobRunner) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.runners[typ] = runner
+}
+
+// start begins heartbeating and adopting jobs as node nodeID. Only
+// the first call has any effect.
+func (r *jobRegistry) start(nodeID int32) {
+	r.startOnce.Do(func() {
+		r.nodeID = nodeID
+		go r.loop()
+	})
+}
+
+// loop heartbeats the jobs being run and adopts jobs every
+// jobHeartbeatInterval until the registry is stopped.
+func (r *jobRegistry) loop() {
+	ticker := time.NewTicker(jobHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.heartbeat()
+			r.adopt()
+		case <-r.closer:
+			return
+		}
+	}
+}
+
+// stop stops all jobs being run and waits for their runners to
+// return. The jobs are left to be adopted by other nodes.
+func (r *jobRegistry) stop() {
+	r.mu.Lock()
+	close(r.closer)
+	for _, jc := range r.running {
+		jc.stop()
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+}
+
+// owns returns true if the job is running and owned by this node.
+func (r *jobRegistry) owns(job *kv.Job) bool {
+	return job.Status == kv.JobRunning && job.NodeID == r.nodeID
+}
+
+// heartbeat renews the ownership of each job being run, stopping
+// those which this node no longer owns.
+func (r *jobRegistry) heartbeat() {
+	r.mu.Lock()
+	running := make([]*JobContext, 0, len(r.running))
+	for _, jc := range r.running {
+		running = append(running, jc)
+	}
+	r.mu.Unlock()
+	for _, jc := range running {
+		_, err := kv.UpdateJob(r.db, jc.Job.ID, func(job *kv.Job) error {
+			if !r.owns(job) {
+				return errJobStopped
+			}
+			job.Heartbeat = time.Now().UnixNano()
+			return nil
+		})
+		if err == errJobStopped {
+			glog.Infof("job %d stopped", jc.Job.ID)
+			jc.stop()
+		} else if err != nil {
+			glog.Warningf("unable to heartbeat job %d: %v", jc.Job.ID, err)
+		}
+	}
+}
+
+// adopt claims and runs jobs which are running but unowned, or whose
+// owner's heartbeat is older than jobLeaseDuration. Claims are
+// conditional on the job being unchanged since it was read; see
+// kv.UpdateJob. Of nodes claiming a job concurrently, only one
+// succeeds, and the others find the job no longer adoptable.
+func (r *jobRegistry) adopt() {
+	jobs, err := kv.ListJobs(r.db)
+	if err != nil {
+		glog.Warningf("unable to list jobs: %v", err)
+		return
+	}
+	for _, job := range jobs {
+		if !r.adoptable(job, time.Now()) {
+			continue
+		}
+		claimed, err := kv.UpdateJob(r.db, job.ID, func(job *kv.Job) error {
+			now := time.Now()
+			if !r.adoptable(job, now) {
+				return errJobStopped
+			}
+			job.NodeID = r.nodeID
+			job.Heartbeat = now.UnixNano()
+			return nil
+		})
+		if err == errJobStopped {
+			continue
+		} else if err != nil {
+			glog.Warningf("unable to adopt job %d: %v", job.ID, err)
+			continue
+		}
+		r.run(claimed)
+	}
+}
+
+// adoptable returns true if the job is running, unowned or owned by
+// a node whose heartbeat has lapsed, has a runner here and isn't
+// already being run here.
+func (r *jobRegistry) adoptable(job *kv.Job, now time.Time) bool {
+	if job.Status != kv.JobRunning {
+		return false
+	}
+	if job.NodeID != 0 && job.NodeID != r.nodeID && now.UnixNano()-job.Heartbeat < jobLeaseDuration.Nanoseconds() {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, isRunning := r.running[job.ID]
+	_, hasRunner := r.runners[job.Type]
+	return hasRunner && !isRunning
+}
+
+// run executes the claimed job in a goroutine. When the runner
+// returns, the job is marked succeeded or failed unless it was
+// stopped in the meantime.
+func (r *jobRegistry) run(job *kv.Job) {
+	jc := &JobContext{Job: job, registry: r, stopped: make(chan struct{})}
+	r.mu.Lock()
+	runner := r.runners[job.Type]
+	r.running[job.ID] = jc
+	r.wg.Add(1)
+	select {
+	case <-r.closer:
+		jc.stop()
+	default:
+	}
+	r.mu.Unlock()
+	glog.Infof("node %d running %s job %d: %s", r.nodeID, job.Type, job.ID, job.Description)
+
+	go func() {
+		defer r.wg.Done()
+		runErr := runner(jc)
+		r.mu.Lock()
+		delete(r.running, job.ID)
+		r.mu.Unlock()
+		select {
+		case <-jc.stopped:
+			return
+		default:
+		}
+		_, err := kv.UpdateJob(r.db, job.ID, func(job *kv.Job) error {
+			if !r.owns(job) {
+				return errJobStopped
+			}
+			if runErr != nil {
+				job.Status = kv.JobFailed
+				job.Error = runErr.Error()
+			} else {
+				job.Status = kv.JobSucceeded
+				job.Progress = 1
+			}
+			return nil
+		})
+		if err != nil && err != errJobStopped {
+			glog.Warningf("unable to record completion of job %d: %v", job.ID, err)
+		}
+	}()
+}
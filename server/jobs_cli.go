@@ -0,0 +1,148 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	commander "code.google.com/p/go-commander"
+	"github.com/cockroachdb/cockroach/kv"
+)
+
+// A CmdLsJobs command displays a list of jobs.
+var CmdLsJobs = &commander.Command{
+	UsageLine: "ls-jobs [options]",
+	Short:     "list all jobs",
+	Long: `
+List long-running jobs, such as backups, restores and imports. Each
+job is displayed as its ID, type, status, percentage complete, the
+ID of the node running it and its description. Failed jobs are
+followed by the reason for failure.
+`,
+	Run:  runLsJobs,
+	Flag: *flag.CommandLine,
+}
+
+// runLsJobs invokes the REST API with GET action and no path, which
+// fetches a list of all jobs.
+func runLsJobs(cmd *commander.Command, args []string) {
+	if len(args) != 0 {
+		cmd.Usage()
+		return
+	}
+	req, err := http.NewRequest("GET", kv.HTTPAddr()+jobsKeyPrefix, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to create request to admin REST endpoint: %v\n", err)
+		return
+	}
+	b, err := sendAdminRequest(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "admin REST request failed: %v\n", err)
+		return
+	}
+	var jobs []*kv.Job
+	if err = json.Unmarshal(b, &jobs); err != nil {
+		fmt.Fprintf(os.Stderr, "unable to parse admin REST response: %v\n", err)
+		return
+	}
+	for _, job := range jobs {
+		fmt.Fprintf(os.Stdout, "%d\t%s\t%s\t%.0f%%\t%d\t%s\n", job.ID, job.Type, job.Status,
+			job.Progress*100, job.NodeID, job.Description)
+		if job.Status == kv.JobFailed {
+			fmt.Fprintf(os.Stdout, "\t%s\n", job.Error)
+		}
+	}
+}
+
+// A CmdPauseJob command pauses a running job.
+var CmdPauseJob = &commander.Command{
+	UsageLine: "pause-job [options] <job-id>",
+	Short:     "pause a running job",
+	Long: `
+Pause the running job with <job-id>. The node running the job stops it
+within a few seconds; it can be resumed later from where it left off
+with resume-job.
+`,
+	Run:  runPauseJob,
+	Flag: *flag.CommandLine,
+}
+
+// runPauseJob invokes the REST API to pause a job.
+func runPauseJob(cmd *commander.Command, args []string) {
+	runJobAction(cmd, args, "pause", "paused")
+}
+
+// A CmdResumeJob command resumes a paused job.
+var CmdResumeJob = &commander.Command{
+	UsageLine: "resume-job [options] <job-id>",
+	Short:     "resume a paused job",
+	Long: `
+Resume the paused job with <job-id>. The job is adopted by a node able
+to run it and continues from its last recorded progress.
+`,
+	Run:  runResumeJob,
+	Flag: *flag.CommandLine,
+}
+
+// runResumeJob invokes the REST API to resume a job.
+func runResumeJob(cmd *commander.Command, args []string) {
+	runJobAction(cmd, args, "resume", "resumed")
+}
+
+// A CmdCancelJob command cancels a job.
+var CmdCancelJob = &commander.Command{
+	UsageLine: "cancel-job [options] <job-id>",
+	Short:     "cancel a running or paused job",
+	Long: `
+Cancel the running or paused job with <job-id>. A canceled job can't
+be resumed. Work already done by the job isn't undone.
+`,
+	Run:  runCancelJob,
+	Flag: *flag.CommandLine,
+}
+
+// runCancelJob invokes the REST API to cancel a job.
+func runCancelJob(cmd *commander.Command, args []string) {
+	runJobAction(cmd, args, "cancel", "canceled")
+}
+
+// runJobAction invokes the REST API with POST action and path
+// "/<job-id>/<action>".
+func runJobAction(cmd *commander.Command, args []string, action, done string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		return
+	}
+	if _, err := strconv.ParseInt(args[0], 10, 64); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid job ID %q: %v\n", args[0], err)
+		return
+	}
+	req, err := http.NewRequest("POST", kv.HTTPAddr()+jobsKeyPrefix+"/"+args[0]+"/"+action, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to create request to admin REST endpoint: %v\n", err)
+		return
+	}
+	if _, err = sendAdminRequest(req); err != nil {
+		fmt.Fprintf(os.Stderr, "admin REST request failed: %v\n", err)
+		return
+	}
+	fmt.Fprintf(os.Stdout, "%s job %s\n", done, args[0])
+}
@@ -0,0 +1,291 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// createTestJobRegistries returns registries for the specified node
+// IDs, sharing a bootstrapped database. Each registry runs jobs of
+// type kv.JobTypeImport with runner.
+func createTestJobRegistries(t *testing.T, runner JobRunner, nodeIDs ...int32) (kv.DB, []*jobRegistry) {
+	db, err := BootstrapCluster("cluster-1", storage.NewInMem(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var registries []*jobRegistry
+	for _, nodeID := range nodeIDs {
+		r := newJobRegistry(db)
+		r.nodeID = nodeID
+		r.register(kv.JobTypeImport, runner)
+		registries = append(registries, r)
+	}
+	return db, registries
+}
+
+// waitForJobStatus waits for the job with id to reach status.
+func waitForJobStatus(t *testing.T, db kv.DB, id int64, status kv.JobStatus) *kv.Job {
+	var job *kv.Job
+	if err := util.IsTrueWithin(func() bool {
+		var err error
+		job, err = kv.GetJob(db, id)
+		return err == nil && job.Status == status
+	}, 1*time.Second); err != nil {
+		t.Fatalf("job %d didn't reach status %s: %+v", id, status, job)
+	}
+	return job
+}
+
+// TestJobRegistryRun verifies an adopted job records its progress and
+// is marked succeeded or failed according to its runner's result.
+func TestJobRegistryRun(t *testing.T) {
+	runner := func(jc *JobContext) error {
+		if err := jc.Progress(0.5, []byte("half")); err != nil {
+			return err
+		}
+		if string(jc.Job.Payload) == "fail" {
+			return util.Errorf("import failed")
+		}
+		return nil
+	}
+	db, registries := createTestJobRegistries(t, runner, 1)
+	r := registries[0]
+	defer r.stop()
+	ok, err := kv.CreateJob(db, kv.JobTypeImport, "succeeds", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fail, err := kv.CreateJob(db, kv.JobTypeImport, "fails", []byte("fail"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := kv.CreateJob(db, kv.JobTypeBackup, "no runner", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.adopt()
+	if job := waitForJobStatus(t, db, ok.ID, kv.JobSucceeded); job.Progress != 1 || string(job.Checkpoint) != "half" || job.NodeID != 1 {
+		t.Errorf("unexpected succeeded job %+v", job)
+	}
+	if job := waitForJobStatus(t, db, fail.ID, kv.JobFailed); !strings.HasSuffix(job.Error, "import failed") {
+		t.Errorf("unexpected failed job %+v", job)
+	}
+	if job, err := kv.GetJob(db, other.ID); err != nil || job.NodeID != 0 {
+		t.Errorf("expected job without runner to remain unowned; got %+v, %v", job, err)
+	}
+}
+
+// TestJobRegistryPauseResume verifies a paused job is stopped at the
+// next heartbeat and resumes from its checkpoint once resumed.
+func TestJobRegistryPauseResume(t *testing.T) {
+	checkpoints := make(chan string, 2)
+	runner := func(jc *JobContext) error {
+		checkpoints <- string(jc.Job.Checkpoint)
+		if len(jc.Job.Checkpoint) > 0 {
+			return nil
+		}
+		if err := jc.Progress(0.25, []byte("quarter")); err != nil {
+			return err
+		}
+		<-jc.Stopped()
+		return errJobStopped
+	}
+	db, registries := createTestJobRegistries(t, runner, 1)
+	r := registries[0]
+	defer r.stop()
+	job, err := kv.CreateJob(db, kv.JobTypeImport, "import", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.adopt()
+	if cp := <-checkpoints; cp != "" {
+		t.Errorf("expected new job to start without checkpoint; got %q", cp)
+	}
+	if err := util.IsTrueWithin(func() bool {
+		j, err := kv.GetJob(db, job.ID)
+		return err == nil && j.Progress == 0.25
+	}, 1*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.PauseJob(db, job.ID); err != nil {
+		t.Fatal(err)
+	}
+	r.heartbeat()
+	if err := util.IsTrueWithin(func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return len(r.running) == 0
+	}, 1*time.Second); err != nil {
+		t.Fatal("expected paused job to stop")
+	}
+	r.adopt()
+	if j, err := kv.GetJob(db, job.ID); err != nil || j.Status != kv.JobPaused {
+		t.Fatalf("expected job to remain paused; got %+v, %v", j, err)
+	}
+	if err := kv.ResumeJob(db, job.ID); err != nil {
+		t.Fatal(err)
+	}
+	r.adopt()
+	if cp := <-checkpoints; cp != "quarter" {
+		t.Errorf("expected resumed job to start from checkpoint; got %q", cp)
+	}
+	waitForJobStatus(t, db, job.ID, kv.JobSucceeded)
+}
+
+// TestJobRegistryAdoption verifies a job is adopted by another node
+// once its owner's heartbeat lapses, and that the previous owner then
+// stops running it.
+func TestJobRegistryAdoption(t *testing.T) {
+	defer func(d time.Duration) { jobLeaseDuration = d }(jobLeaseDuration)
+	jobLeaseDuration = 50 * time.Millisecond
+	runner := func(jc *JobContext) error {
+		<-jc.Stopped()
+		return errJobStopped
+	}
+	db, registries := createTestJobRegistries(t, runner, 1, 2)
+	r1, r2 := registries[0], registries[1]
+	defer r2.stop()
+	defer r1.stop()
+	job, err := kv.CreateJob(db, kv.JobTypeImport, "import", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r1.adopt()
+	r2.adopt()
+	if j, err := kv.GetJob(db, job.ID); err != nil || j.NodeID != 1 {
+		t.Fatalf("expected job to be owned by node 1; got %+v, %v", j, err)
+	}
+	// Without heartbeats from node 1, node 2 adopts the job once the
+	// lease expires.
+	time.Sleep(jobLeaseDuration)
+	r2.adopt()
+	if j, err := kv.GetJob(db, job.ID); err != nil || j.NodeID != 2 {
+		t.Fatalf("expected job to be adopted by node 2; got %+v, %v", j, err)
+	}
+	r1.heartbeat()
+	if err := util.IsTrueWithin(func() bool {
+		r1.mu.Lock()
+		defer r1.mu.Unlock()
+		return len(r1.running) == 0
+	}, 1*time.Second); err != nil {
+		t.Fatal("expected node 1 to stop running adopted job")
+	}
+	r2.mu.Lock()
+	defer r2.mu.Unlock()
+	if len(r2.running) != 1 {
+		t.Errorf("expected node 2 to be running job; got %d jobs", len(r2.running))
+	}
+}
+
+// readDelayDB delays each read's reply, so that nodes reading a job
+// concurrently also write it concurrently.
+type readDelayDB struct {
+	kv.DB
+}
+
+// Get replies with the value read after a delay.
+func (db readDelayDB) Get(args *storage.GetRequest) <-chan *storage.GetResponse {
+	reply := <-db.DB.Get(args)
+	time.Sleep(5 * time.Millisecond)
+	c := make(chan *storage.GetResponse, 1)
+	c <- reply
+	return c
+}
+
+// TestJobRegistryConcurrentAdoption verifies each job is run by just
+// one of the nodes claiming it concurrently: the node it records as
+// its owner.
+func TestJobRegistryConcurrentAdoption(t *testing.T) {
+	runner := func(jc *JobContext) error {
+		<-jc.Stopped()
+		return errJobStopped
+	}
+	db, registries := createTestJobRegistries(t, runner, 1, 2, 3, 4)
+	for _, r := range registries {
+		r.db = readDelayDB{db}
+		defer r.stop()
+	}
+	const numJobs = 10
+	for i := 0; i < numJobs; i++ {
+		if _, err := kv.CreateJob(db, kv.JobTypeImport, "import", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var wg sync.WaitGroup
+	for _, r := range registries {
+		wg.Add(1)
+		go func(r *jobRegistry) {
+			defer wg.Done()
+			r.adopt()
+		}(r)
+	}
+	wg.Wait()
+
+	running := 0
+	for _, r := range registries {
+		r.mu.Lock()
+		for id := range r.running {
+			running++
+			if job, err := kv.GetJob(db, id); err != nil || job.NodeID != r.nodeID {
+				t.Errorf("node %d is running job %d owned by another node: %+v, %v", r.nodeID, id, job, err)
+			}
+		}
+		r.mu.Unlock()
+	}
+	if running != numJobs {
+		t.Errorf("expected %d jobs to be run once each; got %d runs", numJobs, running)
+	}
+}
+
+// TestNodeRunsJobs verifies a node lists and adopts jobs via the
+// distributed database.
+func TestNodeRunsJobs(t *testing.T) {
+	defer func(d time.Duration) { jobHeartbeatInterval = d }(jobHeartbeatInterval)
+	jobHeartbeatInterval = 10 * time.Millisecond
+	engine := storage.NewInMem(1 << 20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	addr := util.CreateTestAddr("tcp")
+	server, node := createTestNode(addr, []storage.Engine{engine}, addr, t)
+	defer server.Close()
+	defer node.stop()
+	node.RegisterJobRunner(kv.JobTypeImport, func(jc *JobContext) error { return nil })
+	db := node.kvDB
+	for _, typ := range []string{kv.JobTypeImport, kv.JobTypeBackup} {
+		if _, err := kv.CreateJob(db, typ, typ, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	jobs, err := kv.ListJobs(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 || jobs[0].ID != 1 || jobs[1].ID != 2 {
+		t.Fatalf("expected jobs 1 and 2; got %+v", jobs)
+	}
+	if job := waitForJobStatus(t, db, 1, kv.JobSucceeded); job.NodeID != node.Attributes.NodeID {
+		t.Errorf("expected job run by node %d; got %+v", node.Attributes.NodeID, job)
+	}
+}
@@ -18,8 +18,12 @@
 package server
 
 import (
+	"bytes"
 	"container/list"
+	"flag"
+	"math"
 	"net"
+	"reflect"
 	"strconv"
 	"sync"
 	"time"
@@ -36,26 +40,92 @@ const (
 	// gossipGroupLimit is the size limit for gossip groups with storage
 	// topics.
 	gossipGroupLimit = 100
-	// gossipInterval is the interval for gossiping storage-related info.
-	gossipInterval = 1 * time.Minute
-	// ttlCapacityGossip is time-to-live for capacity-related info.
-	ttlCapacityGossip = 2 * time.Minute
-	// ttlNodeIDGossip is time-to-live for node ID -> address.
-	ttlNodeIDGossip = 0 * time.Second
+	// ttlNodeLivenessGossip is time-to-live for node ID -> liveness.
+	// Zero means liveness records never expire from gossip; whether a
+	// node is live is determined instead by the expiration embedded
+	// in its record. See storage.NodeLiveness.
+	ttlNodeLivenessGossip = 0 * time.Second
+	// maxDebugScanResults limits the rows returned by a debug scan.
+	maxDebugScanResults = 1000
+	// nodeConnectTimeout bounds the wait for a connection to another
+	// node to administer its replicas.
+	nodeConnectTimeout = 5 * time.Second
 )
 
+var rangeMergeInterval = flag.Duration("range_merge_interval", 1*time.Minute, "interval at which "+
+	"adjacent ranges below their zone's minimum size are merged; 0 disables automatic merging")
+
+var rangeSplitInterval = flag.Duration("range_split_interval", 1*time.Minute, "interval at which "+
+	"ranges led by this node's stores which exceed their zone's maximum size are split in half; "+
+	"0 disables automatic splitting")
+
+var zoneRefreshInterval = flag.Duration("zone_refresh_interval", 10*time.Second, "interval at which "+
+	"gossiped zone configs are checked for changes, which are otherwise applied as they arrive; changes are "+
+	"applied to affected ranges without waiting for the split, merge, rebalance and GC queues; 0 disables "+
+	"applying changes")
+
+var rangeRebalanceInterval = flag.Duration("range_rebalance_interval", 1*time.Minute, "interval at which "+
+	"replicas are added to and removed from ranges led by this node's stores to satisfy their zone's replica "+
+	"specification and even out the disk usage of stores; 0 disables automatic rebalancing")
+
+var rangeGCInterval = flag.Duration("range_gc_interval", 1*time.Minute, "interval at which "+
+	"ranges due for garbage collection are scanned to remove expired values and superseded versions "+
+	"and abort abandoned write intents; 0 disables garbage collection")
+
+var rangeCompactionInterval = flag.Duration("range_compaction_interval", 1*time.Minute, "interval at which "+
+	"the storage of spans where ranges have deleted many rows, by garbage collection, range deletions or "+
+	"merges, is compacted to reclaim their space; 0 disables hinted compactions")
+
+var closedTimestampInterval = flag.Duration("closed_timestamp_interval", 2*time.Second, "interval at which "+
+	"the resolved timestamps of ranges led by this node's stores are closed and replicated, so that followers "+
+	"may serve reads at and below them; 0 disables follower reads of BOUNDED consistency")
+
+var rowCacheSize = flag.Int64("row_cache_size", 0, "size in bytes of each store's cache of recently "+
+	"read rows, adjustable at runtime via "+cachesKeyPrefix+"; 0 disables the row cache")
+
+var snapshotRate = flag.Int64("snapshot_rate", 32<<20, "maximum rate in bytes per second at which "+
+	"each store sends raft snapshots to replicas catching up; 0 is unlimited")
+
+var storeGossipInterval = flag.Duration("store_gossip_interval", 1*time.Minute, "interval at which "+
+	"the descriptors of each store, with its capacity and range count, are gossiped; descriptors "+
+	"expire after twice the interval, after which the store is presumed unavailable")
+
+var timeUntilNodeDead = flag.Duration("time_until_node_dead", storage.DefaultTimeUntilNodeDead, "time after "+
+	"a node's liveness, gossiped with its store descriptors, expires beyond which the node is considered dead; "+
+	"replicas on dead nodes are replaced by the rebalance queue")
+
+var usageRollupInterval = flag.Duration("usage_rollup_interval", 1*time.Minute, "interval at which "+
+	"the usage by account of ranges led by this node's stores is rolled up for cluster usage reports; "+
+	"0 disables rollups")
+
+var enableDebugScan = flag.Bool("enable_debug_scan", false, "allow InternalDebugScan requests, "+
+	"which return raw stored keys and values, including system keys, without permission checks")
+
 // Node manages a map of stores (by store ID) for which it serves traffic.
 type Node struct {
 	ClusterID  string                 // UUID for Cockroach cluster
 	Attributes storage.NodeAttributes // Node ID, network/physical topology
 	gossip     *gossip.Gossip         // Nodes gossip cluster ID, node ID -> host:port
 	kvDB       kv.DB                  // Used to access global id generators
+	budget     *requestBudget         // Limits memory held by in-flight requests
+	scheduler  *requestScheduler      // Orders execution of requests by priority
+	jobs       *jobRegistry           // Runs long-running jobs
+	slos       *sloTracker            // Tracks attainment of latency objectives
+	clock      *util.Clock            // Hybrid logical clock; stamps writes
+	writes     *writeSampler          // Samples writes to selected key prefixes
+	clients    *clientTracker         // Tracks requests by client
+	rebalance  chan struct{}          // Wakes the rebalance queue
 	closer     chan struct{}
 
+	// staleReplicas holds the replicas found missing from their
+	// ranges' addressing records by the last check; accessed only by
+	// rebalanceReplicas, which runs only on the rebalance queue. See
+	// removeStaleReplicas.
+	staleReplicas map[storage.Replica]struct{}
+
 	mu       sync.RWMutex             // Protects storeMap during bootstrapping
 	storeMap map[int32]*storage.Store // Map from StoreID to Store
 
-	maxAvailPrefix string // Prefix for max avail capacity gossip topic
 }
 
 // allocateNodeID increments the node id generator key to allocate
@@ -93,6 +163,12 @@ func allocateStoreIDs(nodeID int32, inc int64, db kv.DB) (int32, error) {
 //
 // Returns a direct-access kv.LocalDB for unittest purposes only.
 func BootstrapCluster(clusterID string, engine storage.Engine) (*kv.LocalDB, error) {
+	return bootstrapCluster(clusterID, engine, getDatacenter())
+}
+
+// bootstrapCluster bootstraps a cluster as BootstrapCluster does, with
+// the first range's replica in datacenter.
+func bootstrapCluster(clusterID string, engine storage.Engine, datacenter string) (*kv.LocalDB, error) {
 	sIdent := storage.StoreIdent{
 		ClusterID: clusterID,
 		NodeID:    1,
@@ -120,15 +196,15 @@ func BootstrapCluster(clusterID string, engine storage.Engine) (*kv.LocalDB, err
 		NodeID:     1,
 		StoreID:    1,
 		RangeID:    1,
-		Datacenter: getDatacenter(),
+		Datacenter: datacenter,
 		DiskType:   engine.Type(),
 	}
 	rng, err := s.CreateRange(storage.KeyMin, storage.KeyMax, []storage.Replica{replica})
 	if err != nil {
 		return nil, err
 	}
-	if rng.Meta.RangeID != 1 {
-		return nil, util.Errorf("expected range id of 1, got %d", rng.Meta.RangeID)
+	if rangeID := rng.Metadata().RangeID; rangeID != 1 {
+		return nil, util.Errorf("expected range id of 1, got %d", rangeID)
 	}
 
 	// Create a local DB to directly modify the new range.
@@ -161,24 +237,37 @@ func BootstrapCluster(clusterID string, engine storage.Engine) (*kv.LocalDB, err
 // Stores. Registers the storage instance for the RPC service "Node".
 func NewNode(kvDB kv.DB, gossip *gossip.Gossip) *Node {
 	n := &Node{
-		gossip:   gossip,
-		kvDB:     kvDB,
-		storeMap: make(map[int32]*storage.Store),
-		closer:   make(chan struct{}),
+		gossip:    gossip,
+		kvDB:      kvDB,
+		storeMap:  make(map[int32]*storage.Store),
+		closer:    make(chan struct{}),
+		budget:    newRequestBudget(*maxInflightRequests, *maxInflightBytes),
+		scheduler: newRequestScheduler(*maxExecutingRequests),
+		jobs:      newJobRegistry(kvDB),
+		slos:      newSLOTracker(nil, *sloSustainedWindows),
+		clock:     util.NewClock(util.UnixNano, storage.MaxClockOffset),
+		writes:    newWriteSampler(parseWriteSamplePrefixes(*writeSamplePrefixes), *writeSampleRate, *writeSampleSize),
+		clients:   newClientTracker(),
+		rebalance: make(chan struct{}, 1),
 	}
 	return n
 }
 
 // initAttributes initializes the physical/network topology attributes
 // if possible. Datacenter, PDU & Rack values are taken from environment
-// variables or command line flags.
+// variables or command line flags, unless already set, as they are
+// for the nodes of a cluster started from a Topology.
 func (n *Node) initAttributes(addr net.Addr) {
-	n.Attributes = storage.NodeAttributes{
-		// NodeID is after invocation of start()
-		Address:    addr,
-		Datacenter: getDatacenter(),
-		PDU:        getPDU(),
-		Rack:       getRack(),
+	// NodeID is set after invocation of start().
+	n.Attributes.Address = addr
+	if n.Attributes.Datacenter == "" {
+		n.Attributes.Datacenter = getDatacenter()
+	}
+	if n.Attributes.PDU == "" {
+		n.Attributes.PDU = getPDU()
+	}
+	if n.Attributes.Rack == "" {
+		n.Attributes.Rack = getRack()
 	}
 }
 
@@ -187,6 +276,11 @@ func (n *Node) initAttributes(addr net.Addr) {
 // for each specified engine. Launches periodic store gossipping
 // in a goroutine.
 func (n *Node) start(rpcServer *rpc.Server, engines []storage.Engine) error {
+	slos, err := parseLatencySLOs(*latencySLOs)
+	if err != nil {
+		return err
+	}
+	n.slos = newSLOTracker(slos, *sloSustainedWindows)
 	n.initAttributes(rpcServer.Addr())
 	rpcServer.RegisterName("Node", n)
 
@@ -194,16 +288,69 @@ func (n *Node) start(rpcServer *rpc.Server, engines []storage.Engine) error {
 		return err
 	}
 	go n.startGossip()
+	if *rangeMergeInterval > 0 {
+		go n.runQueue(*rangeMergeInterval, n.mergeUnderfullRanges)
+	}
+	if *rangeSplitInterval > 0 {
+		go n.runQueue(*rangeSplitInterval, n.splitOversizedRanges)
+	}
+	if *rangeRebalanceInterval > 0 {
+		go n.startRebalanceQueue(*rangeRebalanceInterval)
+	}
+	if *zoneRefreshInterval > 0 {
+		go n.startZoneRefresh(*zoneRefreshInterval)
+	}
+	if *rangeGCInterval > 0 {
+		go n.runQueue(*rangeGCInterval, n.garbageCollectRanges)
+	}
+	if *rangeCompactionInterval > 0 {
+		go n.runQueue(*rangeCompactionInterval, n.compactHintedRanges)
+	}
+	if *closedTimestampInterval > 0 {
+		go n.runQueue(*closedTimestampInterval, n.closeTimestamps)
+	}
+	if *consistencyCheckInterval > 0 {
+		go n.runQueue(*consistencyCheckInterval, n.checkConsistency)
+	}
+	if *clockOffsetCheckInterval > 0 {
+		go n.runQueue(*clockOffsetCheckInterval, n.checkClockOffsets)
+	}
+	if len(slos) > 0 {
+		go n.startSLOTracker(*sloWindow)
+	}
+	if *usageRollupInterval > 0 {
+		go n.runQueue(*usageRollupInterval, func() {
+			if err := n.rollupUsage(); err != nil {
+				glog.Warningf("failed to roll up usage: %v", err)
+			}
+		})
+	}
 
 	return nil
 }
 
+// RegisterJobRunner sets the runner with which this node executes
+// jobs of type typ. Runners should be registered before the node is
+// started.
+func (n *Node) RegisterJobRunner(typ string, runner JobRunner) {
+	n.jobs.register(typ, runner)
+}
+
 // stop cleanly stops the node.
 func (n *Node) stop() {
 	close(n.closer)
+	n.jobs.stop()
 	n.mu.RLock()
 	defer n.mu.RUnlock()
 	for _, store := range n.storeMap {
+		// Delete the store's descriptor from the gossip network, so
+		// that other nodes stop placing replicas on the store without
+		// awaiting the descriptor's expiration.
+		if n.Attributes.NodeID != 0 {
+			if err := n.gossip.DeleteInfo(gossip.MakeStoreKey(n.Attributes.NodeID, store.Ident.StoreID)); err != nil {
+				glog.Warningf("unable to delete gossiped descriptor of store %d: %v", store.Ident.StoreID, err)
+			}
+		}
 		store.Close()
 	}
 }
@@ -222,6 +369,10 @@ func (n *Node) initStoreMap(engines []storage.Engine) error {
 
 	for _, engine := range engines {
 		s := storage.NewStore(engine, n.gossip)
+		s.SetRowCacheSize(*rowCacheSize)
+		s.SetSnapshotRate(*snapshotRate)
+		s.SetTimeUntilNodeDead(*timeUntilNodeDead)
+		s.SetRaftTransport(newRaftTransport(n.gossip))
 		// If not bootstrapped, add to list.
 		if !s.IsBootstrapped() {
 			bootstraps.PushBack(s)
@@ -249,14 +400,34 @@ func (n *Node) initStoreMap(engines []storage.Engine) error {
 		return err
 	}
 
+	// Persist the addresses of gossip peers to the initialized stores,
+	// so that on restart the node may rejoin gossip via the peers it
+	// knew, should its configured bootstrap hosts be down.
+	if len(n.storeMap) > 0 {
+		var stores storesBootstrap
+		for _, s := range n.storeMap {
+			stores = append(stores, s)
+		}
+		if err := n.gossip.SetStorage(stores); err != nil {
+			glog.Warningf("unable to read persisted gossip bootstrap info: %v", err)
+		}
+	}
+
 	// Connect gossip before starting bootstrap. For new nodes, connecting
 	// to the gossip network is necessary to get the cluster ID.
 	n.connectGossip()
 
-	// Bootstrap any uninitialized stores asynchronously.
-	if bootstraps.Len() > 0 {
-		go n.bootstrapStores(bootstraps)
-	}
+	// Bootstrap any uninitialized stores asynchronously, then start
+	// running jobs: a new node's ID is known only once bootstrapping
+	// has allocated it.
+	go func() {
+		if bootstraps.Len() > 0 {
+			n.bootstrapStores(bootstraps)
+		}
+		if n.Attributes.NodeID != 0 {
+			n.jobs.start(n.Attributes.NodeID)
+		}
+	}()
 
 	return nil
 }
@@ -296,11 +467,7 @@ func (n *Node) bootstrapStores(bootstraps *list.List) {
 		if err != nil {
 			glog.Fatal(err)
 		}
-		// Gossip node address keyed by node ID.
-		nodeIDKey := gossip.MakeNodeIDGossipKey(n.Attributes.NodeID)
-		if err := n.gossip.AddInfo(nodeIDKey, n.Attributes.Address, ttlNodeIDGossip); err != nil {
-			glog.Errorf("couldn't gossip address for node %d: %v", n.Attributes.NodeID, err)
-		}
+		n.gossipDescriptor()
 	}
 
 	// Bootstrap all waiting stores by allocating a new store id for
@@ -326,6 +493,34 @@ func (n *Node) bootstrapStores(bootstraps *list.List) {
 	}
 }
 
+// storesBootstrap implements gossip.Storage for the stores of a node,
+// writing bootstrap info to each and reading the most recent.
+type storesBootstrap []*storage.Store
+
+// ReadBootstrapInfo implements the gossip.Storage interface.
+func (ss storesBootstrap) ReadBootstrapInfo(info *gossip.BootstrapInfo) error {
+	for _, s := range ss {
+		var bi gossip.BootstrapInfo
+		if err := s.ReadBootstrapInfo(&bi); err != nil {
+			return err
+		}
+		if bi.Timestamp > info.Timestamp {
+			*info = bi
+		}
+	}
+	return nil
+}
+
+// WriteBootstrapInfo implements the gossip.Storage interface.
+func (ss storesBootstrap) WriteBootstrapInfo(info *gossip.BootstrapInfo) error {
+	for _, s := range ss {
+		if err := s.WriteBootstrapInfo(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // connectGossip connects to gossip network and reads cluster ID. If
 // this node is already part of a cluster, the cluster ID is verified
 // for a match. If not part of a cluster, the cluster ID is set. The
@@ -348,24 +543,48 @@ func (n *Node) connectGossip() {
 	}
 	glog.Infof("node connected via gossip and verified as part of cluster %q", gossipClusterID)
 
-	// Gossip node address keyed by node ID.
-	if n.Attributes.NodeID != 0 {
-		nodeIDKey := gossip.MakeNodeIDGossipKey(n.Attributes.NodeID)
-		if err := n.gossip.AddInfo(nodeIDKey, n.Attributes.Address, ttlNodeIDGossip); err != nil {
-			glog.Errorf("couldn't gossip address for node %d: %v", n.Attributes.NodeID, err)
+	n.gossipDescriptor()
+}
+
+// runQueue calls fn on a periodic ticker until the node is closed.
+// It should be invoked via goroutine.
+func (n *Node) runQueue(interval time.Duration, fn func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fn()
+		case <-n.closer:
+			return
 		}
 	}
 }
 
+// stores returns the node's stores.
+func (n *Node) stores() []*storage.Store {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	stores := make([]*storage.Store, 0, len(n.storeMap))
+	for _, store := range n.storeMap {
+		stores = append(stores, store)
+	}
+	return stores
+}
+
 // startGossip loops on a periodic ticker to gossip node-related
 // information. Loops until the node is closed and should be
 // invoked via goroutine.
 func (n *Node) startGossip() {
-	ticker := time.NewTicker(gossipInterval)
+	n.gossipLiveness()
+	n.gossipStores()
+	ticker := time.NewTicker(*storeGossipInterval)
 	for {
 		select {
 		case <-ticker.C:
-			n.gossipCapacities()
+			n.gossipDescriptor()
+			n.gossipLiveness()
+			n.gossipStores()
 		case <-n.closer:
 			ticker.Stop()
 			return
@@ -373,176 +592,1332 @@ func (n *Node) startGossip() {
 	}
 }
 
-// gossipCapacities calls capacity on each store and adds it to the
-// gossip network.
-func (n *Node) gossipCapacities() {
-	n.mu.RLock()
-	defer n.mu.RUnlock()
-
-	// Register gossip groups.
-	n.maxAvailPrefix = gossip.KeyMaxAvailCapacityPrefix + n.Attributes.Datacenter
-	n.gossip.RegisterGroup(n.maxAvailPrefix, gossipGroupLimit, gossip.MaxGroup)
-
-	for _, store := range n.storeMap {
-		capacity, err := store.Capacity()
-		if err != nil {
-			glog.Warningf("problem getting capacity: %v", err)
-			continue
-		}
-
-		keyMaxCapacity := n.maxAvailPrefix + strconv.FormatInt(int64(n.Attributes.NodeID), 16) + "-" +
-			strconv.FormatInt(int64(store.Ident.StoreID), 16)
-		storeAttr := storage.StoreAttributes{
-			StoreID:    store.Ident.StoreID,
-			Attributes: n.Attributes,
-			Capacity:   capacity,
+// startSLOTracker loops on a periodic ticker, evaluating attainment
+// of latency objectives over each window.
+func (n *Node) startSLOTracker(window time.Duration) {
+	ticker := time.NewTicker(window)
+	for {
+		select {
+		case now := <-ticker.C:
+			n.slos.endWindow(now)
+		case <-n.closer:
+			ticker.Stop()
+			return
 		}
-		n.gossip.AddInfo(keyMaxCapacity, storeAttr, ttlCapacityGossip)
 	}
 }
 
-// storeCount returns the number of stores this node is exporting.
-func (n *Node) getStoreCount() int {
+// SLOStatuses returns the attainment of the node's latency objectives
+// and recent violation and recovery events.
+func (n *Node) SLOStatuses() ([]SLOStatus, []SLOEvent) {
+	return n.slos.statuses(), n.slos.recentEvents()
+}
+
+// UsageReport returns the usage by account of ranges for which the
+// node's replicas are raft leaders.
+func (n *Node) UsageReport() storage.UsageReport {
 	n.mu.RLock()
 	defer n.mu.RUnlock()
-	return len(n.storeMap)
+	var reports []storage.UsageReport
+	for _, store := range n.storeMap {
+		reports = append(reports, store.LeaderUsageReport())
+	}
+	return storage.MergeUsageReports(reports...)
 }
 
-// getRange looks up the store by Replica.StoreID and then queries it for
-// the range specified by Replica.RangeID.
-func (n *Node) getRange(r *storage.Replica) (*storage.Range, error) {
+// rollupUsage writes the node's usage report to its usage rollup key,
+// from which cluster usage reports are assembled. Nothing is written
+// until the node has been allocated an ID.
+func (n *Node) rollupUsage() error {
 	n.mu.RLock()
-	store, ok := n.storeMap[r.StoreID]
+	nodeID := n.Attributes.NodeID
 	n.mu.RUnlock()
-	if !ok {
-		return nil, util.Errorf("store for replica %+v not found", r)
-	}
-	rng, err := store.GetRange(r.RangeID)
-	if err != nil {
-		return nil, err
+	if nodeID == 0 {
+		return nil
 	}
-	return rng, nil
+	return kv.PutNodeUsage(n.kvDB, nodeID, n.UsageReport())
 }
 
-// All methods to satisfy the Node RPC service fetch the range
-// based on the Replica target provided in the argument header.
-// Commands are broken down into read-only and read-write and
-// sent along to the range via either Range.readOnlyCmd() or
-// Range.readWriteCmd().
+// splitOversizedRanges splits each range selected by
+// Store.SplitCandidates and updates the range addressing records.
+func (n *Node) splitOversizedRanges() {
+	stores := n.stores()
+	for _, store := range stores {
+		splits, err := store.SplitCandidates()
+		if err != nil {
+			glog.Warningf("unable to find ranges to split on store %s: %v", store, err)
+			continue
+		}
+		for _, split := range splits {
+			newRng, err := n.splitRange(store, split.RangeID, split.SplitKey)
+			if err == nil {
+				err = n.addressSplit(store, split.RangeID, newRng)
+			}
+			if err != nil {
+				glog.Warningf("failed to split range %d on store %s at %q: %v", split.RangeID, store, split.SplitKey, err)
+				continue
+			}
+			glog.Infof("split oversized range %d on store %s at %q", split.RangeID, store, split.SplitKey)
+		}
+	}
+}
 
-// Contains .
-func (n *Node) Contains(args *storage.ContainsRequest, reply *storage.ContainsResponse) error {
-	rng, err := n.getRange(&args.Replica)
-	if err != nil {
-		return err
+// startZoneRefresh applies changes to the gossiped zone configs as
+// they arrive, and on a periodic ticker in case any are missed.
+func (n *Node) startZoneRefresh(interval time.Duration) {
+	changed := make(chan struct{}, 1)
+	unregister := n.gossip.RegisterCallback(gossip.KeyConfigZone, func(_ string, _ interface{}) {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+	defer unregister()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-changed:
+			n.refreshZoneConfigs()
+		case <-ticker.C:
+			n.refreshZoneConfigs()
+		case <-n.closer:
+			return
+		}
 	}
-	return rng.ReadOnlyCmd("Contains", args, reply)
 }
 
-// Get .
-func (n *Node) Get(args *storage.GetRequest, reply *storage.GetResponse) error {
-	rng, err := n.getRange(&args.Replica)
-	if err != nil {
-		return err
+// refreshZoneConfigs applies changes to the gossiped zone configs. The
+// ranges of each store overlapping changed zones reload their storage
+// policies and are garbage collected under their new GC TTLs; ranges
+// are then split and merged according to the new sizes, and the
+// rebalance queue woken to apply the new replica specifications.
+func (n *Node) refreshZoneConfigs() {
+	stores := n.stores()
+	var changed bool
+	now := time.Now().UnixNano()
+	for _, store := range stores {
+		rangeIDs, err := store.RefreshZoneConfigs()
+		if err != nil {
+			glog.Warningf("unable to refresh zone configs on store %s: %v", store, err)
+			continue
+		}
+		if len(rangeIDs) == 0 {
+			continue
+		}
+		changed = true
+		glog.Infof("zone configs changed; re-applying to %d range(s) on store %s", len(rangeIDs), store)
+		for _, rangeID := range rangeIDs {
+			rng, err := store.GetRange(rangeID)
+			if err != nil || !rng.IsLeader() {
+				continue
+			}
+			if _, err := rng.GarbageCollect(now); err != nil {
+				glog.Errorf("range %d: garbage collection failed: %v", rangeID, err)
+			}
+		}
+	}
+	if changed {
+		n.splitOversizedRanges()
+		n.mergeUnderfullRanges()
+		n.wakeRebalanceQueue()
 	}
-	return rng.ReadOnlyCmd("Get", args, reply)
 }
 
-// Put .
-func (n *Node) Put(args *storage.PutRequest, reply *storage.PutResponse) error {
-	rng, err := n.getRange(&args.Replica)
-	if err != nil {
-		return err
+// mergeUnderfullRanges merges each range selected by
+// Store.MergeCandidates with its successor and updates the range
+// addressing records.
+func (n *Node) mergeUnderfullRanges() {
+	stores := n.stores()
+	for _, store := range stores {
+		rangeIDs, err := store.MergeCandidates()
+		if err != nil {
+			glog.Warningf("unable to find ranges to merge on store %s: %v", store, err)
+			continue
+		}
+		for _, rangeID := range rangeIDs {
+			if err := n.mergeRange(store, rangeID); err != nil {
+				glog.Warningf("failed to merge range %d on store %s: %v", rangeID, store, err)
+				continue
+			}
+			glog.Infof("merged underfull range %d on store %s with its successor", rangeID, store)
+		}
 	}
-	return <-rng.ReadWriteCmd("Put", args, reply)
 }
 
-// Increment .
-func (n *Node) Increment(args *storage.IncrementRequest, reply *storage.IncrementResponse) error {
-	rng, err := n.getRange(&args.Replica)
-	if err != nil {
-		return err
+// garbageCollectRanges runs a garbage collection pass over each range
+// selected by Store.GCCandidates. The leader of each also resolves
+// the range's abandoned write intents, and retries the resolution of
+// the write intents of committed transactions whose records it holds;
+// see Range.AbandonedIntents and Range.UnresolvedTxns.
+func (n *Node) garbageCollectRanges() {
+	stores := n.stores()
+	now := time.Now().UnixNano()
+	for _, store := range stores {
+		rangeIDs, err := store.GCCandidates(now)
+		if err != nil {
+			glog.Warningf("unable to find ranges to garbage collect on store %s: %v", store, err)
+			continue
+		}
+		for _, rangeID := range rangeIDs {
+			rng, err := store.GetRange(rangeID)
+			if err != nil {
+				continue // Removed or merged since
+			}
+			gc, err := rng.GarbageCollect(now)
+			if err != nil {
+				glog.Errorf("range %d: garbage collection failed: %v", rangeID, err)
+				continue
+			}
+			glog.V(1).Infof("range %d: garbage collected %+v", rangeID, gc)
+			if !rng.IsLeader() {
+				continue
+			}
+			n.resolveAbandonedIntents(rng, now)
+			txns, err := rng.UnresolvedTxns(now)
+			if err != nil {
+				glog.Errorf("range %d: unable to find unresolved transactions: %v", rangeID, err)
+				continue
+			}
+			for _, txn := range txns {
+				n.resolveIntents(txn.ID, txn.Keys, true)
+			}
+		}
 	}
-	return <-rng.ReadWriteCmd("Increment", args, reply)
 }
 
-// Delete .
-func (n *Node) Delete(args *storage.DeleteRequest, reply *storage.DeleteResponse) error {
-	rng, err := n.getRange(&args.Replica)
+// resolveAbandonedIntents pushes the transactions of the write
+// intents in rng abandoned at now, aborting those still pending, and
+// resolves the intents according to the transactions' outcomes. The
+// pushes have the highest priority, so that they needn't wait on
+// transactions presumed abandoned. Failures are logged and retried by
+// the range's next pass.
+func (n *Node) resolveAbandonedIntents(rng *storage.Range, now int64) {
+	rangeID := rng.Metadata().RangeID
+	intents, err := rng.AbandonedIntents(now)
 	if err != nil {
-		return err
+		glog.Errorf("range %d: unable to find abandoned write intents: %v", rangeID, err)
+		return
+	}
+	for _, intent := range intents {
+		pushReply := <-n.kvDB.InternalPushTxn(&storage.InternalPushTxnRequest{
+			RequestHeader:   storage.RequestHeader{TxnPriority: math.MaxInt32},
+			Key:             storage.TxnRecordKey(intent.TxnID),
+			PusheeTxID:      intent.TxnID,
+			PusheePriority:  intent.TxnPriority,
+			PusheeTimestamp: intent.Timestamp,
+		})
+		if pushReply.Error != nil {
+			glog.Warningf("range %d: failed to push transaction %q: %v", rangeID, intent.TxnID, pushReply.Error)
+			continue
+		}
+		resolveReply := <-n.kvDB.InternalResolveIntent(&storage.InternalResolveIntentRequest{
+			Key:        intent.Key,
+			IntentTxID: intent.TxnID,
+			Commit:     pushReply.Pushee.Status == storage.TxnCommitted,
+		})
+		if resolveReply.Error != nil {
+			glog.Warningf("range %d: failed to resolve write intent of transaction %q on %q: %v", rangeID, intent.TxnID, intent.Key, resolveReply.Error)
+		}
 	}
-	return <-rng.ReadWriteCmd("Delete", args, reply)
 }
 
-// DeleteRange .
-func (n *Node) DeleteRange(args *storage.DeleteRangeRequest, reply *storage.DeleteRangeResponse) error {
-	rng, err := n.getRange(&args.Replica)
-	if err != nil {
-		return err
+// compactHintedRanges compacts the spans selected by
+// Store.CompactHinted on each store.
+func (n *Node) compactHintedRanges() {
+	stores := n.stores()
+	for _, store := range stores {
+		rangeIDs, err := store.CompactHinted()
+		if err != nil {
+			glog.Warningf("failed to compact hinted ranges on store %s: %v", store, err)
+		}
+		if len(rangeIDs) > 0 {
+			glog.V(1).Infof("compacted ranges %v on store %s", rangeIDs, store)
+		}
 	}
-	return <-rng.ReadWriteCmd("DeleteRange", args, reply)
 }
 
-// Scan .
-func (n *Node) Scan(args *storage.ScanRequest, reply *storage.ScanResponse) error {
-	rng, err := n.getRange(&args.Replica)
-	if err != nil {
-		return err
+// closeTimestamps closes the resolved timestamps of the ranges led by
+// each store; see Store.CloseTimestamps.
+func (n *Node) closeTimestamps() {
+	stores := n.stores()
+	for _, store := range stores {
+		if _, err := store.CloseTimestamps(); err != nil {
+			glog.V(1).Infof("failed to close timestamps of ranges on store %s: %v", store, err)
+		}
 	}
-	return rng.ReadOnlyCmd("Scan", args, reply)
 }
 
-// EndTransaction .
-func (n *Node) EndTransaction(args *storage.EndTransactionRequest, reply *storage.EndTransactionResponse) error {
-	rng, err := n.getRange(&args.Replica)
-	if err != nil {
-		return err
+// startRebalanceQueue loops on a periodic ticker, rebalancing the
+// replicas of ranges led by each store, and also rebalances whenever
+// woken by wakeRebalanceQueue. Rebalancing runs only here, so that
+// passes never overlap.
+func (n *Node) startRebalanceQueue(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for {
+		select {
+		case <-ticker.C:
+			n.rebalanceReplicas()
+		case <-n.rebalance:
+			n.rebalanceReplicas()
+		case <-n.closer:
+			ticker.Stop()
+			return
+		}
 	}
-	return <-rng.ReadWriteCmd("EndTransaction", args, reply)
 }
 
-// AccumulateTS .
-func (n *Node) AccumulateTS(args *storage.AccumulateTSRequest, reply *storage.AccumulateTSResponse) error {
-	rng, err := n.getRange(&args.Replica)
-	if err != nil {
-		return err
+// wakeRebalanceQueue has the rebalance queue rebalance without
+// awaiting its next tick. Wakings while a pass is pending are merged.
+func (n *Node) wakeRebalanceQueue() {
+	select {
+	case n.rebalance <- struct{}{}:
+	default:
 	}
-	return <-rng.ReadWriteCmd("AccumulateTS", args, reply)
 }
 
-// ReapQueue .
-func (n *Node) ReapQueue(args *storage.ReapQueueRequest, reply *storage.ReapQueueResponse) error {
-	rng, err := n.getRange(&args.Replica)
-	if err != nil {
-		return err
+// rebalanceReplicas applies each change selected by
+// Store.RebalanceCandidates to the replicas of its range.
+func (n *Node) rebalanceReplicas() {
+	stores := n.stores()
+	stale := map[storage.Replica]struct{}{}
+	for _, store := range stores {
+		n.removeStaleReplicas(store, stale)
+		changes, err := store.RebalanceCandidates()
+		if err != nil {
+			glog.Warningf("unable to find ranges to rebalance on store %s: %v", store, err)
+			continue
+		}
+		for _, change := range changes {
+			if err := n.changeReplicas(store, change); err != nil {
+				glog.Warningf("failed to rebalance range %d on store %s: %v", change.RangeID, store, err)
+				continue
+			}
+			glog.Infof("rebalanced range %d on store %s: added %+v, removed %+v", change.RangeID, store, change.Add, change.Remove)
+		}
 	}
-	return <-rng.ReadWriteCmd("ReapQueue", args, reply)
+	n.staleReplicas = stale
 }
 
-// EnqueueUpdate .
-func (n *Node) EnqueueUpdate(args *storage.EnqueueUpdateRequest, reply *storage.EnqueueUpdateResponse) error {
-	rng, err := n.getRange(&args.Replica)
-	if err != nil {
-		return err
+// removeStaleReplicas removes the replicas held by store of ranges
+// whose addressing records no longer list them, as when a replica is
+// removed while its node is dead, or its addition fails without it
+// being removed. Replicas being added to a range are created before
+// its addressing records list them, so a replica is removed only if
+// the previous check also found it missing; stale collects those
+// found missing by this check. Replicas are left in place if their
+// ranges have since split or merged.
+func (n *Node) removeStaleReplicas(store *storage.Store, stale map[storage.Replica]struct{}) {
+	for _, meta := range store.FollowerRanges() {
+		var locations storage.RangeLocations
+		ok, _, err := kv.GetI(n.kvDB, storage.MakeKey(storage.KeyMeta2Prefix, meta.EndKey), &locations)
+		if err != nil {
+			glog.Warningf("unable to look up range %d on store %s: %v", meta.RangeID, store, err)
+			continue
+		}
+		if !ok || !bytes.Equal(locations.StartKey, meta.StartKey) || listsStore(locations.Replicas, store) {
+			continue
+		}
+		replica := storage.Replica{NodeID: store.Ident.NodeID, StoreID: store.Ident.StoreID, RangeID: meta.RangeID}
+		if _, ok := n.staleReplicas[replica]; !ok {
+			stale[replica] = struct{}{}
+			continue
+		}
+		if err := store.RemoveReplica(meta.RangeID); err != nil {
+			glog.Warningf("unable to remove stale replica of range %d from store %s: %v", meta.RangeID, store, err)
+			continue
+		}
+		glog.Infof("removed stale replica of range %d from store %s", meta.RangeID, store)
 	}
-	return <-rng.ReadWriteCmd("EnqueueUpdate", args, reply)
 }
 
-// EnqueueMessage .
-func (n *Node) EnqueueMessage(args *storage.EnqueueMessageRequest, reply *storage.EnqueueMessageResponse) error {
-	rng, err := n.getRange(&args.Replica)
-	if err != nil {
-		return err
+// listsStore returns true if one of replicas resides on store.
+func listsStore(replicas []storage.Replica, store *storage.Store) bool {
+	for _, replica := range replicas {
+		if replica.NodeID == store.Ident.NodeID && replica.StoreID == store.Ident.StoreID {
+			return true
+		}
 	}
-	return <-rng.ReadWriteCmd("EnqueueMessage", args, reply)
+	return false
 }
 
-// InternalRangeLookup .
-func (n *Node) InternalRangeLookup(args *storage.InternalRangeLookupRequest, reply *storage.InternalRangeLookupResponse) error {
-	rng, err := n.getRange(&args.Replica)
+// changeReplicas applies change to the replicas of a range led by
+// store. Added replicas are created on their stores, then the change
+// is committed via the range's raft group one replica at a time,
+// additions first, updating the range addressing records after each
+// step. Removed replicas are then removed from their stores. Replicas
+// created for additions which fail to commit are removed. Replicas on
+// dead nodes are only removed from the range's replicas; should the
+// nodes return, the replicas are removed as stale. See
+// removeStaleReplicas.
+func (n *Node) changeReplicas(store *storage.Store, change storage.ReplicaChange) (err error) {
+	rng, err := store.GetRange(change.RangeID)
 	if err != nil {
 		return err
 	}
-	return rng.ReadOnlyCmd("InternalRangeLookup", args, reply)
+	meta := rng.Metadata()
+	var replicas []storage.Replica
+	for _, replica := range meta.Replicas.Replicas {
+		removed := false
+		for _, r := range change.Remove {
+			removed = removed || (r.NodeID == replica.NodeID && r.StoreID == replica.StoreID)
+		}
+		if !removed {
+			replicas = append(replicas, replica)
+		}
+	}
+	// Each new replica is created knowing the range's eventual
+	// replicas, though not the range IDs of the other new replicas,
+	// which it learns as the change commits.
+	eventual := append(append([]storage.Replica(nil), replicas...), change.Add...)
+	var created []storage.Replica
+	defer func() {
+		if err != nil {
+			n.removeReplicas(created)
+		}
+	}()
+	for _, replica := range change.Add {
+		args := &storage.InternalCreateReplicaRequest{
+			RequestHeader: storage.RequestHeader{Replica: replica},
+			StartKey:      meta.StartKey,
+			EndKey:        meta.EndKey,
+			Replicas:      eventual,
+		}
+		reply := &storage.InternalCreateReplicaResponse{}
+		if err := n.sendToNode(replica.NodeID, "Node.InternalCreateReplica", args, reply); err != nil {
+			return err
+		}
+		if reply.Error != nil {
+			return reply.Error
+		}
+		created = append(created, reply.Replica)
+	}
+	// A raft group's replicas may safely change only one at a time;
+	// see storage.Store.ChangeReplicas.
+	for len(created) > 0 {
+		replicas := append(append([]storage.Replica(nil), meta.Replicas.Replicas...), created[0])
+		if meta, err = store.ChangeReplicas(change.RangeID, replicas); err != nil {
+			return err
+		}
+		created = created[1:]
+		if err := kv.UpdateRangeLocations(n.kvDB, meta, meta.Replicas); err != nil {
+			return err
+		}
+	}
+	for _, replica := range change.Remove {
+		var replicas []storage.Replica
+		for _, r := range meta.Replicas.Replicas {
+			if r.NodeID != replica.NodeID || r.StoreID != replica.StoreID {
+				replicas = append(replicas, r)
+			}
+		}
+		if meta, err = store.ChangeReplicas(change.RangeID, replicas); err != nil {
+			return err
+		}
+		if err := kv.UpdateRangeLocations(n.kvDB, meta, meta.Replicas); err != nil {
+			return err
+		}
+	}
+	for _, replica := range change.Remove {
+		if store.IsNodeDead(replica.NodeID) {
+			continue
+		}
+		args := &storage.InternalRemoveReplicaRequest{RequestHeader: storage.RequestHeader{Replica: replica}}
+		reply := &storage.InternalRemoveReplicaResponse{}
+		if err := n.sendToNode(replica.NodeID, "Node.InternalRemoveReplica", args, reply); err != nil {
+			return err
+		}
+		if reply.Error != nil {
+			return reply.Error
+		}
+	}
+	return nil
+}
+
+// removeReplicas removes replicas created for a change which failed.
+// Failures are logged; replicas left in place are removed as stale.
+func (n *Node) removeReplicas(replicas []storage.Replica) {
+	for _, replica := range replicas {
+		args := &storage.InternalRemoveReplicaRequest{RequestHeader: storage.RequestHeader{Replica: replica}}
+		reply := &storage.InternalRemoveReplicaResponse{}
+		err := n.sendToNode(replica.NodeID, "Node.InternalRemoveReplica", args, reply)
+		if err == nil {
+			err = reply.Error
+		}
+		if err != nil {
+			glog.Warningf("unable to remove replica %+v created for failed change: %v", replica, err)
+		}
+	}
+}
+
+// sendToNode sends an RPC to the node with the specified ID, whose
+// address is looked up via gossip, and waits for the reply.
+func (n *Node) sendToNode(nodeID int32, method string, args, reply interface{}) error {
+	addr, err := n.gossip.GetNodeAddr(nodeID)
+	if err != nil {
+		return util.Errorf("unable to look up address of node %d: %v", nodeID, err)
+	}
+	client := rpc.NewClient(addr, nil)
+	select {
+	case <-client.Ready:
+	case <-time.After(nodeConnectTimeout):
+		return util.Errorf("connection to node %d not ready within %s", nodeID, nodeConnectTimeout)
+	}
+	return client.Call(method, args, reply)
+}
+
+// gossipDescriptor adds the node's descriptor, with its address and
+// topology, keyed by node ID, to the gossip network, live until twice
+// the store gossip interval from now, so that the descriptors of nodes
+// removed from the cluster expire. See gossip.Gossip.Nodes.
+func (n *Node) gossipDescriptor() {
+	if n.Attributes.NodeID == 0 {
+		return
+	}
+	desc := gossip.NodeDescriptor{
+		NodeID:     n.Attributes.NodeID,
+		Address:    n.Attributes.Address,
+		Datacenter: n.Attributes.Datacenter,
+		PDU:        n.Attributes.PDU,
+		Rack:       n.Attributes.Rack,
+	}
+	nodeIDKey := gossip.MakeNodeIDGossipKey(n.Attributes.NodeID)
+	if err := n.gossip.AddInfo(nodeIDKey, desc, 2**storeGossipInterval); err != nil {
+		glog.Errorf("couldn't gossip address for node %d: %v", n.Attributes.NodeID, err)
+	}
+}
+
+// gossipLiveness adds the node's liveness record to the gossip
+// network. The record marks the node live until twice the store
+// gossip interval from now; the record itself remains in the network
+// after that, so that a node which stops gossiping is seen as dead
+// rather than forgotten. See storage.NodeLiveness.
+func (n *Node) gossipLiveness() {
+	if n.Attributes.NodeID == 0 {
+		return
+	}
+	liveness := storage.NodeLiveness{
+		NodeID:     n.Attributes.NodeID,
+		Expiration: time.Now().Add(2 * *storeGossipInterval).UnixNano(),
+	}
+	if err := n.gossip.AddInfo(gossip.MakeNodeLivenessKey(n.Attributes.NodeID), liveness, ttlNodeLivenessGossip); err != nil {
+		glog.Warningf("unable to gossip liveness of node %d: %v", n.Attributes.NodeID, err)
+	}
+}
+
+// gossipStores adds the descriptor of each store to the gossip
+// network. The descriptors of all stores form a group, retaining
+// those with the most available capacity should the cluster exceed
+// gossipGroupLimit stores. A store whose capacity can't be determined
+// isn't gossiped, so that its descriptor expires.
+func (n *Node) gossipStores() {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	// Register the gossip group; this fails harmlessly once registered.
+	n.gossip.RegisterGroup(gossip.KeyStorePrefix, gossipGroupLimit, gossip.MaxGroup)
+
+	for _, store := range n.storeMap {
+		desc, err := store.Descriptor(n.Attributes)
+		if err != nil {
+			glog.Warningf("unable to describe store %d: %v", store.Ident.StoreID, err)
+			continue
+		}
+		if err := n.gossip.AddInfo(gossip.MakeStoreKey(desc.Node.NodeID, desc.StoreID), desc, 2**storeGossipInterval); err != nil {
+			glog.Warningf("unable to gossip descriptor of store %d: %v", desc.StoreID, err)
+		}
+	}
+}
+
+// VerifyUsage verifies the usage of ranges overlapping the span
+// [start, end) in all of the node's stores, reconciling drift if
+// reconcile is true. See storage.Range.VerifyUsage.
+func (n *Node) VerifyUsage(start, end storage.Key, reconcile bool) ([]storage.UsageDrift, error) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	var drift []storage.UsageDrift
+	for _, store := range n.storeMap {
+		d, err := store.VerifyUsage(start, end, reconcile)
+		if err != nil {
+			return nil, err
+		}
+		drift = append(drift, d...)
+	}
+	return drift, nil
+}
+
+// CacheStats returns statistics of the caches of each of the node's
+// stores, by store ID.
+func (n *Node) CacheStats() (map[int32]storage.StoreCacheStats, error) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	stats := map[int32]storage.StoreCacheStats{}
+	for storeID, store := range n.storeMap {
+		s, err := store.CacheStats()
+		if err != nil {
+			return nil, err
+		}
+		stats[storeID] = s
+	}
+	return stats, nil
+}
+
+// SetCacheSizes resizes the caches of the store with the given ID, or
+// of all the node's stores if storeID is zero. Negative sizes leave
+// the corresponding cache unchanged; a zero row cache size disables
+// the row cache.
+func (n *Node) SetCacheSizes(storeID int32, rowCacheSize, blockCacheSize int64) error {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	var stores []*storage.Store
+	if storeID == 0 {
+		for _, store := range n.storeMap {
+			stores = append(stores, store)
+		}
+	} else if store, ok := n.storeMap[storeID]; ok {
+		stores = append(stores, store)
+	} else {
+		return util.Errorf("store %d not found", storeID)
+	}
+	for _, store := range stores {
+		if rowCacheSize >= 0 {
+			store.SetRowCacheSize(rowCacheSize)
+		}
+		if blockCacheSize >= 0 {
+			if err := store.SetBlockCacheSize(blockCacheSize); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// storeCount returns the number of stores this node is exporting.
+func (n *Node) getStoreCount() int {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return len(n.storeMap)
+}
+
+// getStore looks up the store by Replica.StoreID.
+func (n *Node) getStore(r *storage.Replica) (*storage.Store, error) {
+	n.mu.RLock()
+	store, ok := n.storeMap[r.StoreID]
+	n.mu.RUnlock()
+	if !ok {
+		return nil, util.Errorf("store for replica %+v not found", r)
+	}
+	return store, nil
+}
+
+// getRange looks up the store by Replica.StoreID and then queries it for
+// the range specified by Replica.RangeID.
+func (n *Node) getRange(r *storage.Replica) (*storage.Range, error) {
+	store, err := n.getStore(r)
+	if err != nil {
+		return nil, err
+	}
+	rng, err := store.GetRange(r.RangeID)
+	if err != nil {
+		return nil, err
+	}
+	return rng, nil
+}
+
+// admit updates the node's clock with the clock reading of the
+// request args, reserves memory for the request from the node's
+// budget and returns a function which releases the reservation and
+// sets a reading of the node's clock in reply. If the request's clock
+// reading is further ahead of the node's clock than the maximum
+// offset, or the node is over budget, the error is set in reply and
+// nil is returned.
+func (n *Node) admit(args, reply interface{}) func() {
+	errField := reflect.ValueOf(reply).Elem().FieldByName("Error")
+	if err := n.clock.Update(reflect.ValueOf(args).Elem().FieldByName("ClockReading").Int()); err != nil {
+		glog.Warningf("refused request from client with offset clock: %v", err)
+		errField.Set(reflect.ValueOf(storage.NewGenericError(err)))
+		return nil
+	}
+	bytes, err := n.budget.acquire(requestBytes(args))
+	if err != nil {
+		errField.Set(reflect.ValueOf(err))
+		return nil
+	}
+	return func() {
+		n.budget.release(bytes)
+		reflect.ValueOf(reply).Elem().FieldByName("ClockReading").SetInt(n.clock.Now())
+	}
+}
+
+// proxy routes the request args, sent by a client in proxy mode, to
+// the range holding its key via the node's own client and copies the
+// result into reply. Proxied requests aren't scheduled, as the node
+// spends their execution waiting on other nodes.
+func (n *Node) proxy(method string, args, reply interface{}) error {
+	if n.kvDB == nil {
+		return util.Errorf("node %d has no client to proxy %s requests", n.Attributes.NodeID, method)
+	}
+	m := reflect.ValueOf(n.kvDB).MethodByName(method)
+	if !m.IsValid() {
+		return util.Errorf("%s requests can't be proxied", method)
+	}
+	// Clear the proxy flag so the request executes where it's routed.
+	argsVal := reflect.New(reflect.TypeOf(args).Elem())
+	reflect.Indirect(argsVal).Set(reflect.Indirect(reflect.ValueOf(args)))
+	reflect.Indirect(argsVal).FieldByName("Proxy").SetBool(false)
+	replyVal, _ := m.Call([]reflect.Value{argsVal})[0].Recv()
+	reflect.ValueOf(reply).Elem().Set(replyVal.Elem())
+	// Errors set by the client, such as those created via util, must
+	// be converted to be encoded in the reply.
+	errField := reflect.ValueOf(reply).Elem().FieldByName("Error")
+	if err, ok := errField.Interface().(error); ok {
+		switch err.(type) {
+		case *storage.GenericError, *storage.ServerBusyError, *storage.PermissionDeniedError, *storage.SpanFrozenError,
+			*storage.ReservedKeyError:
+		default:
+			errField.Set(reflect.ValueOf(storage.NewGenericError(err)))
+		}
+	}
+	return nil
+}
+
+// readOnlyCmd admits and schedules the request and executes it as a
+// read-only command on the range specified by the header's replica,
+// if the keys it accesses aren't frozen to reads and the header's
+// user has permission to read them. The latency of admitted requests
+// is tracked against the method's latency objective, if any, and
+// attributed to the header's client.
+func (n *Node) readOnlyCmd(method string, header *storage.RequestHeader, args, reply interface{}) error {
+	release := n.admit(args, reply)
+	if release == nil {
+		return nil
+	}
+	defer release()
+	defer n.trackLatency(method, header, time.Now())
+	if header.Proxy {
+		return n.proxy(method, args, reply)
+	}
+	n.scheduler.acquire(header.Priority)
+	defer n.scheduler.release()
+	rng, err := n.getRange(&header.Replica)
+	if err != nil {
+		return err
+	}
+	if !n.permitted(rng, method, args, reply, false) {
+		return nil
+	}
+	return redirectErr(rng.ReadOnlyCmd(method, args, reply), reply)
+}
+
+// readWriteCmd admits and schedules the request and executes it as a
+// read-write command on the range specified by the header's replica,
+// if the keys it accesses aren't reserved, unless the request is
+// internal, or frozen, and the header's user has permission to write
+// them. Reserved keys are checked before proxying, as proxied
+// requests are sent on by the node's own client. The request is
+// timestamped with a reading of the node's clock. Latency is tracked
+// as for readOnlyCmd.
+func (n *Node) readWriteCmd(method string, header *storage.RequestHeader, args, reply interface{}) error {
+	release := n.admit(args, reply)
+	if release == nil {
+		return nil
+	}
+	defer release()
+	defer n.trackLatency(method, header, time.Now())
+	if err := storage.CheckReserved(method, args); err != nil {
+		reflect.ValueOf(reply).Elem().FieldByName("Error").Set(reflect.ValueOf(err))
+		return nil
+	}
+	if header.Proxy {
+		return n.proxy(method, args, reply)
+	}
+	header.Timestamp = n.clock.Now()
+	n.scheduler.acquire(header.Priority)
+	defer n.scheduler.release()
+	rng, err := n.getRange(&header.Replica)
+	if err != nil {
+		return err
+	}
+	if !n.permitted(rng, method, args, reply, true) {
+		return nil
+	}
+	err = <-rng.ReadWriteCmd(method, args, reply)
+	if err == nil && reflect.ValueOf(reply).Elem().FieldByName("Error").IsNil() {
+		n.writes.record(method, header, args)
+		n.clients.recordWrite(header.Client, args)
+	}
+	return redirectErr(err, reply)
+}
+
+// StartWriteSampling begins sampling writes to prefix executed by
+// the node; see WriteSamples.
+func (n *Node) StartWriteSampling(prefix storage.Key) {
+	n.writes.start(prefix)
+}
+
+// StopWriteSampling ends sampling writes to prefix and discards its
+// samples.
+func (n *Node) StopWriteSampling(prefix storage.Key) {
+	n.writes.stop(prefix)
+}
+
+// WriteSamples returns the recent sampled writes executed by the node
+// to each sampled prefix.
+func (n *Node) WriteSamples() []PrefixWriteSamples {
+	return n.writes.samples()
+}
+
+// trackLatency records the latency of a request of method, sent with
+// header, which started at start.
+func (n *Node) trackLatency(method string, header *storage.RequestHeader, start time.Time) {
+	latency := time.Since(start)
+	n.slos.record(method, latency)
+	n.clients.recordRequest(header.Client, latency)
+}
+
+// permitted checks the request args against the range's freeze and
+// permission configs; see Range.CheckFreeze and
+// Range.CheckPermission. If the request is refused, the error is set
+// in reply and false is returned.
+func (n *Node) permitted(rng *storage.Range, method string, args, reply interface{}, write bool) bool {
+	err := rng.CheckFreeze(method, args, write)
+	if err == nil {
+		err = rng.CheckPermission(method, args, write)
+	}
+	if err == nil {
+		return true
+	}
+	switch err.(type) {
+	case *storage.SpanFrozenError, *storage.PermissionDeniedError:
+	default:
+		err = storage.NewGenericError(err)
+	}
+	reflect.ValueOf(reply).Elem().FieldByName("Error").Set(reflect.ValueOf(err))
+	return false
+}
+
+// redirectErr returns err as the error of an RPC, unless it's a
+// NotLeaderError, NotLeaseHolderError or RangeSubsumedError, or a
+// conflict between transactions. Those are set in reply instead, as
+// errors returned from an RPC are reduced to strings: the client needs
+// the leader's or lease holder's location to redirect the request,
+// to know to retry it against a merged range, and the conflicting
+// transaction to push it.
+func redirectErr(err error, reply interface{}) error {
+	switch err.(type) {
+	case *storage.NotLeaderError, *storage.NotLeaseHolderError, *storage.RangeSubsumedError,
+		*storage.WriteIntentError, *storage.TransactionPushError, *storage.TransactionAbortedError:
+		reflect.ValueOf(reply).Elem().FieldByName("Error").Set(reflect.ValueOf(err))
+		return nil
+	}
+	return err
+}
+
+// All methods to satisfy the Node RPC service fetch the range
+// based on the Replica target provided in the argument header.
+// Commands are broken down into read-only and read-write and
+// sent along to the range via either Range.ReadOnlyCmd() or
+// Range.ReadWriteCmd(). Both are subject to the node's request
+// budget; see requestBudget.
+
+// Contains .
+func (n *Node) Contains(args *storage.ContainsRequest, reply *storage.ContainsResponse) error {
+	return n.readOnlyCmd("Contains", &args.RequestHeader, args, reply)
+}
+
+// Get .
+func (n *Node) Get(args *storage.GetRequest, reply *storage.GetResponse) error {
+	return n.readOnlyCmd("Get", &args.RequestHeader, args, reply)
+}
+
+// Put .
+func (n *Node) Put(args *storage.PutRequest, reply *storage.PutResponse) error {
+	return n.readWriteCmd("Put", &args.RequestHeader, args, reply)
+}
+
+// Increment .
+func (n *Node) Increment(args *storage.IncrementRequest, reply *storage.IncrementResponse) error {
+	return n.readWriteCmd("Increment", &args.RequestHeader, args, reply)
+}
+
+// Append .
+func (n *Node) Append(args *storage.AppendRequest, reply *storage.AppendResponse) error {
+	return n.readWriteCmd("Append", &args.RequestHeader, args, reply)
+}
+
+// GetByteRange .
+func (n *Node) GetByteRange(args *storage.GetByteRangeRequest, reply *storage.GetByteRangeResponse) error {
+	return n.readOnlyCmd("GetByteRange", &args.RequestHeader, args, reply)
+}
+
+// Delete .
+func (n *Node) Delete(args *storage.DeleteRequest, reply *storage.DeleteResponse) error {
+	return n.readWriteCmd("Delete", &args.RequestHeader, args, reply)
+}
+
+// DeleteRange .
+func (n *Node) DeleteRange(args *storage.DeleteRangeRequest, reply *storage.DeleteRangeResponse) error {
+	return n.readWriteCmd("DeleteRange", &args.RequestHeader, args, reply)
+}
+
+// Scan .
+func (n *Node) Scan(args *storage.ScanRequest, reply *storage.ScanResponse) error {
+	return n.readOnlyCmd("Scan", &args.RequestHeader, args, reply)
+}
+
+// EndTransaction ends the transaction and, once it has committed or
+// aborted, resolves its write intents asynchronously.
+func (n *Node) EndTransaction(args *storage.EndTransactionRequest, reply *storage.EndTransactionResponse) error {
+	if err := n.readWriteCmd("EndTransaction", &args.RequestHeader, args, reply); err != nil || args.Proxy {
+		return err
+	}
+	// A transaction which failed to commit because it was aborted
+	// leaves intents to remove.
+	_, aborted := reply.Error.(*storage.TransactionAbortedError)
+	if reply.Error == nil || aborted {
+		go n.resolveIntents(args.TxID, args.Keys, args.Commit && !aborted)
+	}
+	return nil
+}
+
+// resolveIntents resolves the write intents on keys of the ended
+// transaction txID and, once all are resolved, marks them resolved in
+// the transaction's record, so that it may be garbage collected.
+// Failures are logged: an unresolved intent is resolved by the next
+// request it blocks, which pushes the transaction and finds it ended,
+// and the resolution of a committed transaction is retried by garbage
+// collection; see garbageCollectRanges.
+func (n *Node) resolveIntents(txID string, keys []storage.Key, commit bool) {
+	resolved := true
+	for _, key := range keys {
+		reply := <-n.kvDB.InternalResolveIntent(&storage.InternalResolveIntentRequest{
+			Key:        key,
+			IntentTxID: txID,
+			Commit:     commit,
+		})
+		if reply.Error != nil {
+			glog.Warningf("failed to resolve write intent of transaction %q on %q: %v", txID, key, reply.Error)
+			resolved = false
+		}
+	}
+	if !resolved {
+		return
+	}
+	reply := <-n.kvDB.InternalTxnResolved(&storage.InternalTxnResolvedRequest{
+		Key:  storage.TxnRecordKey(txID),
+		TxID: txID,
+	})
+	if reply.Error != nil {
+		glog.Warningf("failed to mark intents of transaction %q resolved: %v", txID, reply.Error)
+	}
+}
+
+// AccumulateTS .
+func (n *Node) AccumulateTS(args *storage.AccumulateTSRequest, reply *storage.AccumulateTSResponse) error {
+	return n.readWriteCmd("AccumulateTS", &args.RequestHeader, args, reply)
+}
+
+// GetTSBlock .
+func (n *Node) GetTSBlock(args *storage.GetTSBlockRequest, reply *storage.GetTSBlockResponse) error {
+	return n.readOnlyCmd("GetTSBlock", &args.RequestHeader, args, reply)
+}
+
+// ReapQueue .
+func (n *Node) ReapQueue(args *storage.ReapQueueRequest, reply *storage.ReapQueueResponse) error {
+	return n.readWriteCmd("ReapQueue", &args.RequestHeader, args, reply)
+}
+
+// EnqueueUpdate .
+func (n *Node) EnqueueUpdate(args *storage.EnqueueUpdateRequest, reply *storage.EnqueueUpdateResponse) error {
+	return n.readWriteCmd("EnqueueUpdate", &args.RequestHeader, args, reply)
+}
+
+// EnqueueMessage .
+func (n *Node) EnqueueMessage(args *storage.EnqueueMessageRequest, reply *storage.EnqueueMessageResponse) error {
+	return n.readWriteCmd("EnqueueMessage", &args.RequestHeader, args, reply)
+}
+
+// AckQueue .
+func (n *Node) AckQueue(args *storage.AckQueueRequest, reply *storage.AckQueueResponse) error {
+	return n.readWriteCmd("AckQueue", &args.RequestHeader, args, reply)
+}
+
+// InternalRangeLookup .
+func (n *Node) InternalRangeLookup(args *storage.InternalRangeLookupRequest, reply *storage.InternalRangeLookupResponse) error {
+	return n.readOnlyCmd("InternalRangeLookup", &args.RequestHeader, args, reply)
+}
+
+// InternalResolvedTimestamp .
+func (n *Node) InternalResolvedTimestamp(args *storage.InternalResolvedTimestampRequest, reply *storage.InternalResolvedTimestampResponse) error {
+	return n.readOnlyCmd("InternalResolvedTimestamp", &args.RequestHeader, args, reply)
+}
+
+// InternalWatch is admitted like other requests but isn't scheduled,
+// as it spends most of its time waiting for events rather than
+// executing.
+func (n *Node) InternalWatch(args *storage.InternalWatchRequest, reply *storage.InternalWatchResponse) error {
+	release := n.admit(args, reply)
+	if release == nil {
+		return nil
+	}
+	defer release()
+	if args.Proxy {
+		return n.proxy("InternalWatch", args, reply)
+	}
+	rng, err := n.getRange(&args.Replica)
+	if err != nil {
+		return err
+	}
+	if !n.permitted(rng, "InternalWatch", args, reply, false) {
+		return nil
+	}
+	return rng.ReadOnlyCmd("InternalWatch", args, reply)
+}
+
+// InternalBulkWrite .
+func (n *Node) InternalBulkWrite(args *storage.InternalBulkWriteRequest, reply *storage.InternalBulkWriteResponse) error {
+	return n.readWriteCmd("InternalBulkWrite", &args.RequestHeader, args, reply)
+}
+
+// InternalPushTxn .
+func (n *Node) InternalPushTxn(args *storage.InternalPushTxnRequest, reply *storage.InternalPushTxnResponse) error {
+	return n.readWriteCmd("InternalPushTxn", &args.RequestHeader, args, reply)
+}
+
+// InternalResolveIntent .
+func (n *Node) InternalResolveIntent(args *storage.InternalResolveIntentRequest, reply *storage.InternalResolveIntentResponse) error {
+	return n.readWriteCmd("InternalResolveIntent", &args.RequestHeader, args, reply)
+}
+
+// InternalTxnResolved .
+func (n *Node) InternalTxnResolved(args *storage.InternalTxnResolvedRequest, reply *storage.InternalTxnResolvedResponse) error {
+	return n.readWriteCmd("InternalTxnResolved", &args.RequestHeader, args, reply)
+}
+
+// InternalRaftMessage delivers a raft message to the replica
+// specified by the argument header. Raft messages aren't subject to
+// the request budget, as the range's replicas can't make progress
+// without them.
+func (n *Node) InternalRaftMessage(args *storage.InternalRaftMessageRequest, reply *storage.InternalRaftMessageResponse) error {
+	rng, err := n.getRange(&args.Replica)
+	if err != nil {
+		return err
+	}
+	return rng.StepRaft(&args.Message)
+}
+
+// InternalSnapshotChunk returns a chunk of the raft snapshot of the
+// replica specified by the argument header, to a follower catching up
+// from the snapshot. Like raft messages, chunks aren't subject to the
+// request budget; they're paced by the store's snapshot throttle.
+func (n *Node) InternalSnapshotChunk(args *storage.InternalSnapshotChunkRequest, reply *storage.InternalSnapshotChunkResponse) error {
+	rng, err := n.getRange(&args.Replica)
+	if err != nil {
+		return err
+	}
+	rng.SnapshotChunk(args, reply)
+	if reply.Error != nil {
+		reply.Error = storage.NewGenericError(reply.Error)
+	}
+	return nil
+}
+
+// InternalChecksum returns the checksum of the data of the replica
+// specified by the argument header, as computed for a consistency
+// check. Like snapshot chunks, checksums aren't subject to the request
+// budget, and followers return them without holding the lease.
+func (n *Node) InternalChecksum(args *storage.InternalChecksumRequest, reply *storage.InternalChecksumResponse) error {
+	rng, err := n.getRange(&args.Replica)
+	if err != nil {
+		return err
+	}
+	rng.InternalChecksum(args, reply)
+	if reply.Error != nil {
+		reply.Error = storage.NewGenericError(reply.Error)
+	}
+	return nil
+}
+
+// InternalQuarantineReplica takes the replica specified by the
+// argument header offline for inspection, as its data has diverged
+// from that of the range's other replicas.
+func (n *Node) InternalQuarantineReplica(args *storage.InternalQuarantineReplicaRequest, reply *storage.InternalQuarantineReplicaResponse) error {
+	store, err := n.getStore(&args.Replica)
+	if err != nil {
+		return err
+	}
+	reply.Replica = args.Replica
+	if err := store.QuarantineReplica(args.Replica.RangeID); err != nil {
+		reply.Error = storage.NewGenericError(err)
+	}
+	return nil
+}
+
+// InternalCreateReplica creates an empty replica of a range on the
+// store specified by the argument header, which awaits a snapshot of
+// the range's data from its leader. Fails if another of the node's
+// stores already holds a replica of the range, as one left behind by
+// a failed replica change.
+func (n *Node) InternalCreateReplica(args *storage.InternalCreateReplicaRequest, reply *storage.InternalCreateReplicaResponse) error {
+	store, err := n.getStore(&args.Replica)
+	if err != nil {
+		return err
+	}
+	n.mu.RLock()
+	for storeID, other := range n.storeMap {
+		if storeID != args.Replica.StoreID && other.HasRangeStartingAt(args.StartKey) {
+			reply.Error = storage.NewGenericError(util.Errorf("store %s already holds a replica of the range beginning at %q", other, args.StartKey))
+		}
+	}
+	n.mu.RUnlock()
+	if reply.Error != nil {
+		return nil
+	}
+	if reply.Replica, err = store.CreateReplica(args.StartKey, args.EndKey, args.Replicas); err != nil {
+		reply.Error = storage.NewGenericError(err)
+	}
+	return nil
+}
+
+// InternalAllocateRangeID allocates a range ID on the store specified
+// by the argument header, for its replica of a range being split from
+// one of its ranges.
+func (n *Node) InternalAllocateRangeID(args *storage.InternalAllocateRangeIDRequest, reply *storage.InternalAllocateRangeIDResponse) error {
+	store, err := n.getStore(&args.Replica)
+	if err != nil {
+		return err
+	}
+	reply.Replica = args.Replica
+	if reply.RangeID, err = store.AllocateRangeID(); err != nil {
+		reply.Error = storage.NewGenericError(err)
+	}
+	return nil
+}
+
+// InternalRemoveReplica removes the replica specified by the argument
+// header, and its data, from its store.
+func (n *Node) InternalRemoveReplica(args *storage.InternalRemoveReplicaRequest, reply *storage.InternalRemoveReplicaResponse) error {
+	store, err := n.getStore(&args.Replica)
+	if err != nil {
+		return err
+	}
+	reply.Replica = args.Replica
+	if err := store.RemoveReplica(args.Replica.RangeID); err != nil {
+		reply.Error = storage.NewGenericError(err)
+	}
+	return nil
+}
+
+// InternalDebugScan returns the raw contents of the engine of the
+// store holding args.Replica, which must identify an existing range.
+// Requests are rejected unless the node was started with
+// --enable_debug_scan, as they bypass the permissions of the keys
+// they read.
+func (n *Node) InternalDebugScan(args *storage.InternalDebugScanRequest, reply *storage.InternalDebugScanResponse) error {
+	if !*enableDebugScan {
+		reply.Error = &storage.GenericError{Message: "debug scans are disabled; start the node with --enable_debug_scan"}
+		return nil
+	}
+	release := n.admit(args, reply)
+	if release == nil {
+		return nil
+	}
+	defer release()
+	store, err := n.getStore(&args.Replica)
+	if err != nil {
+		return err
+	}
+	if _, err := store.GetRange(args.Replica.RangeID); err != nil {
+		return err
+	}
+	if args.MaxResults <= 0 || args.MaxResults > maxDebugScanResults {
+		args.MaxResults = maxDebugScanResults
+	}
+	reply.Replica = args.Replica
+	reply.Rows, err = store.DebugScan(args.StartKey, args.EndKey, args.MaxResults)
+	if err != nil {
+		reply.Error = storage.NewGenericError(err)
+	}
+	return nil
+}
+
+// AdminSplit splits the range specified by the replica in the
+// argument header at args.SplitKey and then updates the range
+// addressing records for both halves. Split failures are set in the
+// reply and are final. Failures to update addressing are returned so
+// the client retries; the retried split finds the range already
+// split and resumes with the addressing updates.
+func (n *Node) AdminSplit(args *storage.AdminSplitRequest, reply *storage.AdminSplitResponse) error {
+	if args.Proxy {
+		return n.proxy("AdminSplit", args, reply)
+	}
+	store, err := n.getStore(&args.Replica)
+	if err != nil {
+		return err
+	}
+	reply.Replica = args.Replica
+	newRng, err := n.splitRange(store, args.Replica.RangeID, args.SplitKey)
+	if err != nil {
+		reply.Error = storage.NewGenericError(err)
+		return nil
+	}
+	if err := n.addressSplit(store, args.Replica.RangeID, newRng); err != nil {
+		return err
+	}
+	reply.NewRange = newRng.Metadata().Replicas
+	return nil
+}
+
+// splitRange splits the range with rangeID on store at splitKey. The
+// new range's range IDs are first allocated on the stores of each of
+// the range's replicas, so a range with a replica on an unreachable
+// node can't split until the replica is replaced.
+func (n *Node) splitRange(store *storage.Store, rangeID int64, splitKey storage.Key) (*storage.Range, error) {
+	rng, err := store.GetRange(rangeID)
+	if err != nil {
+		return nil, err
+	}
+	meta := rng.Metadata()
+	if bytes.Equal(meta.EndKey, splitKey) {
+		// A retried split finds the range already split.
+		return store.SplitRange(rangeID, splitKey, nil)
+	}
+	var newReplicas []storage.Replica
+	for _, replica := range meta.Replicas.Replicas {
+		if replica.RangeID, err = n.allocateRangeID(replica); err != nil {
+			return nil, err
+		}
+		newReplicas = append(newReplicas, replica)
+	}
+	return store.SplitRange(rangeID, splitKey, newReplicas)
+}
+
+// allocateRangeID allocates a range ID on the store of replica, on
+// this node or another.
+func (n *Node) allocateRangeID(replica storage.Replica) (int64, error) {
+	n.mu.RLock()
+	store, ok := n.storeMap[replica.StoreID]
+	local := ok && replica.NodeID == n.Attributes.NodeID
+	n.mu.RUnlock()
+	if local {
+		return store.AllocateRangeID()
+	}
+	args := &storage.InternalAllocateRangeIDRequest{RequestHeader: storage.RequestHeader{Replica: replica}}
+	reply := &storage.InternalAllocateRangeIDResponse{}
+	if err := n.sendToNode(replica.NodeID, "Node.InternalAllocateRangeID", args, reply); err != nil {
+		return 0, err
+	}
+	if reply.Error != nil {
+		return 0, reply.Error
+	}
+	return reply.RangeID, nil
+}
+
+// addressSplit updates the range addressing records for both halves
+// of the range with rangeID on store, following its split into newRng.
+func (n *Node) addressSplit(store *storage.Store, rangeID int64, newRng *storage.Range) error {
+	rng, err := store.GetRange(rangeID)
+	if err != nil {
+		return err
+	}
+	// Address the new range first; until the original range's record
+	// is updated, requests for the split keys continue to be routed to
+	// the original range, which shares the store's engine.
+	newMeta, meta := newRng.Metadata(), rng.Metadata()
+	if err := kv.UpdateRangeLocations(n.kvDB, newMeta, newMeta.Replicas); err != nil {
+		return err
+	}
+	return kv.UpdateRangeLocations(n.kvDB, meta, meta.Replicas)
+}
+
+// AdminMerge merges the range specified by the replica in the
+// argument header with the range which follows it and then updates
+// the range addressing records. A retried merge would subsume yet
+// another range, so all failures are set in the reply and are final.
+func (n *Node) AdminMerge(args *storage.AdminMergeRequest, reply *storage.AdminMergeResponse) error {
+	if args.Proxy {
+		return n.proxy("AdminMerge", args, reply)
+	}
+	store, err := n.getStore(&args.Replica)
+	if err != nil {
+		return err
+	}
+	reply.Replica = args.Replica
+	if err := n.mergeRange(store, args.Replica.RangeID); err != nil {
+		reply.Error = storage.NewGenericError(err)
+	}
+	return nil
+}
+
+// AdminTransferLease transfers the lease of the range specified by
+// the replica in the argument header to args.Target. Unless the
+// replica holds the lease, or can acquire it as the leader, the
+// request is redirected.
+func (n *Node) AdminTransferLease(args *storage.AdminTransferLeaseRequest, reply *storage.AdminTransferLeaseResponse) error {
+	if args.Proxy {
+		return n.proxy("AdminTransferLease", args, reply)
+	}
+	store, err := n.getStore(&args.Replica)
+	if err != nil {
+		return err
+	}
+	rng, err := store.GetRange(args.Replica.RangeID)
+	if err != nil {
+		return err
+	}
+	reply.Replica = args.Replica
+	lease, err := rng.TransferLease(args.Target)
+	switch err.(type) {
+	case nil:
+		reply.Lease = lease
+	case *storage.NotLeaderError, *storage.NotLeaseHolderError:
+		reply.Error = err
+	default:
+		reply.Error = storage.NewGenericError(err)
+	}
+	return nil
+}
+
+// AdminCompact deletes the rows hidden by range tombstones in a span
+// of the range specified by the replica in the argument header and
+// compacts the span's storage on the replica's store. Clients send
+// the request to each of the range's replicas.
+func (n *Node) AdminCompact(args *storage.AdminCompactRequest, reply *storage.AdminCompactResponse) error {
+	if args.Proxy {
+		return n.proxy("AdminCompact", args, reply)
+	}
+	store, err := n.getStore(&args.Replica)
+	if err != nil {
+		return err
+	}
+	rng, err := store.GetRange(args.Replica.RangeID)
+	if err != nil {
+		return err
+	}
+	reply.Replica = args.Replica
+	if reply.RowsCompacted, err = rng.Compact(args.StartKey, args.EndKey); err != nil {
+		reply.Error = storage.NewGenericError(err)
+	}
+	return nil
+}
+
+// mergeRange merges the specified range with its successor on store
+// and updates the range addressing records.
+func (n *Node) mergeRange(store *storage.Store, rangeID int64) error {
+	rng, err := store.GetRange(rangeID)
+	if err != nil {
+		return err
+	}
+	oldEndKey := rng.Metadata().EndKey
+	if _, err := store.MergeRange(rangeID); err != nil {
+		return err
+	}
+	// Point the subsumed range's record at the merged range before
+	// removing the merged range's old record.
+	meta := rng.Metadata()
+	if err := kv.UpdateRangeLocations(n.kvDB, meta, meta.Replicas); err != nil {
+		return err
+	}
+	dr := <-n.kvDB.Delete(&storage.DeleteRequest{Key: storage.MakeKey(storage.KeyMeta2Prefix, oldEndKey)})
+	return dr.Error
 }
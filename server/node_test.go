@@ -20,6 +20,7 @@ package server
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"math"
 	"net"
 	"reflect"
@@ -31,6 +32,7 @@ import (
 	"github.com/cockroachdb/cockroach/rpc"
 	"github.com/cockroachdb/cockroach/storage"
 	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/protobuf"
 )
 
 // createTestNode creates an rpc server using the specified address,
@@ -52,7 +54,7 @@ func createTestNode(addr net.Addr, engines []storage.Engine, gossipBS net.Addr,
 		g.SetBootstrap([]net.Addr{gossipBS})
 		g.Start(rpcServer)
 	}
-	db := kv.NewDB(g)
+	db := kv.NewDBWithOptions(g, kv.DistDBOptions{Internal: true})
 	node := NewNode(db, g)
 	if err := node.start(rpcServer, engines); err != nil {
 		t.Fatal(err)
@@ -92,6 +94,7 @@ func TestBootstrapCluster(t *testing.T) {
 	var expectedKeys = []storage.Key{
 		storage.Key("\x00\x00\x00range-1"),
 		storage.Key("\x00\x00\x00range-id-generator"),
+		storage.Key("\x00\x00\x00stats-1"),
 		storage.Key("\x00\x00\x00store-ident"),
 		storage.Key("\x00\x00meta1\xff"),
 		storage.Key("\x00\x00meta2\xff"),
@@ -134,6 +137,41 @@ func TestBootstrapNewStore(t *testing.T) {
 	}
 }
 
+// TestNodeCreateReplicaOnOneStore verifies a node refuses to create a
+// replica of a range on one of its stores while another holds one.
+func TestNodeCreateReplicaOnOneStore(t *testing.T) {
+	engine := storage.NewInMem(1 << 20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	server, node := createTestNode(util.CreateTestAddr("tcp"), []storage.Engine{engine, storage.NewInMem(1 << 20)}, nil, t)
+	defer server.Close()
+	if err := util.IsTrueWithin(func() bool { return node.getStoreCount() == 2 }, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	var replica storage.Replica
+	node.mu.RLock()
+	for storeID := range node.storeMap {
+		if storeID != 1 {
+			replica = storage.Replica{NodeID: node.Attributes.NodeID, StoreID: storeID}
+		}
+	}
+	node.mu.RUnlock()
+	args := &storage.InternalCreateReplicaRequest{
+		RequestHeader: storage.RequestHeader{Replica: replica},
+		StartKey:      storage.KeyMin,
+		EndKey:        storage.KeyMax,
+		Replicas:      []storage.Replica{replica},
+	}
+	reply := &storage.InternalCreateReplicaResponse{}
+	if err := node.InternalCreateReplica(args, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Error == nil {
+		t.Error("expected error creating a second replica of the first range on the node")
+	}
+}
+
 // TestNodeJoin verifies a new node is able to join a bootstrapped
 // cluster consisting of one node.
 func TestNodeJoin(t *testing.T) {
@@ -160,21 +198,1092 @@ func TestNodeJoin(t *testing.T) {
 	}
 
 	// Verify node1 sees node2 via gossip and vice versa.
-	node1Key := gossip.MakeNodeIDGossipKey(node1.Attributes.NodeID)
-	node2Key := gossip.MakeNodeIDGossipKey(node2.Attributes.NodeID)
 	if err := util.IsTrueWithin(func() bool {
-		if val, err := node1.gossip.GetInfo(node2Key); err != nil {
+		if addr, err := node1.gossip.GetNodeAddr(node2.Attributes.NodeID); err != nil {
 			return false
-		} else if val.(net.Addr).String() != server2.Addr().String() {
-			t.Error("addr2 gossip %s doesn't match addr2 address %s", val.(net.Addr).String(), server2.Addr().String())
+		} else if addr.String() != server2.Addr().String() {
+			t.Errorf("addr2 gossip %s doesn't match addr2 address %s", addr, server2.Addr())
 		}
-		if val, err := node2.gossip.GetInfo(node1Key); err != nil {
+		if addr, err := node2.gossip.GetNodeAddr(node1.Attributes.NodeID); err != nil {
 			return false
-		} else if val.(net.Addr).String() != server1.Addr().String() {
-			t.Error("addr1 gossip %s doesn't match addr1 address %s", val.(net.Addr).String(), server1.Addr().String())
+		} else if addr.String() != server1.Addr().String() {
+			t.Errorf("addr1 gossip %s doesn't match addr1 address %s", addr, server1.Addr())
 		}
 		return true
 	}, 50*time.Millisecond); err != nil {
 		t.Error(err)
 	}
 }
+
+// TestNodeGossipStores verifies each node gossips the descriptors of
+// its stores, which other nodes learn of.
+func TestNodeGossipStores(t *testing.T) {
+	engine := storage.NewInMem(1 << 20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	*gossip.GossipInterval = 10 * time.Millisecond
+	addr1 := util.CreateTestAddr("tcp")
+	server1, node1 := createTestNode(addr1, []storage.Engine{engine}, addr1, t)
+	defer server1.Close()
+	server2, node2 := createTestNode(util.CreateTestAddr("tcp"), []storage.Engine{storage.NewInMem(1 << 20)}, server1.Addr(), t)
+	defer server2.Close()
+	if err := util.IsTrueWithin(func() bool { return node2.getStoreCount() == 1 }, 1*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	node1.gossipStores()
+	node2.gossipStores()
+
+	var desc storage.StoreDescriptor
+	if err := util.IsTrueWithin(func() bool {
+		info, err := node2.gossip.GetInfo(gossip.MakeStoreKey(node1.Attributes.NodeID, 1))
+		if err != nil {
+			return false
+		}
+		desc = info.(storage.StoreDescriptor)
+		return true
+	}, 1*time.Second); err != nil {
+		t.Fatal("expected node 2 to learn of node 1's store")
+	}
+	if desc.Node.NodeID != node1.Attributes.NodeID || desc.RangeCount != 1 || desc.Capacity.Capacity != 1<<20 {
+		t.Errorf("unexpected store descriptor %+v", desc)
+	}
+	if err := util.IsTrueWithin(func() bool {
+		stores, err := node2.gossip.GetGroupInfos(gossip.KeyStorePrefix)
+		return err == nil && len(stores) == 2
+	}, 1*time.Second); err != nil {
+		t.Error("expected node 2 to learn of both stores")
+	}
+}
+
+// TestNodeTracing verifies requests sent via a node's DistDB are
+// traced, including the replica which served them.
+func TestNodeTracing(t *testing.T) {
+	engine := storage.NewInMem(1 << 20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	addr := util.CreateTestAddr("tcp")
+	server, node := createTestNode(addr, []storage.Engine{engine}, addr, t)
+	defer server.Close()
+
+	pr := <-node.kvDB.Put(&storage.PutRequest{Key: storage.Key("a"), Value: storage.Value{Bytes: []byte("value")}})
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	metrics := node.kvDB.(*kv.DistDB).Metrics().Snapshot()
+	if mm, ok := metrics.Methods["Node.Put"]; !ok || mm.Latency.Count == 0 || mm.Errors != 0 {
+		t.Errorf("expected successful puts in metrics; got %+v", mm)
+	}
+	if metrics.RangeLookups.Count == 0 {
+		t.Error("expected range lookups in metrics")
+	}
+	for storeID := range node.storeMap {
+		replica := fmt.Sprintf("%d/%d", node.Attributes.NodeID, storeID)
+		if metrics.Replicas[replica] == 0 {
+			t.Errorf("expected requests served by replica %s; got %v", replica, metrics.Replicas)
+		}
+	}
+}
+
+// TestNodeAdminSplitAndMerge verifies a client can split a range and
+// merge it back, with requests routed to the correct range throughout.
+func TestNodeAdminSplitAndMerge(t *testing.T) {
+	engine := storage.NewInMem(1 << 20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	addr := util.CreateTestAddr("tcp")
+	server, node := createTestNode(addr, []storage.Engine{engine}, addr, t)
+	defer server.Close()
+	db := node.kvDB
+
+	sr := <-db.AdminSplit(&storage.AdminSplitRequest{SplitKey: storage.Key("m")})
+	if sr.Error != nil {
+		t.Fatal(sr.Error)
+	}
+	if !bytes.Equal(sr.NewRange.StartKey, storage.Key("m")) {
+		t.Errorf("expected new range to start at \"m\"; got %q", sr.NewRange.StartKey)
+	}
+	newRangeID := sr.NewRange.Replicas[0].RangeID
+
+	// Write keys on both sides of the split and verify each was
+	// served by the correct range.
+	for _, test := range []struct {
+		key     storage.Key
+		rangeID int64
+	}{
+		{storage.Key("a"), 1},
+		{storage.Key("z"), newRangeID},
+	} {
+		pr := <-db.Put(&storage.PutRequest{Key: test.key, Value: storage.Value{Bytes: []byte("value")}})
+		if pr.Error != nil {
+			t.Fatal(pr.Error)
+		}
+		if pr.Replica.RangeID != test.rangeID {
+			t.Errorf("expected key %q written to range %d; got %d", test.key, test.rangeID, pr.Replica.RangeID)
+		}
+	}
+
+	mr := <-db.AdminMerge(&storage.AdminMergeRequest{Key: storage.Key("a")})
+	if mr.Error != nil {
+		t.Fatal(mr.Error)
+	}
+	gr := <-db.Get(&storage.GetRequest{Key: storage.Key("z")})
+	if gr.Error != nil {
+		t.Fatal(gr.Error)
+	}
+	if !bytes.Equal(gr.Value.Bytes, []byte("value")) || gr.Replica.RangeID != 1 {
+		t.Errorf("expected key \"z\" read from merged range 1; got %q from range %d", gr.Value.Bytes, gr.Replica.RangeID)
+	}
+}
+
+// TestNodeAdminCompact verifies a client can compact a span of a
+// range after deleting it.
+func TestNodeAdminCompact(t *testing.T) {
+	engine := storage.NewInMem(1 << 20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	addr := util.CreateTestAddr("tcp")
+	server, node := createTestNode(addr, []storage.Engine{engine}, addr, t)
+	defer server.Close()
+	db := node.kvDB
+
+	if err := kv.PutI(db, storage.Key("a"), "value"); err != nil {
+		t.Fatal(err)
+	}
+	dr := <-db.DeleteRange(&storage.DeleteRangeRequest{StartKey: storage.Key("a"), EndKey: storage.Key("b")})
+	if dr.Error != nil || dr.NumDeleted != 1 {
+		t.Fatalf("expected 1 row deleted; got %d, %v", dr.NumDeleted, dr.Error)
+	}
+	cr := <-db.AdminCompact(&storage.AdminCompactRequest{StartKey: storage.Key("a"), EndKey: storage.Key("b")})
+	if cr.Error != nil {
+		t.Fatal(cr.Error)
+	}
+	gr := <-db.Get(&storage.GetRequest{Key: storage.Key("a")})
+	if gr.Error != nil || gr.Value.Bytes != nil {
+		t.Errorf("expected key \"a\" to remain deleted; got %q, %v", gr.Value.Bytes, gr.Error)
+	}
+}
+
+// TestNodeFollowRangeChanges verifies a client following range
+// changes routes requests to the range split off from a range whose
+// location it cached, without any request failing.
+func TestNodeFollowRangeChanges(t *testing.T) {
+	engine := storage.NewInMem(1 << 20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	addr := util.CreateTestAddr("tcp")
+	server, node := createTestNode(addr, []storage.Engine{engine}, addr, t)
+	defer server.Close()
+	db := kv.NewDBWithOptions(node.gossip, kv.DistDBOptions{FollowRangeChanges: true})
+	defer db.Close()
+
+	put := func(key string) int64 {
+		pr := <-db.Put(&storage.PutRequest{Key: storage.Key(key), Value: storage.Value{Bytes: []byte("value")}})
+		if pr.Error != nil {
+			t.Fatal(pr.Error)
+		}
+		return pr.Replica.RangeID
+	}
+	if rangeID := put("z"); rangeID != 1 {
+		t.Fatalf("expected key \"z\" written to range 1; got %d", rangeID)
+	}
+	sr := <-node.kvDB.AdminSplit(&storage.AdminSplitRequest{SplitKey: storage.Key("m")})
+	if sr.Error != nil {
+		t.Fatal(sr.Error)
+	}
+	newRangeID := sr.NewRange.Replicas[0].RangeID
+	if err := util.IsTrueWithin(func() bool { return put("z") == newRangeID }, 5*time.Second); err != nil {
+		t.Errorf("expected key \"z\" to be routed to new range %d", newRangeID)
+	}
+}
+
+// TestNodeMergeUnderfullRanges verifies adjacent ranges below their
+// zone's minimum size are merged and requests routed to the merged
+// range afterwards.
+func TestNodeMergeUnderfullRanges(t *testing.T) {
+	engine := storage.NewInMem(1 << 20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	addr := util.CreateTestAddr("tcp")
+	server, node := createTestNode(addr, []storage.Engine{engine}, addr, t)
+	defer server.Close()
+	db := node.kvDB
+
+	sr := <-db.AdminSplit(&storage.AdminSplitRequest{SplitKey: storage.Key("m")})
+	if sr.Error != nil {
+		t.Fatal(sr.Error)
+	}
+	pr := <-db.Put(&storage.PutRequest{Key: storage.Key("z"), Value: storage.Value{Bytes: []byte("value")}})
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	// Rewriting the default zone config gossips it.
+	zone := &storage.ZoneConfig{RangeMinBytes: 1 << 20, RangeMaxBytes: 64 << 20}
+	if err := kv.PutI(db, storage.MakeKey(storage.KeyConfigZonePrefix, storage.KeyMin), zone); err != nil {
+		t.Fatal(err)
+	}
+	newRangeID := sr.NewRange.Replicas[0].RangeID
+	if err := util.IsTrueWithin(func() bool {
+		node.mergeUnderfullRanges()
+		_, err := node.storeMap[1].GetRange(newRangeID)
+		return err != nil
+	}, 1*time.Second); err != nil {
+		t.Fatal("expected ranges to be merged")
+	}
+	gr := <-db.Get(&storage.GetRequest{Key: storage.Key("z")})
+	if gr.Error != nil {
+		t.Fatal(gr.Error)
+	}
+	if !bytes.Equal(gr.Value.Bytes, []byte("value")) || gr.Replica.RangeID != 1 {
+		t.Errorf("expected key \"z\" read from merged range 1; got %q from range %d", gr.Value.Bytes, gr.Replica.RangeID)
+	}
+}
+
+// TestNodeRebalanceReplicas verifies a range is replicated to another
+// node's store to satisfy its zone config, after which writes to the
+// range are replicated to the new replica.
+func TestNodeRebalanceReplicas(t *testing.T) {
+	engine := storage.NewInMem(1 << 20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	*gossip.GossipInterval = 10 * time.Millisecond
+	addr1 := util.CreateTestAddr("tcp")
+	server1, node1 := createTestNode(addr1, []storage.Engine{engine}, addr1, t)
+	defer server1.Close()
+	server2, node2 := createTestNode(util.CreateTestAddr("tcp"), []storage.Engine{storage.NewInMem(1 << 20)}, server1.Addr(), t)
+	defer server2.Close()
+	if err := util.IsTrueWithin(func() bool { return node2.getStoreCount() == 1 }, 1*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	db := node1.kvDB
+	pr := <-db.Put(&storage.PutRequest{Key: storage.Key("a"), Value: storage.Value{Bytes: []byte("value")}})
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	// Rewriting the default zone config gossips it.
+	zone := &storage.ZoneConfig{
+		Replicas:      map[string][]string{"": []string{"MEM", "MEM"}},
+		RangeMinBytes: 1 << 20,
+		RangeMaxBytes: 64 << 20,
+	}
+	if err := kv.PutI(db, storage.MakeKey(storage.KeyConfigZonePrefix, storage.KeyMin), zone); err != nil {
+		t.Fatal(err)
+	}
+	node1.gossipStores()
+	node2.gossipStores()
+	if err := util.IsTrueWithin(func() bool {
+		stores, err := node1.gossip.GetGroupInfos(gossip.KeyStorePrefix)
+		_, addrErr := node1.gossip.GetInfo(gossip.MakeNodeIDGossipKey(node2.Attributes.NodeID))
+		return err == nil && len(stores) == 2 && addrErr == nil
+	}, 1*time.Second); err != nil {
+		t.Fatal("expected node 1 to learn of node 2's store")
+	}
+
+	if err := util.IsTrueWithin(func() bool {
+		node1.rebalanceReplicas()
+		rng, err := node1.storeMap[1].GetRange(1)
+		return err == nil && len(rng.Metadata().Replicas.Replicas) == 2
+	}, 1*time.Second); err != nil {
+		t.Fatal("expected range to be replicated to node 2")
+	}
+	pr = <-db.Put(&storage.PutRequest{Key: storage.Key("b"), Value: storage.Value{Bytes: []byte("value")}})
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	var store2 *storage.Store
+	for _, store := range node2.storeMap {
+		store2 = store
+	}
+	if err := util.IsTrueWithin(func() bool {
+		rows, err := store2.DebugScan(storage.Key("a"), storage.Key("c"), 0)
+		return err == nil && len(rows) == 2
+	}, 1*time.Second); err != nil {
+		t.Error("expected keys written before and after the change to be replicated to node 2")
+	}
+}
+
+// TestNodeSplitAndMergeReplicatedRange verifies a range with a
+// replica on another node splits and merges on both nodes, and that
+// the resulting ranges' writes are replicated.
+func TestNodeSplitAndMergeReplicatedRange(t *testing.T) {
+	engine := storage.NewInMem(1 << 20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	*gossip.GossipInterval = 10 * time.Millisecond
+	addr1 := util.CreateTestAddr("tcp")
+	server1, node1 := createTestNode(addr1, []storage.Engine{engine}, addr1, t)
+	defer server1.Close()
+	server2, node2 := createTestNode(util.CreateTestAddr("tcp"), []storage.Engine{storage.NewInMem(1 << 20)}, server1.Addr(), t)
+	defer server2.Close()
+	if err := util.IsTrueWithin(func() bool { return node2.getStoreCount() == 1 }, 1*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := util.IsTrueWithin(func() bool {
+		_, err := node1.gossip.GetInfo(gossip.MakeNodeIDGossipKey(node2.Attributes.NodeID))
+		return err == nil
+	}, 1*time.Second); err != nil {
+		t.Fatal("expected node 1 to learn of node 2")
+	}
+	store1 := node1.storeMap[1]
+	var store2 *storage.Store
+	for _, store := range node2.storeMap {
+		store2 = store
+	}
+	change := storage.ReplicaChange{RangeID: 1, Add: []storage.Replica{{NodeID: store2.Ident.NodeID, StoreID: store2.Ident.StoreID}}}
+	if err := node1.changeReplicas(store1, change); err != nil {
+		t.Fatal(err)
+	}
+
+	newRng, err := node1.splitRange(store1, 1, storage.Key("m"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := node1.addressSplit(store1, 1, newRng); err != nil {
+		t.Fatal(err)
+	}
+	if replicas := newRng.Metadata().Replicas.Replicas; len(replicas) != 2 {
+		t.Fatalf("expected new range to have 2 replicas; got %+v", replicas)
+	}
+	if err := util.IsTrueWithin(func() bool {
+		return store2.RangeCount() == 2 && store2.HasRangeStartingAt(storage.Key("m"))
+	}, 1*time.Second); err != nil {
+		t.Fatal("expected range to split on node 2")
+	}
+	pr := <-node1.kvDB.Put(&storage.PutRequest{Key: storage.Key("n"), Value: storage.Value{Bytes: []byte("value")}})
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	if err := util.IsTrueWithin(func() bool {
+		rows, err := store2.DebugScan(storage.Key("n"), storage.Key("o"), 0)
+		return err == nil && len(rows) == 1
+	}, 1*time.Second); err != nil {
+		t.Error("expected write to new range to be replicated to node 2")
+	}
+
+	if err := util.IsTrueWithin(newRng.IsLeader, 1*time.Second); err != nil {
+		t.Fatal("expected node 1 to lead the new range")
+	}
+	if err := node1.mergeRange(store1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := util.IsTrueWithin(func() bool {
+		return store2.RangeCount() == 1 && !store2.HasRangeStartingAt(storage.Key("m"))
+	}, 1*time.Second); err != nil {
+		t.Fatal("expected ranges to merge on node 2")
+	}
+	pr = <-node1.kvDB.Put(&storage.PutRequest{Key: storage.Key("p"), Value: storage.Value{Bytes: []byte("value")}})
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	if err := util.IsTrueWithin(func() bool {
+		rows, err := store2.DebugScan(storage.Key("n"), storage.Key("q"), 0)
+		return err == nil && len(rows) == 2
+	}, 1*time.Second); err != nil {
+		t.Error("expected merged range's data and writes to be replicated to node 2")
+	}
+}
+
+// TestNodeRemoveStaleReplicas verifies replicas created for a replica
+// change which fails are removed, as are replicas missing from their
+// ranges' addressing records on two successive checks.
+func TestNodeRemoveStaleReplicas(t *testing.T) {
+	engine := storage.NewInMem(1 << 20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	*gossip.GossipInterval = 10 * time.Millisecond
+	addr1 := util.CreateTestAddr("tcp")
+	server1, node1 := createTestNode(addr1, []storage.Engine{engine}, addr1, t)
+	defer server1.Close()
+	server2, node2 := createTestNode(util.CreateTestAddr("tcp"), []storage.Engine{storage.NewInMem(1 << 20)}, server1.Addr(), t)
+	defer server2.Close()
+	if err := util.IsTrueWithin(func() bool { return node2.getStoreCount() == 1 }, 1*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := util.IsTrueWithin(func() bool {
+		_, err := node1.gossip.GetInfo(gossip.MakeNodeIDGossipKey(node2.Attributes.NodeID))
+		return err == nil
+	}, 1*time.Second); err != nil {
+		t.Fatal("expected node 1 to learn of node 2")
+	}
+	store1 := node1.storeMap[1]
+	var store2 *storage.Store
+	for _, store := range node2.storeMap {
+		store2 = store
+	}
+
+	// The change fails to create a replica on an unknown node.
+	change := storage.ReplicaChange{
+		RangeID: 1,
+		Add: []storage.Replica{
+			{NodeID: store2.Ident.NodeID, StoreID: store2.Ident.StoreID},
+			{NodeID: 99, StoreID: 1},
+		},
+	}
+	if err := node1.changeReplicas(store1, change); err == nil {
+		t.Fatal("expected change adding a replica on an unknown node to fail")
+	}
+	if count := store2.RangeCount(); count != 0 {
+		t.Errorf("expected replica created for failed change to be removed; store 2 has %d ranges", count)
+	}
+
+	// A replica the range's addressing records don't list is removed
+	// on the second check.
+	rng, err := store1.GetRange(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replicas := append(rng.Metadata().Replicas.Replicas, storage.Replica{NodeID: store2.Ident.NodeID, StoreID: store2.Ident.StoreID})
+	if _, err := store2.CreateReplica(storage.KeyMin, storage.KeyMax, replicas); err != nil {
+		t.Fatal(err)
+	}
+	stale := map[storage.Replica]struct{}{}
+	node2.removeStaleReplicas(store2, stale)
+	if count := store2.RangeCount(); count != 1 {
+		t.Fatalf("expected replica to survive first check; store 2 has %d ranges", count)
+	}
+	node2.staleReplicas = stale
+	node2.removeStaleReplicas(store2, map[storage.Replica]struct{}{})
+	if count := store2.RangeCount(); count != 0 {
+		t.Errorf("expected stale replica to be removed; store 2 has %d ranges", count)
+	}
+	if count := store1.RangeCount(); count != 1 {
+		t.Errorf("expected leader's replica to remain; store 1 has %d ranges", count)
+	}
+}
+
+// TestNodeQuorumRead verifies a quorum read compares the values of a
+// range's replicas, reporting divergence once a replica's data is
+// made to disagree.
+func TestNodeQuorumRead(t *testing.T) {
+	engine := storage.NewInMem(1 << 20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	*gossip.GossipInterval = 10 * time.Millisecond
+	addr1 := util.CreateTestAddr("tcp")
+	server1, node1 := createTestNode(addr1, []storage.Engine{engine}, addr1, t)
+	defer server1.Close()
+	server2, node2 := createTestNode(util.CreateTestAddr("tcp"), []storage.Engine{storage.NewInMem(1 << 20)}, server1.Addr(), t)
+	defer server2.Close()
+	if err := util.IsTrueWithin(func() bool { return node2.getStoreCount() == 1 }, 1*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	db := node1.kvDB.(*kv.DistDB)
+	zone := &storage.ZoneConfig{
+		Replicas:      map[string][]string{"": []string{"MEM", "MEM"}},
+		RangeMinBytes: 1 << 20,
+		RangeMaxBytes: 64 << 20,
+	}
+	if err := kv.PutI(db, storage.MakeKey(storage.KeyConfigZonePrefix, storage.KeyMin), zone); err != nil {
+		t.Fatal(err)
+	}
+	node1.gossipStores()
+	node2.gossipStores()
+	if err := util.IsTrueWithin(func() bool {
+		stores, err := node1.gossip.GetGroupInfos(gossip.KeyStorePrefix)
+		_, addrErr := node1.gossip.GetInfo(gossip.MakeNodeIDGossipKey(node2.Attributes.NodeID))
+		return err == nil && len(stores) == 2 && addrErr == nil
+	}, 1*time.Second); err != nil {
+		t.Fatal("expected node 1 to learn of node 2's store")
+	}
+	if err := util.IsTrueWithin(func() bool {
+		node1.rebalanceReplicas()
+		rng, err := node1.storeMap[1].GetRange(1)
+		return err == nil && len(rng.Metadata().Replicas.Replicas) == 2
+	}, 1*time.Second); err != nil {
+		t.Fatal("expected range to be replicated to node 2")
+	}
+	pr := <-db.Put(&storage.PutRequest{Key: storage.Key("a"), Value: storage.Value{Bytes: []byte("value")}})
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	var read *kv.QuorumRead
+	if err := util.IsTrueWithin(func() bool {
+		var err error
+		read, err = db.QuorumGet(&storage.GetRequest{Key: storage.Key("a")})
+		return err == nil && !read.Divergent
+	}, 1*time.Second); err != nil {
+		t.Fatalf("expected replicas to agree; got %+v", read)
+	}
+	if len(read.Replies) != 2 || !bytes.Equal(read.Reply.Value.Bytes, []byte("value")) {
+		t.Fatalf("expected \"value\" read from both replicas; got %+v", read)
+	}
+
+	// Overwrite node 2's replica directly, bypassing raft.
+	var rng2 *storage.Range
+	for _, store := range node2.storeMap {
+		rng2, _ = store.GetRange(1)
+	}
+	if rng2 == nil {
+		t.Fatal("expected node 2 to hold a replica of range 1")
+	}
+	newer := storage.Value{Bytes: []byte("diverged"), Timestamp: time.Now().UnixNano()}
+	pr = &storage.PutResponse{}
+	rng2.Put(&storage.PutRequest{Key: storage.Key("a"), Value: newer}, pr)
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	read, err := db.QuorumGet(&storage.GetRequest{Key: storage.Key("a")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !read.Divergent || !bytes.Equal(read.Reply.Value.Bytes, newer.Bytes) {
+		t.Errorf("expected divergent read returning the newest value; got %+v", read)
+	}
+	if db.Metrics().Snapshot().Divergences == 0 {
+		t.Error("expected divergence to be counted")
+	}
+}
+
+// TestNodeWarmUp verifies a client resolves each range overlapping
+// the hot spans it declares.
+func TestNodeWarmUp(t *testing.T) {
+	engine := storage.NewInMem(1 << 20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	addr := util.CreateTestAddr("tcp")
+	server, node := createTestNode(addr, []storage.Engine{engine}, addr, t)
+	defer server.Close()
+	db := node.kvDB.(*kv.DistDB)
+	if err := db.WaitForFirstRange(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	sr := <-db.AdminSplit(&storage.AdminSplitRequest{SplitKey: storage.Key("m")})
+	if sr.Error != nil {
+		t.Fatal(sr.Error)
+	}
+	testCases := []struct {
+		spans     []kv.KeySpan
+		expStarts []storage.Key
+	}{
+		{[]kv.KeySpan{{Start: storage.Key("a"), End: storage.Key("b")}}, []storage.Key{storage.KeyMin}},
+		{[]kv.KeySpan{{Start: storage.Key("a"), End: storage.Key("m")}}, []storage.Key{storage.KeyMin}},
+		{[]kv.KeySpan{{Start: storage.Key("a"), End: storage.Key("z")}}, []storage.Key{storage.KeyMin, storage.Key("m")}},
+		{[]kv.KeySpan{{Start: storage.Key("x"), End: storage.Key("z")}, {Start: storage.Key("a"), End: storage.Key("b")}},
+			[]storage.Key{storage.Key("m"), storage.KeyMin}},
+	}
+	for i, test := range testCases {
+		ranges, err := db.WarmUp(test.spans, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var starts []storage.Key
+		for _, locations := range ranges {
+			starts = append(starts, locations.StartKey)
+		}
+		if len(starts) != len(test.expStarts) {
+			t.Errorf("%d: expected ranges starting at %q; got %q", i, test.expStarts, starts)
+			continue
+		}
+		for j := range starts {
+			if !bytes.Equal(starts[j], test.expStarts[j]) {
+				t.Errorf("%d: expected ranges starting at %q; got %q", i, test.expStarts, starts)
+				break
+			}
+		}
+	}
+}
+
+// TestNodeDebugScan verifies debug scans are rejected unless enabled
+// and then return raw stored rows, including store-local keys.
+func TestNodeDebugScan(t *testing.T) {
+	engine := storage.NewInMem(1 << 20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	addr := util.CreateTestAddr("tcp")
+	server, node := createTestNode(addr, []storage.Engine{engine}, addr, t)
+	defer server.Close()
+
+	args := &storage.InternalDebugScanRequest{
+		RequestHeader: storage.RequestHeader{Replica: storage.Replica{StoreID: 1, RangeID: 1}},
+		StartKey:      storage.KeyMin,
+		EndKey:        storage.KeyMax,
+	}
+	reply := &storage.InternalDebugScanResponse{}
+	if err := node.InternalDebugScan(args, reply); err != nil || reply.Error == nil {
+		t.Fatalf("expected debug scan to be rejected; got %v, %v", err, reply.Error)
+	}
+
+	*enableDebugScan = true
+	defer func() { *enableDebugScan = false }()
+	reply = &storage.InternalDebugScanResponse{}
+	if err := node.InternalDebugScan(args, reply); err != nil || reply.Error != nil {
+		t.Fatalf("unexpected debug scan failure: %v, %v", err, reply.Error)
+	}
+	var sawStoreIdent, sawMeta bool
+	for _, row := range reply.Rows {
+		sawStoreIdent = sawStoreIdent || bytes.Equal(row.Key, storage.Key("\x00\x00\x00store-ident"))
+		sawMeta = sawMeta || bytes.HasPrefix(row.Key, storage.KeyMeta1Prefix)
+	}
+	if !sawStoreIdent || !sawMeta {
+		t.Errorf("expected store ident and meta1 keys in %d rows", len(reply.Rows))
+	}
+
+	args.Replica.RangeID = 100
+	if err := node.InternalDebugScan(args, &storage.InternalDebugScanResponse{}); err == nil {
+		t.Error("expected error scanning unknown range")
+	}
+}
+
+// TestNodeCacheSizes verifies the caches of a node's stores may be
+// resized at runtime.
+func TestNodeCacheSizes(t *testing.T) {
+	engine := storage.NewInMem(1 << 20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	addr := util.CreateTestAddr("tcp")
+	server, node := createTestNode(addr, []storage.Engine{engine}, addr, t)
+	defer server.Close()
+
+	if err := node.SetCacheSizes(1, 1<<16, -1); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := node.CacheStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := stats[1]; !ok || s.RowCache.Capacity != 1<<16 {
+		t.Errorf("expected row cache capacity of store 1 to be %d; got %+v", 1<<16, stats)
+	}
+	if err := node.SetCacheSizes(0, -1, 1<<16); err == nil {
+		t.Error("expected error resizing block cache of in-memory store")
+	}
+	if err := node.SetCacheSizes(2, 0, -1); err == nil {
+		t.Error("expected error resizing caches of unknown store")
+	}
+}
+
+// TestNodeUsageRollup verifies a node's usage rollup is written to
+// its usage key and reported in cluster usage.
+func TestNodeUsageRollup(t *testing.T) {
+	engine := storage.NewInMem(1 << 20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	addr := util.CreateTestAddr("tcp")
+	server, node := createTestNode(addr, []storage.Engine{engine}, addr, t)
+	defer server.Close()
+
+	if err := kv.PutI(node.kvDB, storage.Key("a"), "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := node.rollupUsage(); err != nil {
+		t.Fatal(err)
+	}
+	usage, err := kv.GetClusterUsage(node.kvDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage.Nodes) != 1 || usage.Nodes[0].NodeID != node.Attributes.NodeID {
+		t.Fatalf("expected rollup of node %d; got %+v", node.Attributes.NodeID, usage.Nodes)
+	}
+	var found bool
+	for _, u := range usage.Accounts {
+		if u.Account == storage.AcctDefault {
+			found = u.Keys == 1 && u.Writes == 1
+		}
+	}
+	if !found {
+		t.Errorf("expected one key written to the default account; got %+v", usage.Accounts)
+	}
+}
+
+// TestNodePermissions verifies nodes refuse requests which the
+// permission configs of their keys don't grant the request's user.
+func TestNodePermissions(t *testing.T) {
+	engine := storage.NewInMem(1 << 20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	addr := util.CreateTestAddr("tcp")
+	server, node := createTestNode(addr, []storage.Engine{engine}, addr, t)
+	defer server.Close()
+
+	// Permission configs are reserved keys, written by the node's own
+	// client.
+	db := kv.NewProxyDB([]net.Addr{server.Addr()})
+	if err := kv.PutI(node.kvDB, storage.MakeKey(storage.KeyConfigPermissionPrefix, storage.Key("secret")), &storage.PermConfig{
+		Perms: []storage.Permission{{Users: []string{"admin"}, Read: true, Write: true}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	pr := <-db.Put(&storage.PutRequest{Key: storage.Key("secret/a"), Value: storage.Value{Bytes: []byte("value")}})
+	if pde, ok := pr.Error.(*storage.PermissionDeniedError); !ok || !pde.Write {
+		t.Fatalf("expected write permission to be denied; got %v", pr.Error)
+	}
+	pr = <-db.Put(&storage.PutRequest{
+		RequestHeader: storage.RequestHeader{User: "admin"},
+		Key:           storage.Key("secret/a"),
+		Value:         storage.Value{Bytes: []byte("value")},
+	})
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	if gr := <-db.Get(&storage.GetRequest{Key: storage.Key("a")}); gr.Error != nil {
+		t.Errorf("expected read outside restricted prefix to succeed; got %v", gr.Error)
+	}
+}
+
+// TestNodeReservedKeys verifies nodes refuse clients' writes of
+// reserved keys, including those proxied via another node, unless the
+// requests are flagged as internal.
+func TestNodeReservedKeys(t *testing.T) {
+	engine := storage.NewInMem(1 << 20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	addr := util.CreateTestAddr("tcp")
+	server, node := createTestNode(addr, []storage.Engine{engine}, addr, t)
+	defer server.Close()
+
+	meta2Key := storage.MakeKey(storage.KeyMeta2Prefix, storage.KeyMax)
+	db := kv.NewProxyDB([]net.Addr{server.Addr()})
+	pr := <-db.Put(&storage.PutRequest{Key: meta2Key, Value: storage.Value{Bytes: []byte("clobbered")}})
+	if _, ok := pr.Error.(*storage.ReservedKeyError); !ok {
+		t.Fatalf("expected write of reserved key to be refused; got %v", pr.Error)
+	}
+	dr := <-db.DeleteRange(&storage.DeleteRangeRequest{StartKey: storage.KeyMin, EndKey: storage.KeyMax})
+	if _, ok := dr.Error.(*storage.ReservedKeyError); !ok {
+		t.Fatalf("expected deletion spanning reserved keys to be refused; got %v", dr.Error)
+	}
+	if gr := <-db.Get(&storage.GetRequest{Key: meta2Key}); gr.Error != nil || gr.Value.Bytes == nil {
+		t.Errorf("expected reserved key to be readable and intact; got %q, %v", gr.Value.Bytes, gr.Error)
+	}
+	zoneKey := storage.MakeKey(storage.KeyConfigZonePrefix, storage.Key("db"))
+	if err := kv.PutI(node.kvDB, zoneKey, &storage.ZoneConfig{}); err != nil {
+		t.Errorf("expected node's client to write reserved key; got %v", err)
+	}
+}
+
+// TestNodeProxy verifies a thin client may send requests to any node,
+// which routes them to the ranges holding their keys.
+func TestNodeProxy(t *testing.T) {
+	engine := storage.NewInMem(1 << 20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	addr := util.CreateTestAddr("tcp")
+	server, node := createTestNode(addr, []storage.Engine{engine}, addr, t)
+	defer server.Close()
+
+	db := kv.NewProxyDB([]net.Addr{server.Addr()})
+	pr := <-db.Put(&storage.PutRequest{Key: storage.Key("a"), Value: storage.Value{Bytes: []byte("value")}})
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	gr := <-db.Get(&storage.GetRequest{Key: storage.Key("a")})
+	if gr.Error != nil || string(gr.Value.Bytes) != "value" {
+		t.Fatalf("expected to read proxied write; got %q, %v", gr.Value.Bytes, gr.Error)
+	}
+	if gr.Replica.NodeID != node.Attributes.NodeID {
+		t.Errorf("expected reply from replica on node %d; got %+v", node.Attributes.NodeID, gr.Replica)
+	}
+}
+
+// TestNodeClock verifies a node refuses requests whose clock readings
+// are further ahead of its clock than the maximum offset, and that
+// writes are timestamped by the node's clock after the readings it
+// has received.
+func TestNodeClock(t *testing.T) {
+	engine := storage.NewInMem(1 << 20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	addr := util.CreateTestAddr("tcp")
+	server, _ := createTestNode(addr, []storage.Engine{engine}, addr, t)
+	defer server.Close()
+
+	db := kv.NewProxyDB([]net.Addr{server.Addr()})
+	pr := <-db.Put(&storage.PutRequest{
+		RequestHeader: storage.RequestHeader{ClockReading: time.Now().Add(time.Hour).UnixNano()},
+		Key:           storage.Key("a"),
+		Value:         storage.Value{Bytes: []byte("value")},
+	})
+	if pr.Error == nil {
+		t.Fatal("expected request from client with offset clock to be refused")
+	}
+	ahead := time.Now().Add(storage.MaxClockOffset / 2).UnixNano()
+	pr = <-db.Put(&storage.PutRequest{
+		RequestHeader: storage.RequestHeader{ClockReading: ahead},
+		Key:           storage.Key("a"),
+		Value:         storage.Value{Bytes: []byte("value"), Timestamp: 1},
+	})
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	if pr.ClockReading <= ahead {
+		t.Errorf("expected reply clock reading after %d; got %d", ahead, pr.ClockReading)
+	}
+	gr := <-db.Get(&storage.GetRequest{Key: storage.Key("a")})
+	if gr.Error != nil {
+		t.Fatal(gr.Error)
+	}
+	if gr.Value.Timestamp <= ahead || gr.Value.Timestamp >= pr.ClockReading {
+		t.Errorf("expected value timestamped between %d and %d; got %d", ahead, pr.ClockReading, gr.Value.Timestamp)
+	}
+}
+
+// TestNodeWriteIntentConflicts verifies requests blocked by write
+// intents push the intents' transactions, aborting those of lower
+// priority and waiting on others, and that intents are resolved after
+// their transactions end.
+func TestNodeWriteIntentConflicts(t *testing.T) {
+	engine := storage.NewInMem(1 << 20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	addr := util.CreateTestAddr("tcp")
+	server, node := createTestNode(addr, []storage.Engine{engine}, addr, t)
+	defer server.Close()
+	db := node.kvDB
+
+	put := func(header storage.RequestHeader, key, value string) {
+		if pr := <-db.Put(&storage.PutRequest{RequestHeader: header, Key: storage.Key(key), Value: storage.Value{Bytes: []byte(value)}}); pr.Error != nil {
+			t.Fatal(pr.Error)
+		}
+	}
+	get := func(header storage.RequestHeader, key string) string {
+		gr := <-db.Get(&storage.GetRequest{RequestHeader: header, Key: storage.Key(key)})
+		if gr.Error != nil {
+			t.Fatal(gr.Error)
+		}
+		return string(gr.Value.Bytes)
+	}
+	endTxn := func(txID string, keys ...string) error {
+		args := &storage.EndTransactionRequest{RequestHeader: storage.RequestHeader{TxID: txID}, Commit: true}
+		for _, key := range keys {
+			args.Keys = append(args.Keys, storage.Key(key))
+		}
+		return (<-db.EndTransaction(args)).Error
+	}
+
+	// traced returns a DistDB whose requests are recorded by tr.
+	traced := func(tr *kv.TxnRecorder) kv.DB {
+		tdb := kv.NewDB(node.gossip)
+		tdb.SetTracer(tr)
+		return tdb
+	}
+
+	// A reader of higher priority aborts the writer; the push is
+	// recorded in the reader's report.
+	put(storage.RequestHeader{}, "a", "old")
+	put(storage.RequestHeader{TxID: "txn1", TxnPriority: 1}, "a", "new")
+	if value := get(storage.RequestHeader{TxID: "txn1"}, "a"); value != "new" {
+		t.Errorf("expected transaction to read its intent; got %q", value)
+	}
+	tr := kv.NewTxnRecorder()
+	gr := <-traced(tr).Get(&storage.GetRequest{RequestHeader: storage.RequestHeader{TxnPriority: 2}, Key: storage.Key("a")})
+	if gr.Error != nil || string(gr.Value.Bytes) != "old" {
+		t.Errorf("expected reader to abort writer and read %q; got %q, %v", "old", gr.Value.Bytes, gr.Error)
+	}
+	if r := tr.Report(); r.Pushes != 1 {
+		t.Errorf("expected a single push; got %+v", r)
+	} else {
+		for _, e := range r.Events {
+			if e.Kind == kv.TxnEventPush && (e.Pushee != "txn1" || e.Outcome != "aborted" || e.Error != "") {
+				t.Errorf("expected push aborting txn1; got %+v", e)
+			}
+		}
+	}
+	if _, ok := endTxn("txn1", "a").(*storage.TransactionAbortedError); !ok {
+		t.Error("expected aborted transaction to fail to commit")
+	}
+
+	// A committed transaction's intents are resolved asynchronously.
+	put(storage.RequestHeader{TxID: "txn2", TxnPriority: 1}, "b", "committed")
+	if err := endTxn("txn2", "b"); err != nil {
+		t.Fatal(err)
+	}
+	*enableDebugScan = true
+	defer func() { *enableDebugScan = false }()
+	if err := util.IsTrueWithin(func() bool {
+		// Once resolved, the intent's rows are replaced by the value.
+		reply := &storage.InternalDebugScanResponse{}
+		if err := node.InternalDebugScan(&storage.InternalDebugScanRequest{
+			RequestHeader: storage.RequestHeader{Replica: storage.Replica{StoreID: 1, RangeID: 1}},
+			StartKey:      storage.Key("b"),
+			EndKey:        storage.Key("c"),
+		}, reply); err != nil || reply.Error != nil {
+			t.Fatal(err, reply.Error)
+		}
+		return len(reply.Rows) == 1 && string(reply.Rows[0].Key) == "b" && string(reply.Rows[0].Value.Bytes) == "committed"
+	}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reader of lower priority waits for the writer to end.
+	// Its pushes are recorded, the last finding the writer committed.
+	put(storage.RequestHeader{TxID: "txn3", TxnPriority: 5}, "c", "waited")
+	readChan := make(chan string, 1)
+	tr = kv.NewTxnRecorder()
+	go func() {
+		gr := <-traced(tr).Get(&storage.GetRequest{RequestHeader: storage.RequestHeader{TxnPriority: 1}, Key: storage.Key("c")})
+		if gr.Error != nil {
+			t.Error(gr.Error)
+		}
+		readChan <- string(gr.Value.Bytes)
+	}()
+	select {
+	case value := <-readChan:
+		t.Fatalf("expected reader to wait; read %q", value)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := endTxn("txn3", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if value := <-readChan; value != "waited" {
+		t.Errorf("expected reader to read committed value; got %q", value)
+	}
+	var pushes []kv.TxnEvent
+	for _, e := range tr.Report().Events {
+		if e.Kind == kv.TxnEventPush {
+			pushes = append(pushes, e)
+		}
+	}
+	if len(pushes) == 0 {
+		t.Fatal("expected pushes of the writer to be recorded")
+	}
+	for i, e := range pushes {
+		if last := i == len(pushes)-1; e.Pushee != "txn3" || last != (e.Error == "") || last != (e.Outcome == "committed") {
+			t.Errorf("%d: unexpected push %+v", i, e)
+		}
+	}
+}
+
+// TestNodeResolveAbandonedIntents verifies abandoned write intents are
+// resolved according to their transactions' records: committed if the
+// transaction committed without resolving them, and otherwise aborted.
+func TestNodeResolveAbandonedIntents(t *testing.T) {
+	engine := storage.NewInMem(1 << 20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	addr := util.CreateTestAddr("tcp")
+	server, node := createTestNode(addr, []storage.Engine{engine}, addr, t)
+	defer server.Close()
+	db := node.kvDB
+
+	for _, txID := range []string{"committed", "abandoned"} {
+		pr := <-db.Put(&storage.PutRequest{
+			RequestHeader: storage.RequestHeader{TxID: txID, TxnPriority: 1},
+			Key:           storage.Key(txID),
+			Value:         storage.Value{Bytes: []byte("value")},
+		})
+		if pr.Error != nil {
+			t.Fatal(pr.Error)
+		}
+	}
+	// The transaction commits without listing its intent, which is
+	// left unresolved.
+	er := <-db.EndTransaction(&storage.EndTransactionRequest{RequestHeader: storage.RequestHeader{TxID: "committed"}, Commit: true})
+	if er.Error != nil {
+		t.Fatal(er.Error)
+	}
+	rng, err := node.storeMap[1].GetRange(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.resolveAbandonedIntents(rng, time.Now().Add(2*time.Hour).UnixNano())
+	if intents, err := rng.AbandonedIntents(time.Now().Add(2 * time.Hour).UnixNano()); err != nil || len(intents) != 0 {
+		t.Fatalf("expected abandoned intents resolved; got %+v, %v", intents, err)
+	}
+	for key, exp := range map[string]string{"committed": "value", "abandoned": ""} {
+		gr := <-db.Get(&storage.GetRequest{Key: storage.Key(key)})
+		if gr.Error != nil || string(gr.Value.Bytes) != exp {
+			t.Errorf("%s: expected %q; got %q, %v", key, exp, gr.Value.Bytes, gr.Error)
+		}
+	}
+}
+
+// TestReadOnlyClientResolvesIntents verifies a read-only client's
+// read of a key with another transaction's write intent pushes the
+// transaction and resolves the intent, rather than failing.
+func TestReadOnlyClientResolvesIntents(t *testing.T) {
+	engine := storage.NewInMem(1 << 20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	addr := util.CreateTestAddr("tcp")
+	server, node := createTestNode(addr, []storage.Engine{engine}, addr, t)
+	defer server.Close()
+	db := node.kvDB
+	pr := <-db.Put(&storage.PutRequest{
+		RequestHeader: storage.RequestHeader{TxID: "txn", TxnPriority: 1},
+		Key:           storage.Key("a"),
+		Value:         storage.Value{Bytes: []byte("value")},
+	})
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	// The transaction commits without listing its intent, which is
+	// left for the reader to resolve.
+	er := <-db.EndTransaction(&storage.EndTransactionRequest{RequestHeader: storage.RequestHeader{TxID: "txn"}, Commit: true})
+	if er.Error != nil {
+		t.Fatal(er.Error)
+	}
+	roDB := kv.NewDBWithOptions(node.gossip, kv.DistDBOptions{ReadOnly: true})
+	defer roDB.Close()
+	gr := <-roDB.Get(&storage.GetRequest{Key: storage.Key("a")})
+	if gr.Error != nil || string(gr.Value.Bytes) != "value" {
+		t.Errorf("expected committed value; got %q, %v", gr.Value.Bytes, gr.Error)
+	}
+	// The client still refuses to push transactions on its own behalf.
+	push := <-roDB.InternalPushTxn(&storage.InternalPushTxnRequest{
+		Key:        storage.TxnRecordKey("txn"),
+		PusheeTxID: "txn",
+	})
+	if _, ok := push.Error.(*kv.ReadOnlyError); !ok {
+		t.Errorf("expected read-only error; got %v", push.Error)
+	}
+}
+
+// TestNodeMessagesMatchSchema verifies the arguments and replies of
+// the Node RPC service's methods match their declarations in the
+// proto directory, so that they're sent as declared.
+func TestNodeMessagesMatchSchema(t *testing.T) {
+	var schema []byte
+	for _, file := range []string{"data.proto", "errors.proto", "api.proto"} {
+		b, err := ioutil.ReadFile("../proto/" + file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		schema = append(schema, b...)
+	}
+	var prototypes []interface{}
+	nodeType := reflect.TypeOf(&Node{})
+	for i := 0; i < nodeType.NumMethod(); i++ {
+		m := nodeType.Method(i)
+		// Methods served via RPC take arguments and a reply, and return
+		// an error.
+		if m.Type.NumIn() != 3 || m.Type.NumOut() != 1 || m.Type.Out(0).Name() != "error" {
+			continue
+		}
+		args, reply := m.Type.In(1), m.Type.In(2)
+		if args.Kind() != reflect.Ptr || reply.Kind() != reflect.Ptr {
+			continue
+		}
+		for _, p := range []reflect.Type{args, reply} {
+			if !protobuf.IsMessage(reflect.New(p.Elem()).Interface()) {
+				t.Errorf("%s: %s isn't a protobuf message", m.Name, p)
+			}
+			prototypes = append(prototypes, reflect.New(p.Elem()).Interface())
+		}
+	}
+	if len(prototypes) == 0 {
+		t.Fatal("expected Node RPC methods")
+	}
+	if err := protobuf.CheckSchema(string(schema), prototypes...); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/rpc"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// raftTransport sends raft messages to the nodes holding the replicas
+// to which they're addressed, via the InternalRaftMessage RPC. Node
+// addresses are looked up via gossip.
+type raftTransport struct {
+	gossip *gossip.Gossip
+}
+
+// newRaftTransport returns a transport which looks up node addresses
+// via gossip.
+func newRaftTransport(gossip *gossip.Gossip) *raftTransport {
+	return &raftTransport{gossip: gossip}
+}
+
+// client returns a ready client of the node with ID nodeID.
+func (t *raftTransport) client(nodeID int32) (*rpc.Client, error) {
+	addr, err := t.gossip.GetNodeAddr(nodeID)
+	if err != nil {
+		return nil, util.Errorf("unable to look up address of node %d: %v", nodeID, err)
+	}
+	client := rpc.NewClient(addr, nil)
+	select {
+	case <-client.Ready:
+	default:
+		return nil, util.Errorf("connection to node %d not ready", nodeID)
+	}
+	return client, nil
+}
+
+// Send implements the storage.RaftTransport interface. The message is
+// sent asynchronously; if the connection to the recipient's node
+// isn't yet ready, the message is dropped and the connection left to
+// be established for subsequent messages.
+func (t *raftTransport) Send(msg *storage.RaftMessage) error {
+	client, err := t.client(msg.To.NodeID)
+	if err != nil {
+		return err
+	}
+	args := &storage.InternalRaftMessageRequest{
+		RequestHeader: storage.RequestHeader{Replica: msg.To},
+		Message:       *msg,
+	}
+	client.Go("Node.InternalRaftMessage", args, &storage.InternalRaftMessageResponse{}, nil)
+	return nil
+}
+
+// SnapshotChunk implements the storage.RaftTransport interface,
+// fetching the chunk via the InternalSnapshotChunk RPC. As with Send,
+// fails if the connection to the node holding args.Replica isn't yet
+// ready; the fetch is retried when the leader resends the snapshot.
+func (t *raftTransport) SnapshotChunk(args *storage.InternalSnapshotChunkRequest, reply *storage.InternalSnapshotChunkResponse) error {
+	client, err := t.client(args.Replica.NodeID)
+	if err != nil {
+		return err
+	}
+	call := client.Go("Node.InternalSnapshotChunk", args, reply, nil)
+	<-call.Done
+	return call.Error
+}
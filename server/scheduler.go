@@ -0,0 +1,106 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"container/heap"
+	"flag"
+	"sync"
+)
+
+var maxExecutingRequests = flag.Int("max_executing_requests", 64, "maximum number of "+
+	"requests a node executes at once; further requests wait, ordered by priority")
+
+// A schedWaiter is a request waiting to execute.
+type schedWaiter struct {
+	priority float32
+	seq      int64         // Arrival order, to break ties
+	ready    chan struct{} // Closed when the request may execute
+}
+
+// waiterHeap is a heap of waiting requests, ordered by descending
+// priority and then by arrival. It implements heap.Interface.
+type waiterHeap []*schedWaiter
+
+func (wh waiterHeap) Len() int      { return len(wh) }
+func (wh waiterHeap) Swap(i, j int) { wh[i], wh[j] = wh[j], wh[i] }
+func (wh waiterHeap) Less(i, j int) bool {
+	if wh[i].priority != wh[j].priority {
+		return wh[i].priority > wh[j].priority
+	}
+	return wh[i].seq < wh[j].seq
+}
+func (wh *waiterHeap) Push(x interface{}) { *wh = append(*wh, x.(*schedWaiter)) }
+func (wh *waiterHeap) Pop() interface{} {
+	old := *wh
+	n := len(old)
+	x := old[n-1]
+	*wh = old[:n-1]
+	return x
+}
+
+// A requestScheduler limits the number of requests a node executes
+// at once. When all execution slots are in use, requests wait and are
+// granted slots in order of priority, so that high-priority
+// operations run ahead of batch and background traffic.
+type requestScheduler struct {
+	mu      sync.Mutex
+	slots   int // Unused execution slots
+	seq     int64
+	waiters waiterHeap
+}
+
+// newRequestScheduler returns a scheduler with the specified number
+// of execution slots.
+func newRequestScheduler(slots int) *requestScheduler {
+	return &requestScheduler{slots: slots}
+}
+
+// acquire blocks until a request with the specified priority may
+// execute. Higher values indicate higher priority. Each call must be
+// paired with a call to release.
+func (s *requestScheduler) acquire(priority float32) {
+	s.mu.Lock()
+	if s.slots > 0 {
+		s.slots--
+		s.mu.Unlock()
+		return
+	}
+	s.seq++
+	w := &schedWaiter{priority: priority, seq: s.seq, ready: make(chan struct{})}
+	heap.Push(&s.waiters, w)
+	s.mu.Unlock()
+	<-w.ready
+}
+
+// release returns an execution slot, handing it directly to the
+// highest priority waiter, if any.
+func (s *requestScheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.waiters) > 0 {
+		close(heap.Pop(&s.waiters).(*schedWaiter).ready)
+		return
+	}
+	s.slots++
+}
+
+// waiting returns the number of requests waiting to execute.
+func (s *requestScheduler) waiting() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.waiters)
+}
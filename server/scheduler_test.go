@@ -0,0 +1,60 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// TestRequestScheduler verifies waiting requests are granted slots
+// by descending priority and then by arrival.
+func TestRequestScheduler(t *testing.T) {
+	s := newRequestScheduler(1)
+	s.acquire(0)
+	order := make(chan float32, 4)
+	var wg sync.WaitGroup
+	for i, priority := range []float32{1, 10, 1, 5} {
+		wg.Add(1)
+		go func(priority float32) {
+			defer wg.Done()
+			s.acquire(priority)
+			order <- priority
+			s.release()
+		}(priority)
+		// Ensure waiters arrive in order.
+		if err := util.IsTrueWithin(func() bool { return s.waiting() == i+1 }, 100*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.release()
+	var got []float32
+	for i := 0; i < 4; i++ {
+		got = append(got, <-order)
+	}
+	if exp := []float32{10, 5, 1, 1}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected execution order %v; got %v", exp, got)
+	}
+	// The last waiter may still be releasing its slot.
+	wg.Wait()
+	if s.slots != 1 {
+		t.Errorf("expected slot to be returned; got %d", s.slots)
+	}
+}
@@ -31,6 +31,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 
 	commander "code.google.com/p/go-commander"
 	"github.com/cockroachdb/cockroach/gossip"
@@ -55,6 +56,43 @@ var (
 		"for spinning disks, hdd=<path>; for in-memory, mem=<size in bytes>. E.g. "+
 		"-data_dirs=hdd=/mnt/hda1,ssd=/mnt/ssd01,ssd=/mnt/ssd02,mem=1073741824")
 
+	// cacheSize is the total size of the block caches of RocksDB-backed
+	// stores.
+	cacheSize = flag.Int64("cache_size", 1<<30, "total size in bytes for "+
+		"caches, shared evenly if there are multiple storage devices")
+	// maxOpenFiles bounds the table cache of each RocksDB-backed
+	// store.
+	maxOpenFiles = flag.Int("max_open_files", 0, "maximum number of table files each "+
+		"disk-backed store keeps open, with their indexes cached; 0 uses the engine default, "+
+		"-1 keeps all files open")
+	// syncWrites makes RocksDB-backed stores sync their write-ahead
+	// logs before completing each write.
+	syncWrites = flag.Bool("sync_writes", false, "sync the write-ahead log of disk-backed "+
+		"stores before completing each write, so that writes survive machine crashes; "+
+		"writes always survive process crashes")
+
+	// tlsCert, tlsKey and tlsCACert secure RPC connections, including
+	// those of the gossip network, with TLS. Peers which don't present
+	// a certificate signed by the CA are refused.
+	tlsCert = flag.String("tls_cert", "", "path to the PEM-encoded certificate of this node; "+
+		"if set, RPC and gossip connections use TLS, and every node must set the TLS flags. "+
+		"The certificate must name the node's RPC host as a subject alternative name")
+	tlsKey    = flag.String("tls_key", "", "path to the PEM-encoded private key of -tls_cert")
+	tlsCACert = flag.String("tls_ca_cert", "", "path to the PEM-encoded certificates of the "+
+		"authority signing node certificates; peers presenting other certificates are refused. "+
+		"The TLS files are reloaded, to rotate certificates, when the process receives SIGHUP")
+	// rpcCompression compresses the requests and replies of the RPC
+	// connections this node opens.
+	rpcCompression = flag.String("rpc_compression", "none", "compression of large requests and "+
+		"replies on RPC connections opened by this node, such as scans and snapshot chunks: none or gzip; "+
+		"nodes compress the replies of connections opened by others as those nodes request")
+
+	// insecure permits running without TLS, so that any peer may
+	// connect and issue requests, including nodes' internal requests.
+	insecure = flag.Bool("insecure", false, "serve and dial RPC and gossip connections without TLS, "+
+		"so that peers needn't authenticate; intended only for local development. Unless set, "+
+		"-tls_cert, -tls_key and -tls_ca_cert are required")
+
 	// Regular expression for capturing data directory specifications.
 	dataDirRE = regexp.MustCompile(`^(mem)=([\d]+)|(ssd|hdd)=(.+)$`)
 )
@@ -90,10 +128,11 @@ A node exports an HTTP API with the following endpoints:
 
 type server struct {
 	host           string
+	httpAddr       string // host:port to bind for HTTP traffic
 	mux            *http.ServeMux
 	rpc            *rpc.Server
 	gossip         *gossip.Gossip
-	kvDB           kv.DB
+	kvDB           *kv.DistDB
 	kvREST         *kv.RESTServer
 	node           *Node
 	admin          *adminServer
@@ -129,20 +168,50 @@ func runStart(cmd *commander.Command, args []string) {
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, os.Kill)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	// Block until one of the signals above is received, reloading the
+	// TLS certificates on SIGHUP.
+	for {
+		select {
+		case <-hup:
+			reloadTLSCertificates()
+		case <-c:
+			return
+		}
+	}
+}
 
-	// Block until one of the signals above is received.
-	<-c
+// reloadTLSCertificates reloads the TLS files specified by -tls_cert,
+// -tls_key and -tls_ca_cert, logging the outcome. The certificates in
+// use are kept if the files can't be loaded.
+func reloadTLSCertificates() {
+	if *insecure {
+		glog.Warning("not reloading TLS certificates; running with -insecure")
+		return
+	}
+	if err := rpc.ReloadTLSConfig(); err != nil {
+		glog.Errorf("failed to reload TLS certificates: %v", err)
+		return
+	}
+	glog.Infof("reloaded TLS certificates from %s, %s and %s", *tlsCert, *tlsKey, *tlsCACert)
 }
 
 // initEngines interprets the dirs parameter to initialize a slice of
 // storage.Engine objects.
 func initEngines(dirs string) ([]storage.Engine, error) {
 	engines := make([]storage.Engine, 0, 1)
+	// The cache is shared evenly between disk-backed stores.
+	opts := storage.RocksDBOptions{CacheSize: *cacheSize, MaxOpenFiles: *maxOpenFiles, SyncWrites: *syncWrites}
+	if disks := len(regexp.MustCompile(`(^|,)(ssd|hdd)=`).FindAllString(dirs, -1)); disks > 1 {
+		opts.CacheSize /= int64(disks)
+	}
 	for _, dir := range strings.Split(dirs, ",") {
 		if len(dir) == 0 {
 			continue
 		}
-		engine, err := initEngine(dir)
+		engine, err := initEngine(dir, opts)
 		if err != nil {
 			glog.Warningf("%v; skipping...will not serve data", err)
 			continue
@@ -155,7 +224,8 @@ func initEngines(dirs string) ([]storage.Engine, error) {
 
 // initEngine parses the engine specification according to the
 // dataDirRE regexp and instantiates an engine of correct type.
-func initEngine(spec string) (storage.Engine, error) {
+// RocksDB-backed engines are configured by opts.
+func initEngine(spec string, opts storage.RocksDBOptions) (storage.Engine, error) {
 	// Error if regexp doesn't match.
 	matches := dataDirRE.FindStringSubmatch(spec)
 	if matches == nil {
@@ -181,7 +251,7 @@ func initEngine(spec string) (storage.Engine, error) {
 		default:
 			return nil, util.Errorf("unhandled disk type %q", matches[4])
 		}
-		engine, err = storage.NewRocksDB(typ, matches[4])
+		engine, err = storage.NewRocksDBWithOptions(typ, matches[4], opts)
 		if err != nil {
 			return nil, util.Errorf("unable to init rocksdb with data dir %q", matches[4])
 		}
@@ -205,22 +275,58 @@ func newServer() (*server, error) {
 	if err != nil {
 		return nil, err
 	}
+	if strings.HasPrefix(*httpAddr, ":") {
+		*httpAddr = host + *httpAddr
+	}
+	if *tlsCert != "" || *tlsKey != "" || *tlsCACert != "" {
+		if *tlsCert == "" || *tlsKey == "" || *tlsCACert == "" {
+			return nil, util.Errorf("-tls_cert, -tls_key and -tls_ca_cert must be specified together")
+		}
+		if *insecure {
+			return nil, util.Errorf("-insecure can't be specified with -tls_cert, -tls_key and -tls_ca_cert")
+		}
+		config, err := rpc.LoadTLSConfig(*tlsCert, *tlsKey, *tlsCACert)
+		if err != nil {
+			return nil, err
+		}
+		rpc.SetTLSConfig(config)
+	} else if !*insecure {
+		return nil, util.Errorf("-tls_cert, -tls_key and -tls_ca_cert must be specified so that nodes " +
+			"authenticate each other; specify -insecure to run without TLS")
+	}
+	compression, err := rpc.ParseCompression(*rpcCompression)
+	if err != nil {
+		return nil, err
+	}
+	rpc.SetCompression(compression)
+	return newServerAt(host, addr, *httpAddr), nil
+}
 
+// newServerAt returns a server on host binding addr for RPC traffic
+// and httpAddr for HTTP traffic.
+func newServerAt(host string, addr net.Addr, httpAddr string) *server {
 	s := &server{
-		host: host,
-		mux:  http.NewServeMux(),
-		rpc:  rpc.NewServer(addr),
+		host:     host,
+		httpAddr: httpAddr,
+		mux:      http.NewServeMux(),
+		rpc:      rpc.NewServer(addr),
 	}
 
 	s.gossip = gossip.New()
-	s.kvDB = kv.NewDB(s.gossip)
+	s.kvDB = kv.NewDBWithOptions(s.gossip, kv.DistDBOptions{
+		Internal:     true,
+		ReplicaOrder: kv.OrderLocality,
+		Datacenter:   getDatacenter(),
+		Rack:         getRack(),
+	})
 	s.kvREST = kv.NewRESTServer(s.kvDB)
 	s.node = NewNode(s.kvDB, s.gossip)
-	s.admin = newAdminServer(s.kvDB)
+	s.kvDB.SetClock(s.node.clock)
+	s.admin = newAdminServer(s.kvDB, s.node)
 	s.structuredDB = structured.NewDB(s.kvDB)
 	s.structuredREST = structured.NewRESTServer(s.structuredDB)
 
-	return s, nil
+	return s
 }
 
 // start runs the RPC and HTTP servers, starts the gossip instance (if
@@ -251,13 +357,12 @@ func (s *server) start(engines []storage.Engine, selfBootstrap bool) error {
 	glog.Infof("Initialized %d storage engine(s)", len(engines))
 
 	s.initHTTP()
-	if strings.HasPrefix(*httpAddr, ":") {
-		*httpAddr = s.host + *httpAddr
-	}
-	ln, err := net.Listen("tcp", *httpAddr)
+	ln, err := net.Listen("tcp", s.httpAddr)
 	if err != nil {
-		return util.Errorf("could not listen on %s: %s", *httpAddr, err)
+		return util.Errorf("could not listen on %s: %s", s.httpAddr, err)
 	}
+	// Admin and REST requests authenticate as RPC connections do.
+	ln = rpc.NewListener(ln)
 	// Obtaining the http end point listener is difficult using
 	// http.ListenAndServe(), so we are storing it with the server
 	s.httpListener = &ln
@@ -269,6 +374,21 @@ func (s *server) start(engines []storage.Engine, selfBootstrap bool) error {
 func (s *server) initHTTP() {
 	s.mux.HandleFunc(adminKeyPrefix+"healthz", s.admin.handleHealthz)
 	s.mux.HandleFunc(zoneKeyPrefix, s.admin.handleZoneAction)
+	s.mux.HandleFunc(freezesKeyPrefix, s.admin.handleFreezeAction)
+	s.mux.HandleFunc(freezesKeyPrefix+"/", s.admin.handleFreezeAction)
+	s.mux.HandleFunc(statsKeyPrefix, s.admin.handleStatsAction)
+	s.mux.HandleFunc(debugScanKeyPrefix, s.admin.handleDebugScanAction)
+	s.mux.HandleFunc(cachesKeyPrefix, s.admin.handleCachesAction)
+	s.mux.HandleFunc(slosKeyPrefix, s.admin.handleSLOsAction)
+	s.mux.HandleFunc(usageKeyPrefix, s.admin.handleUsageAction)
+	s.mux.HandleFunc(writesKeyPrefix, s.admin.handleWritesAction)
+	s.mux.HandleFunc(clientsKeyPrefix, s.admin.handleClientsAction)
+	s.mux.HandleFunc(sendNextKeyPrefix, s.admin.handleSendNextAction)
+	s.mux.HandleFunc(tlsKeyPrefix, s.admin.handleTLSAction)
+	s.mux.HandleFunc(nodesKeyPrefix, s.admin.handleNodesAction)
+	s.mux.HandleFunc(gossipKeyPrefix, s.admin.handleGossipAction)
+	s.mux.HandleFunc(jobsKeyPrefix, s.admin.handleJobsAction)
+	s.mux.HandleFunc(jobsKeyPrefix+"/", s.admin.handleJobsAction)
 	s.mux.HandleFunc(kv.KVKeyPrefix, s.kvREST.HandleAction)
 	s.mux.HandleFunc(structured.StructuredKeyPrefix, s.structuredREST.HandleAction)
 }
@@ -277,6 +397,7 @@ func (s *server) stop() {
 	// TODO(spencer): the http server should exit; this functionality is
 	// slated for go 1.3.
 	s.node.stop()
+	s.kvDB.Close()
 	s.gossip.Stop()
 	s.rpc.Close()
 }
@@ -39,6 +39,7 @@ func init() {
 	// have been launched for the purpose of this test.
 	*httpAddr = "127.0.0.1:0"
 	*rpcAddr = "127.0.0.1:0"
+	*insecure = true
 }
 
 func startServer() *server {
@@ -86,7 +87,7 @@ func TestInitEngine(t *testing.T) {
 		{"abc=/dev/null", storage.HDD, true},
 	}
 	for _, spec := range testCases {
-		engine, err := initEngine(spec.key)
+		engine, err := initEngine(spec.key, storage.RocksDBOptions{})
 		if err == nil {
 			if spec.wantError {
 				t.Fatalf("invalid engine spec '%v' erroneously accepted", spec.key)
@@ -0,0 +1,223 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"flag"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/golang/glog"
+)
+
+var (
+	latencySLOs = flag.String("latency_slos", "", "comma-separated list of per-method latency "+
+		"objectives for requests served by this node, as <method>:p<percentile>=<duration>; "+
+		"e.g. -latency_slos=Get:p99=10ms,Scan:p99=100ms")
+	sloWindow = flag.Duration("slo_window", 10*time.Second, "interval over which attainment "+
+		"of latency objectives is evaluated")
+	sloSustainedWindows = flag.Int("slo_sustained_windows", 3, "number of consecutive windows "+
+		"in which a latency objective must be missed before a violation is reported")
+)
+
+// maxSLOEvents is the number of recent violation and recovery events
+// retained for inspection.
+const maxSLOEvents = 100
+
+// A LatencySLO is a latency objective for requests of a method: the
+// fraction Quantile of requests should complete within Target.
+type LatencySLO struct {
+	Method   string
+	Quantile float64
+	Target   time.Duration
+}
+
+// parseLatencySLOs parses a comma-separated list of objectives of the
+// form <method>:p<percentile>=<duration>, such as "Get:p99=10ms" or
+// "Scan:p99.9=100ms".
+func parseLatencySLOs(spec string) ([]LatencySLO, error) {
+	var slos []LatencySLO
+	for _, s := range strings.Split(spec, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		colon, eq := strings.Index(s, ":p"), strings.Index(s, "=")
+		if colon <= 0 || eq < colon {
+			return nil, util.Errorf("invalid latency objective %q; expected <method>:p<percentile>=<duration>", s)
+		}
+		percentile, err := strconv.ParseFloat(s[colon+2:eq], 64)
+		if err != nil || percentile <= 0 || percentile >= 100 {
+			return nil, util.Errorf("invalid percentile in latency objective %q", s)
+		}
+		target, err := time.ParseDuration(s[eq+1:])
+		if err != nil || target <= 0 {
+			return nil, util.Errorf("invalid target in latency objective %q", s)
+		}
+		slos = append(slos, LatencySLO{Method: s[:colon], Quantile: percentile / 100, Target: target})
+	}
+	return slos, nil
+}
+
+// SLOStatus reports the attainment of a latency objective.
+type SLOStatus struct {
+	LatencySLO
+	Requests        int64   // Requests recorded since the node started
+	Met             int64   // Recorded requests which completed within the target
+	Windows         int64   // Evaluated windows with requests
+	MissedWindows   int64   // Evaluated windows in which the objective was missed
+	LastAttainment  float64 // Fraction within target in the last window with requests
+	ConsecutiveMiss int     // Consecutive windows in which the objective was missed
+	Violating       bool    // Whether a sustained violation is in progress
+}
+
+// An SLOEvent marks the start of a sustained violation of a latency
+// objective, or the recovery from one.
+type SLOEvent struct {
+	Time       time.Time
+	Method     string
+	Quantile   float64
+	Target     time.Duration
+	Attainment float64 // Fraction within target in the window which triggered the event
+	Recovered  bool
+}
+
+// sloState holds a latency objective's status and the counts of the
+// current window.
+type sloState struct {
+	status      SLOStatus
+	windowTotal int64 // Requests recorded in the current window
+	windowMet   int64 // Of which completed within the target
+}
+
+// An sloTracker tracks attainment of latency objectives. Requests are
+// recorded as they complete; at the end of each window, the fraction
+// of each method's requests which completed within its target is
+// compared with the objective's quantile. Missing the objective for
+// sustain consecutive windows starts a violation, which ends with the
+// first window in which the objective is met. Windows without
+// requests are skipped. Each violation and recovery is logged and
+// retained as an SLOEvent.
+type sloTracker struct {
+	mu      sync.Mutex
+	sustain int
+	slos    map[string]*sloState // By method
+	events  []SLOEvent           // Most recent events, oldest first
+}
+
+// newSLOTracker returns a tracker of slos which reports violations
+// sustained for the given number of windows.
+func newSLOTracker(slos []LatencySLO, sustain int) *sloTracker {
+	if sustain < 1 {
+		sustain = 1
+	}
+	t := &sloTracker{sustain: sustain, slos: map[string]*sloState{}}
+	for _, slo := range slos {
+		t.slos[slo.Method] = &sloState{status: SLOStatus{LatencySLO: slo}}
+	}
+	return t
+}
+
+// record records the latency of a request of method.
+func (t *sloTracker) record(method string, latency time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.slos[method]
+	if !ok {
+		return
+	}
+	s.status.Requests++
+	s.windowTotal++
+	if latency <= s.status.Target {
+		s.status.Met++
+		s.windowMet++
+	}
+}
+
+// endWindow evaluates the current window of each objective as of now
+// and starts a new one.
+func (t *sloTracker) endWindow(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, s := range t.slos {
+		if s.windowTotal == 0 {
+			continue
+		}
+		st := &s.status
+		attainment := float64(s.windowMet) / float64(s.windowTotal)
+		s.windowTotal, s.windowMet = 0, 0
+		st.Windows++
+		st.LastAttainment = attainment
+		if attainment < st.Quantile {
+			st.MissedWindows++
+			st.ConsecutiveMiss++
+			if !st.Violating && st.ConsecutiveMiss >= t.sustain {
+				st.Violating = true
+				glog.Warningf("latency objective %s:p%g=%s violated for %d windows; %.2f%% of requests within target",
+					st.Method, st.Quantile*100, st.Target, st.ConsecutiveMiss, attainment*100)
+				t.addEvent(SLOEvent{Time: now, Method: st.Method, Quantile: st.Quantile, Target: st.Target, Attainment: attainment})
+			}
+			continue
+		}
+		st.ConsecutiveMiss = 0
+		if st.Violating {
+			st.Violating = false
+			glog.Infof("latency objective %s:p%g=%s recovered; %.2f%% of requests within target",
+				st.Method, st.Quantile*100, st.Target, attainment*100)
+			t.addEvent(SLOEvent{Time: now, Method: st.Method, Quantile: st.Quantile, Target: st.Target,
+				Attainment: attainment, Recovered: true})
+		}
+	}
+}
+
+// addEvent retains ev, discarding the oldest event if there are more
+// than maxSLOEvents. Requires the lock.
+func (t *sloTracker) addEvent(ev SLOEvent) {
+	t.events = append(t.events, ev)
+	if len(t.events) > maxSLOEvents {
+		t.events = append([]SLOEvent(nil), t.events[len(t.events)-maxSLOEvents:]...)
+	}
+}
+
+// statuses returns the status of each objective, sorted by method.
+func (t *sloTracker) statuses() []SLOStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	statuses := make([]SLOStatus, 0, len(t.slos))
+	for _, s := range t.slos {
+		statuses = append(statuses, s.status)
+	}
+	sort.Sort(sloStatuses(statuses))
+	return statuses
+}
+
+// recentEvents returns the retained violation and recovery events,
+// oldest first.
+func (t *sloTracker) recentEvents() []SLOEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]SLOEvent(nil), t.events...)
+}
+
+// sloStatuses implements sort.Interface, ordering statuses by method.
+type sloStatuses []SLOStatus
+
+func (ss sloStatuses) Len() int           { return len(ss) }
+func (ss sloStatuses) Swap(i, j int)      { ss[i], ss[j] = ss[j], ss[i] }
+func (ss sloStatuses) Less(i, j int) bool { return ss[i].Method < ss[j].Method }
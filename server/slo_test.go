@@ -0,0 +1,121 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// TestParseLatencySLOs verifies parsing of latency objectives.
+func TestParseLatencySLOs(t *testing.T) {
+	slos, err := parseLatencySLOs("Get:p99=10ms, Scan:p99.9=100ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expSLOs := []LatencySLO{
+		{Method: "Get", Quantile: 0.99, Target: 10 * time.Millisecond},
+		{Method: "Scan", Quantile: 0.999, Target: 100 * time.Millisecond},
+	}
+	if len(slos) != len(expSLOs) {
+		t.Fatalf("expected %+v; got %+v", expSLOs, slos)
+	}
+	for i, slo := range slos {
+		exp := expSLOs[i]
+		if slo.Method != exp.Method || math.Abs(slo.Quantile-exp.Quantile) > 1e-9 || slo.Target != exp.Target {
+			t.Errorf("expected %+v; got %+v", exp, slo)
+		}
+	}
+	if slos, err := parseLatencySLOs(""); err != nil || len(slos) != 0 {
+		t.Errorf("expected no objectives; got %+v, %v", slos, err)
+	}
+	for _, spec := range []string{"Get", "Get=10ms", "Get:p100=10ms", "Get:pxx=10ms", "Get:p99=fast", "Get:p99=-1ms"} {
+		if _, err := parseLatencySLOs(spec); err == nil {
+			t.Errorf("expected error parsing %q", spec)
+		}
+	}
+}
+
+// TestSLOTracker verifies a violation is reported only once the
+// objective has been missed for the sustained number of windows, and
+// recovery once it's met again.
+func TestSLOTracker(t *testing.T) {
+	tracker := newSLOTracker([]LatencySLO{{Method: "Get", Quantile: 0.9, Target: 10 * time.Millisecond}}, 2)
+	window := func(fast, slow int) {
+		for i := 0; i < fast; i++ {
+			tracker.record("Get", time.Millisecond)
+		}
+		for i := 0; i < slow; i++ {
+			tracker.record("Get", time.Second)
+		}
+		tracker.record("Put", time.Second)
+		tracker.endWindow(time.Now())
+	}
+
+	window(8, 2)
+	if s := tracker.statuses()[0]; s.Violating || s.ConsecutiveMiss != 1 || s.LastAttainment != 0.8 {
+		t.Errorf("expected single missed window without violation; got %+v", s)
+	}
+	// Windows without requests are skipped.
+	tracker.endWindow(time.Now())
+	window(5, 5)
+	if s := tracker.statuses()[0]; !s.Violating || s.MissedWindows != 2 || s.Windows != 2 {
+		t.Errorf("expected sustained violation; got %+v", s)
+	}
+	window(5, 5)
+	window(10, 0)
+	s := tracker.statuses()[0]
+	if s.Violating || s.ConsecutiveMiss != 0 || s.Requests != 40 || s.Met != 28 {
+		t.Errorf("expected recovery; got %+v", s)
+	}
+	events := tracker.recentEvents()
+	if len(events) != 2 || events[0].Recovered || !events[1].Recovered || events[0].Attainment != 0.5 {
+		t.Errorf("expected violation and recovery events; got %+v", events)
+	}
+	if len(tracker.statuses()) != 1 {
+		t.Error("expected only methods with objectives to be tracked")
+	}
+}
+
+// TestNodeTracksLatencySLOs verifies the latencies of requests served
+// by a node are tracked against its latency objectives.
+func TestNodeTracksLatencySLOs(t *testing.T) {
+	*latencySLOs = "Get:p99=10s"
+	defer func() { *latencySLOs = "" }()
+	engine := storage.NewInMem(1 << 20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	addr := util.CreateTestAddr("tcp")
+	server, node := createTestNode(addr, []storage.Engine{engine}, addr, t)
+	defer server.Close()
+
+	if gr := <-node.kvDB.Get(&storage.GetRequest{Key: storage.Key("a")}); gr.Error != nil {
+		t.Fatal(gr.Error)
+	}
+	node.slos.endWindow(time.Now())
+	statuses, events := node.SLOStatuses()
+	if len(statuses) != 1 || statuses[0].Requests == 0 || statuses[0].Met != statuses[0].Requests || statuses[0].Windows != 1 {
+		t.Errorf("expected requests within target; got %+v", statuses)
+	}
+	if len(events) != 0 {
+		t.Errorf("expected no violations; got %+v", events)
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"net"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/golang/glog"
+	yaml "gopkg.in/yaml.v1"
+)
+
+const (
+	// defaultLocalAddr is the address to which local cluster nodes bind
+	// unless their spec specifies addresses.
+	defaultLocalAddr = "127.0.0.1:0"
+	// localClusterStartTimeout bounds the wait for each node of a
+	// local cluster to initialize its stores.
+	localClusterStartTimeout = 10 * time.Second
+)
+
+// A Topology declaratively specifies a cluster: its nodes, with their
+// stores and locality attributes, the zone configs to install and the
+// keys at which to pre-split the key space. A cluster is stood up from
+// its topology in one step by StartLocalCluster, for reproducible test
+// and demo environments. Topologies are YAML-formatted; see the
+// start-local command for an example.
+type Topology struct {
+	// ClusterID is the cluster's ID; a new UUID if unspecified.
+	ClusterID string     `yaml:"cluster_id,omitempty"`
+	Nodes     []NodeSpec `yaml:"nodes"`
+	// Zones maps key prefixes to their zone configs; the empty prefix
+	// replaces the default zone config.
+	Zones map[string]storage.ZoneConfig `yaml:"zones,omitempty"`
+	// Splits are the keys at which ranges are split once the cluster
+	// has started.
+	Splits []string `yaml:"splits,omitempty"`
+}
+
+// A NodeSpec specifies a node of a Topology. The first store of the
+// first node is bootstrapped with the cluster's first range.
+type NodeSpec struct {
+	Datacenter string `yaml:"datacenter,omitempty"`
+	PDU        string `yaml:"pdu,omitempty"`
+	Rack       string `yaml:"rack,omitempty"`
+	// Stores are specified as for -data_dirs: ssd=<path>, hdd=<path>
+	// or mem=<capacity-in-bytes>.
+	Stores []string `yaml:"stores"`
+	// RPCAddr and HTTPAddr are the addresses the node binds; unused
+	// local ports by default.
+	RPCAddr  string `yaml:"rpc_addr,omitempty"`
+	HTTPAddr string `yaml:"http_addr,omitempty"`
+}
+
+// ParseTopology parses and validates a YAML-formatted Topology.
+func ParseTopology(in []byte) (*Topology, error) {
+	t := &Topology{}
+	if err := yaml.Unmarshal(in, t); err != nil {
+		return nil, util.Errorf("unable to parse topology: %v", err)
+	}
+	return t, t.Validate()
+}
+
+// Validate returns an error if the topology has no nodes, a node
+// without stores or an invalid zone config or split key.
+func (t *Topology) Validate() error {
+	if len(t.Nodes) == 0 {
+		return util.Errorf("topology specifies no nodes")
+	}
+	for i, node := range t.Nodes {
+		if len(node.Stores) == 0 {
+			return util.Errorf("node %d specifies no stores", i+1)
+		}
+		for _, spec := range node.Stores {
+			if !dataDirRE.MatchString(spec) {
+				return util.Errorf("node %d: invalid store specification %q", i+1, spec)
+			}
+		}
+	}
+	for prefix, zone := range t.Zones {
+		if err := zone.Validate(); err != nil {
+			return util.Errorf("zone %q: %v", prefix, err)
+		}
+	}
+	for _, split := range t.Splits {
+		if split == "" {
+			return util.Errorf("empty split key")
+		}
+	}
+	return nil
+}
+
+// A LocalCluster is a cluster of nodes running in this process,
+// started from a Topology.
+type LocalCluster struct {
+	ClusterID string
+	servers   []*server
+}
+
+// StartLocalCluster starts the cluster specified by t in this process.
+// The first node's first store is bootstrapped and the other nodes
+// join it via gossip; once every node has initialized its stores, the
+// topology's zone configs are written and its splits performed.
+func StartLocalCluster(t *Topology) (*LocalCluster, error) {
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	lc := &LocalCluster{ClusterID: t.ClusterID}
+	if lc.ClusterID == "" {
+		lc.ClusterID = uuid.New()
+	}
+	if err := lc.startNodes(t.Nodes); err != nil {
+		lc.Stop()
+		return nil, err
+	}
+	if err := lc.configure(t); err != nil {
+		lc.Stop()
+		return nil, err
+	}
+	return lc, nil
+}
+
+// startNodes starts a server for each node spec in turn, waiting for
+// each to initialize its stores before starting the next.
+func (lc *LocalCluster) startNodes(specs []NodeSpec) error {
+	opts := storage.RocksDBOptions{CacheSize: *cacheSize, MaxOpenFiles: *maxOpenFiles, SyncWrites: *syncWrites}
+	for i, spec := range specs {
+		engines := make([]storage.Engine, 0, len(spec.Stores))
+		for _, storeSpec := range spec.Stores {
+			engine, err := initEngine(storeSpec, opts)
+			if err != nil {
+				return err
+			}
+			engines = append(engines, engine)
+		}
+		if i == 0 {
+			if _, err := bootstrapCluster(lc.ClusterID, engines[0], spec.Datacenter); err != nil {
+				return err
+			}
+		}
+		s, err := newLocalServer(spec)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			s.gossip.SetBootstrap([]net.Addr{lc.servers[0].rpc.Addr()})
+		}
+		if err := s.start(engines, i == 0); err != nil {
+			return err
+		}
+		lc.servers = append(lc.servers, s)
+		if err := util.IsTrueWithin(func() bool {
+			return s.node.getStoreCount() == len(engines)
+		}, localClusterStartTimeout); err != nil {
+			return util.Errorf("node %d failed to initialize %d stores: %v", i+1, len(engines), err)
+		}
+		glog.Infof("started node %d of local cluster %s: rpc %s, http %s",
+			s.node.Attributes.NodeID, lc.ClusterID, s.rpc.Addr(), (*s.httpListener).Addr())
+	}
+	return nil
+}
+
+// newLocalServer returns a server for the node specified by spec.
+func newLocalServer(spec NodeSpec) (*server, error) {
+	rpcAddr, httpAddr := spec.RPCAddr, spec.HTTPAddr
+	if rpcAddr == "" {
+		rpcAddr = defaultLocalAddr
+	}
+	if httpAddr == "" {
+		httpAddr = defaultLocalAddr
+	}
+	addr, err := net.ResolveTCPAddr("tcp", rpcAddr)
+	if err != nil {
+		return nil, err
+	}
+	s := newServerAt(addr.IP.String(), addr, httpAddr)
+	s.node.Attributes = storage.NodeAttributes{
+		Datacenter: spec.Datacenter,
+		PDU:        spec.PDU,
+		Rack:       spec.Rack,
+	}
+	return s, nil
+}
+
+// configure writes the zone configs of t and splits its ranges at
+// t's split keys.
+func (lc *LocalCluster) configure(t *Topology) error {
+	db := lc.DB()
+	for prefix, zone := range t.Zones {
+		zone := zone
+		zoneKey := storage.MakeKey(storage.KeyConfigZonePrefix, storage.Key(prefix))
+		if err := kv.PutI(db, zoneKey, &zone); err != nil {
+			return util.Errorf("unable to write zone config for %q: %v", prefix, err)
+		}
+	}
+	for _, split := range t.Splits {
+		reply := <-db.AdminSplit(&storage.AdminSplitRequest{SplitKey: storage.Key(split)})
+		if reply.Error != nil {
+			return util.Errorf("unable to split at %q: %v", split, reply.Error)
+		}
+	}
+	return nil
+}
+
+// DB returns a client of the cluster, via its first node.
+func (lc *LocalCluster) DB() kv.DB {
+	return lc.servers[0].kvDB
+}
+
+// Nodes returns the cluster's nodes, in the order of its topology.
+func (lc *LocalCluster) Nodes() []*Node {
+	nodes := make([]*Node, len(lc.servers))
+	for i, s := range lc.servers {
+		nodes[i] = s.node
+	}
+	return nodes
+}
+
+// Stop stops the cluster's nodes, most recently started first.
+func (lc *LocalCluster) Stop() {
+	for i := len(lc.servers) - 1; i >= 0; i-- {
+		lc.servers[i].stop()
+	}
+	lc.servers = nil
+}
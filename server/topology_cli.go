@@ -0,0 +1,85 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"os/signal"
+
+	commander "code.google.com/p/go-commander"
+	"github.com/golang/glog"
+)
+
+// A CmdStartLocal command starts a local cluster from a topology file.
+var CmdStartLocal = &commander.Command{
+	UsageLine: "start-local <topology-file>",
+	Short:     "start a fully configured cluster in this process",
+	Long: `
+Start a new Cockroach cluster in this process, as specified by the
+YAML-formatted topology file, for test and demo environments. The
+topology specifies the cluster's nodes, each with its stores and
+locality attributes, the zone configs to install and the keys at
+which to pre-split the key space. For example:
+
+  cluster_id: demo
+  nodes:
+  - datacenter: us-east-1a
+    stores: [mem=1073741824, mem=1073741824]
+  - datacenter: us-west-1a
+    stores: [mem=1073741824]
+    http_addr: 127.0.0.1:8080
+  zones:
+    db1: {replicas: {us-east-1a: [mem], us-west-1a: [mem]}}
+  splits: [db1, db2]
+
+Stores are specified as for -data_dirs. Nodes bind unused local ports
+unless rpc_addr and http_addr are specified. The cluster runs until
+the process is interrupted.
+`,
+	Run:  runStartLocal,
+	Flag: *flag.CommandLine,
+}
+
+// runStartLocal starts the local cluster specified by the topology
+// file and blocks until interrupted.
+func runStartLocal(cmd *commander.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		return
+	}
+	body, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		glog.Fatalf("unable to read topology file %q: %v", args[0], err)
+	}
+	topology, err := ParseTopology(body)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	lc, err := StartLocalCluster(topology)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	defer lc.Stop()
+	glog.Infof("Cockroach cluster %s started with %d nodes", lc.ClusterID, len(topology.Nodes))
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, os.Kill)
+
+	// Block until one of the signals above is received.
+	<-c
+}
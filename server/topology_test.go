@@ -0,0 +1,111 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+const testTopology = `
+cluster_id: topology-test
+nodes:
+- datacenter: dc1
+  rack: r1
+  stores: [mem=1048576, mem=1048576]
+- datacenter: dc2
+  stores: [mem=1048576]
+zones:
+  db1: {replicas: {dc1: [mem]}, range_max_bytes: 1048576}
+splits: [db1, db2]
+`
+
+// TestParseTopology verifies topologies are parsed and that invalid
+// topologies are rejected.
+func TestParseTopology(t *testing.T) {
+	topology, err := ParseTopology([]byte(testTopology))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topology.ClusterID != "topology-test" || len(topology.Nodes) != 2 ||
+		len(topology.Nodes[0].Stores) != 2 || topology.Nodes[0].Rack != "r1" ||
+		topology.Zones["db1"].RangeMaxBytes != 1048576 || len(topology.Splits) != 2 {
+		t.Errorf("unexpected topology %+v", topology)
+	}
+	for i, invalid := range []string{
+		`nodes: []`,
+		`nodes: [{datacenter: dc1}]`,
+		`nodes: [{stores: [floppy=/dev/fd0]}]`,
+		`{nodes: [{stores: [mem=1024]}], zones: {db1: {gc_ttl_seconds: -1}}}`,
+		`{nodes: [{stores: [mem=1024]}], splits: [""]}`,
+	} {
+		if _, err := ParseTopology([]byte(invalid)); err == nil {
+			t.Errorf("%d: expected error parsing %s", i, invalid)
+		}
+	}
+}
+
+// TestStartLocalCluster verifies a local cluster is started with the
+// nodes, stores, zone configs and splits of its topology.
+func TestStartLocalCluster(t *testing.T) {
+	*gossip.GossipInterval = 10 * time.Millisecond
+	topology, err := ParseTopology([]byte(testTopology))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc, err := StartLocalCluster(topology)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lc.Stop()
+
+	nodes := lc.Nodes()
+	if len(nodes) != 2 {
+		t.Fatalf("expected 2 nodes; got %d", len(nodes))
+	}
+	for i, expected := range []struct {
+		stores     int
+		datacenter string
+	}{{2, "dc1"}, {1, "dc2"}} {
+		if count := nodes[i].getStoreCount(); count != expected.stores {
+			t.Errorf("node %d: expected %d stores; got %d", i+1, expected.stores, count)
+		}
+		if dc := nodes[i].Attributes.Datacenter; dc != expected.datacenter {
+			t.Errorf("node %d: expected datacenter %q; got %q", i+1, expected.datacenter, dc)
+		}
+	}
+	if nodes[0].ClusterID != "topology-test" {
+		t.Errorf("expected cluster ID topology-test; got %q", nodes[0].ClusterID)
+	}
+
+	db := lc.DB()
+	zone := &storage.ZoneConfig{}
+	zoneKey := storage.MakeKey(storage.KeyConfigZonePrefix, storage.Key("db1"))
+	if ok, _, err := kv.GetI(db, zoneKey, zone); err != nil || !ok || zone.RangeMaxBytes != 1048576 {
+		t.Errorf("expected zone config for db1; got %+v, %t, %v", zone, ok, err)
+	}
+	// Each split leaves a range ending at the split key.
+	for _, split := range topology.Splits {
+		meta2Key := storage.MakeKey(storage.KeyMeta2Prefix, storage.Key(split))
+		if ok, _, err := kv.GetI(db, meta2Key, &storage.RangeLocations{}); err != nil || !ok {
+			t.Errorf("expected range ending at %q; got %t, %v", split, ok, err)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"bytes"
+	"flag"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+var (
+	writeSamplePrefixes = flag.String("write_sample_prefixes", "", "comma-separated list of key "+
+		"prefixes whose writes to this node's ranges are sampled for inspection via the admin API; "+
+		"prefixes may also be added and removed at runtime")
+	writeSampleRate = flag.Float64("write_sample_rate", 0.01, "fraction of writes to sampled "+
+		"prefixes which are recorded")
+	writeSampleSize = flag.Int("write_sample_size", 1000, "number of recent sampled writes "+
+		"retained per prefix")
+)
+
+// A WriteSample describes a sampled write to a key.
+type WriteSample struct {
+	Method    string      // The write's method, such as "Put"
+	Key       storage.Key // The key written
+	Bytes     int64       // The size of the key and value written
+	Timestamp int64       // The write's timestamp, in nanoseconds since the epoch
+	TxID      string      // The write's transaction, if any
+	Client    string      // The client which sent the write, if identified
+}
+
+// PrefixWriteSamples holds the sampled writes to a key prefix, oldest
+// first.
+type PrefixWriteSamples struct {
+	Prefix  storage.Key
+	Samples []WriteSample
+}
+
+// A writeRing retains the most recent samples of a prefix, up to its
+// capacity, overwriting the oldest once full.
+type writeRing struct {
+	samples []WriteSample
+	next    int // Index of the oldest sample once full
+}
+
+// add records sample, overwriting the oldest if the ring is full.
+func (wr *writeRing) add(sample WriteSample, size int) {
+	if len(wr.samples) < size {
+		wr.samples = append(wr.samples, sample)
+		return
+	}
+	wr.samples[wr.next] = sample
+	wr.next = (wr.next + 1) % len(wr.samples)
+}
+
+// list returns the ring's samples, oldest first.
+func (wr *writeRing) list() []WriteSample {
+	return append(append([]WriteSample(nil), wr.samples[wr.next:]...), wr.samples[:wr.next]...)
+}
+
+// A writeSampler records a random sample of the writes a node
+// executes to each of a set of key prefixes, in a ring buffer per
+// prefix. It answers what is writing to a prefix without tracing all
+// requests. A write whose key matches several prefixes is recorded
+// for each.
+type writeSampler struct {
+	rate float64 // Fraction of writes recorded
+	size int     // Samples retained per prefix
+
+	mu    sync.Mutex
+	rings map[string]*writeRing // Rings by prefix
+}
+
+// newWriteSampler creates a sampler of the writes to prefixes, which
+// records the fraction rate of writes and retains size per prefix.
+func newWriteSampler(prefixes []storage.Key, rate float64, size int) *writeSampler {
+	ws := &writeSampler{rate: rate, size: size, rings: map[string]*writeRing{}}
+	for _, prefix := range prefixes {
+		ws.start(prefix)
+	}
+	return ws
+}
+
+// parseWriteSamplePrefixes parses a comma-separated list of prefixes.
+func parseWriteSamplePrefixes(spec string) []storage.Key {
+	var prefixes []storage.Key
+	for _, s := range strings.Split(spec, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			prefixes = append(prefixes, storage.Key(s))
+		}
+	}
+	return prefixes
+}
+
+// start begins sampling writes to prefix. Samples already retained
+// for the prefix are kept.
+func (ws *writeSampler) start(prefix storage.Key) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if _, ok := ws.rings[string(prefix)]; !ok {
+		ws.rings[string(prefix)] = &writeRing{}
+	}
+}
+
+// stop ends sampling writes to prefix and discards its samples.
+func (ws *writeSampler) stop(prefix storage.Key) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	delete(ws.rings, string(prefix))
+}
+
+// record samples the keys written by the request args of method,
+// executed with header.
+func (ws *writeSampler) record(method string, header *storage.RequestHeader, args interface{}) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if len(ws.rings) == 0 {
+		return
+	}
+	for _, kv := range writtenKeys(args) {
+		for prefix, ring := range ws.rings {
+			if !bytes.HasPrefix(kv.Key, storage.Key(prefix)) || rand.Float64() >= ws.rate {
+				continue
+			}
+			ring.add(WriteSample{
+				Method:    method,
+				Key:       kv.Key,
+				Bytes:     int64(len(kv.Key) + len(kv.Value.Bytes)),
+				Timestamp: header.Timestamp,
+				TxID:      header.TxID,
+				Client:    header.Client,
+			}, ws.size)
+		}
+	}
+}
+
+// samples returns the samples of each prefix, sorted by prefix.
+func (ws *writeSampler) samples() []PrefixWriteSamples {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	prefixes := make([]string, 0, len(ws.rings))
+	for prefix := range ws.rings {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	result := make([]PrefixWriteSamples, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		result = append(result, PrefixWriteSamples{
+			Prefix:  storage.Key(prefix),
+			Samples: ws.rings[prefix].list(),
+		})
+	}
+	return result
+}
+
+// writtenKeys returns the keys written by the request args, with the
+// values written to them, if any. A DeleteRange is represented by its
+// start key.
+func writtenKeys(args interface{}) []storage.KeyValue {
+	switch t := args.(type) {
+	case *storage.PutRequest:
+		return []storage.KeyValue{{Key: t.Key, Value: t.Value}}
+	case *storage.AppendRequest:
+		return []storage.KeyValue{{Key: t.Key, Value: t.Value}}
+	case *storage.IncrementRequest:
+		return []storage.KeyValue{{Key: t.Key}}
+	case *storage.DeleteRequest:
+		return []storage.KeyValue{{Key: t.Key}}
+	case *storage.DeleteRangeRequest:
+		return []storage.KeyValue{{Key: t.StartKey}}
+	case *storage.EnqueueMessageRequest:
+		return []storage.KeyValue{{Key: t.Inbox, Value: t.Message}}
+	case *storage.InternalBulkWriteRequest:
+		return t.Rows
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// TestWriteSampler verifies writes are sampled by matching prefix and
+// that only the most recent samples of each prefix are retained.
+func TestWriteSampler(t *testing.T) {
+	ws := newWriteSampler(parseWriteSamplePrefixes("a, b"), 1, 3)
+	header := &storage.RequestHeader{Timestamp: 1, TxID: "txn"}
+	for i := 0; i < 5; i++ {
+		ws.record("Put", header, &storage.PutRequest{
+			Key:   storage.Key(fmt.Sprintf("a%d", i)),
+			Value: storage.Value{Bytes: []byte("value")},
+		})
+	}
+	ws.record("Delete", header, &storage.DeleteRequest{Key: storage.Key("b")})
+	ws.record("Delete", header, &storage.DeleteRequest{Key: storage.Key("c")})
+
+	samples := ws.samples()
+	if len(samples) != 2 || !bytes.Equal(samples[0].Prefix, storage.Key("a")) || !bytes.Equal(samples[1].Prefix, storage.Key("b")) {
+		t.Fatalf("expected samples of prefixes a and b; got %+v", samples)
+	}
+	var keys []string
+	for _, s := range samples[0].Samples {
+		keys = append(keys, string(s.Key))
+	}
+	if fmt.Sprint(keys) != "[a2 a3 a4]" {
+		t.Errorf("expected the 3 most recent writes to a, oldest first; got %v", keys)
+	}
+	if s := samples[0].Samples[0]; s.Method != "Put" || s.Bytes != 7 || s.Timestamp != 1 || s.TxID != "txn" {
+		t.Errorf("unexpected sample %+v", s)
+	}
+	if len(samples[1].Samples) != 1 || samples[1].Samples[0].Method != "Delete" {
+		t.Errorf("expected delete of b to be sampled; got %+v", samples[1].Samples)
+	}
+
+	ws.stop(storage.Key("a"))
+	if samples := ws.samples(); len(samples) != 1 {
+		t.Errorf("expected sampling of a to stop; got %+v", samples)
+	}
+}
+
+// TestNodeSamplesWrites verifies a node samples the writes it executes
+// to prefixes added at runtime.
+func TestNodeSamplesWrites(t *testing.T) {
+	*writeSampleRate = 1
+	defer func() { *writeSampleRate = 0.01 }()
+	engine := storage.NewInMem(1 << 20)
+	if _, err := BootstrapCluster("cluster-1", engine); err != nil {
+		t.Fatal(err)
+	}
+	addr := util.CreateTestAddr("tcp")
+	server, node := createTestNode(addr, []storage.Engine{engine}, addr, t)
+	defer server.Close()
+
+	node.StartWriteSampling(storage.Key("hot/"))
+	for _, key := range []string{"hot/a", "cold/a"} {
+		pr := <-node.kvDB.Put(&storage.PutRequest{Key: storage.Key(key), Value: storage.Value{Bytes: []byte("value")}})
+		if pr.Error != nil {
+			t.Fatal(pr.Error)
+		}
+	}
+	samples := node.WriteSamples()
+	if len(samples) != 1 || len(samples[0].Samples) != 1 {
+		t.Fatalf("expected one sampled write; got %+v", samples)
+	}
+	if s := samples[0].Samples[0]; !bytes.Equal(s.Key, storage.Key("hot/a")) || s.Timestamp == 0 {
+		t.Errorf("expected timestamped write to hot/a; got %+v", s)
+	}
+}
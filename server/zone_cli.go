@@ -30,18 +30,27 @@ import (
 
 	commander "code.google.com/p/go-commander"
 	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/rpc"
 	"github.com/cockroachdb/cockroach/util"
 	"github.com/golang/glog"
 )
 
 // sendAdminRequest send an HTTP request and processes the response for
-// its body or error message if a non-200 response code.
+// its body or error message if a non-200 response code. Unless
+// -insecure is specified, the request is sent over TLS.
 func sendAdminRequest(req *http.Request) ([]byte, error) {
-	resp, err := http.DefaultClient.Do(req)
-	defer resp.Body.Close()
+	client, err := adminClient()
+	if err != nil {
+		return nil, err
+	}
+	if !*insecure {
+		req.URL.Scheme = "https"
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, util.Errorf("admin REST request failed: %v\n", err)
 	}
+	defer resp.Body.Close()
 	b, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, util.Errorf("unable to read admin REST response: %v\n", err)
@@ -52,6 +61,25 @@ func sendAdminRequest(req *http.Request) ([]byte, error) {
 	return b, nil
 }
 
+// adminClient returns the client with which admin requests are sent:
+// one presenting the certificate given by -tls_cert and -tls_key and
+// verifying the node's against -tls_ca_cert or, with -insecure, one
+// without TLS.
+func adminClient() (*http.Client, error) {
+	if *insecure {
+		return http.DefaultClient, nil
+	}
+	if *tlsCert == "" || *tlsKey == "" || *tlsCACert == "" {
+		return nil, util.Errorf("admin requests are sent over TLS with -tls_cert, -tls_key and -tls_ca_cert; " +
+			"specify -insecure to send them without TLS")
+	}
+	config, err := rpc.LoadTLSConfig(*tlsCert, *tlsKey, *tlsCACert)
+	if err != nil {
+		return nil, util.Errorf("unable to load TLS certificates: %v", err)
+	}
+	return rpc.NewHTTPClient(config), nil
+}
+
 // A CmdGetZone command displays the zone config for the specified
 // prefix.
 var CmdGetZone = &commander.Command{
@@ -77,7 +105,6 @@ func runGetZones(cmd *commander.Command, args []string) {
 		fmt.Fprintf(os.Stderr, "unable to create request to admin REST endpoint: %v\n", err)
 		return
 	}
-	// TODO(spencer): need to move to SSL.
 	b, err := sendAdminRequest(req)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "admin REST request failed: %v\n", err)
@@ -171,7 +198,6 @@ func runRmZone(cmd *commander.Command, args []string) {
 		fmt.Fprintf(os.Stderr, "unable to create request to admin REST endpoint: %v\n", err)
 		return
 	}
-	// TODO(spencer): need to move to SSL.
 	_, err = sendAdminRequest(req)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "admin REST request failed: %v\n", err)
@@ -206,6 +232,7 @@ The zone config format has the following YAML schema:
     - ...
   range_min_bytes: <size-in-bytes>
   range_max_bytes: <size-in-bytes>
+  gc_ttl_seconds: <age-in-seconds>
 
 Setting zone configs will guarantee that key ranges will be split
 such that no key range straddles two zone config specifications.
@@ -234,7 +261,6 @@ func runSetZone(cmd *commander.Command, args []string) {
 		fmt.Fprintf(os.Stderr, "unable to create request to admin REST endpoint: %v\n", err)
 		return
 	}
-	// TODO(spencer): need to move to SSL.
 	_, err = sendAdminRequest(req)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "admin REST request failed: %v\n", err)
@@ -0,0 +1,378 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// Names of internal accounts. Internal subsystems keep their data
+// under system key prefixes; usage beneath those prefixes is
+// attributed to a named internal account so that operators can
+// distinguish growth in user data from system overhead.
+const (
+	AcctTimeSeries = "internal.timeseries"
+	AcctQueue      = "internal.queue"
+	AcctAuditLog   = "internal.auditlog"
+	AcctSystem     = "internal.system"
+	// AcctDefault is the account for user keys not matched by any
+	// accounting config.
+	AcctDefault = "default"
+)
+
+// internalAccounts maps system key prefixes to internal accounts.
+// Entries are matched in order, so more specific prefixes must
+// precede KeySystemPrefix.
+var internalAccounts = []struct {
+	prefix Key
+	name   string
+}{
+	{KeyTimeSeriesPrefix, AcctTimeSeries},
+	{KeyQueuePrefix, AcctQueue},
+	{KeyAuditLogPrefix, AcctAuditLog},
+	{KeySystemPrefix, AcctSystem},
+}
+
+// AcctUsage is an entry in a usage report, holding the storage and
+// operation counts attributed to a single account.
+type AcctUsage struct {
+	Account  string // Account name
+	Internal bool   // True for internal subsystem accounts
+	Bytes    int64  // Live bytes (keys + values)
+	Keys     int64  // Live keys
+	Reads    int64  // Read operations
+	Writes   int64  // Write operations
+	// EstKeys and EstPrefixes estimate the distinct keys and key
+	// prefixes written, without scanning; see keySketch. Summed
+	// across ranges, prefixes spanning ranges are counted in each.
+	EstKeys     int64
+	EstPrefixes int64
+}
+
+// add accumulates the counts in o into u.
+func (u *AcctUsage) add(o *AcctUsage) {
+	u.Bytes += o.Bytes
+	u.Keys += o.Keys
+	u.Reads += o.Reads
+	u.Writes += o.Writes
+	u.EstKeys += o.EstKeys
+	u.EstPrefixes += o.EstPrefixes
+}
+
+// UsageReport is a slice of per-account usage, sorted by account name.
+type UsageReport []AcctUsage
+
+// Implementation of sort.Interface.
+func (ur UsageReport) Len() int           { return len(ur) }
+func (ur UsageReport) Swap(i, j int)      { ur[i], ur[j] = ur[j], ur[i] }
+func (ur UsageReport) Less(i, j int) bool { return ur[i].Account < ur[j].Account }
+
+// MergeUsageReports combines reports, summing the usage of accounts
+// which appear in more than one.
+func MergeUsageReports(reports ...UsageReport) UsageReport {
+	byAcct := map[string]*AcctUsage{}
+	for _, report := range reports {
+		for i := range report {
+			u, ok := byAcct[report[i].Account]
+			if !ok {
+				u = &AcctUsage{Account: report[i].Account, Internal: report[i].Internal}
+				byAcct[u.Account] = u
+			}
+			u.add(&report[i])
+		}
+	}
+	return usageReportFromMap(byAcct)
+}
+
+// usageReportFromMap returns a sorted usage report from a map of
+// usage by account name.
+func usageReportFromMap(byAcct map[string]*AcctUsage) UsageReport {
+	report := make(UsageReport, 0, len(byAcct))
+	for _, u := range byAcct {
+		report = append(report, *u)
+	}
+	sort.Sort(report)
+	return report
+}
+
+// acctStats tracks usage by account for a range.
+type acctStats struct {
+	sync.Mutex
+	configs  *prefixConfigMap      // Accounting configs; nil for defaults
+	source   []*prefixConfig       // Configs as supplied to setConfigs
+	usage    map[string]*AcctUsage // Usage by account name
+	sketches map[string]*keySketch // Distinct key estimates by account name
+}
+
+// newAcctStats returns a new acctStats with no accounting configs;
+// user keys are attributed to AcctDefault until configs are set.
+func newAcctStats() *acctStats {
+	return &acctStats{
+		usage:    map[string]*AcctUsage{},
+		sketches: map[string]*keySketch{},
+	}
+}
+
+// setConfigs sets the accounting configs used to attribute usage of
+// user keys. An empty slice reverts to attributing all user keys to
+// AcctDefault. Returns whether the configs differ from those
+// previously set, in which case existing usage is misattributed and
+// must be recomputed by the caller.
+func (as *acctStats) setConfigs(configs []*prefixConfig) (bool, error) {
+	as.Lock()
+	defer as.Unlock()
+	if reflect.DeepEqual(configs, as.source) {
+		return false, nil
+	}
+	var pcm *prefixConfigMap
+	if len(configs) > 0 {
+		// newPrefixConfigMap sorts and appends to the slice it's given,
+		// and configs may be shared, e.g. with gossip.
+		var err error
+		if pcm, err = newPrefixConfigMap(append([]*prefixConfig(nil), configs...)); err != nil {
+			return false, err
+		}
+	}
+	as.configs = pcm
+	as.source = append([]*prefixConfig(nil), configs...)
+	return true, nil
+}
+
+// accountForKey returns the name of the account to which the
+// specified key is attributed and whether the account is internal.
+// System keys always belong to an internal account, regardless of
+// accounting configs.
+func (as *acctStats) accountForKey(key Key) (string, bool) {
+	for _, ia := range internalAccounts {
+		if bytes.HasPrefix(key, ia.prefix) {
+			return ia.name, true
+		}
+	}
+	if as.configs == nil {
+		return AcctDefault, false
+	}
+	pc := as.configs.matchByPrefix(key)
+	// The prefix of the returned config may be an end marker added
+	// by newPrefixConfigMap; look up the canonical entry to recover
+	// the prefix which actually names the account.
+	if canonical, ok := as.configs.canonicalConfigs[pc.Config]; ok {
+		pc = canonical
+	}
+	if config, ok := pc.Config.(*AcctConfig); ok && config.Name != "" {
+		return config.Name, false
+	}
+	if len(pc.Prefix) == 0 {
+		return AcctDefault, false
+	}
+	return string(pc.Prefix), false
+}
+
+// usageForKey returns the usage entry for the account of the
+// specified key, creating it if necessary. Requires the lock.
+func (as *acctStats) usageForKey(key Key) *AcctUsage {
+	name, internal := as.accountForKey(key)
+	u, ok := as.usage[name]
+	if !ok {
+		u = &AcctUsage{Account: name, Internal: internal}
+		as.usage[name] = u
+	}
+	return u
+}
+
+// sketchKey adds key to the sketch of its account, creating it if
+// necessary. Requires the lock.
+func (as *acctStats) sketchKey(key Key) {
+	name, _ := as.accountForKey(key)
+	ks, ok := as.sketches[name]
+	if !ok {
+		ks = &keySketch{}
+		as.sketches[name] = ks
+	}
+	ks.add(key)
+}
+
+// recordRead attributes a read operation at key.
+func (as *acctStats) recordRead(key Key) {
+	as.Lock()
+	defer as.Unlock()
+	as.usageForKey(key).Reads++
+}
+
+// recordScan attributes a scan which returned kvs, counting one read
+// for each returned row against the row's account. A scan returning
+// no rows is counted as a single read at startKey.
+func (as *acctStats) recordScan(startKey Key, kvs []KeyValue) {
+	as.Lock()
+	defer as.Unlock()
+	if len(kvs) == 0 {
+		as.usageForKey(startKey).Reads++
+		return
+	}
+	for _, kv := range kvs {
+		as.usageForKey(kv.Key).Reads++
+	}
+}
+
+// recordWrite attributes a write operation at key which changed its
+// value from before to after. Either value may be nil, indicating the
+// key did not exist or was deleted.
+func (as *acctStats) recordWrite(key Key, before, after []byte) {
+	as.Lock()
+	defer as.Unlock()
+	u := as.usageForKey(key)
+	u.Writes++
+	if before != nil {
+		u.Bytes -= int64(len(key) + len(before))
+		u.Keys--
+	}
+	if after != nil {
+		u.Bytes += int64(len(key) + len(after))
+		u.Keys++
+		as.sketchKey(key)
+	}
+}
+
+// recordStored attributes the keys and bytes of existing kvs, without
+// counting any operations.
+func (as *acctStats) recordStored(kvs []KeyValue) {
+	as.Lock()
+	defer as.Unlock()
+	for _, kv := range kvs {
+		u := as.usageForKey(kv.Key)
+		u.Bytes += int64(len(kv.Key) + len(kv.Value.Bytes))
+		u.Keys++
+		as.sketchKey(kv.Key)
+	}
+}
+
+// reset clears the recorded keys, bytes and key sketches of all
+// accounts. Operation counts can't be re-attributed and are retained
+// by the accounts which incurred them.
+func (as *acctStats) reset() {
+	as.Lock()
+	defer as.Unlock()
+	as.sketches = map[string]*keySketch{}
+	for name, u := range as.usage {
+		u.Bytes, u.Keys = 0, 0
+		if u.Reads == 0 && u.Writes == 0 {
+			delete(as.usage, name)
+		}
+	}
+}
+
+// A UsageDrift describes an account whose incrementally maintained
+// usage in a range differs from usage recomputed from the range's
+// data.
+type UsageDrift struct {
+	RangeID       int64
+	Account       string
+	Keys, Bytes   int64 // Maintained usage
+	ComputedKeys  int64 // Recomputed live keys
+	ComputedBytes int64 // Recomputed live bytes
+}
+
+// copyConfigs returns a new acctStats with the same accounting
+// configs and no usage.
+func (as *acctStats) copyConfigs() *acctStats {
+	as.Lock()
+	defer as.Unlock()
+	c := newAcctStats()
+	c.configs, c.source = as.configs, as.source
+	return c
+}
+
+// diff compares the keys and bytes of each account with those in
+// computed, returning the accounts which differ, sorted by name.
+func (as *acctStats) diff(computed *acctStats, rangeID int64) []UsageDrift {
+	as.Lock()
+	defer as.Unlock()
+	computed.Lock()
+	defer computed.Unlock()
+	names := map[string]struct{}{}
+	for name := range as.usage {
+		names[name] = struct{}{}
+	}
+	for name := range computed.usage {
+		names[name] = struct{}{}
+	}
+	var drift []UsageDrift
+	for name := range names {
+		d := UsageDrift{RangeID: rangeID, Account: name}
+		if u, ok := as.usage[name]; ok {
+			d.Keys, d.Bytes = u.Keys, u.Bytes
+		}
+		if u, ok := computed.usage[name]; ok {
+			d.ComputedKeys, d.ComputedBytes = u.Keys, u.Bytes
+		}
+		if d.Keys != d.ComputedKeys || d.Bytes != d.ComputedBytes {
+			drift = append(drift, d)
+		}
+	}
+	sort.Sort(usageDrifts(drift))
+	return drift
+}
+
+// usageDrifts implements sort.Interface for a slice of UsageDrift,
+// ordering by range ID and account.
+type usageDrifts []UsageDrift
+
+func (ud usageDrifts) Len() int      { return len(ud) }
+func (ud usageDrifts) Swap(i, j int) { ud[i], ud[j] = ud[j], ud[i] }
+func (ud usageDrifts) Less(i, j int) bool {
+	if ud[i].RangeID != ud[j].RangeID {
+		return ud[i].RangeID < ud[j].RangeID
+	}
+	return ud[i].Account < ud[j].Account
+}
+
+// setStored replaces the keys, bytes and key sketches of all accounts
+// with those in computed, retaining operation counts.
+func (as *acctStats) setStored(computed *acctStats) {
+	as.Lock()
+	defer as.Unlock()
+	computed.Lock()
+	defer computed.Unlock()
+	as.sketches = computed.sketches
+	for _, u := range as.usage {
+		u.Keys, u.Bytes = 0, 0
+	}
+	for name, c := range computed.usage {
+		u, ok := as.usage[name]
+		if !ok {
+			u = &AcctUsage{Account: name, Internal: c.Internal}
+			as.usage[name] = u
+		}
+		u.Keys, u.Bytes = c.Keys, c.Bytes
+	}
+}
+
+// report returns a usage report for all accounts with recorded usage,
+// with distinct keys and prefixes estimated from their sketches.
+func (as *acctStats) report() UsageReport {
+	as.Lock()
+	defer as.Unlock()
+	report := usageReportFromMap(as.usage)
+	for i := range report {
+		if ks, ok := as.sketches[report[i].Account]; ok {
+			report[i].EstKeys = ks.keys.estimate()
+			report[i].EstPrefixes = ks.prefixes.estimate()
+		}
+	}
+	return report
+}
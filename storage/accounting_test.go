@@ -0,0 +1,266 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+)
+
+// findUsage returns the usage for the named account, or nil if the
+// account does not appear in the report.
+func findUsage(report UsageReport, name string) *AcctUsage {
+	for i := range report {
+		if report[i].Account == name {
+			return &report[i]
+		}
+	}
+	return nil
+}
+
+// TestAccountForKey verifies attribution of keys to internal and
+// user accounts.
+func TestAccountForKey(t *testing.T) {
+	as := newAcctStats()
+	configs := []*prefixConfig{
+		{KeyMin, &AcctConfig{}},
+		{Key("/db2/sub"), &AcctConfig{Name: "sub"}},
+		{Key("/db1"), &AcctConfig{Name: "acct1"}},
+		{Key("/db2"), &AcctConfig{}},
+	}
+	if changed, err := as.setConfigs(configs); err != nil || !changed {
+		t.Fatalf("expected configs to be set: %v", err)
+	}
+	// The supplied slice must not be reordered or extended.
+	if len(configs) != 4 || !bytes.Equal(configs[1].Prefix, Key("/db2/sub")) {
+		t.Errorf("expected configs to be unmodified; got %+v", configs)
+	}
+	if changed, err := as.setConfigs(configs); err != nil || changed {
+		t.Errorf("expected identical configs to be unchanged: %v", err)
+	}
+	testData := []struct {
+		key      Key
+		account  string
+		internal bool
+	}{
+		{MakeKey(KeyTimeSeriesPrefix, Key("cpu")), AcctTimeSeries, true},
+		{MakeKey(KeyQueuePrefix, Key("inbox")), AcctQueue, true},
+		{MakeKey(KeyAuditLogPrefix, Key("1")), AcctAuditLog, true},
+		{KeyConfigZonePrefix, AcctSystem, true},
+		{MakeKey(KeyMeta2Prefix, Key("a")), AcctSystem, true},
+		{Key("/db1/table"), "acct1", false},
+		{Key("/db2/table"), "/db2", false},
+		{Key("/db2/sub/a"), "sub", false},
+		{Key("/db2/tablf"), "/db2", false},
+		{Key("/db3"), AcctDefault, false},
+		{Key("a"), AcctDefault, false},
+	}
+	for i, test := range testData {
+		account, internal := as.accountForKey(test.key)
+		if account != test.account || internal != test.internal {
+			t.Errorf("%d: expected key %q in account %q (internal=%t); got %q (internal=%t)",
+				i, test.key, test.account, test.internal, account, internal)
+		}
+	}
+}
+
+// TestRangeUsageReport verifies that reads and writes to internal
+// subsystem keys are reported separately from user data.
+func TestRangeUsageReport(t *testing.T) {
+	engine := createTestEngine(t)
+	if err := putI(engine, MakeKey(KeyConfigAccountingPrefix, Key("/db1")), AcctConfig{Name: "db1"}); err != nil {
+		t.Fatal(err)
+	}
+	r, _ := createTestRange(engine, t)
+	defer r.Stop()
+
+	tsKey := MakeKey(KeyTimeSeriesPrefix, Key("cpu"))
+	queueKey := MakeKey(KeyQueuePrefix, Key("inbox"))
+	userKey := Key("/db1/a")
+	for _, key := range []Key{tsKey, queueKey, userKey} {
+		pArgs := &PutRequest{Key: key, Value: Value{Bytes: []byte("value")}}
+		if err := <-r.ReadWriteCmd("Put", pArgs, &PutResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Overwrite the user key with a shorter value and delete the queue key.
+	pArgs := &PutRequest{Key: userKey, Value: Value{Bytes: []byte("v")}}
+	if err := <-r.ReadWriteCmd("Put", pArgs, &PutResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	dArgs := &DeleteRequest{Key: queueKey}
+	if err := <-r.ReadWriteCmd("Delete", dArgs, &DeleteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	gArgs := &GetRequest{Key: tsKey}
+	if err := r.ReadOnlyCmd("Get", gArgs, &GetResponse{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Key estimates include the deleted queue key, as sketches can't
+	// forget keys.
+	report := r.UsageReport()
+	expUsage := []AcctUsage{
+		{Account: AcctTimeSeries, Internal: true, Bytes: int64(len(tsKey) + 5), Keys: 1, Reads: 1, Writes: 1, EstKeys: 1, EstPrefixes: 1},
+		{Account: AcctQueue, Internal: true, Bytes: 0, Keys: 0, Reads: 0, Writes: 2, EstKeys: 1, EstPrefixes: 1},
+		{Account: "db1", Internal: false, Bytes: int64(len(userKey) + 1), Keys: 1, Reads: 0, Writes: 2, EstKeys: 1, EstPrefixes: 1},
+	}
+	for _, exp := range expUsage {
+		u := findUsage(report, exp.Account)
+		if u == nil {
+			t.Errorf("expected account %q in usage report %+v", exp.Account, report)
+		} else if *u != exp {
+			t.Errorf("expected usage %+v; got %+v", exp, *u)
+		}
+	}
+	// Configs present at startup are attributed to the system account.
+	if u := findUsage(report, AcctSystem); u == nil || u.Keys != 4 || !u.Internal {
+		t.Errorf("expected 4 system keys in internal account; got %+v", u)
+	}
+}
+
+// TestRangeUsageConfigChange verifies that usage is re-attributed
+// when accounting configs are added and deleted.
+func TestRangeUsageConfigChange(t *testing.T) {
+	engine := createTestEngine(t)
+	r, _ := createTestRange(engine, t)
+	defer r.Stop()
+
+	for _, key := range []Key{Key("/db2/a"), Key("/db2/b"), Key("/db3/a")} {
+		pArgs := &PutRequest{Key: key, Value: Value{Bytes: []byte("value")}}
+		if err := <-r.ReadWriteCmd("Put", pArgs, &PutResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	configKey := MakeKey(KeyConfigAccountingPrefix, Key("/db2"))
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(AcctConfig{Name: "db2"}); err != nil {
+		t.Fatal(err)
+	}
+	pArgs := &PutRequest{Key: configKey, Value: Value{Bytes: buf.Bytes()}}
+	if err := <-r.ReadWriteCmd("Put", pArgs, &PutResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if u := findUsage(r.UsageReport(), "db2"); u == nil || u.Keys != 2 {
+		t.Errorf("expected 2 keys in account db2; got %+v", u)
+	}
+	// Deleting the config returns the keys to the default account,
+	// which retains its write counts.
+	if err := <-r.ReadWriteCmd("Delete", &DeleteRequest{Key: configKey}, &DeleteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	report := r.UsageReport()
+	if u := findUsage(report, "db2"); u != nil {
+		t.Errorf("expected account db2 to be removed; got %+v", u)
+	}
+	if u := findUsage(report, AcctDefault); u == nil || u.Keys != 3 || u.Writes != 3 {
+		t.Errorf("expected 3 keys and 3 writes in default account; got %+v", u)
+	}
+	for _, u := range report {
+		if u.Keys < 0 || u.Bytes < 0 {
+			t.Errorf("expected non-negative usage; got %+v", u)
+		}
+	}
+}
+
+// TestRangeUsageScan verifies that scans are charged one read per
+// returned row, attributed to the row's account.
+func TestRangeUsageScan(t *testing.T) {
+	engine := createTestEngine(t)
+	r, _ := createTestRange(engine, t)
+	defer r.Stop()
+
+	tsKey := MakeKey(KeyTimeSeriesPrefix, Key("cpu"))
+	for _, key := range []Key{tsKey, Key("a"), Key("b")} {
+		pArgs := &PutRequest{Key: key, Value: Value{Bytes: []byte("value")}}
+		if err := <-r.ReadWriteCmd("Put", pArgs, &PutResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sArgs := &ScanRequest{StartKey: KeyTimeSeriesPrefix, EndKey: Key("c"), MaxResults: 10}
+	if err := r.ReadOnlyCmd("Scan", sArgs, &ScanResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	report := r.UsageReport()
+	if u := findUsage(report, AcctTimeSeries); u == nil || u.Reads != 1 {
+		t.Errorf("expected 1 time series read; got %+v", u)
+	}
+	if u := findUsage(report, AcctDefault); u == nil || u.Reads != 2 {
+		t.Errorf("expected 2 default reads; got %+v", u)
+	}
+}
+
+// TestMergeUsageReports verifies usage for the same account is summed
+// across reports.
+func TestMergeUsageReports(t *testing.T) {
+	merged := MergeUsageReports(
+		UsageReport{{Account: "a", Bytes: 1, Keys: 1}, {Account: AcctQueue, Internal: true, Writes: 2}},
+		UsageReport{{Account: "a", Bytes: 2, Keys: 1, Reads: 3}},
+	)
+	expected := UsageReport{
+		{Account: "a", Bytes: 3, Keys: 2, Reads: 3},
+		{Account: AcctQueue, Internal: true, Writes: 2},
+	}
+	if len(merged) != len(expected) {
+		t.Fatalf("expected %d accounts; got %+v", len(expected), merged)
+	}
+	for i := range expected {
+		if merged[i] != expected[i] {
+			t.Errorf("%d: expected %+v; got %+v", i, expected[i], merged[i])
+		}
+	}
+}
+
+// TestVerifyUsage verifies drift between maintained and recomputed
+// usage is reported and reconciled.
+func TestVerifyUsage(t *testing.T) {
+	engine := createTestEngine(t)
+	r, _ := createTestRange(engine, t)
+	defer r.Stop()
+
+	pArgs := &PutRequest{Key: Key("a"), Value: Value{Bytes: []byte("value")}}
+	if err := <-r.ReadWriteCmd("Put", pArgs, &PutResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if drift, err := r.VerifyUsage(false); err != nil || len(drift) != 0 {
+		t.Fatalf("expected no drift; got %+v, %v", drift, err)
+	}
+	// Write directly to the engine, bypassing usage maintenance.
+	if err := engine.put(Key("b"), Value{Bytes: []byte("v")}); err != nil {
+		t.Fatal(err)
+	}
+	drift, err := r.VerifyUsage(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := UsageDrift{
+		Account:       AcctDefault,
+		Keys:          1,
+		Bytes:         6,
+		ComputedKeys:  2,
+		ComputedBytes: 8,
+	}
+	if len(drift) != 1 || drift[0] != exp {
+		t.Errorf("expected drift %+v; got %+v", exp, drift)
+	}
+	if drift, err := r.VerifyUsage(false); err != nil || len(drift) != 0 {
+		t.Errorf("expected drift to be reconciled; got %+v, %v", drift, err)
+	}
+	if u := findUsage(r.UsageReport(), AcctDefault); u == nil || u.Writes != 1 {
+		t.Errorf("expected write count to be retained; got %+v", u)
+	}
+}
@@ -21,10 +21,14 @@ import (
 	"fmt"
 	"math/rand"
 	"sort"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/util"
 )
 
 // StoreFinder finds the disks in a datacenter with the most available capacity.
-type StoreFinder func(string) ([]StoreAttributes, error)
+type StoreFinder func(string) ([]StoreDescriptor, error)
 
 // allocator makes allocation decisions based on a zone configuration,
 // existing range metadata and available stores. Configuration
@@ -32,30 +36,46 @@ type StoreFinder func(string) ([]StoreAttributes, error)
 // engine-backed range they describe.  Information on suitability and
 // availability of servers is gleaned from the gossip network.
 type allocator struct {
-	storeFinder StoreFinder
-	rand        rand.Rand
+	storeFinder    StoreFinder
+	livenessFinder LivenessFinder // Nodes without liveness records are live; may be nil
+	timeUntilDead  time.Duration  // See NodeLiveness.IsDead
+	rand           rand.Rand
+}
+
+// isDead returns whether the node with the specified ID is dead
+// according to its liveness record.
+func (a *allocator) isDead(nodeID int32) bool {
+	if a.livenessFinder == nil {
+		return false
+	}
+	liveness, ok := a.livenessFinder(nodeID)
+	return ok && liveness.IsDead(time.Now().UnixNano(), a.timeUntilDead)
 }
 
 // allocate returns a suitable Replica for the range and zone. If none
 // are available / suitable, returns an error. It looks at the zone
 // config for the block to determine where it needs to send data, then
 // uses the StoreFinder to pick a random set of nodes in each data
-// center based on the available capacity of the node.
-// TODO(levon): Handle Racks/Power Units.
+// center based on the available capacity of the node. Nodes on racks
+// which don't yet hold a replica of the range are preferred, so that
+// the failure of a rack loses as few replicas as possible.
+// TODO(levon): Handle Power Units.
 func (a *allocator) allocate(config *ZoneConfig, existingReplicas map[string][]Replica) ([]Replica, error) {
 	var neededReplicas int
 	var results []Replica
 
 	// Create a sorted list of datacenters to fix the order in which
 	// replicas are assigned.
-	dcs := make([]string, len(config.Replicas), len(config.Replicas))
+	dcs := make([]string, 0, len(config.Replicas))
 	for dc := range config.Replicas {
 		dcs = append(dcs, dc)
 	}
 	sort.Strings(dcs)
 
+	var existing int
 	for _, dc := range dcs {
 		diskTypes := config.Replicas[dc]
+		existing += len(existingReplicas[dc])
 		usedHosts := make(map[int32]struct{})
 		for _, replica := range existingReplicas[dc] {
 			usedHosts[replica.NodeID] = struct{}{}
@@ -66,6 +86,7 @@ func (a *allocator) allocate(config *ZoneConfig, existingReplicas map[string][]R
 		if err != nil {
 			return nil, err
 		}
+		usedRacks := racksOf(stores, usedHosts)
 
 		// Compute how many of each DiskType we need in this Data Center.
 		// We store the maximal disk type as we need it below.
@@ -90,15 +111,21 @@ func (a *allocator) allocate(config *ZoneConfig, existingReplicas map[string][]R
 			count := neededDiskTypes[diskType]
 			for i := 0; i < count; i++ {
 				// Randomly pick a node weighted by capacity.
-				var candidates []StoreAttributes
-				var capacityTotal float64
+				var candidates []StoreDescriptor
 				for _, s := range stores {
-					_, alreadyUsed := usedHosts[s.Attributes.NodeID]
+					_, alreadyUsed := usedHosts[s.Node.NodeID]
+					if config.EncryptionRequired && !s.Encrypted || a.isDead(s.Node.NodeID) {
+						continue
+					}
 					if s.Capacity.DiskType == diskType && !alreadyUsed {
 						candidates = append(candidates, s)
-						capacityTotal += s.Capacity.PercentAvail()
 					}
 				}
+				candidates = preferNewRacks(candidates, usedRacks)
+				var capacityTotal float64
+				for _, c := range candidates {
+					capacityTotal += c.Capacity.PercentAvail()
+				}
 
 				var capacitySeen float64
 				targetCapacity := a.rand.Float64() * capacityTotal
@@ -109,14 +136,17 @@ func (a *allocator) allocate(config *ZoneConfig, existingReplicas map[string][]R
 					capacitySeen += c.Capacity.PercentAvail()
 					if capacitySeen >= targetCapacity {
 						replica := Replica{
-							NodeID:     c.Attributes.NodeID,
+							NodeID:     c.Node.NodeID,
 							StoreID:    c.StoreID,
 							Datacenter: dc,
 							DiskType:   diskType,
 							// RangeID is filled in later, when range is created.
 						}
 						results = append(results, replica)
-						usedHosts[c.Attributes.NodeID] = struct{}{}
+						usedHosts[c.Node.NodeID] = struct{}{}
+						if c.Node.Rack != "" {
+							usedRacks[c.Node.Rack] = struct{}{}
+						}
 						break
 					}
 				}
@@ -124,12 +154,182 @@ func (a *allocator) allocate(config *ZoneConfig, existingReplicas map[string][]R
 		}
 	}
 	var err error
-	if len(existingReplicas)+len(results) < neededReplicas {
+	if existing+len(results) < neededReplicas {
 		err = fmt.Errorf("unable to place all %d replicas, Only %d found", neededReplicas, len(results))
 	}
 	return results, err
 }
 
-/*func findZoneConfig(key string) (ZoneConfig, error) {
+// racksOf returns the racks of the nodes in hosts, as declared by the
+// descriptors of their stores. Nodes which don't declare a rack are
+// omitted.
+func racksOf(stores []StoreDescriptor, hosts map[int32]struct{}) map[string]struct{} {
+	racks := map[string]struct{}{}
+	for _, s := range stores {
+		if _, ok := hosts[s.Node.NodeID]; ok && s.Node.Rack != "" {
+			racks[s.Node.Rack] = struct{}{}
+		}
+	}
+	return racks
+}
+
+// preferNewRacks returns those of candidates on racks not in used, if
+// there are any; otherwise, all candidates. Candidates on nodes which
+// don't declare a rack aren't preferred.
+func preferNewRacks(candidates []StoreDescriptor, used map[string]struct{}) []StoreDescriptor {
+	var diverse []StoreDescriptor
+	for _, c := range candidates {
+		if _, ok := used[c.Node.Rack]; !ok && c.Node.Rack != "" {
+			diverse = append(diverse, c)
+		}
+	}
+	if len(diverse) == 0 {
+		return candidates
+	}
+	return diverse
+}
+
+// rebalance returns the replicas to add to and remove from a range
+// with the specified replicas so that they satisfy config. Replicas in
+// datacenters or of disk types in excess of config are removed, and
+// replicas it requires are placed via allocate. If the replicas
+// already satisfy config, a replica is instead moved to the store of
+// the same datacenter and disk type with the most available capacity,
+// provided its share of available capacity exceeds that of the
+// replica's store by rebalanceThreshold. Replicas on dead nodes are
+// removed and replaced. The leader's replica is never removed.
+// Returns an error if the replicas config requires can't be placed,
+// in which case no changes are made.
+func (a *allocator) rebalance(config *ZoneConfig, replicas []Replica, leader Replica) (add, remove []Replica, err error) {
+	// Count the replicas of each disk type config requires in each
+	// datacenter.
+	needed := map[string]map[DiskType]int{}
+	for dc, diskTypes := range config.Replicas {
+		needed[dc] = map[DiskType]int{}
+		for _, diskType := range diskTypes {
+			needed[dc][StringToDiskType(diskType)]++
+		}
+	}
+	// Keep the leader's replica first, so that it's counted against
+	// its datacenter and disk type before any others.
+	ordered := make([]Replica, 0, len(replicas))
+	for _, replica := range replicas {
+		if idOf(replica) == idOf(leader) {
+			ordered = append([]Replica{replica}, ordered...)
+		} else {
+			ordered = append(ordered, replica)
+		}
+	}
+	existing := map[string][]Replica{}
+	for _, replica := range ordered {
+		if idOf(replica) != idOf(leader) && a.isDead(replica.NodeID) {
+			remove = append(remove, replica)
+			continue
+		}
+		if needed[replica.Datacenter][replica.DiskType] > 0 || idOf(replica) == idOf(leader) {
+			if counts, ok := needed[replica.Datacenter]; ok {
+				counts[replica.DiskType]--
+			}
+			existing[replica.Datacenter] = append(existing[replica.Datacenter], replica)
+			continue
+		}
+		remove = append(remove, replica)
+	}
+	if add, err = a.allocate(config, existing); err != nil {
+		return nil, nil, err
+	}
+	if len(add) > 0 || len(remove) > 0 {
+		return add, remove, nil
+	}
+	return a.balance(config, replicas, leader)
+}
+
+// rebalanceThreshold is the difference in the fraction of available
+// capacity between stores above which a replica is moved from one to
+// the other.
+const rebalanceThreshold = 0.1
+
+// balance returns a replica to add and a replica to remove which
+// together move the replica whose store has the least available
+// capacity to the store of the same datacenter and disk type with the
+// most, if the difference exceeds rebalanceThreshold. Only stores on
+// nodes which don't already hold a replica are considered, and a
+// replica isn't moved onto the rack of another replica unless it
+// already shares one.
+func (a *allocator) balance(config *ZoneConfig, replicas []Replica, leader Replica) (add, remove []Replica, err error) {
+	usedHosts := map[int32]struct{}{}
+	for _, replica := range replicas {
+		usedHosts[replica.NodeID] = struct{}{}
+	}
+	var bestGain float64
+	for _, replica := range replicas {
+		if idOf(replica) == idOf(leader) {
+			continue
+		}
+		stores, err := a.storeFinder(replica.Datacenter)
+		if err != nil {
+			return nil, nil, err
+		}
+		var current *StoreDescriptor
+		for i, s := range stores {
+			if s.Node.NodeID == replica.NodeID && s.StoreID == replica.StoreID {
+				current = &stores[i]
+			}
+		}
+		if current == nil {
+			continue
+		}
+		others := map[int32]struct{}{}
+		for _, r := range replicas {
+			if r.NodeID != replica.NodeID {
+				others[r.NodeID] = struct{}{}
+			}
+		}
+		otherRacks := racksOf(stores, others)
+		_, currentShared := otherRacks[current.Node.Rack]
+		for _, s := range stores {
+			if _, alreadyUsed := usedHosts[s.Node.NodeID]; alreadyUsed || s.Capacity.DiskType != replica.DiskType {
+				continue
+			}
+			if _, shared := otherRacks[s.Node.Rack]; shared && !currentShared {
+				continue
+			}
+			if config.EncryptionRequired && !s.Encrypted || a.isDead(s.Node.NodeID) {
+				continue
+			}
+			gain := s.Capacity.PercentAvail() - current.Capacity.PercentAvail()
+			if gain > rebalanceThreshold && gain > bestGain {
+				bestGain = gain
+				add = []Replica{{
+					NodeID:     s.Node.NodeID,
+					StoreID:    s.StoreID,
+					Datacenter: replica.Datacenter,
+					DiskType:   replica.DiskType,
+				}}
+				remove = []Replica{replica}
+			}
+		}
+	}
+	return add, remove, nil
+}
 
-}*/
+// gossipStoreFinder returns a StoreFinder which finds the stores in a
+// datacenter via the descriptors their nodes gossip.
+func gossipStoreFinder(g *gossip.Gossip) StoreFinder {
+	return func(dc string) ([]StoreDescriptor, error) {
+		if g == nil {
+			return nil, util.Errorf("no gossip network to find stores in datacenter %q", dc)
+		}
+		infos, err := g.GetGroupInfos(gossip.KeyStorePrefix)
+		if err != nil {
+			return nil, err
+		}
+		var stores []StoreDescriptor
+		for _, info := range infos {
+			if desc := info.(StoreDescriptor); desc.Node.Datacenter == dc {
+				stores = append(stores, desc)
+			}
+		}
+		return stores, nil
+	}
+}
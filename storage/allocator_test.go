@@ -21,6 +21,9 @@ import (
 	"math/rand"
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
 )
 
 var simpleZoneConfig = ZoneConfig{
@@ -42,11 +45,11 @@ var multiDCConfig = ZoneConfig{
 	},
 }
 
-var singleStore = func(x string) ([]StoreAttributes, error) {
-	return []StoreAttributes{
-		StoreAttributes{
+var singleStore = func(x string) ([]StoreDescriptor, error) {
+	return []StoreDescriptor{
+		StoreDescriptor{
 			StoreID: 1,
-			Attributes: NodeAttributes{
+			Node: NodeAttributes{
 				NodeID:     1,
 				Datacenter: "a",
 				PDU:        "a",
@@ -61,11 +64,11 @@ var singleStore = func(x string) ([]StoreAttributes, error) {
 	}, nil
 }
 
-var sameDCStores = func(x string) ([]StoreAttributes, error) {
-	return []StoreAttributes{
-		StoreAttributes{
+var sameDCStores = func(x string) ([]StoreDescriptor, error) {
+	return []StoreDescriptor{
+		StoreDescriptor{
 			StoreID: 1,
-			Attributes: NodeAttributes{
+			Node: NodeAttributes{
 				NodeID:     1,
 				Datacenter: "a",
 				PDU:        "a",
@@ -77,9 +80,9 @@ var sameDCStores = func(x string) ([]StoreAttributes, error) {
 				DiskType:  SSD,
 			},
 		},
-		StoreAttributes{
+		StoreDescriptor{
 			StoreID: 2,
-			Attributes: NodeAttributes{
+			Node: NodeAttributes{
 				NodeID:     2,
 				Datacenter: "a",
 				PDU:        "a",
@@ -91,9 +94,9 @@ var sameDCStores = func(x string) ([]StoreAttributes, error) {
 				DiskType:  SSD,
 			},
 		},
-		StoreAttributes{
+		StoreDescriptor{
 			StoreID: 3,
-			Attributes: NodeAttributes{
+			Node: NodeAttributes{
 				NodeID:     2,
 				Datacenter: "a",
 				PDU:        "a",
@@ -105,9 +108,9 @@ var sameDCStores = func(x string) ([]StoreAttributes, error) {
 				DiskType:  HDD,
 			},
 		},
-		StoreAttributes{
+		StoreDescriptor{
 			StoreID: 4,
-			Attributes: NodeAttributes{
+			Node: NodeAttributes{
 				NodeID:     3,
 				Datacenter: "a",
 				PDU:        "a",
@@ -119,9 +122,9 @@ var sameDCStores = func(x string) ([]StoreAttributes, error) {
 				DiskType:  HDD,
 			},
 		},
-		StoreAttributes{
+		StoreDescriptor{
 			StoreID: 5,
-			Attributes: NodeAttributes{
+			Node: NodeAttributes{
 				NodeID:     4,
 				Datacenter: "a",
 				PDU:        "a",
@@ -136,12 +139,12 @@ var sameDCStores = func(x string) ([]StoreAttributes, error) {
 	}, nil
 }
 
-var multiDCStores = func(dc string) ([]StoreAttributes, error) {
+var multiDCStores = func(dc string) ([]StoreDescriptor, error) {
 	if dc == "a" {
-		return []StoreAttributes{
-			StoreAttributes{
+		return []StoreDescriptor{
+			StoreDescriptor{
 				StoreID: 1,
-				Attributes: NodeAttributes{
+				Node: NodeAttributes{
 					NodeID:     1,
 					Datacenter: "a",
 					PDU:        "a",
@@ -155,10 +158,10 @@ var multiDCStores = func(dc string) ([]StoreAttributes, error) {
 			},
 		}, nil
 	}
-	return []StoreAttributes{
-		StoreAttributes{
+	return []StoreDescriptor{
+		StoreDescriptor{
 			StoreID: 2,
-			Attributes: NodeAttributes{
+			Node: NodeAttributes{
 				NodeID:     2,
 				Datacenter: "b",
 				PDU:        "a",
@@ -173,8 +176,8 @@ var multiDCStores = func(dc string) ([]StoreAttributes, error) {
 	}, nil
 }
 
-var noStores = func(x string) ([]StoreAttributes, error) {
-	return []StoreAttributes{}, nil
+var noStores = func(x string) ([]StoreDescriptor, error) {
+	return []StoreDescriptor{}, nil
 }
 
 func TestSimpleRetrieval(t *testing.T) {
@@ -291,3 +294,262 @@ func TestExistingReplica(t *testing.T) {
 		t.Fatalf("Expected: %v\nGot: %v", expected, result)
 	}
 }
+
+// TestEncryptionRequired verifies zones requiring encryption are
+// allocated only to encrypted stores.
+func TestEncryptionRequired(t *testing.T) {
+	config := simpleZoneConfig
+	config.EncryptionRequired = true
+	a := allocator{
+		storeFinder: singleStore,
+		rand:        *rand.New(rand.NewSource(0)),
+	}
+	if result, err := a.allocate(&config, map[string][]Replica{}); err == nil {
+		t.Errorf("expected allocation to unencrypted store to fail; got %v", result)
+	}
+	a.storeFinder = func(dc string) ([]StoreDescriptor, error) {
+		stores, err := singleStore(dc)
+		for i := range stores {
+			stores[i].Encrypted = true
+		}
+		return stores, err
+	}
+	if _, err := a.allocate(&config, map[string][]Replica{}); err != nil {
+		t.Errorf("expected allocation to encrypted store; got %v", err)
+	}
+}
+
+// TestRebalance verifies replicas are added and removed to satisfy a
+// zone config, without removing the leader's replica.
+func TestRebalance(t *testing.T) {
+	leader := Replica{NodeID: 1, StoreID: 1, RangeID: 1, Datacenter: "a", DiskType: SSD}
+	testCases := []struct {
+		config      ZoneConfig
+		storeFinder StoreFinder
+		replicas    []Replica
+		expAdd      []Replica
+		expRemove   []Replica
+		expErr      bool
+	}{
+		// Satisfied.
+		{simpleZoneConfig, sameDCStores, []Replica{leader}, nil, nil, false},
+		// Missing a replica in datacenter "b".
+		{multiDCConfig, multiDCStores, []Replica{leader},
+			[]Replica{{NodeID: 2, StoreID: 2, Datacenter: "b", DiskType: SSD}}, nil, false},
+		// Surplus replica.
+		{simpleZoneConfig, sameDCStores, []Replica{{NodeID: 2, StoreID: 2, RangeID: 5, Datacenter: "a", DiskType: SSD}, leader},
+			nil, []Replica{{NodeID: 2, StoreID: 2, RangeID: 5, Datacenter: "a", DiskType: SSD}}, false},
+		// Replica in a datacenter not in the config.
+		{simpleZoneConfig, sameDCStores, []Replica{leader, {NodeID: 2, StoreID: 2, RangeID: 5, Datacenter: "c", DiskType: SSD}},
+			nil, []Replica{{NodeID: 2, StoreID: 2, RangeID: 5, Datacenter: "c", DiskType: SSD}}, false},
+		// The leader's replica is kept though it doesn't satisfy the config.
+		{simpleZoneConfig, sameDCStores, []Replica{{NodeID: 1, StoreID: 1, RangeID: 1, Datacenter: "c", DiskType: SSD}},
+			[]Replica{{NodeID: 2, StoreID: 2, Datacenter: "a", DiskType: SSD}}, nil, false},
+		// Unsatisfiable.
+		{multiDisksConfig, singleStore, []Replica{leader}, nil, nil, true},
+	}
+	for i, test := range testCases {
+		a := allocator{storeFinder: test.storeFinder, rand: *rand.New(rand.NewSource(0))}
+		add, remove, err := a.rebalance(&test.config, test.replicas, leader)
+		if test.expErr != (err != nil) {
+			t.Errorf("%d: expected error %t; got %v", i, test.expErr, err)
+			continue
+		}
+		if !reflect.DeepEqual(add, test.expAdd) || !reflect.DeepEqual(remove, test.expRemove) {
+			t.Errorf("%d: expected to add %+v and remove %+v; got %+v and %+v", i, test.expAdd, test.expRemove, add, remove)
+		}
+	}
+}
+
+// TestRebalanceDiskUsage verifies a replica is moved off a store with
+// much less available capacity than another.
+func TestRebalanceDiskUsage(t *testing.T) {
+	config := ZoneConfig{Replicas: map[string][]string{"a": []string{"SSD", "SSD"}}}
+	leader := Replica{NodeID: 1, StoreID: 1, RangeID: 1, Datacenter: "a", DiskType: SSD}
+	follower := Replica{NodeID: 2, StoreID: 2, RangeID: 1, Datacenter: "a", DiskType: SSD}
+	for i, avail := range []int64{15, 90} {
+		a := allocator{
+			storeFinder: func(dc string) ([]StoreDescriptor, error) {
+				var stores []StoreDescriptor
+				for j, available := range []int64{100, 10, avail} {
+					stores = append(stores, StoreDescriptor{
+						StoreID:  int32(j + 1),
+						Node:     NodeAttributes{NodeID: int32(j + 1), Datacenter: "a"},
+						Capacity: StoreCapacity{Capacity: 100, Available: available, DiskType: SSD},
+					})
+				}
+				return stores, nil
+			},
+		}
+		add, remove, err := a.rebalance(&config, []Replica{leader, follower}, leader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if avail == 15 && (add != nil || remove != nil) {
+			t.Errorf("%d: expected no change; got add %+v, remove %+v", i, add, remove)
+		}
+		expAdd := []Replica{{NodeID: 3, StoreID: 3, Datacenter: "a", DiskType: SSD}}
+		if avail == 90 && (!reflect.DeepEqual(add, expAdd) || !reflect.DeepEqual(remove, []Replica{follower})) {
+			t.Errorf("%d: expected to move %+v to store 3; got add %+v, remove %+v", i, follower, add, remove)
+		}
+	}
+}
+
+// rackStores returns a StoreFinder listing an SSD store on each of
+// nodes 1 through len(racks) in datacenter "a", on the specified
+// racks, with the specified available capacities.
+func rackStores(racks []string, avail []int64) StoreFinder {
+	return func(dc string) ([]StoreDescriptor, error) {
+		var stores []StoreDescriptor
+		for i, rack := range racks {
+			stores = append(stores, StoreDescriptor{
+				StoreID:  int32(i + 1),
+				Node:     NodeAttributes{NodeID: int32(i + 1), Datacenter: "a", Rack: rack},
+				Capacity: StoreCapacity{Capacity: 100, Available: avail[i], DiskType: SSD},
+			})
+		}
+		return stores, nil
+	}
+}
+
+// TestAllocateRackDiversity verifies replicas are placed on distinct
+// racks while there are racks without replicas, and that allocation
+// falls back to shared racks otherwise.
+func TestAllocateRackDiversity(t *testing.T) {
+	config := ZoneConfig{Replicas: map[string][]string{"a": []string{"SSD", "SSD", "SSD"}}}
+	racks := []string{"r1", "r1", "r1", "r1", "r2", "r3"}
+	for i := 0; i < 20; i++ {
+		a := allocator{
+			storeFinder: rackStores(racks, []int64{100, 100, 100, 100, 10, 10}),
+			rand:        *rand.New(rand.NewSource(int64(i))),
+		}
+		result, err := a.allocate(&config, map[string][]Replica{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		used := map[string]bool{}
+		for _, r := range result {
+			used[racks[r.NodeID-1]] = true
+		}
+		if len(used) != 3 {
+			t.Fatalf("%d: expected replicas on 3 racks; got %+v", i, result)
+		}
+	}
+
+	// With two racks, the third replica must share one.
+	a := allocator{
+		storeFinder: rackStores([]string{"r1", "r1", "r2"}, []int64{100, 100, 100}),
+		rand:        *rand.New(rand.NewSource(0)),
+	}
+	existing := map[string][]Replica{"a": []Replica{{NodeID: 1, StoreID: 1, Datacenter: "a", DiskType: SSD}}}
+	result, err := a.allocate(&config, existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 2 || result[0].NodeID != 3 || result[1].NodeID != 2 {
+		t.Errorf("expected nodes 3 then 2; got %+v", result)
+	}
+}
+
+// TestRebalanceRackDiversity verifies a replica isn't moved onto the
+// rack of another replica for capacity, unless it already shares one.
+func TestRebalanceRackDiversity(t *testing.T) {
+	config := ZoneConfig{Replicas: map[string][]string{"a": []string{"SSD", "SSD"}}}
+	leader := Replica{NodeID: 1, StoreID: 1, RangeID: 1, Datacenter: "a", DiskType: SSD}
+	follower := Replica{NodeID: 2, StoreID: 2, RangeID: 1, Datacenter: "a", DiskType: SSD}
+	avail := []int64{100, 10, 90}
+	testCases := []struct {
+		racks  []string
+		expect bool
+	}{
+		{[]string{"r1", "r2", "r1"}, false}, // would join the leader's rack
+		{[]string{"r1", "r2", "r3"}, true},  // diverse either way
+		{[]string{"r1", "r1", "r1"}, true},  // already shares the leader's rack
+	}
+	for i, test := range testCases {
+		a := allocator{storeFinder: rackStores(test.racks, avail)}
+		add, remove, err := a.rebalance(&config, []Replica{leader, follower}, leader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if moved := add != nil && remove != nil; moved != test.expect {
+			t.Errorf("%d: expected move %t; got add %+v, remove %+v", i, test.expect, add, remove)
+		}
+	}
+}
+
+// TestRebalanceDeadNode verifies a replica on a dead node is replaced
+// by one on a live node, and that stores on dead nodes aren't
+// allocated.
+func TestRebalanceDeadNode(t *testing.T) {
+	config := ZoneConfig{Replicas: map[string][]string{"a": []string{"SSD", "SSD"}}}
+	leader := Replica{NodeID: 1, StoreID: 1, RangeID: 1, Datacenter: "a", DiskType: SSD}
+	follower := Replica{NodeID: 2, StoreID: 2, RangeID: 1, Datacenter: "a", DiskType: SSD}
+	now := time.Now().UnixNano()
+	dead := map[int32]bool{}
+	a := allocator{
+		storeFinder: func(dc string) ([]StoreDescriptor, error) {
+			var stores []StoreDescriptor
+			for j := int32(1); j <= 4; j++ {
+				stores = append(stores, StoreDescriptor{
+					StoreID:  j,
+					Node:     NodeAttributes{NodeID: j, Datacenter: "a"},
+					Capacity: StoreCapacity{Capacity: 100, Available: 100, DiskType: SSD},
+				})
+			}
+			return stores, nil
+		},
+		livenessFinder: func(nodeID int32) (NodeLiveness, bool) {
+			if nodeID > 4 {
+				return NodeLiveness{}, false
+			}
+			if dead[nodeID] {
+				return NodeLiveness{NodeID: nodeID, Expiration: now - int64(2*time.Minute)}, true
+			}
+			return NodeLiveness{NodeID: nodeID, Expiration: now + int64(time.Minute)}, true
+		},
+		timeUntilDead: time.Minute,
+		rand:          *rand.New(rand.NewSource(0)),
+	}
+	add, remove, err := a.rebalance(&config, []Replica{leader, follower}, leader)
+	if err != nil || add != nil || remove != nil {
+		t.Fatalf("expected no change while all nodes are live; got add %+v, remove %+v, %v", add, remove, err)
+	}
+	dead[2], dead[3] = true, true
+	add, remove, err = a.rebalance(&config, []Replica{leader, follower}, leader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expAdd := []Replica{{NodeID: 4, StoreID: 4, Datacenter: "a", DiskType: SSD}}
+	if !reflect.DeepEqual(add, expAdd) || !reflect.DeepEqual(remove, []Replica{follower}) {
+		t.Errorf("expected to replace %+v with %+v; got add %+v, remove %+v", follower, expAdd, add, remove)
+	}
+	// A node whose liveness expired within timeUntilDead isn't dead.
+	a.timeUntilDead = 5 * time.Minute
+	if a.isDead(2) {
+		t.Error("expected node within time until dead to be live")
+	}
+	if a.isDead(5) {
+		t.Error("expected node without liveness record to be live")
+	}
+}
+
+// TestGossipLivenessFinder verifies liveness records are found via
+// the gossip network.
+func TestGossipLivenessFinder(t *testing.T) {
+	g := gossip.New()
+	finder := gossipLivenessFinder(g)
+	if _, ok := finder(1); ok {
+		t.Error("expected no liveness record before gossiping")
+	}
+	liveness := NodeLiveness{NodeID: 1, Expiration: 10}
+	if err := g.AddInfo(gossip.MakeNodeLivenessKey(1), liveness, 0); err != nil {
+		t.Fatal(err)
+	}
+	if found, ok := finder(1); !ok || found != liveness {
+		t.Errorf("expected liveness %+v; got %+v, %t", liveness, found, ok)
+	}
+	if !liveness.IsDead(20, 10) || liveness.IsDead(19, 10) {
+		t.Error("expected node dead once its liveness expired by the threshold")
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"sort"
+)
+
+// A Batch is an Engine which buffers writes to an underlying engine
+// until they're committed, atomically, by Commit. Reads of the batch
+// see its buffered writes, so an operation writing several keys, such
+// as a raft command or the resolution of a write intent, may run
+// against a batch as against the engine itself, and a crash can't
+// leave the operation partially applied.
+//
+// A batch isn't safe for concurrent use. Writes to the underlying
+// engine made after the batch was created are visible to its reads,
+// except for keys the batch has written; callers exclude concurrent
+// writes where that matters.
+type Batch struct {
+	engine  Engine
+	writes  []engineWrite          // Buffered writes in order
+	updates map[string]engineWrite // Latest buffered write by key
+}
+
+// NewBatch returns a batch of writes to engine.
+func NewBatch(engine Engine) *Batch {
+	return &Batch{engine: engine, updates: map[string]engineWrite{}}
+}
+
+// Commit applies the batch's writes to the underlying engine
+// atomically and empties the batch.
+func (b *Batch) Commit() error {
+	if len(b.writes) == 0 {
+		return nil
+	}
+	if err := b.engine.writeBatch(b.writes); err != nil {
+		return err
+	}
+	b.writes = nil
+	b.updates = map[string]engineWrite{}
+	return nil
+}
+
+// Len returns the number of buffered writes.
+func (b *Batch) Len() int {
+	return len(b.writes)
+}
+
+// Type returns the underlying engine's disk type.
+func (b *Batch) Type() DiskType {
+	return b.engine.Type()
+}
+
+// put buffers a write of value to key.
+func (b *Batch) put(key Key, value Value) error {
+	if len(key) == 0 {
+		return emptyKeyError()
+	}
+	b.add(engineWrite{key: append(Key(nil), key...), value: value})
+	return nil
+}
+
+// del buffers a deletion of key.
+func (b *Batch) del(key Key) error {
+	if len(key) == 0 {
+		return emptyKeyError()
+	}
+	b.add(engineWrite{key: append(Key(nil), key...), del: true})
+	return nil
+}
+
+// writeBatch buffers writes, so that batches may be nested.
+func (b *Batch) writeBatch(writes []engineWrite) error {
+	for _, w := range writes {
+		if len(w.key) == 0 {
+			return emptyKeyError()
+		}
+	}
+	for _, w := range writes {
+		b.add(w)
+	}
+	return nil
+}
+
+// add buffers w.
+func (b *Batch) add(w engineWrite) {
+	b.writes = append(b.writes, w)
+	b.updates[string(w.key)] = w
+}
+
+// get returns the value of key as the batch leaves it.
+func (b *Batch) get(key Key) (Value, error) {
+	if w, ok := b.updates[string(key)]; ok {
+		if w.del {
+			return Value{}, nil
+		}
+		return w.value, nil
+	}
+	return b.engine.get(key)
+}
+
+// scan returns up to max key/value objects in [start, end) as the
+// batch leaves them.
+func (b *Batch) scan(start, end Key, max int64) ([]KeyValue, error) {
+	return b.mergedScan(start, end, max, false)
+}
+
+// reverseScan is like scan, but returns key/value objects in
+// descending key order.
+func (b *Batch) reverseScan(start, end Key, max int64) ([]KeyValue, error) {
+	return b.mergedScan(start, end, max, true)
+}
+
+// mergedScan overlays the batch's writes to keys in [start, end) on a
+// scan of the underlying engine. The underlying scan reads an extra
+// row for each buffered deletion in the span, so that at least max
+// rows remain of those it read once deletions are applied, and rows
+// the batch adds beyond them are truncated.
+func (b *Batch) mergedScan(start, end Key, max int64, reverse bool) ([]KeyValue, error) {
+	var overlay []engineWrite
+	var dels int64
+	for _, w := range b.updates {
+		if bytes.Compare(w.key, start) >= 0 && (len(end) == 0 || bytes.Compare(w.key, end) < 0) {
+			overlay = append(overlay, w)
+			if w.del {
+				dels++
+			}
+		}
+	}
+	scanMax := max
+	if max > 0 {
+		scanMax += dels
+	}
+	var kvs []KeyValue
+	var err error
+	if reverse {
+		kvs, err = b.engine.reverseScan(start, end, scanMax)
+	} else {
+		kvs, err = b.engine.scan(start, end, scanMax)
+	}
+	if err != nil || len(overlay) == 0 {
+		return kvs, err
+	}
+	rows := map[string]Value{}
+	for _, kv := range kvs {
+		rows[string(kv.Key)] = kv.Value
+	}
+	for _, w := range overlay {
+		if w.del {
+			delete(rows, string(w.key))
+		} else {
+			rows[string(w.key)] = w.value
+		}
+	}
+	merged := make([]KeyValue, 0, len(rows))
+	for key, value := range rows {
+		merged = append(merged, KeyValue{Key: Key(key), Value: value})
+	}
+	sort.Sort(keyValues(merged))
+	if reverse {
+		for i, j := 0, len(merged)-1; i < j; i, j = i+1, j-1 {
+			merged[i], merged[j] = merged[j], merged[i]
+		}
+	}
+	if max > 0 && int64(len(merged)) > max {
+		merged = merged[:max]
+	}
+	return merged, nil
+}
+
+// capacity returns the underlying engine's capacity.
+func (b *Batch) capacity() (StoreCapacity, error) {
+	return b.engine.capacity()
+}
+
+// newSnapshot returns a read-only view of the batch: a snapshot of
+// the underlying engine with the writes buffered so far applied.
+func (b *Batch) newSnapshot() Snapshot {
+	snap := b.engine.newSnapshot()
+	view := &batchSnapshot{Batch: NewBatch(snap), snap: snap}
+	for _, w := range b.writes {
+		view.add(w)
+	}
+	return view
+}
+
+// newIterator returns an iterator over the rows as the batch leaves
+// them. The rows are read into memory, as the buffered writes must be
+// merged with those of the underlying engine.
+func (b *Batch) newIterator() Iterator {
+	kvs, err := b.scan(KeyMin, KeyMax, 0)
+	return &sliceIterator{kvs: kvs, pos: -1, failure: err}
+}
+
+// A batchSnapshot is a read-only view of a batch; see
+// Batch.newSnapshot.
+type batchSnapshot struct {
+	*Batch
+	snap Snapshot // Snapshot of the batch's underlying engine
+}
+
+// put fails, as snapshots are read-only.
+func (s *batchSnapshot) put(key Key, value Value) error {
+	return readOnlyError()
+}
+
+// del fails, as snapshots are read-only.
+func (s *batchSnapshot) del(key Key) error {
+	return readOnlyError()
+}
+
+// writeBatch fails, as snapshots are read-only.
+func (s *batchSnapshot) writeBatch(writes []engineWrite) error {
+	return readOnlyError()
+}
+
+// newSnapshot returns a snapshot sharing this snapshot's view.
+func (s *batchSnapshot) newSnapshot() Snapshot {
+	return nestedSnapshot{s}
+}
+
+// close releases the snapshot of the underlying engine.
+func (s *batchSnapshot) close() {
+	s.snap.close()
+}
+
+// keyValues sorts key/value objects by key.
+type keyValues []KeyValue
+
+func (kvs keyValues) Len() int           { return len(kvs) }
+func (kvs keyValues) Swap(i, j int)      { kvs[i], kvs[j] = kvs[j], kvs[i] }
+func (kvs keyValues) Less(i, j int) bool { return bytes.Compare(kvs[i].Key, kvs[j].Key) < 0 }
@@ -0,0 +1,216 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+// keysOf returns the keys of kvs as strings.
+func keysOf(kvs []KeyValue) []string {
+	keys := []string{}
+	for _, kv := range kvs {
+		keys = append(keys, string(kv.Key))
+	}
+	return keys
+}
+
+// TestBatchReadsOwnWrites verifies reads of a batch reflect its
+// buffered writes, which aren't visible in the underlying engine until
+// committed.
+func TestBatchReadsOwnWrites(t *testing.T) {
+	engine := NewInMem(1 << 20)
+	for _, key := range []string{"a", "c", "e", "g"} {
+		if err := engine.put(Key(key), Value{Bytes: []byte(key)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := NewBatch(engine)
+	b.put(Key("b"), Value{Bytes: []byte("b")})
+	b.del(Key("c"))
+	b.put(Key("e"), Value{Bytes: []byte("E")})
+	b.del(Key("f"))
+
+	if v, _ := b.get(Key("c")); v.Bytes != nil {
+		t.Errorf("expected deleted key to read nil; got %q", v.Bytes)
+	}
+	if v, _ := b.get(Key("e")); string(v.Bytes) != "E" {
+		t.Errorf("expected buffered value; got %q", v.Bytes)
+	}
+	testCases := []struct {
+		start, end string
+		max        int64
+		reverse    bool
+		expKeys    []string
+	}{
+		{"a", "z", 0, false, []string{"a", "b", "e", "g"}},
+		{"a", "z", 2, false, []string{"a", "b"}},
+		{"b", "z", 2, false, []string{"b", "e"}},
+		{"c", "e", 0, false, []string{}},
+		{"a", "z", 0, true, []string{"g", "e", "b", "a"}},
+		{"a", "f", 2, true, []string{"e", "b"}},
+	}
+	for i, test := range testCases {
+		var kvs []KeyValue
+		var err error
+		if test.reverse {
+			kvs, err = b.reverseScan(Key(test.start), Key(test.end), test.max)
+		} else {
+			kvs, err = b.scan(Key(test.start), Key(test.end), test.max)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys := keysOf(kvs); !reflect.DeepEqual(keys, test.expKeys) {
+			t.Errorf("%d: expected keys %v; got %v", i, test.expKeys, keys)
+		}
+	}
+
+	if v, _ := engine.get(Key("b")); v.Bytes != nil {
+		t.Error("expected batch writes to be invisible before commit")
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	kvs, err := engine.scan(KeyMin, KeyMax, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := keysOf(kvs); !reflect.DeepEqual(keys, []string{"a", "b", "e", "g"}) {
+		t.Errorf("unexpected keys after commit: %v", keys)
+	}
+	if b.Len() != 0 {
+		t.Errorf("expected committed batch to be empty; got %d writes", b.Len())
+	}
+}
+
+// TestBatchCommitAtomic verifies a batch which can't be applied in
+// its entirety leaves the underlying engine unchanged.
+func TestBatchCommitAtomic(t *testing.T) {
+	engine := NewInMem(1 << 10)
+	b := NewBatch(engine)
+	b.put(Key("a"), Value{Bytes: make([]byte, 600)})
+	b.put(Key("b"), Value{Bytes: make([]byte, 600)})
+	if err := b.Commit(); err == nil {
+		t.Fatal("expected batch exceeding capacity to fail")
+	}
+	if v, _ := engine.get(Key("a")); v.Bytes != nil {
+		t.Error("expected failed batch to write nothing")
+	}
+
+	// A nested batch commits into its parent.
+	nested := NewBatch(NewBatch(engine))
+	nested.put(Key("c"), Value{Bytes: []byte("c")})
+	if err := nested.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := engine.get(Key("c")); v.Bytes != nil {
+		t.Error("expected nested batch to write to its parent only")
+	}
+	if err := nested.put(nil, Value{}); err == nil {
+		t.Error("expected error writing empty key")
+	}
+}
+
+// TestRangeBulkWriteAtomic verifies a bulk write which fails leaves
+// none of its rows written.
+func TestRangeBulkWriteAtomic(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	args := &InternalBulkWriteRequest{Rows: []KeyValue{
+		{Key: Key("a"), Value: Value{Bytes: make([]byte, 600<<10)}},
+		{Key: Key("b"), Value: Value{Bytes: make([]byte, 600<<10)}},
+	}}
+	reply := &InternalBulkWriteResponse{}
+	r.InternalBulkWrite(args, reply)
+	if reply.Error == nil || reply.Written != 0 {
+		t.Fatalf("expected bulk write exceeding capacity to fail; got %d written, %v", reply.Written, reply.Error)
+	}
+	if v, _ := r.engine.get(Key("a")); v.Bytes != nil {
+		t.Error("expected failed bulk write to write nothing")
+	}
+
+	args.Rows = args.Rows[:1]
+	if r.InternalBulkWrite(args, reply); reply.Error != nil || reply.Written != 1 {
+		t.Fatalf("expected row to be written; got %d written, %v", reply.Written, reply.Error)
+	}
+}
+
+// TestRangeBulkWriteIntent verifies a bulk write of a row holding
+// another transaction's write intent fails without writing any rows.
+func TestRangeBulkWriteIntent(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	pr := &PutResponse{}
+	if r.Put(&PutRequest{RequestHeader: txnHeader("txn", 1), Key: Key("b"), Value: Value{Bytes: []byte("intent")}}, pr); pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	for _, txID := range []string{"", "txn2"} {
+		args := &InternalBulkWriteRequest{Rows: []KeyValue{
+			{Key: Key("a"), Value: Value{Bytes: []byte("a")}},
+			{Key: Key("b"), Value: Value{Bytes: []byte("b")}},
+		}}
+		if txID != "" {
+			args.RequestHeader = txnHeader(txID, 1)
+		}
+		reply := &InternalBulkWriteResponse{}
+		r.InternalBulkWrite(args, reply)
+		if _, ok := reply.Error.(*WriteIntentError); !ok || reply.Written != 0 {
+			t.Errorf("txn %q: expected write intent error; got %d written, %v", txID, reply.Written, reply.Error)
+		}
+		if v, _ := r.engine.get(Key("a")); v.Bytes != nil {
+			t.Errorf("txn %q: expected failed bulk write to write nothing", txID)
+		}
+	}
+}
+
+// TestBatchSnapshot verifies a snapshot of a batch includes the writes
+// buffered when it was taken, but not later writes to the batch or its
+// engine.
+func TestBatchSnapshot(t *testing.T) {
+	engine := NewInMem(1 << 20)
+	if err := engine.put(Key("a"), Value{Bytes: []byte("a")}); err != nil {
+		t.Fatal(err)
+	}
+	b := NewBatch(engine)
+	b.put(Key("b"), Value{Bytes: []byte("b")})
+	snap := b.newSnapshot()
+	defer snap.close()
+	b.put(Key("c"), Value{Bytes: []byte("c")})
+	if err := engine.del(Key("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := snap.put(Key("d"), Value{Bytes: []byte("d")}); err == nil {
+		t.Error("expected write to snapshot to fail")
+	}
+	kvs, err := snap.scan(KeyMin, KeyMax, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := keysOf(kvs); !reflect.DeepEqual(keys, []string{"a", "b"}) {
+		t.Errorf("expected snapshot keys [a b]; got %q", keys)
+	}
+	it := b.newIterator()
+	defer it.close()
+	var keys []string
+	for it.seekToLast(); it.valid(); it.prev() {
+		keys = append(keys, string(it.key()))
+	}
+	if !reflect.DeepEqual(keys, []string{"c", "b"}) {
+		t.Errorf("expected batch iteration [c b]; got %q", keys)
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// CacheStats describes the size and effectiveness of a cache.
+type CacheStats struct {
+	Capacity int64 // Maximum bytes cached; 0 if the cache is disabled
+	Bytes    int64 // Bytes currently cached
+	Hits     int64 // Lookups served from the cache
+	Misses   int64 // Lookups which missed the cache
+}
+
+// HitRate returns the fraction of lookups served from the cache, or
+// zero if there have been none.
+func (cs CacheStats) HitRate() float64 {
+	if cs.Hits+cs.Misses == 0 {
+		return 0
+	}
+	return float64(cs.Hits) / float64(cs.Hits+cs.Misses)
+}
+
+// StoreCacheStats describes the caches of a store: its row cache and,
+// for engines which have one, such as RocksDB, the engine's block
+// cache.
+type StoreCacheStats struct {
+	RowCache   CacheStats
+	BlockCache *CacheStats `json:",omitempty"` // Nil if the engine has no block cache
+}
+
+// A BlockCachedEngine is an Engine which caches blocks of data read
+// from disk.
+type BlockCachedEngine interface {
+	Engine
+	// BlockCacheStats returns statistics of the block cache.
+	BlockCacheStats() (CacheStats, error)
+	// SetBlockCacheSize sets the size in bytes of the block cache.
+	SetBlockCacheSize(bytes int64) error
+}
+
+// cachingEngine is an Engine which caches rows read from the
+// underlying engine, up to a capacity which may be adjusted at
+// runtime. Writes go through to the underlying engine and invalidate
+// cached rows. Scans aren't cached, so that they don't displace rows
+// which are read repeatedly.
+type cachingEngine struct {
+	Engine
+	mu       sync.Mutex
+	lru      *util.LRUCache // Map from string(key) to Value
+	maxBytes int64
+	bytes    int64
+	hits     int64
+	misses   int64
+	// gen is incremented by each write, so that rows read
+	// concurrently with a write aren't cached after it.
+	gen int64
+}
+
+// newCachingEngine returns an engine caching rows read from engine.
+// The cache is disabled until its size is set.
+func newCachingEngine(engine Engine) *cachingEngine {
+	ce := &cachingEngine{Engine: engine, lru: util.NewLRUCache(0)}
+	ce.lru.OnEvicted = func(key util.Key, value interface{}) {
+		ce.bytes -= rowCacheSize(key.(string), value.(Value))
+	}
+	return ce
+}
+
+// rowCacheSize returns the approximate bytes used to cache value at
+// key.
+func rowCacheSize(key string, value Value) int64 {
+	return computeSize(KeyValue{Key: Key(key), Value: value})
+}
+
+// setCapacity sets the maximum bytes of rows cached, evicting the
+// least recently used rows as necessary. Zero disables the cache.
+func (ce *cachingEngine) setCapacity(capacity int64) {
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+	ce.maxBytes = capacity
+	ce.evict()
+}
+
+// evict removes the least recently used rows until the cache is
+// within its capacity. The lock must be held.
+func (ce *cachingEngine) evict() {
+	for ce.bytes > ce.maxBytes && ce.lru.Len() > 0 {
+		ce.lru.RemoveOldest()
+	}
+}
+
+// stats returns statistics of the row cache.
+func (ce *cachingEngine) stats() CacheStats {
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+	return CacheStats{Capacity: ce.maxBytes, Bytes: ce.bytes, Hits: ce.hits, Misses: ce.misses}
+}
+
+// String formats the underlying engine for debug output.
+func (ce *cachingEngine) String() string {
+	return fmt.Sprint(ce.Engine)
+}
+
+// Encrypted returns whether the underlying engine encrypts data at
+// rest.
+func (ce *cachingEngine) Encrypted() bool {
+	ee, ok := ce.Engine.(EncryptedEngine)
+	return ok && ee.Encrypted()
+}
+
+// CompactRange compacts the underlying engine.
+func (ce *cachingEngine) CompactRange(start, end Key) error {
+	return compactEngine(ce.Engine, start, end)
+}
+
+// get returns the value for the given key from the cache, if present,
+// or else from the underlying engine, caching it.
+func (ce *cachingEngine) get(key Key) (Value, error) {
+	ce.mu.Lock()
+	if ce.maxBytes == 0 {
+		ce.mu.Unlock()
+		return ce.Engine.get(key)
+	}
+	if value, ok := ce.lru.Get(string(key)); ok {
+		ce.hits++
+		ce.mu.Unlock()
+		return value.(Value), nil
+	}
+	ce.misses++
+	gen := ce.gen
+	ce.mu.Unlock()
+
+	value, err := ce.Engine.get(key)
+	if err != nil {
+		return value, err
+	}
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+	if size := rowCacheSize(string(key), value); ce.gen == gen && size <= ce.maxBytes {
+		ce.lru.Add(string(key), value)
+		ce.bytes += size
+		ce.evict()
+	}
+	return value, nil
+}
+
+// invalidate removes the rows at keys from the cache following a
+// write to them.
+func (ce *cachingEngine) invalidate(keys ...Key) {
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+	ce.gen++
+	for _, key := range keys {
+		ce.lru.Remove(string(key))
+	}
+}
+
+// put writes through to the underlying engine.
+func (ce *cachingEngine) put(key Key, value Value) error {
+	defer ce.invalidate(key)
+	return ce.Engine.put(key, value)
+}
+
+// del writes through to the underlying engine.
+func (ce *cachingEngine) del(key Key) error {
+	defer ce.invalidate(key)
+	return ce.Engine.del(key)
+}
+
+// writeBatch writes through to the underlying engine.
+func (ce *cachingEngine) writeBatch(writes []engineWrite) error {
+	keys := make([]Key, len(writes))
+	for i, w := range writes {
+		keys[i] = w.key
+	}
+	defer ce.invalidate(keys...)
+	return ce.Engine.writeBatch(writes)
+}
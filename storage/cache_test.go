@@ -0,0 +1,103 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestCachingEngine verifies rows are served from the cache once read,
+// that writes invalidate them and that the cache is bounded by its
+// capacity.
+func TestCachingEngine(t *testing.T) {
+	in := NewInMem(1 << 20)
+	ce := newCachingEngine(in)
+	if err := ce.put(Key("a"), Value{Bytes: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Disabled, reads bypass the cache entirely.
+	if _, err := ce.get(Key("a")); err != nil {
+		t.Fatal(err)
+	}
+	if stats := ce.stats(); stats != (CacheStats{}) {
+		t.Errorf("expected empty stats while disabled; got %+v", stats)
+	}
+
+	ce.setCapacity(1 << 10)
+	for i := 0; i < 2; i++ {
+		if v, err := ce.get(Key("a")); err != nil || !bytes.Equal(v.Bytes, []byte("1")) {
+			t.Fatalf("unexpected get result: %v, %v", v, err)
+		}
+	}
+	if stats := ce.stats(); stats.Hits != 1 || stats.Misses != 1 || stats.HitRate() != 0.5 || stats.Bytes == 0 {
+		t.Errorf("expected one hit and one miss; got %+v", stats)
+	}
+
+	// A write to the underlying engine alone isn't seen, but a write
+	// through the cache invalidates the row.
+	in.put(Key("a"), Value{Bytes: []byte("2")})
+	if v, _ := ce.get(Key("a")); !bytes.Equal(v.Bytes, []byte("1")) {
+		t.Errorf("expected cached value; got %q", v.Bytes)
+	}
+	if err := ce.writeBatch([]engineWrite{{key: Key("a"), value: Value{Bytes: []byte("3")}}}); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := ce.get(Key("a")); !bytes.Equal(v.Bytes, []byte("3")) {
+		t.Errorf("expected written value; got %q", v.Bytes)
+	}
+	if err := ce.del(Key("a")); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := ce.get(Key("a")); v.Bytes != nil {
+		t.Errorf("expected deleted value; got %q", v.Bytes)
+	}
+
+	// Shrinking the cache evicts rows to fit.
+	for _, key := range []string{"b", "c", "d", "e"} {
+		if err := ce.put(Key(key), Value{Bytes: make([]byte, 100)}); err != nil {
+			t.Fatal(err)
+		}
+		ce.get(Key(key))
+	}
+	ce.setCapacity(250)
+	if stats := ce.stats(); stats.Bytes > 250 || stats.Bytes == 0 {
+		t.Errorf("expected cache within capacity; got %+v", stats)
+	}
+	ce.setCapacity(0)
+	if stats := ce.stats(); stats.Bytes != 0 || ce.lru.Len() != 0 {
+		t.Errorf("expected disabled cache to be empty; got %+v", stats)
+	}
+}
+
+// TestStoreCacheStats verifies a store reports its row cache and
+// that an engine without a block cache can't be resized.
+func TestStoreCacheStats(t *testing.T) {
+	store := NewStore(NewInMem(1<<20), nil)
+	defer store.Close()
+	store.SetRowCacheSize(1 << 20)
+	stats, err := store.CacheStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.RowCache.Capacity != 1<<20 || stats.BlockCache != nil {
+		t.Errorf("unexpected cache stats %+v", stats)
+	}
+	if err := store.SetBlockCacheSize(1 << 20); err == nil {
+		t.Error("expected error resizing nonexistent block cache")
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// compactionHintMinRows is the number of rows a range must delete in
+// bulk, as counted by its compaction hint, before the hinted span is
+// compacted by Store.CompactHinted. Var for testing.
+var compactionHintMinRows int64 = 10000
+
+// A CompactableEngine is an Engine which can compact its storage on
+// demand, reclaiming the space of deleted and overwritten rows, which
+// otherwise happens only as the engine compacts in the background.
+type CompactableEngine interface {
+	Engine
+	// CompactRange compacts the storage of the rows in [start, end).
+	// An empty start or end leaves that side of the span unbounded.
+	CompactRange(start, end Key) error
+}
+
+// compactEngine compacts the span [start, end) of engine, failing if
+// it isn't a CompactableEngine.
+func compactEngine(engine Engine, start, end Key) error {
+	ce, ok := engine.(CompactableEngine)
+	if !ok {
+		return util.Errorf("%s doesn't support compaction", engine)
+	}
+	return ce.CompactRange(start, end)
+}
+
+// A compactionHint suggests compacting a span of a range, following
+// bulk deletions within it. Hints are kept in memory only; one lost
+// with a restart leaves the space to be reclaimed by the engine's
+// background compactions.
+type compactionHint struct {
+	start, end Key
+	rows       int64 // Rows deleted within the span since it was last compacted
+}
+
+// hintCompaction records the deletion of rows within [start, end),
+// widening the range's compaction hint to cover the span.
+func (r *Range) hintCompaction(start, end Key, rows int64) {
+	if rows <= 0 {
+		return
+	}
+	r.compactMu.Lock()
+	defer r.compactMu.Unlock()
+	if r.compactHint == nil {
+		r.compactHint = &compactionHint{start: start, end: end, rows: rows}
+		return
+	}
+	hint := r.compactHint
+	if bytes.Compare(start, hint.start) < 0 {
+		hint.start = start
+	}
+	if bytes.Compare(end, hint.end) > 0 {
+		hint.end = end
+	}
+	hint.rows += rows
+}
+
+// takeCompactionHint returns and clears the range's compaction hint,
+// if it counts at least minRows deleted rows.
+func (r *Range) takeCompactionHint(minRows int64) (compactionHint, bool) {
+	r.compactMu.Lock()
+	defer r.compactMu.Unlock()
+	if r.compactHint == nil || r.compactHint.rows < minRows {
+		return compactionHint{}, false
+	}
+	hint := *r.compactHint
+	r.compactHint = nil
+	return hint, true
+}
+
+// Compact deletes the rows hidden by range tombstones in the span
+// [start, end), clamped to the range, and then compacts the span's
+// storage, reclaiming the space of deleted rows promptly. An empty
+// end key extends the span to the end of the range. Returns the
+// number of hidden rows deleted.
+func (r *Range) Compact(start, end Key) (int64, error) {
+	meta := r.Metadata()
+	if bytes.Compare(start, meta.StartKey) < 0 {
+		start = meta.StartKey
+	}
+	if len(end) == 0 || bytes.Compare(end, meta.EndKey) > 0 {
+		end = meta.EndKey
+	}
+	if bytes.Compare(start, end) >= 0 {
+		return 0, nil
+	}
+	rows, _, err := r.compactTombstones(start, end, 0)
+	if err != nil {
+		return rows, err
+	}
+	return rows, compactEngine(r.engine, start, end)
+}
+
+// CompactHinted compacts the span hinted by each of the store's
+// ranges whose bulk deletions, by garbage collection, DeleteRange or
+// merges, count at least compactionHintMinRows rows. Returns the IDs
+// of the ranges compacted, in key order. A failed compaction's hint is
+// restored, to be retried.
+func (s *Store) CompactHinted() ([]int64, error) {
+	s.mu.Lock()
+	ranges := make([]*Range, 0, len(s.ranges))
+	for _, rng := range s.ranges {
+		ranges = append(ranges, rng)
+	}
+	s.mu.Unlock()
+	sort.Sort(rangesByKey(ranges))
+
+	var compacted []int64
+	for _, rng := range ranges {
+		hint, ok := rng.takeCompactionHint(compactionHintMinRows)
+		if !ok {
+			continue
+		}
+		if err := compactEngine(s.engine, hint.start, hint.end); err != nil {
+			rng.hintCompaction(hint.start, hint.end, hint.rows)
+			return compacted, err
+		}
+		compacted = append(compacted, rng.Metadata().RangeID)
+	}
+	return compacted, nil
+}
@@ -0,0 +1,156 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// compactRecorder is an in-memory engine which records the spans it's
+// asked to compact.
+type compactRecorder struct {
+	*InMem
+	mu    sync.Mutex
+	spans []rangeTombstone
+}
+
+// CompactRange records the span.
+func (cr *compactRecorder) CompactRange(start, end Key) error {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.spans = append(cr.spans, rangeTombstone{start, end})
+	return nil
+}
+
+// takeSpans returns and clears the spans compacted so far.
+func (cr *compactRecorder) takeSpans() []rangeTombstone {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	spans := cr.spans
+	cr.spans = nil
+	return spans
+}
+
+// TestStoreCompactHinted verifies the spans of bulk deletions and of
+// merged ranges are compacted once their hints count enough rows.
+func TestStoreCompactHinted(t *testing.T) {
+	defer func(n int64) { compactionHintMinRows = n }(compactionHintMinRows)
+	compactionHintMinRows = 5
+	engine := &compactRecorder{InMem: NewInMem(1 << 20)}
+	store := NewStore(engine, nil)
+	defer store.Close()
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	replica := Replica{NodeID: testIdent.NodeID, StoreID: testIdent.StoreID, RangeID: 1}
+	rng, err := store.CreateRange(KeyMin, KeyMax, []Replica{replica})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleteRows := func(prefix string, n int) {
+		for i := 0; i < n; i++ {
+			pr := &PutResponse{}
+			rng.Put(&PutRequest{Key: Key(fmt.Sprintf("%s%d", prefix, i)), Value: Value{Bytes: []byte("value")}}, pr)
+			if pr.Error != nil {
+				t.Fatal(pr.Error)
+			}
+		}
+		dr := &DeleteRangeResponse{}
+		rng.DeleteRange(&DeleteRangeRequest{StartKey: Key(prefix), EndKey: PrefixEndKey(Key(prefix))}, dr)
+		if dr.Error != nil || dr.NumDeleted != uint64(n) {
+			t.Fatalf("expected %d rows deleted; got %d, %v", n, dr.NumDeleted, dr.Error)
+		}
+	}
+	compactHinted := func() []int64 {
+		ids, err := store.CompactHinted()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ids
+	}
+
+	deleteRows("a", 3)
+	if ids := compactHinted(); len(ids) != 0 {
+		t.Errorf("expected no compaction below the hint threshold; got %v", ids)
+	}
+	deleteRows("b", 3)
+	if ids := compactHinted(); !reflect.DeepEqual(ids, []int64{1}) {
+		t.Errorf("expected range 1 compacted; got %v", ids)
+	}
+	exp := []rangeTombstone{{Key("a"), Key("c")}}
+	if spans := engine.takeSpans(); !reflect.DeepEqual(spans, exp) {
+		t.Errorf("expected spans %q compacted; got %q", exp, spans)
+	}
+	if ids := compactHinted(); len(ids) != 0 {
+		t.Errorf("expected hint cleared by compaction; got %v", ids)
+	}
+
+	// A merge hints the merged range's span.
+	newRng, err := store.SplitRange(rng.Metadata().RangeID, Key("m"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newRng.hintCompaction(Key("m"), Key("n"), 1)
+	if _, err := store.MergeRange(rng.Metadata().RangeID); err != nil {
+		t.Fatal(err)
+	}
+	if ids := compactHinted(); !reflect.DeepEqual(ids, []int64{1}) {
+		t.Errorf("expected merged range compacted; got %v", ids)
+	}
+	exp = []rangeTombstone{{KeyMin, KeyMax}}
+	if spans := engine.takeSpans(); !reflect.DeepEqual(spans, exp) {
+		t.Errorf("expected spans %q compacted; got %q", exp, spans)
+	}
+}
+
+// TestRangeCompact verifies compacting a span of a range deletes the
+// rows hidden by range tombstones and compacts the engine.
+func TestRangeCompact(t *testing.T) {
+	defer func(n int) { rangeTombstoneMinRows = n }(rangeTombstoneMinRows)
+	rangeTombstoneMinRows = 2
+	engine := &compactRecorder{InMem: NewInMem(1 << 20)}
+	r, _ := createTestRange(engine, t)
+	defer r.Stop()
+	for i := 0; i < 5; i++ {
+		pr := &PutResponse{}
+		r.Put(&PutRequest{Key: Key(fmt.Sprintf("k%d", i)), Value: Value{Bytes: []byte("value")}}, pr)
+		if pr.Error != nil {
+			t.Fatal(pr.Error)
+		}
+	}
+	dr := &DeleteRangeResponse{}
+	r.DeleteRange(&DeleteRangeRequest{StartKey: Key("k"), EndKey: Key("l")}, dr)
+	if dr.Error != nil {
+		t.Fatal(dr.Error)
+	}
+	rows, err := r.Compact(Key("k"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows != 5 {
+		t.Errorf("expected 5 hidden rows deleted; got %d", rows)
+	}
+	if ts := tombstoneSpans(t, engine); len(ts) != 0 {
+		t.Errorf("expected tombstones removed; got %q", ts)
+	}
+	exp := []rangeTombstone{{Key("k"), KeyMax}}
+	if spans := engine.takeSpans(); !reflect.DeepEqual(spans, exp) {
+		t.Errorf("expected spans %q compacted; got %q", exp, spans)
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// DictVersionNone is the DictVersion of values compressed without a
+// dictionary, as required by a zone's CompressionDeflate policy.
+const DictVersionNone int32 = -1
+
+// CompressionDicts holds the compression dictionaries configured for
+// key prefixes, as stored under KeyConfigCompressionPrefix. Values
+// under a prefix with a dictionary are DEFLATE-compressed using the
+// newest version of the dictionary, which shrinks small, repetitive
+// values considerably. A nil *CompressionDicts has no dictionaries.
+//
+// System keys are never compressed.
+type CompressionDicts struct {
+	configs *prefixConfigMap
+}
+
+// newCompressionDicts returns the dictionaries specified by configs,
+// a slice of *CompressionConfig prefix configs.
+func newCompressionDicts(configs []*prefixConfig) (*CompressionDicts, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+	// The prefix config map requires a default; it's uncompressed.
+	// newPrefixConfigMap also sorts and appends to the slice it's
+	// given, which may be shared with gossip.
+	configs = append([]*prefixConfig(nil), configs...)
+	hasDefault := false
+	for _, pc := range configs {
+		hasDefault = hasDefault || len(pc.Prefix) == 0
+	}
+	if !hasDefault {
+		configs = append(configs, &prefixConfig{Prefix: KeyMin, Config: &CompressionConfig{}})
+	}
+	pcm, err := newPrefixConfigMap(configs)
+	if err != nil {
+		return nil, err
+	}
+	return &CompressionDicts{configs: pcm}, nil
+}
+
+// GossipedCompressionDicts returns the compression dictionaries
+// gossiped by the range holding them, or nil if they're unavailable.
+func GossipedCompressionDicts(g *gossip.Gossip) *CompressionDicts {
+	info, err := g.GetInfo(gossip.KeyConfigCompression)
+	if err != nil {
+		return nil
+	}
+	cd, err := newCompressionDicts(info.([]*prefixConfig))
+	if err != nil {
+		return nil
+	}
+	return cd
+}
+
+// lookup returns the dictionary of the specified version for key, or
+// the newest version if version is zero. Returns nil if there's no
+// such dictionary.
+func (cd *CompressionDicts) lookup(key Key, version int32) *CompressionDict {
+	if cd == nil || bytes.HasPrefix(key, KeySystemPrefix) {
+		return nil
+	}
+	config := cd.configs.matchByPrefix(key).Config.(*CompressionConfig)
+	var dict *CompressionDict
+	for i := range config.Dicts {
+		d := &config.Dicts[i]
+		if d.Version <= 0 {
+			continue // Invalid; zero denotes uncompressed values
+		}
+		if version == d.Version {
+			return d
+		}
+		if version == 0 && (dict == nil || d.Version > dict.Version) {
+			dict = d
+		}
+	}
+	return dict
+}
+
+// Compress returns value compressed with the newest dictionary for
+// key. The value is returned unchanged if it's already compressed,
+// if key has no dictionary, or if compression doesn't shrink it.
+func (cd *CompressionDicts) Compress(key Key, value Value) (Value, error) {
+	if value.DictVersion != 0 || value.Bytes == nil {
+		return value, nil
+	}
+	dict := cd.lookup(key, 0)
+	if dict == nil {
+		return value, nil
+	}
+	return deflate(value, dict.Dict, dict.Version)
+}
+
+// CompressCodec returns value compressed according to codec, a
+// CompressionOptions codec: with the newest dictionary for key, or
+// without one for CompressionDeflate if key has none. The value is
+// returned unchanged if it's already compressed, if key is a system
+// key, or if compression doesn't shrink it.
+func (cd *CompressionDicts) CompressCodec(key Key, value Value, codec string) (Value, error) {
+	if !(CompressionOptions{Codec: codec}).Enabled() || bytes.HasPrefix(key, KeySystemPrefix) {
+		return value, nil
+	}
+	compressed, err := cd.Compress(key, value)
+	if err != nil || compressed.DictVersion != 0 || codec != CompressionDeflate || value.Bytes == nil {
+		return compressed, err
+	}
+	return deflate(value, nil, DictVersionNone)
+}
+
+// deflate returns value compressed with the specified dictionary,
+// which may be nil, and marked with version. The value is returned
+// unchanged if compression doesn't shrink it.
+func deflate(value Value, dict []byte, version int32) (Value, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriterDict(&buf, flate.BestCompression, dict)
+	if err != nil {
+		return value, err
+	}
+	if _, err := w.Write(value.Bytes); err != nil {
+		return value, err
+	}
+	if err := w.Close(); err != nil {
+		return value, err
+	}
+	if buf.Len() >= len(value.Bytes) {
+		return value, nil
+	}
+	value.Bytes, value.DictVersion = buf.Bytes(), version
+	return value, nil
+}
+
+// Decompress returns value decompressed with the dictionary with
+// which it was compressed. Uncompressed values are returned
+// unchanged. Returns an error if the dictionary isn't known.
+func (cd *CompressionDicts) Decompress(key Key, value Value) (Value, error) {
+	var dict []byte
+	switch value.DictVersion {
+	case 0:
+		return value, nil
+	case DictVersionNone:
+	default:
+		d := cd.lookup(key, value.DictVersion)
+		if d == nil {
+			return value, util.Errorf("key %q: unknown compression dictionary version %d", key, value.DictVersion)
+		}
+		dict = d.Dict
+	}
+	r := flate.NewReaderDict(bytes.NewReader(value.Bytes), dict)
+	defer r.Close()
+	decompressed, err := ioutil.ReadAll(r)
+	if err != nil {
+		return value, util.Errorf("key %q: unable to decompress value: %v", key, err)
+	}
+	value.Bytes, value.DictVersion = decompressed, 0
+	return value, nil
+}
@@ -0,0 +1,208 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+)
+
+var testDict = []byte(`{"level":"info","service":"frontend","message":"request served"}`)
+
+// testLogValue is a value resembling testDict.
+var testLogValue = []byte(`{"level":"info","service":"frontend","message":"request served","latency":12}`)
+
+// TestCompressionDicts verifies values are compressed with the newest
+// dictionary for their prefix and decompressed with the dictionary
+// version recorded in the value.
+func TestCompressionDicts(t *testing.T) {
+	cd, err := newCompressionDicts([]*prefixConfig{
+		{Key("/logs"), &CompressionConfig{Dicts: []CompressionDict{{1, []byte("unrelated")}, {2, testDict}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := Key("/logs/1")
+	compressed, err := cd.Compress(key, Value{Bytes: testLogValue})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compressed.DictVersion != 2 || len(compressed.Bytes) >= len(testLogValue) {
+		t.Errorf("expected value compressed with version 2; got version %d, %d bytes", compressed.DictVersion, len(compressed.Bytes))
+	}
+	value, err := cd.Decompress(key, compressed)
+	if err != nil || !bytes.Equal(value.Bytes, testLogValue) || value.DictVersion != 0 {
+		t.Errorf("expected original value; got %q, %v", value.Bytes, err)
+	}
+	// Keys without dictionaries, and system keys, aren't compressed.
+	for _, key := range []Key{Key("/other"), MakeKey(KeySystemPrefix, Key("/logs"))} {
+		if value, err := cd.Compress(key, Value{Bytes: testLogValue}); err != nil || value.DictVersion != 0 {
+			t.Errorf("%q: expected value uncompressed; got version %d, %v", key, value.DictVersion, err)
+		}
+	}
+	// Unknown dictionaries can't be decompressed.
+	if _, err := cd.Decompress(key, Value{Bytes: compressed.Bytes, DictVersion: 3}); err == nil {
+		t.Error("expected error decompressing with unknown dictionary")
+	}
+	var nilDicts *CompressionDicts
+	if _, err := nilDicts.Decompress(key, compressed); err == nil {
+		t.Error("expected error decompressing without dictionaries")
+	}
+}
+
+// TestCompressCodec verifies values are compressed according to the
+// codec of a client's compression options.
+func TestCompressCodec(t *testing.T) {
+	cd, err := newCompressionDicts([]*prefixConfig{
+		{Key("/logs"), &CompressionConfig{Dicts: []CompressionDict{{1, testDict}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		key            Key
+		codec          string
+		expDictVersion int32
+	}{
+		{Key("/logs/1"), CompressionDictionary, 1},
+		{Key("/logs/1"), CompressionDeflate, 1},
+		{Key("/other/1"), CompressionDictionary, 0},
+		{Key("/other/1"), CompressionDeflate, DictVersionNone},
+		{Key("/logs/1"), CompressionNone, 0},
+		{Key("/logs/1"), "", 0},
+		{MakeKey(KeySystemPrefix, Key("/other")), CompressionDeflate, 0},
+	}
+	for i, test := range testCases {
+		value, err := cd.CompressCodec(test.key, Value{Bytes: testLogValue}, test.codec)
+		if err != nil || value.DictVersion != test.expDictVersion {
+			t.Errorf("%d: expected dictionary version %d; got %d, %v", i, test.expDictVersion, value.DictVersion, err)
+		}
+		if value, err = cd.Decompress(test.key, value); err != nil || !bytes.Equal(value.Bytes, testLogValue) {
+			t.Errorf("%d: expected original value; got %q, %v", i, value.Bytes, err)
+		}
+	}
+}
+
+// TestRangeCompression verifies a range compresses values it stores
+// under a prefix with a dictionary, returning them decompressed
+// unless the client accepts compressed values.
+func TestRangeCompression(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(CompressionConfig{Dicts: []CompressionDict{{1, testDict}}}); err != nil {
+		t.Fatal(err)
+	}
+	putReply := &PutResponse{}
+	r.Put(&PutRequest{Key: MakeKey(KeyConfigCompressionPrefix, Key("/logs")), Value: Value{Bytes: buf.Bytes()}}, putReply)
+	if putReply.Error != nil {
+		t.Fatal(putReply.Error)
+	}
+	key := Key("/logs/1")
+	r.Put(&PutRequest{Key: key, Value: Value{Bytes: testLogValue}}, putReply)
+	if putReply.Error != nil {
+		t.Fatal(putReply.Error)
+	}
+	if stored, err := r.engine.get(key); err != nil || stored.DictVersion != 1 {
+		t.Errorf("expected value stored compressed; got version %d, %v", stored.DictVersion, err)
+	}
+	getReply := &GetResponse{}
+	r.Get(&GetRequest{Key: key}, getReply)
+	if getReply.Error != nil || !bytes.Equal(getReply.Value.Bytes, testLogValue) {
+		t.Errorf("expected decompressed value; got %q, %v", getReply.Value.Bytes, getReply.Error)
+	}
+	getReply = &GetResponse{}
+	r.Get(&GetRequest{RequestHeader: RequestHeader{AcceptCompressed: true}, Key: key}, getReply)
+	if getReply.Error != nil || getReply.Value.DictVersion != 1 {
+		t.Errorf("expected compressed value; got version %d, %v", getReply.Value.DictVersion, getReply.Error)
+	}
+	// Values stored uncompressed are compressed in reply if at least
+	// as large as the client's response threshold.
+	r.Put(&PutRequest{Key: Key("/other"), Value: Value{Bytes: testLogValue}}, putReply)
+	if putReply.Error != nil {
+		t.Fatal(putReply.Error)
+	}
+	for threshold, expDictVersion := range map[int]int32{len(testLogValue): DictVersionNone, len(testLogValue) + 1: 0} {
+		header := RequestHeader{
+			AcceptCompressed: true,
+			Compression:      &CompressionOptions{Codec: CompressionDeflate, ResponseThreshold: threshold},
+		}
+		getReply = &GetResponse{}
+		r.Get(&GetRequest{RequestHeader: header, Key: Key("/other")}, getReply)
+		if getReply.Error != nil || getReply.Value.DictVersion != expDictVersion {
+			t.Errorf("threshold %d: expected version %d; got %d, %v", threshold, expDictVersion, getReply.Value.DictVersion, getReply.Error)
+		}
+	}
+	// Conditional puts compare against the decompressed value.
+	r.Put(&PutRequest{Key: key, Value: Value{Bytes: []byte("new")}, ExpValue: &Value{Bytes: testLogValue}}, putReply)
+	if putReply.Error != nil {
+		t.Error(putReply.Error)
+	}
+}
+
+// TestRangeZoneCompressionPolicy verifies a range compresses values
+// according to the compression policy of their zone.
+func TestRangeZoneCompressionPolicy(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	for prefix, policy := range map[string]string{"/deflate": CompressionDeflate, "/none": CompressionNone} {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(ZoneConfig{Compression: policy}); err != nil {
+			t.Fatal(err)
+		}
+		reply := &PutResponse{}
+		r.Put(&PutRequest{Key: MakeKey(KeyConfigZonePrefix, Key(prefix)), Value: Value{Bytes: buf.Bytes()}}, reply)
+		if reply.Error != nil {
+			t.Fatal(reply.Error)
+		}
+	}
+	testCases := []struct {
+		key            Key
+		value          Value
+		expDictVersion int32
+	}{
+		{Key("/deflate/1"), Value{Bytes: testLogValue}, DictVersionNone},
+		{Key("/other/1"), Value{Bytes: testLogValue}, 0},
+		// Values compressed by the client are stored uncompressed.
+		{Key("/none/1"), Value{Bytes: mustDeflate(t, testLogValue), DictVersion: DictVersionNone}, 0},
+	}
+	for i, test := range testCases {
+		reply := &PutResponse{}
+		r.Put(&PutRequest{Key: test.key, Value: test.value}, reply)
+		if reply.Error != nil {
+			t.Fatal(reply.Error)
+		}
+		stored, err := r.engine.get(test.key)
+		if err != nil || stored.DictVersion != test.expDictVersion {
+			t.Errorf("%d: expected dictionary version %d; got %d, %v", i, test.expDictVersion, stored.DictVersion, err)
+		}
+		getReply := &GetResponse{}
+		r.Get(&GetRequest{Key: test.key}, getReply)
+		if getReply.Error != nil || !bytes.Equal(getReply.Value.Bytes, testLogValue) {
+			t.Errorf("%d: expected original value; got %q, %v", i, getReply.Value.Bytes, getReply.Error)
+		}
+	}
+}
+
+// mustDeflate returns b compressed without a dictionary.
+func mustDeflate(t *testing.T, b []byte) []byte {
+	value, err := deflate(Value{Bytes: b}, nil, DictVersionNone)
+	if err != nil || value.DictVersion != DictVersionNone {
+		t.Fatalf("unable to compress: %v", err)
+	}
+	return value.Bytes
+}
@@ -60,11 +60,11 @@ func StringToDiskType(str string) DiskType {
 // DiskType are provided to optimize reads. Replicas are stored in
 // Range lookup records (meta1, meta2).
 type Replica struct {
-	NodeID     int32
-	StoreID    int32
-	RangeID    int64
-	Datacenter string
-	DiskType
+	NodeID     int32  `protobuf:"1"`
+	StoreID    int32  `protobuf:"2"`
+	RangeID    int64  `protobuf:"3"`
+	Datacenter string `protobuf:"4"`
+	DiskType   `protobuf:"5"`
 }
 
 // StoreCapacity contains capacity information for a storage device.
@@ -83,17 +83,26 @@ type NodeAttributes struct {
 	Rack       string
 }
 
-// StoreAttributes holds store information including physical/network
-// topology via NodeAttributes and disk type & capacity data.
-type StoreAttributes struct {
+// A StoreDescriptor describes a store: its node's physical/network
+// topology, its disk type, capacity and load. Nodes gossip the
+// descriptors of their stores at a regular interval, keyed by
+// gossip.MakeStoreKey, for the allocator and rebalancer; a store whose
+// descriptor expires is presumed unavailable.
+type StoreDescriptor struct {
 	StoreID    int32
-	Attributes NodeAttributes
+	Node       NodeAttributes
 	Capacity   StoreCapacity
+	RangeCount int        // Replicas held by the store
+	Stats      RangeStats // Stats of the store's replicas, summed
+	Encrypted  bool       // Store encrypts data at rest
 }
 
 // AcctConfig holds accounting configuration.
 type AcctConfig struct {
-	// Nothing for the moment.
+	// Name is the account to which usage under the config's key
+	// prefix is attributed in usage reports. If empty, the key prefix
+	// itself names the account.
+	Name string `yaml:"name,omitempty"`
 }
 
 // Permission specifies read/write access and associated priority.
@@ -109,19 +118,101 @@ type PermConfig struct {
 	Perms []Permission `yaml:"permissions,omitempty"`
 }
 
+// A CompressionDict is a preset dictionary used to compress values,
+// trained offline on representative values.
+type CompressionDict struct {
+	Version int32  `yaml:"version"` // Positive; recorded with values compressed with the dictionary
+	Dict    []byte `yaml:"dict"`
+}
+
+// CompressionConfig holds the compression dictionaries for a key
+// prefix. New values are compressed with the newest version; older
+// versions must be retained for as long as values compressed with
+// them remain.
+type CompressionConfig struct {
+	Dicts []CompressionDict `yaml:"dicts,omitempty"`
+}
+
+// A TTLConfig limits the lifetime of values under a key prefix.
+// Expired values are deleted by garbage collection; until then, they
+// remain readable.
+type TTLConfig struct {
+	// TTLSeconds is the time after a value is written at which it
+	// expires. Zero means values don't expire, which exempts a prefix
+	// from the TTL of an enclosing prefix.
+	TTLSeconds int64 `yaml:"ttl_seconds,omitempty"`
+	// Sliding makes reads extend the lifetime of values, which then
+	// expire TTLSeconds after they were last written or read, as
+	// suits session stores. To limit the writes this causes, a read
+	// extends a value's lifetime only once a tenth of its TTL has
+	// passed since it was last extended, so values may expire up to a
+	// tenth of the TTL early. A value's Expiration is ignored if it
+	// precedes the TTL, as it records the extended lifetime.
+	Sliding bool `yaml:"sliding,omitempty"`
+}
+
+// A FreezeConfig freezes access to the span of keys from its start
+// key, the suffix of its config key, up to EndKey, as during
+// migrations, restores into a prefix or forensic investigation.
+// Requests accessing frozen keys are refused with a SpanFrozenError
+// until the freeze is deleted or expires. Freezes are always
+// temporary, so that a forgotten freeze can't make data permanently
+// unavailable.
+type FreezeConfig struct {
+	EndKey     Key    // Exclusive end of the frozen span
+	Reads      bool   // Reads are refused as well as writes
+	Reason     string // Why the span is frozen; reported to clients
+	Expiration int64  // Time at which the freeze lapses, in nanoseconds since the epoch
+}
+
+// Compression policies for values stored in a zone. An empty policy
+// compresses values only under prefixes with compression dictionaries.
+const (
+	// CompressionNone stores values uncompressed, even if compressed
+	// by the client or a dictionary is available.
+	CompressionNone = "none"
+	// CompressionDeflate compresses all values, using the prefix's
+	// compression dictionary if there is one.
+	CompressionDeflate = "deflate"
+)
+
 // ZoneConfig holds configuration that is needed for a range of KV pairs.
 type ZoneConfig struct {
 	// Replicas is a map from datacenter name to a slice of disk types.
 	Replicas      map[string][]string `yaml:"replicas,omitempty"`
 	RangeMinBytes int64               `yaml:"range_min_bytes,omitempty"`
 	RangeMaxBytes int64               `yaml:"range_max_bytes,omitempty"`
+	// Compression is the compression policy for stored values.
+	Compression string `yaml:"compression,omitempty"`
+	// EncryptionRequired restricts replicas to stores which encrypt
+	// data at rest.
+	EncryptionRequired bool `yaml:"encryption_required,omitempty"`
+	// GCTTLSeconds is the age beyond which MVCC versions which have
+	// been superseded are garbage collected. Zero specifies the
+	// default of one day.
+	GCTTLSeconds int64 `yaml:"gc_ttl_seconds,omitempty"`
 }
 
 // ParseZoneConfig parses a YAML serialized ZoneConfig.
 func ParseZoneConfig(in []byte) (*ZoneConfig, error) {
 	z := &ZoneConfig{}
-	err := yaml.Unmarshal(in, z)
-	return z, err
+	if err := yaml.Unmarshal(in, z); err != nil {
+		return z, err
+	}
+	return z, z.Validate()
+}
+
+// Validate returns an error if the zone config specifies an unknown
+// storage policy or a negative GC TTL.
+func (z *ZoneConfig) Validate() error {
+	if z.GCTTLSeconds < 0 {
+		return util.Errorf("negative GC TTL %d", z.GCTTLSeconds)
+	}
+	switch z.Compression {
+	case "", CompressionNone, CompressionDeflate:
+		return nil
+	}
+	return util.Errorf("unknown compression policy %q", z.Compression)
 }
 
 // ToYAML serializes a ZoneConfig as YAML.
@@ -129,9 +220,9 @@ func (z *ZoneConfig) ToYAML() ([]byte, error) {
 	return yaml.Marshal(z)
 }
 
-// Less compares two StoreAttributess based on percentage of disk available.
-func (a StoreAttributes) Less(b gossip.Ordered) bool {
-	return a.Capacity.PercentAvail() < b.(StoreAttributes).Capacity.PercentAvail()
+// Less compares two StoreDescriptors based on percentage of disk available.
+func (a StoreDescriptor) Less(b gossip.Ordered) bool {
+	return a.Capacity.PercentAvail() < b.(StoreDescriptor).Capacity.PercentAvail()
 }
 
 // PercentAvail computes the percentage of disk space that is available.
@@ -145,8 +236,8 @@ func (sc StoreCapacity) PercentAvail() float64 {
 type RangeLocations struct {
 	// The start key of the range represented by this struct, along with the
 	// meta1 or meta2 key prefix.
-	StartKey Key
-	Replicas []Replica
+	StartKey Key       `protobuf:"1"`
+	Replicas []Replica `protobuf:"2"`
 }
 
 // ChooseRandomReplica returns a replica selected at random or nil if none exist.
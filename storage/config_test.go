@@ -46,3 +46,14 @@ func TestZoneConfigRoundTrip(t *testing.T) {
 		glog.Fatalf("yaml round trip configs differ.\nOriginal: %+v\nParse: %+v\n", testConfig, parsedZoneConfig)
 	}
 }
+
+// TestZoneConfigValidate verifies unknown compression policies are
+// rejected when parsing.
+func TestZoneConfigValidate(t *testing.T) {
+	if _, err := ParseZoneConfig([]byte("compression: deflate\nencryption_required: true\n")); err != nil {
+		t.Errorf("expected valid config; got %v", err)
+	}
+	if _, err := ParseZoneConfig([]byte("compression: zippy\n")); err == nil {
+		t.Error("expected error for unknown compression policy")
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/golang/glog"
+)
+
+// maxRetainedChecksums is the number of computed checksums each
+// replica retains for collection; older checksums are discarded.
+const maxRetainedChecksums = 8
+
+// keyRangeQuarantinePrefix is the prefix for store-local keys marking
+// ranges quarantined by QuarantineReplica. The value's timestamp is
+// the time of quarantine.
+var keyRangeQuarantinePrefix = Key("\x00\x00\x00quarantine-")
+
+// rangeQuarantineKey creates a range quarantine key as the
+// concatenation of the keyRangeQuarantinePrefix and
+// hexadecimal-formatted range ID.
+func rangeQuarantineKey(rangeID int64) Key {
+	return MakeKey(keyRangeQuarantinePrefix, Key(strconv.FormatInt(rangeID, 16)))
+}
+
+// A rangeChecksum is a checksum of a replica's data, as computed on
+// executing the InternalComputeChecksum command with ID id. The
+// checksum is set, unless its computation failed, before done is
+// closed.
+type rangeChecksum struct {
+	id       int64
+	checksum []byte
+	done     chan struct{}
+}
+
+// checksumRows returns a SHA-256 checksum of rows, covering each
+// row's key, value bytes, timestamp and expiration.
+func checksumRows(rows []KeyValue) []byte {
+	h := sha256.New()
+	var buf [8]byte
+	writeBytes := func(b []byte) {
+		binary.BigEndian.PutUint64(buf[:], uint64(len(b)))
+		h.Write(buf[:])
+		h.Write(b)
+	}
+	for _, kv := range rows {
+		writeBytes(kv.Key)
+		writeBytes(kv.Value.Bytes)
+		binary.BigEndian.PutUint64(buf[:], uint64(kv.Value.Timestamp))
+		h.Write(buf[:])
+		binary.BigEndian.PutUint64(buf[:], uint64(kv.Value.Expiration))
+		h.Write(buf[:])
+	}
+	return h.Sum(nil)
+}
+
+// ComputeChecksum proposes an InternalComputeChecksum command to the
+// range's raft group, on whose execution each replica computes a
+// checksum of its data, all at the same point in the log. Returns the
+// ID under which the replicas retain their checksums, for collection
+// via InternalChecksum, and this replica's checksum. Must be invoked
+// on the leader.
+func (r *Range) ComputeChecksum() (int64, []byte, error) {
+	r.raftMu.RLock()
+	self := r.self
+	r.raftMu.RUnlock()
+	args := &InternalComputeChecksumRequest{
+		RequestHeader: RequestHeader{Replica: self},
+		ChecksumID:    time.Now().UnixNano(),
+	}
+	if err := <-r.ReadWriteCmd("InternalComputeChecksum", args, &InternalComputeChecksumResponse{}); err != nil {
+		return 0, nil, err
+	}
+	r.checksumMu.Lock()
+	var c *rangeChecksum
+	for _, rc := range r.checksums {
+		if rc.id == args.ChecksumID {
+			c = rc
+		}
+	}
+	r.checksumMu.Unlock()
+	if c != nil {
+		<-c.done
+	}
+	checksum, ok := r.checksum(args.ChecksumID)
+	if !ok {
+		return 0, nil, util.Errorf("range %d: checksum %d not computed", r.Metadata().RangeID, args.ChecksumID)
+	}
+	return args.ChecksumID, checksum, nil
+}
+
+// InternalComputeChecksum computes a checksum of the replica's
+// replicated data, including its lease, and retains it under
+// args.ChecksumID. Executed as a raft command, so that the checksums
+// of all replicas reflect the same commands. The checksum is computed
+// in the background from an engine snapshot, so that the commands
+// which follow it aren't delayed.
+func (r *Range) InternalComputeChecksum(args *InternalComputeChecksumRequest, reply *InternalComputeChecksumResponse) {
+	snap := r.engine.newSnapshot()
+	c := &rangeChecksum{id: args.ChecksumID, done: make(chan struct{})}
+	r.checksumMu.Lock()
+	r.checksums = append(r.checksums, c)
+	if len(r.checksums) > maxRetainedChecksums {
+		r.checksums = r.checksums[len(r.checksums)-maxRetainedChecksums:]
+	}
+	r.checksumMu.Unlock()
+	go func() {
+		defer close(c.done)
+		defer snap.close()
+		rows, err := r.replicatedRows(snap)
+		if err != nil {
+			glog.Errorf("range %d: unable to compute checksum %d: %v", r.Metadata().RangeID, c.id, err)
+			return
+		}
+		if lease, ok := r.leaseRow(snap); ok {
+			rows = append(rows, lease)
+		}
+		sort.Sort(keyValues(rows))
+		c.checksum = checksumRows(rows)
+	}()
+}
+
+// checksum returns the retained checksum with ID id, if it has been
+// computed.
+func (r *Range) checksum(id int64) ([]byte, bool) {
+	r.checksumMu.Lock()
+	defer r.checksumMu.Unlock()
+	for _, c := range r.checksums {
+		if c.id != id {
+			continue
+		}
+		select {
+		case <-c.done:
+			return c.checksum, c.checksum != nil
+		default:
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// InternalChecksum returns the replica's checksum with ID
+// args.ChecksumID. Fails if the replica hasn't yet executed the
+// InternalComputeChecksum command, in which case the caller should
+// retry, or if it has since discarded the checksum.
+func (r *Range) InternalChecksum(args *InternalChecksumRequest, reply *InternalChecksumResponse) {
+	checksum, ok := r.checksum(args.ChecksumID)
+	if !ok {
+		reply.Error = util.Errorf("range %d: checksum %d is unavailable", r.Metadata().RangeID, args.ChecksumID)
+		return
+	}
+	reply.Checksum = checksum
+}
+
+// ConsistencyCandidates returns the IDs of ranges led by this store
+// which have replicas on other stores, ordered by start key, for
+// checking the consistency of their replicas.
+func (s *Store) ConsistencyCandidates() []int64 {
+	s.mu.Lock()
+	ranges := make([]*Range, 0, len(s.ranges))
+	for _, rng := range s.ranges {
+		ranges = append(ranges, rng)
+	}
+	s.mu.Unlock()
+	sort.Sort(rangesByKey(ranges))
+	var ids []int64
+	for _, rng := range ranges {
+		if meta := rng.Metadata(); rng.IsLeader() && len(meta.Replicas.Replicas) > 1 {
+			ids = append(ids, meta.RangeID)
+		}
+	}
+	return ids
+}
+
+// QuarantineReplica takes the range with the specified ID offline for
+// inspection, as when its data has diverged from that of its other
+// replicas. The range is stopped and removed from the store, leaving
+// its data and metadata in place, and isn't restarted when the store
+// is next initialized. The range's other replicas see the replica as
+// unavailable.
+func (s *Store) QuarantineReplica(rangeID int64) error {
+	s.splitMu.Lock()
+	defer s.splitMu.Unlock()
+	rng, err := s.GetRange(rangeID)
+	if err != nil {
+		return err
+	}
+	if err := s.engine.put(rangeQuarantineKey(rangeID), Value{Bytes: []byte("quarantined"), Timestamp: time.Now().UnixNano()}); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.ranges, rangeID)
+	s.mu.Unlock()
+	rng.Stop()
+	glog.Warningf("range %d quarantined on store %s for inspection", rangeID, s)
+	return nil
+}
+
+// isQuarantined returns whether the range with the specified ID has
+// been quarantined on the store.
+func (s *Store) isQuarantined(rangeID int64) (bool, error) {
+	value, err := s.engine.get(rangeQuarantineKey(rangeID))
+	return value.Bytes != nil, err
+}
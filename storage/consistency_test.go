@@ -0,0 +1,114 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestRangeComputeChecksum verifies checksums are retained for
+// collection and change with the range's data.
+func TestRangeComputeChecksum(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	id1, checksum1, err := r.ComputeChecksum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := &InternalChecksumResponse{}
+	r.InternalChecksum(&InternalChecksumRequest{ChecksumID: id1}, reply)
+	if reply.Error != nil || !bytes.Equal(reply.Checksum, checksum1) {
+		t.Fatalf("expected retained checksum %x; got %x, %v", checksum1, reply.Checksum, reply.Error)
+	}
+	reply = &InternalChecksumResponse{}
+	if r.InternalChecksum(&InternalChecksumRequest{ChecksumID: id1 - 1}, reply); reply.Error == nil {
+		t.Error("expected error collecting checksum which wasn't computed")
+	}
+
+	pr := &PutResponse{}
+	r.Put(&PutRequest{Key: Key("a"), Value: Value{Bytes: []byte("value")}}, pr)
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	_, checksum2, err := r.ComputeChecksum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(checksum1, checksum2) {
+		t.Error("expected checksum to change with the range's data")
+	}
+	_, checksum3, err := r.ComputeChecksum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(checksum2, checksum3) {
+		t.Errorf("expected checksum of unchanged data to be stable; got %x, %x", checksum2, checksum3)
+	}
+}
+
+// TestChecksumRows verifies checksums cover value timestamps and
+// distinguish rows by the boundaries between their keys and values.
+func TestChecksumRows(t *testing.T) {
+	rows := []KeyValue{{Key: Key("ab"), Value: Value{Bytes: []byte("c"), Timestamp: 1}}}
+	for _, other := range [][]KeyValue{
+		{{Key: Key("ab"), Value: Value{Bytes: []byte("c"), Timestamp: 2}}},
+		{{Key: Key("a"), Value: Value{Bytes: []byte("bc"), Timestamp: 1}}},
+		nil,
+	} {
+		if bytes.Equal(checksumRows(rows), checksumRows(other)) {
+			t.Errorf("expected checksums of %+v and %+v to differ", rows, other)
+		}
+	}
+}
+
+// TestStoreQuarantineReplica verifies a quarantined range is removed
+// from its store, with its data left in place, and isn't restarted
+// when the store is next initialized.
+func TestStoreQuarantineReplica(t *testing.T) {
+	engine := NewInMem(1 << 20)
+	store := NewStore(engine, nil)
+	defer store.Close()
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	rng, err := store.CreateRange(KeyMin, KeyMax, []Replica{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr := &PutResponse{}
+	rng.Put(&PutRequest{Key: Key("a"), Value: Value{Bytes: []byte("value")}}, pr)
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	if err := store.QuarantineReplica(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetRange(1); err == nil {
+		t.Error("expected quarantined range to be removed from the store")
+	}
+	if rows, err := store.DebugScan(Key("a"), Key("b"), 0); err != nil || len(rows) != 1 {
+		t.Errorf("expected quarantined range's data to remain; got %+v, %v", rows, err)
+	}
+
+	store = NewStore(engine, nil)
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetRange(1); err == nil {
+		t.Error("expected quarantined range not to be restarted")
+	}
+}
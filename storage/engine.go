@@ -39,10 +39,172 @@ type Engine interface {
 	// start (inclusive) and ending at end (non-inclusive).
 	// Specify max=0 for unbounded scans.
 	scan(start, end Key, max int64) ([]KeyValue, error)
+	// reverseScan is like scan, but returns key/value objects in
+	// descending key order, beginning with the last key before end.
+	reverseScan(start, end Key, max int64) ([]KeyValue, error)
 	// delete removes the item from the db with the given key.
 	del(key Key) error
 	// capacity returns capacity details for the engine's available storage.
 	capacity() (StoreCapacity, error)
+	// writeBatch applies writes in order and atomically: either all
+	// or none are applied, even if the process crashes. Writes are
+	// usually accumulated for it by a Batch.
+	writeBatch(writes []engineWrite) error
+	// newSnapshot returns a read-only view of the engine's data as of
+	// now, unaffected by subsequent writes. It must be closed once no
+	// longer needed.
+	newSnapshot() Snapshot
+	// newIterator returns an iterator over the engine's rows. It must
+	// be closed once no longer needed.
+	newIterator() Iterator
+}
+
+// A Snapshot is a read-only view of an engine's data as of the
+// snapshot's creation. Reads which take a while, such as scans paced
+// by a rate limit or checksums of a range's data, see a consistent
+// view via a snapshot without blocking writes meanwhile. Writes to a
+// snapshot fail.
+type Snapshot interface {
+	Engine
+	// close releases the snapshot.
+	close()
+}
+
+// An Iterator steps through the rows of an engine in key order,
+// forwards or backwards. It must be positioned by a seek before use.
+type Iterator interface {
+	// seek positions the iterator at the first row with a key at or
+	// after key.
+	seek(key Key)
+	// seekToLast positions the iterator at the last row.
+	seekToLast()
+	// valid returns whether the iterator is positioned at a row. It
+	// isn't once stepped beyond the first or last row, or on error.
+	valid() bool
+	// next steps to the following row.
+	next()
+	// prev steps to the preceding row.
+	prev()
+	// key returns the key of the current row.
+	key() Key
+	// value returns the value of the current row.
+	value() (Value, error)
+	// err returns the error encountered by the iterator, if any.
+	err() error
+	// close releases the iterator.
+	close()
+}
+
+// readOnlyError returns the error with which writes to a snapshot
+// fail.
+func readOnlyError() error {
+	return util.ErrorSkipFrames(1, "attempted write to read-only snapshot")
+}
+
+// A nestedSnapshot is a snapshot of a snapshot, which shares its view.
+// Closing it has no effect; the snapshot it was taken of must be
+// closed instead.
+type nestedSnapshot struct {
+	Snapshot
+}
+
+// close does nothing.
+func (nestedSnapshot) close() {}
+
+// iterScan returns up to max rows of it starting from start
+// (inclusive) and ending at end (non-inclusive), or the last row if
+// end is empty. Specify max=0 for unbounded scans.
+func iterScan(it Iterator, start, end Key, max int64) ([]KeyValue, error) {
+	kvs := []KeyValue{}
+	for it.seek(start); it.valid(); it.next() {
+		if max > 0 && int64(len(kvs)) >= max {
+			break
+		}
+		key := it.key()
+		if len(end) > 0 && bytes.Compare(key, end) >= 0 {
+			break
+		}
+		value, err := it.value()
+		if err != nil {
+			return nil, err
+		}
+		kvs = append(kvs, KeyValue{Key: key, Value: value})
+	}
+	if err := it.err(); err != nil {
+		return nil, err
+	}
+	return kvs, nil
+}
+
+// iterReverseScan is like iterScan, but returns rows in descending key
+// order, beginning with the last row before end.
+func iterReverseScan(it Iterator, start, end Key, max int64) ([]KeyValue, error) {
+	// Position the iterator at the last row before end.
+	if len(end) == 0 {
+		it.seekToLast()
+	} else {
+		it.seek(end)
+		if it.valid() {
+			it.prev()
+		} else {
+			it.seekToLast()
+		}
+	}
+	kvs := []KeyValue{}
+	for ; it.valid(); it.prev() {
+		if max > 0 && int64(len(kvs)) >= max {
+			break
+		}
+		key := it.key()
+		if bytes.Compare(key, start) < 0 {
+			break
+		}
+		value, err := it.value()
+		if err != nil {
+			return nil, err
+		}
+		kvs = append(kvs, KeyValue{Key: key, Value: value})
+	}
+	if err := it.err(); err != nil {
+		return nil, err
+	}
+	return kvs, nil
+}
+
+// An engineWrite is a put or deletion applied by Engine.writeBatch.
+type engineWrite struct {
+	key   Key
+	value Value
+	del   bool // Deletes key if set; value is ignored
+}
+
+// encodeEngineValue encodes value for engines which store byte
+// strings: its Timestamp, Expiration and DictVersion as varints,
+// followed by its Bytes.
+func encodeEngineValue(value Value) []byte {
+	encoded := make([]byte, 3*binary.MaxVarintLen64, 3*binary.MaxVarintLen64+len(value.Bytes))
+	n := binary.PutVarint(encoded, value.Timestamp)
+	n += binary.PutVarint(encoded[n:], value.Expiration)
+	n += binary.PutVarint(encoded[n:], int64(value.DictVersion))
+	return append(encoded[:n], value.Bytes...)
+}
+
+// decodeEngineValue decodes a value encoded by encodeEngineValue.
+func decodeEngineValue(encoded []byte) (Value, error) {
+	var fields [3]int64
+	for i := range fields {
+		var n int
+		if fields[i], n = binary.Varint(encoded); n <= 0 {
+			return Value{}, util.Errorf("corrupt stored value %q", encoded)
+		}
+		encoded = encoded[n:]
+	}
+	return Value{
+		Bytes:       encoded,
+		Timestamp:   fields[0],
+		Expiration:  fields[1],
+		DictVersion: int32(fields[2]),
+	}, nil
 }
 
 // putI sets the given key to the gob-serialized byte string of the
@@ -89,29 +251,40 @@ func increment(engine Engine, key Key, inc int64, ts int64) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
+	newVal, r, err := incrementValue(key, val, inc)
+	if err != nil {
+		return 0, err
+	}
+	newVal.Timestamp = ts
+	if err = engine.put(key, newVal); err != nil {
+		return 0, err
+	}
+	return r, nil
+}
+
+// incrementValue decodes val, the varint encoded int64 value at key,
+// or zero if it has none, and returns the value encoding it plus
+// "inc", along with the incremented integer.
+func incrementValue(key Key, val Value, inc int64) (Value, int64, error) {
 	var int64Val int64
 	// If the value exists, attempt to decode it as a varint.
 	if len(val.Bytes) != 0 {
 		var numBytes int
 		int64Val, numBytes = binary.Varint(val.Bytes)
 		if numBytes == 0 {
-			return 0, util.Errorf("key %q cannot be incremented; not varint-encoded", key)
+			return Value{}, 0, util.Errorf("key %q cannot be incremented; not varint-encoded", key)
 		} else if numBytes < 0 {
-			return 0, util.Errorf("key %q cannot be incremented; integer overflow", key)
+			return Value{}, 0, util.Errorf("key %q cannot be incremented; integer overflow", key)
 		}
 	}
 
 	// Check for overflow and underflow.
 	r := int64Val + inc
 	if (r < int64Val) != (inc < 0) {
-		return 0, util.Errorf("key %q with value %d incremented by %d results in overflow", key, int64Val, inc)
+		return Value{}, 0, util.Errorf("key %q with value %d incremented by %d results in overflow", key, int64Val, inc)
 	}
 
 	encoded := make([]byte, binary.MaxVarintLen64)
 	numBytes := binary.PutVarint(encoded, r)
-	encoded = encoded[:numBytes]
-	if err = engine.put(key, Value{Bytes: encoded, Timestamp: ts}); err != nil {
-		return 0, err
-	}
-	return r, nil
+	return Value{Bytes: encoded[:numBytes]}, r, nil
 }
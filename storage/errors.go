@@ -0,0 +1,300 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util/protobuf"
+)
+
+// init registers error types which may be sent in a ResponseHeader,
+// with gob and, by their numbers in the Error message of
+// proto/errors.proto, with protobuf.
+func init() {
+	for num, err := range map[int]error{
+		2:  &GenericError{},
+		3:  &ServerBusyError{},
+		4:  &WriteIntentError{},
+		5:  &WriteTooOldError{},
+		6:  &TxnTooLargeError{},
+		7:  &AppendTooLargeError{},
+		8:  &TransactionAbortedError{},
+		9:  &TransactionPushError{},
+		10: &NotLeaderError{},
+		11: &NotLeaseHolderError{},
+		12: &PermissionDeniedError{},
+		13: &SpanFrozenError{},
+		14: &ReservedKeyError{},
+		15: &RangeSubsumedError{},
+	} {
+		gob.Register(err)
+		protobuf.Register(num, err)
+	}
+}
+
+// A GenericError carries the message of an arbitrary error in a
+// response header. Errors created via fmt or util can't be encoded
+// for transmission via RPC; they must be converted with
+// NewGenericError first. Unlike errors returned from an RPC, errors
+// set in a reply are final and are not retried by clients.
+type GenericError struct {
+	Message string `protobuf:"1"`
+}
+
+// NewGenericError returns a GenericError with the message of err.
+func NewGenericError(err error) *GenericError {
+	return &GenericError{Message: err.Error()}
+}
+
+// Error implements the error interface.
+func (e *GenericError) Error() string {
+	return e.Message
+}
+
+// A ServerBusyError indicates a node declined to execute a request
+// because it's overloaded. The request was not executed and may be
+// retried, preferably after backing off. If RetryAfter is non-zero,
+// it's the node's estimate of when it will have capacity for the
+// request; clients should wait that long rather than backing off.
+type ServerBusyError struct {
+	Message    string        `protobuf:"1"`
+	RetryAfter time.Duration `protobuf:"2"`
+}
+
+// Error implements the error interface.
+func (e *ServerBusyError) Error() string {
+	return e.Message
+}
+
+// CanRetry implements the Retryable interface.
+func (e *ServerBusyError) CanRetry() bool { return true }
+
+// A WriteIntentError indicates a key couldn't be read or written
+// because another transaction has a write intent on it, which must be
+// resolved first.
+type WriteIntentError struct {
+	Key         Key    `protobuf:"1"`
+	TxnID       string `protobuf:"2"`
+	TxnPriority int32  `protobuf:"3"` // The priority of the intent's transaction
+	Timestamp   int64  `protobuf:"4"` // The timestamp of the intent
+}
+
+// Error implements the error interface.
+func (e *WriteIntentError) Error() string {
+	return fmt.Sprintf("key %q has a write intent of transaction %q", e.Key, e.TxnID)
+}
+
+// A WriteTooOldError indicates a write to a key at Timestamp was
+// refused because a newer version exists, written at
+// ExistingTimestamp.
+type WriteTooOldError struct {
+	Key               Key   `protobuf:"1"`
+	Timestamp         int64 `protobuf:"2"`
+	ExistingTimestamp int64 `protobuf:"3"`
+}
+
+// Error implements the error interface.
+func (e *WriteTooOldError) Error() string {
+	return fmt.Sprintf("write of key %q at %d precedes existing version at %d", e.Key, e.Timestamp, e.ExistingTimestamp)
+}
+
+// A TransactionAbortedError indicates a transaction couldn't commit
+// because it was aborted, typically by a conflicting transaction of
+// higher priority which pushed it; see InternalPushTxn.
+type TransactionAbortedError struct {
+	TxID string `protobuf:"1"`
+}
+
+// Error implements the error interface.
+func (e *TransactionAbortedError) Error() string {
+	return fmt.Sprintf("transaction %q was aborted", e.TxID)
+}
+
+// A TransactionPushError indicates a push of the transaction PusheeTxID
+// failed because it's pending and has at least the priority of the
+// pusher, which must wait for it to end. It's retryable, so pushes are
+// retried with backoff until the pushee commits or aborts.
+type TransactionPushError struct {
+	PusheeTxID     string `protobuf:"1"`
+	PusheePriority int32  `protobuf:"2"`
+}
+
+// Error implements the error interface.
+func (e *TransactionPushError) Error() string {
+	return fmt.Sprintf("failed to push transaction %q of priority %d", e.PusheeTxID, e.PusheePriority)
+}
+
+// CanRetry implements the Retryable interface.
+func (e *TransactionPushError) CanRetry() bool { return true }
+
+// A TxnTooLargeError indicates a write was refused because it would
+// take its transaction past MaxTxnKeys or MaxTxnBytes. Keys and Bytes
+// are the transaction's writes including the refused one.
+type TxnTooLargeError struct {
+	TxID  string `protobuf:"1"`
+	Keys  int    `protobuf:"2"`
+	Bytes int64  `protobuf:"3"`
+}
+
+// Error implements the error interface.
+func (e *TxnTooLargeError) Error() string {
+	return fmt.Sprintf("transaction %q too large: %d keys (max %d), %d bytes (max %d)",
+		e.TxID, e.Keys, MaxTxnKeys, e.Bytes, MaxTxnBytes)
+}
+
+// An AppendTooLargeError indicates an append was refused because it
+// would take the value of Key to Length bytes, beyond the request's
+// MaxLength. The value was not changed.
+type AppendTooLargeError struct {
+	Key       Key   `protobuf:"1"`
+	Length    int64 `protobuf:"2"`
+	MaxLength int64 `protobuf:"3"`
+}
+
+// Error implements the error interface.
+func (e *AppendTooLargeError) Error() string {
+	return fmt.Sprintf("append to key %q refused: value would be %d bytes (max %d)", e.Key, e.Length, e.MaxLength)
+}
+
+// A NotLeaderError indicates a request was sent to a replica which
+// isn't the raft leader of its range. The request was not executed.
+// Leader is set if the replica knows the current leader, in which
+// case the request should be redirected to it; otherwise, an election
+// is underway and the request may be retried after backing off.
+type NotLeaderError struct {
+	Replica Replica  `protobuf:"1"` // The replica which received the request
+	Leader  *Replica `protobuf:"2"` // The current leader, if known
+}
+
+// Error implements the error interface.
+func (e *NotLeaderError) Error() string {
+	if e.Leader == nil {
+		return fmt.Sprintf("range %d replica on node %d is not the leader; leader unknown",
+			e.Replica.RangeID, e.Replica.NodeID)
+	}
+	return fmt.Sprintf("range %d replica on node %d is not the leader; leader is on node %d",
+		e.Replica.RangeID, e.Replica.NodeID, e.Leader.NodeID)
+}
+
+// CanRetry implements the Retryable interface.
+func (e *NotLeaderError) CanRetry() bool {
+	return true
+}
+
+// A NotLeaseHolderError indicates a request was sent to a replica
+// which doesn't hold its range's lease while another replica does.
+// The request was not executed and should be redirected to the lease
+// holder.
+type NotLeaseHolderError struct {
+	Replica     Replica  `protobuf:"1"` // The replica which received the request
+	LeaseHolder *Replica `protobuf:"2"` // The replica holding the lease
+}
+
+// Error implements the error interface.
+func (e *NotLeaseHolderError) Error() string {
+	return fmt.Sprintf("range %d replica on node %d does not hold the lease; lease holder is on node %d",
+		e.Replica.RangeID, e.Replica.NodeID, e.LeaseHolder.NodeID)
+}
+
+// CanRetry implements the Retryable interface.
+func (e *NotLeaseHolderError) CanRetry() bool {
+	return true
+}
+
+// A PermissionDeniedError indicates a request was refused because the
+// permission config of the key prefix Prefix doesn't grant User the
+// access it required to Key: write access if Write is set and read
+// access otherwise. The request was not executed.
+type PermissionDeniedError struct {
+	User   string `protobuf:"1"`
+	Method string `protobuf:"2"`
+	Key    Key    `protobuf:"3"`
+	Prefix Key    `protobuf:"4"`
+	Write  bool   `protobuf:"5"`
+}
+
+// Error implements the error interface.
+func (e *PermissionDeniedError) Error() string {
+	access := "read"
+	if e.Write {
+		access = "write"
+	}
+	return fmt.Sprintf("user %q has no %s permission for %s of key %q under prefix %q",
+		e.User, access, e.Method, e.Key, e.Prefix)
+}
+
+// A SpanFrozenError indicates a request was refused because it
+// accesses Key, which lies within the span [StartKey, EndKey) frozen
+// for Reason until Expiration; see FreezeConfig. Write is set if the
+// request was refused as a write to a span frozen only for writes.
+// The request was not executed; it may be retried once the freeze is
+// lifted.
+type SpanFrozenError struct {
+	Method     string `protobuf:"1"`
+	Key        Key    `protobuf:"2"`
+	StartKey   Key    `protobuf:"3"`
+	EndKey     Key    `protobuf:"4"`
+	Reason     string `protobuf:"5"`
+	Expiration int64  `protobuf:"6"`
+	Write      bool   `protobuf:"7"`
+}
+
+// Error implements the error interface.
+func (e *SpanFrozenError) Error() string {
+	access := "access"
+	if e.Write {
+		access = "writes"
+	}
+	return fmt.Sprintf("%s of key %q refused: span [%q, %q) frozen to %s until %s: %s", e.Method, e.Key,
+		e.StartKey, e.EndKey, access, time.Unix(0, e.Expiration).UTC().Format(time.RFC3339), e.Reason)
+}
+
+// A ReservedKeyError indicates a write was refused because it accesses
+// Key, which lies within the reserved key prefix Prefix, and wasn't
+// flagged as internal; see RequestHeader.Internal. The request was not
+// executed.
+type ReservedKeyError struct {
+	Method string `protobuf:"1"`
+	Key    Key    `protobuf:"2"`
+	Prefix Key    `protobuf:"3"`
+}
+
+// Error implements the error interface.
+func (e *ReservedKeyError) Error() string {
+	return fmt.Sprintf("%s of key %q refused: keys under prefix %q are reserved for internal use", e.Method, e.Key, e.Prefix)
+}
+
+// A RangeSubsumedError indicates a read-write command was refused
+// because its range has been subsumed by a merge with the range
+// preceding it. The command was not executed; it may be retried
+// against the merged range once the range addressing records reflect
+// the merge.
+type RangeSubsumedError struct {
+	Replica Replica `protobuf:"1"` // The replica which refused the command
+}
+
+// Error implements the error interface.
+func (e *RangeSubsumedError) Error() string {
+	return fmt.Sprintf("range %d replica on node %d has been subsumed by a merge", e.Replica.RangeID, e.Replica.NodeID)
+}
+
+// CanRetry implements the Retryable interface.
+func (e *RangeSubsumedError) CanRetry() bool {
+	return true
+}
@@ -0,0 +1,90 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"sync"
+)
+
+// defaultFeedSize is the number of change events retained by a
+// range's event feed for watchers to catch up on.
+const defaultFeedSize = 1024
+
+// An eventFeed retains the most recent change events written to a
+// range, each assigned a sequence number one greater than the last.
+// Watchers poll the feed for events following the last sequence
+// number they've seen.
+type eventFeed struct {
+	sync.Mutex
+	events []ChangeEvent // Ring buffer of retained events
+	next   int           // Index in events of the next event
+	seq    int64         // Sequence number of the most recent event
+	notify chan struct{} // Closed when an event is published
+}
+
+// newEventFeed returns a feed retaining up to size events.
+func newEventFeed(size int) *eventFeed {
+	return &eventFeed{
+		events: make([]ChangeEvent, 0, size),
+		notify: make(chan struct{}),
+	}
+}
+
+// publish assigns ev the next sequence number, retains it and wakes
+// any waiting watchers.
+func (f *eventFeed) publish(ev ChangeEvent) {
+	f.Lock()
+	defer f.Unlock()
+	f.seq++
+	ev.Seq = f.seq
+	if len(f.events) < cap(f.events) {
+		f.events = append(f.events, ev)
+	} else {
+		f.events[f.next] = ev
+	}
+	f.next = (f.next + 1) % cap(f.events)
+	close(f.notify)
+	f.notify = make(chan struct{})
+}
+
+// latest returns the sequence number of the most recent event.
+func (f *eventFeed) latest() int64 {
+	f.Lock()
+	defer f.Unlock()
+	return f.seq
+}
+
+// since returns retained events following seq with keys in the span
+// [start, end), in sequence order, along with the most recent
+// sequence number. truncated is true if events following seq are no
+// longer retained. The returned channel is closed when the next event
+// is published.
+func (f *eventFeed) since(seq int64, start, end Key) (events []ChangeEvent, latest int64, truncated bool, notify <-chan struct{}) {
+	f.Lock()
+	defer f.Unlock()
+	oldest := f.seq - int64(len(f.events)) + 1
+	if seq+1 < oldest {
+		return nil, f.seq, true, f.notify
+	}
+	for i := seq + 1; i <= f.seq; i++ {
+		ev := f.events[(f.next+len(f.events)-int(f.seq-i)-1)%len(f.events)]
+		if bytes.Compare(ev.Key, start) >= 0 && bytes.Compare(ev.Key, end) < 0 {
+			events = append(events, ev)
+		}
+	}
+	return events, f.seq, false, f.notify
+}
@@ -0,0 +1,76 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+// TestEventFeed verifies events are returned in sequence order,
+// filtered by span, and that dropped events are reported.
+func TestEventFeed(t *testing.T) {
+	f := newEventFeed(3)
+	for _, key := range []string{"a", "b", "c"} {
+		f.publish(ChangeEvent{Key: Key(key)})
+	}
+	events, latest, truncated, _ := f.since(0, Key("b"), KeyMax)
+	if len(events) != 2 || string(events[0].Key) != "b" || events[1].Seq != 3 || latest != 3 || truncated {
+		t.Errorf("unexpected events %+v (latest %d, truncated %t)", events, latest, truncated)
+	}
+	// Overwrite the oldest event.
+	f.publish(ChangeEvent{Key: Key("d")})
+	if _, _, truncated, _ := f.since(0, KeyMin, KeyMax); !truncated {
+		t.Error("expected events following 0 to be truncated")
+	}
+	events, latest, truncated, notify := f.since(1, KeyMin, KeyMax)
+	if len(events) != 3 || string(events[2].Key) != "d" || latest != 4 || truncated {
+		t.Errorf("unexpected events %+v (latest %d, truncated %t)", events, latest, truncated)
+	}
+	f.publish(ChangeEvent{Key: Key("e")})
+	select {
+	case <-notify:
+	default:
+		t.Error("expected notification of publish")
+	}
+}
+
+// TestRangeInternalWatch verifies InternalWatch waits for and returns
+// writes to the watched span.
+func TestRangeInternalWatch(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+
+	reply := &InternalWatchResponse{}
+	r.InternalWatch(&InternalWatchRequest{StartKey: Key("a"), EndKey: Key("b"), Seq: -1}, reply)
+	go func() {
+		for _, key := range []string{"c", "a1"} {
+			pArgs := &PutRequest{Key: Key(key), Value: Value{Bytes: []byte("v")}}
+			if err := <-r.ReadWriteCmd("Put", pArgs, &PutResponse{}); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	args := &InternalWatchRequest{StartKey: Key("a"), EndKey: Key("b"), Seq: reply.Seq, MaxWait: int64(time.Second)}
+	reply = &InternalWatchResponse{}
+	r.InternalWatch(args, reply)
+	if len(reply.Events) != 1 || string(reply.Events[0].Key) != "a1" || reply.Events[0].Op != ChangePut {
+		t.Errorf("expected put of a1; got %+v", reply.Events)
+	}
+	if reply.RangeID != r.Metadata().RangeID || string(reply.EndKey) != string(KeyMax) {
+		t.Errorf("unexpected range in reply %+v", reply)
+	}
+}
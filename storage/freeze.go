@@ -0,0 +1,86 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/golang/glog"
+)
+
+// loadFreezeConfigs sets the freeze configs against which requests
+// are checked. Configs are read directly if they fall within the
+// range; otherwise, the gossiped configs are used, if available.
+func (r *Range) loadFreezeConfigs() {
+	configs, err := r.configsFor(KeyConfigFreezePrefix, gossip.KeyConfigFreeze, FreezeConfig{})
+	if err != nil {
+		glog.Errorf("failed loading freeze configs: %v", err)
+		return
+	}
+	r.policyMu.Lock()
+	defer r.policyMu.Unlock()
+	r.freezes = configs
+}
+
+// CheckFreeze returns a SpanFrozenError if the request args accesses
+// a key within a span frozen by a freeze config which hasn't expired:
+// for read-write commands, any freeze, and otherwise, those which
+// also freeze reads. Range lookups are exempt, as are the freeze
+// configs themselves, so that freezes may always be lifted.
+func (r *Range) CheckFreeze(method string, args interface{}, write bool) error {
+	if method == "InternalRangeLookup" {
+		return nil
+	}
+	r.policyMu.RLock()
+	freezes := r.freezes
+	r.policyMu.RUnlock()
+	if len(freezes) == 0 {
+		return nil
+	}
+	now := time.Now().UnixNano()
+	for _, span := range requestSpans(args) {
+		if bytes.HasPrefix(span.start, KeyConfigFreezePrefix) {
+			continue
+		}
+		for _, pc := range freezes {
+			freeze := pc.Config.(*FreezeConfig)
+			if freeze.Expiration <= now || (!write && !freeze.Reads) || !span.overlaps(pc.Prefix, freeze.EndKey) {
+				continue
+			}
+			return &SpanFrozenError{
+				Method:     method,
+				Key:        span.start,
+				StartKey:   pc.Prefix,
+				EndKey:     freeze.EndKey,
+				Reason:     freeze.Reason,
+				Expiration: freeze.Expiration,
+				Write:      !freeze.Reads,
+			}
+		}
+	}
+	return nil
+}
+
+// overlaps returns whether the span accesses a key within [start,
+// end).
+func (ks keySpan) overlaps(start, end Key) bool {
+	if ks.end == nil {
+		return bytes.Compare(start, ks.start) <= 0 && bytes.Compare(ks.start, end) < 0
+	}
+	return bytes.Compare(ks.start, end) < 0 && bytes.Compare(start, ks.end) < 0
+}
@@ -0,0 +1,70 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+	"time"
+)
+
+// TestRangeCheckFreeze verifies requests accessing frozen spans are
+// refused until their freezes expire, and that reads are refused only
+// by freezes of reads.
+func TestRangeCheckFreeze(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	now := time.Now().UnixNano()
+	for start, config := range map[string]FreezeConfig{
+		"b": {EndKey: Key("d"), Reason: "migration", Expiration: now + int64(time.Hour)},
+		"m": {EndKey: Key("n"), Reads: true, Reason: "forensics", Expiration: now + int64(time.Hour)},
+		"x": {EndKey: Key("z"), Reason: "expired", Expiration: now - 1},
+	} {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(config); err != nil {
+			t.Fatal(err)
+		}
+		reply := &PutResponse{}
+		r.Put(&PutRequest{Key: MakeKey(KeyConfigFreezePrefix, Key(start)), Value: Value{Bytes: buf.Bytes()}}, reply)
+		if reply.Error != nil {
+			t.Fatal(reply.Error)
+		}
+	}
+
+	testCases := []struct {
+		method    string
+		args      interface{}
+		write     bool
+		expFrozen bool
+	}{
+		{"Put", &PutRequest{Key: Key("b")}, true, true},
+		{"Put", &PutRequest{Key: Key("c\xff")}, true, true},
+		{"Put", &PutRequest{Key: Key("d")}, true, false},
+		{"Get", &GetRequest{Key: Key("c")}, false, false},
+		{"Scan", &ScanRequest{StartKey: Key("l"), EndKey: Key("m\x00")}, false, true},
+		{"Scan", &ScanRequest{StartKey: Key("k"), EndKey: Key("m")}, false, false},
+		{"Put", &PutRequest{Key: Key("y")}, true, false},
+		{"Delete", &DeleteRequest{Key: MakeKey(KeyConfigFreezePrefix, Key("b"))}, true, false},
+		{"InternalRangeLookup", &InternalRangeLookupRequest{Key: Key("m")}, false, false},
+	}
+	for i, test := range testCases {
+		err := r.CheckFreeze(test.method, test.args, test.write)
+		if _, frozen := err.(*SpanFrozenError); frozen != test.expFrozen || (err != nil && !frozen) {
+			t.Errorf("%d: expected frozen %t; got %v", i, test.expFrozen, err)
+		}
+	}
+}
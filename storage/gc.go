@@ -0,0 +1,419 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// gcInterval is the minimum interval between the garbage
+	// collection passes of a range.
+	gcInterval = 10 * time.Minute
+	// gcBatchSize is the number of rows scanned at a time during
+	// garbage collection.
+	gcBatchSize = 1000
+	// defaultGCTTL is the age beyond which superseded MVCC versions
+	// are collected in zones which don't specify a GC TTL.
+	defaultGCTTL = 24 * time.Hour
+	// intentAbandonAge is the age beyond which a write intent is
+	// considered abandoned by its transaction, which is aborted when
+	// pushed unless it has ended; see InternalPushTxn and
+	// AbandonedIntents.
+	intentAbandonAge = 1 * time.Hour
+)
+
+// gcMaxRowsPerPass is the number of rows a garbage collection pass
+// scans before yielding. The pass records where it stopped and is
+// resumed by the range's next pass. Var for testing.
+var gcMaxRowsPerPass = 100000
+
+// keyRangeGCPrefix is the prefix for store-local keys recording the
+// garbage collection progress of ranges. The value is a struct of
+// type GCMetadata.
+var keyRangeGCPrefix = Key("\x00\x00\x00gc-")
+
+// rangeGCKey creates a range GC key as the concatenation of the
+// keyRangeGCPrefix and hexadecimal-formatted range ID.
+func rangeGCKey(rangeID int64) Key {
+	return MakeKey(keyRangeGCPrefix, Key(strconv.FormatInt(rangeID, 16)))
+}
+
+// GCMetadata records the progress of a range's garbage collection.
+// A pass scans the range in key order, possibly over several calls
+// to Range.GarbageCollect; counts are of the data removed by the
+// current pass or, once it completes, the last complete pass.
+type GCMetadata struct {
+	LastGC            int64 // Time at which the last complete pass ended
+	ResumeKey         Key   // Key at which an incomplete pass resumes
+	ValuesExpired     int64 // Values deleted by expiration or TTL
+	VersionsCollected int64 // Superseded MVCC versions deleted
+	TSBlocksPruned    int64 // Time series blocks past their retention
+	ResponsesPruned   int64 // Response cache replies past responseCacheTTL
+	TxnsPruned        int64 // Records of long-ended transactions
+	RowsCompacted     int64 // Rows hidden by range tombstones deleted
+}
+
+// rowsRemoved returns the number of rows the pass has deleted.
+func (gc GCMetadata) rowsRemoved() int64 {
+	return gc.ValuesExpired + gc.VersionsCollected + gc.TSBlocksPruned + gc.ResponsesPruned + gc.TxnsPruned + gc.RowsCompacted
+}
+
+// newTTLConfigs returns a prefix config map of TTL configs, or nil if
+// there are none.
+func newTTLConfigs(configs []*prefixConfig) (*prefixConfigMap, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+	// The prefix config map requires a default; values without a
+	// configured TTL don't expire. Copy configs, which may be shared
+	// with gossip, as newPrefixConfigMap sorts and appends to them.
+	configs = append([]*prefixConfig(nil), configs...)
+	hasDefault := false
+	for _, pc := range configs {
+		hasDefault = hasDefault || len(pc.Prefix) == 0
+	}
+	if !hasDefault {
+		configs = append(configs, &prefixConfig{Prefix: KeyMin, Config: &TTLConfig{}})
+	}
+	return newPrefixConfigMap(configs)
+}
+
+// ttl returns the TTL configured for the span containing key, or zero
+// if values at key don't expire, and whether reads extend the
+// lifetime of values. System keys never expire.
+func (r *Range) ttl(key Key) (time.Duration, bool) {
+	if bytes.HasPrefix(key, KeySystemPrefix) {
+		return 0, false
+	}
+	r.policyMu.RLock()
+	ttls := r.ttls
+	r.policyMu.RUnlock()
+	if ttls == nil {
+		return 0, false
+	}
+	config := ttls.matchByPrefix(key).Config.(*TTLConfig)
+	ttl := time.Duration(config.TTLSeconds) * time.Second
+	return ttl, ttl > 0 && config.Sliding
+}
+
+// stampTTL returns value with its timestamp set to the current time
+// if it has none and is written to a span with a TTL, so that its
+// lifetime can be determined.
+func (r *Range) stampTTL(key Key, value Value) Value {
+	if ttl, _ := r.ttl(key); value.Timestamp == 0 && ttl > 0 {
+		value.Timestamp = time.Now().UnixNano()
+	}
+	return value
+}
+
+// expired returns whether value, stored in a span with the specified
+// TTL, had expired at now, either by its own expiration or the TTL.
+// If the TTL is sliding, the value instead expires at the later of
+// the two.
+func expired(value Value, ttl time.Duration, sliding bool, now int64) bool {
+	if sliding && value.Timestamp > 0 {
+		return slidingExpiration(value, ttl) <= now
+	}
+	if value.Expiration > 0 && value.Expiration <= now {
+		return true
+	}
+	return ttl > 0 && value.Timestamp > 0 && value.Timestamp+int64(ttl) <= now
+}
+
+// slidingExpiration returns the time at which value, stored in a span
+// with a sliding TTL, expires: ttl after it was written or, if later,
+// its Expiration, which is extended as it's read.
+func slidingExpiration(value Value, ttl time.Duration) int64 {
+	if deadline := value.Timestamp + int64(ttl); deadline > value.Expiration {
+		return deadline
+	}
+	return value.Expiration
+}
+
+// slidingTouchDivisor limits reads of values with sliding TTLs to
+// extending their lifetimes once per this fraction of the TTL.
+const slidingTouchDivisor = 10
+
+// maybeTouch extends the lifetime of value, just read at key, if the
+// key's span has a sliding TTL and a tenth of the TTL has passed
+// since its lifetime was last extended. The extension is proposed as
+// an InternalTouch command in the background, so that the read isn't
+// delayed; at most one is outstanding per key. Expired values aren't
+// revived.
+func (r *Range) maybeTouch(key Key, value Value) {
+	ttl, sliding := r.ttl(key)
+	// Followers serving quorum reads leave extending lifetimes to the
+	// leader.
+	if !sliding || value.Bytes == nil || value.Timestamp == 0 || !r.IsLeader() {
+		return
+	}
+	now := time.Now().UnixNano()
+	deadline := slidingExpiration(value, ttl)
+	if deadline <= now || now-(deadline-int64(ttl)) < int64(ttl)/slidingTouchDivisor {
+		return
+	}
+	r.touchMu.Lock()
+	defer r.touchMu.Unlock()
+	if _, ok := r.touching[string(key)]; ok {
+		return
+	}
+	r.touching[string(key)] = struct{}{}
+	r.raftMu.RLock()
+	self := r.self
+	r.raftMu.RUnlock()
+	args := &InternalTouchRequest{
+		RequestHeader: RequestHeader{Replica: self},
+		Key:           key,
+		Expiration:    now + int64(ttl),
+	}
+	go func() {
+		if err := <-r.ReadWriteCmd("InternalTouch", args, &InternalTouchResponse{}); err != nil {
+			glog.V(1).Infof("range %d: failed to extend lifetime of %q: %v", r.Metadata().RangeID, key, err)
+		}
+		r.touchMu.Lock()
+		defer r.touchMu.Unlock()
+		delete(r.touching, string(key))
+	}()
+}
+
+// gcTTL returns the age beyond which superseded MVCC versions of key
+// are collected, according to the GC TTL of its zone.
+func (r *Range) gcTTL(key Key) time.Duration {
+	r.policyMu.RLock()
+	zones := r.zones
+	r.policyMu.RUnlock()
+	if zones != nil {
+		if secs := zones.matchByPrefix(key).Config.(*ZoneConfig).GCTTLSeconds; secs > 0 {
+			return time.Duration(secs) * time.Second
+		}
+	}
+	return defaultGCTTL
+}
+
+// GCMetadata returns the garbage collection progress of the range.
+func (r *Range) GCMetadata() (GCMetadata, error) {
+	var gc GCMetadata
+	_, _, err := getI(r.engine, rangeGCKey(r.Metadata().RangeID), &gc)
+	return gc, err
+}
+
+// GarbageCollect runs a garbage collection pass over the range at
+// now, the time in nanoseconds since the epoch, resuming the previous
+// pass if it was incomplete. The pass deletes values which have
+// expired, either at their Expiration or once the TTL of their span
+// has elapsed since they were written; collects MVCC versions which
+// were superseded more than their zone's GC TTL before now, but not
+// those of keys with write intents, whose outcome is unknown until
+// resolved; see AbandonedIntents. Values remain readable until
+// collected. System keys are never collected, except
+// that time series blocks past their resolution's retention, response
+// cache replies past responseCacheTTL and the records of transactions
+// which ended more than intentAbandonAge ago are pruned on each call;
+// see pruneTxnRecords.
+//
+// Rows hidden by range tombstones are deleted before the range is
+// scanned. A pass yields after scanning gcMaxRowsPerPass rows, or
+// reading as many while deleting hidden rows, so that ranges with
+// much dead data are collected over several passes rather than
+// rescanned from the start. Progress is recorded in the range's
+// GCMetadata, which is returned. The rows each call removes count
+// towards the range's compaction hint; see Store.CompactHinted.
+func (r *Range) GarbageCollect(now int64) (GCMetadata, error) {
+	meta := r.Metadata()
+	gc, err := r.GCMetadata()
+	if err != nil {
+		return gc, err
+	}
+	start := gc.ResumeKey
+	if start == nil {
+		gc = GCMetadata{LastGC: gc.LastGC}
+		start = meta.StartKey
+	}
+	if userStart := PrefixEndKey(KeySystemPrefix); bytes.Compare(start, userStart) < 0 {
+		start = userStart
+	}
+	gc.ResumeKey = nil
+	// The rows this call removes are hinted for compaction.
+	removed := gc.rowsRemoved()
+	defer func() { r.hintCompaction(meta.StartKey, meta.EndKey, gc.rowsRemoved()-removed) }()
+	pruned, err := r.pruneTimeSeries(now)
+	gc.TSBlocksPruned += pruned
+	if err != nil {
+		return gc, err
+	}
+	pruned, err = r.pruneResponseCache(now)
+	gc.ResponsesPruned += pruned
+	if err != nil {
+		return gc, err
+	}
+	pruned, err = r.pruneTxnRecords(now)
+	gc.TxnsPruned += pruned
+	if err != nil {
+		return gc, err
+	}
+	compacted, done, err := r.compactTombstones(meta.StartKey, meta.EndKey, int64(gcMaxRowsPerPass))
+	gc.RowsCompacted += compacted
+	if err != nil {
+		return gc, err
+	}
+	if !done {
+		gc.ResumeKey = start
+		return gc, putI(r.engine, rangeGCKey(meta.RangeID), &gc)
+	}
+	for scanned := 0; bytes.Compare(start, meta.EndKey) < 0; {
+		if scanned >= gcMaxRowsPerPass {
+			gc.ResumeKey = start
+			break
+		}
+		max := gcMaxRowsPerPass - scanned
+		if max > gcBatchSize {
+			max = gcBatchSize
+		}
+		kvs, err := r.engine.scan(start, meta.EndKey, int64(max))
+		if err != nil {
+			return gc, err
+		}
+		for _, kv := range kvs {
+			if err := r.gcRow(kv, now, &gc); err != nil {
+				return gc, err
+			}
+		}
+		// The versions of the keys up to the last row scanned are
+		// collected along with the rows.
+		end := meta.EndKey
+		if len(kvs) == max {
+			end = MakeKey(kvs[len(kvs)-1].Key, Key{0})
+		}
+		versioned, err := r.gcVersionedKeys(start, end, now, &gc)
+		if err != nil {
+			return gc, err
+		}
+		scanned += len(kvs) + versioned
+		if len(kvs) < max {
+			break
+		}
+		start = end
+	}
+	if gc.ResumeKey == nil {
+		gc.LastGC = now
+	}
+	return gc, putI(r.engine, rangeGCKey(meta.RangeID), &gc)
+}
+
+// gcRow garbage collects the plain row kv at now, adding what it
+// removed to gc: the value is deleted if expired.
+func (r *Range) gcRow(kv KeyValue, now int64, gc *GCMetadata) error {
+	if ttl, sliding := r.ttl(kv.Key); !expired(kv.Value, ttl, sliding, now) {
+		return nil
+	}
+	ok, err := r.deleteExpired(kv.Key, now)
+	if ok {
+		gc.ValuesExpired++
+	}
+	return err
+}
+
+// gcVersionedKeys garbage collects the MVCC versions of the keys in
+// [start, end) at now, adding what it removed to gc. Returns the
+// number of keys visited, which count towards the rows scanned by the
+// pass.
+func (r *Range) gcVersionedKeys(start, end Key, now int64, gc *GCMetadata) (int, error) {
+	var scanned int
+	cursor, endKey := mvccMetadataKey(start), mvccSpanEnd(end)
+	for {
+		// Each key's rows are skipped once its first is read.
+		kvs, err := r.engine.scan(cursor, endKey, 1)
+		if err != nil || len(kvs) == 0 {
+			return scanned, err
+		}
+		key, _, err := mvccDecodeKey(kvs[0].Key)
+		if err != nil {
+			return scanned, err
+		}
+		if err := r.gcVersions(key, now, gc); err != nil {
+			return scanned, err
+		}
+		scanned++
+		cursor = mvccVersionsEnd(key)
+	}
+}
+
+// gcVersions collects the versions of key superseded before its GC
+// threshold. Writes are excluded meanwhile.
+func (r *Range) gcVersions(key Key, now int64, gc *GCMetadata) error {
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+	r.usageMu.Lock()
+	defer r.usageMu.Unlock()
+	b := NewBatch(r.engine)
+	n, err := NewMVCC(b).garbageCollect(key, now-int64(r.gcTTL(key)))
+	if err != nil {
+		return err
+	}
+	if err := r.commitBatch(b); err != nil {
+		return err
+	}
+	gc.VersionsCollected += int64(n)
+	return nil
+}
+
+// AbandonedIntents returns the write intents in the range older than
+// intentAbandonAge at now. Their transactions may have ended without
+// resolving them, or been abandoned by their clients; the node pushes
+// each, aborting those still pending, and resolves the intents
+// according to the outcomes recorded. See Node.garbageCollectRanges.
+func (r *Range) AbandonedIntents(now int64) ([]IntentInfo, error) {
+	meta := r.Metadata()
+	var intents []IntentInfo
+	err := visitIntents(r.engine, meta.StartKey, meta.EndKey, func(key Key, meta MVCCMetadata) error {
+		if meta.Timestamp+int64(intentAbandonAge) <= now {
+			intents = append(intents, meta.intentInfo(key))
+		}
+		return nil
+	})
+	return intents, err
+}
+
+// deleteExpired deletes the value at key if it had expired at now.
+// The value is re-read while writes are excluded, as it may have been
+// overwritten since it was scanned. Returns whether it was deleted.
+func (r *Range) deleteExpired(key Key, now int64) (bool, error) {
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+	r.usageMu.Lock()
+	defer r.usageMu.Unlock()
+	value, err := r.engine.get(key)
+	if err != nil || value.Bytes == nil {
+		return false, err
+	}
+	if ttl, sliding := r.ttl(key); !expired(value, ttl, sliding, now) {
+		return false, nil
+	}
+	b := NewBatch(r.engine)
+	if err := b.del(key); err != nil {
+		return false, err
+	}
+	if err := r.commitBatch(b); err != nil {
+		return false, err
+	}
+	r.publishWrite(key, value, nil)
+	return true, nil
+}
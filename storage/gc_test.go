@@ -0,0 +1,269 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// TestRangeGarbageCollect verifies values expire according to the
+// TTL of their span or their own expiration, and that system keys
+// and values in spans without a TTL are retained.
+func TestRangeGarbageCollect(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	for prefix, ttl := range map[string]int64{"logs/": 60, "logs/keep/": 0} {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(TTLConfig{TTLSeconds: ttl}); err != nil {
+			t.Fatal(err)
+		}
+		reply := &PutResponse{}
+		r.Put(&PutRequest{Key: MakeKey(KeyConfigTTLPrefix, Key(prefix)), Value: Value{Bytes: buf.Bytes()}}, reply)
+		if reply.Error != nil {
+			t.Fatal(reply.Error)
+		}
+	}
+	now := time.Now().UnixNano()
+	values := map[string]Value{
+		"logs/1":      {Bytes: []byte("a")},
+		"logs/keep/1": {Bytes: []byte("b")},
+		"other":       {Bytes: []byte("c")},
+		"expiring":    {Bytes: []byte("d"), Expiration: now + int64(30*time.Second)},
+	}
+	for key, value := range values {
+		reply := &PutResponse{}
+		r.Put(&PutRequest{Key: Key(key), Value: value}, reply)
+		if reply.Error != nil {
+			t.Fatal(reply.Error)
+		}
+	}
+
+	testCases := []struct {
+		now      int64
+		expDel   int
+		expGone  []string
+		expExist []string
+	}{
+		{now, 0, nil, []string{"logs/1", "expiring"}},
+		{now + int64(45*time.Second), 1, []string{"expiring"}, []string{"logs/1"}},
+		{now + int64(2*time.Minute), 1, []string{"logs/1"}, []string{"logs/keep/1", "other"}},
+	}
+	for i, test := range testCases {
+		gc, err := r.GarbageCollect(test.now)
+		if err != nil || gc.ValuesExpired != int64(test.expDel) {
+			t.Errorf("%d: expected %d values collected; got %d, %v", i, test.expDel, gc.ValuesExpired, err)
+		}
+		for _, key := range test.expGone {
+			if v, _ := r.engine.get(Key(key)); v.Bytes != nil {
+				t.Errorf("%d: expected %q collected", i, key)
+			}
+		}
+		for _, key := range test.expExist {
+			if v, _ := r.engine.get(Key(key)); v.Bytes == nil {
+				t.Errorf("%d: expected %q retained", i, key)
+			}
+		}
+	}
+	// TTL configs and other system keys are never collected.
+	if v, _ := r.engine.get(MakeKey(KeyConfigTTLPrefix, Key("logs/"))); v.Bytes == nil {
+		t.Error("expected TTL config retained")
+	}
+	// Collected values are deducted from usage.
+	if drift, err := r.VerifyUsage(false); err != nil || len(drift) != 0 {
+		t.Errorf("expected no usage drift after collection; got %+v, %v", drift, err)
+	}
+}
+
+// TestRangeSlidingTTL verifies reads extend the lifetime of values
+// with sliding TTLs, unless read recently after a write or already
+// expired.
+func TestRangeSlidingTTL(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(TTLConfig{TTLSeconds: 60, Sliding: true}); err != nil {
+		t.Fatal(err)
+	}
+	reply := &PutResponse{}
+	r.Put(&PutRequest{Key: MakeKey(KeyConfigTTLPrefix, Key("sessions/")), Value: Value{Bytes: buf.Bytes()}}, reply)
+	if reply.Error != nil {
+		t.Fatal(reply.Error)
+	}
+	now := time.Now().UnixNano()
+	values := map[string]int64{
+		"sessions/idle":    now - int64(30*time.Second),
+		"sessions/fresh":   now,
+		"sessions/expired": now - int64(2*time.Minute),
+	}
+	for key, ts := range values {
+		// Puts are executed as commands, as the touches reads propose
+		// may be executing meanwhile.
+		args := &PutRequest{Key: Key(key), Value: Value{Bytes: []byte("session"), Timestamp: ts}}
+		if err := <-r.ReadWriteCmd("Put", args, &PutResponse{}); err != nil {
+			t.Fatal(err)
+		}
+		gr := &GetResponse{}
+		if r.Get(&GetRequest{Key: Key(key)}, gr); gr.Error != nil {
+			t.Fatal(gr.Error)
+		}
+	}
+	if err := util.IsTrueWithin(func() bool {
+		v, _ := r.engine.get(Key("sessions/idle"))
+		return v.Expiration >= now+int64(time.Minute)
+	}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"sessions/fresh", "sessions/expired"} {
+		if v, _ := r.engine.get(Key(key)); v.Expiration != 0 {
+			t.Errorf("expected %q untouched; got expiration %d", key, v.Expiration)
+		}
+	}
+	// The idle session outlives its original TTL.
+	if _, err := r.GarbageCollect(now + int64(45*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := r.engine.get(Key("sessions/idle")); v.Bytes == nil {
+		t.Error("expected touched session retained")
+	}
+	if _, err := r.GarbageCollect(now + int64(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := r.engine.get(Key("sessions/idle")); v.Bytes != nil {
+		t.Error("expected touched session collected once idle for its TTL")
+	}
+}
+
+// TestRangeGarbageCollectVersions verifies superseded MVCC versions
+// are collected according to their zone's GC TTL, and that abandoned
+// write intents are reported rather than aborted, as their
+// transactions may have committed.
+func TestRangeGarbageCollectVersions(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(ZoneConfig{GCTTLSeconds: 60}); err != nil {
+		t.Fatal(err)
+	}
+	reply := &PutResponse{}
+	r.Put(&PutRequest{Key: MakeKey(KeyConfigZonePrefix, Key("/short")), Value: Value{Bytes: buf.Bytes()}}, reply)
+	if reply.Error != nil {
+		t.Fatal(reply.Error)
+	}
+
+	now := time.Now().UnixNano()
+	ago := func(d time.Duration) int64 { return now - int64(d) }
+	mvcc := NewMVCC(r.engine)
+	writes := []struct {
+		key       Key
+		timestamp int64
+		txnID     string
+	}{
+		// Superseded an hour ago; collected only under the short TTL.
+		{Key("/short/a"), ago(3 * time.Hour), ""},
+		{Key("/short/a"), ago(2 * time.Hour), ""},
+		{Key("/short/a"), ago(1 * time.Hour), ""},
+		{Key("/other/a"), ago(3 * time.Hour), ""},
+		{Key("/other/a"), ago(1 * time.Hour), ""},
+		// An intent abandoned two hours ago, and a recent one.
+		{Key("/short/b"), ago(3 * time.Hour), ""},
+		{Key("/short/b"), ago(2 * time.Hour), "txn1"},
+		{Key("/short/c"), ago(time.Minute), "txn2"},
+	}
+	for i, w := range writes {
+		var txn *Transaction
+		if w.txnID != "" {
+			txn = &Transaction{ID: w.txnID}
+		}
+		if err := mvcc.Put(w.key, w.timestamp, Value{Bytes: []byte{byte(i)}}, txn); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gc, err := r.GarbageCollect(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gc.VersionsCollected != 2 || gc.ResumeKey != nil || gc.LastGC != now {
+		t.Errorf("unexpected GC metadata %+v", gc)
+	}
+	expVersions := map[string]int{"/short/a": 1, "/other/a": 2, "/short/b": 2, "/short/c": 1}
+	for key, exp := range expVersions {
+		if versions, err := mvcc.Versions(Key(key)); err != nil || len(versions) != exp {
+			t.Errorf("%s: expected %d versions; got %+v, %v", key, exp, versions, err)
+		}
+	}
+	for _, key := range []string{"/short/b", "/short/c"} {
+		if _, err := mvcc.Get(Key(key), 0, ""); err == nil {
+			t.Errorf("%s: expected intent retained", key)
+		}
+	}
+	intents, err := r.AbandonedIntents(now)
+	if err != nil || len(intents) != 1 || string(intents[0].Key) != "/short/b" || intents[0].TxnID != "txn1" {
+		t.Errorf("expected intent on /short/b abandoned; got %+v, %v", intents, err)
+	}
+	if persisted, err := r.GCMetadata(); err != nil || persisted.LastGC != now {
+		t.Errorf("expected GC metadata persisted; got %+v, %v", persisted, err)
+	}
+}
+
+// TestRangeGarbageCollectResume verifies a pass which exceeds its
+// scan budget is resumed where it stopped, and that the store
+// prioritizes ranges with incomplete passes.
+func TestRangeGarbageCollectResume(t *testing.T) {
+	defer func(max int) { gcMaxRowsPerPass = max }(gcMaxRowsPerPass)
+	gcMaxRowsPerPass = 3
+	store := NewStore(NewInMem(1<<20), nil)
+	defer store.Close()
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	replica := Replica{NodeID: testIdent.NodeID, StoreID: testIdent.StoreID, RangeID: 1}
+	r, err := store.CreateRange(KeyMin, KeyMax, []Replica{replica})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rangeID := r.Metadata().RangeID
+	now := time.Now().UnixNano()
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		reply := &PutResponse{}
+		r.Put(&PutRequest{Key: Key(key), Value: Value{Bytes: []byte("v"), Expiration: now - 1}}, reply)
+		if reply.Error != nil {
+			t.Fatal(reply.Error)
+		}
+	}
+	gc, err := r.GarbageCollect(now)
+	if err != nil || gc.ValuesExpired != 3 || !bytes.Equal(gc.ResumeKey, Key("c\x00")) || gc.LastGC != 0 {
+		t.Fatalf("expected 3 values collected and pass resuming after \"c\"; got %+v, %v", gc, err)
+	}
+	if ids, err := store.GCCandidates(now); err != nil || len(ids) != 1 || ids[0] != rangeID {
+		t.Errorf("expected range with incomplete pass due; got %v, %v", ids, err)
+	}
+	gc, err = r.GarbageCollect(now)
+	if err != nil || gc.ValuesExpired != 5 || gc.ResumeKey != nil || gc.LastGC != now {
+		t.Fatalf("expected pass completed with 5 values collected; got %+v, %v", gc, err)
+	}
+	if ids, err := store.GCCandidates(now); err != nil || len(ids) != 0 {
+		t.Errorf("expected no ranges due; got %v, %v", ids, err)
+	}
+	if ids, err := store.GCCandidates(now + int64(gcInterval)); err != nil || len(ids) != 1 {
+		t.Errorf("expected range due after gcInterval; got %v, %v", ids, err)
+	}
+}
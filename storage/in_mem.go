@@ -21,6 +21,7 @@ package storage
 import (
 	"bytes"
 	"fmt"
+	"sort"
 	"sync"
 	"unsafe"
 
@@ -69,6 +70,12 @@ func (in *InMem) Type() DiskType {
 	return MEM
 }
 
+// CompactRange does nothing: the memory of deleted rows is reclaimed
+// as they're deleted.
+func (in *InMem) CompactRange(start, end Key) error {
+	return nil
+}
+
 // put sets the given key to the value provided.
 func (in *InMem) put(key Key, value Value) error {
 	in.Lock()
@@ -83,6 +90,33 @@ func (in *InMem) put(key Key, value Value) error {
 	return nil
 }
 
+// writeBatch applies writes in order, atomically with respect to
+// other operations. Fails without applying any writes if the puts
+// would exceed the store's capacity.
+func (in *InMem) writeBatch(writes []engineWrite) error {
+	in.Lock()
+	defer in.Unlock()
+	var size int64
+	for _, w := range writes {
+		if !w.del {
+			size += computeSize(KeyValue{Key: w.key, Value: w.value})
+		}
+	}
+	if size+in.usedBytes > in.maxBytes {
+		return util.Errorf("in mem store at capacity %d + %d > %d", in.usedBytes, size, in.maxBytes)
+	}
+	for _, w := range writes {
+		if w.del {
+			in.delLocked(w.key)
+			continue
+		}
+		kv := KeyValue{Key: w.key, Value: w.value}
+		in.usedBytes += computeSize(kv)
+		in.data.Insert(kv)
+	}
+	return nil
+}
+
 // get returns the value for the given key, nil otherwise.
 func (in *InMem) get(key Key) (Value, error) {
 	in.RLock()
@@ -113,10 +147,45 @@ func (in *InMem) scan(start, end Key, max int64) ([]KeyValue, error) {
 	return scanned, nil
 }
 
+// reverseScan returns up to max key/value objects in the span from
+// start (inclusive) to end (non-inclusive), in descending key order.
+func (in *InMem) reverseScan(start, end Key, max int64) ([]KeyValue, error) {
+	in.RLock()
+	defer in.RUnlock()
+
+	var scanned []KeyValue
+	add := func(kv llrb.Comparable) (done bool) {
+		if max != 0 && int64(len(scanned)) >= max {
+			return true
+		}
+		scanned = append(scanned, kv.(KeyValue))
+		return false
+	}
+	// DoRangeReverse visits keys in (start, end], so end is skipped
+	// and start visited separately.
+	done := in.data.DoRangeReverse(func(kv llrb.Comparable) (done bool) {
+		if bytes.Equal(kv.(KeyValue).Key, end) {
+			return false
+		}
+		return add(kv)
+	}, KeyValue{Key: end}, KeyValue{Key: start})
+	if kv := in.data.Get(KeyValue{Key: start}); !done && kv != nil && bytes.Compare(start, end) < 0 {
+		add(kv)
+	}
+	return scanned, nil
+}
+
 // del removes the item from the db with the given key.
 func (in *InMem) del(key Key) error {
 	in.Lock()
 	defer in.Unlock()
+	in.delLocked(key)
+	return nil
+}
+
+// delLocked removes the item with the given key. The lock must be
+// held.
+func (in *InMem) delLocked(key Key) {
 	// Note: this is approximate. There is likely something missing.
 	// The storage/in_mem_test.go benchmarks this and the measurement
 	// being made seems close enough for government work (tm).
@@ -124,7 +193,6 @@ func (in *InMem) del(key Key) error {
 		in.usedBytes -= computeSize(val.(KeyValue))
 	}
 	in.data.Delete(KeyValue{Key: key})
-	return nil
 }
 
 // capacity formulates available space based on cache size and
@@ -138,3 +206,141 @@ func (in *InMem) capacity() (StoreCapacity, error) {
 		DiskType:  MEM,
 	}, nil
 }
+
+// newSnapshot returns a copy of the store's rows. Writes wait while
+// the rows are copied.
+func (in *InMem) newSnapshot() Snapshot {
+	in.RLock()
+	defer in.RUnlock()
+	snap := &inMemSnapshot{kvs: make([]KeyValue, 0, in.data.Len())}
+	in.data.Do(func(kv llrb.Comparable) (done bool) {
+		snap.kvs = append(snap.kvs, kv.(KeyValue))
+		return false
+	})
+	snap.storeCapacity = StoreCapacity{
+		Capacity:  in.maxBytes,
+		Available: in.maxBytes - in.usedBytes,
+		DiskType:  MEM,
+	}
+	return snap
+}
+
+// newIterator returns an iterator over a snapshot of the store's rows,
+// as the tree holding them can't be stepped through while it's
+// modified.
+func (in *InMem) newIterator() Iterator {
+	return in.newSnapshot().newIterator()
+}
+
+// An inMemSnapshot is a Snapshot of an InMem store, holding a copy of
+// its rows sorted by key.
+type inMemSnapshot struct {
+	kvs           []KeyValue
+	storeCapacity StoreCapacity // The store's capacity when the snapshot was taken
+}
+
+// Type returns MEM.
+func (s *inMemSnapshot) Type() DiskType {
+	return MEM
+}
+
+// get returns the value for the given key.
+func (s *inMemSnapshot) get(key Key) (Value, error) {
+	i := sort.Search(len(s.kvs), func(i int) bool { return bytes.Compare(s.kvs[i].Key, key) >= 0 })
+	if i < len(s.kvs) && bytes.Equal(s.kvs[i].Key, key) {
+		return s.kvs[i].Value, nil
+	}
+	return Value{}, nil
+}
+
+// scan returns up to max key/value objects starting from start
+// (inclusive) and ending at end (non-inclusive).
+func (s *inMemSnapshot) scan(start, end Key, max int64) ([]KeyValue, error) {
+	return iterScan(s.newIterator(), start, end, max)
+}
+
+// reverseScan returns up to max key/value objects in the span from
+// start (inclusive) to end (non-inclusive), in descending key order.
+func (s *inMemSnapshot) reverseScan(start, end Key, max int64) ([]KeyValue, error) {
+	return iterReverseScan(s.newIterator(), start, end, max)
+}
+
+// put fails, as snapshots are read-only.
+func (s *inMemSnapshot) put(key Key, value Value) error {
+	return readOnlyError()
+}
+
+// del fails, as snapshots are read-only.
+func (s *inMemSnapshot) del(key Key) error {
+	return readOnlyError()
+}
+
+// writeBatch fails, as snapshots are read-only.
+func (s *inMemSnapshot) writeBatch(writes []engineWrite) error {
+	return readOnlyError()
+}
+
+// capacity returns the store's capacity when the snapshot was taken.
+func (s *inMemSnapshot) capacity() (StoreCapacity, error) {
+	return s.storeCapacity, nil
+}
+
+// newSnapshot returns a snapshot sharing this snapshot's rows.
+func (s *inMemSnapshot) newSnapshot() Snapshot {
+	return nestedSnapshot{s}
+}
+
+// newIterator returns an iterator over the snapshot's rows.
+func (s *inMemSnapshot) newIterator() Iterator {
+	return &sliceIterator{kvs: s.kvs, pos: -1}
+}
+
+// close does nothing; the snapshot's rows are garbage collected.
+func (s *inMemSnapshot) close() {}
+
+// A sliceIterator is an Iterator over rows held in memory, sorted by
+// key. An iterator with a failure is never valid and reports the
+// failure as its error.
+type sliceIterator struct {
+	kvs     []KeyValue
+	pos     int
+	failure error
+}
+
+func (it *sliceIterator) seek(key Key) {
+	it.pos = sort.Search(len(it.kvs), func(i int) bool { return bytes.Compare(it.kvs[i].Key, key) >= 0 })
+}
+
+func (it *sliceIterator) seekToLast() {
+	it.pos = len(it.kvs) - 1
+}
+
+func (it *sliceIterator) valid() bool {
+	return it.failure == nil && it.pos >= 0 && it.pos < len(it.kvs)
+}
+
+func (it *sliceIterator) next() {
+	if it.pos < len(it.kvs) {
+		it.pos++
+	}
+}
+
+func (it *sliceIterator) prev() {
+	if it.pos >= 0 {
+		it.pos--
+	}
+}
+
+func (it *sliceIterator) key() Key {
+	return it.kvs[it.pos].Key
+}
+
+func (it *sliceIterator) value() (Value, error) {
+	return it.kvs[it.pos].Value, nil
+}
+
+func (it *sliceIterator) err() error {
+	return it.failure
+}
+
+func (it *sliceIterator) close() {}
@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
+	"reflect"
 	"runtime"
 	"testing"
 )
@@ -113,7 +114,7 @@ func TestInMemCapacity(t *testing.T) {
 }
 
 func TestInMemOverCapacity(t *testing.T) {
-	engine := NewInMem(120 /* 120 bytes only -- enough for one node, not two */)
+	engine := NewInMem(130 /* 130 bytes only -- enough for one node, not two */)
 	bytes := []byte("0123456789")
 	var err error
 	if err = engine.put(Key("1"), Value{Bytes: bytes}); err != nil {
@@ -219,6 +220,44 @@ func TestInMemScan(t *testing.T) {
 	verifyScan(KeyMin, KeyMax, 0, keys[0:5], engine, t)
 }
 
+// TestInMemReverseScan verifies reverse scans return keys in
+// descending order, including the start key and excluding the end key.
+func TestInMemReverseScan(t *testing.T) {
+	engine := NewInMem(1 << 20)
+	keys := []Key{Key("a"), Key("aa"), Key("aaa"), Key("ab"), Key("abc")}
+	for _, key := range keys {
+		if err := engine.put(key, Value{Bytes: []byte("value")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testCases := []struct {
+		start, end Key
+		max        int64
+		expKeys    []Key
+	}{
+		{KeyMin, KeyMax, 0, []Key{Key("abc"), Key("ab"), Key("aaa"), Key("aa"), Key("a")}},
+		{Key("a"), Key("abc"), 0, []Key{Key("ab"), Key("aaa"), Key("aa"), Key("a")}},
+		{Key("aa"), Key("ab"), 0, []Key{Key("aaa"), Key("aa")}},
+		{Key("a0"), Key("abcc"), 2, []Key{Key("abc"), Key("ab")}},
+		{Key("ab"), Key("ab"), 0, nil},
+	}
+	for i, test := range testCases {
+		kvs, err := engine.reverseScan(test.start, test.end, test.max)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if len(kvs) != len(test.expKeys) {
+			t.Errorf("%d: expected keys %q; got %v", i, test.expKeys, kvs)
+			continue
+		}
+		for j, kv := range kvs {
+			if !bytes.Equal(kv.Key, test.expKeys[j]) {
+				t.Errorf("%d: expected key %q at %d; got %q", i, test.expKeys[j], j, kv.Key)
+			}
+		}
+	}
+}
+
 func BenchmarkCapacity(b *testing.B) {
 	engine := NewInMem(1 << 30)
 	bytes := []byte("0123456789")
@@ -237,3 +276,93 @@ func BenchmarkCapacity(b *testing.B) {
 		}
 	}
 }
+
+// TestInMemWriteBatch verifies a batch applies its writes in order,
+// and applies none if they would exceed the engine's capacity.
+func TestInMemWriteBatch(t *testing.T) {
+	engine := NewInMem(1 << 10)
+	if err := engine.put(Key("a"), Value{Bytes: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.writeBatch([]engineWrite{
+		{key: Key("a"), del: true},
+		{key: Key("b"), value: Value{Bytes: []byte("2")}},
+		{key: Key("c"), value: Value{Bytes: []byte("3")}},
+		{key: Key("c"), del: true},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	kvs, err := engine.scan(KeyMin, KeyMax, 0)
+	if err != nil || len(kvs) != 1 || !bytes.Equal(kvs[0].Key, Key("b")) {
+		t.Errorf("expected only \"b\" after batch; got %+v, %v", kvs, err)
+	}
+	if err := engine.writeBatch([]engineWrite{
+		{key: Key("b"), del: true},
+		{key: Key("d"), value: Value{Bytes: make([]byte, 1<<10)}},
+	}); err == nil {
+		t.Error("expected batch exceeding capacity to fail")
+	}
+	if v, err := engine.get(Key("b")); err != nil || v.Bytes == nil {
+		t.Errorf("expected failed batch to apply no writes; got %+v, %v", v, err)
+	}
+}
+
+// verifyEngineSnapshot verifies a snapshot of engine, holding keys
+// "a", "b" and "c", is unaffected by subsequent writes, refuses
+// writes, and may be iterated forwards and backwards.
+func verifyEngineSnapshot(t *testing.T, engine Engine) {
+	for _, key := range []string{"a", "b", "c"} {
+		if err := engine.put(Key(key), Value{Bytes: []byte(key)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snap := engine.newSnapshot()
+	defer snap.close()
+	if err := engine.put(Key("b"), Value{Bytes: []byte("B")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.del(Key("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := snap.put(Key("d"), Value{Bytes: []byte("d")}); err == nil {
+		t.Error("expected write to snapshot to fail")
+	}
+	if v, err := snap.get(Key("b")); err != nil || string(v.Bytes) != "b" {
+		t.Errorf("expected snapshot to read \"b\"; got %q, %v", v.Bytes, err)
+	}
+	if kvs, err := snap.scan(KeyMin, KeyMax, 0); err != nil || len(kvs) != 3 {
+		t.Errorf("expected snapshot to scan 3 keys; got %+v, %v", kvs, err)
+	}
+	if kvs, err := snap.reverseScan(Key("a"), Key("c"), 0); err != nil || len(kvs) != 2 || string(kvs[0].Key) != "b" {
+		t.Errorf("expected snapshot to reverse scan \"b\", \"a\"; got %+v, %v", kvs, err)
+	}
+	if kvs, err := engine.scan(KeyMin, KeyMax, 0); err != nil || len(kvs) != 2 {
+		t.Errorf("expected engine to scan 2 keys; got %+v, %v", kvs, err)
+	}
+
+	it := snap.newIterator()
+	defer it.close()
+	var keys []string
+	for it.seek(Key("b")); it.valid(); it.next() {
+		keys = append(keys, string(it.key()))
+	}
+	for it.seekToLast(); it.valid(); it.prev() {
+		value, err := it.value()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, string(value.Bytes))
+	}
+	if err := it.err(); err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{"b", "c", "c", "b", "a"}; !reflect.DeepEqual(keys, exp) {
+		t.Errorf("expected iteration %q; got %q", exp, keys)
+	}
+}
+
+// TestInMemSnapshot verifies snapshots and iterators of an in-memory
+// engine.
+func TestInMemSnapshot(t *testing.T) {
+	verifyEngineSnapshot(t, NewInMem(1<<20))
+}
@@ -35,6 +35,11 @@ var (
 	// storage/encoding.go), they will never start with \xff.
 	KeyMax = Key("\xff")
 
+	// KeySystemPrefix indicates the beginning of the key range
+	// reserved for system data. Usage under this prefix is
+	// attributed to internal accounts rather than user accounts.
+	KeySystemPrefix = Key("\x00")
+
 	// KeyConfigAccountingPrefix specifies the key prefix for accounting
 	// configurations. The suffix is the affected key prefix.
 	KeyConfigAccountingPrefix = Key("\x00acct")
@@ -44,6 +49,34 @@ var (
 	// KeyConfigZonePrefix specifies the key prefix for zone
 	// configurations. The suffix is the affected key prefix.
 	KeyConfigZonePrefix = Key("\x00zone")
+	// KeyConfigCompressionPrefix specifies the key prefix for
+	// compression dictionaries. The suffix is the affected key prefix.
+	KeyConfigCompressionPrefix = Key("\x00comp")
+	// KeyConfigTTLPrefix specifies the key prefix for TTL
+	// configurations, which limit the lifetime of values by key span.
+	KeyConfigTTLPrefix = Key("\x00ttl")
+	// KeyConfigFreezePrefix specifies the key prefix for freezes of
+	// key spans; the suffix is the start key of the frozen span.
+	KeyConfigFreezePrefix = Key("\x00freeze")
+	// KeyAuditLogPrefix is the key prefix for audit log entries.
+	KeyAuditLogPrefix = Key("\x00audit")
+	// KeyQueuePrefix is the key prefix for message queues. The suffix
+	// is the recipient inbox key.
+	KeyQueuePrefix = Key("\x00queue")
+	// KeyTimeSeriesPrefix is the key prefix for time series data.
+	KeyTimeSeriesPrefix = Key("\x00tsd")
+	// KeyJobPrefix is the key prefix for records of long-running jobs.
+	// The suffix is the big-endian encoded job ID.
+	KeyJobPrefix = Key("\x00jobs")
+	// KeyJobIDGenerator contains a sequence generator for job IDs.
+	KeyJobIDGenerator = Key("\x00job-id-generator")
+	// KeyUsagePrefix is the key prefix for each node's periodic
+	// rollup of usage by account. The suffix is the big-endian
+	// encoded node ID.
+	KeyUsagePrefix = Key("\x00usage")
+	// KeyTxnPrefix is the key prefix for transaction records. The
+	// suffix is the transaction ID; see TxnRecordKey.
+	KeyTxnPrefix = Key("\x00txn-")
 	// KeyMetaPrefix is the prefix for range metadata keys.
 	KeyMetaPrefix = Key("\x00\x00meta")
 	// KeyMeta1Prefix is the first level of key addressing. The value is a
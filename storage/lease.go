@@ -0,0 +1,299 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"strconv"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/golang/glog"
+)
+
+// MaxClockOffset is the maximum offset assumed between the clocks of
+// any two nodes. A lease holder stops serving reads this long before
+// its lease expires, so that the next holder, whose lease can't begin
+// until the previous one expires by its own clock, never serves reads
+// concurrently with it.
+const MaxClockOffset = 250 * time.Millisecond
+
+// rangeLeaseDuration is the duration of range leases. A holder which
+// remains the raft leader extends its lease once less than half of
+// the duration remains. Var for testing.
+var rangeLeaseDuration = 9 * time.Second
+
+// keyRangeLeasePrefix is the prefix for store-local keys holding the
+// lease of each range. The value is a struct of type Lease. Unlike
+// other store-local keys, the lease is replicated, as it's set by
+// raft commands, and included in snapshots of the range's data.
+var keyRangeLeasePrefix = Key("\x00\x00\x00lease-")
+
+// rangeLeaseKey creates a range lease key as the concatenation of the
+// keyRangeLeasePrefix and hexadecimal-formatted range ID.
+func rangeLeaseKey(rangeID int64) Key {
+	return MakeKey(keyRangeLeasePrefix, Key(strconv.FormatInt(rangeID, 16)))
+}
+
+// A Lease grants Replica the exclusive right to serve reads of its
+// range from its own data, without a consensus round trip, from Start
+// until Expiration, in nanoseconds since the epoch. Leases are
+// acquired and extended by the raft leader via InternalLease
+// commands, and may be transferred by the holder to another replica.
+// While a replica holds a lease, other replicas refuse
+// reads and writes alike, so that the holder never misses a write.
+type Lease struct {
+	Replica    Replica `protobuf:"1"`
+	Start      int64   `protobuf:"2"`
+	Expiration int64   `protobuf:"3"`
+}
+
+// heldBy returns whether the lease is held by replica at time now,
+// as judged by the holder: the holder relinquishes its lease
+// MaxClockOffset before it expires.
+func (l Lease) heldBy(replica Replica, now int64) bool {
+	return l.Expiration > 0 && idOf(l.Replica) == idOf(replica) && now < l.Expiration-int64(MaxClockOffset)
+}
+
+// heldByOther returns whether the lease is held by a replica other
+// than replica at time now, as judged by replica.
+func (l Lease) heldByOther(replica Replica, now int64) bool {
+	return l.Expiration > 0 && idOf(l.Replica) != idOf(replica) && now < l.Expiration
+}
+
+// Lease returns the range's most recently applied lease, which may
+// have expired.
+func (r *Range) Lease() Lease {
+	r.leaseMu.RLock()
+	defer r.leaseMu.RUnlock()
+	return r.lease
+}
+
+// loadLease reads the range's lease from the engine.
+func (r *Range) loadLease() {
+	var lease Lease
+	if _, _, err := getI(r.engine, rangeLeaseKey(r.Metadata().RangeID), &lease); err != nil {
+		glog.Errorf("range %d: unable to load lease: %v", r.Metadata().RangeID, err)
+		return
+	}
+	r.leaseMu.Lock()
+	defer r.leaseMu.Unlock()
+	r.lease = lease
+}
+
+// leaseRow returns the range's lease as stored in engine, for
+// inclusion in snapshots of the range's data, or false if it has none.
+func (r *Range) leaseRow(engine Engine) (KeyValue, bool) {
+	key := rangeLeaseKey(r.Metadata().RangeID)
+	value, err := engine.get(key)
+	if err != nil || value.Bytes == nil {
+		return KeyValue{}, false
+	}
+	return KeyValue{Key: key, Value: value}, true
+}
+
+// redirectError returns the error with which a replica refuses a
+// request because another replica holds the range's lease, or nil if
+// no other replica does.
+func (r *Range) redirectError(now int64) error {
+	r.raftMu.RLock()
+	self := r.self
+	r.raftMu.RUnlock()
+	if lease := r.Lease(); lease.heldByOther(self, now) {
+		holder := lease.Replica
+		return &NotLeaseHolderError{Replica: self, LeaseHolder: &holder}
+	}
+	return nil
+}
+
+// checkLease verifies this replica holds the range's lease, so that
+// it may serve reads from its own data. A leader without a lease
+// acquires it, unless another replica holds it; if one does, a
+// NotLeaseHolderError redirects the read to it. A follower returns a
+// NotLeaderError. A holder which remains the leader extends its lease
+// in the background once less than half of it remains. A holder
+// transferring its lease redirects reads to the lease's recipient,
+// as the recipient may begin serving them before the transfer is
+// applied here.
+func (r *Range) checkLease() error {
+	now := time.Now().UnixNano()
+	r.raftMu.RLock()
+	self := r.self
+	r.raftMu.RUnlock()
+	if lease := r.Lease(); lease.heldBy(self, now) {
+		if target := r.leaseTransfer(); target != nil {
+			return &NotLeaseHolderError{Replica: self, LeaseHolder: target}
+		}
+		if lease.Expiration-now < int64(rangeLeaseDuration)/2 && r.IsLeader() {
+			r.maybeExtendLease()
+		}
+		return nil
+	}
+	if err := r.redirectError(now); err != nil {
+		return err
+	}
+	if !r.IsLeader() {
+		return r.notLeaderError()
+	}
+	return r.requestLease(self, now)
+}
+
+// requestLease proposes a lease for self beginning at now and waits
+// for it to be applied.
+func (r *Range) requestLease(self Replica, now int64) error {
+	_, err := r.proposeLease(self, self, now)
+	return err
+}
+
+// proposeLease proposes, on behalf of self, a lease for holder
+// beginning at now and waits for it to be applied.
+func (r *Range) proposeLease(self, holder Replica, now int64) (Lease, error) {
+	args := &InternalLeaseRequest{
+		RequestHeader: RequestHeader{Replica: self},
+		Lease: Lease{
+			Replica:    holder,
+			Start:      now,
+			Expiration: now + int64(rangeLeaseDuration),
+		},
+	}
+	reply := &InternalLeaseResponse{}
+	if err := <-r.ReadWriteCmd("InternalLease", args, reply); err != nil {
+		return Lease{}, err
+	}
+	return reply.Lease, reply.Error
+}
+
+// leaseTransfer returns the replica to which this replica is
+// transferring the range's lease, or nil if there's no transfer.
+func (r *Range) leaseTransfer() *Replica {
+	r.leaseMu.RLock()
+	defer r.leaseMu.RUnlock()
+	return r.transfer
+}
+
+// TransferLease transfers the range's lease to target, one of the
+// range's replicas, for instance to move load off an overloaded node.
+// This replica must hold the lease, acquiring it if it's the leader;
+// otherwise, a NotLeaderError or NotLeaseHolderError redirects the
+// request. Once the new lease is applied, the raft leadership is
+// handed to target as well, so that it may extend the lease. Returns
+// the new lease.
+func (r *Range) TransferLease(target Replica) (Lease, error) {
+	meta := r.Metadata()
+	found := false
+	for _, replica := range meta.Replicas.Replicas {
+		if idOf(replica) == idOf(target) {
+			target, found = replica, true
+		}
+	}
+	if !found {
+		return Lease{}, util.Errorf("range %d has no replica on node %d, store %d", meta.RangeID, target.NodeID, target.StoreID)
+	}
+	if err := r.checkLease(); err != nil {
+		return Lease{}, err
+	}
+	r.raftMu.RLock()
+	self := r.self
+	r.raftMu.RUnlock()
+	if idOf(target) == idOf(self) {
+		return r.Lease(), nil
+	}
+	r.leaseMu.Lock()
+	if r.transfer != nil {
+		r.leaseMu.Unlock()
+		return Lease{}, util.Errorf("range %d: lease transfer to node %d already in progress", meta.RangeID, r.transfer.NodeID)
+	}
+	r.transfer = &target
+	r.leaseMu.Unlock()
+	defer func() {
+		r.leaseMu.Lock()
+		defer r.leaseMu.Unlock()
+		r.transfer = nil
+	}()
+	return r.proposeLease(self, target, time.Now().UnixNano())
+}
+
+// maybeTransferLeadership hands the raft leadership to the holder of
+// the range's lease, following the application of a command of method
+// which transferred the lease away from this replica, the leader. If
+// the holder fails to take over, it serves reads until its lease
+// expires, and the leader then acquires the lease anew. Called only
+// by processPending.
+func (r *Range) maybeTransferLeadership(method string) {
+	if method != "InternalLease" || !r.raft.isLeader() {
+		return
+	}
+	if lease := r.Lease(); lease.heldByOther(r.raft.self, time.Now().UnixNano()) {
+		r.raft.transferLeadership(lease.Replica)
+	}
+}
+
+// maybeExtendLease extends this replica's lease in the background,
+// unless an extension is already outstanding or the lease is being
+// transferred.
+func (r *Range) maybeExtendLease() {
+	r.leaseMu.Lock()
+	defer r.leaseMu.Unlock()
+	if r.extending || r.transfer != nil {
+		return
+	}
+	r.extending = true
+	r.raftMu.RLock()
+	self := r.self
+	r.raftMu.RUnlock()
+	go func() {
+		if err := r.requestLease(self, time.Now().UnixNano()); err != nil {
+			glog.V(1).Infof("range %d: failed to extend lease: %v", r.Metadata().RangeID, err)
+		}
+		r.leaseMu.Lock()
+		defer r.leaseMu.Unlock()
+		r.extending = false
+	}()
+}
+
+// InternalLease sets the range's lease to args.Lease. The lease may
+// be extended or transferred by its holder, the replica in the
+// request header, at any time, but is granted to another replica by
+// any other only if it begins once the current lease has expired.
+// Executed by every replica as the command is applied.
+func (r *Range) InternalLease(args *InternalLeaseRequest, reply *InternalLeaseResponse) {
+	r.leaseMu.Lock()
+	defer r.leaseMu.Unlock()
+	prev := r.lease
+	if prev.Expiration > 0 && idOf(prev.Replica) != idOf(args.Lease.Replica) &&
+		idOf(prev.Replica) != idOf(args.Replica) && args.Lease.Start < prev.Expiration {
+		holder := prev.Replica
+		reply.Error = &NotLeaseHolderError{Replica: args.Lease.Replica, LeaseHolder: &holder}
+		return
+	}
+	var buf bytes.Buffer
+	if reply.Error = gob.NewEncoder(&buf).Encode(&args.Lease); reply.Error != nil {
+		return
+	}
+	// The lease is stored with the timestamp of its start, rather than
+	// the local time, so that replicas store identical rows.
+	value := Value{Bytes: buf.Bytes(), Timestamp: args.Lease.Start}
+	b := r.newBatch()
+	if reply.Error = b.put(rangeLeaseKey(r.Metadata().RangeID), value); reply.Error != nil {
+		return
+	}
+	if reply.Error = b.Commit(); reply.Error != nil {
+		return
+	}
+	r.lease = args.Lease
+	reply.Lease = args.Lease
+}
@@ -0,0 +1,62 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+)
+
+// DefaultTimeUntilNodeDead is the time after a node's liveness expires
+// beyond which it's considered dead and its replicas are replaced.
+const DefaultTimeUntilNodeDead = 5 * time.Minute
+
+// NodeLiveness records that a node is live. Each node gossips its
+// record periodically, extending its expiration. Records never expire
+// from the gossip network, so that a node which stops gossiping is
+// known to have died rather than forgotten.
+type NodeLiveness struct {
+	NodeID     int32
+	Expiration int64 // Time until which the node is live (Unix nanos)
+}
+
+// IsDead returns whether the node's liveness expired more than
+// threshold before now. Expired nodes aren't dead until the threshold
+// elapses, so that brief outages, such as restarts, don't cause all of
+// their replicas to be replaced.
+func (l NodeLiveness) IsDead(now int64, threshold time.Duration) bool {
+	return l.Expiration+int64(threshold) <= now
+}
+
+// A LivenessFinder returns the liveness record of a node, or false if
+// the node has none.
+type LivenessFinder func(nodeID int32) (NodeLiveness, bool)
+
+// gossipLivenessFinder returns a LivenessFinder which finds the
+// liveness records nodes gossip.
+func gossipLivenessFinder(g *gossip.Gossip) LivenessFinder {
+	return func(nodeID int32) (NodeLiveness, bool) {
+		if g == nil {
+			return NodeLiveness{}, false
+		}
+		var liveness NodeLiveness
+		if err := g.GetInfoAs(gossip.MakeNodeLivenessKey(nodeID), &liveness); err != nil {
+			return NodeLiveness{}, false
+		}
+		return liveness, true
+	}
+}
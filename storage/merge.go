@@ -0,0 +1,205 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/golang/glog"
+)
+
+// mergeReplicationTicks is the number of raft ticks a merge awaits the
+// replication of the subsumption to every replica of the subsumed
+// range; see Range.awaitReplicated.
+const mergeReplicationTicks = 5 * raftElectionTicks
+
+// keyRangeSubsumedPrefix is the prefix for store-local keys marking
+// ranges subsumed by a merge which has yet to be applied. The value
+// is a bool, always true.
+var keyRangeSubsumedPrefix = Key("\x00\x00\x00subsumed-")
+
+// rangeSubsumedKey creates a range subsumed key as the concatenation
+// of the keyRangeSubsumedPrefix and hexadecimal-formatted range ID.
+func rangeSubsumedKey(rangeID int64) Key {
+	return MakeKey(keyRangeSubsumedPrefix, Key(strconv.FormatInt(rangeID, 16)))
+}
+
+// loadSubsumed reads whether the range has been subsumed by a merge.
+func (r *Range) loadSubsumed() {
+	ok, _, err := getI(r.engine, rangeSubsumedKey(r.Metadata().RangeID), nil)
+	if err != nil {
+		glog.Errorf("range %d: unable to load subsumption: %v", r.Metadata().RangeID, err)
+		return
+	}
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+	r.subsumed = ok
+}
+
+// writeSubsumed records via b whether the range has been subsumed.
+func (r *Range) writeSubsumed(b *Batch, subsumed bool) error {
+	key := rangeSubsumedKey(r.Metadata().RangeID)
+	if subsumed {
+		return putI(b, key, true)
+	}
+	return b.del(key)
+}
+
+// Subsumed returns whether the range has been subsumed by a merge with
+// the range preceding it, which has yet to be applied.
+func (r *Range) Subsumed() bool {
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+	return r.subsumed
+}
+
+// setApplied records that the range has applied its raft log through
+// index.
+func (r *Range) setApplied(index int64) {
+	r.raftMu.Lock()
+	defer r.raftMu.Unlock()
+	r.applied = index
+}
+
+// awaitApplied blocks until the range has applied its raft log through
+// index, returning false if the range or stop is closed first.
+func (r *Range) awaitApplied(index int64, stop <-chan struct{}) bool {
+	ticker := time.NewTicker(raftTickInterval)
+	defer ticker.Stop()
+	for {
+		r.raftMu.RLock()
+		applied := r.applied
+		r.raftMu.RUnlock()
+		if applied >= index {
+			return true
+		}
+		select {
+		case <-ticker.C:
+		case <-r.closer:
+			return false
+		case <-stop:
+			return false
+		}
+	}
+}
+
+// awaitReplicated blocks until the range, as leader, has replicated its
+// raft log through index to all of its replicas. Returns an error if
+// it doesn't within mergeReplicationTicks, or if the range stops.
+func (r *Range) awaitReplicated(index int64) error {
+	ticker := time.NewTicker(raftTickInterval)
+	defer ticker.Stop()
+	for ticks := 0; ticks < mergeReplicationTicks; ticks++ {
+		r.raftMu.RLock()
+		replicated := r.replicated
+		r.raftMu.RUnlock()
+		if replicated >= index {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-r.closer:
+			return util.Errorf("range %d stopped before replicating index %d", r.Metadata().RangeID, index)
+		}
+	}
+	return util.Errorf("range %d failed to replicate index %d to all replicas", r.Metadata().RangeID, index)
+}
+
+// learnCommitted informs the range's raft group that entry is
+// committed, should the leader not, as when it has stopped since.
+// Returns false if the range or stop is closed first.
+func (r *Range) learnCommitted(entry RaftEntry, stop <-chan struct{}) bool {
+	select {
+	case r.commits <- entry:
+		return true
+	case <-r.closer:
+		return false
+	case <-stop:
+		return false
+	}
+}
+
+// InternalSubsume freezes the range's data ahead of its merge with the
+// range preceding it: read-write commands which follow in the raft log
+// are refused with a RangeSubsumedError, so that each replica's data
+// is final once it has applied the subsumption. Executed by each
+// replica as the subsumption commits, so called only from
+// processPending. Subsuming a subsumed range, as when a failed merge
+// is retried, has no further effect. See InternalMerge.
+func (r *Range) InternalSubsume(args *InternalSubsumeRequest, reply *InternalSubsumeResponse) {
+	reply.Index, reply.Term = r.applying.Index, r.applying.Term
+	if r.subsumed {
+		return
+	}
+	b := r.newBatch()
+	if reply.Error = r.writeSubsumed(b, true); reply.Error != nil {
+		return
+	}
+	if reply.Error = b.Commit(); reply.Error != nil {
+		return
+	}
+	r.afterCommit(func() { r.subsumed = true })
+}
+
+// InternalMerge extends the range over the range following it, held
+// by the range's store as the store's replica listed in
+// args.SubsumedReplicas. Executed by each replica as the merge
+// commits, so called only from processPending. The subsumed range's
+// data is final once it has applied its log through
+// args.SubsumedIndex, at which it was subsumed. Each replica's log
+// holds the subsumption before the merge is proposed, but a replica
+// may not have learned that it's committed before the leader stops
+// the subsumed range; the merge tells it, then awaits its application.
+// The subsumed range is then stopped and removed from the store.
+func (r *Range) InternalMerge(args *InternalMergeRequest, reply *InternalMergeResponse) {
+	meta := r.Metadata()
+	if r.store == nil {
+		reply.Error = util.Errorf("range %d has no store holding the range it subsumes", meta.RangeID)
+		return
+	}
+	var subsumedID int64
+	for _, replica := range args.SubsumedReplicas {
+		if replica.NodeID == r.ident.NodeID && replica.StoreID == r.ident.StoreID {
+			subsumedID = replica.RangeID
+		}
+	}
+	subsumed, err := r.store.GetRange(subsumedID)
+	if err != nil {
+		reply.Error = err
+		return
+	}
+	subsumedMeta := subsumed.Metadata()
+	if !bytes.Equal(subsumedMeta.StartKey, meta.EndKey) {
+		reply.Error = util.Errorf("range %d doesn't follow range %d ending at %q", subsumedID, meta.RangeID, meta.EndKey)
+		return
+	}
+	entry := RaftEntry{Index: args.SubsumedIndex, Term: args.SubsumedTerm}
+	if !subsumed.learnCommitted(entry, r.closer) || !subsumed.awaitApplied(args.SubsumedIndex, r.closer) {
+		reply.Error = util.Errorf("range %d stopped before applying its subsumption at index %d", subsumedID, args.SubsumedIndex)
+		return
+	}
+	meta.EndKey = subsumedMeta.EndKey
+	if reply.Error = r.store.writeMerge(r.newBatch(), meta, subsumedMeta); reply.Error != nil {
+		return
+	}
+	r.afterCommit(func() {
+		r.store.finishMerge(r, subsumed, meta)
+		r.recomputeStats()
+	})
+}
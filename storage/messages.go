@@ -17,6 +17,21 @@
 
 package storage
 
+import "github.com/cockroachdb/cockroach/util/protobuf"
+
+// init registers the updates which may be enqueued by EnqueueUpdate
+// by their numbers in the Update message of proto/api.proto.
+func init() {
+	for num, update := range map[int]interface{}{
+		16: &PutRequest{},
+		17: &IncrementRequest{},
+		18: &DeleteRequest{},
+		19: &DeleteRangeRequest{},
+	} {
+		protobuf.Register(num, update)
+	}
+}
+
 // Key defines the key in the key-value datastore.
 type Key []byte
 
@@ -26,73 +41,201 @@ type Key []byte
 // deleted.
 type Value struct {
 	// Bytes is the byte string value.
-	Bytes []byte
+	Bytes []byte `protobuf:"1"`
 	// Timestamp of value in nanoseconds since epoch.
-	Timestamp int64
+	Timestamp int64 `protobuf:"2"`
 	// Expiration in nanoseconds.
-	Expiration int64
+	Expiration int64 `protobuf:"3"`
+	// DictVersion, if non-zero, indicates Bytes is compressed with
+	// this version of the compression dictionary for the key's
+	// prefix. See CompressionDicts.
+	DictVersion int32 `protobuf:"4"`
 }
 
 // KeyValue is a pair of Key and Value for returned Key/Value pairs
 // from ScanRequest/ScanResponse. It embeds a Key and a Value.
 type KeyValue struct {
-	Key
-	Value
+	Key   `protobuf:"1"`
+	Value `protobuf:"2"`
+}
+
+// A ClientCmdID uniquely identifies a mutation sent by a client. A
+// range executes each command ID at most once, replaying its reply if
+// the client retries, so that retries after ambiguous failures don't
+// double-apply the mutation. Replies are persisted with the range's
+// data, so that retries are recognized across restarts and leader
+// changes, and are remembered for responseCacheTTL.
+type ClientCmdID struct {
+	WallTime int64 `protobuf:"1"` // Nanoseconds since the epoch
+	Random   int64 `protobuf:"2"`
+}
+
+// IsEmpty returns whether the command ID is unset.
+func (ccid ClientCmdID) IsEmpty() bool {
+	return ccid.WallTime == 0 && ccid.Random == 0
+}
+
+// CompressionDictionary is a CompressionOptions codec which compresses
+// only values under prefixes with compression dictionaries.
+const CompressionDictionary = "dictionary"
+
+// CompressionOptions control the compression of values sent between
+// clients and nodes, independently of how nodes store them.
+type CompressionOptions struct {
+	// Codec is CompressionDictionary; CompressionDeflate, which
+	// compresses all values, using the prefix's dictionary if there is
+	// one; or CompressionNone or empty to send values uncompressed, as
+	// is best for values already compressed by the application.
+	Codec string `protobuf:"1"`
+	// RequestThreshold is the size in bytes below which values sent by
+	// the client are left uncompressed.
+	RequestThreshold int `protobuf:"2"`
+	// ResponseThreshold, if positive, is the size in bytes at or above
+	// which values stored uncompressed are compressed with Codec by
+	// nodes replying to the client.
+	ResponseThreshold int `protobuf:"3"`
+}
+
+// Enabled returns true if values are compressed with the options.
+func (co CompressionOptions) Enabled() bool {
+	return co.Codec == CompressionDictionary || co.Codec == CompressionDeflate
 }
 
+const (
+	// CONSISTENT reads are served by the replica holding the range's
+	// lease, reflecting every write acknowledged before the read.
+	CONSISTENT ReadConsistency = iota
+	// INCONSISTENT reads are served by any replica from its own data,
+	// which may be arbitrarily stale.
+	INCONSISTENT
+	// BOUNDED reads are served by any replica whose resolved timestamp,
+	// as closed by the lease holder, is at or beyond the request's
+	// MinTimestamp, so that they reflect every write at and below it;
+	// other replicas redirect them to the lease holder. See
+	// Range.CloseTimestamp.
+	BOUNDED
+)
+
+// ReadConsistency is the consistency required of a read.
+type ReadConsistency int
+
 // RequestHeader is supplied with every storage node request.
 type RequestHeader struct {
 	// Timestamp specifies time at which read or writes should be
 	// performed. In nanoseconds since the epoch. Defaults to current
-	// wall time.
-	Timestamp int64
+	// wall time. Nodes set the timestamp of writes from their clocks,
+	// replacing any set by the client; see util.Clock.
+	Timestamp int64 `protobuf:"1"`
+	// User is the user on whose behalf the request is made. Nodes
+	// refuse requests which the permission configs of the keys they
+	// access don't grant the user; see PermConfig. Empty for the
+	// default user.
+	User string `protobuf:"2"`
+	// Client identifies the application sending the request, by
+	// convention as "name/version". Nodes attribute the requests they
+	// execute and the writes they sample to it, so that load on a
+	// shared cluster may be traced to the services generating it.
+	// Empty if the client is unidentified.
+	Client string `protobuf:"3"`
 
 	// The following values are set internally and should not be set
 	// manually.
 
 	// Replica specifies the destination for the request. See config.go.
-	Replica Replica
+	Replica Replica `protobuf:"4"`
 	// MaxTimestamp is the maximum wall time seen by the client to
 	// date. This should be supplied with successive transactions for
 	// linearalizability for this client. In nanoseconds since the
 	// epoch.
-	MaxTimestamp int64
+	MaxTimestamp int64 `protobuf:"5"`
 	// TxID is set non-empty if a transaction is underway. Empty string
 	// to start a new transaction.
-	TxID string
+	TxID string `protobuf:"6"`
+	// TxnPriority is the priority of the request's transaction in
+	// conflicts with other transactions: a request blocked by the
+	// write intent of a transaction of lower priority aborts it,
+	// while one of equal or higher priority must be waited on. See
+	// InternalPushTxn.
+	TxnPriority int32 `protobuf:"7"`
+	// Priority orders execution of requests waiting on a busy node;
+	// higher values execute first. Zero is the default priority. See
+	// Permission.Priority.
+	Priority float32 `protobuf:"8"`
+	// CmdID is set by clients on mutations; see ClientCmdID. Empty to
+	// execute the request without duplicate detection.
+	CmdID ClientCmdID `protobuf:"9"`
+	// AcceptCompressed indicates the client decompresses values itself;
+	// otherwise, compressed values are decompressed before replying.
+	AcceptCompressed bool `protobuf:"10"`
+	// Compression, if set, overrides the client's compression options
+	// for this request. Clients accepting compressed values set it to
+	// their own options otherwise, so nodes compress replies
+	// accordingly.
+	Compression *CompressionOptions `protobuf:"11"`
+	// Proxy asks the receiving node to route the request to the range
+	// holding its key, rather than execute it against Replica, which
+	// is unset. Set by clients which don't look up ranges themselves;
+	// see kv.ProxyDB.
+	Proxy bool `protobuf:"12"`
+	// AnyReplica asks a replica which isn't the raft leader to serve a
+	// read from its own data, which may be stale, rather than redirect
+	// it to the leader. Set by quorum reads, which compare the data of
+	// a quorum of replicas; see kv.DistDB.QuorumGet.
+	AnyReplica bool `protobuf:"13"`
+	// ReadConsistency is the consistency required of a read. Reads
+	// which aren't CONSISTENT may be served by replicas other than the
+	// lease holder, spreading load across replicas and letting reads
+	// be served by nearby replicas; see kv.DistDBOptions.ReadConsistency.
+	ReadConsistency ReadConsistency `protobuf:"14"`
+	// MinTimestamp is the timestamp at and below which a BOUNDED read
+	// must reflect all writes. In nanoseconds since the epoch.
+	MinTimestamp int64 `protobuf:"15"`
+	// Internal permits the request to write keys reserved for the
+	// system, such as range addressing records and configs, which
+	// nodes otherwise refuse to let clients write; see IsReservedKey.
+	// Set by nodes' own clients; see kv.DistDBOptions.Internal.
+	Internal bool `protobuf:"16"`
+	// ClockReading is a reading of the sender's hybrid logical clock,
+	// with which the receiving node updates its own. See util.Clock.
+	ClockReading int64 `protobuf:"17"`
 }
 
 // ResponseHeader is returned with every storage node response.
 type ResponseHeader struct {
 	// Error is non-nil if an error occurred.
-	Error error
+	Error error `protobuf:"1"`
+	// Replica is the replica which served the request.
+	Replica Replica `protobuf:"2"`
 	// TxID is non-empty if a transaction is underway.
-	TxID string
+	TxID string `protobuf:"3"`
+	// ClockReading is a reading of the serving node's hybrid logical
+	// clock, with which the client updates its own.
+	ClockReading int64 `protobuf:"4"`
 }
 
 // A ContainsRequest is arguments to the Contains() method.
 type ContainsRequest struct {
-	RequestHeader
-	Key Key
+	RequestHeader `protobuf:"1"`
+	Key           Key `protobuf:"2"`
 }
 
 // A ContainsResponse is the return value of the Contains() method.
 type ContainsResponse struct {
-	ResponseHeader
-	Exists bool
+	ResponseHeader `protobuf:"1"`
+	Exists         bool `protobuf:"2"`
 }
 
 // A GetRequest is arguments to the Get() method.
 type GetRequest struct {
-	RequestHeader
-	Key Key
+	RequestHeader `protobuf:"1"`
+	Key           Key `protobuf:"2"`
 }
 
 // A GetResponse is the return value from the Get() method.
 // If the key doesn't exist, returns nil for Value.Bytes.
 type GetResponse struct {
-	ResponseHeader
-	Value Value
+	ResponseHeader `protobuf:"1"`
+	Value          Value `protobuf:"2"`
 }
 
 // A PutRequest is arguments to the Put() method.
@@ -101,84 +244,170 @@ type GetResponse struct {
 // - If key doesn't exist and ExpValue is empty, sets value.
 // - Otherwise, returns error.
 type PutRequest struct {
-	RequestHeader
-	Key      Key    // must be non-empty
-	Value    Value  // The value to put
-	ExpValue *Value // ExpValue.Bytes empty to test for non-existence
+	RequestHeader `protobuf:"1"`
+	Key           Key    `protobuf:"2"` // must be non-empty
+	Value         Value  `protobuf:"3"` // The value to put
+	ExpValue      *Value `protobuf:"4"` // ExpValue.Bytes empty to test for non-existence
 }
 
 // A PutResponse is the return value form the Put() method.
 type PutResponse struct {
-	ResponseHeader
-	ActualValue *Value // ActualValue.Bytes set if conditional put failed
+	ResponseHeader `protobuf:"1"`
+	ActualValue    *Value `protobuf:"2"` // ActualValue.Bytes set if conditional put failed
 }
 
 // An IncrementRequest is arguments to the Increment() method. It
 // increments the value for key, interpreting the existing value as a
 // varint64.
 type IncrementRequest struct {
-	RequestHeader
-	Key       Key
-	Increment int64
+	RequestHeader `protobuf:"1"`
+	Key           Key   `protobuf:"2"`
+	Increment     int64 `protobuf:"3"`
 }
 
 // An IncrementResponse is the return value from the Increment
 // method. The new value after increment is specified in NewValue. If
 // the value could not be decoded as specified, Error will be set.
 type IncrementResponse struct {
-	ResponseHeader
-	NewValue int64
+	ResponseHeader `protobuf:"1"`
+	NewValue       int64 `protobuf:"2"`
+}
+
+// An AppendRequest is arguments to the Append() method. It appends
+// Value.Bytes to the existing value for key, creating the value if it
+// doesn't exist, so that log-style values can be extended without
+// first being read. The other fields of Value replace those of the
+// existing value. If MaxLength is positive, an append which would
+// take the value's length past it fails with an AppendTooLargeError,
+// leaving the value unchanged.
+type AppendRequest struct {
+	RequestHeader `protobuf:"1"`
+	Key           Key   `protobuf:"2"`
+	Value         Value `protobuf:"3"`
+	MaxLength     int64 `protobuf:"4"`
+}
+
+// An AppendResponse is the return value from the Append() method.
+// NewLength is the length of the value after appending.
+type AppendResponse struct {
+	ResponseHeader `protobuf:"1"`
+	NewLength      int64 `protobuf:"2"`
+}
+
+// A GetByteRangeRequest is arguments to the GetByteRange() method. It
+// specifies Length bytes of the value for key starting at Offset.
+// Length 0 reads through the end of the value.
+type GetByteRangeRequest struct {
+	RequestHeader `protobuf:"1"`
+	Key           Key   `protobuf:"2"`
+	Offset        int64 `protobuf:"3"`
+	Length        int64 `protobuf:"4"`
+}
+
+// A GetByteRangeResponse is the return value from the GetByteRange()
+// method. Bytes is truncated if the requested range extends past the
+// end of the value, and is empty if the value doesn't exist. Length is
+// the length of the entire value.
+type GetByteRangeResponse struct {
+	ResponseHeader `protobuf:"1"`
+	Bytes          []byte `protobuf:"2"`
+	Length         int64  `protobuf:"3"`
 }
 
 // A DeleteRequest is arguments to the Delete() method.
 type DeleteRequest struct {
-	RequestHeader
-	Key Key
+	RequestHeader `protobuf:"1"`
+	Key           Key `protobuf:"2"`
 }
 
 // A DeleteResponse is the return value from the Delete() method.
 type DeleteResponse struct {
-	ResponseHeader
+	ResponseHeader `protobuf:"1"`
 }
 
 // A DeleteRangeRequest is arguments to the DeleteRange method. It
 // specifies the range of keys to delete.
 type DeleteRangeRequest struct {
-	RequestHeader
-	StartKey Key // Empty to start at first key
-	EndKey   Key // Non-inclusive; if empty, deletes all
+	RequestHeader `protobuf:"1"`
+	StartKey      Key `protobuf:"2"` // Empty to start at first key
+	EndKey        Key `protobuf:"3"` // Non-inclusive; if empty, deletes all
 }
 
 // A DeleteRangeResponse is the return value from the DeleteRange()
 // method.
 type DeleteRangeResponse struct {
-	ResponseHeader
-	NumDeleted uint64
+	ResponseHeader `protobuf:"1"`
+	NumDeleted     uint64 `protobuf:"2"`
 }
 
 // A ScanRequest is arguments to the Scan() method. It specifies the
 // start and end keys for the scan and the maximum number of results.
+// MaxBytes and MaxBytesPerSecond optionally limit the size of the
+// results and the rate at which they're read, so that a large scan
+// doesn't monopolize a node; a scan stopped by either limit returns a
+// ResumeKey from which to continue.
 type ScanRequest struct {
-	RequestHeader
-	StartKey   Key   // Empty to start at first key
-	EndKey     Key   // Optional max key; empty to ignore
-	MaxResults int64 // Must be > 0
+	RequestHeader     `protobuf:"1"`
+	StartKey          Key   `protobuf:"2"` // Empty to start at first key
+	EndKey            Key   `protobuf:"3"` // Optional max key; empty to ignore
+	MaxResults        int64 `protobuf:"4"` // Must be > 0
+	MaxBytes          int64 `protobuf:"5"` // Maximum bytes of keys and values; 0 for no limit
+	MaxBytesPerSecond int64 `protobuf:"6"` // Maximum read rate; 0 for no limit
+	// Reverse returns rows in descending key order, beginning with the
+	// last key before EndKey, which must be set. Over prefixes whose
+	// keys embed sequence numbers or timestamps, as big-endian
+	// suffixes, this enumerates the latest entries first, so the
+	// latest N are read without scanning the rest.
+	Reverse bool `protobuf:"7"`
+	// IncludeIntents reports the write intents of transactions within
+	// the span scanned in the response's Intents. Rows hold the
+	// committed values of the keys, as for any read outside a
+	// transaction; the scan neither blocks on intents nor pushes their
+	// transactions. For debugging and transaction-aware consumers.
+	IncludeIntents bool `protobuf:"8"`
+}
+
+// An IntentInfo describes a write intent encountered by a scan.
+type IntentInfo struct {
+	Key         Key    `protobuf:"1"`
+	TxnID       string `protobuf:"2"`
+	TxnPriority int32  `protobuf:"3"` // The priority of the intent's transaction
+	Timestamp   int64  `protobuf:"4"` // The timestamp of the intent
 }
 
 // A ScanResponse is the return value from the Scan() method.
 type ScanResponse struct {
-	ResponseHeader
-	Rows []KeyValue // Empty if no rows were scanned
+	ResponseHeader `protobuf:"1"`
+	Rows           []KeyValue `protobuf:"2"` // Empty if no rows were scanned
+	// ResumeKey is set if the scan stopped at MaxBytes or was paced
+	// past its time limit, to the StartKey from which to resume, or
+	// for reverse scans, the EndKey.
+	ResumeKey Key `protobuf:"3"`
+	// Intents holds the write intents encountered, in scan order, if
+	// the request set IncludeIntents.
+	Intents []IntentInfo `protobuf:"4"`
 }
 
+// Limits on the writes of a single transaction. Write intents are
+// held by their ranges until the transaction ends and resolves them
+// all at once, so an unbounded transaction could stall its ranges and
+// exhaust the memory of the node ending it. Writes beyond either
+// limit fail with a TxnTooLargeError; updates too large for one
+// transaction may be applied in chunks with kv.ApplyChunked.
+const (
+	MaxTxnKeys  = 10000    // Maximum distinct keys written
+	MaxTxnBytes = 16 << 20 // Maximum bytes of keys and values written
+)
+
 // An EndTransactionRequest is arguments to the EndTransaction() method.
 // It specifies whether to commit or roll back an extant transaction.
 // It also lists the keys involved in the transaction so their write
-// intents may be aborted or committed.
+// intents may be aborted or committed. It's sent to the range holding
+// the transaction's record; see TxnRecordKey.
 type EndTransactionRequest struct {
-	RequestHeader
-	Commit bool  // False to abort and rollback
-	Keys   []Key // Write-intent keys to commit or abort
+	RequestHeader `protobuf:"1"`
+	Commit        bool  `protobuf:"2"` // False to abort and rollback
+	Keys          []Key `protobuf:"3"` // Write-intent keys to commit or abort
 }
 
 // An EndTransactionResponse is the return value from the
@@ -188,39 +417,89 @@ type EndTransactionRequest struct {
 // MUST wait before signalling completion of the transaction to another
 // distributed node to maintain consistency.
 type EndTransactionResponse struct {
-	ResponseHeader
-	CommitTimestamp int64 // Unix nanos (us)
-	CommitWait      int64 // Remaining with (us)
+	ResponseHeader  `protobuf:"1"`
+	CommitTimestamp int64 `protobuf:"2"` // Unix nanos (us)
+	CommitWait      int64 `protobuf:"3"` // Remaining with (us)
 }
 
 // An AccumulateTSRequest is arguments to the AccumulateTS() method.
 // It specifies the key at which to accumulate TS values, and the
 // time series counts for this discrete time interval.
 type AccumulateTSRequest struct {
-	RequestHeader
-	Key    Key
-	Counts []int64 // One per discrete subtime period (e.g. one/minute or one/second)
+	RequestHeader `protobuf:"1"`
+	Key           Key     `protobuf:"2"`
+	Counts        []int64 `protobuf:"3"` // One per discrete subtime period (e.g. one/minute or one/second)
 }
 
 // An AccumulateTSResponse is the return value from the AccumulateTS()
 // method.
 type AccumulateTSResponse struct {
-	ResponseHeader
+	ResponseHeader `protobuf:"1"`
+}
+
+// A GetTSBlockRequest is arguments to the GetTSBlock() method. It
+// specifies the span of keys holding time series, accumulated by
+// AccumulateTS, to read, and the maximum number of keys to return;
+// MaxKeys 0 returns as many as a single reply allows.
+type GetTSBlockRequest struct {
+	RequestHeader `protobuf:"1"`
+	StartKey      Key   `protobuf:"2"` // Empty to start at first key
+	EndKey        Key   `protobuf:"3"` // Non-inclusive; must be set
+	MaxKeys       int64 `protobuf:"4"`
+}
+
+// A GetTSBlockResponse is the return value from the GetTSBlock()
+// method. The time series of adjacent keys are packed into a single
+// block: Counts holds each key's counts in turn, Lengths[i] of them
+// for Keys[i]. ResumeKey is set if the reply stopped before EndKey,
+// either at MaxKeys or at the end of the range, to the StartKey from
+// which to resume.
+type GetTSBlockResponse struct {
+	ResponseHeader `protobuf:"1"`
+	Keys           []Key   `protobuf:"2"`
+	Lengths        []int32 `protobuf:"3"`
+	Counts         []int64 `protobuf:"4"`
+	ResumeKey      Key     `protobuf:"5"`
 }
 
 // A ReapQueueRequest is arguments to the ReapQueue() method. It
 // specifies the recipient inbox key to which messages are waiting
-// to be reapted and also the maximum number of results to return.
+// to be reaped, the maximum number of results to return, and how
+// long reaped messages remain invisible to other reapers unless
+// acknowledged. Messages reaped MaxDeliveries times without being
+// acknowledged are moved to the inbox's dead-letter queue instead of
+// being delivered again.
 type ReapQueueRequest struct {
-	RequestHeader
-	Inbox      Key   // Recipient inbox key
-	MaxResults int64 // Maximum results to return; must be > 0
+	RequestHeader     `protobuf:"1"`
+	Inbox             Key   `protobuf:"2"` // Recipient inbox key
+	MaxResults        int64 `protobuf:"3"` // Maximum results to return; must be > 0
+	VisibilityTimeout int64 `protobuf:"4"` // In nanoseconds; 0 for DefaultQueueVisibilityTimeout
+	MaxDeliveries     int32 `protobuf:"5"` // 0 to redeliver unacknowledged messages indefinitely
+	DeadLetter        bool  `protobuf:"6"` // Reap from the inbox's dead-letter queue instead
 }
 
 // A ReapQueueResponse is the return value from the ReapQueue() method.
+// Messages are in the order in which they were enqueued.
 type ReapQueueResponse struct {
-	ResponseHeader
-	Messages []Value
+	ResponseHeader `protobuf:"1"`
+	Messages       []QueueMessage `protobuf:"2"`
+	DeadLettered   int64          `protobuf:"3"` // Messages moved to the dead-letter queue
+}
+
+// An AckQueueRequest is arguments to the AckQueue() method. It
+// specifies the inbox and the IDs of reaped messages whose processing
+// is complete, which are deleted.
+type AckQueueRequest struct {
+	RequestHeader `protobuf:"1"`
+	Inbox         Key     `protobuf:"2"` // Recipient inbox key
+	IDs           []int64 `protobuf:"3"` // IDs of the messages to acknowledge
+	DeadLetter    bool    `protobuf:"4"` // The messages are in the dead-letter queue
+}
+
+// An AckQueueResponse is the return value from the AckQueue() method.
+type AckQueueResponse struct {
+	ResponseHeader `protobuf:"1"`
+	Acked          int64 `protobuf:"2"` // Messages deleted; already deleted messages aren't counted
 }
 
 // An EnqueueUpdateRequest is arguments to the EnqueueUpdate() method.
@@ -229,37 +508,506 @@ type ReapQueueResponse struct {
 // IncrementRequest, DeleteRequest, DeleteRangeRequest, or
 // AccountingRequest.
 type EnqueueUpdateRequest struct {
-	RequestHeader
-	Update interface{}
+	RequestHeader `protobuf:"1"`
+	Update        interface{} `protobuf:"2"`
 }
 
 // An EnqueueUpdateResponse is the return value from the
 // EnqueueUpdate() method.
 type EnqueueUpdateResponse struct {
-	ResponseHeader
+	ResponseHeader `protobuf:"1"`
 }
 
 // An EnqueueMessageRequest is arguments to the EnqueueMessage() method.
 // It specifies the recipient inbox key and the message (an arbitrary
 // byte slice value).
 type EnqueueMessageRequest struct {
-	RequestHeader
-	Inbox   Key   // Recipient key
-	Message Value // Message value to delivery to inbox
+	RequestHeader `protobuf:"1"`
+	Inbox         Key   `protobuf:"2"` // Recipient key
+	Message       Value `protobuf:"3"` // Message value to delivery to inbox
 }
 
 // An EnqueueMessageResponse is the return value from the
 // EnqueueMessage() method.
 type EnqueueMessageResponse struct {
-	ResponseHeader
+	ResponseHeader `protobuf:"1"`
+	ID             int64 `protobuf:"2"` // ID of the enqueued message within its inbox
+}
+
+// An AdminSplitRequest is arguments to the AdminSplit() method. The
+// range containing SplitKey is split in two, with SplitKey becoming
+// the start key of the new range.
+type AdminSplitRequest struct {
+	RequestHeader `protobuf:"1"`
+	SplitKey      Key `protobuf:"2"`
+}
+
+// An AdminSplitResponse is the return value from the AdminSplit()
+// method. It returns the locations of the newly created range.
+type AdminSplitResponse struct {
+	ResponseHeader `protobuf:"1"`
+	NewRange       RangeLocations `protobuf:"2"`
+}
+
+// An AdminMergeRequest is arguments to the AdminMerge() method. The
+// range containing Key is merged with the range which immediately
+// follows it.
+type AdminMergeRequest struct {
+	RequestHeader `protobuf:"1"`
+	Key           Key `protobuf:"2"`
+}
+
+// An AdminMergeResponse is the return value from the AdminMerge()
+// method.
+type AdminMergeResponse struct {
+	ResponseHeader `protobuf:"1"`
+}
+
+// An AdminCompactRequest is arguments to the AdminCompact() method.
+// Each replica of the range containing StartKey deletes the rows
+// hidden by range tombstones from StartKey through EndKey, clamped to
+// the range, and compacts the span's storage.
+type AdminCompactRequest struct {
+	RequestHeader `protobuf:"1"`
+	StartKey      Key `protobuf:"2"`
+	EndKey        Key `protobuf:"3"` // Non-inclusive; if empty, extends to the end of the range
+}
+
+// An AdminCompactResponse is the return value from the AdminCompact()
+// method.
+type AdminCompactResponse struct {
+	ResponseHeader `protobuf:"1"`
+	RowsCompacted  int64 `protobuf:"2"` // Hidden rows deleted, by the replica which deleted the most
+}
+
+// An AdminTransferLeaseRequest is arguments to the
+// AdminTransferLease() method. The lease of the range containing Key
+// is transferred to Target, one of the range's replicas.
+type AdminTransferLeaseRequest struct {
+	RequestHeader `protobuf:"1"`
+	Key           Key     `protobuf:"2"`
+	Target        Replica `protobuf:"3"`
+}
+
+// An AdminTransferLeaseResponse is the return value from the
+// AdminTransferLease() method. It returns the new lease.
+type AdminTransferLeaseResponse struct {
+	ResponseHeader `protobuf:"1"`
+	Lease          Lease `protobuf:"2"`
+}
+
+// An InternalBulkWriteRequest is arguments to the InternalBulkWrite()
+// method. Rows must be non-empty and sorted by key. The range writes
+// the leading rows which it contains, stopping at the first row
+// beyond its end key.
+type InternalBulkWriteRequest struct {
+	RequestHeader `protobuf:"1"`
+	Rows          []KeyValue `protobuf:"2"`
+}
+
+// An InternalBulkWriteResponse is the return value from the
+// InternalBulkWrite() method. Written is the number of leading rows
+// which were written; the remainder belong to subsequent ranges.
+type InternalBulkWriteResponse struct {
+	ResponseHeader `protobuf:"1"`
+	Written        int `protobuf:"2"`
+}
+
+// An InternalDebugScanRequest is arguments to the InternalDebugScan()
+// method. It scans the engine of the store holding the replica
+// specified in the header from StartKey to EndKey, regardless of
+// range boundaries, so that store-local system keys may be inspected.
+type InternalDebugScanRequest struct {
+	RequestHeader `protobuf:"1"`
+	StartKey      Key   `protobuf:"2"`
+	EndKey        Key   `protobuf:"3"`
+	MaxResults    int64 `protobuf:"4"`
+}
+
+// An InternalDebugScanResponse is the return value from the
+// InternalDebugScan() method. Rows are returned exactly as stored,
+// with values compressed, if they were when written.
+type InternalDebugScanResponse struct {
+	ResponseHeader `protobuf:"1"`
+	Rows           []KeyValue `protobuf:"2"`
+}
+
+// An InternalRaftMessageRequest is arguments to the
+// InternalRaftMessage() method. It delivers a raft message to the
+// replica specified by the header, which must be Message.To.
+type InternalRaftMessageRequest struct {
+	RequestHeader `protobuf:"1"`
+	Message       RaftMessage `protobuf:"2"`
+}
+
+// An InternalRaftMessageResponse is the return value from the
+// InternalRaftMessage() method. Raft messages are one way; replies
+// are sent as messages of their own.
+type InternalRaftMessageResponse struct {
+	ResponseHeader `protobuf:"1"`
+}
+
+// An InternalSnapshotChunkRequest is arguments to the
+// InternalSnapshotChunk() method. It fetches rows of the raft
+// snapshot at Index held by the replica specified by the header,
+// beginning with the row at Offset, up to approximately MaxBytes.
+type InternalSnapshotChunkRequest struct {
+	RequestHeader `protobuf:"1"`
+	Index         int64 `protobuf:"2"` // Log index of the snapshot
+	Offset        int   `protobuf:"3"` // Index of the first row to return
+	MaxBytes      int64 `protobuf:"4"` // Approximate limit on the size of rows returned
+}
+
+// An InternalSnapshotChunkResponse is the return value from the
+// InternalSnapshotChunk() method.
+type InternalSnapshotChunkResponse struct {
+	ResponseHeader `protobuf:"1"`
+	Rows           []KeyValue `protobuf:"2"`
+	More           bool       `protobuf:"3"` // True if rows follow those returned
+}
+
+// An InternalChangeReplicasRequest is arguments to the
+// InternalChangeReplicas() method. It replaces the replicas of the
+// range with Replicas, which must include the leader's replica.
+type InternalChangeReplicasRequest struct {
+	RequestHeader `protobuf:"1"`
+	Replicas      []Replica `protobuf:"2"`
+}
+
+// An InternalChangeReplicasResponse is the return value from the
+// InternalChangeReplicas() method.
+type InternalChangeReplicasResponse struct {
+	ResponseHeader `protobuf:"1"`
+}
+
+// An InternalSplitRequest is arguments to the InternalSplit() method.
+// It truncates the range to end at SplitKey; the range spanning from
+// SplitKey to the range's end key is created with NewReplicas, one on
+// the store of each of the range's replicas.
+type InternalSplitRequest struct {
+	RequestHeader `protobuf:"1"`
+	SplitKey      Key       `protobuf:"2"`
+	NewReplicas   []Replica `protobuf:"3"`
+}
+
+// An InternalSplitResponse is the return value from the
+// InternalSplit() method.
+type InternalSplitResponse struct {
+	ResponseHeader `protobuf:"1"`
+}
+
+// An InternalSubsumeRequest is arguments to the InternalSubsume()
+// method. It freezes the range's data ahead of its merge with the
+// range preceding it; the range refuses read-write commands
+// thereafter.
+type InternalSubsumeRequest struct {
+	RequestHeader `protobuf:"1"`
+}
+
+// An InternalSubsumeResponse is the return value from the
+// InternalSubsume() method. Index and Term are the raft log index and
+// term of the subsumption, which each replica must have applied before
+// merging.
+type InternalSubsumeResponse struct {
+	ResponseHeader `protobuf:"1"`
+	Index          int64 `protobuf:"2"`
+	Term           int64 `protobuf:"3"`
+}
+
+// An InternalMergeRequest is arguments to the InternalMerge() method.
+// It extends the range over the range following it, with replicas
+// SubsumedReplicas, once each replica of the subsumed range has
+// applied its log through the subsumption, at SubsumedIndex in term
+// SubsumedTerm; see InternalSubsume.
+type InternalMergeRequest struct {
+	RequestHeader    `protobuf:"1"`
+	SubsumedReplicas []Replica `protobuf:"2"`
+	SubsumedIndex    int64     `protobuf:"3"`
+	SubsumedTerm     int64     `protobuf:"4"`
+}
+
+// An InternalMergeResponse is the return value from the
+// InternalMerge() method.
+type InternalMergeResponse struct {
+	ResponseHeader `protobuf:"1"`
+}
+
+// An InternalTouchRequest is arguments to the InternalTouch() method.
+// It extends the lifetime of the value at Key, in a span with a
+// sliding TTL, by setting its expiration to Expiration.
+type InternalTouchRequest struct {
+	RequestHeader `protobuf:"1"`
+	Key           Key   `protobuf:"2"`
+	Expiration    int64 `protobuf:"3"`
+}
+
+// An InternalTouchResponse is the return value from the
+// InternalTouch() method. Touched is false if the value was absent or
+// already expired later.
+type InternalTouchResponse struct {
+	ResponseHeader `protobuf:"1"`
+	Touched        bool `protobuf:"2"`
+}
+
+// An InternalPushTxnRequest is arguments to the InternalPushTxn()
+// method. It's sent to the range holding the record of the pushee
+// transaction, at Key, by a request blocked by one of its write
+// intents, and aborts the pushee if the pusher's priority, set in the
+// header, is higher. The pushee's priority and the timestamp of its
+// intent are taken from the write intent, as the pushee may not have
+// a record yet.
+type InternalPushTxnRequest struct {
+	RequestHeader   `protobuf:"1"`
+	Key             Key    `protobuf:"2"` // The pushee's record key; see TxnRecordKey
+	PusheeTxID      string `protobuf:"3"`
+	PusheePriority  int32  `protobuf:"4"`
+	PusheeTimestamp int64  `protobuf:"5"`
+}
+
+// An InternalPushTxnResponse is the return value from the
+// InternalPushTxn() method. Pushee is the pushee's record after the
+// push: committed or aborted, as the pusher may then resolve the
+// write intent blocking it. A push of a pending transaction which
+// can't be aborted fails with a TransactionPushError.
+type InternalPushTxnResponse struct {
+	ResponseHeader `protobuf:"1"`
+	Pushee         Transaction `protobuf:"2"`
+}
+
+// An InternalResolveIntentRequest is arguments to the
+// InternalResolveIntent() method. It resolves the write intent on Key
+// of the ended transaction IntentTxID: committed intents replace the
+// key's value, and aborted intents are removed.
+type InternalResolveIntentRequest struct {
+	RequestHeader `protobuf:"1"`
+	Key           Key    `protobuf:"2"`
+	IntentTxID    string `protobuf:"3"`
+	Commit        bool   `protobuf:"4"`
+}
+
+// An InternalResolveIntentResponse is the return value from the
+// InternalResolveIntent() method.
+type InternalResolveIntentResponse struct {
+	ResponseHeader `protobuf:"1"`
+}
+
+// An InternalTxnResolvedRequest is arguments to the
+// InternalTxnResolved() method. It's sent to the range holding the
+// record of the ended transaction TxID, at Key, once the write intents
+// it lists have all been resolved, so that the record may be garbage
+// collected.
+type InternalTxnResolvedRequest struct {
+	RequestHeader `protobuf:"1"`
+	Key           Key    `protobuf:"2"` // The transaction's record key; see TxnRecordKey
+	TxID          string `protobuf:"3"`
+}
+
+// An InternalTxnResolvedResponse is the return value from the
+// InternalTxnResolved() method.
+type InternalTxnResolvedResponse struct {
+	ResponseHeader `protobuf:"1"`
+}
+
+// An InternalComputeChecksumRequest is arguments to the
+// InternalComputeChecksum() method. Each replica executing the
+// command computes a checksum of its data, retained under ChecksumID
+// for collection via InternalChecksum().
+type InternalComputeChecksumRequest struct {
+	RequestHeader `protobuf:"1"`
+	ChecksumID    int64 `protobuf:"2"`
+}
+
+// An InternalComputeChecksumResponse is the return value from the
+// InternalComputeChecksum() method.
+type InternalComputeChecksumResponse struct {
+	ResponseHeader `protobuf:"1"`
+}
+
+// An InternalChecksumRequest is arguments to the InternalChecksum()
+// method. It collects the checksum the replica specified by the
+// header computed on executing the InternalComputeChecksum command
+// with ChecksumID.
+type InternalChecksumRequest struct {
+	RequestHeader `protobuf:"1"`
+	ChecksumID    int64 `protobuf:"2"`
+}
+
+// An InternalChecksumResponse is the return value from the
+// InternalChecksum() method.
+type InternalChecksumResponse struct {
+	ResponseHeader `protobuf:"1"`
+	Checksum       []byte `protobuf:"2"`
+}
+
+// An InternalQuarantineReplicaRequest is arguments to the
+// InternalQuarantineReplica() method. It takes the replica specified
+// by the header offline for inspection.
+type InternalQuarantineReplicaRequest struct {
+	RequestHeader `protobuf:"1"`
+}
+
+// An InternalQuarantineReplicaResponse is the return value from the
+// InternalQuarantineReplica() method.
+type InternalQuarantineReplicaResponse struct {
+	ResponseHeader `protobuf:"1"`
+}
+
+// An InternalLeaseRequest is arguments to the InternalLease() method.
+// It acquires or extends the range's lease for Lease.Replica.
+type InternalLeaseRequest struct {
+	RequestHeader `protobuf:"1"`
+	Lease         Lease `protobuf:"2"`
+}
+
+// An InternalLeaseResponse is the return value from the
+// InternalLease() method. Lease is the lease granted.
+type InternalLeaseResponse struct {
+	ResponseHeader `protobuf:"1"`
+	Lease          Lease `protobuf:"2"`
+}
+
+// An InternalCreateReplicaRequest is arguments to the
+// InternalCreateReplica() method. It creates an empty replica of the
+// range spanning StartKey to EndKey on the store specified by the
+// header, which awaits a snapshot of the range's data from its
+// leader. Replicas are the replicas of the range once the new replica
+// is added, including the new replica itself without a range ID.
+type InternalCreateReplicaRequest struct {
+	RequestHeader `protobuf:"1"`
+	StartKey      Key       `protobuf:"2"`
+	EndKey        Key       `protobuf:"3"`
+	Replicas      []Replica `protobuf:"4"`
+}
+
+// An InternalCreateReplicaResponse is the return value from the
+// InternalCreateReplica() method. The ResponseHeader's Replica is the
+// new replica.
+type InternalCreateReplicaResponse struct {
+	ResponseHeader `protobuf:"1"`
+}
+
+// An InternalRemoveReplicaRequest is arguments to the
+// InternalRemoveReplica() method. It removes the replica specified by
+// the header, and its data, from its store.
+type InternalRemoveReplicaRequest struct {
+	RequestHeader `protobuf:"1"`
+}
+
+// An InternalRemoveReplicaResponse is the return value from the
+// InternalRemoveReplica() method.
+type InternalRemoveReplicaResponse struct {
+	ResponseHeader `protobuf:"1"`
+}
+
+// An InternalAllocateRangeIDRequest is arguments to the
+// InternalAllocateRangeID() method. It allocates a range ID on the
+// store specified by the header, for its replica of a range being
+// split from one of its ranges.
+type InternalAllocateRangeIDRequest struct {
+	RequestHeader `protobuf:"1"`
+}
+
+// An InternalAllocateRangeIDResponse is the return value from the
+// InternalAllocateRangeID() method.
+type InternalAllocateRangeIDResponse struct {
+	ResponseHeader `protobuf:"1"`
+	RangeID        int64 `protobuf:"2"`
+}
+
+// A ChangeOp is the type of change described by a ChangeEvent.
+type ChangeOp int
+
+// Change operations.
+const (
+	// ChangePut indicates the key was written with Value.
+	ChangePut ChangeOp = iota
+	// ChangeDelete indicates the key was deleted.
+	ChangeDelete
+	// ChangeResync indicates events were lost, for example because a
+	// watcher fell too far behind. Watchers should re-read the span.
+	ChangeResync
+)
+
+// A ChangeEvent describes a change to the value of a key.
+type ChangeEvent struct {
+	Seq       int64    `protobuf:"1"` // Sequence number in the range's event feed
+	Op        ChangeOp `protobuf:"2"`
+	Key       Key      `protobuf:"3"`
+	Value     Value    `protobuf:"4"` // The new value; empty for deletes
+	Timestamp int64    `protobuf:"5"` // Wall time of the change in nanoseconds
+}
+
+// An InternalWatchRequest is arguments to the InternalWatch() method.
+// It requests change events for keys in [StartKey, EndKey) which
+// follow the event with sequence number Seq in the range's feed. A
+// negative Seq returns the range's current sequence number without
+// events. If RangeID is non-zero and doesn't match the range, Seq
+// refers to another range's feed and all retained events are
+// returned.
+type InternalWatchRequest struct {
+	RequestHeader `protobuf:"1"`
+	StartKey      Key   `protobuf:"2"`
+	EndKey        Key   `protobuf:"3"`
+	Seq           int64 `protobuf:"4"`
+	RangeID       int64 `protobuf:"5"`
+	MaxWait       int64 `protobuf:"6"` // Nanoseconds to wait for events, if none are available
+}
+
+// An InternalWatchResponse is the return value from the
+// InternalWatch() method. Seq is the sequence number from which to
+// continue watching. RangeID and EndKey identify the range which
+// served the request; keys at and beyond EndKey must be watched via
+// the following range.
+type InternalWatchResponse struct {
+	ResponseHeader `protobuf:"1"`
+	Events         []ChangeEvent `protobuf:"2"`
+	Seq            int64         `protobuf:"3"`
+	Truncated      bool          `protobuf:"4"` // Events following the requested Seq were dropped
+	RangeID        int64         `protobuf:"5"`
+	EndKey         Key           `protobuf:"6"`
+}
+
+// An InternalResolvedTimestampRequest is arguments to the
+// InternalResolvedTimestamp() method. It requests the resolved
+// timestamp of the range containing Key.
+type InternalResolvedTimestampRequest struct {
+	RequestHeader `protobuf:"1"`
+	Key           Key `protobuf:"2"`
+}
+
+// An InternalResolvedTimestampResponse is the return value from the
+// InternalResolvedTimestamp() method. All writes to the range at or
+// below Timestamp have been resolved, and no more will be accepted.
+// EndKey is the end of the range which served the request; keys at
+// and beyond it must be queried via the following range.
+type InternalResolvedTimestampResponse struct {
+	ResponseHeader `protobuf:"1"`
+	Timestamp      int64 `protobuf:"2"`
+	EndKey         Key   `protobuf:"3"`
+}
+
+// An InternalCloseTimestampRequest is arguments to the
+// InternalCloseTimestamp() method. Timestamp is the range's resolved
+// timestamp, as computed by the lease holder.
+type InternalCloseTimestampRequest struct {
+	RequestHeader `protobuf:"1"`
+	Timestamp     int64 `protobuf:"2"`
+}
+
+// An InternalCloseTimestampResponse is the return value from the
+// InternalCloseTimestamp() method. Timestamp is the replica's resolved
+// timestamp once the command is applied.
+type InternalCloseTimestampResponse struct {
+	ResponseHeader `protobuf:"1"`
+	Timestamp      int64 `protobuf:"2"`
 }
 
 // An InternalRangeLookupRequest is arguments to the InternalRangeLookup()
 // method. It specifies the key for range lookup, which is a system key prefixed
 // by KeyMeta1Prefix or KeyMeta2Prefix to the user key.
 type InternalRangeLookupRequest struct {
-	RequestHeader
-	Key Key
+	RequestHeader `protobuf:"1"`
+	Key           Key `protobuf:"2"`
 }
 
 // An InternalRangeLookupResponse is the return value from the
@@ -269,7 +1017,7 @@ type InternalRangeLookupRequest struct {
 // for the key. And when looking up 2-level metadata, it returns the
 // info for the range possibly containing the actual key and its value.
 type InternalRangeLookupResponse struct {
-	ResponseHeader
-	EndKey    Key // The key in datastore whose value is the Locations object.
-	Locations RangeLocations
+	ResponseHeader `protobuf:"1"`
+	EndKey         Key            `protobuf:"2"` // The key in datastore whose value is the Locations object.
+	Locations      RangeLocations `protobuf:"3"`
 }
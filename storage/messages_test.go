@@ -0,0 +1,122 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/util/protobuf"
+)
+
+// readSchema returns the text of the .proto files describing the
+// storage package's messages.
+func readSchema(t *testing.T) string {
+	var schema []byte
+	for _, file := range []string{"data.proto", "errors.proto", "api.proto"} {
+		b, err := ioutil.ReadFile("../proto/" + file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		schema = append(schema, b...)
+	}
+	return string(schema)
+}
+
+// TestMessagesMatchSchema verifies the errors, the updates of
+// EnqueueUpdate and the arguments and replies of read-write commands
+// match their declarations in the proto directory.
+func TestMessagesMatchSchema(t *testing.T) {
+	prototypes := []interface{}{
+		&GenericError{}, &ServerBusyError{}, &WriteIntentError{}, &WriteTooOldError{},
+		&TxnTooLargeError{}, &AppendTooLargeError{}, &TransactionAbortedError{},
+		&TransactionPushError{}, &NotLeaderError{}, &NotLeaseHolderError{},
+		&PermissionDeniedError{}, &SpanFrozenError{}, &ReservedKeyError{}, &RangeSubsumedError{},
+		&EnqueueUpdateRequest{}, &PutRequest{}, &IncrementRequest{}, &DeleteRequest{}, &DeleteRangeRequest{},
+		&InternalRaftMessageRequest{},
+	}
+	for _, newReply := range raftReplies {
+		prototypes = append(prototypes, newReply())
+	}
+	if err := protobuf.CheckSchema(readSchema(t), prototypes...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestMessagesRoundTrip verifies requests and replies, including
+// their errors and updates, are decoded as encoded.
+func TestMessagesRoundTrip(t *testing.T) {
+	leader := Replica{NodeID: 2, StoreID: 3, RangeID: 4, Datacenter: "dc", DiskType: HDD}
+	testCases := []struct {
+		msg, decoded interface{}
+	}{
+		{
+			&GetRequest{
+				RequestHeader: RequestHeader{
+					Timestamp:       1,
+					User:            "user",
+					Replica:         leader,
+					CmdID:           ClientCmdID{WallTime: 5, Random: -6},
+					Compression:     &CompressionOptions{Codec: CompressionDictionary, RequestThreshold: 100},
+					ReadConsistency: BOUNDED,
+					Priority:        0.5,
+				},
+				Key: Key("a"),
+			},
+			&GetRequest{},
+		},
+		{
+			&PutResponse{
+				ResponseHeader: ResponseHeader{Error: &NotLeaderError{Replica: Replica{NodeID: 1}, Leader: &leader}, TxID: "txn"},
+				ActualValue:    &Value{Bytes: []byte("value"), Timestamp: 7},
+			},
+			&PutResponse{},
+		},
+		{
+			&EnqueueUpdateRequest{Update: &IncrementRequest{Key: Key("counter"), Increment: -2}},
+			&EnqueueUpdateRequest{},
+		},
+		{
+			&InternalRaftMessageRequest{Message: RaftMessage{
+				Type:     RaftAppend,
+				To:       leader,
+				Entries:  []RaftEntry{{Term: 1, Index: 2, Command: []byte("cmd")}, {Term: 1, Index: 3}},
+				Snapshot: &RaftSnapshot{Index: 2, Rows: []KeyValue{{Key: Key("k"), Value: Value{Bytes: []byte("v")}}}},
+			}},
+			&InternalRaftMessageRequest{},
+		},
+		{
+			&ScanResponse{
+				Rows:    []KeyValue{{Key: Key("a")}, {Key: Key("b"), Value: Value{Expiration: 9}}},
+				Intents: []IntentInfo{{Key: Key("c"), TxnID: "txn", TxnPriority: 3}},
+			},
+			&ScanResponse{},
+		},
+	}
+	for i, test := range testCases {
+		data, err := protobuf.Marshal(test.msg)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if err := protobuf.Unmarshal(data, test.decoded); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if !reflect.DeepEqual(test.msg, test.decoded) {
+			t.Errorf("%d: expected %+v; got %+v", i, test.msg, test.decoded)
+		}
+	}
+}
@@ -0,0 +1,658 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"math"
+
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/encoding"
+)
+
+// keyMVCCPrefix is the prefix for store-local keys holding the MVCC
+// metadata and versions of keys; see MVCC. Unlike other store-local
+// keys, they're replicated: they're included in the range's data by
+// Range.replicatedRows, and counted by its stats.
+var keyMVCCPrefix = Key("\x00\x00\x00mvcc-")
+
+// MVCC provides multi-version concurrency control on top of an
+// Engine. Each write adds a version of its key at the write's
+// timestamp rather than overwriting the previous value, so that reads
+// may be served at any timestamp whose versions haven't been garbage
+// collected. Transactional writes are laid down as write intents,
+// which block conflicting reads and writes until the transaction
+// resolves them.
+//
+// The latest committed version of each key is stored as a plain row
+// at the key itself, so that reads of latest values, and the
+// accounting, watchers and range tombstones which deal in plain rows,
+// are unaffected by versioning. The versions it superseded, the
+// deletions and the write intents are stored under keyMVCCPrefix,
+// apart from plain rows, so that scans of plain rows never return
+// them and user keys can't collide with them: each key's metadata
+// entry, present while it has a write intent, followed by its
+// versions, newest first; see mvccEncodeKey.
+//
+// A plain row may also be removed without a deletion being written,
+// as when it expires or is hidden by a range tombstone. The key then
+// reads as absent from its newest stored version on.
+type MVCC struct {
+	engine Engine
+}
+
+// MVCCMetadata describes the write intent on a key. It's stored under
+// the key's metadata entry, which exists only while the key has an
+// intent.
+type MVCCMetadata struct {
+	// TxnID is the ID of the transaction which wrote the intent.
+	TxnID string
+	// TxnPriority is the priority of the transaction which wrote the
+	// intent. See InternalPushTxn.
+	TxnPriority int32
+	// Timestamp is the timestamp of the intent.
+	Timestamp int64
+}
+
+// mvccVersion is the encoding of a version of a key.
+type mvccVersion struct {
+	Value   Value
+	Deleted bool // True for versions written by deletions
+}
+
+// NewMVCC returns an MVCC storing versioned keys in engine.
+func NewMVCC(engine Engine) *MVCC {
+	return &MVCC{engine: engine}
+}
+
+// batch invokes fn with an MVCC whose writes are buffered in a batch
+// of writes to mvcc's engine, and commits them atomically if fn
+// succeeds. Operations writing several keys, such as a version and
+// the key's metadata, can't then be torn by a crash.
+func (mvcc *MVCC) batch(fn func(bm *MVCC) error) error {
+	b := NewBatch(mvcc.engine)
+	if err := fn(NewMVCC(b)); err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+// Get returns the version of key current at timestamp, which is zero
+// to read the latest version. The value's Bytes are nil if the key
+// didn't exist or was deleted at timestamp. The write intent of
+// txnID, if any, is visible; an intent of another transaction at or
+// before timestamp fails the read with a WriteIntentError.
+func (mvcc *MVCC) Get(key Key, timestamp int64, txnID string) (Value, error) {
+	meta, ok, err := mvcc.getMetadata(key)
+	if err != nil {
+		return Value{}, err
+	}
+	if ok && (meta.TxnID == txnID || timestamp == 0 || meta.Timestamp <= timestamp) {
+		if meta.TxnID != txnID {
+			return Value{}, meta.intentError(key)
+		}
+		version, err := mvcc.getVersion(key, meta.Timestamp)
+		if err != nil || version.Deleted {
+			return Value{}, err
+		}
+		return version.Value, nil
+	}
+	return mvcc.getCommitted(key, timestamp)
+}
+
+// getCommitted returns the committed version of key current at
+// timestamp, or the latest if timestamp is zero.
+func (mvcc *MVCC) getCommitted(key Key, timestamp int64) (Value, error) {
+	plain, err := mvcc.engine.get(key)
+	if err != nil || timestamp == 0 || (plain.Bytes != nil && plain.Timestamp <= timestamp) {
+		return plain, err
+	}
+	kvs, err := mvcc.engine.scan(mvccEncodeKey(key, timestamp), mvccVersionsEnd(key), 1)
+	if err != nil || len(kvs) == 0 {
+		return Value{}, err
+	}
+	version, err := decodeVersion(kvs[0].Value)
+	if err != nil || version.Deleted {
+		return Value{}, err
+	}
+	if plain.Bytes == nil {
+		// The plain row was removed without a deletion.
+		newest, _, err := mvcc.newestCommitted(key)
+		if err != nil || bytes.Equal(newest.Key, kvs[0].Key) {
+			return Value{}, err
+		}
+	}
+	return version.Value, nil
+}
+
+// getVersion returns the version of key stored at timestamp.
+func (mvcc *MVCC) getVersion(key Key, timestamp int64) (mvccVersion, error) {
+	value, err := mvcc.engine.get(mvccEncodeKey(key, timestamp))
+	if err != nil || value.Bytes == nil {
+		return mvccVersion{}, err
+	}
+	return decodeVersion(value)
+}
+
+// newestCommitted returns the row of the newest stored version of key
+// which isn't a write intent, and whether there is one.
+func (mvcc *MVCC) newestCommitted(key Key) (KeyValue, bool, error) {
+	meta, ok, err := mvcc.getMetadata(key)
+	if err != nil {
+		return KeyValue{}, false, err
+	}
+	kvs, err := mvcc.engine.scan(mvccEncodeKey(key, math.MaxInt64), mvccVersionsEnd(key), 2)
+	if err != nil {
+		return KeyValue{}, false, err
+	}
+	for _, kv := range kvs {
+		if !ok || !bytes.Equal(kv.Key, mvccEncodeKey(key, meta.Timestamp)) {
+			return kv, true, nil
+		}
+	}
+	return KeyValue{}, false, nil
+}
+
+// latestTimestamp returns the timestamp of the latest committed
+// version of key, or zero if there is none.
+func (mvcc *MVCC) latestTimestamp(key Key) (int64, error) {
+	plain, err := mvcc.engine.get(key)
+	if err != nil {
+		return 0, err
+	}
+	latest := plain.Timestamp
+	newest, ok, err := mvcc.newestCommitted(key)
+	if err != nil || !ok {
+		return latest, err
+	}
+	if _, timestamp, err := mvccDecodeKey(newest.Key); err != nil {
+		return 0, err
+	} else if timestamp > latest {
+		latest = timestamp
+	}
+	return latest, nil
+}
+
+// Put writes a version of key with value at timestamp. If txn is
+// non-nil, the version is a write intent of that transaction,
+// replacing any intent it wrote previously. Fails with a
+// WriteIntentError if another transaction has an intent on the key,
+// and with a WriteTooOldError if a committed version newer than
+// timestamp exists.
+func (mvcc *MVCC) Put(key Key, timestamp int64, value Value, txn *Transaction) error {
+	return mvcc.batch(func(bm *MVCC) error {
+		return bm.write(key, timestamp, mvccVersion{Value: value}, txn)
+	})
+}
+
+// Delete writes a deletion of key at timestamp, subject to the same
+// conditions as Put. Reads at or after timestamp find no value, while
+// earlier versions remain readable until garbage collected.
+func (mvcc *MVCC) Delete(key Key, timestamp int64, txn *Transaction) error {
+	return mvcc.batch(func(bm *MVCC) error {
+		return bm.write(key, timestamp, mvccVersion{Deleted: true}, txn)
+	})
+}
+
+// write adds version at timestamp to key on behalf of txn, if
+// non-nil. A write intent and its metadata are written separately;
+// see batch.
+func (mvcc *MVCC) write(key Key, timestamp int64, version mvccVersion, txn *Transaction) error {
+	meta, ok, err := mvcc.getMetadata(key)
+	if err != nil {
+		return err
+	}
+	if ok && (txn == nil || meta.TxnID != txn.ID) {
+		return meta.intentError(key)
+	}
+	latest, err := mvcc.latestTimestamp(key)
+	if err != nil {
+		return err
+	}
+	if latest > timestamp {
+		return &WriteTooOldError{Key: key, Timestamp: timestamp, ExistingTimestamp: latest}
+	}
+	version.Value.Timestamp = timestamp
+	if txn == nil {
+		return mvcc.commitVersion(key, version)
+	}
+	// A transaction rewriting its intent replaces it.
+	if ok && meta.Timestamp != timestamp {
+		if err := mvcc.engine.del(mvccEncodeKey(key, meta.Timestamp)); err != nil {
+			return err
+		}
+	}
+	if err := mvcc.putVersion(key, version); err != nil {
+		return err
+	}
+	return mvcc.putMetadata(key, MVCCMetadata{TxnID: txn.ID, TxnPriority: txn.Priority, Timestamp: timestamp})
+}
+
+// commitVersion makes version the latest committed version of key.
+// The plain row it supersedes is kept as a version, unless written at
+// the same timestamp. A deletion removes the plain row and is kept as
+// a version itself, so that reads at earlier timestamps still find
+// the row.
+func (mvcc *MVCC) commitVersion(key Key, version mvccVersion) error {
+	timestamp := version.Value.Timestamp
+	plain, err := mvcc.engine.get(key)
+	if err != nil {
+		return err
+	}
+	if plain.Bytes != nil && plain.Timestamp < timestamp {
+		if err := mvcc.putVersion(key, mvccVersion{Value: plain}); err != nil {
+			return err
+		}
+	}
+	if !version.Deleted {
+		return mvcc.engine.put(key, version.Value)
+	}
+	if plain.Bytes == nil {
+		return nil
+	}
+	if err := mvcc.engine.del(key); err != nil {
+		return err
+	}
+	// A deletion at timestamp zero has no earlier versions to hide.
+	if timestamp == 0 {
+		return nil
+	}
+	return mvcc.putVersion(key, mvccVersion{Value: Value{Timestamp: timestamp}, Deleted: true})
+}
+
+// putVersion stores version under key at its value's timestamp.
+func (mvcc *MVCC) putVersion(key Key, version mvccVersion) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&version); err != nil {
+		return err
+	}
+	timestamp := version.Value.Timestamp
+	return mvcc.engine.put(mvccEncodeKey(key, timestamp), Value{Bytes: buf.Bytes(), Timestamp: timestamp})
+}
+
+// ResolveWriteIntent resolves the write intent of txnID on key, if
+// any. A committed intent becomes the latest committed version of the
+// key; an aborted intent is removed.
+func (mvcc *MVCC) ResolveWriteIntent(key Key, txnID string, commit bool) error {
+	return mvcc.batch(func(bm *MVCC) error {
+		return bm.resolveWriteIntent(key, txnID, commit)
+	})
+}
+
+// resolveWriteIntent implements ResolveWriteIntent without batching
+// its writes.
+func (mvcc *MVCC) resolveWriteIntent(key Key, txnID string, commit bool) error {
+	meta, ok, err := mvcc.getMetadata(key)
+	if err != nil || !ok || meta.TxnID != txnID || txnID == "" {
+		return err
+	}
+	version, err := mvcc.getVersion(key, meta.Timestamp)
+	if err != nil {
+		return err
+	}
+	if err := mvcc.engine.del(mvccEncodeKey(key, meta.Timestamp)); err != nil {
+		return err
+	}
+	if err := mvcc.engine.del(mvccMetadataKey(key)); err != nil {
+		return err
+	}
+	if !commit {
+		return nil
+	}
+	return mvcc.commitVersion(key, version)
+}
+
+// Scan returns up to max keys in [start, end) with their versions
+// current at timestamp, as Get would read them; keys without a value
+// at timestamp are omitted. Specify max=0 for unbounded scans. The
+// rows storing MVCC metadata and versions aren't themselves scanned
+// as keys.
+func (mvcc *MVCC) Scan(start, end Key, max int64, timestamp int64, txnID string) ([]KeyValue, error) {
+	return mvcc.scan(start, end, max, timestamp, txnID, false)
+}
+
+// ReverseScan is like Scan, but returns keys in descending order,
+// starting from the last key before end.
+func (mvcc *MVCC) ReverseScan(start, end Key, max int64, timestamp int64, txnID string) ([]KeyValue, error) {
+	return mvcc.scan(start, end, max, timestamp, txnID, true)
+}
+
+// scan implements Scan and ReverseScan.
+func (mvcc *MVCC) scan(start, end Key, max int64, timestamp int64, txnID string, reverse bool) ([]KeyValue, error) {
+	var kvs []KeyValue
+	for max == 0 || int64(len(kvs)) < max {
+		key, ok, err := mvcc.nextKey(start, end, reverse)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		value, err := mvcc.Get(key, timestamp, txnID)
+		if err != nil {
+			return nil, err
+		}
+		if value.Bytes != nil {
+			kvs = append(kvs, KeyValue{Key: key, Value: value})
+		}
+		if reverse {
+			end = key
+		} else {
+			start = MakeKey(key, Key{0})
+		}
+	}
+	return kvs, nil
+}
+
+// nextKey returns the first key in [start, end), or the last if
+// reverse, which has a plain row or stored versions, and whether
+// there is one.
+func (mvcc *MVCC) nextKey(start, end Key, reverse bool) (Key, bool, error) {
+	kvs, err := scanPlainRows(mvcc.engine, start, end, 1, reverse)
+	if err != nil {
+		return nil, false, err
+	}
+	var versions []KeyValue
+	if reverse {
+		versions, err = mvcc.engine.reverseScan(mvccMetadataKey(start), mvccSpanEnd(end), 1)
+	} else {
+		versions, err = mvcc.engine.scan(mvccMetadataKey(start), mvccSpanEnd(end), 1)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if len(versions) == 0 {
+		if len(kvs) == 0 {
+			return nil, false, nil
+		}
+		return kvs[0].Key, true, nil
+	}
+	key, _, err := mvccDecodeKey(versions[0].Key)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(kvs) > 0 && (bytes.Compare(kvs[0].Key, key) < 0) != reverse {
+		return kvs[0].Key, true, nil
+	}
+	return key, true, nil
+}
+
+// scanPlainRows returns up to max rows of engine in [start, end), or
+// the last rows before end in descending key order if reverse,
+// skipping those storing MVCC metadata and versions. Specify max=0
+// for unbounded scans.
+func scanPlainRows(engine Engine, start, end Key, max int64, reverse bool) ([]KeyValue, error) {
+	spans := [][2]Key{{start, end}}
+	mvccEnd := PrefixEndKey(keyMVCCPrefix)
+	if bytes.Compare(start, mvccEnd) < 0 {
+		spans = [][2]Key{{start, keyMVCCPrefix}, {mvccEnd, end}}
+		if reverse {
+			spans[0], spans[1] = spans[1], spans[0]
+		}
+	}
+	var kvs []KeyValue
+	for _, span := range spans {
+		from, to := span[0], span[1]
+		if bytes.Compare(from, start) < 0 {
+			from = start
+		}
+		if len(end) > 0 && (len(to) == 0 || bytes.Compare(to, end) > 0) {
+			to = end
+		}
+		if len(to) > 0 && bytes.Compare(from, to) >= 0 {
+			continue
+		}
+		var remaining int64
+		if max > 0 {
+			remaining = max - int64(len(kvs))
+		}
+		var rows []KeyValue
+		var err error
+		if reverse {
+			rows, err = engine.reverseScan(from, to, remaining)
+		} else {
+			rows, err = engine.scan(from, to, remaining)
+		}
+		if err != nil {
+			return nil, err
+		}
+		kvs = append(kvs, rows...)
+		if max > 0 && int64(len(kvs)) >= max {
+			break
+		}
+	}
+	if kvs == nil {
+		kvs = []KeyValue{}
+	}
+	return kvs, nil
+}
+
+// Versions returns the history of key, newest first, including any
+// write intent and the latest committed version. Versions written by
+// deletions have nil Bytes.
+func (mvcc *MVCC) Versions(key Key) ([]Value, error) {
+	plain, err := mvcc.engine.get(key)
+	if err != nil {
+		return nil, err
+	}
+	meta, ok, err := mvcc.getMetadata(key)
+	if err != nil {
+		return nil, err
+	}
+	kvs, err := mvcc.engine.scan(mvccEncodeKey(key, math.MaxInt64), mvccVersionsEnd(key), 0)
+	if err != nil {
+		return nil, err
+	}
+	var values []Value
+	for _, kv := range kvs {
+		version, err := decodeVersion(kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		if version.Deleted {
+			version.Value = Value{Timestamp: kv.Value.Timestamp}
+		}
+		// The plain row precedes the versions it superseded.
+		if plain.Bytes != nil && !(ok && bytes.Equal(kv.Key, mvccEncodeKey(key, meta.Timestamp))) {
+			values, plain = append(values, plain), Value{}
+		}
+		values = append(values, version.Value)
+	}
+	if plain.Bytes != nil {
+		values = append(values, plain)
+	}
+	return values, nil
+}
+
+// GarbageCollect removes the versions of key which aren't needed to
+// serve reads at or after threshold: all but the newest version at or
+// before threshold, and that version too if no newer version follows
+// it and the key has no plain row, as it then reads as absent. Write
+// intents, and the versions they may be aborted in favor of, are
+// retained. Returns the number of versions removed.
+func (mvcc *MVCC) GarbageCollect(key Key, threshold int64) (int, error) {
+	var n int
+	err := mvcc.batch(func(bm *MVCC) error {
+		var err error
+		n, err = bm.garbageCollect(key, threshold)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// garbageCollect implements GarbageCollect without batching its
+// writes.
+func (mvcc *MVCC) garbageCollect(key Key, threshold int64) (int, error) {
+	meta, ok, err := mvcc.getMetadata(key)
+	if err != nil {
+		return 0, err
+	}
+	if ok && meta.Timestamp <= threshold {
+		threshold = meta.Timestamp - 1
+	}
+	if threshold < 0 {
+		return 0, nil
+	}
+	kvs, err := mvcc.engine.scan(mvccEncodeKey(key, threshold), mvccVersionsEnd(key), 0)
+	if err != nil || len(kvs) == 0 {
+		return 0, err
+	}
+	// A plain row written at or before threshold supersedes all the
+	// versions; otherwise the newest version is retained if it's
+	// followed by a newer one, or by the plain row.
+	plain, err := mvcc.engine.get(key)
+	if err != nil {
+		return 0, err
+	}
+	if plain.Bytes == nil || plain.Timestamp > threshold {
+		newest, _, err := mvcc.newestCommitted(key)
+		if err != nil {
+			return 0, err
+		}
+		if plain.Bytes != nil || !bytes.Equal(newest.Key, kvs[0].Key) {
+			kvs = kvs[1:]
+		}
+	}
+	for _, kv := range kvs {
+		if err := mvcc.engine.del(kv.Key); err != nil {
+			return 0, err
+		}
+	}
+	return len(kvs), nil
+}
+
+// getMetadata returns the metadata of key and whether it exists.
+func (mvcc *MVCC) getMetadata(key Key) (MVCCMetadata, bool, error) {
+	var meta MVCCMetadata
+	ok, _, err := getI(mvcc.engine, mvccMetadataKey(key), &meta)
+	return meta, ok, err
+}
+
+// intentError returns the error for a read or write of key which
+// conflicts with the write intent described by meta.
+func (meta MVCCMetadata) intentError(key Key) *WriteIntentError {
+	return &WriteIntentError{Key: key, TxnID: meta.TxnID, TxnPriority: meta.TxnPriority, Timestamp: meta.Timestamp}
+}
+
+// intentInfo describes the write intent on key described by meta, as
+// reported by scans.
+func (meta MVCCMetadata) intentInfo(key Key) IntentInfo {
+	return IntentInfo{Key: key, TxnID: meta.TxnID, TxnPriority: meta.TxnPriority, Timestamp: meta.Timestamp}
+}
+
+// putMetadata stores the metadata of key.
+func (mvcc *MVCC) putMetadata(key Key, meta MVCCMetadata) error {
+	return putI(mvcc.engine, mvccMetadataKey(key), &meta)
+}
+
+// decodeVersion decodes a version stored in the engine.
+func decodeVersion(value Value) (mvccVersion, error) {
+	var version mvccVersion
+	if err := gob.NewDecoder(bytes.NewBuffer(value.Bytes)).Decode(&version); err != nil {
+		return mvccVersion{}, util.Errorf("unable to decode version: %v", err)
+	}
+	return version, nil
+}
+
+// decodeMetadata decodes the metadata of a key stored in the engine.
+func decodeMetadata(value Value) (MVCCMetadata, error) {
+	var meta MVCCMetadata
+	if err := gob.NewDecoder(bytes.NewBuffer(value.Bytes)).Decode(&meta); err != nil {
+		return MVCCMetadata{}, util.Errorf("unable to decode MVCC metadata: %v", err)
+	}
+	return meta, nil
+}
+
+// mvccEscapeKey returns key with each zero byte escaped as 0x00 0xff,
+// followed by the terminator 0x00 0x01; see encoding.EncodeBytes. The
+// encoding preserves the order of keys, and no encoded key is a
+// prefix of another, so that the suffixes of versions don't
+// interleave the versions of different keys.
+func mvccEscapeKey(key Key) Key {
+	return Key(encoding.EncodeBytes(make([]byte, 0, len(key)+2), key))
+}
+
+// mvccMetadataKey returns the encoded key of key's metadata: the
+// concatenation of keyMVCCPrefix and the escaped key, which sorts
+// before all of its versions.
+func mvccMetadataKey(key Key) Key {
+	return MakeKey(keyMVCCPrefix, mvccEscapeKey(key))
+}
+
+// mvccEncodeKey returns the encoded key of the version of key at
+// timestamp: the metadata key followed by the bitwise complement of
+// the timestamp, big endian, so that newer versions sort first.
+func mvccEncodeKey(key Key, timestamp int64) Key {
+	return Key(encoding.EncodeUint64Decreasing(mvccMetadataKey(key), uint64(timestamp)))
+}
+
+// mvccVersionsEnd returns the encoded key following all versions of
+// key and preceding those of any other key.
+func mvccVersionsEnd(key Key) Key {
+	end := mvccMetadataKey(key)
+	end[len(end)-1]++
+	return end
+}
+
+// mvccSpanEnd returns the encoded key following the metadata and
+// versions of all keys before end, or of all keys if end is empty.
+func mvccSpanEnd(end Key) Key {
+	if len(end) == 0 {
+		return PrefixEndKey(keyMVCCPrefix)
+	}
+	return mvccMetadataKey(end)
+}
+
+// mvccDecodeKey decodes a key encoded by mvccMetadataKey or
+// mvccEncodeKey, returning the key and the version's timestamp, or
+// zero for metadata.
+func mvccDecodeKey(encoded Key) (Key, int64, error) {
+	if !bytes.HasPrefix(encoded, keyMVCCPrefix) {
+		return nil, 0, util.Errorf("invalid MVCC key %q", encoded)
+	}
+	encoded = encoded[len(keyMVCCPrefix):]
+	var key Key
+	for i := 0; i < len(encoded); i++ {
+		if encoded[i] != 0 {
+			key = append(key, encoded[i])
+			continue
+		}
+		if i+1 >= len(encoded) {
+			break
+		}
+		switch encoded[i+1] {
+		case 0xff:
+			key = append(key, 0)
+			i++
+			continue
+		case 0x01:
+			switch suffix := encoded[i+2:]; len(suffix) {
+			case 0:
+				return key, 0, nil
+			case 8:
+				return key, int64(^binary.BigEndian.Uint64(suffix)), nil
+			}
+			return nil, 0, util.Errorf("invalid timestamp suffix in MVCC key %q", encoded)
+		}
+		break
+	}
+	return nil, 0, util.Errorf("invalid MVCC key %q", encoded)
+}
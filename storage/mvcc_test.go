@@ -0,0 +1,196 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+)
+
+// TestMVCCKeyEncoding verifies encoded keys decode to their keys and
+// timestamps, and sort by key and then by descending timestamp.
+func TestMVCCKeyEncoding(t *testing.T) {
+	keys := []Key{Key(""), Key("\x00"), Key("\x00\x00"), Key("a"), Key("a\x00"), Key("a\x00b"), Key("a\x01"), Key("ab")}
+	var encoded []Key
+	for _, key := range keys {
+		for _, ts := range []int64{0, 5, 1} {
+			var k Key
+			if ts == 0 {
+				k = mvccMetadataKey(key)
+			} else {
+				k = mvccEncodeKey(key, ts)
+			}
+			decoded, decodedTS, err := mvccDecodeKey(k)
+			if err != nil || !bytes.Equal(decoded, key) || decodedTS != ts {
+				t.Errorf("%q@%d: decoded to %q@%d, %v", key, ts, decoded, decodedTS, err)
+			}
+			encoded = append(encoded, k)
+		}
+	}
+	sorted := append([]Key(nil), encoded...)
+	sort.Sort(keySlice(sorted))
+	for i := range encoded {
+		if !bytes.Equal(encoded[i], sorted[i]) {
+			t.Fatalf("%d: expected encoded keys in order; got %q", i, sorted)
+		}
+	}
+}
+
+// keySlice implements sort.Interface for a slice of keys.
+type keySlice []Key
+
+func (ks keySlice) Len() int           { return len(ks) }
+func (ks keySlice) Swap(i, j int)      { ks[i], ks[j] = ks[j], ks[i] }
+func (ks keySlice) Less(i, j int) bool { return bytes.Compare(ks[i], ks[j]) < 0 }
+
+// TestMVCCSnapshotReads verifies reads return the version current at
+// their timestamp, and that writes older than the latest version are
+// refused.
+func TestMVCCSnapshotReads(t *testing.T) {
+	mvcc := NewMVCC(NewInMem(1 << 20))
+	key := Key("a")
+	for _, ts := range []int64{10, 20} {
+		if err := mvcc.Put(key, ts, Value{Bytes: []byte{byte(ts)}}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mvcc.Delete(key, 30, nil); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		ts  int64
+		exp []byte
+	}{
+		{5, nil},
+		{10, []byte{10}},
+		{15, []byte{10}},
+		{25, []byte{20}},
+		{30, nil},
+		{0, nil},
+	}
+	for _, test := range testCases {
+		value, err := mvcc.Get(key, test.ts, "")
+		if err != nil || !bytes.Equal(value.Bytes, test.exp) {
+			t.Errorf("read at %d: expected %v; got %v, %v", test.ts, test.exp, value.Bytes, err)
+		}
+	}
+	if err := mvcc.Put(key, 25, Value{Bytes: []byte("old")}, nil); err == nil {
+		t.Error("expected write older than latest version to fail")
+	} else if _, ok := err.(*WriteTooOldError); !ok {
+		t.Errorf("expected write too old error; got %v", err)
+	}
+	if versions, err := mvcc.Versions(key); err != nil || len(versions) != 3 || versions[0].Bytes != nil {
+		t.Errorf("expected 3 versions, newest a deletion; got %+v, %v", versions, err)
+	}
+}
+
+// TestMVCCWriteIntents verifies intents are visible only to their
+// transaction, block other transactions and are committed or aborted
+// on resolution.
+func TestMVCCWriteIntents(t *testing.T) {
+	mvcc := NewMVCC(NewInMem(1 << 20))
+	key := Key("a")
+	if err := mvcc.Put(key, 10, Value{Bytes: []byte("committed")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, commit := range []bool{false, true} {
+		if err := mvcc.Put(key, 20, Value{Bytes: []byte("intent")}, &Transaction{ID: "txn"}); err != nil {
+			t.Fatal(err)
+		}
+		if value, err := mvcc.Get(key, 0, "txn"); err != nil || string(value.Bytes) != "intent" {
+			t.Errorf("expected transaction to read its intent; got %q, %v", value.Bytes, err)
+		}
+		if _, err := mvcc.Get(key, 0, ""); err == nil {
+			t.Error("expected intent to block read")
+		} else if _, ok := err.(*WriteIntentError); !ok {
+			t.Errorf("expected write intent error; got %v", err)
+		}
+		if value, err := mvcc.Get(key, 15, ""); err != nil || string(value.Bytes) != "committed" {
+			t.Errorf("expected read before intent to succeed; got %q, %v", value.Bytes, err)
+		}
+		if err := mvcc.Put(key, 30, Value{Bytes: []byte("other")}, &Transaction{ID: "other-txn"}); err == nil {
+			t.Error("expected intent to block write by another transaction")
+		}
+		if err := mvcc.ResolveWriteIntent(key, "txn", commit); err != nil {
+			t.Fatal(err)
+		}
+		exp := "committed"
+		if commit {
+			exp = "intent"
+		}
+		if value, err := mvcc.Get(key, 0, ""); err != nil || string(value.Bytes) != exp {
+			t.Errorf("commit=%t: expected %q; got %q, %v", commit, exp, value.Bytes, err)
+		}
+	}
+}
+
+// TestMVCCScan verifies scans return each key's version current at
+// the scan's timestamp, omitting deleted keys.
+func TestMVCCScan(t *testing.T) {
+	mvcc := NewMVCC(NewInMem(1 << 20))
+	for _, key := range []string{"a", "a\x00", "b", "c"} {
+		if err := mvcc.Put(Key(key), 10, Value{Bytes: []byte(key + "1")}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := mvcc.Put(Key(key), 20, Value{Bytes: []byte(key + "2")}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mvcc.Delete(Key("b"), 30, nil); err != nil {
+		t.Fatal(err)
+	}
+	kvs, err := mvcc.Scan(Key("a"), Key("c"), 0, 15, "")
+	if err != nil || len(kvs) != 3 || string(kvs[1].Value.Bytes) != "a\x001" {
+		t.Errorf("expected 3 versions at 15; got %+v, %v", kvs, err)
+	}
+	kvs, err = mvcc.Scan(Key("a"), Key("d"), 0, 0, "")
+	if err != nil || len(kvs) != 3 || string(kvs[2].Value.Bytes) != "c2" {
+		t.Errorf("expected latest versions of a, a\\x00 and c; got %+v, %v", kvs, err)
+	}
+	if kvs, err = mvcc.Scan(Key("a"), Key("d"), 2, 0, ""); err != nil || len(kvs) != 2 {
+		t.Errorf("expected 2 rows; got %+v, %v", kvs, err)
+	}
+}
+
+// TestMVCCGarbageCollect verifies versions which can't be read at or
+// after the threshold are removed, along with keys deleted before it.
+func TestMVCCGarbageCollect(t *testing.T) {
+	mvcc := NewMVCC(NewInMem(1 << 20))
+	for _, ts := range []int64{10, 20, 30} {
+		if err := mvcc.Put(Key("a"), ts, Value{Bytes: []byte("a")}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := mvcc.Put(Key("b"), ts, Value{Bytes: []byte("b")}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mvcc.Delete(Key("b"), 40, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := mvcc.GarbageCollect(Key("a"), 25); err != nil || n != 1 {
+		t.Errorf("expected 1 version of a removed; got %d, %v", n, err)
+	}
+	if value, err := mvcc.Get(Key("a"), 25, ""); err != nil || value.Bytes == nil {
+		t.Errorf("expected version at threshold retained; got %v", err)
+	}
+	if n, err := mvcc.GarbageCollect(Key("b"), 50); err != nil || n != 4 {
+		t.Errorf("expected all 4 versions of deleted b removed; got %d, %v", n, err)
+	}
+	if _, ok, err := mvcc.getMetadata(Key("b")); ok || err != nil {
+		t.Errorf("expected metadata of deleted b removed; got %t, %v", ok, err)
+	}
+}
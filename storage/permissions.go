@@ -0,0 +1,147 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"reflect"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/golang/glog"
+)
+
+// permissionFor returns the permission the config grants user: the
+// permission listing user or, failing that, the default permission,
+// which lists no users or the empty user. Returns false if there is
+// neither.
+func (pc *PermConfig) permissionFor(user string) (Permission, bool) {
+	var def *Permission
+	for i, perm := range pc.Perms {
+		if len(perm.Users) == 0 && def == nil {
+			def = &pc.Perms[i]
+		}
+		for _, u := range perm.Users {
+			if u == user && user != "" {
+				return perm, true
+			}
+			if u == "" && def == nil {
+				def = &pc.Perms[i]
+			}
+		}
+	}
+	if def == nil {
+		return Permission{}, false
+	}
+	return *def, true
+}
+
+// loadPermConfigs sets the permission configs against which requests
+// are checked. Configs are read directly if they fall within the
+// range; otherwise, the gossiped configs are used, if available.
+func (r *Range) loadPermConfigs() {
+	configs, err := r.configsFor(KeyConfigPermissionPrefix, gossip.KeyConfigPermission, PermConfig{})
+	var perms *prefixConfigMap
+	if err == nil && len(configs) > 0 {
+		perms, err = newPrefixConfigMap(append([]*prefixConfig(nil), configs...))
+	}
+	if err != nil {
+		glog.Errorf("failed loading permission configs: %v", err)
+		return
+	}
+	r.policyMu.Lock()
+	defer r.policyMu.Unlock()
+	r.perms = perms
+}
+
+// CheckPermission returns a PermissionDeniedError if the permission
+// configs of the keys accessed by the request args deny its user the
+// required access: write access for read-write commands and read
+// access otherwise. Each key is governed by the config of its longest
+// matching prefix. Range lookups are exempt, as clients must route
+// requests regardless of their permissions. Until permission configs
+// are available, as while the cluster is bootstrapped, no permissions
+// are enforced.
+func (r *Range) CheckPermission(method string, args interface{}, write bool) error {
+	if method == "InternalRangeLookup" {
+		return nil
+	}
+	r.policyMu.RLock()
+	perms := r.perms
+	r.policyMu.RUnlock()
+	if perms == nil {
+		return nil
+	}
+	user := reflect.Indirect(reflect.ValueOf(args)).FieldByName("User").String()
+	for _, span := range requestSpans(args) {
+		var configs []*prefixConfig
+		if span.end == nil {
+			configs = append(configs, perms.matchByPrefix(span.start))
+		} else {
+			results, err := perms.splitRangeByPrefixes(span.start, span.end)
+			if err != nil {
+				return err
+			}
+			for _, rr := range results {
+				configs = append(configs, perms.canonicalConfigs[rr.config])
+			}
+		}
+		for _, pc := range configs {
+			perm, ok := pc.Config.(*PermConfig).permissionFor(user)
+			if !ok || (write && !perm.Write) || (!write && !perm.Read) {
+				return &PermissionDeniedError{User: user, Method: method, Key: span.start, Prefix: pc.Prefix, Write: write}
+			}
+		}
+	}
+	return nil
+}
+
+// A keySpan is the span of keys [start, end) accessed by a request,
+// or the single key start if end is nil.
+type keySpan struct {
+	start, end Key
+}
+
+// requestSpans returns the keys accessed by the request args: its
+// key or inbox, the span between its start and end keys, or the keys
+// of its rows or transaction. A missing end key is taken to extend to
+// the end of the key space.
+func requestSpans(args interface{}) []keySpan {
+	argsVal := reflect.Indirect(reflect.ValueOf(args))
+	if key := argsVal.FieldByName("Key"); key.IsValid() {
+		return []keySpan{{start: key.Interface().(Key)}}
+	}
+	if inbox := argsVal.FieldByName("Inbox"); inbox.IsValid() {
+		return []keySpan{{start: inbox.Interface().(Key)}}
+	}
+	if start := argsVal.FieldByName("StartKey"); start.IsValid() {
+		span := keySpan{start: start.Interface().(Key), end: KeyMax}
+		if end := argsVal.FieldByName("EndKey").Interface().(Key); len(end) > 0 {
+			span.end = end
+		}
+		return []keySpan{span}
+	}
+	var spans []keySpan
+	if rows := argsVal.FieldByName("Rows"); rows.IsValid() {
+		for _, row := range rows.Interface().([]KeyValue) {
+			spans = append(spans, keySpan{start: row.Key})
+		}
+	}
+	if keys := argsVal.FieldByName("Keys"); keys.IsValid() {
+		for _, key := range keys.Interface().([]Key) {
+			spans = append(spans, keySpan{start: key})
+		}
+	}
+	return spans
+}
@@ -0,0 +1,94 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+)
+
+// TestPermissionFor verifies a user is granted their own permission
+// if listed and the default permission otherwise.
+func TestPermissionFor(t *testing.T) {
+	pc := &PermConfig{Perms: []Permission{
+		{Users: []string{"root"}, Read: true, Write: true},
+		{Users: []string{""}, Read: true},
+	}}
+	if perm, ok := pc.permissionFor("root"); !ok || !perm.Write {
+		t.Errorf("expected root to have write permission; got %+v, %t", perm, ok)
+	}
+	if perm, ok := pc.permissionFor("guest"); !ok || perm.Write || !perm.Read {
+		t.Errorf("expected guest to have default read permission; got %+v, %t", perm, ok)
+	}
+	pc = &PermConfig{Perms: []Permission{{Users: []string{"root"}, Read: true}}}
+	if _, ok := pc.permissionFor("guest"); ok {
+		t.Error("expected no permission for unlisted user without default")
+	}
+}
+
+// TestRangeCheckPermission verifies requests are checked against the
+// permission config of the longest prefix of each key they access.
+func TestRangeCheckPermission(t *testing.T) {
+	engine := createTestEngine(t)
+	if err := putI(engine, MakeKey(KeyConfigPermissionPrefix, Key("secret")), &PermConfig{Perms: []Permission{
+		{Users: []string{"admin"}, Read: true, Write: true},
+		{Read: true},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	r, _ := createTestRange(engine, t)
+	defer r.Stop()
+
+	testCases := []struct {
+		method string
+		args   interface{}
+		write  bool
+		expOK  bool
+	}{
+		{"Put", &PutRequest{Key: Key("a")}, true, true},
+		{"Get", &GetRequest{Key: Key("secret/a")}, false, true},
+		{"Put", &PutRequest{Key: Key("secret/a")}, true, false},
+		{"Put", &PutRequest{RequestHeader: RequestHeader{User: "admin"}, Key: Key("secret/a")}, true, true},
+		{"Scan", &ScanRequest{StartKey: Key("a"), EndKey: Key("z")}, false, true},
+		{"InternalBulkWrite", &InternalBulkWriteRequest{Rows: []KeyValue{{Key: Key("a")}, {Key: Key("secret")}}}, true, false},
+		{"InternalRangeLookup", &InternalRangeLookupRequest{Key: Key("secret")}, false, true},
+	}
+	for i, test := range testCases {
+		err := r.CheckPermission(test.method, test.args, test.write)
+		if test.expOK != (err == nil) {
+			t.Errorf("%d: expected ok %t; got %v", i, test.expOK, err)
+		}
+		if pde, ok := err.(*PermissionDeniedError); err != nil && (!ok || string(pde.Prefix) != "secret") {
+			t.Errorf("%d: expected permission denied under prefix \"secret\"; got %v", i, err)
+		}
+	}
+
+	// Changing the config takes effect as the write commits.
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(PermConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-r.ReadWriteCmd("Put", &PutRequest{
+		Key:   MakeKey(KeyConfigPermissionPrefix, Key("secret")),
+		Value: Value{Bytes: buf.Bytes()},
+	}, &PutResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.CheckPermission("Get", &GetRequest{Key: Key("secret/a")}, false); err == nil {
+		t.Error("expected read to be denied without a default permission")
+	}
+}
@@ -218,7 +218,10 @@ func (p *prefixConfigMap) splitRangeByPrefixes(start, end Key) ([]*rangeResult,
 		return bytes.Compare(end, p.configs[i].Prefix) < 0
 	})
 
-	if startIdx >= len(p.configs) || endIdx > len(p.configs) {
+	// A start key sorting after the last prefix falls within the
+	// last prefix's span; only a start key before the default prefix
+	// is outside the map.
+	if startIdx == 0 {
 		return nil, util.Errorf("start and/or end keys (%q, %q) fall outside prefix range; "+
 			"was default prefix not added?", start, end)
 	}
@@ -209,6 +209,24 @@ func TestSplitRangeByPrefixesError(t *testing.T) {
 	}
 }
 
+// TestSplitRangeByDefaultPrefix verifies a map with only the default
+// prefix covers the entire key space.
+func TestSplitRangeByDefaultPrefix(t *testing.T) {
+	pcc, err := newPrefixConfigMap([]*prefixConfig{{KeyMin, "default"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, start := range []Key{KeyMin, Key("a")} {
+		results, err := pcc.splitRangeByPrefixes(start, KeyMax)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 || results[0].config != "default" {
+			t.Errorf("expected single default result from %q; got %+v", start, results)
+		}
+	}
+}
+
 // TestSplitRangeByPrefixes verifies splitting of a key range
 // into sub-ranges based on config prefixes.
 func TestSplitRangeByPrefixes(t *testing.T) {
@@ -0,0 +1,407 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// DefaultQueueVisibilityTimeout is the time for which reaped messages
+// remain invisible to other reapers, unless a reaper specifies its
+// own timeout. A message which isn't acknowledged within its
+// visibility timeout is delivered again.
+const DefaultQueueVisibilityTimeout = 30 * time.Second
+
+// queueScanBatchSize is the number of messages read from the engine
+// at a time when reaping.
+const queueScanBatchSize = 100
+
+// A QueueMessage is a message enqueued in an inbox, as delivered by
+// ReapQueue.
+type QueueMessage struct {
+	ID         int64 `protobuf:"1"` // Orders messages within their inbox; see AckQueue
+	Message    Value `protobuf:"2"` // The enqueued message
+	Deliveries int32 `protobuf:"3"` // Times the message has been reaped, including this time
+	VisibleAt  int64 `protobuf:"4"` // Time before which the message won't be reaped again
+}
+
+// queueMetadata is stored at an inbox's key and records the ID of the
+// inbox's most recently enqueued message.
+type queueMetadata struct {
+	LastID int64
+}
+
+// An inbox's keys all begin with the inbox key followed by a zero
+// byte, so that they sort immediately after it and an inbox and its
+// messages are held by the same range; see queueInbox. They include
+// the messages of the inbox's queue and dead-letter queue, by ID, and
+// an index of each queue's messages by visibility: those visible to
+// reapers, by ID, and those in flight, by the time at which they
+// become visible again.
+
+// queueKind returns the key suffix distinguishing an inbox's
+// dead-letter queue, if deadLetter, from its queue.
+func queueKind(deadLetter bool) Key {
+	if deadLetter {
+		return Key("d")
+	}
+	return Key("q")
+}
+
+// encodeQueueInt returns the big-endian encoding of v, so that keys
+// ending with it sort in its order.
+func encodeQueueInt(v int64) Key {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(v))
+	return Key(buf[:])
+}
+
+// queueMessagePrefix returns the prefix of the keys of the messages
+// in inbox, or in its dead-letter queue if deadLetter.
+func queueMessagePrefix(inbox Key, deadLetter bool) Key {
+	return MakeKey(inbox, MakeKey(Key("\x00"), queueKind(deadLetter)))
+}
+
+// queueMessageKey returns the key of the message with the specified
+// ID in inbox, or in its dead-letter queue if deadLetter, as the
+// concatenation of the queue's message prefix and the big-endian
+// encoded ID, so that messages sort in the order enqueued.
+func queueMessageKey(inbox Key, id int64, deadLetter bool) Key {
+	return MakeKey(queueMessagePrefix(inbox, deadLetter), encodeQueueInt(id))
+}
+
+// queueVisiblePrefix returns the prefix of the keys indexing the
+// messages of inbox, or of its dead-letter queue if deadLetter, which
+// are visible to reapers.
+func queueVisiblePrefix(inbox Key, deadLetter bool) Key {
+	return MakeKey(inbox, MakeKey(Key("\x00v"), queueKind(deadLetter)))
+}
+
+// queueVisibleKey returns the key indexing the visible message with
+// the specified ID, ordered by ID.
+func queueVisibleKey(inbox Key, id int64, deadLetter bool) Key {
+	return MakeKey(queueVisiblePrefix(inbox, deadLetter), encodeQueueInt(id))
+}
+
+// queueInFlightPrefix returns the prefix of the keys indexing the
+// messages of inbox, or of its dead-letter queue if deadLetter, which
+// have been reaped and are invisible until their visibility timeouts
+// elapse.
+func queueInFlightPrefix(inbox Key, deadLetter bool) Key {
+	return MakeKey(inbox, MakeKey(Key("\x00f"), queueKind(deadLetter)))
+}
+
+// queueInFlightKey returns the key indexing the in-flight message with
+// the specified ID, ordered by visibleAt, the time at which it becomes
+// visible again.
+func queueInFlightKey(inbox Key, visibleAt, id int64, deadLetter bool) Key {
+	return MakeKey(queueInFlightPrefix(inbox, deadLetter), MakeKey(encodeQueueInt(visibleAt), encodeQueueInt(id)))
+}
+
+// putQueueIndex writes, via b, the index entry at key of the message
+// with the specified ID.
+func putQueueIndex(b *Batch, key Key, id, now int64) error {
+	value, err := encodeQueueValue(id, now)
+	if err != nil {
+		return err
+	}
+	return b.put(key, value)
+}
+
+// decodeQueueIndex returns the ID of the message indexed by kv.
+func decodeQueueIndex(kv KeyValue) (int64, error) {
+	var id int64
+	if err := gob.NewDecoder(bytes.NewReader(kv.Value.Bytes)).Decode(&id); err != nil {
+		return 0, util.Errorf("unable to decode queue index %q: %v", kv.Key, err)
+	}
+	return id, nil
+}
+
+// queueInbox returns the inbox among whose keys key falls, other than
+// the inbox key itself, or nil if there's none. Ranges are split only
+// at keys outside inboxes; see Store.SplitRange.
+func queueInbox(engine Engine, key Key) (Key, error) {
+	for i := 1; i < len(key); i++ {
+		if key[i] != 0 {
+			continue
+		}
+		inbox := key[:i]
+		value, err := engine.get(inbox)
+		if err != nil {
+			return nil, err
+		}
+		if value.Bytes == nil {
+			continue
+		}
+		var meta queueMetadata
+		if gob.NewDecoder(bytes.NewReader(value.Bytes)).Decode(&meta) == nil {
+			return inbox, nil
+		}
+	}
+	return nil, nil
+}
+
+// encodeQueueValue returns a value holding the gob encoding of v,
+// timestamped at now.
+func encodeQueueValue(v interface{}, now int64) (Value, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return Value{}, err
+	}
+	return Value{Bytes: buf.Bytes(), Timestamp: now}, nil
+}
+
+// queueNow returns the time at which a queue command executes: the
+// timestamp set in its header by the node which proposed it, so that
+// all replicas agree on the visibility of messages, or the current
+// time if it has none.
+func queueNow(header *RequestHeader) int64 {
+	if header.Timestamp != 0 {
+		return header.Timestamp
+	}
+	return time.Now().UnixNano()
+}
+
+// EnqueueMessage enqueues a message (Value) for delivery to a
+// recipient inbox. Messages are assigned increasing IDs within their
+// inbox and are reaped in ID order; the message's ID is returned.
+func (r *Range) EnqueueMessage(args *EnqueueMessageRequest, reply *EnqueueMessageResponse) {
+	now := queueNow(&args.RequestHeader)
+	reply.Error = r.recordWrites(func(b *Batch, record func(key Key, before Value, after *Value)) error {
+		metaBefore, err := b.get(args.Inbox)
+		if err != nil {
+			return err
+		}
+		var meta queueMetadata
+		if metaBefore.Bytes != nil {
+			if err := gob.NewDecoder(bytes.NewReader(metaBefore.Bytes)).Decode(&meta); err != nil {
+				return util.Errorf("key %q is not an inbox: %v", args.Inbox, err)
+			}
+		}
+		meta.LastID++
+		metaAfter, err := encodeQueueValue(&meta, now)
+		if err != nil {
+			return err
+		}
+		msg, err := encodeQueueValue(&QueueMessage{ID: meta.LastID, Message: args.Message}, now)
+		if err != nil {
+			return err
+		}
+		key := queueMessageKey(args.Inbox, meta.LastID, false)
+		if err := b.put(args.Inbox, metaAfter); err != nil {
+			return err
+		}
+		if err := b.put(key, msg); err != nil {
+			return err
+		}
+		if err := putQueueIndex(b, queueVisibleKey(args.Inbox, meta.LastID, false), meta.LastID, now); err != nil {
+			return err
+		}
+		record(args.Inbox, metaBefore, &metaAfter)
+		record(key, Value{}, &msg)
+		reply.ID = meta.LastID
+		return nil
+	})
+}
+
+// ReapQueue delivers up to args.MaxResults messages from an inbox in
+// the order enqueued. Reaped messages remain queued but are invisible
+// to other reapers until their visibility timeout elapses, after
+// which they're delivered again unless acknowledged via AckQueue, so
+// that messages whose reaper fails aren't lost. A message already
+// delivered args.MaxDeliveries times is moved to the inbox's
+// dead-letter queue instead, whence it may be reaped and acknowledged
+// by setting args.DeadLetter. Messages are found via the queue's index
+// of visible messages, so reaping doesn't scan past those in flight.
+func (r *Range) ReapQueue(args *ReapQueueRequest, reply *ReapQueueResponse) {
+	if args.MaxResults <= 0 {
+		reply.Error = util.Errorf("max results must be positive; got %d", args.MaxResults)
+		return
+	}
+	now := queueNow(&args.RequestHeader)
+	timeout := args.VisibilityTimeout
+	if timeout <= 0 {
+		timeout = int64(DefaultQueueVisibilityTimeout)
+	}
+	var messages []QueueMessage
+	var deadLettered int64
+	reply.Error = r.recordWrites(func(b *Batch, record func(key Key, before Value, after *Value)) error {
+		if err := expireInFlight(b, args.Inbox, args.DeadLetter, now); err != nil {
+			return err
+		}
+		start := queueVisiblePrefix(args.Inbox, args.DeadLetter)
+		end := PrefixEndKey(start)
+		for int64(len(messages)) < args.MaxResults {
+			kvs, err := b.scan(start, end, queueScanBatchSize)
+			if err != nil {
+				return err
+			}
+			for _, kv := range kvs {
+				if int64(len(messages)) == args.MaxResults {
+					break
+				}
+				id, err := decodeQueueIndex(kv)
+				if err != nil {
+					return err
+				}
+				// The message ceases to be visible, whether it's
+				// delivered or dead-lettered.
+				if err := b.del(kv.Key); err != nil {
+					return err
+				}
+				key := queueMessageKey(args.Inbox, id, args.DeadLetter)
+				before, err := b.get(key)
+				if err != nil {
+					return err
+				}
+				var msg QueueMessage
+				if err := gob.NewDecoder(bytes.NewReader(before.Bytes)).Decode(&msg); err != nil {
+					return util.Errorf("unable to decode queue message %q: %v", key, err)
+				}
+				if !args.DeadLetter && args.MaxDeliveries > 0 && msg.Deliveries >= args.MaxDeliveries {
+					if err := r.deadLetter(b, record, args.Inbox, KeyValue{Key: key, Value: before}, msg, now); err != nil {
+						return err
+					}
+					deadLettered++
+					continue
+				}
+				msg.Deliveries++
+				msg.VisibleAt = now + timeout
+				after, err := encodeQueueValue(&msg, now)
+				if err != nil {
+					return err
+				}
+				if err := b.put(key, after); err != nil {
+					return err
+				}
+				if err := putQueueIndex(b, queueInFlightKey(args.Inbox, msg.VisibleAt, id, args.DeadLetter), id, now); err != nil {
+					return err
+				}
+				record(key, before, &after)
+				messages = append(messages, msg)
+			}
+			if len(kvs) < queueScanBatchSize {
+				break
+			}
+			start = MakeKey(kvs[len(kvs)-1].Key, Key{0})
+		}
+		return nil
+	})
+	if reply.Error == nil {
+		reply.Messages, reply.DeadLettered = messages, deadLettered
+	}
+}
+
+// expireInFlight makes visible again, via b, the in-flight messages of
+// inbox, or of its dead-letter queue if deadLetter, whose visibility
+// timeouts have elapsed by now.
+func expireInFlight(b *Batch, inbox Key, deadLetter bool, now int64) error {
+	start := queueInFlightPrefix(inbox, deadLetter)
+	end := MakeKey(start, encodeQueueInt(now+1))
+	for {
+		kvs, err := b.scan(start, end, queueScanBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, kv := range kvs {
+			id, err := decodeQueueIndex(kv)
+			if err != nil {
+				return err
+			}
+			if err := b.del(kv.Key); err != nil {
+				return err
+			}
+			if err := putQueueIndex(b, queueVisibleKey(inbox, id, deadLetter), id, now); err != nil {
+				return err
+			}
+		}
+		if len(kvs) < queueScanBatchSize {
+			return nil
+		}
+		start = MakeKey(kvs[len(kvs)-1].Key, Key{0})
+	}
+}
+
+// deadLetter moves the message msg, read from kv, from inbox to its
+// dead-letter queue, where it's immediately visible.
+func (r *Range) deadLetter(b *Batch, record func(key Key, before Value, after *Value), inbox Key, kv KeyValue, msg QueueMessage, now int64) error {
+	msg.VisibleAt = 0
+	after, err := encodeQueueValue(&msg, now)
+	if err != nil {
+		return err
+	}
+	key := queueMessageKey(inbox, msg.ID, true)
+	if err := b.del(kv.Key); err != nil {
+		return err
+	}
+	if err := b.put(key, after); err != nil {
+		return err
+	}
+	if err := putQueueIndex(b, queueVisibleKey(inbox, msg.ID, true), msg.ID, now); err != nil {
+		return err
+	}
+	record(kv.Key, kv.Value, nil)
+	record(key, Value{}, &after)
+	return nil
+}
+
+// AckQueue deletes the reaped messages with the specified IDs from
+// an inbox, or from its dead-letter queue, once their processing is
+// complete. Acknowledging a message which was already deleted, as
+// when it was redelivered and acknowledged by another reaper, has no
+// effect.
+func (r *Range) AckQueue(args *AckQueueRequest, reply *AckQueueResponse) {
+	var acked int64
+	reply.Error = r.recordWrites(func(b *Batch, record func(key Key, before Value, after *Value)) error {
+		for _, id := range args.IDs {
+			key := queueMessageKey(args.Inbox, id, args.DeadLetter)
+			before, err := b.get(key)
+			if err != nil {
+				return err
+			}
+			if before.Bytes == nil {
+				continue
+			}
+			var msg QueueMessage
+			if err := gob.NewDecoder(bytes.NewReader(before.Bytes)).Decode(&msg); err != nil {
+				return util.Errorf("unable to decode queue message %q: %v", key, err)
+			}
+			// The message is indexed as visible or in flight.
+			for _, index := range []Key{
+				queueVisibleKey(args.Inbox, id, args.DeadLetter),
+				queueInFlightKey(args.Inbox, msg.VisibleAt, id, args.DeadLetter),
+			} {
+				if err := b.del(index); err != nil {
+					return err
+				}
+			}
+			if err := b.del(key); err != nil {
+				return err
+			}
+			record(key, before, nil)
+			acked++
+		}
+		return nil
+	})
+	if reply.Error == nil {
+		reply.Acked = acked
+	}
+}
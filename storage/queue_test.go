@@ -0,0 +1,155 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestRangeQueue verifies messages are reaped in the order enqueued,
+// hidden from other reapers until their visibility timeout elapses,
+// redelivered unless acknowledged, and moved to the dead-letter queue
+// after their maximum deliveries.
+func TestRangeQueue(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	inbox := MakeKey(KeyQueuePrefix, Key("inbox"))
+	now := time.Now().UnixNano()
+	for i := 1; i <= 3; i++ {
+		reply := &EnqueueMessageResponse{}
+		r.EnqueueMessage(&EnqueueMessageRequest{
+			RequestHeader: RequestHeader{Timestamp: now},
+			Inbox:         inbox,
+			Message:       Value{Bytes: []byte(fmt.Sprintf("m%d", i))},
+		}, reply)
+		if reply.Error != nil || reply.ID != int64(i) {
+			t.Fatalf("expected message ID %d; got %d, %v", i, reply.ID, reply.Error)
+		}
+	}
+	reap := func(at int64, max int64, deadLetter bool) *ReapQueueResponse {
+		reply := &ReapQueueResponse{}
+		r.ReapQueue(&ReapQueueRequest{
+			RequestHeader:     RequestHeader{Timestamp: at},
+			Inbox:             inbox,
+			MaxResults:        max,
+			VisibilityTimeout: int64(time.Minute),
+			MaxDeliveries:     2,
+			DeadLetter:        deadLetter,
+		}, reply)
+		if reply.Error != nil {
+			t.Fatal(reply.Error)
+		}
+		return reply
+	}
+	ids := func(reply *ReapQueueResponse) string {
+		var ids []int64
+		for _, msg := range reply.Messages {
+			ids = append(ids, msg.ID)
+		}
+		return fmt.Sprint(ids)
+	}
+
+	if reply := reap(now, 2, false); ids(reply) != "[1 2]" || string(reply.Messages[0].Message.Bytes) != "m1" {
+		t.Fatalf("expected messages 1 and 2 in order; got %+v", reply.Messages)
+	}
+	// Reaped messages are invisible until their timeout elapses.
+	if reply := reap(now, 10, false); ids(reply) != "[3]" {
+		t.Errorf("expected only message 3 visible; got %s", ids(reply))
+	}
+	ack := &AckQueueResponse{}
+	r.AckQueue(&AckQueueRequest{Inbox: inbox, IDs: []int64{1, 1, 4}}, ack)
+	if ack.Error != nil || ack.Acked != 1 {
+		t.Errorf("expected one message acknowledged; got %d, %v", ack.Acked, ack.Error)
+	}
+	// Unacknowledged messages are redelivered after the timeout.
+	later := now + int64(2*time.Minute)
+	if reply := reap(later, 10, false); ids(reply) != "[2 3]" || reply.Messages[0].Deliveries != 2 {
+		t.Errorf("expected messages 2 and 3 redelivered; got %+v", reply.Messages)
+	}
+	// Messages delivered the maximum number of times are dead-lettered.
+	later += int64(2 * time.Minute)
+	if reply := reap(later, 10, false); len(reply.Messages) != 0 || reply.DeadLettered != 2 {
+		t.Errorf("expected two messages dead-lettered; got %+v", reply)
+	}
+	reply := reap(later, 10, true)
+	if ids(reply) != "[2 3]" {
+		t.Errorf("expected messages 2 and 3 in the dead-letter queue; got %s", ids(reply))
+	}
+	r.AckQueue(&AckQueueRequest{Inbox: inbox, IDs: []int64{2, 3}, DeadLetter: true}, ack)
+	if ack.Error != nil || ack.Acked != 2 {
+		t.Errorf("expected dead letters acknowledged; got %d, %v", ack.Acked, ack.Error)
+	}
+	if reply := reap(later+int64(time.Hour), 10, true); len(reply.Messages) != 0 {
+		t.Errorf("expected empty dead-letter queue; got %+v", reply.Messages)
+	}
+
+	reapReply := &ReapQueueResponse{}
+	if r.ReapQueue(&ReapQueueRequest{Inbox: inbox}, reapReply); reapReply.Error == nil {
+		t.Error("expected error reaping without max results")
+	}
+}
+
+// TestRangeQueueIndexAndSplits verifies only visible messages are
+// indexed for reaping, and that ranges aren't split within an inbox's
+// keys.
+func TestRangeQueueIndexAndSplits(t *testing.T) {
+	store := NewStore(NewInMem(1<<20), nil)
+	defer store.Close()
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	replica := Replica{NodeID: testIdent.NodeID, StoreID: testIdent.StoreID, RangeID: 1}
+	rng, err := store.CreateRange(KeyMin, KeyMax, []Replica{replica})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inbox := Key("inbox")
+	now := time.Now().UnixNano()
+	for i := 0; i < 20; i++ {
+		reply := &EnqueueMessageResponse{}
+		rng.EnqueueMessage(&EnqueueMessageRequest{
+			RequestHeader: RequestHeader{Timestamp: now},
+			Inbox:         inbox,
+			Message:       Value{Bytes: []byte(fmt.Sprintf("m%d", i))},
+		}, reply)
+		if reply.Error != nil {
+			t.Fatal(reply.Error)
+		}
+	}
+	reply := &ReapQueueResponse{}
+	rng.ReapQueue(&ReapQueueRequest{RequestHeader: RequestHeader{Timestamp: now}, Inbox: inbox, MaxResults: 15}, reply)
+	if reply.Error != nil || len(reply.Messages) != 15 {
+		t.Fatalf("expected 15 messages reaped; got %d, %v", len(reply.Messages), reply.Error)
+	}
+	prefix := queueVisiblePrefix(inbox, false)
+	if kvs, err := store.engine.scan(prefix, PrefixEndKey(prefix), 0); err != nil || len(kvs) != 5 {
+		t.Errorf("expected 5 visible messages indexed; got %d, %v", len(kvs), err)
+	}
+
+	splitKey, err := rng.splitKey()
+	if err != nil || !bytes.Equal(splitKey, inbox) {
+		t.Errorf("expected split at inbox %q; got %q, %v", inbox, splitKey, err)
+	}
+	if _, err := store.SplitRange(rng.Metadata().RangeID, queueMessageKey(inbox, 10, false), nil); err == nil {
+		t.Error("expected error splitting within inbox")
+	}
+	if _, err := store.SplitRange(rng.Metadata().RangeID, inbox, nil); err != nil {
+		t.Errorf("expected split at inbox to succeed; got %v", err)
+	}
+}
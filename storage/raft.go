@@ -18,6 +18,87 @@
 
 package storage
 
+import (
+	"encoding/gob"
+	"math/rand"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// init registers the arguments of read-write commands, which are
+// encoded as interfaces in raft log entries, and their replies, which
+// are encoded as interfaces in the response cache.
+func init() {
+	for _, args := range []interface{}{
+		&PutRequest{}, &IncrementRequest{}, &AppendRequest{}, &DeleteRequest{},
+		&DeleteRangeRequest{}, &EndTransactionRequest{}, &AccumulateTSRequest{},
+		&ReapQueueRequest{}, &EnqueueUpdateRequest{}, &EnqueueMessageRequest{}, &AckQueueRequest{},
+		&InternalBulkWriteRequest{}, &InternalChangeReplicasRequest{}, &InternalSplitRequest{},
+		&InternalSubsumeRequest{}, &InternalMergeRequest{},
+		&InternalTouchRequest{}, &InternalLeaseRequest{},
+		&InternalPushTxnRequest{}, &InternalResolveIntentRequest{}, &InternalTxnResolvedRequest{},
+		&InternalComputeChecksumRequest{}, &InternalCloseTimestampRequest{},
+	} {
+		gob.Register(args)
+	}
+	for _, newReply := range raftReplies {
+		gob.Register(newReply())
+	}
+}
+
+// raftReplies creates an empty reply for each read-write command, for
+// the execution of commands proposed by other replicas.
+var raftReplies = map[string]func() interface{}{
+	"Put":                     func() interface{} { return &PutResponse{} },
+	"Increment":               func() interface{} { return &IncrementResponse{} },
+	"Append":                  func() interface{} { return &AppendResponse{} },
+	"Delete":                  func() interface{} { return &DeleteResponse{} },
+	"DeleteRange":             func() interface{} { return &DeleteRangeResponse{} },
+	"EndTransaction":          func() interface{} { return &EndTransactionResponse{} },
+	"AccumulateTS":            func() interface{} { return &AccumulateTSResponse{} },
+	"ReapQueue":               func() interface{} { return &ReapQueueResponse{} },
+	"EnqueueUpdate":           func() interface{} { return &EnqueueUpdateResponse{} },
+	"EnqueueMessage":          func() interface{} { return &EnqueueMessageResponse{} },
+	"AckQueue":                func() interface{} { return &AckQueueResponse{} },
+	"InternalBulkWrite":       func() interface{} { return &InternalBulkWriteResponse{} },
+	"InternalChangeReplicas":  func() interface{} { return &InternalChangeReplicasResponse{} },
+	"InternalSplit":           func() interface{} { return &InternalSplitResponse{} },
+	"InternalSubsume":         func() interface{} { return &InternalSubsumeResponse{} },
+	"InternalMerge":           func() interface{} { return &InternalMergeResponse{} },
+	"InternalTouch":           func() interface{} { return &InternalTouchResponse{} },
+	"InternalLease":           func() interface{} { return &InternalLeaseResponse{} },
+	"InternalPushTxn":         func() interface{} { return &InternalPushTxnResponse{} },
+	"InternalResolveIntent":   func() interface{} { return &InternalResolveIntentResponse{} },
+	"InternalTxnResolved":     func() interface{} { return &InternalTxnResolvedResponse{} },
+	"InternalComputeChecksum": func() interface{} { return &InternalComputeChecksumResponse{} },
+	"InternalCloseTimestamp":  func() interface{} { return &InternalCloseTimestampResponse{} },
+}
+
+// Raft timing, in ticks of raftTickInterval.
+const (
+	// raftElectionTicks is the minimum number of ticks a follower waits
+	// without hearing from a leader before campaigning. The actual
+	// timeout is randomized up to twice this, so that replicas rarely
+	// campaign simultaneously.
+	raftElectionTicks = 10
+	// raftHeartbeatTicks is the number of ticks between the appends a
+	// leader sends to maintain its leadership.
+	raftHeartbeatTicks = 2
+)
+
+const (
+	// raftMaxAppendEntries limits the entries sent in one append.
+	raftMaxAppendEntries = 64
+	// defaultRaftMaxLogEntries is the number of applied entries a
+	// range's log retains before it's compacted into a snapshot.
+	defaultRaftMaxLogEntries = 1000
+)
+
+// raftTickInterval is the interval between raft ticks. Tests lower it
+// to speed up elections.
+var raftTickInterval = 50 * time.Millisecond
+
 // A LogEntry provides serialization of a read/write command. Once
 // committed to the log, the command is executed and the result
 // returned via the done channel.
@@ -28,3 +109,722 @@ type LogEntry struct {
 
 	done chan error // Used to signal waiting RPC handler
 }
+
+// A RaftTransport delivers raft messages to the replicas of ranges,
+// which may reside on other nodes. Send must not block; messages
+// which can't be delivered may be dropped, as raft retransmits as
+// necessary. SnapshotChunk fetches a chunk of the snapshot held by
+// the replica specified by args.Replica, blocking until it's received.
+type RaftTransport interface {
+	Send(msg *RaftMessage) error
+	SnapshotChunk(args *InternalSnapshotChunkRequest, reply *InternalSnapshotChunkResponse) error
+}
+
+// RaftMessageType is the type of a RaftMessage.
+type RaftMessageType int
+
+// Raft message types.
+const (
+	RaftVote            RaftMessageType = iota // Candidate requests a vote
+	RaftVoteResponse                           // Vote granted or denied
+	RaftAppend                                 // Leader appends entries; also a heartbeat
+	RaftAppendResponse                         // Append accepted or rejected
+	RaftInstallSnapshot                        // Leader replaces a lagging follower's log and data
+	RaftTimeoutNow                             // Leader hands its leadership to a caught up follower
+)
+
+// A RaftEntry is an entry in a range's raft log. Entries without a
+// command are appended by new leaders to commit the entries of their
+// predecessors.
+type RaftEntry struct {
+	Term    int64  `protobuf:"1"`
+	Index   int64  `protobuf:"2"`
+	Command []byte `protobuf:"3"` // Gob-encoded raftCommand
+}
+
+// A RaftSnapshot holds the data of a range as of a log index. It
+// replaces the log entries up to and including the index, which are
+// discarded once applied. The Rows of a snapshot aren't sent in
+// RaftInstallSnapshot messages, which may be retransmitted with every
+// heartbeat; the recipient's range fetches them from the leader in
+// chunks. See Range.maybeFetchSnapshot.
+type RaftSnapshot struct {
+	Index    int64      `protobuf:"1"`
+	Term     int64      `protobuf:"2"`
+	Subsumed bool       `protobuf:"3"` // The range had been subsumed by a merge; see Range.InternalSubsume
+	Rows     []KeyValue `protobuf:"4"` // The range's replicated data, as fetched by a follower
+}
+
+// A RaftMessage is sent between the replicas of a range to elect a
+// leader and replicate its log.
+type RaftMessage struct {
+	Type     RaftMessageType `protobuf:"1"`
+	RangeID  int64           `protobuf:"2"`
+	From     Replica         `protobuf:"3"`
+	To       Replica         `protobuf:"4"`
+	Term     int64           `protobuf:"5"`  // Sender's term
+	Index    int64           `protobuf:"6"`  // Append: index preceding Entries; vote: candidate's last index; response: follower's last matching index
+	LogTerm  int64           `protobuf:"7"`  // Term of the entry at Index
+	Entries  []RaftEntry     `protobuf:"8"`  // Entries to append
+	Commit   int64           `protobuf:"9"`  // Leader's commit index
+	Reject   bool            `protobuf:"10"` // Response: vote denied or append failed
+	Snapshot *RaftSnapshot   `protobuf:"11"`
+}
+
+// raftCommand is a read-write command as encoded in a RaftEntry.
+type raftCommand struct {
+	Method string
+	Args   interface{}
+}
+
+// raftRole is the role of a replica in its range's raft group.
+type raftRole int
+
+const (
+	raftFollower raftRole = iota
+	raftCandidate
+	raftLeader
+)
+
+// replicaID identifies a replica of a range by its node and store.
+type replicaID struct {
+	NodeID, StoreID int32
+}
+
+// idOf returns the replicaID of replica.
+func idOf(replica Replica) replicaID {
+	return replicaID{replica.NodeID, replica.StoreID}
+}
+
+// A raftGroup implements the Raft consensus algorithm for the
+// replicas of a range, as described in "In Search of an
+// Understandable Consensus Algorithm" by Diego Ongaro and John
+// Ousterhout. A raftGroup only maintains state; its range drives it,
+// delivering messages and ticks, sending the messages it produces and
+// applying the entries it commits. It's accessed only by the range's
+// processing goroutine. The range persists the group's hard state and
+// log before sending its messages, so that a replica keeps its
+// promises across restarts; see Range.persistRaft.
+type raftGroup struct {
+	rangeID int64
+	self    Replica
+	peers   []Replica // All replicas of the range, including self
+	role    raftRole
+	term    int64
+	voted   bool      // True if a vote was cast in the current term
+	vote    replicaID // Recipient of the vote in the current term
+	leader  *Replica  // Leader of the current term, if known
+
+	// entries[0] holds only the index and term of the last compacted
+	// entry; it's index zero and term zero for an uncompacted log.
+	entries  []RaftEntry
+	unstable int64         // Index of the first entry which may not be persisted
+	commit   int64         // Index of the last entry known to be committed
+	applied  int64         // Index of the last entry applied by the range
+	snapshot *RaftSnapshot // Snapshot of the compacted entries, for lagging followers
+	restore  *RaftSnapshot // Snapshot received from the leader, awaiting application
+
+	votes      map[replicaID]bool  // Candidate: votes received
+	next       map[replicaID]int64 // Leader: next entry to send to each replica
+	match      map[replicaID]int64 // Leader: last entry known to be replicated to each replica
+	transferee *Replica            // Leader: replica to which leadership is being transferred
+
+	electionElapsed  int // Ticks since hearing from the leader or granting a vote
+	electionTimeout  int // Randomized ticks before campaigning
+	heartbeatElapsed int // Leader: ticks since the last heartbeat
+	transferElapsed  int // Leader: ticks since the leadership transfer began
+
+	rand *rand.Rand
+	msgs []*RaftMessage // Outgoing messages; see readMessages
+}
+
+// newRaftGroup returns a raft group for the range with the specified
+// ID, whose replicas are peers, as seen by the replica self. A group
+// with a single replica is its own leader from the outset.
+func newRaftGroup(rangeID int64, self Replica, peers []Replica) *raftGroup {
+	return restoreRaftGroup(rangeID, self, peers, raftHardState{}, nil)
+}
+
+// restoreRaftGroup returns a raft group as does newRaftGroup, but with
+// the hard state and log entries persisted by the replica before it
+// restarted. The replica follows until it hears from a leader.
+func restoreRaftGroup(rangeID int64, self Replica, peers []Replica, state raftHardState, entries []RaftEntry) *raftGroup {
+	g := &raftGroup{
+		rangeID: rangeID,
+		self:    self,
+		peers:   peers,
+		term:    state.Term,
+		voted:   state.Voted,
+		vote:    state.Vote,
+		entries: append([]RaftEntry{{Term: state.FirstTerm, Index: state.FirstIndex}}, entries...),
+		commit:  state.Commit,
+		applied: state.Applied,
+		rand:    util.NewPseudoRand(),
+	}
+	g.unstable = g.lastIndex() + 1
+	g.becomeFollower(g.term, nil)
+	if g.quorum() <= 1 {
+		g.campaign()
+	}
+	return g
+}
+
+// quorum returns the number of replicas which constitute a majority.
+func (g *raftGroup) quorum() int {
+	return len(g.peers)/2 + 1
+}
+
+// isLeader returns whether this replica is the leader.
+func (g *raftGroup) isLeader() bool {
+	return g.role == raftLeader
+}
+
+// hardState returns the state of the group which must be persisted
+// before its messages are sent.
+func (g *raftGroup) hardState() raftHardState {
+	return raftHardState{
+		Term:       g.term,
+		Voted:      g.voted,
+		Vote:       g.vote,
+		Commit:     g.commit,
+		Applied:    g.applied,
+		FirstIndex: g.entries[0].Index,
+		FirstTerm:  g.entries[0].Term,
+		LastIndex:  g.lastIndex(),
+	}
+}
+
+// unstableEntries returns the entries of the log which may not yet be
+// persisted; persistedTo must be invoked once they are.
+func (g *raftGroup) unstableEntries() []RaftEntry {
+	offset := g.entries[0].Index
+	if g.unstable <= offset {
+		return g.entries[1:]
+	}
+	return g.entries[g.unstable-offset:]
+}
+
+// persistedTo records that the entries up to index have been
+// persisted.
+func (g *raftGroup) persistedTo(index int64) {
+	g.unstable = index + 1
+}
+
+// lastIndex returns the index of the last entry in the log.
+func (g *raftGroup) lastIndex() int64 {
+	return g.entries[len(g.entries)-1].Index
+}
+
+// lastTerm returns the term of the last entry in the log.
+func (g *raftGroup) lastTerm() int64 {
+	return g.entries[len(g.entries)-1].Term
+}
+
+// termAt returns the term of the entry at index. Returns false if the
+// entry has been compacted or doesn't exist.
+func (g *raftGroup) termAt(index int64) (int64, bool) {
+	offset := g.entries[0].Index
+	if index < offset || index > g.lastIndex() {
+		return 0, false
+	}
+	return g.entries[index-offset].Term, true
+}
+
+// send queues msg for delivery, filling in the sender's details.
+func (g *raftGroup) send(msg *RaftMessage) {
+	msg.RangeID = g.rangeID
+	msg.From = g.self
+	msg.Term = g.term
+	g.msgs = append(g.msgs, msg)
+}
+
+// readMessages returns the messages queued since the last call.
+func (g *raftGroup) readMessages() []*RaftMessage {
+	msgs := g.msgs
+	g.msgs = nil
+	return msgs
+}
+
+// resetElectionTimeout restarts the election timer with a new
+// randomized timeout.
+func (g *raftGroup) resetElectionTimeout() {
+	g.electionElapsed = 0
+	g.electionTimeout = raftElectionTicks + g.rand.Intn(raftElectionTicks)
+}
+
+// becomeFollower makes this replica a follower of leader, which may
+// be nil if unknown, advancing to term if it's newer.
+func (g *raftGroup) becomeFollower(term int64, leader *Replica) {
+	if term > g.term {
+		g.term = term
+		g.voted = false
+		g.vote = replicaID{}
+	}
+	g.role = raftFollower
+	g.leader = leader
+	g.transferee = nil
+	g.resetElectionTimeout()
+}
+
+// campaign starts an election for a new term, voting for this
+// replica and requesting the votes of the others.
+func (g *raftGroup) campaign() {
+	g.role = raftCandidate
+	g.term++
+	g.leader = nil
+	g.voted = true
+	g.vote = idOf(g.self)
+	g.votes = map[replicaID]bool{idOf(g.self): true}
+	g.resetElectionTimeout()
+	if g.quorum() <= 1 {
+		g.becomeLeader()
+		return
+	}
+	for _, peer := range g.peers {
+		if idOf(peer) != idOf(g.self) {
+			g.send(&RaftMessage{Type: RaftVote, To: peer, Index: g.lastIndex(), LogTerm: g.lastTerm()})
+		}
+	}
+}
+
+// becomeLeader makes this replica the leader of the current term. An
+// empty entry is appended, as a leader may only count replicas of
+// entries from its own term towards committing them.
+func (g *raftGroup) becomeLeader() {
+	g.role = raftLeader
+	self := g.self
+	g.leader = &self
+	g.heartbeatElapsed = 0
+	g.transferee = nil
+	g.next = map[replicaID]int64{}
+	g.match = map[replicaID]int64{}
+	for _, peer := range g.peers {
+		g.next[idOf(peer)] = g.lastIndex() + 1
+	}
+	g.appendEntry(nil)
+	g.broadcastAppend()
+}
+
+// tick advances the group's clock, campaigning if the election
+// timeout elapses without contact from a leader, or sending
+// heartbeats if this replica is the leader.
+func (g *raftGroup) tick() {
+	if g.role == raftLeader {
+		if g.transferee != nil {
+			if g.transferElapsed++; g.transferElapsed >= raftElectionTicks {
+				g.transferee = nil
+			}
+		}
+		if g.heartbeatElapsed++; g.heartbeatElapsed >= raftHeartbeatTicks {
+			g.heartbeatElapsed = 0
+			g.broadcastAppend()
+		}
+		return
+	}
+	if g.electionElapsed++; g.electionElapsed >= g.electionTimeout {
+		g.campaign()
+	}
+}
+
+// propose appends command to the log for replication. Returns the
+// index and term of the new entry, or false if this replica isn't
+// the leader or is transferring its leadership.
+func (g *raftGroup) propose(command []byte) (int64, int64, bool) {
+	if g.role != raftLeader || g.transferee != nil {
+		return 0, 0, false
+	}
+	g.appendEntry(command)
+	g.broadcastAppend()
+	return g.lastIndex(), g.term, true
+}
+
+// appendEntry appends an entry for command to the leader's log.
+func (g *raftGroup) appendEntry(command []byte) {
+	g.entries = append(g.entries, RaftEntry{Term: g.term, Index: g.lastIndex() + 1, Command: command})
+	g.match[idOf(g.self)] = g.lastIndex()
+	g.maybeCommit()
+}
+
+// transferLeadership hands the leadership to target, one of the
+// group's other replicas, as described in section 3.10 of Ongaro's
+// dissertation: once target's log is caught up, it's told to campaign
+// immediately, which it wins as no other replica's log is more up to
+// date. Proposals are refused meanwhile, so that target can catch up.
+// The transfer is abandoned if target doesn't take over within an
+// election timeout.
+func (g *raftGroup) transferLeadership(target Replica) {
+	if !g.isLeader() || idOf(target) == idOf(g.self) || !g.isPeer(target) {
+		return
+	}
+	g.transferee = &target
+	g.transferElapsed = 0
+	g.maybeSendTimeoutNow()
+}
+
+// maybeSendTimeoutNow tells the transferee to campaign if its log is
+// caught up, or otherwise sends it the entries it lacks.
+func (g *raftGroup) maybeSendTimeoutNow() {
+	if g.transferee == nil {
+		return
+	}
+	if g.match[idOf(*g.transferee)] < g.lastIndex() {
+		g.sendAppend(*g.transferee)
+		return
+	}
+	g.send(&RaftMessage{Type: RaftTimeoutNow, To: *g.transferee})
+}
+
+// broadcastAppend sends entries, or a heartbeat if there are none, to
+// all other replicas.
+func (g *raftGroup) broadcastAppend() {
+	for _, peer := range g.peers {
+		if idOf(peer) != idOf(g.self) {
+			g.sendAppend(peer)
+		}
+	}
+}
+
+// sendAppend sends the entries following those known to be
+// replicated to peer. If they've been compacted, the snapshot which
+// replaced them is sent instead.
+func (g *raftGroup) sendAppend(peer Replica) {
+	next := g.next[idOf(peer)]
+	prevTerm, ok := g.termAt(next - 1)
+	if !ok {
+		if g.snapshot != nil {
+			snap := &RaftSnapshot{Index: g.snapshot.Index, Term: g.snapshot.Term}
+			g.send(&RaftMessage{Type: RaftInstallSnapshot, To: peer, Snapshot: snap})
+		}
+		return
+	}
+	end := g.lastIndex() + 1
+	if end-next > raftMaxAppendEntries {
+		end = next + raftMaxAppendEntries
+	}
+	// Entries are copied, as the message is encoded asynchronously
+	// and the log may be truncated should this replica lose its
+	// leadership.
+	offset := g.entries[0].Index
+	entries := append([]RaftEntry(nil), g.entries[next-offset:end-offset]...)
+	g.send(&RaftMessage{
+		Type:    RaftAppend,
+		To:      peer,
+		Index:   next - 1,
+		LogTerm: prevTerm,
+		Entries: entries,
+		Commit:  g.commit,
+	})
+}
+
+// maybeCommit advances the leader's commit index to the last entry
+// of its term replicated to a quorum.
+func (g *raftGroup) maybeCommit() {
+	best := g.commit
+	for _, candidate := range g.match {
+		if candidate <= best {
+			continue
+		}
+		count := 0
+		for _, peer := range g.peers {
+			if g.match[idOf(peer)] >= candidate {
+				count++
+			}
+		}
+		if term, _ := g.termAt(candidate); count >= g.quorum() && term == g.term {
+			best = candidate
+		}
+	}
+	g.commit = best
+}
+
+// replicated returns the index through which every replica's log is
+// known to match the leader's, or zero if this replica isn't the
+// leader.
+func (g *raftGroup) replicated() int64 {
+	if !g.isLeader() {
+		return 0
+	}
+	min := g.lastIndex()
+	for _, peer := range g.peers {
+		if match := g.match[idOf(peer)]; match < min {
+			min = match
+		}
+	}
+	return min
+}
+
+// commitTo records that the entry at index, of the specified term, is
+// committed, as learned other than from the leader. By the log
+// matching property, the log through index then matches the leader's,
+// so is committed too. Ignored unless the log holds the entry.
+func (g *raftGroup) commitTo(index, term int64) {
+	if index <= g.commit {
+		return
+	}
+	if t, ok := g.termAt(index); ok && t == term {
+		g.commit = index
+	}
+}
+
+// step processes a message from another replica. Messages from
+// replicas which aren't peers are ignored, so that replicas removed
+// from the group, or not yet added to it, can't disrupt it.
+func (g *raftGroup) step(msg *RaftMessage) {
+	if !g.isPeer(msg.From) {
+		return
+	}
+	switch {
+	case msg.Term > g.term:
+		var leader *Replica
+		if msg.Type == RaftAppend || msg.Type == RaftInstallSnapshot {
+			from := msg.From
+			leader = &from
+		}
+		g.becomeFollower(msg.Term, leader)
+	case msg.Term < g.term:
+		// Inform a stale leader or candidate of the current term.
+		switch msg.Type {
+		case RaftAppend, RaftInstallSnapshot:
+			g.send(&RaftMessage{Type: RaftAppendResponse, To: msg.From, Reject: true, Index: g.lastIndex()})
+		case RaftVote:
+			g.send(&RaftMessage{Type: RaftVoteResponse, To: msg.From, Reject: true})
+		}
+		return
+	}
+	switch msg.Type {
+	case RaftVote:
+		g.handleVote(msg)
+	case RaftVoteResponse:
+		if g.role != raftCandidate {
+			return
+		}
+		g.votes[idOf(msg.From)] = !msg.Reject
+		granted := 0
+		for _, ok := range g.votes {
+			if ok {
+				granted++
+			}
+		}
+		if granted >= g.quorum() {
+			g.becomeLeader()
+		}
+	case RaftAppend:
+		g.handleAppend(msg)
+	case RaftAppendResponse:
+		if g.role == raftLeader {
+			g.handleAppendResponse(msg)
+		}
+	case RaftInstallSnapshot:
+		g.handleSnapshot(msg)
+	case RaftTimeoutNow:
+		if g.role == raftFollower {
+			g.campaign()
+		}
+	}
+}
+
+// isPeer returns whether replica is one of the group's replicas.
+func (g *raftGroup) isPeer(replica Replica) bool {
+	for _, peer := range g.peers {
+		if idOf(peer) == idOf(replica) {
+			return true
+		}
+	}
+	return false
+}
+
+// setPeers replaces the group's replicas with peers. A leader begins
+// replicating to added replicas from its snapshot, which must be
+// taken before it next sends entries; see Range.compactRaftLog.
+// Replicas are changed at most one at a time; see
+// Store.ChangeReplicas.
+func (g *raftGroup) setPeers(peers []Replica) {
+	g.peers = peers
+	if !g.isLeader() {
+		return
+	}
+	ids := map[replicaID]struct{}{}
+	for _, peer := range peers {
+		id := idOf(peer)
+		ids[id] = struct{}{}
+		if _, ok := g.next[id]; !ok {
+			g.next[id] = g.entries[0].Index
+			g.match[id] = 0
+		}
+	}
+	for id := range g.next {
+		if _, ok := ids[id]; !ok {
+			delete(g.next, id)
+			delete(g.match, id)
+		}
+	}
+	g.maybeCommit()
+}
+
+// handleVote grants a candidate's request for a vote if no other
+// candidate has received this replica's vote in the term and the
+// candidate's log is at least as up to date as this replica's.
+func (g *raftGroup) handleVote(msg *RaftMessage) {
+	upToDate := msg.LogTerm > g.lastTerm() ||
+		(msg.LogTerm == g.lastTerm() && msg.Index >= g.lastIndex())
+	grant := (!g.voted || g.vote == idOf(msg.From)) && upToDate
+	if grant {
+		g.voted = true
+		g.vote = idOf(msg.From)
+		g.resetElectionTimeout()
+	}
+	g.send(&RaftMessage{Type: RaftVoteResponse, To: msg.From, Reject: !grant})
+}
+
+// handleAppend appends the leader's entries to the log if the log
+// contains the entry which precedes them, replacing any conflicting
+// entries, and advances the commit index.
+func (g *raftGroup) handleAppend(msg *RaftMessage) {
+	from := msg.From
+	g.becomeFollower(msg.Term, &from)
+	lastNew := msg.Index + int64(len(msg.Entries))
+	index, entries := msg.Index, msg.Entries
+	offset := g.entries[0].Index
+	if index < offset {
+		// Entries up to the compacted index are committed, so they
+		// match those of the leader.
+		skip := offset - index
+		if skip > int64(len(entries)) {
+			g.send(&RaftMessage{Type: RaftAppendResponse, To: from, Index: lastNew})
+			return
+		}
+		entries = entries[skip:]
+	} else if term, ok := g.termAt(index); !ok || term != msg.LogTerm {
+		g.send(&RaftMessage{Type: RaftAppendResponse, To: from, Reject: true, Index: g.lastIndex()})
+		return
+	}
+	for i, entry := range entries {
+		if term, ok := g.termAt(entry.Index); ok {
+			if term == entry.Term {
+				continue
+			}
+			// Conflicting entries can't have been committed.
+			g.entries = g.entries[:entry.Index-offset]
+			if entry.Index < g.unstable {
+				g.unstable = entry.Index
+			}
+		}
+		g.entries = append(g.entries, entries[i:]...)
+		break
+	}
+	if commit := msg.Commit; commit > g.commit {
+		if commit > lastNew {
+			commit = lastNew
+		}
+		if commit > g.commit {
+			g.commit = commit
+		}
+	}
+	g.send(&RaftMessage{Type: RaftAppendResponse, To: from, Index: lastNew})
+}
+
+// handleAppendResponse records the entries replicated to a follower
+// and sends it any which follow. If the follower rejected the append,
+// earlier entries are sent, back to the end of its log.
+func (g *raftGroup) handleAppendResponse(msg *RaftMessage) {
+	id := idOf(msg.From)
+	if msg.Reject {
+		next := g.next[id] - 1
+		if msg.Index+1 < next {
+			next = msg.Index + 1
+		}
+		if next < 1 {
+			next = 1
+		}
+		g.next[id] = next
+		g.sendAppend(msg.From)
+		return
+	}
+	if msg.Index > g.match[id] {
+		g.match[id] = msg.Index
+		g.maybeCommit()
+	}
+	if g.next[id] <= msg.Index {
+		g.next[id] = msg.Index + 1
+	}
+	if g.next[id] <= g.lastIndex() {
+		g.sendAppend(msg.From)
+	} else if g.transferee != nil && idOf(*g.transferee) == id && g.match[id] == g.lastIndex() {
+		g.send(&RaftMessage{Type: RaftTimeoutNow, To: msg.From})
+	}
+}
+
+// handleSnapshot replaces the log with the leader's snapshot, unless
+// the log already contains its entries. The range applies the
+// snapshot; see takeRestore.
+func (g *raftGroup) handleSnapshot(msg *RaftMessage) {
+	from := msg.From
+	g.becomeFollower(msg.Term, &from)
+	snap := msg.Snapshot
+	if snap.Index > g.commit {
+		g.entries = []RaftEntry{{Term: snap.Term, Index: snap.Index}}
+		g.unstable = snap.Index + 1
+		g.commit = snap.Index
+		g.snapshot = snap
+		g.restore = snap
+	}
+	g.send(&RaftMessage{Type: RaftAppendResponse, To: from, Index: snap.Index})
+}
+
+// needsSnapshot returns whether the rows of the snapshot in msg, a
+// RaftInstallSnapshot message, must be fetched before the message is
+// stepped: whether the message is from the leader of the current or
+// a later term and the snapshot follows the commit index. If so, the
+// sender is followed as leader, so that this replica doesn't campaign
+// while the rows are fetched.
+func (g *raftGroup) needsSnapshot(msg *RaftMessage) bool {
+	if !g.isPeer(msg.From) || msg.Term < g.term || msg.Snapshot.Index <= g.commit {
+		return false
+	}
+	from := msg.From
+	g.becomeFollower(msg.Term, &from)
+	return true
+}
+
+// takeRestore returns a snapshot received from the leader which must
+// be applied to the range before any further entries, or nil if
+// there is none. The snapshot's index is considered applied.
+func (g *raftGroup) takeRestore() *RaftSnapshot {
+	snap := g.restore
+	if snap != nil {
+		g.restore = nil
+		g.applied = snap.Index
+	}
+	return snap
+}
+
+// unapplied returns the committed entries which haven't yet been
+// applied; appliedTo must be invoked as they're applied.
+func (g *raftGroup) unapplied() []RaftEntry {
+	if g.restore != nil {
+		return nil
+	}
+	offset := g.entries[0].Index
+	return g.entries[g.applied-offset+1 : g.commit-offset+1]
+}
+
+// appliedTo records that the entries up to index have been applied.
+func (g *raftGroup) appliedTo(index int64) {
+	g.applied = index
+}
+
+// compactable returns whether more than max applied entries are
+// retained in the log.
+func (g *raftGroup) compactable(max int) bool {
+	return g.applied-g.entries[0].Index > int64(max)
+}
+
+// compact discards the applied entries from the log, replacing them
+// with a snapshot as of the last applied entry. The snapshot's rows,
+// the range's data, are served by the range; see Range.SnapshotChunk.
+func (g *raftGroup) compact() {
+	offset := g.entries[0].Index
+	term, _ := g.termAt(g.applied)
+	g.snapshot = &RaftSnapshot{Index: g.applied, Term: term}
+	g.entries = append([]RaftEntry{{Term: term, Index: g.applied}}, g.entries[g.applied-offset+1:]...)
+}
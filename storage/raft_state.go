@@ -0,0 +1,144 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"encoding/binary"
+	"strconv"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+var (
+	// keyRaftStatePrefix is the prefix for store-local keys holding the
+	// raft hard state of each range's replica. The value is a struct of
+	// type raftHardState.
+	keyRaftStatePrefix = Key("\x00\x00\x00raft-state-")
+	// keyRaftLogPrefix is the prefix for store-local keys holding the
+	// raft log entries of each range's replica. The value is a struct
+	// of type RaftEntry.
+	keyRaftLogPrefix = Key("\x00\x00\x00raft-log-")
+)
+
+// rangeRaftStateKey creates a raft hard state key as the
+// concatenation of the keyRaftStatePrefix and hexadecimal-formatted
+// range ID.
+func rangeRaftStateKey(rangeID int64) Key {
+	return MakeKey(keyRaftStatePrefix, Key(strconv.FormatInt(rangeID, 16)))
+}
+
+// rangeRaftLogPrefix creates the prefix of a range's raft log keys as
+// the concatenation of the keyRaftLogPrefix and hexadecimal-formatted
+// range ID, terminated so that no range's prefix is a prefix of
+// another's.
+func rangeRaftLogPrefix(rangeID int64) Key {
+	return MakeKey(keyRaftLogPrefix, Key(strconv.FormatInt(rangeID, 16)+"-"))
+}
+
+// rangeRaftLogKey creates the key of the raft log entry at index,
+// ordered by index.
+func rangeRaftLogKey(rangeID, index int64) Key {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(index))
+	return MakeKey(rangeRaftLogPrefix(rangeID), Key(buf[:]))
+}
+
+// raftHardState is the state of a replica's raft group which survives
+// restarts: the term and vote, which are promises to the other
+// replicas, the extent of the log and the indexes of the entries
+// committed and applied.
+type raftHardState struct {
+	Term       int64
+	Voted      bool
+	Vote       replicaID
+	Commit     int64
+	Applied    int64
+	FirstIndex int64 // Index of the last compacted entry
+	FirstTerm  int64 // Term of the last compacted entry
+	LastIndex  int64
+}
+
+// loadRaftState reads the raft hard state and log entries persisted by
+// the replica before it restarted. Returns false if none were.
+func (r *Range) loadRaftState() (raftHardState, []RaftEntry, bool, error) {
+	var state raftHardState
+	rangeID := r.Metadata().RangeID
+	ok, _, err := getI(r.engine, rangeRaftStateKey(rangeID), &state)
+	if err != nil || !ok {
+		return raftHardState{}, nil, false, err
+	}
+	var entries []RaftEntry
+	for index := state.FirstIndex + 1; index <= state.LastIndex; index++ {
+		var entry RaftEntry
+		ok, _, err := getI(r.engine, rangeRaftLogKey(rangeID, index), &entry)
+		if err != nil {
+			return raftHardState{}, nil, false, err
+		} else if !ok {
+			return raftHardState{}, nil, false, util.Errorf("range %d: raft log entry %d is missing", rangeID, index)
+		}
+		entries = append(entries, entry)
+	}
+	return state, entries, true, nil
+}
+
+// persistRaft persists the raft group's hard state and any log entries
+// not yet persisted, atomically. It must precede sending the group's
+// messages, which may acknowledge entries or grant votes.
+func (r *Range) persistRaft() error {
+	state := r.raft.hardState()
+	if state == r.raftState && len(r.raft.unstableEntries()) == 0 {
+		return nil
+	}
+	b := NewBatch(r.engine)
+	if err := r.writeRaftState(b, state); err != nil {
+		return err
+	}
+	if err := b.Commit(); err != nil {
+		return err
+	}
+	r.raftPersisted(state)
+	return nil
+}
+
+// writeRaftState writes, via b, state and the log entries not yet
+// persisted, and deletes those truncated or compacted since the hard
+// state last persisted.
+func (r *Range) writeRaftState(b *Batch, state raftHardState) error {
+	rangeID := r.Metadata().RangeID
+	prev := r.raftState
+	for index := prev.FirstIndex + 1; index <= prev.LastIndex; index++ {
+		if index > state.FirstIndex && index <= state.LastIndex {
+			index = state.LastIndex // Retained; rewritten if unstable
+			continue
+		}
+		if err := b.del(rangeRaftLogKey(rangeID, index)); err != nil {
+			return err
+		}
+	}
+	for _, entry := range r.raft.unstableEntries() {
+		if err := putI(b, rangeRaftLogKey(rangeID, entry.Index), &entry); err != nil {
+			return err
+		}
+	}
+	return putI(b, rangeRaftStateKey(rangeID), &state)
+}
+
+// raftPersisted records that state and the log entries it spans have
+// been persisted.
+func (r *Range) raftPersisted(state raftHardState) {
+	r.raftState = state
+	r.raft.persistedTo(state.LastIndex)
+}
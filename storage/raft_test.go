@@ -0,0 +1,553 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// testReplicas returns n replicas of range 1, on nodes and stores
+// numbered from 1.
+func testReplicas(n int) []Replica {
+	var replicas []Replica
+	for i := 1; i <= n; i++ {
+		replicas = append(replicas, Replica{NodeID: int32(i), StoreID: int32(i), RangeID: 1})
+	}
+	return replicas
+}
+
+// newTestRaftGroups returns a raft group for each of n replicas.
+func newTestRaftGroups(n int) []*raftGroup {
+	replicas := testReplicas(n)
+	var groups []*raftGroup
+	for _, replica := range replicas {
+		groups = append(groups, newRaftGroup(1, replica, replicas))
+	}
+	return groups
+}
+
+// deliver delivers messages between groups until none remain.
+// Messages to or from the groups at the indexes in isolated are
+// dropped.
+func deliver(groups []*raftGroup, isolated ...int) {
+	drop := map[int32]bool{}
+	for _, i := range isolated {
+		drop[groups[i].self.NodeID] = true
+	}
+	for {
+		var msgs []*RaftMessage
+		for _, g := range groups {
+			msgs = append(msgs, g.readMessages()...)
+		}
+		if len(msgs) == 0 {
+			return
+		}
+		for _, msg := range msgs {
+			if !drop[msg.From.NodeID] && !drop[msg.To.NodeID] {
+				groups[msg.To.NodeID-1].step(msg)
+			}
+		}
+	}
+}
+
+// elect ticks the group at index i until it campaigns and delivers
+// the resulting messages.
+func elect(groups []*raftGroup, i int, isolated ...int) {
+	for term := groups[i].term; groups[i].term == term; {
+		groups[i].tick()
+	}
+	deliver(groups, isolated...)
+}
+
+// applyAll marks the committed entries of groups as applied.
+func applyAll(groups []*raftGroup) {
+	for _, g := range groups {
+		g.takeRestore()
+		g.appliedTo(g.commit)
+	}
+}
+
+// TestRaftGroupElection verifies a replica which campaigns is elected
+// and that its proposals are committed by all replicas.
+func TestRaftGroupElection(t *testing.T) {
+	groups := newTestRaftGroups(3)
+	elect(groups, 1)
+	for i, g := range groups {
+		if g.leader == nil || g.leader.NodeID != 2 {
+			t.Fatalf("%d: expected replica on node 2 to be leader; got %+v", i, g.leader)
+		}
+	}
+	if _, _, ok := groups[0].propose([]byte("cmd")); ok {
+		t.Error("expected follower to refuse proposal")
+	}
+	index, _, ok := groups[1].propose([]byte("cmd"))
+	if !ok {
+		t.Fatal("expected leader to accept proposal")
+	}
+	deliver(groups)
+	// Followers learn of the commit with the next heartbeat.
+	for i := 0; i < raftHeartbeatTicks; i++ {
+		groups[1].tick()
+	}
+	deliver(groups)
+	for i, g := range groups {
+		entries := g.unapplied()
+		if g.commit != index || len(entries) == 0 || string(entries[len(entries)-1].Command) != "cmd" {
+			t.Errorf("%d: expected command committed at %d; got commit %d, entries %+v", i, index, g.commit, entries)
+		}
+	}
+}
+
+// TestRaftGroupSingleReplica verifies a group with one replica leads
+// from the outset and commits proposals immediately.
+func TestRaftGroupSingleReplica(t *testing.T) {
+	g := newTestRaftGroups(1)[0]
+	index, _, ok := g.propose([]byte("cmd"))
+	if !ok || g.commit != index {
+		t.Errorf("expected proposal committed; got ok=%t, commit %d of %d", ok, g.commit, index)
+	}
+	if msgs := g.readMessages(); len(msgs) != 0 {
+		t.Errorf("expected no messages; got %+v", msgs)
+	}
+}
+
+// TestRaftGroupLeaderFailure verifies a new leader is elected when the
+// leader is isolated, that the deposed leader's uncommitted entries
+// are replaced on its return, and that a replica whose log lacks
+// committed entries can't be elected.
+func TestRaftGroupLeaderFailure(t *testing.T) {
+	groups := newTestRaftGroups(3)
+	elect(groups, 0)
+	groups[0].propose([]byte("committed"))
+	deliver(groups)
+	groups[0].propose([]byte("lost"))
+	deliver(groups, 0)
+
+	// Replica 3 holds all committed entries, so it may be elected.
+	elect(groups, 2, 0)
+	if !groups[2].isLeader() || groups[2].term != 2 {
+		t.Fatalf("expected replica 3 to lead term 2; role %d, term %d", groups[2].role, groups[2].term)
+	}
+	groups[2].propose([]byte("replacement"))
+	deliver(groups, 0)
+
+	// The deposed leader steps down once it hears from the new one,
+	// replacing its uncommitted entry.
+	groups[2].propose([]byte("final"))
+	deliver(groups)
+	if groups[0].isLeader() || groups[0].term != 2 {
+		t.Errorf("expected deposed leader to follow in term 2; role %d, term %d", groups[0].role, groups[0].term)
+	}
+	for i, g := range groups {
+		var cmds []string
+		for _, entry := range g.entries[1:] {
+			if len(entry.Command) > 0 {
+				cmds = append(cmds, string(entry.Command))
+			}
+		}
+		if fmt.Sprint(cmds) != "[committed replacement final]" {
+			t.Errorf("%d: unexpected log %v", i, cmds)
+		}
+	}
+
+	// Isolate replica 1 while a command commits; it can't then be
+	// elected with its shorter log.
+	groups[2].propose([]byte("unseen"))
+	deliver(groups, 0)
+	elect(groups, 0)
+	if groups[0].isLeader() {
+		t.Error("expected replica with stale log to lose election")
+	}
+}
+
+// TestRaftGroupTransferLeadership verifies the leader hands its
+// leadership to a follower once the follower's log is caught up,
+// refusing proposals meanwhile.
+func TestRaftGroupTransferLeadership(t *testing.T) {
+	groups := newTestRaftGroups(3)
+	elect(groups, 0)
+	groups[0].propose([]byte("cmd"))
+	deliver(groups, 2)
+
+	// Replica 3 missed the command, so it's caught up before it's told
+	// to campaign.
+	groups[0].transferLeadership(groups[2].self)
+	if _, _, ok := groups[0].propose([]byte("refused")); ok {
+		t.Error("expected leader to refuse proposals while transferring leadership")
+	}
+	deliver(groups)
+	if !groups[2].isLeader() || groups[2].term != 2 {
+		t.Fatalf("expected replica 3 to lead term 2; role %d, term %d", groups[2].role, groups[2].term)
+	}
+	if groups[0].isLeader() || groups[0].transferee != nil {
+		t.Errorf("expected former leader to follow; role %d, transferee %+v", groups[0].role, groups[0].transferee)
+	}
+
+	// A transfer to an isolated replica is abandoned after an election
+	// timeout.
+	groups[2].transferLeadership(groups[1].self)
+	deliver(groups, 1)
+	for i := 0; i < raftElectionTicks; i++ {
+		groups[2].tick()
+	}
+	if _, _, ok := groups[2].propose([]byte("cmd")); !ok {
+		t.Error("expected leader to accept proposals once transfer was abandoned")
+	}
+}
+
+// TestRaftGroupSnapshot verifies a follower which falls behind a
+// compacted log is caught up with a snapshot.
+func TestRaftGroupSnapshot(t *testing.T) {
+	groups := newTestRaftGroups(3)
+	elect(groups, 0)
+	for i := 0; i < 10; i++ {
+		groups[0].propose([]byte(fmt.Sprintf("cmd%d", i)))
+		deliver(groups, 2)
+	}
+	applyAll(groups)
+	if !groups[0].compactable(5) {
+		t.Fatal("expected leader's log to be compactable")
+	}
+	groups[0].compact()
+	for i := 0; i < raftHeartbeatTicks; i++ {
+		groups[0].tick()
+	}
+	deliver(groups)
+	// The snapshot's rows are fetched separately by the range.
+	snap := groups[2].takeRestore()
+	if snap == nil || snap.Index != groups[0].commit || len(snap.Rows) != 0 {
+		t.Fatalf("expected snapshot at %d without rows; got %+v", groups[0].commit, snap)
+	}
+	// Subsequent entries are appended following the snapshot.
+	index, _, _ := groups[0].propose([]byte("after"))
+	deliver(groups)
+	if groups[2].lastIndex() != index {
+		t.Errorf("expected follower's log to end at %d; got %d", index, groups[2].lastIndex())
+	}
+}
+
+// TestRaftGroupCommitTo verifies a follower which holds a committed
+// entry commits it when told, unless its entry differs or it lacks
+// one, and that the leader reports the extent of its log replicated
+// to all replicas.
+func TestRaftGroupCommitTo(t *testing.T) {
+	groups := newTestRaftGroups(3)
+	elect(groups, 0)
+	index, term, _ := groups[0].propose([]byte("cmd"))
+	deliver(groups, 2)
+	if replicated := groups[0].replicated(); replicated >= index {
+		t.Errorf("expected entry %d not replicated to isolated replica; got %d", index, replicated)
+	}
+	// Replica 2 has yet to hear of the commit.
+	groups[1].commitTo(index, term+1)
+	if groups[1].commit >= index {
+		t.Errorf("expected entry of another term not committed; got commit %d", groups[1].commit)
+	}
+	groups[1].commitTo(index, term)
+	if groups[1].commit != index {
+		t.Errorf("expected commit %d; got %d", index, groups[1].commit)
+	}
+	groups[2].commitTo(index, term)
+	if groups[2].commit >= index {
+		t.Errorf("expected entry missing from log not committed; got commit %d", groups[2].commit)
+	}
+
+	// Replica 3 is caught up by the next heartbeat.
+	for i := 0; i < raftHeartbeatTicks; i++ {
+		groups[0].tick()
+	}
+	deliver(groups)
+	if replicated := groups[0].replicated(); replicated != index {
+		t.Errorf("expected entry %d replicated to all replicas; got %d", index, replicated)
+	}
+	if replicated := groups[1].replicated(); replicated != 0 {
+		t.Errorf("expected follower to report nothing replicated; got %d", replicated)
+	}
+}
+
+// testRaftTransport delivers raft messages between ranges in the same
+// process. Messages to or from isolated replicas are dropped. If
+// failEvery is set, every failEvery'th snapshot chunk fetched fails.
+type testRaftTransport struct {
+	mu        sync.Mutex
+	ranges    map[int32]*Range // Ranges by node ID
+	isolated  map[int32]bool
+	failEvery int
+	chunks    int // Snapshot chunks fetched
+}
+
+// Send implements the RaftTransport interface.
+func (tt *testRaftTransport) Send(msg *RaftMessage) error {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	if tt.isolated[msg.From.NodeID] || tt.isolated[msg.To.NodeID] {
+		return nil
+	}
+	rng, ok := tt.ranges[msg.To.NodeID]
+	if !ok {
+		return util.Errorf("no range on node %d", msg.To.NodeID)
+	}
+	return rng.StepRaft(msg)
+}
+
+// SnapshotChunk implements the RaftTransport interface.
+func (tt *testRaftTransport) SnapshotChunk(args *InternalSnapshotChunkRequest, reply *InternalSnapshotChunkResponse) error {
+	tt.mu.Lock()
+	tt.chunks++
+	fail := tt.failEvery > 0 && tt.chunks%tt.failEvery == 0
+	rng, ok := tt.ranges[args.Replica.NodeID]
+	tt.mu.Unlock()
+	if fail {
+		return util.Errorf("injected failure fetching chunk %d", tt.chunks)
+	}
+	if !ok {
+		return util.Errorf("no range on node %d", args.Replica.NodeID)
+	}
+	rng.SnapshotChunk(args, reply)
+	return nil
+}
+
+// isolate sets whether messages to and from the replica on nodeID
+// are dropped.
+func (tt *testRaftTransport) isolate(nodeID int32, isolated bool) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	tt.isolated[nodeID] = isolated
+}
+
+// startTestReplicatedRanges starts n replicas of a range spanning
+// the key space, connected via a testRaftTransport. Raft ticks are
+// shortened for the duration of the test, and each range's log is
+// compacted beyond maxLog applied entries.
+func startTestReplicatedRanges(t *testing.T, n, maxLog int) ([]*Range, *testRaftTransport, func()) {
+	defer func(interval time.Duration) { raftTickInterval = interval }(raftTickInterval)
+	raftTickInterval = 2 * time.Millisecond
+	tt := &testRaftTransport{ranges: map[int32]*Range{}, isolated: map[int32]bool{}}
+	replicas := testReplicas(n)
+	meta := RangeMetadata{
+		RangeID:  1,
+		StartKey: KeyMin,
+		EndKey:   KeyMax,
+		Replicas: RangeLocations{StartKey: KeyMin, Replicas: replicas},
+	}
+	var ranges []*Range
+	for _, replica := range replicas {
+		rng := NewRange(meta, NewInMem(1<<20), nil, nil)
+		rng.raftMaxLog = maxLog
+		rng.setRaftTransport(StoreIdent{NodeID: replica.NodeID, StoreID: replica.StoreID}, tt)
+		tt.ranges[replica.NodeID] = rng
+		ranges = append(ranges, rng)
+	}
+	for _, rng := range ranges {
+		rng.Start()
+	}
+	return ranges, tt, func() {
+		for _, rng := range ranges {
+			rng.Stop()
+		}
+	}
+}
+
+// waitForLeader returns the range among ranges which leads, once one
+// is elected and known to the others.
+func waitForLeader(t *testing.T, ranges []*Range) *Range {
+	var leader *Range
+	if err := util.IsTrueWithin(func() bool {
+		leader = nil
+		for _, rng := range ranges {
+			if rng.IsLeader() {
+				leader = rng
+			}
+		}
+		if leader == nil {
+			return false
+		}
+		for _, rng := range ranges {
+			if err, ok := rng.notLeaderError().(*NotLeaderError); rng != leader && (!ok || err.Leader == nil || err.Leader.NodeID != leader.self.NodeID) {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second); err != nil {
+		t.Fatal("no leader elected")
+	}
+	return leader
+}
+
+// waitForValue waits until key has value in the engine of rng.
+func waitForValue(t *testing.T, rng *Range, key Key, value string) {
+	if err := util.IsTrueWithin(func() bool {
+		v, err := rng.engine.get(key)
+		return err == nil && string(v.Bytes) == value
+	}, 5*time.Second); err != nil {
+		t.Fatalf("range on node %d: %q never set to %q", rng.self.NodeID, key, value)
+	}
+}
+
+// TestRangeReplication verifies writes to the leader of a replicated
+// range are applied by all replicas, that followers redirect
+// requests to the leader, and that a new leader is elected and
+// accepts writes when the leader fails.
+func TestRangeReplication(t *testing.T) {
+	ranges, tt, stop := startTestReplicatedRanges(t, 3, defaultRaftMaxLogEntries)
+	defer stop()
+	leader := waitForLeader(t, ranges)
+	put := &PutRequest{Key: Key("a"), Value: Value{Bytes: []byte("1")}}
+	if err := <-leader.ReadWriteCmd("Put", put, &PutResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	var followers []*Range
+	for _, rng := range ranges {
+		waitForValue(t, rng, Key("a"), "1")
+		if rng != leader {
+			followers = append(followers, rng)
+		}
+	}
+
+	err := <-followers[0].ReadWriteCmd("Put", put, &PutResponse{})
+	if nle, ok := err.(*NotLeaderError); !ok || nle.Leader == nil || nle.Leader.NodeID != leader.self.NodeID {
+		t.Errorf("expected write to follower to redirect to leader; got %v", err)
+	}
+	err = followers[0].ReadOnlyCmd("Get", &GetRequest{Key: Key("a")}, &GetResponse{})
+	if _, ok := err.(*NotLeaderError); !ok {
+		t.Errorf("expected read from follower to redirect to leader; got %v", err)
+	}
+
+	// Isolate the leader; one of the followers takes over.
+	tt.isolate(leader.self.NodeID, true)
+	newLeader := waitForLeader(t, followers)
+	put = &PutRequest{Key: Key("b"), Value: Value{Bytes: []byte("2")}}
+	if err := <-newLeader.ReadWriteCmd("Put", put, &PutResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	// On its return, the former leader follows and catches up.
+	tt.isolate(leader.self.NodeID, false)
+	waitForValue(t, leader, Key("b"), "2")
+	if waitForLeader(t, ranges) == leader {
+		t.Error("expected former leader to follow")
+	}
+}
+
+// TestRangeReplicationSnapshot verifies a replica which misses writes
+// compacted from the leader's log is caught up with a snapshot,
+// fetched in chunks, and that a fetch which fails resumes from the
+// chunks already received.
+func TestRangeReplicationSnapshot(t *testing.T) {
+	defer func(bytes int64) { snapshotChunkBytes = bytes }(snapshotChunkBytes)
+	snapshotChunkBytes = 1
+	ranges, tt, stop := startTestReplicatedRanges(t, 3, 5)
+	defer stop()
+	// Fetches of more than two chunks complete only if resumed.
+	tt.failEvery = 3
+	leader := waitForLeader(t, ranges)
+	var lagging *Range
+	for _, rng := range ranges {
+		if rng != leader {
+			lagging = rng
+		}
+	}
+	tt.isolate(lagging.self.NodeID, true)
+	for i := 0; i < 20; i++ {
+		put := &PutRequest{Key: Key(fmt.Sprintf("key%02d", i)), Value: Value{Bytes: []byte("v")}}
+		if err := <-leader.ReadWriteCmd("Put", put, &PutResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tt.isolate(lagging.self.NodeID, false)
+	for i := 0; i < 20; i++ {
+		waitForValue(t, lagging, Key(fmt.Sprintf("key%02d", i)), "v")
+	}
+	tt.mu.Lock()
+	chunks := tt.chunks
+	tt.mu.Unlock()
+	if chunks < 20 {
+		t.Errorf("expected snapshot fetched a row per chunk; got %d chunks", chunks)
+	}
+	// Writes following the snapshot are caught up from the log. The
+	// lagging replica's campaigns while isolated may have deposed the
+	// leader on its return, so the write is retried against the leader
+	// elected since.
+	put := &PutRequest{Key: Key("after"), Value: Value{Bytes: []byte("v")}}
+	if err := util.IsTrueWithin(func() bool {
+		return <-waitForLeader(t, ranges).ReadWriteCmd("Put", put, &PutResponse{}) == nil
+	}, 5*time.Second); err != nil {
+		t.Fatal("write following snapshot never succeeded")
+	}
+	waitForValue(t, lagging, Key("after"), "v")
+}
+
+// TestRangeRaftRestart verifies a range restarted over the same engine
+// restores its raft term and log, including the compaction of the
+// log, and doesn't execute entries it applied before the restart
+// again.
+func TestRangeRaftRestart(t *testing.T) {
+	engine := createTestEngine(t)
+	meta := RangeMetadata{RangeID: 1, StartKey: KeyMin, EndKey: KeyMax, Replicas: testRangeLocations}
+	start := func(maxLog int) *Range {
+		rng := NewRange(meta, engine, nil, nil)
+		rng.raftMaxLog = maxLog
+		rng.Start()
+		return rng
+	}
+	increment := func(rng *Range, expected int64) {
+		reply := &IncrementResponse{}
+		if err := <-rng.ReadWriteCmd("Increment", &IncrementRequest{Key: Key("a"), Increment: 1}, reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.NewValue != expected {
+			t.Fatalf("expected %d; got %d", expected, reply.NewValue)
+		}
+	}
+	stop := func(rng *Range) raftHardState {
+		var state raftHardState
+		if err := util.IsTrueWithin(func() bool {
+			var ok bool
+			var err error
+			state, _, ok, err = rng.loadRaftState()
+			return err == nil && ok && state.Applied == state.LastIndex
+		}, 1*time.Second); err != nil {
+			t.Fatal("raft state never persisted")
+		}
+		rng.Stop()
+		return state
+	}
+
+	rng := start(defaultRaftMaxLogEntries)
+	for i := int64(1); i <= 5; i++ {
+		increment(rng, i)
+	}
+	first := stop(rng)
+
+	// The entries applied before the restart aren't executed again.
+	rng = start(2)
+	for i := int64(6); i <= 10; i++ {
+		increment(rng, i)
+	}
+	second := stop(rng)
+	if second.Term <= first.Term || second.LastIndex <= first.LastIndex || second.FirstIndex == 0 {
+		t.Errorf("expected a later term and a longer, compacted log than %+v; got %+v", first, second)
+	}
+
+	// Nor are those of a compacted log.
+	rng = start(2)
+	defer rng.Stop()
+	increment(rng, 11)
+}
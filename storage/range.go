@@ -21,6 +21,7 @@ import (
 	"bytes"
 	"encoding/gob"
 	"reflect"
+	"sync"
 	"time"
 
 	"github.com/cockroachdb/cockroach/gossip"
@@ -28,14 +29,25 @@ import (
 	"github.com/golang/glog"
 )
 
-// init pre-registers RangeLocations and PrefixConfigMap types.
+// init registers the types of the infos gossiped by ranges and nodes
+// with the gossip network, which also registers them with gob.
+// Configs are registered as pointers, as which they're loaded, so
+// that gossiped configs decode likewise.
 func init() {
-	gob.Register(RangeLocations{})
-	gob.Register(StoreAttributes{})
-	gob.Register([]*prefixConfig{})
-	gob.Register(AcctConfig{})
-	gob.Register(PermConfig{})
-	gob.Register(ZoneConfig{})
+	gossip.RegisterInfoType(gossip.KeyClusterID, "")
+	gossip.RegisterInfoType(gossip.KeyClusterVersion, ClusterVersion)
+	gossip.RegisterInfoType(gossip.KeyFirstRangeMetadata, RangeLocations{})
+	gossip.RegisterInfoType(gossip.KeyStorePrefix+".*", StoreDescriptor{})
+	gossip.RegisterInfoType(gossip.KeyNodeLivenessPrefix+"*", NodeLiveness{})
+	for _, cp := range configPrefixes {
+		gossip.RegisterInfoType(cp.gossipKey, []*prefixConfig{})
+	}
+	gob.Register(&AcctConfig{})
+	gob.Register(&PermConfig{})
+	gob.Register(&ZoneConfig{})
+	gob.Register(&CompressionConfig{})
+	gob.Register(&TTLConfig{})
+	gob.Register(&FreezeConfig{})
 }
 
 // ttlClusterIDGossip is time-to-live for cluster ID. The cluster ID
@@ -46,6 +58,24 @@ func init() {
 // the first range gossips it.
 const ttlClusterIDGossip = 30 * time.Second
 
+// ttlFirstRangeGossip is the time-to-live of the first range's
+// metadata, which is re-gossipped alongside the cluster ID, so that
+// stale metadata expires should no leader remain to gossip it.
+const ttlFirstRangeGossip = ttlClusterIDGossip
+
+// defaultResponseCacheSize is the number of replies to read/write
+// commands each range retains in memory for replay to retrying
+// clients. Older replies are read from the engine; see cachedReply.
+const defaultResponseCacheSize = 1024
+
+// ClusterVersion is the feature version of this node's software. It
+// is gossiped along with the cluster ID so that clients may verify
+// the cluster supports a feature before using it.
+//
+// Version 2 adds Append and GetByteRange. Version 3 implements
+// AccumulateTS and adds GetTSBlock.
+const ClusterVersion = 3
+
 // configPrefixes describes administrative configuration maps
 // affecting ranges of the key-value map by key prefix.
 var configPrefixes = []struct {
@@ -57,6 +87,9 @@ var configPrefixes = []struct {
 	{KeyConfigAccountingPrefix, gossip.KeyConfigAccounting, AcctConfig{}, true},
 	{KeyConfigPermissionPrefix, gossip.KeyConfigPermission, PermConfig{}, true},
 	{KeyConfigZonePrefix, gossip.KeyConfigZone, ZoneConfig{}, true},
+	{KeyConfigCompressionPrefix, gossip.KeyConfigCompression, CompressionConfig{}, true},
+	{KeyConfigTTLPrefix, gossip.KeyConfigTTL, TTLConfig{}, true},
+	{KeyConfigFreezePrefix, gossip.KeyConfigFreeze, FreezeConfig{}, true},
 }
 
 // A RangeMetadata holds information about the range, including
@@ -76,74 +109,210 @@ type RangeMetadata struct {
 // integrity by replacing failed replicas, splitting and merging
 // as appropriate.
 type Range struct {
-	Meta      RangeMetadata
-	engine    Engine         // The underlying key-value store
-	allocator *allocator     // Makes allocation decisions
-	gossip    *gossip.Gossip // Range may gossip based on contents
-	pending   chan *LogEntry // Not-yet-proposed log entries
-	closer    chan struct{}  // Channel for closing the range
-	// TODO(andybons): raft instance goes here.
+	metaMu    sync.RWMutex      // Protects meta
+	meta      RangeMetadata     // Changes on split and merge; see Metadata()
+	engine    Engine            // The underlying key-value store
+	allocator *allocator        // Makes allocation decisions
+	gossip    *gossip.Gossip    // Range may gossip based on contents
+	pending   chan *LogEntry    // Not-yet-proposed log entries
+	closer    chan struct{}     // Channel for closing the range
+	stopMu    sync.RWMutex      // Protects stopped
+	stopped   bool              // True once Stop() has been invoked
+	acct      *acctStats        // Usage attributed by account
+	usageMu   sync.Mutex        // Serializes writes with usage recomputation
+	applyMu   sync.Mutex        // Serializes read-write commands with the range's other writers
+	stage     *Batch            // Writes of the executing read-write command; protected by applyMu
+	staged    []func()          // Invoked once stage commits; protected by applyMu
+	subsumed  bool              // Refusing read-write commands ahead of a merge; written by processPending under applyMu
+	statsMu   sync.Mutex        // Protects stats
+	stats     RangeStats        // Persisted statistics of the range's data
+	feed      *eventFeed        // Recent changes, for watchers
+	respCache *util.LRUCache    // Replies to recent read/write commands by ClientCmdID
+	policyMu  sync.RWMutex      // Protects dicts, zones, ttls, perms and freezes
+	dicts     *CompressionDicts // Compression dictionaries by key prefix
+	zones     *prefixConfigMap  // Zone configs, for storage policies; may be nil
+	ttls      *prefixConfigMap  // TTL configs, for garbage collection; may be nil
+	perms     *prefixConfigMap  // Permission configs, for requests; may be nil
+	freezes   []*prefixConfig   // Freeze configs, for requests
+
+	touchMu    sync.Mutex              // Protects touching
+	touching   map[string]struct{}     // Keys with outstanding InternalTouch commands
+	leaseMu    sync.RWMutex            // Protects lease, extending and transfer
+	lease      Lease                   // Most recently applied lease
+	extending  bool                    // A lease extension is outstanding
+	transfer   *Replica                // Replica to which the lease is being transferred
+	ident      StoreIdent              // Identifies the store holding this replica
+	store      *Store                  // Holds this replica and the ranges split from it; may be nil
+	transport  RaftTransport           // Sends raft messages to other replicas; may be nil
+	raftMsgs   chan *RaftMessage       // Incoming raft messages
+	commits    chan RaftEntry          // Entries learned to be committed; see InternalMerge
+	raftMaxLog int                     // Applied entries retained before compacting the log
+	raft       *raftGroup              // Accessed only by processPending
+	raftState  raftHardState           // Raft hard state last persisted; accessed only by processPending
+	proposals  map[int64]*raftProposal // Commands proposed by this replica, by log index
+	applying   RaftEntry               // Entry being applied; accessed only by processPending
+	raftMu     sync.RWMutex            // Protects self, leader, applied and replicated
+	self       Replica                 // This replica
+	leader     *Replica                // Raft leader, if known
+	applied    int64                   // Index of the last entry applied
+	replicated int64                   // Leader: index through which all replicas' logs match
+
+	snapMu       sync.Mutex          // Protects snapshot
+	snapshot     *snapshotSource     // Snapshot served to followers; see SnapshotChunk
+	snapThrottle *throttle           // Paces chunks served to followers; may be nil
+	fetched      chan *snapshotFetch // Completed snapshot fetches
+	fetching     bool                // A snapshot fetch is in progress; accessed only by processPending
+	partial      *RaftSnapshot       // Rows of a failed fetch, to resume; accessed only by processPending
+
+	checksumMu sync.Mutex       // Protects checksums
+	checksums  []*rangeChecksum // Most recently computed checksums, oldest first
+
+	compactMu   sync.Mutex      // Protects compactHint
+	compactHint *compactionHint // Span of bulk deletions to compact; may be nil
+
+	closedMu sync.Mutex          // Protects closed, resolved and inflight
+	closed   int64               // Timestamp at and below which no writes are made; see openTimestamp
+	resolved int64               // Resolved timestamp most recently applied; see InternalCloseTimestamp
+	inflight map[*LogEntry]int64 // Timestamps of read-write commands awaiting execution
+}
+
+// A raftProposal is a command proposed by this replica, awaiting
+// commitment at the log index and term at which it was proposed.
+type raftProposal struct {
+	*LogEntry
+	term int64
 }
 
-// NewRange initializes the range starting at key.
+// NewRange initializes the range starting at key. An engine which
+// doesn't support range tombstones is wrapped in one which does.
 func NewRange(meta RangeMetadata, engine Engine, allocator *allocator, gossip *gossip.Gossip) *Range {
+	if _, ok := engine.(*tombstoneEngine); !ok {
+		engine = newTombstoneEngine(engine)
+	}
 	r := &Range{
-		Meta:      meta,
-		engine:    engine,
-		allocator: allocator,
-		gossip:    gossip,
-		pending:   make(chan *LogEntry, 100 /* TODO(spencer): what's correct value? */),
-		closer:    make(chan struct{}),
+		meta:       meta,
+		engine:     engine,
+		allocator:  allocator,
+		gossip:     gossip,
+		pending:    make(chan *LogEntry, 100 /* TODO(spencer): what's correct value? */),
+		closer:     make(chan struct{}),
+		acct:       newAcctStats(),
+		feed:       newEventFeed(defaultFeedSize),
+		respCache:  util.NewLRUCache(defaultResponseCacheSize),
+		raftMsgs:   make(chan *RaftMessage, 256),
+		commits:    make(chan RaftEntry),
+		raftMaxLog: defaultRaftMaxLogEntries,
+		fetched:    make(chan *snapshotFetch),
+		proposals:  map[int64]*raftProposal{},
+		touching:   map[string]struct{}{},
+		inflight:   map[*LogEntry]int64{},
 	}
 	return r
 }
 
+// setRaftTransport sets the transport via which the range replicates
+// to its replicas on other stores and the identity of the store which
+// holds it. Must be invoked before Start; a range started without a
+// transport replicates to no one.
+func (r *Range) setRaftTransport(ident StoreIdent, transport RaftTransport) {
+	r.ident = ident
+	r.transport = transport
+}
+
 // Start begins gossiping and starts the pending log entry processing
 // loop in a goroutine.
 func (r *Range) Start() {
+	r.loadSubsumed()
+	r.startRaft()
 	r.maybeGossipClusterID()
 	r.maybeGossipFirstRange()
 	r.maybeGossipConfigs()
-	go r.processPending()
+	r.loadAcctConfigs()
+	r.loadStoragePolicies()
+	r.loadPermConfigs()
+	r.loadFreezeConfigs()
+	r.loadLease()
+	r.initUsage()
+	r.loadStats()
+	go r.processPending(raftTickInterval)
 	go r.startGossip()
 }
 
-// Stop ends the log processing loop.
+// Stop ends the log processing loop. Read-write commands which are
+// pending or subsequently submitted fail with an error.
 func (r *Range) Stop() {
-	close(r.closer)
+	r.stopMu.Lock()
+	defer r.stopMu.Unlock()
+	if !r.stopped {
+		r.stopped = true
+		close(r.closer)
+	}
+}
+
+// Metadata returns the range's metadata. The key span of a range
+// changes when it is split or merged, so callers should not cache
+// the returned value.
+func (r *Range) Metadata() RangeMetadata {
+	r.metaMu.RLock()
+	defer r.metaMu.RUnlock()
+	return r.meta
+}
+
+// setMetadata replaces the range's metadata.
+func (r *Range) setMetadata(meta RangeMetadata) {
+	r.metaMu.Lock()
+	defer r.metaMu.Unlock()
+	r.meta = meta
 }
 
 // IsFirstRange returns true if this is the first range.
 func (r *Range) IsFirstRange() bool {
-	return bytes.Equal(r.Meta.StartKey, KeyMin)
+	return bytes.Equal(r.Metadata().StartKey, KeyMin)
 }
 
 // IsLeader returns true if this range replica is the raft leader.
-// TODO(spencer): this is always true for now.
 func (r *Range) IsLeader() bool {
-	return true
+	r.raftMu.RLock()
+	defer r.raftMu.RUnlock()
+	return r.leader != nil && idOf(*r.leader) == idOf(r.self)
+}
+
+// notLeaderError returns an error redirecting a request to the raft
+// leader, if known.
+func (r *Range) notLeaderError() error {
+	r.raftMu.RLock()
+	defer r.raftMu.RUnlock()
+	err := &NotLeaderError{Replica: r.self}
+	if r.leader != nil {
+		leader := *r.leader
+		err.Leader = &leader
+	}
+	return err
 }
 
-// ReadOnlyCmd executes a read-only command against the store. If this
-// server is the raft leader, we can satisfy the read
-// locally. Otherwise, if this server has executed a raft command or
-// heartbeat at a timestamp greater than the read timestamp, we can
-// also satisfy the read locally. Otherwise, we must ping the leader
-// to determine with certainty whether our local data is up to
-// date.
+// ReadOnlyCmd executes a read-only command against the store if this
+// replica holds the range's lease, which the raft leader acquires as
+// necessary. Otherwise, a NotLeaseHolderError or NotLeaderError is
+// returned so that the client may redirect the read to the replica
+// whose data is up to date, unless the request's header sets
+// AnyReplica or a read consistency this replica can serve; see
+// servesFollowerRead. See Lease.
 func (r *Range) ReadOnlyCmd(method string, args, reply interface{}) error {
 	if r == nil {
 		return util.Errorf("invalid node specification")
 	}
+	if !r.servesFollowerRead(requestHeader(args)) {
+		if err := r.checkLease(); err != nil {
+			return err
+		}
+	}
 	return r.executeCmd(method, args, reply)
 }
 
 // ReadWriteCmd executes a read-write command against the store. If
-// this node is the raft leader, it proposes the write to the other
-// raft participants. Otherwise, the write is forwarded via a
-// FollowerPropose RPC to the leader and this replica waits for an ACK
-// to execute the command locally and return the result to the
-// requesting client.
+// this replica is the raft leader, it proposes the write to the other
+// raft participants. Otherwise, the command fails with a
+// NotLeaderError so that the client may redirect it to the leader.
 //
 // Commands which mutate the store must be proposed as part of the
 // raft consensus write protocol. Only after committed can the command
@@ -162,49 +331,391 @@ func (r *Range) ReadWriteCmd(method string, args, reply interface{}) <-chan erro
 		Reply:  reply,
 		done:   make(chan error, 1),
 	}
-	r.pending <- logEntry
+	r.stopMu.RLock()
+	defer r.stopMu.RUnlock()
+	if r.stopped {
+		logEntry.done <- util.Errorf("range %d has been stopped", r.Metadata().RangeID)
+	} else {
+		r.trackWrite(logEntry)
+		r.pending <- logEntry
+	}
 
 	return logEntry.done
 }
 
-// processPending processes pending read/write commands, sending them
-// to other replicas in the set as necessary to achieve consensus.
-// This method processes indefinitely or until the Range.Stop() is
-// invoked.
-//
-// TODO(spencer): this is pretty temporary. Just executing commands
-// immediately until raft is in place.
-func (r *Range) processPending() {
+// startRaft creates the range's raft group, restoring the hard state
+// and log persisted before a restart, if any. The group includes the
+// range's replicas on other stores only if the range has a transport
+// to reach them.
+func (r *Range) startRaft() {
+	meta := r.Metadata()
+	self := Replica{NodeID: r.ident.NodeID, StoreID: r.ident.StoreID, RangeID: meta.RangeID}
+	found := false
+	for _, replica := range meta.Replicas.Replicas {
+		if idOf(replica) == idOf(self) {
+			self, found = replica, true
+		}
+	}
+	peers := meta.Replicas.Replicas
+	if !found || r.transport == nil {
+		peers = []Replica{self}
+	}
+	state, entries, ok, err := r.loadRaftState()
+	if err != nil {
+		glog.Errorf("range %d: unable to load raft state; starting with an empty log: %v", meta.RangeID, err)
+	}
+	if ok && err == nil {
+		r.raft = restoreRaftGroup(meta.RangeID, self, peers, state, entries)
+		r.raftState = state
+		// The snapshot of the compacted entries isn't persisted; it's
+		// taken afresh of the range's data.
+		if state.FirstIndex > 0 {
+			r.compactRaftLog()
+		}
+	} else {
+		r.raft = newRaftGroup(meta.RangeID, self, peers)
+	}
+	r.raftMu.Lock()
+	r.self = self
+	r.leader = r.raft.leader
+	r.raftMu.Unlock()
+}
+
+// StepRaft delivers a raft message from another replica of the range.
+// Messages are dropped if the range is stopped or can't keep up; raft
+// retransmits as necessary.
+func (r *Range) StepRaft(msg *RaftMessage) error {
+	r.stopMu.RLock()
+	defer r.stopMu.RUnlock()
+	if r.stopped {
+		return util.Errorf("range %d has been stopped", r.Metadata().RangeID)
+	}
+	select {
+	case r.raftMsgs <- msg:
+		return nil
+	default:
+		return util.Errorf("range %d dropped raft message; too many pending", r.Metadata().RangeID)
+	}
+}
+
+// processPending proposes pending read/write commands to the range's
+// raft group, delivers raft messages and ticks to the group and
+// applies the commands it commits. This method processes
+// indefinitely or until the Range.Stop() is invoked.
+func (r *Range) processPending(tickInterval time.Duration) {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
 	for {
 		select {
 		case logEntry := <-r.pending:
-			logEntry.done <- r.executeCmd(logEntry.Method, logEntry.Args, logEntry.Reply)
+			r.propose(logEntry)
+		case msg := <-r.raftMsgs:
+			if msg.Type == RaftInstallSnapshot {
+				r.maybeFetchSnapshot(msg)
+			} else {
+				r.raft.step(msg)
+			}
+		case entry := <-r.commits:
+			r.raft.commitTo(entry.Index, entry.Term)
+		case f := <-r.fetched:
+			r.finishFetch(f)
+		case <-ticker.C:
+			r.raft.tick()
 		case <-r.closer:
+			r.publishSnapshot(nil)
+			// Fail entries which were submitted before the range
+			// stopped; the stopped flag prevents further submissions.
+			for index, p := range r.proposals {
+				r.finish(p.LogEntry, util.Errorf("range %d stopped before executing %s", r.Metadata().RangeID, p.Method))
+				delete(r.proposals, index)
+			}
+			for {
+				select {
+				case logEntry := <-r.pending:
+					r.finish(logEntry, util.Errorf("range %d stopped before executing %s", r.Metadata().RangeID, logEntry.Method))
+				default:
+					return
+				}
+			}
+		}
+		r.processRaftReady()
+	}
+}
+
+// propose appends a read-write command to the raft log, to be executed
+// once committed. Fails the command if this replica isn't the leader
+// or, unless it's a lease request, if another replica holds the
+// range's lease. The command's timestamp is moved past timestamps
+// closed since it was submitted; see trackWrite.
+func (r *Range) propose(logEntry *LogEntry) {
+	if logEntry.Method != "InternalLease" {
+		if err := r.redirectError(time.Now().UnixNano()); err != nil {
+			r.finish(logEntry, err)
 			return
 		}
 	}
+	r.trackWrite(logEntry)
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&raftCommand{Method: logEntry.Method, Args: logEntry.Args}); err != nil {
+		r.finish(logEntry, util.Errorf("unable to encode %s command: %v", logEntry.Method, err))
+		return
+	}
+	index, term, ok := r.raft.propose(buf.Bytes())
+	if !ok {
+		r.finish(logEntry, r.notLeaderError())
+		return
+	}
+	r.proposals[index] = &raftProposal{LogEntry: logEntry, term: term}
 }
 
-// startGossip periodically gossips the cluster ID if it's the
-// first range and the raft leader.
+// processRaftReady applies a snapshot received from the leader,
+// persists the raft group's hard state and log, sends the messages it
+// produced, applies committed entries and compacts the log once
+// enough entries have been applied. Messages are sent only once the
+// state they reflect is persisted; if it can't be, they're dropped,
+// as raft retransmits as necessary.
+func (r *Range) processRaftReady() {
+	if snap := r.raft.takeRestore(); snap != nil {
+		if err := r.applySnapshot(snap); err != nil {
+			glog.Errorf("range %d: failed to apply snapshot at index %d: %v", r.Metadata().RangeID, snap.Index, err)
+		} else {
+			// Once applied, the snapshot is served from the range's
+			// data, should this replica become leader.
+			r.publishSnapshot(r.newSnapshotSource(snap))
+			r.setApplied(snap.Index)
+		}
+		snap.Rows = nil
+	}
+	if err := r.persistRaft(); err != nil {
+		glog.Errorf("range %d: unable to persist raft state: %v", r.Metadata().RangeID, err)
+		r.raft.readMessages()
+		return
+	}
+	for _, msg := range r.raft.readMessages() {
+		if r.transport == nil {
+			break
+		}
+		if err := r.transport.Send(msg); err != nil {
+			glog.V(1).Infof("range %d: failed to send raft message to node %d: %v", msg.RangeID, msg.To.NodeID, err)
+		}
+	}
+	for _, entry := range r.raft.unapplied() {
+		r.applying = entry
+		r.applyEntry(entry)
+		r.raft.appliedTo(entry.Index)
+		r.setApplied(entry.Index)
+	}
+	if r.raft.compactable(r.raftMaxLog) {
+		r.compactRaftLog()
+	}
+	// Entries applied since the state was persisted are executed again
+	// should the replica restart first; the response cache answers
+	// retried client commands with their original replies.
+	if err := r.persistRaft(); err != nil {
+		glog.Errorf("range %d: unable to persist raft state: %v", r.Metadata().RangeID, err)
+	}
+	r.updateLeader()
+}
+
+// applyEntry executes the command in a committed log entry. If this
+// replica proposed the command, the proposer is signaled with the
+// result; if another command was committed in its place, the proposer
+// is redirected to the leader.
+func (r *Range) applyEntry(entry RaftEntry) {
+	p, ok := r.proposals[entry.Index]
+	if ok {
+		delete(r.proposals, entry.Index)
+		if p.term != entry.Term {
+			r.finish(p.LogEntry, r.notLeaderError())
+			ok = false
+		}
+	}
+	if len(entry.Command) == 0 {
+		return
+	}
+	if ok {
+		r.finish(p.LogEntry, r.executeCmdOnce(p.Method, p.Args, p.Reply))
+		r.maybeTransferLeadership(p.Method)
+		return
+	}
+	var cmd raftCommand
+	if err := gob.NewDecoder(bytes.NewReader(entry.Command)).Decode(&cmd); err != nil {
+		glog.Errorf("range %d: unable to decode command at index %d: %v", r.Metadata().RangeID, entry.Index, err)
+		return
+	}
+	newReply, ok := raftReplies[cmd.Method]
+	if !ok {
+		glog.Errorf("range %d: unrecognized command %s at index %d", r.Metadata().RangeID, cmd.Method, entry.Index)
+		return
+	}
+	r.executeCmdOnce(cmd.Method, cmd.Args, newReply())
+	r.maybeTransferLeadership(cmd.Method)
+}
+
+// updateLeader publishes the leader known to the raft group and, if
+// this replica is the leader, the extent of its log replicated to all
+// replicas. If this replica has lost its leadership, outstanding
+// proposals are redirected to the new leader; they may yet commit, in
+// which case the response cache ensures they're not executed again on
+// retry. If it has become the leader, it gossips as the leader.
+func (r *Range) updateLeader() {
+	wasLeader := r.IsLeader()
+	r.raftMu.Lock()
+	r.leader = nil
+	if r.raft.leader != nil {
+		leader := *r.raft.leader
+		r.leader = &leader
+	}
+	r.replicated = r.raft.replicated()
+	r.raftMu.Unlock()
+	if !r.raft.isLeader() {
+		for index, p := range r.proposals {
+			r.finish(p.LogEntry, r.notLeaderError())
+			delete(r.proposals, index)
+		}
+	} else if !wasLeader {
+		glog.Infof("range %d: replica on node %d became leader in term %d", r.Metadata().RangeID, r.self.NodeID, r.raft.term)
+		r.maybeGossipClusterID()
+		r.maybeGossipFirstRange()
+		r.maybeGossipConfigs()
+	}
+}
+
+// replicatedSpans returns the spans of keys holding the range's
+// replicated data: its plain rows, which exclude keys local to the
+// store, and the MVCC metadata and versions of its keys.
+func (r *Range) replicatedSpans() []snapshotSpan {
+	meta := r.Metadata()
+	return []snapshotSpan{
+		{start: meta.StartKey, end: meta.EndKey, skipLocal: true},
+		{start: mvccMetadataKey(meta.StartKey), end: mvccSpanEnd(meta.EndKey)},
+	}
+}
+
+// replicatedRows returns the range's replicated data, as read from
+// engine; see replicatedSpans.
+func (r *Range) replicatedRows(engine Engine) ([]KeyValue, error) {
+	var rows []KeyValue
+	for _, span := range r.replicatedSpans() {
+		kvs, err := engine.scan(span.start, span.end, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range kvs {
+			if span.includes(kv.Key) {
+				rows = append(rows, kv)
+			}
+		}
+	}
+	return rows, nil
+}
+
+// compactRaftLog replaces the applied entries of the raft log with a
+// snapshot of the range's data, which followers too far behind to be
+// caught up from the log fetch in chunks. The chunks are read from an
+// engine snapshot taken now, so that they reflect the same point in
+// the log without the range's data being held in memory. A range
+// without other replicas has no need of the snapshot.
+func (r *Range) compactRaftLog() {
+	r.raft.compact()
+	r.raft.snapshot.Subsumed = r.subsumed
+	var src *snapshotSource
+	if len(r.raft.peers) > 1 {
+		src = r.newSnapshotSource(r.raft.snapshot)
+	}
+	r.publishSnapshot(src)
+}
+
+// applySnapshot replaces the range's replicated data with that of a
+// snapshot from the leader, atomically with the raft state reflecting
+// it, so that a crash can't leave the range's data part old and part
+// new. Watchers aren't notified of the changes.
+func (r *Range) applySnapshot(snap *RaftSnapshot) error {
+	err := func() error {
+		r.applyMu.Lock()
+		defer r.applyMu.Unlock()
+		r.usageMu.Lock()
+		defer r.usageMu.Unlock()
+		meta := r.Metadata()
+		// Rows hidden by range tombstones are removed first, so that
+		// the snapshot's rows don't fragment the tombstones.
+		if _, _, err := r.compactTombstones(meta.StartKey, meta.EndKey, 0); err != nil {
+			return err
+		}
+		existing, err := r.replicatedRows(r.engine)
+		if err != nil {
+			return err
+		}
+		b := NewBatch(r.engine)
+		for _, kv := range existing {
+			if err := b.del(kv.Key); err != nil {
+				return err
+			}
+		}
+		if err := clearResponseCache(b, r.engine, r.Metadata().RangeID); err != nil {
+			return err
+		}
+		for _, kv := range snap.Rows {
+			if err := b.put(kv.Key, kv.Value); err != nil {
+				return err
+			}
+		}
+		if err := r.writeSubsumed(b, snap.Subsumed); err != nil {
+			return err
+		}
+		state := r.raft.hardState()
+		if err := r.writeRaftState(b, state); err != nil {
+			return err
+		}
+		if err := b.Commit(); err != nil {
+			return err
+		}
+		r.raftPersisted(state)
+		r.subsumed = snap.Subsumed
+		return nil
+	}()
+	r.resetUsage()
+	r.resetStats()
+	r.reloadAcctConfigs()
+	r.loadStoragePolicies()
+	r.loadPermConfigs()
+	r.loadFreezeConfigs()
+	r.loadLease()
+	return err
+}
+
+// startGossip periodically gossips the cluster ID and the range's
+// metadata if it's the first range and the raft leader. Accounting configs are refreshed
+// on the same schedule, as ranges which don't contain them learn of
+// changes only via gossip, as are storage policies, permissions and
+// freezes.
 func (r *Range) startGossip() {
 	ticker := time.NewTicker(ttlClusterIDGossip / 2)
 	for {
 		select {
 		case <-ticker.C:
 			r.maybeGossipClusterID()
+			r.maybeGossipFirstRange()
+			r.reloadAcctConfigs()
+			r.loadStoragePolicies()
+			r.loadPermConfigs()
+			r.loadFreezeConfigs()
 		case <-r.closer:
 			return
 		}
 	}
 }
 
-// maybeGossipClusterID gossips the cluster ID if this range is
-// the start of the key space and the raft leader.
+// maybeGossipClusterID gossips the cluster ID and version if this
+// range is the start of the key space and the raft leader.
 func (r *Range) maybeGossipClusterID() {
 	if r.gossip != nil && r.IsFirstRange() && r.IsLeader() {
-		if err := r.gossip.AddInfo(gossip.KeyClusterID, r.Meta.ClusterID, ttlClusterIDGossip); err != nil {
-			glog.Errorf("failed to gossip cluster ID %s: %v", r.Meta.ClusterID, err)
+		clusterID := r.Metadata().ClusterID
+		if err := r.gossip.AddInfo(gossip.KeyClusterID, clusterID, ttlClusterIDGossip); err != nil {
+			glog.Errorf("failed to gossip cluster ID %s: %v", clusterID, err)
+		}
+		if err := r.gossip.AddInfo(gossip.KeyClusterVersion, ClusterVersion, ttlClusterIDGossip); err != nil {
+			glog.Errorf("failed to gossip cluster version %d: %v", ClusterVersion, err)
 		}
 	}
 }
@@ -213,12 +724,20 @@ func (r *Range) maybeGossipClusterID() {
 // the start of the key space and the raft leader.
 func (r *Range) maybeGossipFirstRange() {
 	if r.gossip != nil && r.IsFirstRange() && r.IsLeader() {
-		if err := r.gossip.AddInfo(gossip.KeyFirstRangeMetadata, r.Meta.Replicas, 0*time.Second); err != nil {
+		if err := r.gossip.AddInfo(gossip.KeyFirstRangeMetadata, r.Metadata().Replicas, ttlFirstRangeGossip); err != nil {
 			glog.Errorf("failed to gossip first range metadata: %v", err)
 		}
 	}
 }
 
+// GetFirstRangeLocations returns the locations of the replicas of the
+// first range, as gossiped by its leader.
+func GetFirstRangeLocations(g *gossip.Gossip) (RangeLocations, error) {
+	var locations RangeLocations
+	err := g.GetInfoAs(gossip.KeyFirstRangeMetadata, &locations)
+	return locations, err
+}
+
 // maybeGossipConfigs gossips configuration maps if their data falls
 // within the range, this replica is the raft leader, and their
 // contents are marked dirty. Configuration maps include accounting,
@@ -266,10 +785,385 @@ func (r *Range) loadConfigs(keyPrefix Key, configI interface{}) ([]*prefixConfig
 	return configs, nil
 }
 
+// loadAcctConfigs sets the accounting configs used to attribute
+// usage to accounts. Configs are read directly if they fall within
+// the range; otherwise, the gossiped configs are used, if available.
+// Returns whether the configs changed.
+func (r *Range) loadAcctConfigs() bool {
+	var configs []*prefixConfig
+	if r.containsKey(KeyConfigAccountingPrefix) {
+		var err error
+		if configs, err = r.loadConfigs(KeyConfigAccountingPrefix, AcctConfig{}); err != nil {
+			glog.Errorf("failed loading accounting configs: %v", err)
+			return false
+		}
+	} else if r.gossip != nil {
+		if err := r.gossip.GetInfoAs(gossip.KeyConfigAccounting, &configs); err != nil {
+			return false
+		}
+	}
+	changed, err := r.acct.setConfigs(configs)
+	if err != nil {
+		glog.Errorf("invalid accounting configs: %v", err)
+	}
+	return changed
+}
+
+// configsFor returns the configs under keyPrefix, read directly if
+// they fall within the range and otherwise from gossip. Returns nil
+// if the configs aren't available.
+func (r *Range) configsFor(keyPrefix Key, gossipKey string, configI interface{}) ([]*prefixConfig, error) {
+	if r.containsKey(keyPrefix) {
+		return r.loadConfigs(keyPrefix, configI)
+	}
+	if r.gossip == nil {
+		return nil, nil
+	}
+	var configs []*prefixConfig
+	if err := r.gossip.GetInfoAs(gossipKey, &configs); err != nil {
+		return nil, nil
+	}
+	return configs, nil
+}
+
+// loadStoragePolicies sets the compression dictionaries, zone configs
+// and TTL configs which determine how values are stored and for how
+// long.
+func (r *Range) loadStoragePolicies() {
+	configs, err := r.configsFor(KeyConfigCompressionPrefix, gossip.KeyConfigCompression, CompressionConfig{})
+	var dicts *CompressionDicts
+	if err == nil {
+		dicts, err = newCompressionDicts(configs)
+	}
+	if err != nil {
+		glog.Errorf("failed loading compression dictionaries: %v", err)
+		return
+	}
+	var zones *prefixConfigMap
+	if configs, err = r.configsFor(KeyConfigZonePrefix, gossip.KeyConfigZone, ZoneConfig{}); err == nil && len(configs) > 0 {
+		zones, err = newPrefixConfigMap(append([]*prefixConfig(nil), configs...))
+	}
+	if err != nil {
+		glog.Errorf("failed loading zone configs: %v", err)
+		return
+	}
+	var ttls *prefixConfigMap
+	if configs, err = r.configsFor(KeyConfigTTLPrefix, gossip.KeyConfigTTL, TTLConfig{}); err == nil {
+		ttls, err = newTTLConfigs(configs)
+	}
+	if err != nil {
+		glog.Errorf("failed loading TTL configs: %v", err)
+		return
+	}
+	r.policyMu.Lock()
+	defer r.policyMu.Unlock()
+	r.dicts, r.zones, r.ttls = dicts, zones, ttls
+}
+
+// compressionDicts returns the range's compression dictionaries.
+func (r *Range) compressionDicts() *CompressionDicts {
+	r.policyMu.RLock()
+	defer r.policyMu.RUnlock()
+	return r.dicts
+}
+
+// compress returns value as it should be stored at key: compressed
+// according to the compression policy of the key's zone and the key
+// prefix's compression dictionary. System keys are never compressed.
+func (r *Range) compress(key Key, value Value) (Value, error) {
+	r.policyMu.RLock()
+	dicts, zones := r.dicts, r.zones
+	r.policyMu.RUnlock()
+	var policy string
+	if zones != nil {
+		policy = zones.matchByPrefix(key).Config.(*ZoneConfig).Compression
+	}
+	if value.DictVersion != 0 {
+		// Compressed by the client; verify the dictionary is known, so
+		// the value remains readable by other clients.
+		decompressed, err := dicts.Decompress(key, value)
+		if err != nil || policy != CompressionNone {
+			return value, err
+		}
+		return decompressed, nil
+	}
+	if policy == CompressionNone || bytes.HasPrefix(key, KeySystemPrefix) {
+		return value, nil
+	}
+	compressed, err := dicts.Compress(key, value)
+	if err != nil || compressed.DictVersion != 0 || policy != CompressionDeflate {
+		return compressed, err
+	}
+	return deflate(value, nil, DictVersionNone)
+}
+
+// decompress returns value decompressed unless the client accepts
+// compressed values, as indicated in header. Values accepted
+// compressed which are stored uncompressed are compressed if at
+// least as large as the response threshold in header.
+func (r *Range) decompress(header *RequestHeader, key Key, value Value) (Value, error) {
+	if header.AcceptCompressed {
+		if co := header.Compression; co != nil && co.ResponseThreshold > 0 && len(value.Bytes) >= co.ResponseThreshold {
+			return r.compressionDicts().CompressCodec(key, value, co.Codec)
+		}
+		return value, nil
+	}
+	return r.compressionDicts().Decompress(key, value)
+}
+
+// reloadAcctConfigs loads the accounting configs and, if they have
+// changed, re-attributes the range's usage accordingly.
+func (r *Range) reloadAcctConfigs() {
+	if r.loadAcctConfigs() {
+		r.resetUsage()
+	}
+}
+
+// usageScanBatch is the maximum number of key/value pairs read into
+// memory at a time while computing a range's usage.
+const usageScanBatch = 1000
+
+// initUsage attributes the keys and bytes already stored in the
+// range to their accounts.
+func (r *Range) initUsage() {
+	if err := r.scanUsage(r.acct); err != nil {
+		glog.Errorf("failed to scan range %d for usage: %v", r.Metadata().RangeID, err)
+	}
+}
+
+// scanUsage attributes the keys and bytes stored in the range to
+// their accounts in as. Store-local keys, such as the range's GC
+// metadata, belong to no account.
+func (r *Range) scanUsage(as *acctStats) error {
+	meta := r.Metadata()
+	for start := meta.StartKey; ; {
+		kvs, err := r.engine.scan(start, meta.EndKey, usageScanBatch)
+		if err != nil {
+			return err
+		}
+		rows := make([]KeyValue, 0, len(kvs))
+		for _, kv := range kvs {
+			if !bytes.HasPrefix(kv.Key, keyLocalPrefix) {
+				rows = append(rows, kv)
+			}
+		}
+		as.recordStored(rows)
+		if len(kvs) < usageScanBatch {
+			return nil
+		}
+		start = MakeKey(kvs[len(kvs)-1].Key, Key{0})
+	}
+}
+
+// VerifyUsage recomputes the keys and bytes stored by each account
+// from the range's data and compares them with the incrementally
+// maintained usage. Returns an entry for each account whose usage
+// has drifted. If reconcile is true, drifted usage is replaced by
+// the recomputed values.
+func (r *Range) VerifyUsage(reconcile bool) ([]UsageDrift, error) {
+	r.usageMu.Lock()
+	defer r.usageMu.Unlock()
+	computed := r.acct.copyConfigs()
+	if err := r.scanUsage(computed); err != nil {
+		return nil, err
+	}
+	drift := r.acct.diff(computed, r.Metadata().RangeID)
+	if reconcile && len(drift) > 0 {
+		r.acct.setStored(computed)
+	}
+	return drift, nil
+}
+
+// resetUsage recomputes the keys and bytes stored by each account
+// following a change to the range's key span or accounting configs.
+func (r *Range) resetUsage() {
+	r.usageMu.Lock()
+	defer r.usageMu.Unlock()
+	r.acct.reset()
+	r.initUsage()
+}
+
+// UsageReport returns the storage and operation counts attributed
+// to each account with usage in this range. Data stored by internal
+// subsystems, such as time series and message queues, is reported
+// under internal accounts.
+func (r *Range) UsageReport() UsageReport {
+	return r.acct.report()
+}
+
+// Bytes returns the bytes, keys plus values, stored in the range,
+// including MVCC metadata and versions.
+func (r *Range) Bytes() int64 {
+	return r.Stats().TotalBytes()
+}
+
+// splitKey returns the key at which to split the range so that its
+// user data is divided roughly in half, or nil if it has no such key.
+// System keys aren't considered, so that ranges aren't split within
+// configuration maps, and a key within an inbox gives way to the inbox
+// key. The MVCC versions of a key, stored apart from its plain row,
+// follow the key to whichever range contains it.
+func (r *Range) splitKey() (Key, error) {
+	meta := r.Metadata()
+	start := meta.StartKey
+	if userStart := PrefixEndKey(KeySystemPrefix); bytes.Compare(start, userStart) < 0 {
+		start = userStart
+	}
+	half := r.Stats().LiveBytes / 2
+	var size int64
+	for bytes.Compare(start, meta.EndKey) < 0 {
+		kvs, err := r.engine.scan(start, meta.EndKey, gcBatchSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range kvs {
+			size += int64(len(kv.Key) + len(kv.Value.Bytes))
+			if size < half {
+				continue
+			}
+			key := kv.Key
+			inbox, err := queueInbox(r.engine, key)
+			if err != nil {
+				return nil, err
+			} else if inbox != nil {
+				key = inbox
+			}
+			if bytes.Compare(key, meta.StartKey) > 0 {
+				return key, nil
+			}
+		}
+		if len(kvs) < gcBatchSize {
+			break
+		}
+		start = MakeKey(kvs[len(kvs)-1].Key, Key{0})
+	}
+	return nil, nil
+}
+
+// recordWrite reads the value at key and invokes mutate with it and
+// a batch of writes to the range's engine, which is committed once
+// mutate succeeds. On success, mutate returns the value it left at
+// key, or nil if the key was deleted; the change is attributed to the
+// key's account, counted in the range's stats and published to the
+// range's event feed. See recordWrites.
+func (r *Range) recordWrite(key Key, mutate func(b *Batch, before Value) (*Value, error)) error {
+	return r.recordWrites(func(b *Batch, record func(key Key, before Value, after *Value)) error {
+		before, err := b.get(key)
+		if err != nil {
+			return err
+		}
+		after, err := mutate(b, before)
+		if err != nil {
+			return err
+		}
+		record(key, before, after)
+		return nil
+	})
+}
+
+// recordWrites invokes apply with a batch of writes to the range's
+// engine and commits the batch atomically once apply succeeds. apply
+// records each change it makes with record, which takes the key's
+// value before the change and the value it leaves, or nil if the key
+// was deleted; once committed, the changes are attributed to their
+// keys' accounts and published to the range's event feed. The range's
+// stats count all of the batch's writes, including those not
+// recorded, such as the MVCC versions of keys. Requires applyMu.
+func (r *Range) recordWrites(apply func(b *Batch, record func(key Key, before Value, after *Value)) error) error {
+	type change struct {
+		key    Key
+		before Value
+		after  *Value
+	}
+	var changes []change
+	if err := func() error {
+		r.usageMu.Lock()
+		defer r.usageMu.Unlock()
+		b := r.newBatch()
+		if err := apply(b, func(key Key, before Value, after *Value) {
+			changes = append(changes, change{key, before, after})
+		}); err != nil {
+			return err
+		}
+		return r.commitBatch(b)
+	}(); err != nil {
+		return err
+	}
+	r.afterCommit(func() {
+		r.usageMu.Lock()
+		defer r.usageMu.Unlock()
+		for _, c := range changes {
+			r.publishWrite(c.key, c.before, c.after)
+		}
+	})
+	return nil
+}
+
+// newBatch returns a batch of writes to the range's engine or, while
+// a read-write command executes, to the command's stage, so that the
+// command's writes are committed together with its reply. Requires
+// applyMu.
+func (r *Range) newBatch() *Batch {
+	if r.stage != nil {
+		return NewBatch(r.stage)
+	}
+	return NewBatch(r.engine)
+}
+
+// afterCommit invokes f once the writes made so far are committed to
+// the range's engine: immediately or, while a read-write command
+// executes, once its stage commits. Requires applyMu.
+func (r *Range) afterCommit(f func()) {
+	if r.stage != nil {
+		r.staged = append(r.staged, f)
+		return
+	}
+	f()
+}
+
+// publishWrite attributes the change of the value at key from before
+// to after, which is nil if the key was deleted, to the key's account
+// and publishes it to the range's event feed. Requires usageMu.
+func (r *Range) publishWrite(key Key, before Value, after *Value) {
+	ev := ChangeEvent{Op: ChangeDelete, Key: key, Timestamp: time.Now().UnixNano()}
+	if after != nil && after.Bytes != nil {
+		ev.Op, ev.Value = ChangePut, *after
+	}
+	r.acct.recordWrite(key, before.Bytes, ev.Value.Bytes)
+	r.feed.publish(ev)
+}
+
+// configChanged is invoked after a write to key. If key is part of a
+// configuration map, the map is marked dirty and gossiped, and
+// accounting configs are reloaded as necessary, once the write is
+// committed. Requires applyMu.
+func (r *Range) configChanged(key Key) {
+	r.afterCommit(func() {
+		for _, cp := range configPrefixes {
+			if bytes.HasPrefix(key, cp.keyPrefix) {
+				cp.dirty = true
+				r.maybeGossipConfigs()
+				break
+			}
+		}
+		if bytes.HasPrefix(key, KeyConfigAccountingPrefix) {
+			r.reloadAcctConfigs()
+		} else if bytes.HasPrefix(key, KeyConfigCompressionPrefix) || bytes.HasPrefix(key, KeyConfigZonePrefix) ||
+			bytes.HasPrefix(key, KeyConfigTTLPrefix) {
+			r.loadStoragePolicies()
+		} else if bytes.HasPrefix(key, KeyConfigPermissionPrefix) {
+			r.loadPermConfigs()
+		} else if bytes.HasPrefix(key, KeyConfigFreezePrefix) {
+			r.loadFreezeConfigs()
+		}
+	})
+}
+
 // containsKey returns whether this range contains the specified key.
 func (r *Range) containsKey(key Key) bool {
-	return bytes.Compare(r.Meta.StartKey, key) <= 0 &&
-		bytes.Compare(r.Meta.EndKey, key) > 0
+	meta := r.Metadata()
+	return bytes.Compare(meta.StartKey, key) <= 0 &&
+		bytes.Compare(meta.EndKey, key) > 0
 }
 
 // executeCmd switches over the method and multiplexes to execute the
@@ -284,6 +1178,12 @@ func (r *Range) executeCmd(method string, args, reply interface{}) error {
 		r.Put(args.(*PutRequest), reply.(*PutResponse))
 	case "Increment":
 		r.Increment(args.(*IncrementRequest), reply.(*IncrementResponse))
+	case "Append":
+		r.Append(args.(*AppendRequest), reply.(*AppendResponse))
+	case "GetByteRange":
+		r.GetByteRange(args.(*GetByteRangeRequest), reply.(*GetByteRangeResponse))
+	case "GetTSBlock":
+		r.GetTSBlock(args.(*GetTSBlockRequest), reply.(*GetTSBlockResponse))
 	case "Delete":
 		r.Delete(args.(*DeleteRequest), reply.(*DeleteResponse))
 	case "DeleteRange":
@@ -300,14 +1200,110 @@ func (r *Range) executeCmd(method string, args, reply interface{}) error {
 		r.EnqueueUpdate(args.(*EnqueueUpdateRequest), reply.(*EnqueueUpdateResponse))
 	case "EnqueueMessage":
 		r.EnqueueMessage(args.(*EnqueueMessageRequest), reply.(*EnqueueMessageResponse))
+	case "AckQueue":
+		r.AckQueue(args.(*AckQueueRequest), reply.(*AckQueueResponse))
 	case "InternalRangeLookup":
 		r.InternalRangeLookup(args.(*InternalRangeLookupRequest), reply.(*InternalRangeLookupResponse))
+	case "InternalWatch":
+		r.InternalWatch(args.(*InternalWatchRequest), reply.(*InternalWatchResponse))
+	case "InternalResolvedTimestamp":
+		r.InternalResolvedTimestamp(args.(*InternalResolvedTimestampRequest), reply.(*InternalResolvedTimestampResponse))
+	case "InternalBulkWrite":
+		r.InternalBulkWrite(args.(*InternalBulkWriteRequest), reply.(*InternalBulkWriteResponse))
+	case "InternalChangeReplicas":
+		r.InternalChangeReplicas(args.(*InternalChangeReplicasRequest), reply.(*InternalChangeReplicasResponse))
+	case "InternalSplit":
+		r.InternalSplit(args.(*InternalSplitRequest), reply.(*InternalSplitResponse))
+	case "InternalSubsume":
+		r.InternalSubsume(args.(*InternalSubsumeRequest), reply.(*InternalSubsumeResponse))
+	case "InternalMerge":
+		r.InternalMerge(args.(*InternalMergeRequest), reply.(*InternalMergeResponse))
+	case "InternalTouch":
+		r.InternalTouch(args.(*InternalTouchRequest), reply.(*InternalTouchResponse))
+	case "InternalLease":
+		r.InternalLease(args.(*InternalLeaseRequest), reply.(*InternalLeaseResponse))
+	case "InternalCloseTimestamp":
+		r.InternalCloseTimestamp(args.(*InternalCloseTimestampRequest), reply.(*InternalCloseTimestampResponse))
+	case "InternalPushTxn":
+		r.InternalPushTxn(args.(*InternalPushTxnRequest), reply.(*InternalPushTxnResponse))
+	case "InternalResolveIntent":
+		r.InternalResolveIntent(args.(*InternalResolveIntentRequest), reply.(*InternalResolveIntentResponse))
+	case "InternalTxnResolved":
+		r.InternalTxnResolved(args.(*InternalTxnResolvedRequest), reply.(*InternalTxnResolvedResponse))
+	case "InternalComputeChecksum":
+		r.InternalComputeChecksum(args.(*InternalComputeChecksumRequest), reply.(*InternalComputeChecksumResponse))
 	default:
 		return util.Errorf("unrecognized command type: %s", method)
 	}
-	// Return the error (if any) set in the reply.
-	err := reflect.ValueOf(reply).Elem().FieldByName("Error").Interface()
-	if err != nil {
+	// Identify the serving replica in the reply.
+	reflect.ValueOf(reply).Elem().FieldByName("Replica").Set(reflect.ValueOf(args).Elem().FieldByName("Replica"))
+	return replyError(reply)
+}
+
+// executeCmdOnce executes a read-write command unless a command with
+// the same client command ID was executed recently, in which case the
+// earlier reply is copied into reply instead. The command's writes are
+// staged and committed together with its reply, so that a crash can't
+// leave the command applied without the reply which prevents its
+// execution on retry. Called only from processPending, which
+// serializes access to the response cache.
+func (r *Range) executeCmdOnce(method string, args, reply interface{}) error {
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+	cmdID := reflect.ValueOf(args).Elem().FieldByName("CmdID").Interface().(ClientCmdID)
+	if !cmdID.IsEmpty() {
+		if cached, ok := r.cachedReply(cmdID); ok {
+			reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(cached).Elem())
+			return replyError(reply)
+		}
+	}
+	if r.subsumed && method != "InternalSubsume" {
+		r.raftMu.RLock()
+		err := &RangeSubsumedError{Replica: r.self}
+		r.raftMu.RUnlock()
+		reflect.ValueOf(reply).Elem().FieldByName("Error").Set(reflect.ValueOf(err))
+		return err
+	}
+	r.stage = NewBatch(r.engine)
+	err := r.executeCmd(method, args, reply)
+	switch err.(type) {
+	case *WriteIntentError, *TransactionPushError:
+		// Conflicts with other transactions aren't replayed, as the
+		// client retries the command once they're resolved.
+	default:
+		// Errors not reflected in the reply, such as an unrecognized
+		// method, aren't replayed.
+		if !cmdID.IsEmpty() && err == replyError(reply) {
+			r.cacheReply(r.stage, cmdID, reply)
+		}
+	}
+	if commitErr := r.commitStage(); commitErr != nil {
+		glog.Errorf("range %d: unable to commit %s: %v", r.Metadata().RangeID, method, commitErr)
+		return commitErr
+	}
+	return err
+}
+
+// commitStage commits the writes staged by the executing read-write
+// command and invokes the functions awaiting their commit. If the
+// commit fails, the range's stats, which count the staged writes, are
+// reloaded from those persisted. Requires applyMu.
+func (r *Range) commitStage() error {
+	stage, staged := r.stage, r.staged
+	r.stage, r.staged = nil, nil
+	if err := stage.Commit(); err != nil {
+		r.readStats()
+		return err
+	}
+	for _, f := range staged {
+		f()
+	}
+	return nil
+}
+
+// replyError returns the error, if any, set in reply.
+func replyError(reply interface{}) error {
+	if err := reflect.ValueOf(reply).Elem().FieldByName("Error").Interface(); err != nil {
 		return err.(error)
 	}
 	return nil
@@ -315,7 +1311,8 @@ func (r *Range) executeCmd(method string, args, reply interface{}) error {
 
 // Contains verifies the existence of a key in the key value store.
 func (r *Range) Contains(args *ContainsRequest, reply *ContainsResponse) {
-	val, err := r.engine.get(args.Key)
+	r.acct.recordRead(args.Key)
+	val, err := r.readValue(&args.RequestHeader, args.Key)
 	if err != nil {
 		reply.Error = err
 		return
@@ -325,93 +1322,567 @@ func (r *Range) Contains(args *ContainsRequest, reply *ContainsResponse) {
 	}
 }
 
+// readValue returns the value at key visible to the request with
+// header, read via MVCC: the version current at the header's
+// timestamp, or the latest if it has none, or the write intent of the
+// header's transaction. Fails with a WriteIntentError if another
+// transaction has an intent on the key at or before the timestamp.
+func (r *Range) readValue(header *RequestHeader, key Key) (Value, error) {
+	return NewMVCC(r.engine).Get(key, header.Timestamp, header.TxID)
+}
+
 // Get returns the value for a specified key.
+//
+// If a timestamp is specified, the value current at that time is
+// returned, as long as the versions it was superseded by are younger
+// than the GC TTL of its zone. Reads of values with sliding TTLs
+// extend their lifetimes; see maybeTouch.
 func (r *Range) Get(args *GetRequest, reply *GetResponse) {
-	reply.Value, reply.Error = r.engine.get(args.Key)
+	r.acct.recordRead(args.Key)
+	reply.Value, reply.Error = r.readValue(&args.RequestHeader, args.Key)
+	if reply.Error == nil {
+		r.maybeTouch(args.Key, reply.Value)
+		reply.Value, reply.Error = r.decompress(&args.RequestHeader, args.Key, reply.Value)
+	}
 }
 
-// Put sets the value for a specified key. Conditional puts are supported.
+// stampTimestamp returns value with its timestamp set to that of the
+// request header, if any, which nodes assign from their clocks to the
+// writes they receive.
+func stampTimestamp(header *RequestHeader, value Value) Value {
+	if header.Timestamp != 0 {
+		value.Timestamp = header.Timestamp
+	}
+	return value
+}
+
+// Put sets the value for a specified key, as a version at the
+// request's timestamp; see writeVersion. Conditional puts are
+// supported. Values are compressed according to the key's storage
+// policy; see compress. Within a transaction, a write intent is laid
+// down instead; see writeIntent.
 func (r *Range) Put(args *PutRequest, reply *PutResponse) {
-	// Handle conditional put.
-	if args.ExpValue != nil {
-		// Handle check for non-existence of key.
-		val, err := r.engine.get(args.Key)
-		if err != nil {
-			reply.Error = err
-			return
+	if args.TxID != "" {
+		reply.Error = r.putIntent(args, reply)
+		return
+	}
+	if err := r.recordWrite(args.Key, func(b *Batch, val Value) (*Value, error) {
+		if err := r.checkIntent(args.Key, args.TxID); err != nil {
+			return nil, err
 		}
-		if args.ExpValue.Bytes == nil && val.Bytes != nil {
-			reply.Error = util.Errorf("key %q already exists", args.Key)
-			return
-		} else if args.ExpValue != nil {
-			// Handle check for existence when there is no key.
-			if val.Bytes == nil {
-				reply.Error = util.Errorf("key %q does not exist", args.Key)
-				return
-			} else if !bytes.Equal(args.ExpValue.Bytes, val.Bytes) {
-				reply.ActualValue.Bytes = val.Bytes
-				reply.Error = util.Errorf("key %q does not match existing", args.Key)
-				return
-			}
+		if err := r.checkExpValue(args, reply, val); err != nil {
+			return nil, err
 		}
-	}
-	if err := r.engine.put(args.Key, args.Value); err != nil {
+		value, err := r.compress(args.Key, r.stampTTL(args.Key, stampTimestamp(&args.RequestHeader, args.Value)))
+		if err != nil {
+			return nil, err
+		}
+		return writeVersion(b, args.Key, &value, r.openTimestamp(value.Timestamp), nil)
+	}); err != nil {
 		reply.Error = err
 		return
 	}
-	// Check whether this put has modified a configuration map.
-	for _, cp := range configPrefixes {
-		if bytes.HasPrefix(args.Key, cp.keyPrefix) {
-			cp.dirty = true
-			r.maybeGossipConfigs()
-			break
+	r.configChanged(args.Key)
+}
+
+// putIntent implements Put within a transaction, laying down a write
+// intent. A conditional put compares the value visible to the
+// transaction.
+func (r *Range) putIntent(args *PutRequest, reply *PutResponse) error {
+	if args.ExpValue != nil {
+		val, err := r.readValue(&RequestHeader{TxID: args.TxID}, args.Key)
+		if err != nil {
+			return err
+		}
+		if err := r.checkExpValue(args, reply, val); err != nil {
+			return err
 		}
 	}
+	value, err := r.compress(args.Key, r.stampTTL(args.Key, stampTimestamp(&args.RequestHeader, args.Value)))
+	if err != nil {
+		return err
+	}
+	return r.writeIntent(&args.RequestHeader, args.Key, &value)
+}
+
+// checkExpValue verifies val, the value stored at args.Key, matches
+// the expected value of a conditional put, if args specifies one.
+func (r *Range) checkExpValue(args *PutRequest, reply *PutResponse, val Value) error {
+	if args.ExpValue == nil {
+		return nil
+	}
+	val, err := r.compressionDicts().Decompress(args.Key, val)
+	if err != nil {
+		return err
+	}
+	// Handle check for non-existence of key.
+	if args.ExpValue.Bytes == nil && val.Bytes != nil {
+		return util.Errorf("key %q already exists", args.Key)
+	}
+	// Handle check for existence when there is no key.
+	if val.Bytes == nil {
+		return util.Errorf("key %q does not exist", args.Key)
+	} else if !bytes.Equal(args.ExpValue.Bytes, val.Bytes) {
+		reply.ActualValue = &Value{Bytes: val.Bytes}
+		return util.Errorf("key %q does not match existing", args.Key)
+	}
+	return nil
 }
 
 // Increment increments the value (interpreted as varint64 encoded) and
 // returns the newly incremented value (encoded as varint64). If no
-// value exists for the key, zero is incremented.
+// value exists for the key, zero is incremented. Within a transaction,
+// the value visible to the transaction is incremented and a write
+// intent laid down; see updateIntent.
 func (r *Range) Increment(args *IncrementRequest, reply *IncrementResponse) {
-	reply.NewValue, reply.Error = increment(r.engine, args.Key, args.Increment, args.Timestamp)
+	update := func(before Value) (*Value, error) {
+		newValue, newInt, err := incrementValue(args.Key, before, args.Increment)
+		if err != nil {
+			return nil, err
+		}
+		reply.NewValue = newInt
+		newValue = stampTimestamp(&args.RequestHeader, newValue)
+		return &newValue, nil
+	}
+	if args.TxID != "" {
+		reply.Error = r.updateIntent(&args.RequestHeader, args.Key, update)
+		return
+	}
+	reply.Error = r.recordWrite(args.Key, func(b *Batch, before Value) (*Value, error) {
+		if err := r.checkIntent(args.Key, args.TxID); err != nil {
+			return nil, err
+		}
+		newValue, err := update(before)
+		if err != nil {
+			return nil, err
+		}
+		return writeVersion(b, args.Key, newValue, r.openTimestamp(args.Timestamp), nil)
+	})
 }
 
-// Delete deletes the key and value specified by key.
-func (r *Range) Delete(args *DeleteRequest, reply *DeleteResponse) {
-	if err := r.engine.del(args.Key); err != nil {
+// Append appends args.Value.Bytes to the value for args.Key, up to
+// args.MaxLength bytes, if positive. As values may be stored
+// compressed, the existing value is decompressed and the result
+// stored according to the key's storage policies. Within a
+// transaction, the value visible to the transaction is appended to
+// and a write intent laid down; see updateIntent.
+func (r *Range) Append(args *AppendRequest, reply *AppendResponse) {
+	update := func(before Value) (*Value, error) {
+		dicts := r.compressionDicts()
+		existing, err := dicts.Decompress(args.Key, before)
+		if err != nil {
+			return nil, err
+		}
+		suffix, err := dicts.Decompress(args.Key, args.Value)
+		if err != nil {
+			return nil, err
+		}
+		length := int64(len(existing.Bytes) + len(suffix.Bytes))
+		if args.MaxLength > 0 && length > args.MaxLength {
+			return nil, &AppendTooLargeError{Key: args.Key, Length: length, MaxLength: args.MaxLength}
+		}
+		suffix.Bytes = append(append([]byte(nil), existing.Bytes...), suffix.Bytes...)
+		reply.NewLength = length
+		value, err := r.compress(args.Key, r.stampTTL(args.Key, stampTimestamp(&args.RequestHeader, suffix)))
+		if err != nil {
+			return nil, err
+		}
+		return &value, nil
+	}
+	if args.TxID != "" {
+		reply.Error = r.updateIntent(&args.RequestHeader, args.Key, update)
+		return
+	}
+	if err := r.recordWrite(args.Key, func(b *Batch, before Value) (*Value, error) {
+		if err := r.checkIntent(args.Key, args.TxID); err != nil {
+			return nil, err
+		}
+		value, err := update(before)
+		if err != nil {
+			return nil, err
+		}
+		return writeVersion(b, args.Key, value, r.openTimestamp(value.Timestamp), nil)
+	}); err != nil {
 		reply.Error = err
+		return
 	}
+	r.configChanged(args.Key)
 }
 
-// DeleteRange deletes the range of key/value pairs specified by
-// start and end keys.
+// GetByteRange returns the bytes of the value for args.Key in the
+// requested range, along with the length of the entire value. Like
+// Get, it extends the lifetime of values with sliding TTLs.
+func (r *Range) GetByteRange(args *GetByteRangeRequest, reply *GetByteRangeResponse) {
+	if args.Offset < 0 || args.Length < 0 {
+		reply.Error = util.Errorf("invalid byte range: offset %d, length %d", args.Offset, args.Length)
+		return
+	}
+	r.acct.recordRead(args.Key)
+	value, err := r.readValue(&args.RequestHeader, args.Key)
+	if err == nil {
+		r.maybeTouch(args.Key, value)
+		value, err = r.compressionDicts().Decompress(args.Key, value)
+	}
+	if err != nil {
+		reply.Error = err
+		return
+	}
+	reply.Length = int64(len(value.Bytes))
+	start, end := args.Offset, args.Offset+args.Length
+	if args.Length == 0 || end > reply.Length {
+		end = reply.Length
+	}
+	if start < end {
+		reply.Bytes = value.Bytes[start:end]
+	}
+}
+
+// GetTSBlock reads the time series of a contiguous run of keys from
+// args.StartKey, returning their counts packed into a single block.
+// Graphing a long time window reads many adjacent keys; a block avoids
+// the overhead of a request and a Value per key. The run stops at
+// args.EndKey, at args.MaxKeys or at the end of the range, in the
+// latter cases setting the key from which to resume.
+func (r *Range) GetTSBlock(args *GetTSBlockRequest, reply *GetTSBlockResponse) {
+	if len(args.EndKey) == 0 {
+		reply.Error = util.Errorf("time series block read requires an end key")
+		return
+	}
+	maxKeys := args.MaxKeys
+	if maxKeys <= 0 || maxKeys > MaxTSBlockKeys {
+		maxKeys = MaxTSBlockKeys
+	}
+	endKey := args.EndKey
+	if meta := r.Metadata(); bytes.Compare(meta.EndKey, endKey) < 0 {
+		endKey = meta.EndKey
+		reply.ResumeKey = meta.EndKey
+	}
+	kvs, err := r.engine.scan(args.StartKey, endKey, maxKeys)
+	if err != nil {
+		reply.Error = err
+		return
+	}
+	r.acct.recordScan(args.StartKey, kvs)
+	if int64(len(kvs)) == maxKeys {
+		reply.ResumeKey = MakeKey(kvs[len(kvs)-1].Key, Key{0})
+	}
+	for _, kv := range kvs {
+		counts, err := decodeTSCounts(kv.Key, kv.Value.Bytes)
+		if err != nil {
+			reply.Error = err
+			return
+		}
+		reply.Keys = append(reply.Keys, kv.Key)
+		reply.Lengths = append(reply.Lengths, int32(len(counts)))
+		reply.Counts = append(reply.Counts, counts...)
+	}
+}
+
+// Delete deletes the key and value specified by key. Within a
+// transaction, a write intent deleting the key is laid down instead.
+func (r *Range) Delete(args *DeleteRequest, reply *DeleteResponse) {
+	if args.TxID != "" {
+		reply.Error = r.writeIntent(&args.RequestHeader, args.Key, nil)
+		return
+	}
+	if reply.Error = r.recordWrite(args.Key, func(b *Batch, _ Value) (*Value, error) {
+		if err := r.checkIntent(args.Key, args.TxID); err != nil {
+			return nil, err
+		}
+		return writeVersion(b, args.Key, nil, r.openTimestamp(args.Timestamp), nil)
+	}); reply.Error != nil {
+		return
+	}
+	r.configChanged(args.Key)
+}
+
+// DeleteRange deletes the keys from start key through end key, within
+// the range's span, returning the number deleted. Deleting more than
+// rangeTombstoneMinRows keys writes a range tombstone hiding their
+// plain rows, rather than a deletion of each; garbage collection
+// removes the hidden rows. The versions such deletions supersede
+// remain readable at earlier timestamps, but reads at timestamps
+// since the latest version of each key find nothing; see MVCC.
 func (r *Range) DeleteRange(args *DeleteRangeRequest, reply *DeleteRangeResponse) {
-	reply.Error = util.Error("unimplemented")
+	if args.TxID != "" {
+		reply.Error = util.Errorf("DeleteRange isn't supported within transactions")
+		return
+	}
+	meta := r.Metadata()
+	start, end := args.StartKey, args.EndKey
+	if bytes.Compare(start, meta.StartKey) < 0 {
+		start = meta.StartKey
+	}
+	if len(end) == 0 || bytes.Compare(end, meta.EndKey) > 0 {
+		end = meta.EndKey
+	}
+	if bytes.Compare(start, end) >= 0 {
+		return
+	}
+	if reply.NumDeleted, reply.Error = r.deleteRange(start, end, args.Timestamp); reply.NumDeleted == 0 {
+		return
+	}
+	span := keySpan{start: start, end: end}
+	for _, cp := range configPrefixes {
+		if span.overlaps(cp.keyPrefix, PrefixEndKey(cp.keyPrefix)) {
+			r.configChanged(cp.keyPrefix)
+		}
+	}
+}
+
+// deleteRange deletes the plain rows in [start, end) at timestamp,
+// returning the number deleted. The rows are read from an engine
+// snapshot, so that each deletion can be attributed to its account
+// and published to watchers, once committed, without holding the rows
+// in memory. Fails without deleting any rows if one of the keys has
+// another transaction's write intent. Requires applyMu.
+func (r *Range) deleteRange(start, end Key, timestamp int64) (uint64, error) {
+	snap := r.engine.newSnapshot()
+	deleted, err := func() (uint64, error) {
+		r.usageMu.Lock()
+		defer r.usageMu.Unlock()
+		timestamp = r.openTimestamp(timestamp)
+		checkIntents := r.Stats().IntentCount > 0
+		var deleted uint64
+		var removed RangeStats
+		if err := visitPlainRows(snap, start, end, func(kv KeyValue) error {
+			if checkIntents {
+				if err := r.checkIntent(kv.Key, ""); err != nil {
+					return err
+				}
+			}
+			deleted++
+			removed.add(rowStats(kv.Key, kv.Value))
+			return nil
+		}); err != nil || deleted == 0 {
+			return 0, err
+		}
+		b := r.newBatch()
+		if _, ok := r.engine.(*tombstoneEngine); ok && deleted > uint64(rangeTombstoneMinRows) {
+			if err := b.put(rangeTombstoneKey(start), Value{Bytes: end}); err != nil {
+				return 0, err
+			}
+			// The stats of the rows the tombstone hides aren't seen by
+			// batchStats, which skips store-local keys.
+			var adjust RangeStats
+			adjust.subtract(removed)
+			return deleted, r.commitBatchAdjusted(b, adjust)
+		}
+		if err := visitPlainRows(snap, start, end, func(kv KeyValue) error {
+			_, err := writeVersion(b, kv.Key, nil, timestamp, nil)
+			return err
+		}); err != nil {
+			return 0, err
+		}
+		if err := r.commitBatch(b); err != nil {
+			return 0, err
+		}
+		// Rows hidden by a tombstone are hinted once garbage
+		// collection deletes them.
+		r.hintCompaction(start, end, int64(deleted))
+		return deleted, nil
+	}()
+	if err != nil || deleted == 0 {
+		snap.close()
+		return 0, err
+	}
+	r.afterCommit(func() {
+		defer snap.close()
+		r.usageMu.Lock()
+		defer r.usageMu.Unlock()
+		if err := visitPlainRows(snap, start, end, func(kv KeyValue) error {
+			r.publishWrite(kv.Key, kv.Value, nil)
+			return nil
+		}); err != nil {
+			glog.Errorf("range %d: unable to publish deletions of [%q, %q): %v", r.Metadata().RangeID, start, end, err)
+		}
+	})
+	return deleted, nil
+}
+
+// visitPlainRows invokes visit with each plain row of engine in
+// [start, end), in key order, skipping store-local keys, such as those
+// storing MVCC metadata and versions.
+func visitPlainRows(engine Engine, start, end Key, visit func(kv KeyValue) error) error {
+	for {
+		kvs, err := engine.scan(start, end, usageScanBatch)
+		if err != nil {
+			return err
+		}
+		for _, kv := range kvs {
+			if !tombstonable(kv.Key) {
+				continue
+			}
+			if err := visit(kv); err != nil {
+				return err
+			}
+		}
+		if len(kvs) < usageScanBatch {
+			return nil
+		}
+		start = MakeKey(kvs[len(kvs)-1].Key, Key{0})
+	}
 }
 
 // Scan scans the key range specified by start key through end key up
 // to some maximum number of results. The last key of the iteration is
-// returned with the reply.
+// returned with the reply. A scan reads the values current at its
+// timestamp, if specified, and those of its transaction's write
+// intents; see scanner. Each returned row counts as a read against
+// the row's account.
 func (r *Range) Scan(args *ScanRequest, reply *ScanResponse) {
-	reply.Rows, reply.Error = r.engine.scan(args.StartKey, args.EndKey, args.MaxResults)
+	if args.Reverse && len(args.EndKey) == 0 {
+		reply.Error = util.Errorf("reverse scan requires an end key")
+		return
+	}
+	if args.MaxBytes > 0 || args.MaxBytesPerSecond > 0 || args.IncludeIntents {
+		r.scanLimited(args, reply)
+		return
+	}
+	reply.Rows, reply.Error = r.scanner(r.engine, args)(args.StartKey, args.EndKey, args.MaxResults)
+	r.acct.recordScan(args.StartKey, reply.Rows)
+	for i := 0; reply.Error == nil && i < len(reply.Rows); i++ {
+		row := &reply.Rows[i]
+		row.Value, reply.Error = r.decompress(&args.RequestHeader, row.Key, row.Value)
+	}
 }
 
-// EndTransaction either commits or aborts (rolls back) an extant
-// transaction according to the args.Commit parameter.
-func (r *Range) EndTransaction(args *EndTransactionRequest, reply *EndTransactionResponse) {
-	reply.Error = util.Error("unimplemented")
+// scanner returns a function which reads up to max of the rows in
+// [start, end) from engine visible to a scan with args, in the scan's
+// direction. Scans at a timestamp or within a transaction read via
+// MVCC, as Get does; other scans read the keys' plain rows, which
+// hold their latest committed values, without conflicting with write
+// intents.
+func (r *Range) scanner(engine Engine, args *ScanRequest) func(start, end Key, max int64) ([]KeyValue, error) {
+	if args.Timestamp != 0 || args.TxID != "" {
+		mvcc := NewMVCC(engine)
+		return func(start, end Key, max int64) ([]KeyValue, error) {
+			return mvcc.scan(start, end, max, args.Timestamp, args.TxID, args.Reverse)
+		}
+	}
+	return func(start, end Key, max int64) ([]KeyValue, error) {
+		return scanPlainRows(engine, start, end, max, args.Reverse)
+	}
 }
 
-// AccumulateTS is used internally to aggregate statistics over key
-// ranges throughout the distributed cluster.
-func (r *Range) AccumulateTS(args *AccumulateTSRequest, reply *AccumulateTSResponse) {
-	reply.Error = util.Error("unimplemented")
+const (
+	// scanBatchSize is the number of rows read from the engine at a
+	// time by scans limited by size or rate, or reporting intents.
+	scanBatchSize = 100
+	// maxScanPacing bounds the time a rate limited scan spends, so
+	// that requests complete within RPC timeouts.
+	maxScanPacing = 5 * time.Second
+)
+
+// scanLimited scans in batches, stopping before the row which would
+// exceed args.MaxBytes and sleeping between batches as necessary to
+// read no faster than args.MaxBytesPerSecond. At least one row is
+// returned, if any exist, regardless of its size. If the scan stops
+// before reaching the end of its span for reasons other than
+// MaxResults, the key from which to resume is set in the reply. With
+// args.IncludeIntents, the write intents in the span scanned are
+// reported; see appendIntents. The batches are read from a snapshot,
+// so that the scan sees a consistent view of the range however long
+// it's paced for.
+func (r *Range) scanLimited(args *ScanRequest, reply *ScanResponse) {
+	defer func() { r.acct.recordScan(args.StartKey, reply.Rows) }()
+	snap := r.engine.newSnapshot()
+	defer snap.close()
+	r.scanBatches(r.scanner(snap, args), args, reply)
+	if args.IncludeIntents && reply.Error == nil {
+		reply.Error = appendIntents(snap, args, reply)
+	}
 }
 
-// ReapQueue destructively queries messages from a delivery inbox
-// queue. This method must be called from within a transaction.
-func (r *Range) ReapQueue(args *ReapQueueRequest, reply *ReapQueueResponse) {
-	reply.Error = util.Error("unimplemented")
+// scanBatches implements the batching and limits of scanLimited,
+// reading rows with scan.
+func (r *Range) scanBatches(scan func(start, end Key, max int64) ([]KeyValue, error), args *ScanRequest, reply *ScanResponse) {
+	start, key, endKey := time.Now(), args.StartKey, args.EndKey
+	var size int64
+	for {
+		batch := int64(scanBatchSize)
+		if remaining := args.MaxResults - int64(len(reply.Rows)); args.MaxResults > 0 && remaining < batch {
+			batch = remaining
+		}
+		kvs, err := scan(key, endKey, batch)
+		if err != nil {
+			reply.Error = err
+			return
+		}
+		for _, kv := range kvs {
+			if kv.Value, err = r.decompress(&args.RequestHeader, kv.Key, kv.Value); err != nil {
+				reply.Error = err
+				return
+			}
+			rowSize := int64(len(kv.Key) + len(kv.Value.Bytes))
+			if args.MaxBytes > 0 && size+rowSize > args.MaxBytes && len(reply.Rows) > 0 {
+				reply.ResumeKey = kv.Key
+				if args.Reverse {
+					reply.ResumeKey = MakeKey(kv.Key, Key{0})
+				}
+				return
+			}
+			size += rowSize
+			reply.Rows = append(reply.Rows, kv)
+		}
+		if int64(len(kvs)) < batch || int64(len(reply.Rows)) == args.MaxResults {
+			return
+		}
+		if args.Reverse {
+			endKey = kvs[len(kvs)-1].Key
+		} else {
+			key = MakeKey(kvs[len(kvs)-1].Key, Key{0})
+		}
+		if args.MaxBytesPerSecond > 0 {
+			due := time.Duration(size * int64(time.Second) / args.MaxBytesPerSecond)
+			if due > maxScanPacing {
+				reply.ResumeKey = key
+				if args.Reverse {
+					reply.ResumeKey = endKey
+				}
+				return
+			}
+			time.Sleep(due - time.Since(start))
+		}
+	}
+}
+
+// AccumulateTS adds args.Counts, element by element, to the time
+// series at args.Key, extending it if args.Counts is longer. It's used
+// to aggregate statistics over key ranges throughout the distributed
+// cluster; see GetTSBlock for reading them. Within a transaction, the
+// counts are added to the time series visible to the transaction and
+// a write intent laid down; see updateIntent.
+func (r *Range) AccumulateTS(args *AccumulateTSRequest, reply *AccumulateTSResponse) {
+	update := func(before Value) (*Value, error) {
+		counts, err := decodeTSCounts(args.Key, before.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		for i, c := range args.Counts {
+			if i < len(counts) {
+				counts[i] += c
+			} else {
+				counts = append(counts, c)
+			}
+		}
+		value := stampTimestamp(&args.RequestHeader, Value{Bytes: encodeTSCounts(counts)})
+		return &value, nil
+	}
+	if args.TxID != "" {
+		reply.Error = r.updateIntent(&args.RequestHeader, args.Key, update)
+		return
+	}
+	reply.Error = r.recordWrite(args.Key, func(b *Batch, before Value) (*Value, error) {
+		if err := r.checkIntent(args.Key, args.TxID); err != nil {
+			return nil, err
+		}
+		value, err := update(before)
+		if err != nil {
+			return nil, err
+		}
+		return writeVersion(b, args.Key, value, r.openTimestamp(value.Timestamp), nil)
+	})
 }
 
 // EnqueueUpdate sidelines an update for asynchronous execution.
@@ -423,10 +1894,221 @@ func (r *Range) EnqueueUpdate(args *EnqueueUpdateRequest, reply *EnqueueUpdateRe
 	reply.Error = util.Error("unimplemented")
 }
 
-// EnqueueMessage enqueues a message (Value) for delivery to a
-// recipient inbox.
-func (r *Range) EnqueueMessage(args *EnqueueMessageRequest, reply *EnqueueMessageResponse) {
-	reply.Error = util.Error("unimplemented")
+// InternalBulkWrite writes the leading rows of args.Rows which fall
+// within the range, stopping at the first row which doesn't. Unlike
+// Put, rows are written unconditionally and without a round trip
+// apiece. The rows are written atomically: on error, none are. Rows
+// whose keys have another transaction's write intent fail the write
+// with a WriteIntentError. Within a transaction, write intents are
+// laid down instead; see writeIntents.
+func (r *Range) InternalBulkWrite(args *InternalBulkWriteRequest, reply *InternalBulkWriteResponse) {
+	var rows []KeyValue
+	for _, row := range args.Rows {
+		if !r.containsKey(row.Key) {
+			break
+		}
+		rows = append(rows, row)
+	}
+	if args.TxID != "" {
+		if reply.Error = r.writeIntents(&args.RequestHeader, func(b *Batch, txn *Transaction) error {
+			for _, row := range rows {
+				value, err := r.compress(row.Key, r.stampTTL(row.Key, stampTimestamp(&args.RequestHeader, row.Value)))
+				if err != nil {
+					return err
+				}
+				if _, err := writeVersion(b, row.Key, &value, r.openTimestamp(value.Timestamp), txn); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); reply.Error == nil {
+			reply.Written = len(rows)
+		}
+		return
+	}
+	if reply.Error = r.recordWrites(func(b *Batch, record func(key Key, before Value, after *Value)) error {
+		for _, row := range rows {
+			before, err := b.get(row.Key)
+			if err != nil {
+				return err
+			}
+			value, err := r.compress(row.Key, r.stampTTL(row.Key, row.Value))
+			if err != nil {
+				return err
+			}
+			written, err := writeVersion(b, row.Key, &value, r.openTimestamp(value.Timestamp), nil)
+			if err != nil {
+				return err
+			}
+			record(row.Key, before, written)
+		}
+		return nil
+	}); reply.Error != nil {
+		return
+	}
+	for _, row := range rows {
+		r.configChanged(row.Key)
+	}
+	reply.Written = len(rows)
+}
+
+// InternalChangeReplicas replaces the range's replicas with
+// args.Replicas. Executed by each replica as the change commits, so
+// called only from processPending. The leader snapshots the range's
+// data as of the preceding entry, from which added replicas are
+// brought up to date. A replica which has been removed ceases to
+// participate in the range's raft group and awaits removal from its
+// store.
+func (r *Range) InternalChangeReplicas(args *InternalChangeReplicasRequest, reply *InternalChangeReplicasResponse) {
+	meta := r.Metadata()
+	meta.Replicas.Replicas = args.Replicas
+	b := r.newBatch()
+	if reply.Error = putI(b, rangeKey(meta.RangeID), meta); reply.Error != nil {
+		return
+	}
+	if reply.Error = b.Commit(); reply.Error != nil {
+		return
+	}
+	r.setMetadata(meta)
+	if r.transport == nil {
+		return
+	}
+	r.raft.setPeers(args.Replicas)
+	if r.raft.isLeader() {
+		r.compactRaftLog()
+		r.maybeGossipFirstRange()
+	}
+}
+
+// InternalSplit truncates the range to end at args.SplitKey and
+// creates the range spanning from args.SplitKey to the range's former
+// end key on the range's store, as the store's replica listed in
+// args.NewReplicas. Executed by each replica as the split commits, so
+// called only from processPending. The new range's replicas form a
+// raft group of their own, whose log begins with the split. The
+// leader's replica of the new range campaigns at once, so that the
+// new range is usually led by the same store as this range.
+func (r *Range) InternalSplit(args *InternalSplitRequest, reply *InternalSplitResponse) {
+	meta := r.Metadata()
+	if r.store == nil {
+		reply.Error = util.Errorf("range %d has no store to hold the ranges split from it", meta.RangeID)
+		return
+	}
+	if !r.containsKey(args.SplitKey) || bytes.Equal(args.SplitKey, meta.StartKey) {
+		reply.Error = util.Errorf("split key %q must be within range %d [%q, %q)",
+			args.SplitKey, meta.RangeID, meta.StartKey, meta.EndKey)
+		return
+	}
+	var newSelf Replica
+	for _, replica := range args.NewReplicas {
+		if replica.NodeID == r.ident.NodeID && replica.StoreID == r.ident.StoreID {
+			newSelf = replica
+		}
+	}
+	newRangeID := newSelf.RangeID
+	if newRangeID == 0 {
+		reply.Error = util.Errorf("range %d split at %q has no replica on store %d", meta.RangeID, args.SplitKey, r.ident.StoreID)
+		return
+	}
+	newMeta := r.store.newRangeMetadata(newRangeID, args.SplitKey, meta.EndKey, args.NewReplicas)
+	meta.EndKey = args.SplitKey
+	b := r.newBatch()
+	if reply.Error = putI(b, rangeKey(newRangeID), newMeta); reply.Error != nil {
+		return
+	}
+	if reply.Error = putI(b, rangeKey(meta.RangeID), meta); reply.Error != nil {
+		return
+	}
+	if reply.Error = copyResponseCache(b, r.engine, meta.RangeID, newRangeID); reply.Error != nil {
+		return
+	}
+	if reply.Error = b.Commit(); reply.Error != nil {
+		return
+	}
+	r.afterCommit(func() {
+		r.setMetadata(meta)
+		newRng := r.store.startRange(newMeta)
+		r.resetUsage()
+		r.recomputeStats()
+		if r.raft.isLeader() {
+			newRng.StepRaft(&RaftMessage{Type: RaftTimeoutNow, RangeID: newRangeID, From: newSelf, To: newSelf})
+		}
+	})
+}
+
+// InternalTouch extends the expiration of the value at args.Key to
+// args.Expiration, unless the value is absent or expires later. The
+// value is otherwise unchanged, so the touch isn't published to
+// watchers. See TTLConfig.Sliding.
+func (r *Range) InternalTouch(args *InternalTouchRequest, reply *InternalTouchResponse) {
+	r.usageMu.Lock()
+	defer r.usageMu.Unlock()
+	b := r.newBatch()
+	value, err := b.get(args.Key)
+	if err != nil || value.Bytes == nil || value.Expiration >= args.Expiration {
+		reply.Error = err
+		return
+	}
+	value.Expiration = args.Expiration
+	if reply.Error = b.put(args.Key, value); reply.Error != nil {
+		return
+	}
+	if reply.Error = b.Commit(); reply.Error == nil {
+		reply.Touched = true
+	}
+}
+
+// maxWatchWait bounds the time InternalWatch waits for events, so
+// that requests complete within RPC timeouts.
+const maxWatchWait = 5 * time.Second
+
+// InternalWatch returns change events for keys in the requested span
+// which follow args.Seq, waiting up to args.MaxWait for an event if
+// none are available.
+func (r *Range) InternalWatch(args *InternalWatchRequest, reply *InternalWatchResponse) {
+	meta := r.Metadata()
+	reply.RangeID, reply.EndKey = meta.RangeID, meta.EndKey
+	seq := args.Seq
+	if args.RangeID != 0 && args.RangeID != meta.RangeID {
+		seq = 0
+	}
+	if seq < 0 {
+		reply.Seq = r.feed.latest()
+		return
+	}
+	start, end := args.StartKey, args.EndKey
+	if bytes.Compare(start, meta.StartKey) < 0 {
+		start = meta.StartKey
+	}
+	if bytes.Compare(end, meta.EndKey) > 0 {
+		end = meta.EndKey
+	}
+	wait := time.Duration(args.MaxWait)
+	if wait > maxWatchWait {
+		wait = maxWatchWait
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		events, latest, truncated, notify := r.feed.since(seq, start, end)
+		reply.Events, reply.Seq, reply.Truncated = events, latest, truncated
+		if len(events) > 0 || truncated {
+			for i := 0; reply.Error == nil && i < len(events); i++ {
+				ev := &events[i]
+				ev.Value, reply.Error = r.decompress(&args.RequestHeader, ev.Key, ev.Value)
+			}
+			return
+		}
+		// Skip events outside the span while waiting.
+		seq = latest
+		select {
+		case <-notify:
+		case <-timer.C:
+			return
+		case <-r.closer:
+			return
+		}
+	}
 }
 
 // InternalRangeLookup looks up the metadata info for the given args.Key.
@@ -437,11 +2119,12 @@ func (r *Range) InternalRangeLookup(args *InternalRangeLookupRequest, reply *Int
 		return
 	}
 
+	meta := r.Metadata()
 	// Validate that key is not outside the range. Since the keys encoded in metadata keys are
-	// the end keys of the range the metadata represent, the check args.Key >= r.Meta.StartKey
+	// the end keys of the range the metadata represent, the check args.Key >= meta.StartKey
 	// may result in false negatives.
-	if bytes.Compare(args.Key, r.Meta.EndKey) >= 0 {
-		reply.Error = util.Errorf("key outside the range %v with end key %q", r.Meta.RangeID, r.Meta.EndKey)
+	if bytes.Compare(args.Key, meta.EndKey) >= 0 {
+		reply.Error = util.Errorf("key outside the range %v with end key %q", meta.RangeID, meta.EndKey)
 		return
 	}
 
@@ -455,7 +2138,7 @@ func (r *Range) InternalRangeLookup(args *InternalRangeLookupRequest, reply *Int
 	// We should have gotten the key with the same metadata level prefix as we queried.
 	metaPrefix := args.Key[0:len(KeyMeta1Prefix)]
 	if len(kvs) != 1 || !bytes.HasPrefix(kvs[0].Key, metaPrefix) {
-		reply.Error = util.Errorf("key not found in range %v", r.Meta.RangeID)
+		reply.Error = util.Errorf("key not found in range %v", meta.RangeID)
 		return
 	}
 
@@ -463,9 +2146,9 @@ func (r *Range) InternalRangeLookup(args *InternalRangeLookupRequest, reply *Int
 		reply.Error = err
 		return
 	}
-	if bytes.Compare(args.Key, reply.Locations.StartKey) < 0 {
+	if bytes.Compare(args.Key[len(metaPrefix):], reply.Locations.StartKey) < 0 {
 		// args.Key doesn't belong to this range. We are perhaps searching the wrong node?
-		reply.Error = util.Errorf("no range found for key %q in range: %+v", args.Key, r.Meta)
+		reply.Error = util.Errorf("no range found for key %q in range: %+v", args.Key, meta)
 		return
 	}
 	reply.EndKey = kvs[0].Key
@@ -19,7 +19,9 @@ package storage
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
+	"fmt"
 	"reflect"
 	"testing"
 
@@ -91,7 +93,8 @@ func createTestRange(engine Engine, t *testing.T) (*Range, *gossip.Gossip) {
 	return r, g
 }
 
-// TestRangeGossipFirstRange verifies that the first range gossips its location.
+// TestRangeGossipFirstRange verifies that the first range gossips its
+// location and the cluster version.
 func TestRangeGossipFirstRange(t *testing.T) {
 	r, g := createTestRange(createTestEngine(t), t)
 	defer r.Stop()
@@ -102,6 +105,13 @@ func TestRangeGossipFirstRange(t *testing.T) {
 	if !reflect.DeepEqual(info.(RangeLocations), testRangeLocations) {
 		t.Errorf("expected gossipped range locations to be equal: %s vs %s", info.(RangeLocations), testRangeLocations)
 	}
+	info, err = g.GetInfo(gossip.KeyClusterVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.(int) != ClusterVersion {
+		t.Errorf("expected gossipped cluster version %d; got %d", ClusterVersion, info.(int))
+	}
 }
 
 // TestRangeGossipAllConfigs verifies that all config types are
@@ -197,3 +207,340 @@ func TestRangeGossipConfigUpdates(t *testing.T) {
 		t.Errorf("expected gossiped configs to be equal %s vs %s", configs, expConfigs)
 	}
 }
+
+// TestRangeIdempotentCommands verifies a read-write command retried
+// with the same client command ID is executed only once, with the
+// original reply replayed.
+func TestRangeIdempotentCommands(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	cmdID := ClientCmdID{WallTime: 1, Random: 1}
+	for i, expValue := range []int64{1, 1} {
+		args := &IncrementRequest{RequestHeader: RequestHeader{CmdID: cmdID}, Key: Key("a"), Increment: 1}
+		reply := &IncrementResponse{}
+		if err := <-r.ReadWriteCmd("Increment", args, reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.NewValue != expValue {
+			t.Errorf("%d: expected value %d; got %d", i, expValue, reply.NewValue)
+		}
+	}
+	// A new command ID executes again.
+	args := &IncrementRequest{RequestHeader: RequestHeader{CmdID: ClientCmdID{WallTime: 1, Random: 2}}, Key: Key("a"), Increment: 1}
+	reply := &IncrementResponse{}
+	if err := <-r.ReadWriteCmd("Increment", args, reply); err != nil || reply.NewValue != 2 {
+		t.Errorf("expected value 2; got %d, %v", reply.NewValue, err)
+	}
+}
+
+// TestRangeScanLimits verifies scans stop at their byte budget or
+// pacing limit and return the key from which to resume.
+func TestRangeScanLimits(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	// 150 rows of 10 bytes each: a 4 byte key and 6 byte value.
+	for i := 0; i < 150; i++ {
+		reply := &PutResponse{}
+		r.Put(&PutRequest{Key: Key(fmt.Sprintf("k%03d", i)), Value: Value{Bytes: []byte("value!")}}, reply)
+		if reply.Error != nil {
+			t.Fatal(reply.Error)
+		}
+	}
+	testCases := []struct {
+		args      ScanRequest
+		expRows   int
+		expResume Key
+	}{
+		// Without limits on bytes or rate, MaxResults applies as usual.
+		{ScanRequest{StartKey: Key("k"), EndKey: Key("l"), MaxResults: 120}, 120, nil},
+		{ScanRequest{StartKey: Key("k"), EndKey: Key("l"), MaxResults: 200, MaxBytes: 55}, 5, Key("k005")},
+		// At least one row is returned, regardless of size.
+		{ScanRequest{StartKey: Key("k010"), EndKey: Key("l"), MaxResults: 200, MaxBytes: 1}, 1, Key("k011")},
+		{ScanRequest{StartKey: Key("k"), EndKey: Key("l"), MaxResults: 120, MaxBytes: 10000}, 120, nil},
+		// Reading the second batch would take more than maxScanPacing.
+		{ScanRequest{StartKey: Key("k"), EndKey: Key("l"), MaxResults: 200, MaxBytesPerSecond: 100}, 100, Key("k099\x00")},
+		{ScanRequest{StartKey: Key("k"), EndKey: Key("l"), MaxResults: 200, MaxBytesPerSecond: 1 << 20}, 150, nil},
+	}
+	for i, test := range testCases {
+		reply := &ScanResponse{}
+		r.Scan(&test.args, reply)
+		if reply.Error != nil {
+			t.Fatalf("%d: %v", i, reply.Error)
+		}
+		if len(reply.Rows) != test.expRows || !bytes.Equal(reply.ResumeKey, test.expResume) {
+			t.Errorf("%d: expected %d rows, resume key %q; got %d rows, resume key %q",
+				i, test.expRows, test.expResume, len(reply.Rows), reply.ResumeKey)
+		}
+	}
+}
+
+// TestRangeReverseScan verifies reverse scans return the latest
+// entries under a prefix whose keys embed sequence numbers, subject
+// to the same limits as forward scans.
+func TestRangeReverseScan(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	eventKey := func(seq uint64) Key {
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], seq)
+		return MakeKey(Key("events/"), buf[:])
+	}
+	keys := []Key{Key("events"), Key("eventsz")}
+	for seq := uint64(0); seq < 300; seq += 3 {
+		keys = append(keys, eventKey(seq))
+	}
+	for _, key := range keys {
+		reply := &PutResponse{}
+		r.Put(&PutRequest{Key: key, Value: Value{Bytes: []byte("value!")}}, reply)
+		if reply.Error != nil {
+			t.Fatal(reply.Error)
+		}
+	}
+	prefix := Key("events/")
+	testCases := []struct {
+		args      ScanRequest
+		expFirst  Key
+		expRows   int
+		expResume Key
+	}{
+		{ScanRequest{StartKey: prefix, EndKey: PrefixEndKey(prefix), MaxResults: 3, Reverse: true}, eventKey(297), 3, nil},
+		{ScanRequest{StartKey: prefix, EndKey: eventKey(297), MaxResults: 3, Reverse: true}, eventKey(294), 3, nil},
+		{ScanRequest{StartKey: prefix, EndKey: PrefixEndKey(prefix), MaxResults: 200, Reverse: true}, eventKey(297), 100, nil},
+		// Each row is 21 bytes: a 15 byte key and 6 byte value.
+		{ScanRequest{StartKey: prefix, EndKey: PrefixEndKey(prefix), MaxResults: 200, MaxBytes: 50, Reverse: true},
+			eventKey(297), 2, MakeKey(eventKey(291), Key{0})},
+		{ScanRequest{StartKey: eventKey(150), EndKey: PrefixEndKey(prefix), MaxResults: 200, MaxBytes: 10000, Reverse: true},
+			eventKey(297), 50, nil},
+	}
+	for i, test := range testCases {
+		reply := &ScanResponse{}
+		r.Scan(&test.args, reply)
+		if reply.Error != nil {
+			t.Fatalf("%d: %v", i, reply.Error)
+		}
+		if len(reply.Rows) != test.expRows || !bytes.Equal(reply.ResumeKey, test.expResume) {
+			t.Errorf("%d: expected %d rows, resume key %q; got %d rows, resume key %q",
+				i, test.expRows, test.expResume, len(reply.Rows), reply.ResumeKey)
+			continue
+		}
+		if !bytes.Equal(reply.Rows[0].Key, test.expFirst) {
+			t.Errorf("%d: expected first row %q; got %q", i, test.expFirst, reply.Rows[0].Key)
+		}
+		for j := 1; j < len(reply.Rows); j++ {
+			if bytes.Compare(reply.Rows[j].Key, reply.Rows[j-1].Key) >= 0 {
+				t.Errorf("%d: rows out of order at %d: %q follows %q", i, j, reply.Rows[j].Key, reply.Rows[j-1].Key)
+			}
+		}
+	}
+	reply := &ScanResponse{}
+	r.Scan(&ScanRequest{StartKey: prefix, MaxResults: 1, Reverse: true}, reply)
+	if reply.Error == nil {
+		t.Error("expected error on reverse scan without end key")
+	}
+}
+
+// TestRangeHistoricalReads verifies a range serves reads at earlier
+// timestamps from the versions its writes superseded, and that writes
+// older than a key's latest version are moved past it.
+func TestRangeHistoricalReads(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	writes := []struct {
+		key       string
+		timestamp int64
+		value     string // Deletes the key if empty
+	}{
+		{"a", 10, "a1"},
+		{"b", 15, "b1"},
+		{"a", 20, "a2"},
+		{"a", 30, ""},
+		{"b", 5, "b2"},
+	}
+	for _, w := range writes {
+		header := RequestHeader{Timestamp: w.timestamp}
+		if w.value == "" {
+			reply := &DeleteResponse{}
+			r.Delete(&DeleteRequest{RequestHeader: header, Key: Key(w.key)}, reply)
+			if reply.Error != nil {
+				t.Fatal(reply.Error)
+			}
+			continue
+		}
+		reply := &PutResponse{}
+		r.Put(&PutRequest{RequestHeader: header, Key: Key(w.key), Value: Value{Bytes: []byte(w.value)}}, reply)
+		if reply.Error != nil {
+			t.Fatal(reply.Error)
+		}
+	}
+
+	getCases := []struct {
+		key       string
+		timestamp int64
+		exp       string
+	}{
+		{"a", 5, ""},
+		{"a", 10, "a1"},
+		{"a", 25, "a2"},
+		{"a", 30, ""},
+		{"a", 0, ""},
+		{"b", 15, "b1"},
+		{"b", 0, "b2"},
+	}
+	for _, test := range getCases {
+		reply := &GetResponse{}
+		r.Get(&GetRequest{RequestHeader: RequestHeader{Timestamp: test.timestamp}, Key: Key(test.key)}, reply)
+		if reply.Error != nil || string(reply.Value.Bytes) != test.exp {
+			t.Errorf("%s@%d: expected %q; got %q, %v", test.key, test.timestamp, test.exp, reply.Value.Bytes, reply.Error)
+		}
+	}
+	reply := &GetResponse{}
+	r.Get(&GetRequest{Key: Key("b")}, reply)
+	if reply.Value.Timestamp != 16 {
+		t.Errorf("expected write at 5 moved past the version at 15; got timestamp %d", reply.Value.Timestamp)
+	}
+
+	scanCases := []struct {
+		timestamp int64
+		exp       []string
+	}{
+		{12, []string{"a1"}},
+		{15, []string{"a1", "b1"}},
+		{25, []string{"a2", "b2"}},
+		{0, []string{"b2"}},
+	}
+	for _, test := range scanCases {
+		for _, reverse := range []bool{false, true} {
+			reply := &ScanResponse{}
+			r.Scan(&ScanRequest{RequestHeader: RequestHeader{Timestamp: test.timestamp}, StartKey: Key("a"), EndKey: Key("c"), Reverse: reverse}, reply)
+			var values []string
+			for _, row := range reply.Rows {
+				values = append(values, string(row.Value.Bytes))
+			}
+			if reverse {
+				for i, j := 0, len(values)-1; i < j; i, j = i+1, j-1 {
+					values[i], values[j] = values[j], values[i]
+				}
+			}
+			if reply.Error != nil || !reflect.DeepEqual(values, test.exp) {
+				t.Errorf("scan at %d, reverse=%t: expected %q; got %q, %v", test.timestamp, reverse, test.exp, values, reply.Error)
+			}
+		}
+	}
+}
+
+// TestRangeTimeSeries verifies AccumulateTS adds counts to time
+// series, and that GetTSBlock reads them in blocks limited by MaxKeys
+// and by the end of the range.
+func TestRangeTimeSeries(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	for _, test := range []struct {
+		key    string
+		counts []int64
+	}{
+		{"a", []int64{1, 2}},
+		{"a", []int64{10, 20, 30}},
+		{"b", []int64{-5}},
+		{"c", nil},
+	} {
+		reply := &AccumulateTSResponse{}
+		r.AccumulateTS(&AccumulateTSRequest{Key: Key(test.key), Counts: test.counts}, reply)
+		if reply.Error != nil {
+			t.Fatal(reply.Error)
+		}
+	}
+	reply := &GetTSBlockResponse{}
+	r.GetTSBlock(&GetTSBlockRequest{StartKey: Key("a"), EndKey: Key("d")}, reply)
+	if reply.Error != nil {
+		t.Fatal(reply.Error)
+	}
+	if expKeys := []Key{Key("a"), Key("b"), Key("c")}; !reflect.DeepEqual(reply.Keys, expKeys) {
+		t.Errorf("expected keys %q; got %q", expKeys, reply.Keys)
+	}
+	for i, exp := range [][]int64{{11, 22, 30}, {-5}, {}} {
+		if series := reply.Series(i); len(series) != len(exp) || (len(exp) > 0 && !reflect.DeepEqual(series, exp)) {
+			t.Errorf("%d: expected series %v; got %v", i, exp, series)
+		}
+	}
+	if reply.ResumeKey != nil {
+		t.Errorf("expected no resume key; got %q", reply.ResumeKey)
+	}
+
+	reply = &GetTSBlockResponse{}
+	r.GetTSBlock(&GetTSBlockRequest{StartKey: Key("a"), EndKey: Key("d"), MaxKeys: 1}, reply)
+	if len(reply.Keys) != 1 || !bytes.Equal(reply.ResumeKey, MakeKey(Key("a"), Key{0})) {
+		t.Errorf("expected one key and resume key after \"a\"; got %q, %q", reply.Keys, reply.ResumeKey)
+	}
+	// Reads past the end of the range resume at its end.
+	reply = &GetTSBlockResponse{}
+	r.GetTSBlock(&GetTSBlockRequest{StartKey: Key("a"), EndKey: MakeKey(KeyMax, Key{0})}, reply)
+	if len(reply.Keys) != 3 || !bytes.Equal(reply.ResumeKey, KeyMax) {
+		t.Errorf("expected three keys and resume key at range end; got %q, %q", reply.Keys, reply.ResumeKey)
+	}
+
+	// Values which aren't time series can't be accumulated.
+	r.Put(&PutRequest{Key: Key("d"), Value: Value{Bytes: []byte{0xff}}}, &PutResponse{})
+	accReply := &AccumulateTSResponse{}
+	r.AccumulateTS(&AccumulateTSRequest{Key: Key("d"), Counts: []int64{1}}, accReply)
+	if accReply.Error == nil {
+		t.Error("expected error accumulating non-time series value")
+	}
+}
+
+// TestRangeAppendAndGetByteRange verifies appends extend values,
+// creating them if necessary, and that byte ranges are read from
+// within values.
+func TestRangeAppendAndGetByteRange(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	for i, s := range []string{"hello", ", ", "world"} {
+		reply := &AppendResponse{}
+		r.Append(&AppendRequest{Key: Key("a"), Value: Value{Bytes: []byte(s)}}, reply)
+		if reply.Error != nil {
+			t.Fatal(reply.Error)
+		}
+		if expLen := []int64{5, 7, 12}[i]; reply.NewLength != expLen {
+			t.Errorf("%d: expected length %d; got %d", i, expLen, reply.NewLength)
+		}
+	}
+	testCases := []struct {
+		key            string
+		offset, length int64
+		expBytes       string
+		expLength      int64
+	}{
+		{"a", 0, 0, "hello, world", 12},
+		{"a", 7, 0, "world", 12},
+		{"a", 2, 3, "llo", 12},
+		{"a", 10, 5, "ld", 12},
+		{"a", 20, 5, "", 12},
+		{"b", 0, 0, "", 0},
+	}
+	for i, test := range testCases {
+		reply := &GetByteRangeResponse{}
+		r.GetByteRange(&GetByteRangeRequest{Key: Key(test.key), Offset: test.offset, Length: test.length}, reply)
+		if reply.Error != nil {
+			t.Fatalf("%d: %v", i, reply.Error)
+		}
+		if string(reply.Bytes) != test.expBytes || reply.Length != test.expLength {
+			t.Errorf("%d: expected %q of %d bytes; got %q of %d", i, test.expBytes, test.expLength, reply.Bytes, reply.Length)
+		}
+	}
+	reply := &GetByteRangeResponse{}
+	r.GetByteRange(&GetByteRangeRequest{Key: Key("a"), Offset: -1}, reply)
+	if reply.Error == nil {
+		t.Error("expected error reading negative offset")
+	}
+
+	// Appends beyond MaxLength are refused, leaving the value as is.
+	ar := &AppendResponse{}
+	r.Append(&AppendRequest{Key: Key("a"), Value: Value{Bytes: []byte("!!")}, MaxLength: 13}, ar)
+	if err, ok := ar.Error.(*AppendTooLargeError); !ok || err.Length != 14 || err.MaxLength != 13 {
+		t.Errorf("expected append too large error; got %v", ar.Error)
+	}
+	ar = &AppendResponse{}
+	r.Append(&AppendRequest{Key: Key("a"), Value: Value{Bytes: []byte("!")}, MaxLength: 13}, ar)
+	if ar.Error != nil || ar.NewLength != 13 {
+		t.Errorf("expected append up to max length; got %d, %v", ar.NewLength, ar.Error)
+	}
+}
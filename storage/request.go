@@ -0,0 +1,177 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+// A Request is the arguments of a node method. Clients set the fields
+// of its header and address it to a replica via the interface, rather
+// than via reflection, as each request is sent.
+type Request interface {
+	// Header returns the request's header.
+	Header() *RequestHeader
+	// SetReplica sets the replica to which the request is sent.
+	SetReplica(replica Replica)
+	// Clone returns a shallow copy of the request, so that its header
+	// may be set for each replica it's sent to without affecting
+	// others.
+	Clone() Request
+}
+
+// A Response is the reply of a node method.
+type Response interface {
+	// Header returns the response's header.
+	Header() *ResponseHeader
+}
+
+// Header implements the Request interface for requests embedding the
+// header.
+func (rh *RequestHeader) Header() *RequestHeader { return rh }
+
+// SetReplica implements the Request interface for requests embedding
+// the header.
+func (rh *RequestHeader) SetReplica(replica Replica) { rh.Replica = replica }
+
+// Header implements the Response interface for responses embedding
+// the header.
+func (rh *ResponseHeader) Header() *ResponseHeader { return rh }
+
+// Clone implements the Request interface.
+func (r *ContainsRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *GetRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *PutRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *IncrementRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *AppendRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *GetByteRangeRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *DeleteRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *DeleteRangeRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *ScanRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *EndTransactionRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *AccumulateTSRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *GetTSBlockRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *ReapQueueRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *AckQueueRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *EnqueueUpdateRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *EnqueueMessageRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *AdminSplitRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *AdminMergeRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *AdminCompactRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *AdminTransferLeaseRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *InternalBulkWriteRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *InternalDebugScanRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *InternalRaftMessageRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *InternalSnapshotChunkRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *InternalChangeReplicasRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *InternalTouchRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *InternalPushTxnRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *InternalResolveIntentRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *InternalTxnResolvedRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *InternalComputeChecksumRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *InternalChecksumRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *InternalQuarantineReplicaRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *InternalLeaseRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *InternalCreateReplicaRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *InternalRemoveReplicaRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *InternalSplitRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *InternalAllocateRangeIDRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *InternalSubsumeRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *InternalMergeRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *InternalWatchRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *InternalResolvedTimestampRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *InternalCloseTimestampRequest) Clone() Request { c := *r; return &c }
+
+// Clone implements the Request interface.
+func (r *InternalRangeLookupRequest) Clone() Request { c := *r; return &c }
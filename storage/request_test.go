@@ -0,0 +1,50 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestRequestClone verifies a cloned request is a copy whose header
+// may be set without affecting the original.
+func TestRequestClone(t *testing.T) {
+	args := &PutRequest{
+		RequestHeader: RequestHeader{User: "u"},
+		Key:           Key("a"),
+		Value:         Value{Bytes: []byte("v")},
+	}
+	var req Request = args
+	clone := req.Clone()
+	if !reflect.DeepEqual(clone, req) {
+		t.Fatalf("expected clone %+v to equal %+v", clone, req)
+	}
+	clone.SetReplica(Replica{NodeID: 1, StoreID: 2})
+	clone.Header().Priority = 1
+	if args.Replica != (Replica{}) || args.Priority != 0 {
+		t.Errorf("expected original header unmodified; got %+v", args.RequestHeader)
+	}
+	if put := clone.(*PutRequest); put.Replica.StoreID != 2 || put.Priority != 1 || put.User != "u" {
+		t.Errorf("unexpected clone header %+v", put.RequestHeader)
+	}
+
+	var resp Response = &PutResponse{}
+	resp.Header().ClockReading = 5
+	if resp.(*PutResponse).ClockReading != 5 {
+		t.Error("expected response header to be set")
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"reflect"
+)
+
+// reservedPrefixes are the prefixes of system keys whose corruption
+// would disrupt the cluster: range addressing records, configs, ID
+// generators and the rows storing MVCC versions and write intents. Other system keys, such as those of queues, jobs and
+// time series, are written by clients as part of their APIs.
+var reservedPrefixes = []Key{
+	KeyMetaPrefix,
+	KeyConfigAccountingPrefix,
+	KeyConfigPermissionPrefix,
+	KeyConfigZonePrefix,
+	KeyConfigCompressionPrefix,
+	KeyConfigTTLPrefix,
+	KeyConfigFreezePrefix,
+	KeyNodeIDGenerator,
+	KeyStoreIDGeneratorPrefix,
+	keyMVCCPrefix,
+}
+
+// IsReservedKey returns whether key lies within a reserved prefix,
+// which clients may write only with requests flagged as internal.
+func IsReservedKey(key Key) bool {
+	for _, prefix := range reservedPrefixes {
+		if bytes.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckReserved returns a ReservedKeyError if the request args, a
+// write of method, accesses a reserved key and isn't flagged as
+// internal.
+func CheckReserved(method string, args interface{}) error {
+	if reflect.Indirect(reflect.ValueOf(args)).FieldByName("Internal").Bool() {
+		return nil
+	}
+	for _, span := range requestSpans(args) {
+		for _, prefix := range reservedPrefixes {
+			if span.overlaps(prefix, PrefixEndKey(prefix)) {
+				return &ReservedKeyError{Method: method, Key: span.start, Prefix: prefix}
+			}
+		}
+	}
+	return nil
+}
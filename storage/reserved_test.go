@@ -0,0 +1,46 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import "testing"
+
+// TestCheckReserved verifies writes accessing reserved keys are
+// refused unless flagged as internal, while writes of other keys,
+// including other system keys, are permitted.
+func TestCheckReserved(t *testing.T) {
+	testCases := []struct {
+		args     interface{}
+		reserved bool
+	}{
+		{&PutRequest{Key: Key("a")}, false},
+		{&PutRequest{Key: MakeKey(KeyQueuePrefix, Key("inbox"))}, false},
+		{&PutRequest{Key: MakeKey(KeyMeta2Prefix, KeyMax)}, true},
+		{&PutRequest{Key: MakeKey(KeyConfigZonePrefix, Key("db"))}, true},
+		{&PutRequest{RequestHeader: RequestHeader{Internal: true}, Key: MakeKey(KeyConfigZonePrefix, Key("db"))}, false},
+		{&IncrementRequest{Key: KeyNodeIDGenerator}, true},
+		{&PutRequest{Key: mvccMetadataKey(Key("a"))}, true},
+		{&DeleteRangeRequest{StartKey: Key("a"), EndKey: Key("z")}, false},
+		{&DeleteRangeRequest{StartKey: KeyMin, EndKey: Key("a")}, true},
+		{&DeleteRangeRequest{StartKey: KeyConfigFreezePrefix}, true},
+		{&InternalBulkWriteRequest{Rows: []KeyValue{{Key: Key("a")}, {Key: MakeKey(KeyConfigPermissionPrefix, Key("a"))}}}, true},
+	}
+	for i, c := range testCases {
+		err := CheckReserved("Write", c.args)
+		if _, ok := err.(*ReservedKeyError); ok != c.reserved {
+			t.Errorf("%d: expected reserved %t; got %v", i, c.reserved, err)
+		}
+	}
+}
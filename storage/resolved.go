@@ -0,0 +1,244 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"reflect"
+	"time"
+)
+
+// requestHeader returns the header of the request args, or nil if it
+// has none.
+func requestHeader(args interface{}) *RequestHeader {
+	header := reflect.Indirect(reflect.ValueOf(args)).FieldByName("RequestHeader")
+	if !header.IsValid() || !header.CanAddr() {
+		return nil
+	}
+	return header.Addr().Interface().(*RequestHeader)
+}
+
+// trackWrite records a read-write command as awaiting execution until
+// it's finished. If the timestamp assigned to it by its node isn't
+// above the range's closed timestamp, it's moved past it, so that
+// timestamps reported as resolved remain so. Called as the command is
+// submitted and again as it's proposed, by which time the proposer
+// holds the lease and has applied the timestamps closed by its
+// predecessors.
+func (r *Range) trackWrite(logEntry *LogEntry) {
+	header := requestHeader(logEntry.Args)
+	if header == nil || header.Timestamp == 0 {
+		return
+	}
+	r.closedMu.Lock()
+	defer r.closedMu.Unlock()
+	if header.Timestamp <= r.closed {
+		header.Timestamp = r.closed + 1
+	}
+	r.inflight[logEntry] = header.Timestamp
+}
+
+// openTimestamp returns the timestamp at which to write a version
+// meant for timestamp: timestamp itself, unless the range's resolved
+// timestamp has been closed at or beyond it, in which case it's moved
+// past the closed timestamp, so that versioned reads at timestamps
+// reported as resolved never see later writes. Unlike trackWrite,
+// this covers writes whose timestamps aren't set by their headers,
+// such as the rows of bulk writes, and commands executed other than
+// via ReadWriteCmd. Requires usageMu.
+func (r *Range) openTimestamp(timestamp int64) int64 {
+	r.closedMu.Lock()
+	defer r.closedMu.Unlock()
+	if r.closed > 0 && timestamp <= r.closed {
+		return r.closed + 1
+	}
+	return timestamp
+}
+
+// finish signals the result of a read-write command to its proposer,
+// ceasing to track it as awaiting execution.
+func (r *Range) finish(logEntry *LogEntry, err error) {
+	r.closedMu.Lock()
+	delete(r.inflight, logEntry)
+	r.closedMu.Unlock()
+	logEntry.done <- err
+}
+
+// minIntentTimestamp returns the earliest timestamp of the write
+// intents in the range, or false if it has none.
+func (r *Range) minIntentTimestamp() (int64, bool, error) {
+	if r.Stats().IntentCount == 0 {
+		return 0, false, nil
+	}
+	var min int64
+	var found bool
+	meta := r.Metadata()
+	err := visitIntents(r.engine, meta.StartKey, meta.EndKey, func(key Key, keyMeta MVCCMetadata) error {
+		if !found || keyMeta.Timestamp < min {
+			min, found = keyMeta.Timestamp, true
+		}
+		return nil
+	})
+	return min, found, err
+}
+
+// InternalResolvedTimestamp returns the range's resolved timestamp:
+// the latest timestamp at and below which all writes to the range
+// have been resolved, so that reads at it will see the same values
+// however late they're made. The timestamp is closed to further
+// writes, which are moved past it, and is held back by write intents
+// and commands awaiting execution. It trails the leader's clock by
+// MaxClockOffset, so that writes stamped by nodes whose clocks lag
+// are rarely moved. A range with a raft transport replicates the
+// timestamp before reporting it, so that it remains closed should the
+// lease move; see CloseTimestamp.
+func (r *Range) InternalResolvedTimestamp(args *InternalResolvedTimestampRequest, reply *InternalResolvedTimestampResponse) {
+	reply.EndKey = r.Metadata().EndKey
+	if r.transport == nil {
+		reply.Timestamp, reply.Error = r.resolvedTimestamp()
+		return
+	}
+	reply.Timestamp, reply.Error = r.CloseTimestamp()
+}
+
+// resolvedTimestamp closes the range's timestamp to writes and returns
+// its resolved timestamp; see InternalResolvedTimestamp.
+func (r *Range) resolvedTimestamp() (int64, error) {
+	resolved := time.Now().UnixNano() - int64(MaxClockOffset)
+	r.closedMu.Lock()
+	for _, timestamp := range r.inflight {
+		if timestamp-1 < resolved {
+			resolved = timestamp - 1
+		}
+	}
+	if resolved < r.closed {
+		resolved = r.closed
+	}
+	r.closed = resolved
+	r.closedMu.Unlock()
+	// Writes which found the timestamp open, under usageMu, are
+	// committed before it's reported resolved.
+	r.usageMu.Lock()
+	r.usageMu.Unlock()
+
+	// Intents are found once the timestamp is closed, so that those
+	// of commands executed meanwhile aren't missed.
+	intent, ok, err := r.minIntentTimestamp()
+	if err != nil {
+		return 0, err
+	}
+	if ok && intent-1 < resolved {
+		resolved = intent - 1
+	}
+	if resolved < 0 {
+		resolved = 0
+	}
+	return resolved, nil
+}
+
+// CloseTimestamp replicates the range's resolved timestamp, as
+// computed by this replica, which must hold the range's lease, to
+// all its replicas via an InternalCloseTimestamp command. As the
+// command follows every write at and below the timestamp in the raft
+// log, a replica which has applied it may serve BOUNDED reads at and
+// below the timestamp from its own data. A replica acquiring the
+// lease applies the command before its lease, so it moves writes past
+// the timestamp too; see Range.propose. Returns the timestamp closed.
+func (r *Range) CloseTimestamp() (int64, error) {
+	if err := r.checkLease(); err != nil {
+		return 0, err
+	}
+	resolved, err := r.resolvedTimestamp()
+	if err != nil {
+		return 0, err
+	}
+	r.raftMu.RLock()
+	self := r.self
+	r.raftMu.RUnlock()
+	args := &InternalCloseTimestampRequest{RequestHeader: RequestHeader{Replica: self}, Timestamp: resolved}
+	reply := &InternalCloseTimestampResponse{}
+	if err := <-r.ReadWriteCmd("InternalCloseTimestamp", args, reply); err != nil {
+		return 0, err
+	}
+	return reply.Timestamp, reply.Error
+}
+
+// InternalCloseTimestamp advances the replica's resolved timestamp to
+// args.Timestamp, closing it to writes should the replica become the
+// leader. Executed by every replica as the command is applied.
+func (r *Range) InternalCloseTimestamp(args *InternalCloseTimestampRequest, reply *InternalCloseTimestampResponse) {
+	r.closedMu.Lock()
+	defer r.closedMu.Unlock()
+	if args.Timestamp > r.closed {
+		r.closed = args.Timestamp
+	}
+	if args.Timestamp > r.resolved {
+		r.resolved = args.Timestamp
+	}
+	reply.Timestamp = r.resolved
+}
+
+// servesFollowerRead returns whether this replica may serve a read
+// with header from its own data without holding the range's lease:
+// reads which set AnyReplica or are INCONSISTENT may be served by any
+// replica, and BOUNDED reads by a replica whose applied resolved
+// timestamp is at or beyond their MinTimestamp.
+func (r *Range) servesFollowerRead(header *RequestHeader) bool {
+	if header == nil {
+		return false
+	}
+	switch {
+	case header.AnyReplica || header.ReadConsistency == INCONSISTENT:
+		return true
+	case header.ReadConsistency == BOUNDED && header.MinTimestamp > 0:
+		r.closedMu.Lock()
+		defer r.closedMu.Unlock()
+		return header.MinTimestamp <= r.resolved
+	}
+	return false
+}
+
+// CloseTimestamps closes the resolved timestamps of the ranges led by
+// this store, concurrently, so that their followers may serve BOUNDED
+// reads; see Range.CloseTimestamp. Returns the number of ranges whose
+// timestamps were closed and the first error encountered, if any.
+func (s *Store) CloseTimestamps() (int, error) {
+	s.mu.Lock()
+	var ranges []*Range
+	for _, rng := range s.ranges {
+		if rng.IsLeader() {
+			ranges = append(ranges, rng)
+		}
+	}
+	s.mu.Unlock()
+
+	errs := make(chan error, len(ranges))
+	for _, rng := range ranges {
+		go func(rng *Range) {
+			_, err := rng.CloseTimestamp()
+			errs <- err
+		}(rng)
+	}
+	closed := 0
+	var firstErr error
+	for range ranges {
+		if err := <-errs; err == nil {
+			closed++
+		} else if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return closed, firstErr
+}
@@ -0,0 +1,181 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// resolvedTimestamp returns the range's resolved timestamp.
+func resolvedTimestamp(t *testing.T, r *Range) int64 {
+	reply := &InternalResolvedTimestampResponse{}
+	r.InternalResolvedTimestamp(&InternalResolvedTimestampRequest{}, reply)
+	if reply.Error != nil {
+		t.Fatal(reply.Error)
+	}
+	if !bytes.Equal(reply.EndKey, r.Metadata().EndKey) {
+		t.Errorf("expected end key %q; got %q", r.Metadata().EndKey, reply.EndKey)
+	}
+	return reply.Timestamp
+}
+
+// TestRangeResolvedTimestamp verifies a range's resolved timestamp
+// trails its clock, is held back by write intents and commands
+// awaiting execution, and that writes at or below it are moved past
+// it.
+func TestRangeResolvedTimestamp(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	resolved := resolvedTimestamp(t, r)
+	now := time.Now().UnixNano()
+	if resolved > now-int64(MaxClockOffset) || resolved < now-int64(time.Minute) {
+		t.Errorf("expected resolved timestamp to trail %d by %s; got %d", now, MaxClockOffset, resolved)
+	}
+
+	// A write at the closed timestamp is moved past it, and holds
+	// back the resolved timestamp until it finishes.
+	args := &PutRequest{RequestHeader: RequestHeader{Timestamp: resolved}, Key: Key("a")}
+	logEntry := &LogEntry{Method: "Put", Args: args, Reply: &PutResponse{}, done: make(chan error, 1)}
+	r.trackWrite(logEntry)
+	if args.Timestamp != resolved+1 {
+		t.Errorf("expected write moved to %d; got %d", resolved+1, args.Timestamp)
+	}
+	if ts := resolvedTimestamp(t, r); ts != resolved {
+		t.Errorf("expected resolved timestamp held at %d; got %d", resolved, ts)
+	}
+	r.finish(logEntry, nil)
+	if ts := resolvedTimestamp(t, r); ts <= resolved {
+		t.Errorf("expected resolved timestamp to advance past %d once write finished; got %d", resolved, ts)
+	}
+
+	// An intent holds back the resolved timestamp until it's resolved.
+	header := txnHeader("txn1", 1)
+	header.Timestamp = time.Now().UnixNano()
+	pr := &PutResponse{}
+	r.Put(&PutRequest{RequestHeader: header, Key: Key("b"), Value: Value{Bytes: []byte("value")}}, pr)
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	time.Sleep(2 * MaxClockOffset)
+	if ts := resolvedTimestamp(t, r); ts != header.Timestamp-1 {
+		t.Errorf("expected resolved timestamp held below intent at %d; got %d", header.Timestamp, ts)
+	}
+	rr := &InternalResolveIntentResponse{}
+	r.InternalResolveIntent(&InternalResolveIntentRequest{Key: Key("b"), IntentTxID: "txn1"}, rr)
+	if rr.Error != nil {
+		t.Fatal(rr.Error)
+	}
+	if ts := resolvedTimestamp(t, r); ts <= header.Timestamp {
+		t.Errorf("expected resolved timestamp past resolved intent at %d; got %d", header.Timestamp, ts)
+	}
+}
+
+// TestRangeFollowerReads verifies followers serve INCONSISTENT reads
+// and, once the lease holder has closed a resolved timestamp at or
+// beyond their MinTimestamp, BOUNDED reads, redirecting others to the
+// lease holder.
+func TestRangeFollowerReads(t *testing.T) {
+	ranges, _, stop := startTestReplicatedRanges(t, 3, defaultRaftMaxLogEntries)
+	defer stop()
+	leader := waitForLeader(t, ranges)
+	var follower *Range
+	for _, rng := range ranges {
+		if rng != leader {
+			follower = rng
+		}
+	}
+	put := &PutRequest{Key: Key("a"), Value: Value{Bytes: []byte("value")}}
+	if err := <-leader.ReadWriteCmd("Put", put, &PutResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.ReadOnlyCmd("Get", &GetRequest{Key: Key("a")}, &GetResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForValue(t, follower, Key("a"), "value")
+	written := time.Now().UnixNano()
+
+	bounded := &GetRequest{RequestHeader: RequestHeader{ReadConsistency: BOUNDED, MinTimestamp: written}, Key: Key("a")}
+	if err := follower.ReadOnlyCmd("Get", bounded, &GetResponse{}); err == nil {
+		t.Error("expected bounded read beyond follower's resolved timestamp to redirect")
+	}
+	inconsistent := &GetRequest{RequestHeader: RequestHeader{ReadConsistency: INCONSISTENT}, Key: Key("a")}
+	if err := follower.ReadOnlyCmd("Get", inconsistent, &GetResponse{}); err != nil {
+		t.Errorf("expected follower to serve inconsistent read; got %v", err)
+	}
+
+	time.Sleep(2 * MaxClockOffset)
+	closed, err := leader.CloseTimestamp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if closed < written {
+		t.Fatalf("expected closed timestamp at or beyond %d; got %d", written, closed)
+	}
+	if err := util.IsTrueWithin(func() bool { return follower.servesFollowerRead(&bounded.RequestHeader) }, 1*time.Second); err != nil {
+		t.Fatal("expected closed timestamp to be replicated")
+	}
+	reply := &GetResponse{}
+	if err := follower.ReadOnlyCmd("Get", bounded, reply); err != nil || reply.Error != nil {
+		t.Fatalf("expected follower to serve bounded read; got %v, %v", err, reply.Error)
+	}
+	if string(reply.Value.Bytes) != "value" {
+		t.Errorf("expected bounded read to see %q; got %q", "value", reply.Value.Bytes)
+	}
+	// A write following the closed timestamp is moved past it.
+	late := &PutRequest{RequestHeader: RequestHeader{Timestamp: closed}, Key: Key("b"), Value: Value{Bytes: []byte("value")}}
+	if err := <-leader.ReadWriteCmd("Put", late, &PutResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if late.Timestamp <= closed {
+		t.Errorf("expected write moved past closed timestamp %d; got %d", closed, late.Timestamp)
+	}
+}
+
+// TestRangeResolvedTimestampLeaseTransfer verifies the resolved
+// timestamp reported by a replicated range remains closed once its
+// lease moves to another replica.
+func TestRangeResolvedTimestampLeaseTransfer(t *testing.T) {
+	ranges, _, stop := startTestReplicatedRanges(t, 3, defaultRaftMaxLogEntries)
+	defer stop()
+	leader := waitForLeader(t, ranges)
+	var target *Range
+	for _, rng := range ranges {
+		if rng != leader {
+			target = rng
+		}
+	}
+	resolved := resolvedTimestamp(t, leader)
+	target.raftMu.RLock()
+	self := target.self
+	target.raftMu.RUnlock()
+	if _, err := leader.TransferLease(self); err != nil {
+		t.Fatal(err)
+	}
+	if err := util.IsTrueWithin(func() bool { return target.IsLeader() && target.checkLease() == nil }, 1*time.Second); err != nil {
+		t.Fatal("expected lease and leadership to move to target")
+	}
+	late := &PutRequest{RequestHeader: RequestHeader{Timestamp: resolved}, Key: Key("a"), Value: Value{Bytes: []byte("value")}}
+	if err := <-target.ReadWriteCmd("Put", late, &PutResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if late.Timestamp <= resolved {
+		t.Errorf("expected write moved past resolved timestamp %d; got %d", resolved, late.Timestamp)
+	}
+}
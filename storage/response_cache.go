@@ -0,0 +1,166 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// responseCacheTTL is the age, by client command ID wall time, beyond
+// which persisted replies are pruned by garbage collection. Clients
+// retrying a command for longer may see it executed again.
+const responseCacheTTL = 1 * time.Hour
+
+// keyRangeResponsePrefix is the prefix for store-local keys holding
+// the replies to read/write commands executed by each range, by
+// client command ID. The value is a struct of type cachedResponse.
+// Like the lease, replies are replicated, as they're written on
+// executing raft commands, and included in snapshots of the range's
+// data, so that a command retried after the range's leader changes
+// is answered with its original reply rather than executed again.
+var keyRangeResponsePrefix = Key("\x00\x00\x00respcache-")
+
+// rangeResponsePrefix creates the prefix of a range's response cache
+// keys as the concatenation of the keyRangeResponsePrefix and
+// hexadecimal-formatted range ID, terminated so that no range's
+// prefix is a prefix of another's.
+func rangeResponsePrefix(rangeID int64) Key {
+	return MakeKey(keyRangeResponsePrefix, Key(strconv.FormatInt(rangeID, 16)+"-"))
+}
+
+// rangeResponseKey creates the response cache key of cmdID, ordered
+// by the command ID's wall time.
+func rangeResponseKey(rangeID int64, cmdID ClientCmdID) Key {
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(cmdID.WallTime))
+	binary.BigEndian.PutUint64(buf[8:], uint64(cmdID.Random))
+	return MakeKey(rangeResponsePrefix(rangeID), Key(buf[:]))
+}
+
+// A cachedResponse is a reply to a read/write command, as persisted.
+type cachedResponse struct {
+	Reply interface{}
+}
+
+// cachedReply returns the reply to the command with cmdID, if the
+// range executed it recently: from memory or, as after a restart or
+// once the reply has been evicted from memory, from the engine.
+func (r *Range) cachedReply(cmdID ClientCmdID) (interface{}, bool) {
+	if cached, ok := r.respCache.Get(cmdID); ok {
+		return cached, true
+	}
+	var cr cachedResponse
+	ok, _, err := getI(r.engine, rangeResponseKey(r.Metadata().RangeID, cmdID), &cr)
+	if err != nil {
+		glog.Errorf("range %d: unable to read cached reply: %v", r.Metadata().RangeID, err)
+		return nil, false
+	}
+	if !ok || cr.Reply == nil {
+		return nil, false
+	}
+	r.respCache.Add(cmdID, cr.Reply)
+	return cr.Reply, true
+}
+
+// cacheReply records reply as the reply to the command with cmdID,
+// writing it via b, which holds the command's own writes, so that the
+// reply is persisted atomically with them; once committed, the reply
+// is also cached in memory. Errors which can't be serialized are
+// persisted as GenericErrors. Requires applyMu.
+func (r *Range) cacheReply(b *Batch, cmdID ClientCmdID, reply interface{}) {
+	key := rangeResponseKey(r.Metadata().RangeID, cmdID)
+	err := putI(b, key, &cachedResponse{Reply: reply})
+	if replyErr := replyError(reply); err != nil && replyErr != nil {
+		generic := reflect.New(reflect.TypeOf(reply).Elem())
+		generic.Elem().Set(reflect.ValueOf(reply).Elem())
+		generic.Elem().FieldByName("Error").Set(reflect.ValueOf(NewGenericError(replyErr)))
+		err = putI(b, key, &cachedResponse{Reply: generic.Interface()})
+	}
+	if err != nil {
+		glog.Errorf("range %d: unable to persist reply: %v", r.Metadata().RangeID, err)
+	}
+	r.afterCommit(func() { r.respCache.Add(cmdID, reply) })
+}
+
+// responseCacheRows returns the replies persisted by the range with
+// the specified ID, for inclusion in snapshots of the range's data.
+func responseCacheRows(engine Engine, rangeID int64) ([]KeyValue, error) {
+	prefix := rangeResponsePrefix(rangeID)
+	return engine.scan(prefix, PrefixEndKey(prefix), 0)
+}
+
+// clearResponseCache deletes, via b, the replies persisted by the
+// range with the specified ID.
+func clearResponseCache(b *Batch, engine Engine, rangeID int64) error {
+	rows, err := responseCacheRows(engine, rangeID)
+	if err != nil {
+		return err
+	}
+	for _, kv := range rows {
+		if err := b.del(kv.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyResponseCache copies, via b, the replies persisted by the range
+// with ID fromID to the range with ID toID, as when a range splits or
+// merges, so that commands retried against either range are answered
+// with their original replies.
+func copyResponseCache(b *Batch, engine Engine, fromID, toID int64) error {
+	rows, err := responseCacheRows(engine, fromID)
+	if err != nil {
+		return err
+	}
+	fromPrefix, toPrefix := rangeResponsePrefix(fromID), rangeResponsePrefix(toID)
+	for _, kv := range rows {
+		key := MakeKey(toPrefix, bytes.TrimPrefix(kv.Key, fromPrefix))
+		if err := b.put(key, kv.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneResponseCache deletes the range's persisted replies to
+// commands whose IDs' wall times are more than responseCacheTTL before
+// now, returning the number deleted.
+func (r *Range) pruneResponseCache(now int64) (int64, error) {
+	rangeID := r.Metadata().RangeID
+	prefix := rangeResponsePrefix(rangeID)
+	end := rangeResponseKey(rangeID, ClientCmdID{WallTime: now - int64(responseCacheTTL)})
+	rows, err := r.engine.scan(prefix, end, 0)
+	if err != nil {
+		return 0, err
+	}
+	b := NewBatch(r.engine)
+	for _, kv := range rows {
+		if err := b.del(kv.Key); err != nil {
+			return 0, err
+		}
+	}
+	if err := b.Commit(); err != nil {
+		return 0, err
+	}
+	return int64(len(rows)), nil
+}
@@ -0,0 +1,143 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestRangeResponseCachePersisted verifies replies, including errors,
+// are replayed by a replica restarted on the same engine, as after a
+// leader change, until garbage collection prunes them.
+func TestRangeResponseCachePersisted(t *testing.T) {
+	engine := createTestEngine(t)
+	r, _ := createTestRange(engine, t)
+	now := time.Now().UnixNano()
+	incID, errID := ClientCmdID{WallTime: now, Random: 1}, ClientCmdID{WallTime: now, Random: 2}
+	increment := func(r *Range, cmdID ClientCmdID, key Key) (int64, error) {
+		args := &IncrementRequest{RequestHeader: RequestHeader{CmdID: cmdID}, Key: key, Increment: 1}
+		reply := &IncrementResponse{}
+		err := <-r.ReadWriteCmd("Increment", args, reply)
+		return reply.NewValue, err
+	}
+	if v, err := increment(r, incID, Key("a")); err != nil || v != 1 {
+		t.Fatalf("expected value 1; got %d, %v", v, err)
+	}
+	pr := &PutResponse{}
+	r.Put(&PutRequest{Key: Key("b"), Value: Value{Bytes: []byte{0xff}}}, pr)
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	if _, err := increment(r, errID, Key("b")); err == nil {
+		t.Fatal("expected error incrementing non-integer value")
+	}
+	r.Stop()
+
+	r, _ = createTestRange(engine, t)
+	defer r.Stop()
+	if v, err := increment(r, incID, Key("a")); err != nil || v != 1 {
+		t.Errorf("expected replayed value 1; got %d, %v", v, err)
+	}
+	// Once the value is deleted, only a replayed reply can fail.
+	dr := &DeleteResponse{}
+	if r.Delete(&DeleteRequest{Key: Key("b")}, dr); dr.Error != nil {
+		t.Fatal(dr.Error)
+	}
+	if _, err := increment(r, errID, Key("b")); err == nil {
+		t.Error("expected replayed error")
+	}
+
+	gc, err := r.GarbageCollect(now + int64(2*responseCacheTTL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gc.ResponsesPruned != 2 {
+		t.Errorf("expected 2 replies pruned; got %d", gc.ResponsesPruned)
+	}
+	r.respCache.Remove(incID)
+	if v, err := increment(r, incID, Key("a")); err != nil || v != 2 {
+		t.Errorf("expected pruned command to execute again; got %d, %v", v, err)
+	}
+}
+
+// TestCopyResponseCache verifies replies are copied between ranges
+// and cleared without affecting other ranges' replies.
+func TestCopyResponseCache(t *testing.T) {
+	engine := NewInMem(1 << 20)
+	for _, rangeID := range []int64{1, 0x10} {
+		if err := putI(engine, rangeResponseKey(rangeID, ClientCmdID{WallTime: 1, Random: rangeID}), &cachedResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := NewBatch(engine)
+	if err := copyResponseCache(b, engine, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := clearResponseCache(b, engine, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for rangeID, expCount := range map[int64]int{1: 0, 2: 1, 0x10: 1} {
+		rows, err := responseCacheRows(engine, rangeID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != expCount {
+			t.Errorf("range %d: expected %d replies; got %d", rangeID, expCount, len(rows))
+		}
+	}
+	if ok, _, err := getI(engine, rangeResponseKey(2, ClientCmdID{WallTime: 1, Random: 1}), nil); !ok || err != nil {
+		t.Errorf("expected copied reply; got %t, %v", ok, err)
+	}
+}
+
+// TestRangeReplyWrittenWithCommand verifies a command's reply is
+// persisted atomically with the command's writes, so that a command
+// whose reply can't be persisted leaves no writes behind and is
+// executed exactly once on retry.
+func TestRangeReplyWrittenWithCommand(t *testing.T) {
+	engine := &prefixFailingEngine{Engine: createTestEngine(t), prefix: keyRangeResponsePrefix}
+	r, _ := createTestRange(engine, t)
+	defer r.Stop()
+	cmdID := ClientCmdID{WallTime: time.Now().UnixNano(), Random: 1}
+	increment := func() (int64, error) {
+		args := &IncrementRequest{RequestHeader: RequestHeader{CmdID: cmdID}, Key: Key("a"), Increment: 1}
+		reply := &IncrementResponse{}
+		err := <-r.ReadWriteCmd("Increment", args, reply)
+		return reply.NewValue, err
+	}
+	atomic.StoreInt32(&engine.failing, 1)
+	if _, err := increment(); err == nil {
+		t.Fatal("expected increment to fail with its reply")
+	}
+	if value, err := engine.get(Key("a")); err != nil || value.Bytes != nil {
+		t.Errorf("expected value not written; got %q, %v", value.Bytes, err)
+	}
+	atomic.StoreInt32(&engine.failing, 0)
+	for i := 0; i < 2; i++ {
+		if v, err := increment(); err != nil || v != 1 {
+			t.Errorf("attempt %d: expected value 1; got %d, %v", i, v, err)
+		}
+	}
+	r.respCache.Remove(cmdID)
+	if v, err := increment(); err != nil || v != 1 {
+		t.Errorf("expected persisted reply 1; got %d, %v", v, err)
+	}
+}
@@ -26,9 +26,10 @@ package storage
 import "C"
 
 import (
-	"bytes"
-	"flag"
+	"bufio"
 	"fmt"
+	"strconv"
+	"strings"
 	"syscall"
 	"unsafe"
 
@@ -36,28 +37,52 @@ import (
 	"github.com/golang/glog"
 )
 
-// defaultCacheSize is the default value for the cacheSize command line flag.
-const defaultCacheSize = 1 << 30 // GB
+// RocksDBOptions configures a RocksDB engine.
+type RocksDBOptions struct {
+	// CacheSize is the size in bytes of the block cache, which holds
+	// uncompressed data blocks read from disk. Zero uses
+	// defaultBlockCacheSize. It may be adjusted at runtime via
+	// SetBlockCacheSize.
+	CacheSize int64
+	// MaxOpenFiles bounds the table cache, which holds open table
+	// files and their indexes. Zero uses RocksDB's default; -1 keeps
+	// all files open.
+	MaxOpenFiles int
+	// SyncWrites makes each write sync the write-ahead log before it
+	// completes, so that completed writes survive machine as well as
+	// process crashes.
+	SyncWrites bool
+}
 
-// cacheSize is the amount of memory in bytes to use for caching data.
-// The value is split evenly between the stores if there are more than one.
-var cacheSize = flag.Int64("cache_size", defaultCacheSize, "total size in bytes for "+
-	"caches, shared evenly if there are multiple storage devices")
+// defaultBlockCacheSize is the size of the block cache if
+// RocksDBOptions.CacheSize is zero. It matches RocksDB's default.
+const defaultBlockCacheSize = 8 << 20
 
-// RocksDB is a wrapper around a RocksDB database instance.
+// RocksDB is a wrapper around a RocksDB database instance. Writes are
+// logged to RocksDB's write-ahead log before they're applied, so that
+// completed writes survive crashes of the process.
 type RocksDB struct {
 	rdb   *C.rocksdb_t              // The DB handle
 	opts  *C.rocksdb_options_t      // Options used when creating or destroying
 	rOpts *C.rocksdb_readoptions_t  // The default read options
 	wOpts *C.rocksdb_writeoptions_t // The default write options
+	cache *C.rocksdb_cache_t        // The block cache
 
-	typ DiskType // HDD or SSD
-	dir string   // The data directory
+	typ     DiskType       // HDD or SSD
+	dir     string         // The data directory
+	options RocksDBOptions // Cache and durability options
 }
 
-// NewRocksDB allocates and returns a new RocksDB object.
+// NewRocksDB allocates and returns a new RocksDB object with default
+// options.
 func NewRocksDB(typ DiskType, dir string) (*RocksDB, error) {
-	r := &RocksDB{typ: typ, dir: dir}
+	return NewRocksDBWithOptions(typ, dir, RocksDBOptions{})
+}
+
+// NewRocksDBWithOptions allocates and returns a new RocksDB object
+// configured by options.
+func NewRocksDBWithOptions(typ DiskType, dir string, options RocksDBOptions) (*RocksDB, error) {
+	r := &RocksDB{typ: typ, dir: dir, options: options}
 	r.createOptions()
 
 	cDir := C.CString(dir)
@@ -97,11 +122,24 @@ func (r *RocksDB) destroy() error {
 // from the db. destroyOptions should be called when the options aren't needed
 // anymore.
 func (r *RocksDB) createOptions() {
-	// TODO(andybons): Set the cache size.
 	r.opts = C.rocksdb_options_create()
 	C.rocksdb_options_set_create_if_missing(r.opts, 1)
+	cacheSize := r.options.CacheSize
+	if cacheSize == 0 {
+		cacheSize = defaultBlockCacheSize
+	}
+	r.cache = C.rocksdb_cache_create_lru(C.size_t(cacheSize))
+	C.rocksdb_options_set_cache(r.opts, r.cache)
+	if r.options.MaxOpenFiles != 0 {
+		C.rocksdb_options_set_max_open_files(r.opts, C.int(r.options.MaxOpenFiles))
+	}
+	// Statistics provide the block cache's hit and miss counts.
+	C.rocksdb_options_enable_statistics(r.opts)
 
 	r.wOpts = C.rocksdb_writeoptions_create()
+	if r.options.SyncWrites {
+		C.rocksdb_writeoptions_set_sync(r.wOpts, 1)
+	}
 	r.rOpts = C.rocksdb_readoptions_create()
 }
 
@@ -111,9 +149,11 @@ func (r *RocksDB) destroyOptions() {
 	C.rocksdb_options_destroy(r.opts)
 	C.rocksdb_readoptions_destroy(r.rOpts)
 	C.rocksdb_writeoptions_destroy(r.wOpts)
+	C.rocksdb_cache_destroy(r.cache)
 	r.opts = nil
 	r.rOpts = nil
 	r.wOpts = nil
+	r.cache = nil
 }
 
 // String formatter.
@@ -127,6 +167,73 @@ func (r *RocksDB) Type() DiskType {
 	return r.typ
 }
 
+// SetBlockCacheSize sets the size in bytes of the block cache,
+// evicting blocks as necessary to shrink it.
+func (r *RocksDB) SetBlockCacheSize(bytes int64) error {
+	if bytes <= 0 {
+		return util.Errorf("invalid block cache size %d", bytes)
+	}
+	C.rocksdb_cache_set_capacity(r.cache, C.size_t(bytes))
+	return nil
+}
+
+// CompactRange compacts the storage of the rows in [start, end),
+// rewriting the table files holding them without deleted and
+// overwritten rows. An empty start or end leaves that side of the
+// span unbounded.
+func (r *RocksDB) CompactRange(start, end Key) error {
+	var cStart, cEnd *C.char
+	if len(start) > 0 {
+		cStart = (*C.char)(unsafe.Pointer(&start[0]))
+	}
+	if len(end) > 0 {
+		cEnd = (*C.char)(unsafe.Pointer(&end[0]))
+	}
+	C.rocksdb_compact_range(r.rdb, cStart, C.size_t(len(start)), cEnd, C.size_t(len(end)))
+	return nil
+}
+
+// BlockCacheStats returns the size, usage and hit and miss counts of
+// the block cache.
+func (r *RocksDB) BlockCacheStats() (CacheStats, error) {
+	stats := CacheStats{
+		Capacity: int64(C.rocksdb_cache_get_capacity(r.cache)),
+		Bytes:    int64(C.rocksdb_cache_get_usage(r.cache)),
+	}
+	cStats := C.rocksdb_options_statistics_get_string(r.opts)
+	if cStats == nil {
+		return stats, nil
+	}
+	tickers := C.GoString(cStats)
+	C.free(unsafe.Pointer(cStats))
+	var err error
+	if stats.Hits, err = statisticsTicker(tickers, "rocksdb.block.cache.hit"); err != nil {
+		return CacheStats{}, err
+	}
+	if stats.Misses, err = statisticsTicker(tickers, "rocksdb.block.cache.miss"); err != nil {
+		return CacheStats{}, err
+	}
+	return stats, nil
+}
+
+// statisticsTicker returns the count of the named ticker from RocksDB
+// statistics formatted as lines of "<name> COUNT : <count>", or zero
+// if the ticker isn't present.
+func statisticsTicker(tickers, name string) (int64, error) {
+	scanner := bufio.NewScanner(strings.NewReader(tickers))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 4 && fields[0] == name && fields[1] == "COUNT" {
+			count, err := strconv.ParseInt(fields[3], 10, 64)
+			if err != nil {
+				return 0, util.Errorf("invalid count for statistic %s: %s", name, err)
+			}
+			return count, nil
+		}
+	}
+	return 0, scanner.Err()
+}
+
 // charToErr converts a *C.char to an error, freeing the given
 // C string in the process.
 func charToErr(c *C.char) error {
@@ -139,7 +246,8 @@ func emptyKeyError() error {
 	return util.ErrorSkipFrames(1, "attempted access to empty key")
 }
 
-// put sets the given key to the value provided.
+// put sets the given key to the value provided. The value is stored
+// with its timestamp and expiration; see encodeEngineValue.
 //
 // The key and value byte slices may be reused safely. put takes a copy of
 // them before returning.
@@ -147,6 +255,7 @@ func (r *RocksDB) put(key Key, value Value) error {
 	if len(key) == 0 {
 		return emptyKeyError()
 	}
+	encoded := encodeEngineValue(value)
 	// rocksdb_put, _get, and _delete call memcpy() (by way of MemTable::Add)
 	// when called, so we do not need to worry about these byte slices being
 	// reclaimed by the GC.
@@ -156,8 +265,8 @@ func (r *RocksDB) put(key Key, value Value) error {
 		r.wOpts,
 		(*C.char)(unsafe.Pointer(&key[0])),
 		C.size_t(len(key)),
-		(*C.char)(unsafe.Pointer(&value.Bytes[0])),
-		C.size_t(len(value.Bytes)),
+		(*C.char)(unsafe.Pointer(&encoded[0])),
+		C.size_t(len(encoded)),
 		&cErr)
 
 	if cErr != nil {
@@ -168,6 +277,12 @@ func (r *RocksDB) put(key Key, value Value) error {
 
 // get returns the value for the given key.
 func (r *RocksDB) get(key Key) (Value, error) {
+	return rocksDBGet(r.rdb, r.rOpts, key)
+}
+
+// rocksDBGet returns the value for the given key read from rdb with
+// the read options opts.
+func rocksDBGet(rdb *C.rocksdb_t, opts *C.rocksdb_readoptions_t, key Key) (Value, error) {
 	if len(key) == 0 {
 		return Value{}, emptyKeyError()
 	}
@@ -176,8 +291,8 @@ func (r *RocksDB) get(key Key) (Value, error) {
 		cErr    *C.char
 	)
 	cVal := C.rocksdb_get(
-		r.rdb,
-		r.rOpts,
+		rdb,
+		opts,
 		(*C.char)(unsafe.Pointer(&key[0])),
 		C.size_t(len(key)),
 		&cValLen,
@@ -190,7 +305,7 @@ func (r *RocksDB) get(key Key) (Value, error) {
 		return Value{}, nil
 	}
 	defer C.free(unsafe.Pointer(cVal))
-	return Value{Bytes: C.GoBytes(unsafe.Pointer(cVal), C.int(cValLen))}, nil
+	return decodeEngineValue(C.GoBytes(unsafe.Pointer(cVal), C.int(cValLen)))
 }
 
 // del removes the item from the db with the given key.
@@ -213,56 +328,56 @@ func (r *RocksDB) del(key Key) error {
 }
 
 // scan returns up to max key/value objects starting from
-// start (inclusive) and ending at end (non-inclusive).
-// If max is zero then the number of key/values returned is unbounded.
+// start (inclusive) and ending at end (non-inclusive), or the last key
+// if end is empty. If max is zero then the number of key/values
+// returned is unbounded.
 func (r *RocksDB) scan(start, end Key, max int64) ([]KeyValue, error) {
-	// In order to prevent content displacement, caching is disabled
-	// when performing scans. Any options set within the shared read
-	// options field that should be carried over needs to be set here
-	// as well.
-	opts := C.rocksdb_readoptions_create()
-	C.rocksdb_readoptions_set_fill_cache(opts, 0)
-	defer C.rocksdb_readoptions_destroy(opts)
-	it := C.rocksdb_create_iterator(r.rdb, opts)
-	defer C.rocksdb_iter_destroy(it)
-
-	keyVals := []KeyValue{}
-	byteCount := len(start)
-	if byteCount == 0 {
-		// start=Key("") needs special treatment since we need
-		// to access start[0] in an explicit seek.
-		C.rocksdb_iter_seek_to_first(it)
-	} else {
-		C.rocksdb_iter_seek(it, (*C.char)(unsafe.Pointer(&start[0])), C.size_t(byteCount))
-	}
-	for i := int64(1); C.rocksdb_iter_valid(it) == 1; C.rocksdb_iter_next(it) {
-		if max > 0 && i > max {
-			break
+	it := newRocksDBIterator(r.rdb, nil)
+	defer it.close()
+	return iterScan(it, start, end, max)
+}
+
+// reverseScan returns up to max key/value objects in the span from
+// start (inclusive) to end (non-inclusive), or the last key if end is
+// empty, in descending key order.
+func (r *RocksDB) reverseScan(start, end Key, max int64) ([]KeyValue, error) {
+	it := newRocksDBIterator(r.rdb, nil)
+	defer it.close()
+	return iterReverseScan(it, start, end, max)
+}
+
+// writeBatch applies writes atomically via a RocksDB write batch,
+// which is logged to the write-ahead log as a unit.
+func (r *RocksDB) writeBatch(writes []engineWrite) error {
+	batch := C.rocksdb_writebatch_create()
+	defer C.rocksdb_writebatch_destroy(batch)
+	// rocksdb_writebatch_put and _delete copy the key and value into
+	// the batch.
+	for _, w := range writes {
+		if len(w.key) == 0 {
+			return emptyKeyError()
 		}
-		var l C.size_t
-		// The data returned by rocksdb_iter_{key,value} is not meant to be
-		// freed by the client. It is a direct reference to the data managed
-		// by the iterator, so it is copied instead of freed.
-		data := C.rocksdb_iter_key(it, &l)
-		k := C.GoBytes(unsafe.Pointer(data), C.int(l))
-		if bytes.Equal(k, end) {
-			break
+		if w.del {
+			C.rocksdb_writebatch_delete(
+				batch,
+				(*C.char)(unsafe.Pointer(&w.key[0])),
+				C.size_t(len(w.key)))
+			continue
 		}
-		data = C.rocksdb_iter_value(it, &l)
-		v := C.GoBytes(unsafe.Pointer(data), C.int(l))
-		keyVals = append(keyVals, KeyValue{
-			Key:   k,
-			Value: Value{Bytes: v},
-		})
-		i++
+		encoded := encodeEngineValue(w.value)
+		C.rocksdb_writebatch_put(
+			batch,
+			(*C.char)(unsafe.Pointer(&w.key[0])),
+			C.size_t(len(w.key)),
+			(*C.char)(unsafe.Pointer(&encoded[0])),
+			C.size_t(len(encoded)))
 	}
-	// Check for any errors during iteration.
 	var cErr *C.char
-	C.rocksdb_iter_get_error(it, &cErr)
+	C.rocksdb_write(r.rdb, r.wOpts, batch, &cErr)
 	if cErr != nil {
-		return nil, charToErr(cErr)
+		return charToErr(cErr)
 	}
-	return keyVals, nil
+	return nil
 }
 
 // capacity queries the underlying file system for disk capacity
@@ -280,6 +395,171 @@ func (r *RocksDB) capacity() (StoreCapacity, error) {
 	return capacity, nil
 }
 
+// newSnapshot returns a read-only view of the database as of now.
+// Rows the snapshot sees are retained by compactions until it's
+// closed.
+func (r *RocksDB) newSnapshot() Snapshot {
+	snap := &rocksDBSnapshot{
+		parent: r,
+		snap:   C.rocksdb_create_snapshot(r.rdb),
+		rOpts:  C.rocksdb_readoptions_create(),
+	}
+	C.rocksdb_readoptions_set_snapshot(snap.rOpts, snap.snap)
+	return snap
+}
+
+// newIterator returns an iterator over the database's rows.
+func (r *RocksDB) newIterator() Iterator {
+	return newRocksDBIterator(r.rdb, nil)
+}
+
+// A rocksDBSnapshot is a Snapshot of a RocksDB database.
+type rocksDBSnapshot struct {
+	parent *RocksDB
+	snap   *C.rocksdb_snapshot_t    // The snapshot handle
+	rOpts  *C.rocksdb_readoptions_t // Read options reading at the snapshot
+}
+
+// Type returns the database's disk type.
+func (s *rocksDBSnapshot) Type() DiskType {
+	return s.parent.Type()
+}
+
+// get returns the value for the given key as of the snapshot.
+func (s *rocksDBSnapshot) get(key Key) (Value, error) {
+	return rocksDBGet(s.parent.rdb, s.rOpts, key)
+}
+
+// scan returns up to max key/value objects starting from start
+// (inclusive) and ending at end (non-inclusive) as of the snapshot.
+func (s *rocksDBSnapshot) scan(start, end Key, max int64) ([]KeyValue, error) {
+	it := newRocksDBIterator(s.parent.rdb, s.snap)
+	defer it.close()
+	return iterScan(it, start, end, max)
+}
+
+// reverseScan is like scan, but returns key/value objects in
+// descending key order.
+func (s *rocksDBSnapshot) reverseScan(start, end Key, max int64) ([]KeyValue, error) {
+	it := newRocksDBIterator(s.parent.rdb, s.snap)
+	defer it.close()
+	return iterReverseScan(it, start, end, max)
+}
+
+// put fails, as snapshots are read-only.
+func (s *rocksDBSnapshot) put(key Key, value Value) error {
+	return readOnlyError()
+}
+
+// del fails, as snapshots are read-only.
+func (s *rocksDBSnapshot) del(key Key) error {
+	return readOnlyError()
+}
+
+// writeBatch fails, as snapshots are read-only.
+func (s *rocksDBSnapshot) writeBatch(writes []engineWrite) error {
+	return readOnlyError()
+}
+
+// capacity returns the database's current capacity.
+func (s *rocksDBSnapshot) capacity() (StoreCapacity, error) {
+	return s.parent.capacity()
+}
+
+// newSnapshot returns a snapshot sharing this snapshot's view.
+func (s *rocksDBSnapshot) newSnapshot() Snapshot {
+	return nestedSnapshot{s}
+}
+
+// newIterator returns an iterator over the rows as of the snapshot.
+func (s *rocksDBSnapshot) newIterator() Iterator {
+	return newRocksDBIterator(s.parent.rdb, s.snap)
+}
+
+// close releases the snapshot.
+func (s *rocksDBSnapshot) close() {
+	C.rocksdb_readoptions_destroy(s.rOpts)
+	C.rocksdb_release_snapshot(s.parent.rdb, s.snap)
+}
+
+// A rocksDBIterator is an Iterator over the rows of a RocksDB
+// database, or of a snapshot of it.
+type rocksDBIterator struct {
+	opts *C.rocksdb_readoptions_t
+	iter *C.rocksdb_iterator_t
+}
+
+// newRocksDBIterator returns an iterator over the rows of rdb as of
+// snap, or the latest rows if snap is nil.
+func newRocksDBIterator(rdb *C.rocksdb_t, snap *C.rocksdb_snapshot_t) *rocksDBIterator {
+	// In order to prevent content displacement, caching is disabled
+	// when iterating. Any options set within the shared read options
+	// field that should be carried over needs to be set here as well.
+	opts := C.rocksdb_readoptions_create()
+	C.rocksdb_readoptions_set_fill_cache(opts, 0)
+	if snap != nil {
+		C.rocksdb_readoptions_set_snapshot(opts, snap)
+	}
+	return &rocksDBIterator{opts: opts, iter: C.rocksdb_create_iterator(rdb, opts)}
+}
+
+func (it *rocksDBIterator) seek(key Key) {
+	if len(key) == 0 {
+		// Key("") needs special treatment since we need to access
+		// key[0] in an explicit seek.
+		C.rocksdb_iter_seek_to_first(it.iter)
+		return
+	}
+	C.rocksdb_iter_seek(it.iter, (*C.char)(unsafe.Pointer(&key[0])), C.size_t(len(key)))
+}
+
+func (it *rocksDBIterator) seekToLast() {
+	C.rocksdb_iter_seek_to_last(it.iter)
+}
+
+func (it *rocksDBIterator) valid() bool {
+	return C.rocksdb_iter_valid(it.iter) == 1
+}
+
+func (it *rocksDBIterator) next() {
+	C.rocksdb_iter_next(it.iter)
+}
+
+func (it *rocksDBIterator) prev() {
+	C.rocksdb_iter_prev(it.iter)
+}
+
+// key returns a copy of the current row's key. The data returned by
+// rocksdb_iter_{key,value} is not meant to be freed by the client. It
+// is a direct reference to the data managed by the iterator, so it is
+// copied instead of freed.
+func (it *rocksDBIterator) key() Key {
+	var l C.size_t
+	data := C.rocksdb_iter_key(it.iter, &l)
+	return C.GoBytes(unsafe.Pointer(data), C.int(l))
+}
+
+// value returns a copy of the current row's value.
+func (it *rocksDBIterator) value() (Value, error) {
+	var l C.size_t
+	data := C.rocksdb_iter_value(it.iter, &l)
+	return decodeEngineValue(C.GoBytes(unsafe.Pointer(data), C.int(l)))
+}
+
+func (it *rocksDBIterator) err() error {
+	var cErr *C.char
+	C.rocksdb_iter_get_error(it.iter, &cErr)
+	if cErr != nil {
+		return charToErr(cErr)
+	}
+	return nil
+}
+
+func (it *rocksDBIterator) close() {
+	C.rocksdb_iter_destroy(it.iter)
+	C.rocksdb_readoptions_destroy(it.opts)
+}
+
 // close closes the database by deallocating the underlying handle.
 func (r *RocksDB) close() {
 	C.rocksdb_close(r.rdb)
@@ -157,3 +157,180 @@ func ensureRangeEqual(t *testing.T, sortedKeys []string, keyMap map[string][]byt
 		}
 	}
 }
+
+// TestRocksDBValueEncoding verifies values are stored with their
+// timestamps, expirations and dictionary versions.
+func TestRocksDBValueEncoding(t *testing.T) {
+	for i, value := range []Value{
+		{},
+		{Bytes: []byte("v")},
+		{Bytes: []byte("v"), Timestamp: 1 << 62, Expiration: 1<<62 + 1, DictVersion: 3},
+		{Timestamp: -1},
+	} {
+		decoded, err := decodeEngineValue(encodeEngineValue(value))
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if !bytes.Equal(decoded.Bytes, value.Bytes) || decoded.Timestamp != value.Timestamp ||
+			decoded.Expiration != value.Expiration || decoded.DictVersion != value.DictVersion {
+			t.Errorf("%d: expected %+v; got %+v", i, value, decoded)
+		}
+	}
+	if _, err := decodeEngineValue([]byte{0x80}); err == nil {
+		t.Error("expected error decoding corrupt value")
+	}
+}
+
+// TestRocksDBWriteBatch verifies a batch applies its puts and
+// deletions in order, and that values survive reopening the engine.
+func TestRocksDBWriteBatch(t *testing.T) {
+	loc := fmt.Sprintf("%s/data_%d", os.TempDir(), time.Now().UnixNano())
+	engine, err := NewRocksDBWithOptions(SSD, loc, RocksDBOptions{CacheSize: 1 << 20, SyncWrites: true})
+	if err != nil {
+		t.Fatalf("could not create new rocksdb db instance at %s: %v", loc, err)
+	}
+	if err := engine.put(Key("a"), Value{Bytes: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.writeBatch([]engineWrite{
+		{key: Key("a"), del: true},
+		{key: Key("b"), value: Value{Bytes: []byte("2"), Timestamp: 10}},
+		{key: Key("c"), value: Value{Bytes: []byte("3")}},
+		{key: Key("c"), del: true},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.writeBatch([]engineWrite{{key: Key("d")}, {key: nil}}); err == nil {
+		t.Error("expected batch with empty key to fail")
+	}
+	engine.close()
+	engine.destroyOptions()
+
+	engine, err = NewRocksDB(SSD, loc)
+	if err != nil {
+		t.Fatalf("could not reopen rocksdb db instance at %s: %v", loc, err)
+	}
+	defer func(t *testing.T) {
+		engine.close()
+		if err := engine.destroy(); err != nil {
+			t.Errorf("could not delete rocksdb db at %s: %v", loc, err)
+		}
+	}(t)
+	kvs, err := engine.scan(KeyMin, KeyMax, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 1 || !bytes.Equal(kvs[0].Key, Key("b")) || kvs[0].Value.Timestamp != 10 {
+		t.Errorf("expected only \"b\" at timestamp 10 after batch; got %+v", kvs)
+	}
+}
+
+// TestRocksDBReverseScan verifies reverse scans return keys in
+// descending order, including the start key and excluding the end key.
+func TestRocksDBReverseScan(t *testing.T) {
+	loc := fmt.Sprintf("%s/data_%d", os.TempDir(), time.Now().UnixNano())
+	engine, err := NewRocksDB(SSD, loc)
+	if err != nil {
+		t.Fatalf("could not create new rocksdb db instance at %s: %v", loc, err)
+	}
+	defer func(t *testing.T) {
+		engine.close()
+		if err := engine.destroy(); err != nil {
+			t.Errorf("could not delete rocksdb db at %s: %v", loc, err)
+		}
+	}(t)
+	for _, key := range []string{"a", "aa", "aaa", "ab", "abc"} {
+		if err := engine.put(Key(key), Value{Bytes: []byte("value")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testCases := []struct {
+		start, end Key
+		max        int64
+		expKeys    []string
+	}{
+		{KeyMin, nil, 0, []string{"abc", "ab", "aaa", "aa", "a"}},
+		{Key("a"), Key("abc"), 0, []string{"ab", "aaa", "aa", "a"}},
+		{Key("aa"), Key("ab"), 0, []string{"aaa", "aa"}},
+		{Key("a0"), Key("abcc"), 2, []string{"abc", "ab"}},
+		{Key("ab"), Key("ab"), 0, nil},
+	}
+	for i, test := range testCases {
+		kvs, err := engine.reverseScan(test.start, test.end, test.max)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if len(kvs) != len(test.expKeys) {
+			t.Errorf("%d: expected keys %q; got %v", i, test.expKeys, kvs)
+			continue
+		}
+		for j, kv := range kvs {
+			if string(kv.Key) != test.expKeys[j] {
+				t.Errorf("%d: expected key %q at %d; got %q", i, test.expKeys[j], j, kv.Key)
+			}
+		}
+	}
+}
+
+// TestRocksDBBlockCache verifies the block cache may be resized and
+// reports its statistics.
+func TestRocksDBBlockCache(t *testing.T) {
+	loc := fmt.Sprintf("%s/data_%d", os.TempDir(), time.Now().UnixNano())
+	engine, err := NewRocksDBWithOptions(SSD, loc, RocksDBOptions{CacheSize: 1 << 20, MaxOpenFiles: 100})
+	if err != nil {
+		t.Fatalf("could not create new rocksdb db instance at %s: %v", loc, err)
+	}
+	defer func(t *testing.T) {
+		engine.close()
+		if err := engine.destroy(); err != nil {
+			t.Errorf("could not delete rocksdb db at %s: %v", loc, err)
+		}
+	}(t)
+
+	var bce BlockCachedEngine = engine
+	stats, err := bce.BlockCacheStats()
+	if err != nil || stats.Capacity != 1<<20 {
+		t.Errorf("expected block cache capacity %d; got %+v, %v", 1<<20, stats, err)
+	}
+	if err := bce.SetBlockCacheSize(2 << 20); err != nil {
+		t.Fatal(err)
+	}
+	if stats, err = bce.BlockCacheStats(); err != nil || stats.Capacity != 2<<20 {
+		t.Errorf("expected block cache capacity %d; got %+v, %v", 2<<20, stats, err)
+	}
+	if err := bce.SetBlockCacheSize(0); err == nil {
+		t.Error("expected error disabling block cache")
+	}
+}
+
+// TestStatisticsTicker verifies ticker counts are parsed from RocksDB
+// statistics.
+func TestStatisticsTicker(t *testing.T) {
+	tickers := "rocksdb.block.cache.miss COUNT : 12\nrocksdb.block.cache.hit COUNT : 34\n"
+	if count, err := statisticsTicker(tickers, "rocksdb.block.cache.hit"); err != nil || count != 34 {
+		t.Errorf("expected 34 hits; got %d, %v", count, err)
+	}
+	if count, err := statisticsTicker(tickers, "rocksdb.bytes.read"); err != nil || count != 0 {
+		t.Errorf("expected missing ticker to count 0; got %d, %v", count, err)
+	}
+	if _, err := statisticsTicker("rocksdb.block.cache.hit COUNT : x", "rocksdb.block.cache.hit"); err == nil {
+		t.Error("expected error parsing invalid count")
+	}
+}
+
+// TestRocksDBSnapshot verifies snapshots and iterators of a RocksDB
+// engine.
+func TestRocksDBSnapshot(t *testing.T) {
+	loc := fmt.Sprintf("%s/data_%d", os.TempDir(), time.Now().UnixNano())
+	engine, err := NewRocksDB(SSD, loc)
+	if err != nil {
+		t.Fatalf("could not create new rocksdb db instance at %s: %v", loc, err)
+	}
+	defer func(t *testing.T) {
+		engine.close()
+		if err := engine.destroy(); err != nil {
+			t.Errorf("could not delete rocksdb db at %s: %v", loc, err)
+		}
+	}(t)
+	verifyEngineSnapshot(t, engine)
+}
@@ -0,0 +1,125 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"hash/fnv"
+	"math"
+)
+
+// hllPrecision is the number of hash bits which select a register of
+// a HyperLogLog sketch. With 2^12 registers, estimates have a
+// standard error of about 1.6%.
+const hllPrecision = 12
+
+// hllRegisters is the number of registers in a HyperLogLog sketch.
+const hllRegisters = 1 << hllPrecision
+
+// keyPrefixDelimiter ends the prefix of a key for the purposes of
+// estimating distinct prefixes; see keyPrefix.
+const keyPrefixDelimiter = '/'
+
+// A hyperLogLog estimates the number of distinct byte strings added
+// to it in constant space. Strings can't be removed.
+type hyperLogLog struct {
+	registers [hllRegisters]uint8
+}
+
+// hash64 returns a 64-bit hash of b, with the output of FNV-1a mixed
+// so that its bits are uniformly distributed, as HyperLogLog requires.
+func hash64(b []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(b)
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// add adds b to the sketch.
+func (hll *hyperLogLog) add(b []byte) {
+	x := hash64(b)
+	idx := x >> (64 - hllPrecision)
+	// The rank is the position of the first set bit among the
+	// remaining bits.
+	rank := uint8(1)
+	for w := x << hllPrecision; w&(1<<63) == 0 && rank <= 64-hllPrecision; w <<= 1 {
+		rank++
+	}
+	if rank > hll.registers[idx] {
+		hll.registers[idx] = rank
+	}
+}
+
+// merge adds the strings added to o to the sketch.
+func (hll *hyperLogLog) merge(o *hyperLogLog) {
+	for i, r := range o.registers {
+		if r > hll.registers[i] {
+			hll.registers[i] = r
+		}
+	}
+}
+
+// estimate returns the estimated number of distinct strings added to
+// the sketch. Small cardinalities are estimated by linear counting of
+// empty registers, which is more accurate.
+func (hll *hyperLogLog) estimate() int64 {
+	m := float64(hllRegisters)
+	var sum float64
+	var zeros int
+	for _, r := range hll.registers {
+		sum += math.Pow(2, -float64(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+	return int64(e + 0.5)
+}
+
+// keyPrefix returns the prefix of key up to its first delimiter after
+// the first byte, or all of key if it has none.
+func keyPrefix(key Key) Key {
+	if len(key) > 1 {
+		if i := bytes.IndexByte(key[1:], keyPrefixDelimiter); i >= 0 {
+			return key[:i+1]
+		}
+	}
+	return key
+}
+
+// A keySketch estimates the distinct keys and key prefixes stored in
+// an account of a range. Since keys can't be removed, the estimates
+// count keys written since the sketch was built, including those
+// since deleted, and are rebuilt from the range's data whenever its
+// usage is recomputed.
+type keySketch struct {
+	keys     hyperLogLog
+	prefixes hyperLogLog
+}
+
+// add adds key to the sketch.
+func (ks *keySketch) add(key Key) {
+	ks.keys.add(key)
+	ks.prefixes.add(keyPrefix(key))
+}
@@ -0,0 +1,107 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// withinPercent returns whether estimate is within pct percent of
+// actual, or within one of small actual counts.
+func withinPercent(estimate, actual int64, pct float64) bool {
+	diff := float64(estimate - actual)
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff <= 1 || diff <= float64(actual)*pct/100
+}
+
+// TestHyperLogLog verifies estimates of small and large cardinalities,
+// including of merged sketches, and that repeated strings aren't
+// counted twice.
+func TestHyperLogLog(t *testing.T) {
+	for _, count := range []int64{0, 10, 1000, 100000} {
+		var hll1, hll2 hyperLogLog
+		for i := int64(0); i < count; i++ {
+			key := []byte(fmt.Sprintf("key%d", i))
+			hll1.add(key)
+			hll1.add(key)
+			if i%2 == 0 {
+				hll2.add(key)
+			}
+		}
+		if est := hll1.estimate(); !withinPercent(est, count, 5) {
+			t.Errorf("expected estimate of %d; got %d", count, est)
+		}
+		hll2.merge(&hll1)
+		if est := hll2.estimate(); !withinPercent(est, count, 5) {
+			t.Errorf("expected merged estimate of %d; got %d", count, est)
+		}
+	}
+}
+
+// TestKeyPrefix verifies keys' prefixes end at their first delimiter
+// after the first byte.
+func TestKeyPrefix(t *testing.T) {
+	testCases := []struct {
+		key, expPrefix Key
+	}{
+		{Key("/db1/table/a"), Key("/db1")},
+		{Key("db1/a"), Key("db1")},
+		{Key("a"), Key("a")},
+		{Key("/"), Key("/")},
+		{Key(""), Key("")},
+	}
+	for i, test := range testCases {
+		if prefix := keyPrefix(test.key); !bytes.Equal(prefix, test.expPrefix) {
+			t.Errorf("%d: expected prefix %q of %q; got %q", i, test.expPrefix, test.key, prefix)
+		}
+	}
+}
+
+// TestRangeKeyEstimates verifies distinct keys and prefixes written
+// to a range are estimated in its usage report and rebuilt when its
+// usage is recomputed.
+func TestRangeKeyEstimates(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	for i := 0; i < 2000; i++ {
+		pr := &PutResponse{}
+		r.Put(&PutRequest{Key: Key(fmt.Sprintf("/t%d/k%d", i%50, i)), Value: Value{Bytes: []byte("v")}}, pr)
+		if pr.Error != nil {
+			t.Fatal(pr.Error)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		dr := &DeleteResponse{}
+		r.Delete(&DeleteRequest{Key: Key(fmt.Sprintf("/t%d/k%d", i%50, i))}, dr)
+		if dr.Error != nil {
+			t.Fatal(dr.Error)
+		}
+	}
+	u := findUsage(r.UsageReport(), AcctDefault)
+	if u == nil || !withinPercent(u.EstKeys, 2000, 5) || !withinPercent(u.EstPrefixes, 50, 5) {
+		t.Fatalf("expected estimates of 2000 keys and 50 prefixes; got %+v", u)
+	}
+	// Recomputing usage forgets the deleted keys.
+	r.resetUsage()
+	u = findUsage(r.UsageReport(), AcctDefault)
+	if u == nil || !withinPercent(u.EstKeys, 1000, 5) || !withinPercent(u.EstPrefixes, 50, 5) {
+		t.Errorf("expected estimates of 1000 keys and 50 prefixes; got %+v", u)
+	}
+}
@@ -0,0 +1,328 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/golang/glog"
+)
+
+// snapshotChunkBytes is the approximate size of the chunks in which
+// followers fetch snapshots from their leader. Var for testing.
+var snapshotChunkBytes int64 = 256 << 10
+
+// A throttle paces the transfer of bytes to a rate shared by all of
+// its callers.
+type throttle struct {
+	mu   sync.Mutex
+	rate int64     // Bytes per second; zero for unlimited
+	next time.Time // Time at which the bytes already admitted are transferred
+}
+
+// setRate sets the rate in bytes per second; zero disables throttling.
+func (t *throttle) setRate(rate int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rate = rate
+}
+
+// wait blocks until bytes may be transferred without exceeding the
+// rate, given the bytes transferred by earlier callers.
+func (t *throttle) wait(bytes int64) {
+	t.mu.Lock()
+	if t.rate <= 0 {
+		t.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	delay := t.next.Sub(now)
+	t.next = t.next.Add(time.Duration(bytes * int64(time.Second) / t.rate))
+	t.mu.Unlock()
+	time.Sleep(delay)
+}
+
+// A snapshotFetch is the outcome of fetching a snapshot's rows from
+// the leader which sent msg. On failure, snap holds the rows fetched
+// so far, from which the next fetch of the same snapshot resumes.
+type snapshotFetch struct {
+	msg  *RaftMessage
+	snap *RaftSnapshot
+	err  error
+}
+
+// A snapshotSpan is a span of keys, from start (inclusive) to end
+// (exclusive), whose rows are part of a range's raft snapshot.
+type snapshotSpan struct {
+	start, end Key
+	skipLocal  bool // Keys local to the store within the span are excluded
+}
+
+// includes returns whether the row with key, within the span, is
+// part of the snapshot.
+func (s snapshotSpan) includes(key Key) bool {
+	return !s.skipLocal || !bytes.HasPrefix(key, keyLocalPrefix)
+}
+
+// snapshotSpans returns the spans of keys whose rows make up the
+// range's raft snapshot: its replicated data, its lease and the
+// replies it has persisted.
+func (r *Range) snapshotSpans() []snapshotSpan {
+	rangeID := r.Metadata().RangeID
+	leaseKey := rangeLeaseKey(rangeID)
+	prefix := rangeResponsePrefix(rangeID)
+	return append(r.replicatedSpans(),
+		snapshotSpan{start: leaseKey, end: MakeKey(leaseKey, Key{0})},
+		snapshotSpan{start: prefix, end: PrefixEndKey(prefix)})
+}
+
+// A snapshotSource serves the rows of a range's raft snapshot, read
+// chunk by chunk from an engine snapshot taken as of the snapshot's
+// index, so that the range's data isn't held in memory. The rows are
+// those of each of the snapshot's spans in turn. The source's
+// iterator remains positioned after the last chunk served, so that
+// successive chunks fetched by a follower are read without rereading
+// the rows before them.
+type snapshotSource struct {
+	index int64
+	spans []snapshotSpan
+
+	mu     sync.Mutex
+	engine Snapshot // Nil once closed
+	it     Iterator // Nil until the first chunk is read
+	span   int      // Index of the span of the iterator's position
+	offset int      // Count of the rows preceding the iterator's position
+}
+
+// newSnapshotSource returns a source of the rows of snap, read from
+// a snapshot of the engine taken now, which must reflect the range's
+// data as of snap's index.
+func (r *Range) newSnapshotSource(snap *RaftSnapshot) *snapshotSource {
+	return &snapshotSource{
+		index:  snap.Index,
+		spans:  r.snapshotSpans(),
+		engine: r.engine.newSnapshot(),
+	}
+}
+
+// chunk returns the rows of the snapshot beginning with the
+// offset'th, up to approximately maxBytes but at least one, along
+// with their size and whether more rows follow them.
+func (s *snapshotSource) chunk(offset int, maxBytes int64) ([]KeyValue, int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.engine == nil {
+		return nil, 0, false, util.Errorf("snapshot at index %d has been released", s.index)
+	}
+	if offset < 0 {
+		return nil, 0, false, util.Errorf("offset %d out of bounds of snapshot", offset)
+	}
+	if s.it == nil || offset < s.offset {
+		s.rewind()
+	}
+	for ; s.offset < offset; s.offset++ {
+		if !s.settle() {
+			if err := s.it.err(); err != nil {
+				return nil, 0, false, err
+			}
+			return nil, 0, false, util.Errorf("offset %d out of bounds of snapshot with %d rows", offset, s.offset)
+		}
+		s.it.next()
+	}
+	var rows []KeyValue
+	var size int64
+	for (len(rows) == 0 || size < maxBytes) && s.settle() {
+		key := s.it.key()
+		value, err := s.it.value()
+		if err != nil {
+			return nil, 0, false, err
+		}
+		rows = append(rows, KeyValue{Key: key, Value: value})
+		size += int64(len(key) + len(value.Bytes))
+		s.it.next()
+		s.offset++
+	}
+	more := s.settle()
+	if err := s.it.err(); err != nil {
+		return nil, 0, false, err
+	}
+	return rows, size, more, nil
+}
+
+// rewind positions a new iterator at the first row of the snapshot.
+func (s *snapshotSource) rewind() {
+	if s.it != nil {
+		s.it.close()
+	}
+	s.it = s.engine.newIterator()
+	s.span, s.offset = 0, 0
+	s.it.seek(s.spans[0].start)
+}
+
+// settle positions the iterator at the next row of the snapshot,
+// moving on to each following span as the last is exhausted. Returns
+// false once the rows of all spans have been read, or on error.
+func (s *snapshotSource) settle() bool {
+	for s.span < len(s.spans) && s.it.err() == nil {
+		span := s.spans[s.span]
+		if s.it.valid() && bytes.Compare(s.it.key(), span.end) < 0 {
+			if span.includes(s.it.key()) {
+				return true
+			}
+			s.it.next()
+			continue
+		}
+		if s.span++; s.span < len(s.spans) {
+			s.it.seek(s.spans[s.span].start)
+		}
+	}
+	return false
+}
+
+// close releases the iterator and engine snapshot.
+func (s *snapshotSource) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.it != nil {
+		s.it.close()
+		s.it = nil
+	}
+	if s.engine != nil {
+		s.engine.close()
+		s.engine = nil
+	}
+}
+
+// publishSnapshot makes src the source of the snapshot served to
+// followers, releasing that of the snapshot it replaces. Nil
+// publishes no snapshot.
+func (r *Range) publishSnapshot(src *snapshotSource) {
+	r.snapMu.Lock()
+	prev := r.snapshot
+	r.snapshot = src
+	r.snapMu.Unlock()
+	if prev != nil {
+		prev.close()
+	}
+}
+
+// SnapshotChunk returns rows of the range's raft snapshot, as fetched
+// by followers too far behind to be caught up from the log. Rows are
+// returned beginning at args.Offset, up to approximately
+// args.MaxBytes, paced by the store's snapshot throttle. Fails if the
+// snapshot at args.Index has been replaced by a later one, in which
+// case the leader sends the follower the later snapshot.
+func (r *Range) SnapshotChunk(args *InternalSnapshotChunkRequest, reply *InternalSnapshotChunkResponse) {
+	r.snapMu.Lock()
+	src := r.snapshot
+	r.snapMu.Unlock()
+	if src == nil || src.index != args.Index {
+		reply.Error = util.Errorf("range %d: snapshot at index %d is unavailable", r.Metadata().RangeID, args.Index)
+		return
+	}
+	rows, size, more, err := src.chunk(args.Offset, args.MaxBytes)
+	if err != nil {
+		reply.Error = util.Errorf("range %d: %v", r.Metadata().RangeID, err)
+		return
+	}
+	if r.snapThrottle != nil {
+		r.snapThrottle.wait(size)
+	}
+	reply.Rows = rows
+	reply.More = more
+}
+
+// maybeFetchSnapshot handles a RaftInstallSnapshot message from the
+// leader. The snapshot's rows aren't sent with the message; unless the
+// raft group has no need of the snapshot, they're fetched from the
+// leader in the background, and the message is stepped once they've
+// all been received. Messages repeating the snapshot of a fetch in
+// progress are dropped; the fetch of a snapshot which previously
+// failed resumes from the rows already received.
+func (r *Range) maybeFetchSnapshot(msg *RaftMessage) {
+	if !r.raft.needsSnapshot(msg) || r.transport == nil {
+		r.raft.step(msg)
+		return
+	}
+	if r.fetching {
+		return
+	}
+	snap := r.partial
+	if snap == nil || snap.Index != msg.Snapshot.Index || snap.Term != msg.Snapshot.Term {
+		snap = &RaftSnapshot{Index: msg.Snapshot.Index, Term: msg.Snapshot.Term, Subsumed: msg.Snapshot.Subsumed}
+	}
+	r.partial = nil
+	r.fetching = true
+	go func() {
+		err := r.fetchSnapshot(msg.From, snap)
+		select {
+		case r.fetched <- &snapshotFetch{msg: msg, snap: snap, err: err}:
+		case <-r.closer:
+		}
+	}()
+}
+
+// fetchSnapshot appends the rows of the snapshot held by leader which
+// follow those in snap, chunk by chunk.
+func (r *Range) fetchSnapshot(leader Replica, snap *RaftSnapshot) error {
+	for {
+		args := &InternalSnapshotChunkRequest{
+			RequestHeader: RequestHeader{Replica: leader},
+			Index:         snap.Index,
+			Offset:        len(snap.Rows),
+			MaxBytes:      snapshotChunkBytes,
+		}
+		reply := &InternalSnapshotChunkResponse{}
+		err := r.transport.SnapshotChunk(args, reply)
+		if err == nil {
+			err = reply.Error
+		}
+		if err != nil {
+			return err
+		}
+		snap.Rows = append(snap.Rows, reply.Rows...)
+		if !reply.More {
+			return nil
+		}
+		select {
+		case <-r.closer:
+			return util.Errorf("range %d stopped", r.Metadata().RangeID)
+		default:
+		}
+	}
+}
+
+// finishFetch steps the message of a completed snapshot fetch, with
+// the fetched rows, into the raft group. A failed fetch's rows are
+// retained to resume the fetch when the leader resends the snapshot.
+func (r *Range) finishFetch(f *snapshotFetch) {
+	r.fetching = false
+	if f.err != nil {
+		glog.Warningf("range %d: failed to fetch snapshot at index %d from node %d after %d rows: %v",
+			f.msg.RangeID, f.snap.Index, f.msg.From.NodeID, len(f.snap.Rows), f.err)
+		r.partial = f.snap
+		return
+	}
+	msg := *f.msg
+	msg.Snapshot = f.snap
+	r.raft.step(&msg)
+}
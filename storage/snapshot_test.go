@@ -0,0 +1,98 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// TestRangeSnapshotChunk verifies snapshots are served in chunks of
+// roughly the requested size, read from the range's data as of the
+// snapshot, and only at the published index.
+func TestRangeSnapshotChunk(t *testing.T) {
+	r := NewRange(RangeMetadata{RangeID: 1, StartKey: KeyMin, EndKey: KeyMax}, NewInMem(1<<20), nil, nil)
+	chunk := func(index int64, offset int, maxBytes int64) ([]KeyValue, bool, error) {
+		reply := &InternalSnapshotChunkResponse{}
+		r.SnapshotChunk(&InternalSnapshotChunkRequest{Index: index, Offset: offset, MaxBytes: maxBytes}, reply)
+		return reply.Rows, reply.More, reply.Error
+	}
+	if _, _, err := chunk(1, 0, 10); err == nil {
+		t.Error("expected error fetching unpublished snapshot")
+	}
+	for _, kv := range []KeyValue{
+		{Key: Key("a"), Value: Value{Bytes: []byte("1")}},
+		{Key: Key("b"), Value: Value{Bytes: []byte("2")}},
+		{Key: Key("c"), Value: Value{Bytes: []byte("3")}},
+		{Key: rangeLeaseKey(1), Value: Value{Bytes: []byte("lease")}},
+		// Rows local to the store, other than the lease, are excluded.
+		{Key: rangeRaftStateKey(1), Value: Value{Bytes: []byte("state")}},
+	} {
+		if err := r.engine.put(kv.Key, kv.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.publishSnapshot(r.newSnapshotSource(&RaftSnapshot{Index: 5, Term: 1}))
+	defer r.publishSnapshot(nil)
+	// Writes following the snapshot aren't served.
+	if err := r.engine.put(Key("d"), Value{Bytes: []byte("4")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := chunk(4, 0, 10); err == nil {
+		t.Error("expected error fetching replaced snapshot")
+	}
+	if rows, more, err := chunk(5, 0, 4); err != nil || len(rows) != 2 || string(rows[1].Key) != "b" || !more {
+		t.Errorf("expected 2 rows with more; got %+v, %t, %v", rows, more, err)
+	}
+	// A chunk holds at least one row, however small the limit.
+	if rows, more, err := chunk(5, 2, 0); err != nil || len(rows) != 1 || string(rows[0].Key) != "c" || !more {
+		t.Errorf("expected third row with more; got %+v, %t, %v", rows, more, err)
+	}
+	if rows, more, err := chunk(5, 3, 100); err != nil || len(rows) != 1 || !bytes.Equal(rows[0].Key, rangeLeaseKey(1)) || more {
+		t.Errorf("expected final lease row; got %+v, %t, %v", rows, more, err)
+	}
+	// Chunks preceding those last served are read anew.
+	if rows, more, err := chunk(5, 1, 100); err != nil || len(rows) != 3 || string(rows[0].Key) != "b" || more {
+		t.Errorf("expected rows following first; got %+v, %t, %v", rows, more, err)
+	}
+	if _, _, err := chunk(5, 5, 10); err == nil {
+		t.Error("expected error fetching beyond snapshot")
+	}
+	r.publishSnapshot(nil)
+	if _, _, err := chunk(5, 0, 10); err == nil {
+		t.Error("expected error fetching released snapshot")
+	}
+}
+
+// TestThrottle verifies a throttle paces transfers to its rate.
+func TestThrottle(t *testing.T) {
+	th := &throttle{}
+	start := time.Now()
+	th.wait(1 << 30)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("expected unlimited throttle not to wait; waited %s", elapsed)
+	}
+	th.setRate(1000)
+	start = time.Now()
+	for i := 0; i < 3; i++ {
+		th.wait(10)
+	}
+	// The third transfer waits for the first two: 20ms.
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("expected transfers paced to 1000 bytes/sec; elapsed %s", elapsed)
+	}
+}
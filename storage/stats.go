@@ -0,0 +1,309 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"strconv"
+
+	"github.com/golang/glog"
+)
+
+// keyRangeStatsPrefix is the prefix for store-local keys holding the
+// statistics of ranges. The value is a struct of type RangeStats.
+var keyRangeStatsPrefix = Key("\x00\x00\x00stats-")
+
+// rangeStatsKey creates a range stats key as the concatenation of the
+// keyRangeStatsPrefix and hexadecimal-formatted range ID.
+func rangeStatsKey(rangeID int64) Key {
+	return MakeKey(keyRangeStatsPrefix, Key(strconv.FormatInt(rangeID, 16)))
+}
+
+// RangeStats holds counts of the data stored in a range, maintained
+// incrementally as the range is written and persisted with it, so
+// that sizing the range for splits, merges and garbage collection
+// doesn't require scanning it. Store-local keys aren't counted, except
+// for the MVCC rows of the range's keys.
+type RangeStats struct {
+	LiveBytes   int64 // Bytes of keys and values of plain rows
+	KeyCount    int64 // Plain rows
+	MVCCBytes   int64 // Bytes of keys and values of MVCC metadata and versions
+	IntentCount int64 // Outstanding write intents
+	GCBytes     int64 // Bytes of MVCC versions other than write intents: superseded versions and deletions
+}
+
+// TotalBytes returns the bytes of all rows counted by the stats.
+func (rs RangeStats) TotalBytes() int64 {
+	return rs.LiveBytes + rs.MVCCBytes
+}
+
+// add adds o to the stats.
+func (rs *RangeStats) add(o RangeStats) {
+	rs.LiveBytes += o.LiveBytes
+	rs.KeyCount += o.KeyCount
+	rs.MVCCBytes += o.MVCCBytes
+	rs.IntentCount += o.IntentCount
+	rs.GCBytes += o.GCBytes
+}
+
+// subtract subtracts o from the stats.
+func (rs *RangeStats) subtract(o RangeStats) {
+	rs.LiveBytes -= o.LiveBytes
+	rs.KeyCount -= o.KeyCount
+	rs.MVCCBytes -= o.MVCCBytes
+	rs.IntentCount -= o.IntentCount
+	rs.GCBytes -= o.GCBytes
+}
+
+// rowStats returns the stats of the plain row at key with value, which
+// are zero if the key has no value.
+func rowStats(key Key, value Value) RangeStats {
+	if value.Bytes == nil {
+		return RangeStats{}
+	}
+	return RangeStats{LiveBytes: int64(len(key) + len(value.Bytes)), KeyCount: 1}
+}
+
+// mvccKeyStats returns the stats of the metadata and versions of key
+// stored in engine; see MVCC.
+func mvccKeyStats(engine Engine, key Key) (RangeStats, error) {
+	var rs RangeStats
+	kvs, err := engine.scan(mvccMetadataKey(key), mvccVersionsEnd(key), 0)
+	if err != nil {
+		return rs, err
+	}
+	var intent Key
+	for _, kv := range kvs {
+		if err := rs.addMVCCRow(kv, &intent); err != nil {
+			return rs, err
+		}
+	}
+	return rs, nil
+}
+
+// addMVCCRow adds the stats of kv, a row storing MVCC metadata or a
+// version, to the stats. Rows are added in key order; intent tracks
+// the key of the version which is the current key's write intent,
+// if any. The other versions were superseded by the key's plain row,
+// or are deletions, so they count as GC bytes.
+func (rs *RangeStats) addMVCCRow(kv KeyValue, intent *Key) error {
+	size := int64(len(kv.Key) + len(kv.Value.Bytes))
+	rs.MVCCBytes += size
+	key, _, err := mvccDecodeKey(kv.Key)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(kv.Key, mvccMetadataKey(key)) {
+		if !bytes.Equal(kv.Key, *intent) {
+			rs.GCBytes += size
+		}
+		return nil
+	}
+	meta, err := decodeMetadata(kv.Value)
+	if err != nil {
+		return err
+	}
+	rs.IntentCount++
+	*intent = mvccEncodeKey(key, meta.Timestamp)
+	return nil
+}
+
+// batchStats returns the change to the stats of the range made by the
+// writes buffered in b, comparing the rows they touch in the
+// underlying engine with the rows as b leaves them. The MVCC rows of
+// a key are counted whole, as a version's write may supersede
+// another.
+func batchStats(b *Batch) (RangeStats, error) {
+	var delta RangeStats
+	mvccKeys := map[string]struct{}{}
+	for _, w := range b.updates {
+		if key, _, err := mvccDecodeKey(w.key); err == nil {
+			mvccKeys[string(key)] = struct{}{}
+			continue
+		}
+		if bytes.HasPrefix(w.key, keyLocalPrefix) {
+			continue
+		}
+		before, err := b.engine.get(w.key)
+		if err != nil {
+			return delta, err
+		}
+		after, err := b.get(w.key)
+		if err != nil {
+			return delta, err
+		}
+		delta.add(rowStats(w.key, after))
+		delta.subtract(rowStats(w.key, before))
+	}
+	for key := range mvccKeys {
+		before, err := mvccKeyStats(b.engine, Key(key))
+		if err != nil {
+			return delta, err
+		}
+		after, err := mvccKeyStats(b, Key(key))
+		if err != nil {
+			return delta, err
+		}
+		delta.add(after)
+		delta.subtract(before)
+	}
+	return delta, nil
+}
+
+// Stats returns the range's statistics.
+func (r *Range) Stats() RangeStats {
+	r.statsMu.Lock()
+	defer r.statsMu.Unlock()
+	return r.stats
+}
+
+// commitBatch commits b, persisting the change it makes to the range's
+// stats atomically with it. Requires applyMu and usageMu.
+func (r *Range) commitBatch(b *Batch) error {
+	return r.commitBatchAdjusted(b, RangeStats{})
+}
+
+// commitBatchAdjusted is like commitBatch, but adds adjust to the
+// change to the range's stats, for writes whose effect batchStats
+// can't see, such as those of range tombstones. Requires applyMu and
+// usageMu.
+func (r *Range) commitBatchAdjusted(b *Batch, adjust RangeStats) error {
+	delta, err := batchStats(b)
+	if err != nil {
+		return err
+	}
+	delta.add(adjust)
+	r.statsMu.Lock()
+	defer r.statsMu.Unlock()
+	stats := r.stats
+	stats.add(delta)
+	if err := putI(b, rangeStatsKey(r.Metadata().RangeID), &stats); err != nil {
+		return err
+	}
+	if err := b.Commit(); err != nil {
+		return err
+	}
+	r.stats = stats
+	return nil
+}
+
+// putRecord writes value, gob-encoded, to key within the range,
+// updating its stats. Unlike writes of clients' values, the write
+// isn't attributed to an account or published to watchers; it's for
+// internal records, such as those of transactions.
+func (r *Range) putRecord(key Key, value interface{}) error {
+	r.usageMu.Lock()
+	defer r.usageMu.Unlock()
+	b := r.newBatch()
+	if err := putI(b, key, value); err != nil {
+		return err
+	}
+	return r.commitBatch(b)
+}
+
+// deleteRecord deletes the gob-encoded record at key, as written by
+// putRecord. Requires applyMu.
+func (r *Range) deleteRecord(key Key) error {
+	r.usageMu.Lock()
+	defer r.usageMu.Unlock()
+	b := r.newBatch()
+	if err := b.del(key); err != nil {
+		return err
+	}
+	return r.commitBatch(b)
+}
+
+// scanStats computes the range's stats from its data.
+func (r *Range) scanStats() (RangeStats, error) {
+	var rs RangeStats
+	meta := r.Metadata()
+	if err := visitPlainRows(r.engine, meta.StartKey, meta.EndKey, func(kv KeyValue) error {
+		rs.add(rowStats(kv.Key, kv.Value))
+		return nil
+	}); err != nil {
+		return rs, err
+	}
+	var intent Key
+	end := mvccSpanEnd(meta.EndKey)
+	for start := mvccMetadataKey(meta.StartKey); ; {
+		kvs, err := r.engine.scan(start, end, usageScanBatch)
+		if err != nil {
+			return rs, err
+		}
+		for _, kv := range kvs {
+			if err := rs.addMVCCRow(kv, &intent); err != nil {
+				return rs, err
+			}
+		}
+		if len(kvs) < usageScanBatch {
+			return rs, nil
+		}
+		start = MakeKey(kvs[len(kvs)-1].Key, Key{0})
+	}
+}
+
+// loadStats loads the range's persisted stats, computing and
+// persisting them if there are none, as for a range created by a
+// split.
+func (r *Range) loadStats() {
+	if !r.readStats() {
+		r.resetStats()
+	}
+}
+
+// readStats replaces the range's stats with those persisted, returning
+// whether there were any.
+func (r *Range) readStats() bool {
+	var stats RangeStats
+	ok, _, err := getI(r.engine, rangeStatsKey(r.Metadata().RangeID), &stats)
+	if err != nil {
+		glog.Errorf("range %d: unable to load stats: %v", r.Metadata().RangeID, err)
+	}
+	if !ok || err != nil {
+		return false
+	}
+	r.statsMu.Lock()
+	r.stats = stats
+	r.statsMu.Unlock()
+	return true
+}
+
+// resetStats recomputes the range's stats from its data and persists
+// them, following a change to the range's key span or the
+// replacement of its data by a snapshot.
+func (r *Range) resetStats() {
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+	r.recomputeStats()
+}
+
+// recomputeStats recomputes and persists the range's stats, as for
+// resetStats. Requires applyMu.
+func (r *Range) recomputeStats() {
+	r.usageMu.Lock()
+	defer r.usageMu.Unlock()
+	stats, err := r.scanStats()
+	if err != nil {
+		glog.Errorf("range %d: unable to compute stats: %v", r.Metadata().RangeID, err)
+		return
+	}
+	r.statsMu.Lock()
+	defer r.statsMu.Unlock()
+	r.stats = stats
+	if err := putI(r.engine, rangeStatsKey(r.Metadata().RangeID), &stats); err != nil {
+		glog.Errorf("range %d: unable to persist stats: %v", r.Metadata().RangeID, err)
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// verifyStats fails the test if the range's incrementally maintained
+// stats differ from those computed by scanning its data.
+func verifyStats(t *testing.T, r *Range, context string) RangeStats {
+	scanned, err := r.scanStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := r.Stats(); stats != scanned {
+		t.Errorf("%s: expected stats %+v; got %+v", context, scanned, stats)
+	}
+	return scanned
+}
+
+// TestRangeStatsIncremental verifies the stats of a range track its
+// data through plain writes, write intents and their resolution, MVCC
+// versions and garbage collection.
+func TestRangeStatsIncremental(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	base := verifyStats(t, r, "initial")
+
+	for _, key := range []string{"a", "b", "c"} {
+		pr := &PutResponse{}
+		r.Put(&PutRequest{Key: Key(key), Value: Value{Bytes: []byte("value")}}, pr)
+		if pr.Error != nil {
+			t.Fatal(pr.Error)
+		}
+	}
+	dr := &DeleteResponse{}
+	r.Delete(&DeleteRequest{Key: Key("c")}, dr)
+	if dr.Error != nil {
+		t.Fatal(dr.Error)
+	}
+	stats := verifyStats(t, r, "plain writes")
+	if keys := stats.KeyCount - base.KeyCount; keys != 2 {
+		t.Errorf("expected 2 keys written; got %d", keys)
+	}
+	if bytes := stats.LiveBytes - base.LiveBytes; bytes != 12 {
+		t.Errorf("expected 12 bytes written; got %d", bytes)
+	}
+
+	// Each transaction writes an intent on "a" and commits it, so that
+	// the second supersedes the version committed by the first.
+	for i, txID := range []string{"txn1", "txn2"} {
+		header := txnHeader(txID, 1)
+		header.Timestamp = int64(i + 1)
+		pr := &PutResponse{}
+		r.Put(&PutRequest{RequestHeader: header, Key: Key("a"), Value: Value{Bytes: []byte(txID)}}, pr)
+		if pr.Error != nil {
+			t.Fatal(pr.Error)
+		}
+		if stats := verifyStats(t, r, txID+" intent"); stats.IntentCount != 1 {
+			t.Errorf("%s: expected 1 intent; got %d", txID, stats.IntentCount)
+		}
+		er := &EndTransactionResponse{}
+		r.EndTransaction(&EndTransactionRequest{RequestHeader: header, Commit: true, Keys: []Key{Key("a")}}, er)
+		if er.Error != nil {
+			t.Fatal(er.Error)
+		}
+		rr := &InternalResolveIntentResponse{}
+		r.InternalResolveIntent(&InternalResolveIntentRequest{Key: Key("a"), IntentTxID: txID, Commit: true}, rr)
+		if rr.Error != nil {
+			t.Fatal(rr.Error)
+		}
+		if stats := verifyStats(t, r, txID+" resolved"); stats.IntentCount != 0 {
+			t.Errorf("%s: expected no intents; got %d", txID, stats.IntentCount)
+		}
+	}
+
+	// Intents' values are copied to their keys on resolution, so
+	// superseded versions are written directly.
+	r.usageMu.Lock()
+	b := NewBatch(r.engine)
+	mvcc := NewMVCC(b)
+	for _, ts := range []int64{1, 2} {
+		if err := mvcc.Put(Key("v"), ts, Value{Bytes: []byte("version")}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.commitBatch(b); err != nil {
+		t.Fatal(err)
+	}
+	r.usageMu.Unlock()
+	if stats := verifyStats(t, r, "versions"); stats.GCBytes == 0 {
+		t.Errorf("expected superseded version to count as GC bytes; got %+v", stats)
+	}
+
+	if _, err := r.GarbageCollect(time.Now().UnixNano() + int64(2*defaultGCTTL)); err != nil {
+		t.Fatal(err)
+	}
+	if stats := verifyStats(t, r, "garbage collected"); stats.GCBytes != 0 {
+		t.Errorf("expected superseded version collected; got %+v", stats)
+	}
+}
+
+// TestRangeStatsPersisted verifies a range's stats are persisted with
+// it and loaded, rather than recomputed, when it's restarted.
+func TestRangeStatsPersisted(t *testing.T) {
+	engine := createTestEngine(t)
+	r, _ := createTestRange(engine, t)
+	pr := &PutResponse{}
+	r.Put(&PutRequest{Key: Key("a"), Value: Value{Bytes: []byte("value")}}, pr)
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	stats := r.Stats()
+	r.Stop()
+
+	// Persisted stats which differ from the range's data are loaded
+	// as is, showing they aren't recomputed.
+	stats.KeyCount += 100
+	if err := putI(engine, rangeStatsKey(r.Metadata().RangeID), &stats); err != nil {
+		t.Fatal(err)
+	}
+	r, _ = createTestRange(engine, t)
+	defer r.Stop()
+	if loaded := r.Stats(); loaded != stats {
+		t.Errorf("expected persisted stats %+v; got %+v", stats, loaded)
+	}
+	r.resetStats()
+	verifyStats(t, r, "reset")
+	if r.Stats().KeyCount == stats.KeyCount {
+		t.Errorf("expected reset to recompute stats")
+	}
+}
+
+// prefixFailingEngine fails batches of writes which include a key
+// with prefix once failing is set, as a crash before they're written
+// would.
+type prefixFailingEngine struct {
+	Engine
+	prefix  Key
+	failing int32 // Accessed atomically
+}
+
+// writeBatch fails if writes include a key with the prefix.
+func (e *prefixFailingEngine) writeBatch(writes []engineWrite) error {
+	for _, w := range writes {
+		if atomic.LoadInt32(&e.failing) != 0 && bytes.HasPrefix(w.key, e.prefix) {
+			return util.Errorf("injected failure writing %q", w.key)
+		}
+	}
+	return e.Engine.writeBatch(writes)
+}
+
+// TestRangeStatsWrittenWithData verifies a range's stats are
+// persisted atomically with the writes they count, so that a write
+// whose stats can't be persisted leaves neither behind.
+func TestRangeStatsWrittenWithData(t *testing.T) {
+	engine := &prefixFailingEngine{Engine: createTestEngine(t), prefix: keyRangeStatsPrefix}
+	r, _ := createTestRange(engine, t)
+	defer r.Stop()
+	stats := r.Stats()
+	atomic.StoreInt32(&engine.failing, 1)
+	pr := &PutResponse{}
+	r.Put(&PutRequest{Key: Key("a"), Value: Value{Bytes: []byte("value")}}, pr)
+	if pr.Error == nil {
+		t.Fatal("expected put to fail with its stats")
+	}
+	if value, err := engine.get(Key("a")); err != nil || value.Bytes != nil {
+		t.Errorf("expected value not written; got %q, %v", value.Bytes, err)
+	}
+	var persisted RangeStats
+	if _, _, err := getI(engine, rangeStatsKey(r.Metadata().RangeID), &persisted); err != nil {
+		t.Fatal(err)
+	}
+	if persisted != stats || r.Stats() != stats {
+		t.Errorf("expected stats %+v unchanged; got %+v persisted, %+v in memory", stats, persisted, r.Stats())
+	}
+}
+
+// TestStoreGCCandidatesByGCBytes verifies ranges due for garbage
+// collection are ordered by the bytes of superseded versions.
+func TestStoreGCCandidatesByGCBytes(t *testing.T) {
+	cs := gcCandidates{
+		{rangeID: 1, stats: RangeStats{GCBytes: 10}},
+		{rangeID: 2, stats: RangeStats{GCBytes: 100}},
+		{rangeID: 3, gc: GCMetadata{ResumeKey: Key("a")}},
+		{rangeID: 4, stats: RangeStats{GCBytes: 10}, gc: GCMetadata{LastGC: -1}},
+	}
+	sort.Sort(cs)
+	for i, expID := range []int64{3, 2, 4, 1} {
+		if cs[i].rangeID != expID {
+			t.Errorf("%d: expected range %d; got %d", i, expID, cs[i].rangeID)
+		}
+	}
+}
@@ -18,13 +18,18 @@
 package storage
 
 import (
+	"bytes"
+	"encoding/gob"
 	"fmt"
+	"reflect"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/cockroachdb/cockroach/gossip"
 	"github.com/cockroachdb/cockroach/util"
+	"github.com/golang/glog"
 )
 
 // Constants for store-reserved keys. These keys are prefixed with
@@ -33,6 +38,8 @@ import (
 // replicated via raft nor is it available via access to the global
 // key-value store.
 var (
+	// keyLocalPrefix is the prefix shared by all store-local keys.
+	keyLocalPrefix = Key("\x00\x00\x00")
 	// keyStoreIdent store immutable identifier for this store, created
 	// when store is first bootstrapped.
 	keyStoreIdent = Key("\x00\x00\x00store-ident")
@@ -42,6 +49,10 @@ var (
 	// keyRangeMetadataPrefix is the prefix for keys storing range metadata.
 	// The value is a struct of type RangeMetadata.
 	keyRangeMetadataPrefix = Key("\x00\x00\x00range-")
+	// keyBootstrapInfo holds the addresses of gossip peers recently
+	// known to the node, for use bootstrapping gossip on restart. The
+	// value is a struct of type gossip.BootstrapInfo.
+	keyBootstrapInfo = Key("\x00\x00\x00gossip-bootstrap")
 )
 
 // rangeKey creates a range key as the concatenation of the
@@ -64,22 +75,63 @@ type StoreIdent struct {
 type Store struct {
 	Ident     StoreIdent
 	engine    Engine           // The underlying key-value store
+	rowCache  *cachingEngine   // Wraps engine, caching rows it reads
 	allocator *allocator       // Makes allocation decisions
 	gossip    *gossip.Gossip   // Passed to new ranges
 	mu        sync.Mutex       // Protects the ranges map
 	ranges    map[int64]*Range // Map of ranges by range ID
+	splitMu   sync.Mutex       // Serializes splits and merges
+	transport RaftTransport    // Passed to ranges; may be nil
+	snapshots *throttle        // Paces snapshot chunks served by the store's ranges
+	zonesMu   sync.Mutex       // Protects zones
+	zones     []*prefixConfig  // Zone configs seen by RefreshZoneConfigs
 }
 
 // NewStore returns a new instance of a store.
 func NewStore(engine Engine, gossip *gossip.Gossip) *Store {
+	rowCache := newCachingEngine(engine)
 	return &Store{
-		engine:    engine,
-		allocator: &allocator{},
+		engine:   newTombstoneEngine(rowCache),
+		rowCache: rowCache,
+		allocator: &allocator{
+			storeFinder:    gossipStoreFinder(gossip),
+			livenessFinder: gossipLivenessFinder(gossip),
+			timeUntilDead:  DefaultTimeUntilNodeDead,
+			rand:           *util.NewPseudoRand(),
+		},
 		gossip:    gossip,
 		ranges:    make(map[int64]*Range),
+		snapshots: &throttle{},
 	}
 }
 
+// SetRaftTransport sets the transport via which ranges subsequently
+// started by the store replicate to their replicas on other stores.
+// Without a transport, ranges don't replicate.
+func (s *Store) SetRaftTransport(transport RaftTransport) {
+	s.transport = transport
+}
+
+// SetSnapshotRate limits the rate at which the store's ranges serve
+// snapshots to followers, in bytes per second, shared among all
+// followers fetching snapshots. Zero, the default, is unlimited.
+func (s *Store) SetSnapshotRate(bytesPerSec int64) {
+	s.snapshots.setRate(bytesPerSec)
+}
+
+// SetTimeUntilNodeDead sets the time after a node's liveness expires
+// beyond which its replicas are replaced by ranges led by the store.
+// See NodeLiveness.IsDead.
+func (s *Store) SetTimeUntilNodeDead(d time.Duration) {
+	s.allocator.timeUntilDead = d
+}
+
+// IsNodeDead returns whether the node with the specified ID is dead
+// according to its gossiped liveness record.
+func (s *Store) IsNodeDead(nodeID int32) bool {
+	return s.allocator.isDead(nodeID)
+}
+
 // Close calls Range.Stop() on all active ranges.
 func (s *Store) Close() {
 	for _, rng := range s.ranges {
@@ -112,17 +164,35 @@ func (s *Store) Init() error {
 		return util.Error("store has not been bootstrapped")
 	}
 
-	// TODO(spencer): scan through all range metadata and instantiate
-	//   ranges. Right now we just get range id hardcoded as 1.
-	var meta RangeMetadata
-	ok, _, err = getI(s.engine, rangeKey(1), &meta)
-	if err != nil || !ok {
+	// Scan through all range metadata and instantiate ranges.
+	kvs, err := s.engine.scan(keyRangeMetadataPrefix, PrefixEndKey(keyRangeMetadataPrefix), 0)
+	if err != nil {
 		return err
 	}
-
-	rng := NewRange(meta, s.engine, s.allocator, s.gossip)
-	rng.Start()
-	s.ranges[meta.RangeID] = rng
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, kv := range kvs {
+		// The range ID generator shares the range metadata key prefix.
+		if bytes.Equal(kv.Key, keyRangeIDGenerator) {
+			continue
+		}
+		var meta RangeMetadata
+		if err := gob.NewDecoder(bytes.NewBuffer(kv.Value.Bytes)).Decode(&meta); err != nil {
+			return util.Errorf("unable to unmarshal range metadata at key %q: %v", kv.Key, err)
+		}
+		if quarantined, err := s.isQuarantined(meta.RangeID); err != nil {
+			return err
+		} else if quarantined {
+			glog.Warningf("range %d is quarantined on store %s; not starting", meta.RangeID, s)
+			continue
+		}
+		rng := NewRange(meta, s.engine, s.allocator, s.gossip)
+		rng.setRaftTransport(s.Ident, s.transport)
+		rng.snapThrottle = s.snapshots
+		rng.store = s
+		rng.Start()
+		s.ranges[meta.RangeID] = rng
+	}
 
 	return nil
 }
@@ -143,27 +213,155 @@ func (s *Store) Bootstrap(ident StoreIdent) error {
 	return putI(s.engine, keyStoreIdent, s.Ident)
 }
 
+// ReadBootstrapInfo implements the gossip.Storage interface, reading
+// the gossip bootstrap info last written to the store.
+func (s *Store) ReadBootstrapInfo(info *gossip.BootstrapInfo) error {
+	_, _, err := getI(s.engine, keyBootstrapInfo, info)
+	return err
+}
+
+// WriteBootstrapInfo implements the gossip.Storage interface, writing
+// the gossip bootstrap info to the store.
+func (s *Store) WriteBootstrapInfo(info *gossip.BootstrapInfo) error {
+	return putI(s.engine, keyBootstrapInfo, info)
+}
+
 // GetRange fetches a range by ID. Returns an error if no range is found.
 func (s *Store) GetRange(rangeID int64) (*Range, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if rng, ok := s.ranges[rangeID]; ok {
 		return rng, nil
 	}
 	return nil, util.Errorf("range %d not found on store", rangeID)
 }
 
+// An EncryptedEngine is an Engine which may encrypt data at rest.
+type EncryptedEngine interface {
+	Engine
+	// Encrypted returns whether the engine encrypts data at rest.
+	Encrypted() bool
+}
+
+// Encrypted returns whether the store's engine encrypts data at rest.
+// Stores which don't may not hold replicas of ranges in zones
+// requiring encryption.
+func (s *Store) Encrypted() bool {
+	ee, ok := s.engine.(EncryptedEngine)
+	return ok && ee.Encrypted()
+}
+
+// SetRowCacheSize sets the maximum bytes of rows the store caches,
+// evicting rows as necessary to shrink the cache. Zero, the default,
+// disables the row cache.
+func (s *Store) SetRowCacheSize(bytes int64) {
+	s.rowCache.setCapacity(bytes)
+}
+
+// SetBlockCacheSize sets the size in bytes of the underlying engine's
+// block cache. Returns an error if the engine has no block cache.
+func (s *Store) SetBlockCacheSize(bytes int64) error {
+	bce, ok := s.rowCache.Engine.(BlockCachedEngine)
+	if !ok {
+		return util.Errorf("%s has no block cache", s)
+	}
+	return bce.SetBlockCacheSize(bytes)
+}
+
+// CacheStats returns statistics of the store's row cache and of the
+// underlying engine's block cache, if it has one.
+func (s *Store) CacheStats() (StoreCacheStats, error) {
+	stats := StoreCacheStats{RowCache: s.rowCache.stats()}
+	if bce, ok := s.rowCache.Engine.(BlockCachedEngine); ok {
+		blockStats, err := bce.BlockCacheStats()
+		if err != nil {
+			return StoreCacheStats{}, err
+		}
+		stats.BlockCache = &blockStats
+	}
+	return stats, nil
+}
+
+// checkStoragePolicy returns an error if a zone overlapping the span
+// [start, end) requires encryption and the store doesn't provide it.
+// Zones are learned via gossip; until they're available, as while the
+// cluster is bootstrapped, no policy is enforced.
+func (s *Store) checkStoragePolicy(start, end Key) error {
+	if s.Encrypted() {
+		return nil
+	}
+	zones, err := s.gossipedZones()
+	if zones == nil || err != nil {
+		return err
+	}
+	results, err := zones.splitRangeByPrefixes(start, end)
+	if err != nil {
+		return err
+	}
+	for _, rr := range results {
+		if rr.config.(*ZoneConfig).EncryptionRequired {
+			return util.Errorf("%s is unencrypted; span [%q, %q) requires encryption", s, rr.start, rr.end)
+		}
+	}
+	return nil
+}
+
+// gossipedZones returns the zone configs learned via gossip, or nil
+// if none are yet available.
+func (s *Store) gossipedZones() (*prefixConfigMap, error) {
+	if s.gossip == nil {
+		return nil, nil
+	}
+	info, err := s.gossip.GetInfo(gossip.KeyConfigZone)
+	if err != nil || len(info.([]*prefixConfig)) == 0 {
+		return nil, nil
+	}
+	return newPrefixConfigMap(append([]*prefixConfig(nil), info.([]*prefixConfig)...))
+}
+
 // CreateRange allocates a new range ID and stores range metadata.
-// On success, returns the new range.
+// On success, returns the new range. Fails if the range's zone
+// requires storage guarantees the store doesn't provide.
 func (s *Store) CreateRange(startKey, endKey Key, replicas []Replica) (*Range, error) {
-	rangeID, err := increment(s.engine, keyRangeIDGenerator, 1, time.Now().UnixNano())
+	if err := s.checkStoragePolicy(startKey, endKey); err != nil {
+		return nil, err
+	}
+	rangeID, err := s.allocateRangeID()
 	if err != nil {
 		return nil, err
 	}
+	return s.addRange(rangeID, startKey, endKey, replicas)
+}
+
+// allocateRangeID allocates a new range ID from the store's range ID
+// generator.
+func (s *Store) allocateRangeID() (int64, error) {
+	rangeID, err := increment(s.engine, keyRangeIDGenerator, 1, time.Now().UnixNano())
+	if err != nil {
+		return 0, err
+	}
 	if ok, _, _ := getI(s.engine, rangeKey(rangeID), nil); ok {
-		return nil, util.Error("newly allocated range id already in use")
+		return 0, util.Error("newly allocated range id already in use")
+	}
+	return rangeID, nil
+}
+
+// addRange stores metadata for a new range with the specified ID,
+// then starts the range and adds it to the store.
+func (s *Store) addRange(rangeID int64, startKey, endKey Key, replicas []Replica) (*Range, error) {
+	meta := s.newRangeMetadata(rangeID, startKey, endKey, replicas)
+	if err := putI(s.engine, rangeKey(rangeID), meta); err != nil {
+		return nil, err
 	}
+	return s.startRange(meta), nil
+}
+
+// newRangeMetadata returns the metadata of a new range with the
+// specified ID.
+func (s *Store) newRangeMetadata(rangeID int64, startKey, endKey Key, replicas []Replica) RangeMetadata {
 	// RangeMetadata is stored local to this store only. It is neither
 	// replicated via raft nor available via the global kv store.
-	meta := RangeMetadata{
+	return RangeMetadata{
 		ClusterID: s.Ident.ClusterID,
 		RangeID:   rangeID,
 		StartKey:  startKey,
@@ -173,17 +371,867 @@ func (s *Store) CreateRange(startKey, endKey Key, replicas []Replica) (*Range, e
 			Replicas: replicas,
 		},
 	}
-	err = putI(s.engine, rangeKey(rangeID), meta)
+}
+
+// startRange starts a range with the stored metadata meta and adds it
+// to the store.
+func (s *Store) startRange(meta RangeMetadata) *Range {
+	rng := NewRange(meta, s.engine, s.allocator, s.gossip)
+	rng.setRaftTransport(s.Ident, s.transport)
+	rng.snapThrottle = s.snapshots
+	rng.store = s
+	rng.Start()
+	s.mu.Lock()
+	s.ranges[meta.RangeID] = rng
+	s.mu.Unlock()
+	return rng
+}
+
+// SplitRange splits the range with the specified ID at splitKey. The
+// existing range is truncated to end at splitKey and a new range is
+// created spanning from splitKey to the existing range's end key.
+// newReplicas are the new range's replicas, one on the store of each
+// of the range's replicas, with range IDs allocated by their stores;
+// see AllocateRangeID. If newReplicas is nil, all replicas of the
+// range must reside on this store. A range with a raft transport
+// splits via its raft group, each of whose replicas splits as the
+// split commits; see Range.InternalSplit. Returns the new range. If
+// the range already ends at splitKey, as when a split is retried, the
+// range on this store which begins at splitKey is returned instead.
+// Updating range addressing records is the caller's responsibility.
+func (s *Store) SplitRange(rangeID int64, splitKey Key, newReplicas []Replica) (*Range, error) {
+	s.splitMu.Lock()
+	defer s.splitMu.Unlock()
+	rng, err := s.GetRange(rangeID)
 	if err != nil {
 		return nil, err
 	}
-	rng := NewRange(meta, s.engine, s.allocator, s.gossip)
-	rng.Start()
-	s.ranges[rangeID] = rng
-	return rng, nil
+	meta := rng.Metadata()
+	if bytes.Equal(splitKey, meta.EndKey) {
+		if next := s.rangeStartingAt(splitKey); next != nil {
+			return next, nil
+		}
+	}
+	if !rng.containsKey(splitKey) || bytes.Equal(splitKey, meta.StartKey) {
+		return nil, util.Errorf("split key %q must be within range %d [%q, %q)",
+			splitKey, rangeID, meta.StartKey, meta.EndKey)
+	}
+	// Range addressing records are looked up via the first range, so
+	// they must remain within it.
+	if bytes.Compare(splitKey, KeyMetaPrefix) <= 0 || bytes.HasPrefix(splitKey, KeyMetaPrefix) {
+		return nil, util.Errorf("split key %q must sort after range metadata keys", splitKey)
+	}
+	// Ranges must not span configuration map boundaries; otherwise,
+	// configs could not be loaded from a single range.
+	for _, cp := range configPrefixes {
+		if bytes.Compare(splitKey, cp.keyPrefix) > 0 && bytes.Compare(splitKey, PrefixEndKey(cp.keyPrefix)) < 0 {
+			return nil, util.Errorf("cannot split range within configuration map %q", cp.keyPrefix)
+		}
+	}
+	// Nor may they split an inbox from its messages.
+	if inbox, err := queueInbox(s.engine, splitKey); err != nil {
+		return nil, err
+	} else if inbox != nil {
+		return nil, util.Errorf("cannot split range within inbox %q", inbox)
+	}
+	if newReplicas == nil {
+		if err := s.verifyLocalReplicas(meta); err != nil {
+			return nil, err
+		}
+		newRangeID, err := s.allocateRangeID()
+		if err != nil {
+			return nil, err
+		}
+		for _, replica := range meta.Replicas.Replicas {
+			replica.RangeID = newRangeID
+			newReplicas = append(newReplicas, replica)
+		}
+	} else if err := verifySplitReplicas(meta, newReplicas); err != nil {
+		return nil, err
+	}
+	if s.transport == nil {
+		return s.splitLocal(rng, splitKey, newReplicas)
+	}
+	self, _ := s.localReplica(meta)
+	args := &InternalSplitRequest{RequestHeader: RequestHeader{Replica: self}, SplitKey: splitKey, NewReplicas: newReplicas}
+	if err := <-rng.ReadWriteCmd("InternalSplit", args, &InternalSplitResponse{}); err != nil {
+		return nil, err
+	}
+	newRng := s.rangeStartingAt(splitKey)
+	if newRng == nil {
+		return nil, util.Errorf("range %d split at %q, but store %s holds no range beginning there", rangeID, splitKey, s)
+	}
+	return newRng, nil
+}
+
+// splitLocal splits rng, all of whose replicas reside on this store,
+// at splitKey, outside of its raft group; see SplitRange.
+func (s *Store) splitLocal(rng *Range, splitKey Key, newReplicas []Replica) (*Range, error) {
+	meta := rng.Metadata()
+	newRangeID := newReplicas[0].RangeID
+	newMeta := s.newRangeMetadata(newRangeID, splitKey, meta.EndKey, newReplicas)
+	meta.EndKey = splitKey
+	// Both ranges' metadata are written atomically, so a crash can't
+	// leave them overlapping.
+	b := NewBatch(s.engine)
+	if err := putI(b, rangeKey(newRangeID), newMeta); err != nil {
+		return nil, err
+	}
+	if err := putI(b, rangeKey(meta.RangeID), meta); err != nil {
+		return nil, err
+	}
+	if err := copyResponseCache(b, s.engine, meta.RangeID, newRangeID); err != nil {
+		return nil, err
+	}
+	if err := b.Commit(); err != nil {
+		return nil, err
+	}
+	newRng := s.startRange(newMeta)
+	rng.setMetadata(meta)
+	rng.resetUsage()
+	rng.resetStats()
+	return newRng, nil
+}
+
+// verifySplitReplicas returns an error unless newReplicas include
+// exactly one replica, with an allocated range ID, on the store of
+// each of the replicas of the range with meta.
+func verifySplitReplicas(meta RangeMetadata, newReplicas []Replica) error {
+	if len(newReplicas) != len(meta.Replicas.Replicas) {
+		return util.Errorf("range %d has %d replicas, but its split has %d", meta.RangeID, len(meta.Replicas.Replicas), len(newReplicas))
+	}
+	for _, replica := range newReplicas {
+		if replica.RangeID == 0 {
+			return util.Errorf("replica %+v of range split from range %d has no range ID", replica, meta.RangeID)
+		}
+	}
+	if n := replicasChanged(meta.Replicas.Replicas, newReplicas); n != 0 {
+		return util.Errorf("replicas of range split from range %d don't reside on the range's stores", meta.RangeID)
+	}
+	return nil
+}
+
+// AllocateRangeID allocates a range ID on this store, for its replica
+// of a range being split from one of its ranges; see SplitRange.
+func (s *Store) AllocateRangeID() (int64, error) {
+	return s.allocateRangeID()
+}
+
+// rangeStartingAt returns the range on this store which begins at
+// key, or nil if there is none.
+func (s *Store) rangeStartingAt(key Key) *Range {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rng := range s.ranges {
+		if bytes.Equal(rng.Metadata().StartKey, key) {
+			return rng
+		}
+	}
+	return nil
+}
+
+// verifyLocalReplicas returns an error if any of the range's replicas
+// reside on another store.
+func (s *Store) verifyLocalReplicas(meta RangeMetadata) error {
+	for _, replica := range meta.Replicas.Replicas {
+		if replica.NodeID != s.Ident.NodeID || replica.StoreID != s.Ident.StoreID {
+			return util.Errorf("range %d has replica on another store: %+v", meta.RangeID, replica)
+		}
+	}
+	return nil
+}
+
+// verifyDistinctNodes returns an error if two of a range's replicas
+// reside on the same node, even on different stores, as the loss of
+// the node would lose both.
+func verifyDistinctNodes(replicas []Replica) error {
+	nodes := map[int32]Replica{}
+	for _, replica := range replicas {
+		if other, ok := nodes[replica.NodeID]; ok {
+			return util.Errorf("replicas on stores %d and %d of node %d would both hold the range",
+				other.StoreID, replica.StoreID, replica.NodeID)
+		}
+		nodes[replica.NodeID] = replica
+	}
+	return nil
+}
+
+// HasRangeStartingAt returns whether the store holds a range
+// beginning at key.
+func (s *Store) HasRangeStartingAt(key Key) bool {
+	return s.rangeStartingAt(key) != nil
+}
+
+// MergeRange merges the range with the specified ID with the range
+// which immediately follows it in the key space. The subsequent range
+// must also reside on this store, and the replicas of both ranges on
+// the same stores. The existing range is extended to the subsequent
+// range's end key and the subsequent range is stopped and removed
+// from the store; commands pending on it fail and may be retried
+// against the merged range. A range with a raft transport first
+// subsumes the subsequent range via the latter's raft group, freezing
+// its data, and awaits the subsumption's replication to each of its
+// replicas, then merges via its own, each of whose replicas merges as
+// the merge commits; see Range.InternalSubsume and
+// Range.InternalMerge. Returns the metadata of the subsumed range.
+// Updating range addressing records is the caller's responsibility.
+func (s *Store) MergeRange(rangeID int64) (RangeMetadata, error) {
+	s.splitMu.Lock()
+	defer s.splitMu.Unlock()
+	rng, err := s.GetRange(rangeID)
+	if err != nil {
+		return RangeMetadata{}, err
+	}
+	meta := rng.Metadata()
+	subsumed := s.rangeStartingAt(meta.EndKey)
+	if subsumed == nil {
+		return RangeMetadata{}, util.Errorf("no range on store follows range %d ending at %q", rangeID, meta.EndKey)
+	}
+	subsumedMeta := subsumed.Metadata()
+	if s.transport == nil {
+		if err := s.verifyLocalReplicas(meta); err != nil {
+			return RangeMetadata{}, err
+		}
+		if err := s.verifyLocalReplicas(subsumedMeta); err != nil {
+			return RangeMetadata{}, err
+		}
+		meta.EndKey = subsumedMeta.EndKey
+		if err := s.writeMerge(NewBatch(s.engine), meta, subsumedMeta); err != nil {
+			return RangeMetadata{}, err
+		}
+		s.finishMerge(rng, subsumed, meta)
+		rng.resetStats()
+		return subsumedMeta, nil
+	}
+	if replicasChanged(meta.Replicas.Replicas, subsumedMeta.Replicas.Replicas) != 0 {
+		return RangeMetadata{}, util.Errorf("ranges %d and %d must have replicas on the same stores to merge", rangeID, subsumedMeta.RangeID)
+	}
+	self, _ := s.localReplica(meta)
+	subsumedSelf, _ := s.localReplica(subsumedMeta)
+	subsumeArgs := &InternalSubsumeRequest{RequestHeader: RequestHeader{Replica: subsumedSelf}}
+	subsumeReply := &InternalSubsumeResponse{}
+	if err := <-subsumed.ReadWriteCmd("InternalSubsume", subsumeArgs, subsumeReply); err != nil {
+		return RangeMetadata{}, err
+	}
+	if err := subsumed.awaitReplicated(subsumeReply.Index); err != nil {
+		return RangeMetadata{}, err
+	}
+	args := &InternalMergeRequest{
+		RequestHeader:    RequestHeader{Replica: self},
+		SubsumedReplicas: subsumedMeta.Replicas.Replicas,
+		SubsumedIndex:    subsumeReply.Index,
+		SubsumedTerm:     subsumeReply.Term,
+	}
+	if err := <-rng.ReadWriteCmd("InternalMerge", args, &InternalMergeResponse{}); err != nil {
+		return RangeMetadata{}, err
+	}
+	return subsumedMeta, nil
+}
+
+// writeMerge writes, via b, meta, the metadata of a range extended by
+// a merge, and deletes the store-local records of the range it
+// subsumed, whose replies move to the merged range's response cache.
+// The merged range's metadata replaces both ranges' atomically, so a
+// crash can't leave them overlapping.
+func (s *Store) writeMerge(b *Batch, meta, subsumedMeta RangeMetadata) error {
+	if err := putI(b, rangeKey(meta.RangeID), meta); err != nil {
+		return err
+	}
+	b.del(rangeKey(subsumedMeta.RangeID))
+	b.del(rangeGCKey(subsumedMeta.RangeID))
+	b.del(rangeLeaseKey(subsumedMeta.RangeID))
+	b.del(rangeStatsKey(subsumedMeta.RangeID))
+	b.del(rangeSubsumedKey(subsumedMeta.RangeID))
+	if err := copyResponseCache(b, s.engine, subsumedMeta.RangeID, meta.RangeID); err != nil {
+		return err
+	}
+	if err := clearResponseCache(b, s.engine, subsumedMeta.RangeID); err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+// finishMerge stops subsumed and removes it from the store once rng's
+// merge with it to meta is committed; see writeMerge. The caller
+// recomputes rng's stats.
+func (s *Store) finishMerge(rng, subsumed *Range, meta RangeMetadata) {
+	s.mu.Lock()
+	delete(s.ranges, subsumed.Metadata().RangeID)
+	s.mu.Unlock()
+	subsumed.Stop()
+	rng.setMetadata(meta)
+	// Merged ranges are underfull, so compacting them is cheap; it
+	// reclaims the space of the subsumed range's records and of any
+	// deletions it had yet to compact.
+	rng.hintCompaction(meta.StartKey, meta.EndKey, compactionHintMinRows)
+	if hint, ok := subsumed.takeCompactionHint(0); ok {
+		rng.hintCompaction(hint.start, hint.end, hint.rows)
+	}
+	rng.resetUsage()
+}
+
+// MergeCandidates returns the IDs of ranges on this store which
+// should be merged with the range following them, in key order. A
+// range and its successor are merged if both are led by this store,
+// have replicas on the same stores, lie within a single zone and store
+// fewer bytes than the zone's RangeMinBytes, and the merged range
+// wouldn't exceed RangeMaxBytes, or if the successor was subsumed by
+// a merge which failed, so that the merge is retried. A range
+// subsumed by one candidate isn't itself a candidate. Without
+// zone configs, as while the cluster is bootstrapped, no ranges are
+// merged.
+func (s *Store) MergeCandidates() ([]int64, error) {
+	zones, err := s.gossipedZones()
+	if zones == nil || err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	ranges := make([]*Range, 0, len(s.ranges))
+	for _, rng := range s.ranges {
+		ranges = append(ranges, rng)
+	}
+	s.mu.Unlock()
+	sort.Sort(rangesByKey(ranges))
+
+	var ids []int64
+	for i := 0; i+1 < len(ranges); i++ {
+		meta, next := ranges[i].Metadata(), ranges[i+1].Metadata()
+		if !bytes.Equal(meta.EndKey, next.StartKey) || !ranges[i].IsLeader() || !ranges[i+1].IsLeader() {
+			continue
+		}
+		if replicasChanged(meta.Replicas.Replicas, next.Replicas.Replicas) != 0 {
+			continue
+		}
+		if ranges[i+1].Subsumed() {
+			ids = append(ids, meta.RangeID)
+			i++
+			continue
+		}
+		results, err := zones.splitRangeByPrefixes(meta.StartKey, next.EndKey)
+		if err != nil {
+			return nil, err
+		}
+		if len(results) != 1 {
+			continue
+		}
+		zone := results[0].config.(*ZoneConfig)
+		size, nextSize := ranges[i].Bytes(), ranges[i+1].Bytes()
+		if size >= zone.RangeMinBytes || nextSize >= zone.RangeMinBytes {
+			continue
+		}
+		if zone.RangeMaxBytes > 0 && size+nextSize > zone.RangeMaxBytes {
+			continue
+		}
+		ids = append(ids, meta.RangeID)
+		i++
+	}
+	return ids, nil
+}
+
+// A SplitCandidate is a range to be split at SplitKey.
+type SplitCandidate struct {
+	RangeID  int64
+	SplitKey Key
+}
+
+// SplitCandidates returns the ranges led by this store which exceed
+// their zone's RangeMaxBytes, with the keys at which to split them in
+// half. A range is sized according to the zone of its start key.
+// Ranges with replicas on other stores aren't split. Without zone
+// configs, no ranges are split.
+func (s *Store) SplitCandidates() ([]SplitCandidate, error) {
+	zones, err := s.gossipedZones()
+	if zones == nil || err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	ranges := make([]*Range, 0, len(s.ranges))
+	for _, rng := range s.ranges {
+		ranges = append(ranges, rng)
+	}
+	s.mu.Unlock()
+	sort.Sort(rangesByKey(ranges))
+
+	var splits []SplitCandidate
+	for _, rng := range ranges {
+		meta := rng.Metadata()
+		if !rng.IsLeader() || s.verifyLocalReplicas(meta) != nil {
+			continue
+		}
+		zone := zones.matchByPrefix(meta.StartKey).Config.(*ZoneConfig)
+		if zone.RangeMaxBytes <= 0 || rng.Bytes() <= zone.RangeMaxBytes {
+			continue
+		}
+		splitKey, err := rng.splitKey()
+		if err != nil {
+			return nil, err
+		}
+		if splitKey != nil {
+			splits = append(splits, SplitCandidate{RangeID: meta.RangeID, SplitKey: splitKey})
+		}
+	}
+	return splits, nil
+}
+
+// RefreshZoneConfigs compares the gossiped zone configs with those
+// seen by the previous call and, if any have changed, reloads the
+// storage policies of ranges overlapping the changed zones, so that
+// their GC TTLs and compression policies apply immediately. Returns
+// the IDs of the affected ranges, in key order. Zones which were
+// added or removed count as changed.
+func (s *Store) RefreshZoneConfigs() ([]int64, error) {
+	var configs []*prefixConfig
+	if s.gossip != nil {
+		if info, err := s.gossip.GetInfo(gossip.KeyConfigZone); err == nil {
+			configs = info.([]*prefixConfig)
+		}
+	}
+	s.zonesMu.Lock()
+	prev := s.zones
+	s.zones = configs
+	s.zonesMu.Unlock()
+
+	changed := changedPrefixes(prev, configs)
+	if len(changed) == 0 {
+		return nil, nil
+	}
+	s.mu.Lock()
+	ranges := make([]*Range, 0, len(s.ranges))
+	for _, rng := range s.ranges {
+		ranges = append(ranges, rng)
+	}
+	s.mu.Unlock()
+	sort.Sort(rangesByKey(ranges))
+
+	var ids []int64
+	for _, rng := range ranges {
+		meta := rng.Metadata()
+		for _, prefix := range changed {
+			if bytes.Compare(prefix, meta.EndKey) < 0 && bytes.Compare(PrefixEndKey(prefix), meta.StartKey) > 0 {
+				rng.loadStoragePolicies()
+				ids = append(ids, meta.RangeID)
+				break
+			}
+		}
+	}
+	return ids, nil
+}
+
+// changedPrefixes returns the prefixes whose configs differ between
+// prev and configs, including those present in only one.
+func changedPrefixes(prev, configs []*prefixConfig) []Key {
+	byPrefix := map[string]interface{}{}
+	for _, pc := range prev {
+		byPrefix[string(pc.Prefix)] = pc.Config
+	}
+	var changed []Key
+	for _, pc := range configs {
+		if old, ok := byPrefix[string(pc.Prefix)]; !ok || !reflect.DeepEqual(old, pc.Config) {
+			changed = append(changed, pc.Prefix)
+		}
+		delete(byPrefix, string(pc.Prefix))
+	}
+	for prefix := range byPrefix {
+		changed = append(changed, Key(prefix))
+	}
+	return changed
+}
+
+// GCCandidates returns the IDs of ranges on this store due for
+// garbage collection at now: those whose last pass was incomplete or
+// completed more than gcInterval before now. Ranges are ordered with
+// incomplete passes first, then by the bytes of superseded versions
+// their stats count, so that the most space is reclaimed soonest,
+// then by the age of their last pass. Every due range is returned, so
+// none starves.
+func (s *Store) GCCandidates(now int64) ([]int64, error) {
+	s.mu.Lock()
+	ranges := make([]*Range, 0, len(s.ranges))
+	for _, rng := range s.ranges {
+		ranges = append(ranges, rng)
+	}
+	s.mu.Unlock()
+
+	var due []gcCandidate
+	for _, rng := range ranges {
+		gc, err := rng.GCMetadata()
+		if err != nil {
+			return nil, err
+		}
+		if gc.ResumeKey == nil && gc.LastGC+int64(gcInterval) > now {
+			continue
+		}
+		due = append(due, gcCandidate{rangeID: rng.Metadata().RangeID, gc: gc, stats: rng.Stats()})
+	}
+	sort.Sort(gcCandidates(due))
+	ids := make([]int64, len(due))
+	for i, c := range due {
+		ids[i] = c.rangeID
+	}
+	return ids, nil
+}
+
+// gcCandidate is a range due for garbage collection.
+type gcCandidate struct {
+	rangeID int64
+	gc      GCMetadata
+	stats   RangeStats
+}
+
+// gcCandidates sorts ranges due for garbage collection, incomplete
+// passes first, then by descending GC bytes, then by the time of
+// their last complete pass.
+type gcCandidates []gcCandidate
+
+func (cs gcCandidates) Len() int      { return len(cs) }
+func (cs gcCandidates) Swap(i, j int) { cs[i], cs[j] = cs[j], cs[i] }
+func (cs gcCandidates) Less(i, j int) bool {
+	if resumeI, resumeJ := cs[i].gc.ResumeKey != nil, cs[j].gc.ResumeKey != nil; resumeI != resumeJ {
+		return resumeI
+	}
+	if cs[i].stats.GCBytes != cs[j].stats.GCBytes {
+		return cs[i].stats.GCBytes > cs[j].stats.GCBytes
+	}
+	return cs[i].gc.LastGC < cs[j].gc.LastGC
+}
+
+// rangesByKey sorts ranges by start key.
+type rangesByKey []*Range
+
+func (rs rangesByKey) Len() int      { return len(rs) }
+func (rs rangesByKey) Swap(i, j int) { rs[i], rs[j] = rs[j], rs[i] }
+func (rs rangesByKey) Less(i, j int) bool {
+	return bytes.Compare(rs[i].Metadata().StartKey, rs[j].Metadata().StartKey) < 0
+}
+
+// A ReplicaChange describes the replicas to add to and remove from a
+// range.
+type ReplicaChange struct {
+	RangeID int64
+	Add     []Replica
+	Remove  []Replica
+}
+
+// RebalanceCandidates returns changes to the replicas of ranges led by
+// this store which bring them in line with their zone's replica
+// specification, or failing that, even out the disk usage of stores,
+// as gleaned from their gossiped capacities. Replicas on dead nodes
+// are replaced with replicas on live nodes. A range is rebalanced
+// according to the zone of its start key. Ranges whose zone can't be
+// satisfied are skipped. Without a raft transport, ranges don't
+// replicate, and without zone configs, they can't be placed, so no
+// changes are returned.
+func (s *Store) RebalanceCandidates() ([]ReplicaChange, error) {
+	if s.transport == nil {
+		return nil, nil
+	}
+	zones, err := s.gossipedZones()
+	if zones == nil || err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	ranges := make([]*Range, 0, len(s.ranges))
+	for _, rng := range s.ranges {
+		ranges = append(ranges, rng)
+	}
+	s.mu.Unlock()
+	sort.Sort(rangesByKey(ranges))
+
+	var changes []ReplicaChange
+	for _, rng := range ranges {
+		if !rng.IsLeader() {
+			continue
+		}
+		meta := rng.Metadata()
+		self, ok := s.localReplica(meta)
+		if !ok {
+			continue
+		}
+		results, err := zones.splitRangeByPrefixes(meta.StartKey, meta.EndKey)
+		if err != nil {
+			return nil, err
+		}
+		add, remove, err := s.allocator.rebalance(results[0].config.(*ZoneConfig), meta.Replicas.Replicas, self)
+		if err != nil {
+			glog.V(1).Infof("unable to rebalance range %d: %v", meta.RangeID, err)
+			continue
+		}
+		if len(add) > 0 || len(remove) > 0 {
+			changes = append(changes, ReplicaChange{RangeID: meta.RangeID, Add: add, Remove: remove})
+		}
+	}
+	return changes, nil
+}
+
+// FollowerRanges returns the metadata of the ranges of which the
+// store holds replicas it doesn't lead, in key order.
+func (s *Store) FollowerRanges() []RangeMetadata {
+	s.mu.Lock()
+	ranges := make([]*Range, 0, len(s.ranges))
+	for _, rng := range s.ranges {
+		ranges = append(ranges, rng)
+	}
+	s.mu.Unlock()
+	sort.Sort(rangesByKey(ranges))
+	var metas []RangeMetadata
+	for _, rng := range ranges {
+		if !rng.IsLeader() {
+			metas = append(metas, rng.Metadata())
+		}
+	}
+	return metas
+}
+
+// localReplica returns the range's replica on this store, or false if
+// it has none.
+func (s *Store) localReplica(meta RangeMetadata) (Replica, bool) {
+	for _, replica := range meta.Replicas.Replicas {
+		if replica.NodeID == s.Ident.NodeID && replica.StoreID == s.Ident.StoreID {
+			return replica, true
+		}
+	}
+	return Replica{}, false
+}
+
+// ChangeReplicas replaces the replicas of the range with the specified
+// ID, which must be led by this store, with replicas. The change is
+// committed via the range's raft group. No two replicas may reside on
+// the same node, and at most one replica may be added or removed:
+// without joint consensus, only then must any majority of the old
+// replicas and any majority of the new overlap, so that no two
+// leaders can be elected or commit conflicting entries across the
+// change. Added replicas must already have been created on
+// their stores; see CreateReplica. Removed
+// replicas are left for the caller to remove; see RemoveReplica.
+// Updating range addressing records is also the caller's
+// responsibility. Returns the range's updated metadata.
+func (s *Store) ChangeReplicas(rangeID int64, replicas []Replica) (RangeMetadata, error) {
+	s.splitMu.Lock()
+	defer s.splitMu.Unlock()
+	if s.transport == nil {
+		return RangeMetadata{}, util.Errorf("store %s doesn't replicate ranges", s)
+	}
+	if err := verifyDistinctNodes(replicas); err != nil {
+		return RangeMetadata{}, err
+	}
+	rng, err := s.GetRange(rangeID)
+	if err != nil {
+		return RangeMetadata{}, err
+	}
+	self, ok := s.localReplica(rng.Metadata())
+	if !ok {
+		return RangeMetadata{}, util.Errorf("range %d has no replica on store %s", rangeID, s)
+	}
+	if n := replicasChanged(rng.Metadata().Replicas.Replicas, replicas); n > 1 {
+		return RangeMetadata{}, util.Errorf("change of range %d adds or removes %d replicas; at most one may change at a time", rangeID, n)
+	}
+	found := false
+	for _, replica := range replicas {
+		found = found || idOf(replica) == idOf(self)
+	}
+	if !found {
+		return RangeMetadata{}, util.Errorf("the leader's replica of range %d can't be removed", rangeID)
+	}
+	args := &InternalChangeReplicasRequest{RequestHeader: RequestHeader{Replica: self}, Replicas: replicas}
+	if err := <-rng.ReadWriteCmd("InternalChangeReplicas", args, &InternalChangeReplicasResponse{}); err != nil {
+		return RangeMetadata{}, err
+	}
+	return rng.Metadata(), nil
+}
+
+// replicasChanged returns the number of replicas added to or removed
+// from prev by next.
+func replicasChanged(prev, next []Replica) int {
+	ids := map[replicaID]int{}
+	for _, replica := range prev {
+		ids[idOf(replica)]++
+	}
+	for _, replica := range next {
+		ids[idOf(replica)]--
+	}
+	changed := 0
+	for _, n := range ids {
+		if n != 0 {
+			changed++
+		}
+	}
+	return changed
+}
+
+// CreateReplica creates an empty replica of the range spanning
+// startKey to endKey on this store, which awaits a snapshot of the
+// range's data from its leader. The replicas of the range must
+// include one on this store, whose range ID is allocated by the
+// store. Fails if the store already holds a range beginning at
+// startKey, if two of the replicas reside on the same node, or if the
+// range's zone requires storage guarantees the store doesn't provide.
+// Returns the new replica.
+func (s *Store) CreateReplica(startKey, endKey Key, replicas []Replica) (Replica, error) {
+	s.splitMu.Lock()
+	defer s.splitMu.Unlock()
+	if s.rangeStartingAt(startKey) != nil {
+		return Replica{}, util.Errorf("store %s already holds a range beginning at %q", s, startKey)
+	}
+	if err := verifyDistinctNodes(replicas); err != nil {
+		return Replica{}, err
+	}
+	if err := s.checkStoragePolicy(startKey, endKey); err != nil {
+		return Replica{}, err
+	}
+	rangeID, err := s.allocateRangeID()
+	if err != nil {
+		return Replica{}, err
+	}
+	replicas = append([]Replica(nil), replicas...)
+	var self *Replica
+	for i := range replicas {
+		if replicas[i].NodeID == s.Ident.NodeID && replicas[i].StoreID == s.Ident.StoreID {
+			replicas[i].RangeID = rangeID
+			self = &replicas[i]
+		}
+	}
+	if self == nil {
+		return Replica{}, util.Errorf("replicas of range beginning at %q don't include store %s", startKey, s)
+	}
+	if _, err := s.addRange(rangeID, startKey, endKey, replicas); err != nil {
+		return Replica{}, err
+	}
+	return *self, nil
+}
+
+// RemoveReplica stops the range with the specified ID and removes it
+// and its replicated data from the store. The range must have been
+// removed from its raft group; a store can't remove a range it leads.
+func (s *Store) RemoveReplica(rangeID int64) error {
+	s.splitMu.Lock()
+	defer s.splitMu.Unlock()
+	rng, err := s.GetRange(rangeID)
+	if err != nil {
+		return err
+	}
+	if rng.IsLeader() {
+		return util.Errorf("range %d is led by store %s and can't be removed", rangeID, s)
+	}
+	s.mu.Lock()
+	delete(s.ranges, rangeID)
+	s.mu.Unlock()
+	rng.Stop()
+	rows, err := rng.replicatedRows(s.engine)
+	if err != nil {
+		return err
+	}
+	// The range's data and metadata are removed atomically, so that a
+	// crash can't leave its metadata without its data.
+	b := NewBatch(s.engine)
+	for _, kv := range rows {
+		b.del(kv.Key)
+	}
+	b.del(rangeGCKey(rangeID))
+	b.del(rangeLeaseKey(rangeID))
+	b.del(rangeStatsKey(rangeID))
+	b.del(rangeSubsumedKey(rangeID))
+	b.del(rangeKey(rangeID))
+	if err := clearResponseCache(b, s.engine, rangeID); err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+// RangeCount returns the number of ranges the store holds.
+func (s *Store) RangeCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.ranges)
+}
+
+// Stats returns the stats of the store's ranges, summed.
+func (s *Store) Stats() RangeStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var stats RangeStats
+	for _, rng := range s.ranges {
+		stats.add(rng.Stats())
+	}
+	return stats
+}
+
+// Descriptor returns a descriptor of the store, which resides on the
+// node with attributes node.
+func (s *Store) Descriptor(node NodeAttributes) (StoreDescriptor, error) {
+	capacity, err := s.Capacity()
+	if err != nil {
+		return StoreDescriptor{}, err
+	}
+	return StoreDescriptor{
+		StoreID:    s.Ident.StoreID,
+		Node:       node,
+		Capacity:   capacity,
+		RangeCount: s.RangeCount(),
+		Stats:      s.Stats(),
+		Encrypted:  s.Encrypted(),
+	}, nil
 }
 
 // Capacity returns the capacity of the underlying storage engine.
 func (s *Store) Capacity() (StoreCapacity, error) {
 	return s.engine.capacity()
 }
+
+// DebugScan returns up to max key/value pairs stored in the engine
+// from start to end, exactly as stored. Unlike Range.Scan, keys
+// outside of any range, such as the store ident, are included, and
+// reads are neither accounted nor decompressed.
+func (s *Store) DebugScan(start, end Key, max int64) ([]KeyValue, error) {
+	return s.engine.scan(start, end, max)
+}
+
+// VerifyUsage verifies the usage of each range in the store which
+// overlaps the span [start, end). See Range.VerifyUsage.
+func (s *Store) VerifyUsage(start, end Key, reconcile bool) ([]UsageDrift, error) {
+	s.mu.Lock()
+	var ranges []*Range
+	for _, rng := range s.ranges {
+		meta := rng.Metadata()
+		if bytes.Compare(meta.StartKey, end) < 0 && bytes.Compare(start, meta.EndKey) < 0 {
+			ranges = append(ranges, rng)
+		}
+	}
+	s.mu.Unlock()
+	var drift []UsageDrift
+	for _, rng := range ranges {
+		d, err := rng.VerifyUsage(reconcile)
+		if err != nil {
+			return nil, err
+		}
+		drift = append(drift, d...)
+	}
+	sort.Sort(usageDrifts(drift))
+	return drift, nil
+}
+
+// UsageReport returns per-account usage summed over all ranges in
+// the store.
+func (s *Store) UsageReport() UsageReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var reports []UsageReport
+	for _, rng := range s.ranges {
+		reports = append(reports, rng.UsageReport())
+	}
+	return MergeUsageReports(reports...)
+}
+
+// LeaderUsageReport is like UsageReport, but sums only ranges of
+// which the store's replica is the raft leader, so that each range is
+// counted once when reports are combined across stores.
+func (s *Store) LeaderUsageReport() UsageReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var reports []UsageReport
+	for _, rng := range s.ranges {
+		if rng.IsLeader() {
+			reports = append(reports, rng.UsageReport())
+		}
+	}
+	return MergeUsageReports(reports...)
+}
@@ -17,7 +17,14 @@
 
 package storage
 
-import "testing"
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+)
 
 var testIdent = StoreIdent{
 	ClusterID: "cluster",
@@ -88,3 +95,376 @@ func TestBootstrapOfNonEmptyStore(t *testing.T) {
 		t.Error("expected bootstrap error on non-empty store")
 	}
 }
+
+// TestStoreBootstrapInfo verifies gossip bootstrap info persists in
+// the store.
+func TestStoreBootstrapInfo(t *testing.T) {
+	engine := NewInMem(1 << 20)
+	store := NewStore(engine, nil)
+	defer store.Close()
+	var info gossip.BootstrapInfo
+	if err := store.ReadBootstrapInfo(&info); err != nil || len(info.Addresses) != 0 {
+		t.Fatalf("expected no bootstrap info; got %+v, %v", info, err)
+	}
+	addr, err := net.ResolveTCPAddr("tcp", "127.0.0.1:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WriteBootstrapInfo(&gossip.BootstrapInfo{Addresses: []net.Addr{addr}, Timestamp: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewStore(engine, nil).ReadBootstrapInfo(&info); err != nil || len(info.Addresses) != 1 ||
+		info.Addresses[0].String() != addr.String() || info.Timestamp != 1 {
+		t.Errorf("expected persisted bootstrap info; got %+v, %v", info, err)
+	}
+}
+
+// TestStoreSplitAndMerge verifies splitting a range and merging it
+// back, including persistence of range metadata across store init.
+func TestStoreSplitAndMerge(t *testing.T) {
+	engine := NewInMem(1 << 20)
+	store := NewStore(engine, nil)
+	defer store.Close()
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	replica := Replica{NodeID: testIdent.NodeID, StoreID: testIdent.StoreID, RangeID: 1}
+	rng, err := store.CreateRange(KeyMin, KeyMax, []Replica{replica})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify invalid split keys.
+	for _, key := range []Key{KeyMin, KeyMax, Key("\x00\x00a"), MakeKey(KeyMeta2Prefix, Key("a")), MakeKey(KeyConfigZonePrefix, Key("/db1"))} {
+		if _, err := store.SplitRange(rng.Metadata().RangeID, key, nil); err == nil {
+			t.Errorf("expected error splitting at key %q", key)
+		}
+	}
+
+	newRng, err := store.SplitRange(rng.Metadata().RangeID, Key("m"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, newMeta := rng.Metadata(), newRng.Metadata()
+	if !bytes.Equal(meta.EndKey, Key("m")) || !bytes.Equal(newMeta.StartKey, Key("m")) ||
+		!bytes.Equal(newMeta.EndKey, KeyMax) {
+		t.Errorf("unexpected range bounds after split: %+v, %+v", meta, newMeta)
+	}
+	if r := newMeta.Replicas.Replicas; len(r) != 1 || r[0].RangeID != newMeta.RangeID {
+		t.Errorf("expected new range replica to have range ID %d: %+v", newRng.Metadata().RangeID, r)
+	}
+
+	store2 := NewStore(engine, nil)
+	if err := store2.Init(); err != nil {
+		t.Fatal(err)
+	}
+	// Retrying the split returns the existing new range.
+	if r, err := store.SplitRange(rng.Metadata().RangeID, Key("m"), nil); err != nil || r != newRng {
+		t.Errorf("expected retried split to return new range: %v", err)
+	}
+
+	// Verify both ranges are initialized from the engine.
+	if r, err := store2.GetRange(newRng.Metadata().RangeID); err != nil || !bytes.Equal(r.Metadata().StartKey, Key("m")) {
+		t.Errorf("expected split range to be initialized: %v", err)
+	}
+	store2.Close()
+
+	// Merge and verify the subsumed range is removed.
+	subsumed, err := store.MergeRange(rng.Metadata().RangeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subsumed.RangeID != newRng.Metadata().RangeID {
+		t.Errorf("expected range %d subsumed; got %d", newRng.Metadata().RangeID, subsumed.RangeID)
+	}
+	if endKey := rng.Metadata().EndKey; !bytes.Equal(endKey, KeyMax) {
+		t.Errorf("expected merged range to end at KeyMax; got %q", endKey)
+	}
+	// Commands sent to the subsumed range fail rather than hang.
+	if err := <-newRng.ReadWriteCmd("Put", &PutRequest{Key: Key("z")}, &PutResponse{}); err == nil {
+		t.Error("expected error writing to subsumed range")
+	}
+	if _, err := store.GetRange(newRng.Metadata().RangeID); err == nil {
+		t.Error("expected subsumed range to be removed from store")
+	}
+	if ok, _, _ := getI(engine, rangeKey(newRng.Metadata().RangeID), nil); ok {
+		t.Error("expected subsumed range metadata to be deleted")
+	}
+	if _, err := store.MergeRange(rng.Metadata().RangeID); err == nil {
+		t.Error("expected error merging last range")
+	}
+}
+
+// TestStoreEncryptionRequired verifies an unencrypted store refuses
+// to create ranges overlapping zones which require encryption.
+func TestStoreEncryptionRequired(t *testing.T) {
+	g := gossip.New()
+	store := NewStore(NewInMem(1<<20), g)
+	defer store.Close()
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	zones := []*prefixConfig{
+		{KeyMin, &ZoneConfig{}},
+		{Key("/secure"), &ZoneConfig{EncryptionRequired: true}},
+	}
+	if err := g.AddInfo(gossip.KeyConfigZone, zones, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.CreateRange(Key("/a"), Key("/b"), nil); err != nil {
+		t.Errorf("expected range outside secure zone to be created; got %v", err)
+	}
+	if _, err := store.CreateRange(Key("/b"), Key("/z"), nil); err == nil {
+		t.Error("expected error creating range overlapping secure zone on unencrypted store")
+	}
+}
+
+// TestStoreMergeCandidates verifies adjacent ranges are selected for
+// merging only when both are smaller than their zone's minimum size
+// and lie within the same zone.
+func TestStoreMergeCandidates(t *testing.T) {
+	g := gossip.New()
+	store := NewStore(NewInMem(1<<20), g)
+	defer store.Close()
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	replica := Replica{NodeID: testIdent.NodeID, StoreID: testIdent.StoreID, RangeID: 1}
+	rng, err := store.CreateRange(KeyMin, KeyMax, []Replica{replica})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without zone configs, no ranges are merged.
+	if ids, err := store.MergeCandidates(); err != nil || len(ids) != 0 {
+		t.Errorf("expected no candidates without zones; got %v, %v", ids, err)
+	}
+	zones := []*prefixConfig{
+		{KeyMin, &ZoneConfig{RangeMinBytes: 100, RangeMaxBytes: 1000}},
+		{Key("/db2"), &ZoneConfig{RangeMinBytes: 100, RangeMaxBytes: 1000}},
+	}
+	if err := g.AddInfo(gossip.KeyConfigZone, zones, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// Ranges: [KeyMin, "/a"), ["/a", "/b"), ["/b", "/db2"), ["/db2", KeyMax).
+	var ranges []*Range
+	for _, key := range []Key{Key("/db2"), Key("/b"), Key("/a")} {
+		newRng, err := store.SplitRange(rng.Metadata().RangeID, key, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ranges = append([]*Range{newRng}, ranges...)
+	}
+	ranges = append([]*Range{rng}, ranges...)
+	// Fill the first range beyond the minimum size.
+	pr := &PutResponse{}
+	ranges[0].Put(&PutRequest{Key: Key("/0"), Value: Value{Bytes: make([]byte, 200)}}, pr)
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	ids, err := store.MergeCandidates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only ["/a", "/b") and ["/b", "/db2") are both underfull and in
+	// the same zone.
+	if len(ids) != 1 || ids[0] != ranges[1].Metadata().RangeID {
+		t.Errorf("expected range %d as only candidate; got %v", ranges[1].Metadata().RangeID, ids)
+	}
+	// A range whose successor was subsumed by a failed merge is a
+	// candidate regardless of size.
+	self := ranges[1].Metadata().Replicas.Replicas[0]
+	subsumeArgs := &InternalSubsumeRequest{RequestHeader: RequestHeader{Replica: self}}
+	if err := <-ranges[1].ReadWriteCmd("InternalSubsume", subsumeArgs, &InternalSubsumeResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if ids, err = store.MergeCandidates(); err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != ranges[0].Metadata().RangeID {
+		t.Errorf("expected range %d as only candidate; got %v", ranges[0].Metadata().RangeID, ids)
+	}
+}
+
+// TestStoreSplitCandidates verifies ranges larger than their zone's
+// maximum size are selected for splitting at a key which divides
+// their data roughly in half.
+func TestStoreSplitCandidates(t *testing.T) {
+	g := gossip.New()
+	store := NewStore(NewInMem(1<<20), g)
+	defer store.Close()
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	replica := Replica{NodeID: testIdent.NodeID, StoreID: testIdent.StoreID, RangeID: 1}
+	rng, err := store.CreateRange(KeyMin, KeyMax, []Replica{replica})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []Key{Key("a"), Key("b"), Key("c"), Key("d")} {
+		pr := &PutResponse{}
+		rng.Put(&PutRequest{Key: key, Value: Value{Bytes: make([]byte, 100)}}, pr)
+		if pr.Error != nil {
+			t.Fatal(pr.Error)
+		}
+	}
+	// Without zone configs, no ranges are split.
+	if splits, err := store.SplitCandidates(); err != nil || len(splits) != 0 {
+		t.Errorf("expected no candidates without zones; got %v, %v", splits, err)
+	}
+	zones := []*prefixConfig{{KeyMin, &ZoneConfig{RangeMaxBytes: 1 << 20}}}
+	if err := g.AddInfo(gossip.KeyConfigZone, zones, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if splits, err := store.SplitCandidates(); err != nil || len(splits) != 0 {
+		t.Errorf("expected no candidates under maximum size; got %v, %v", splits, err)
+	}
+	zones = []*prefixConfig{{KeyMin, &ZoneConfig{RangeMaxBytes: 200}}}
+	if err := g.AddInfo(gossip.KeyConfigZone, zones, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	splits, err := store.SplitCandidates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(splits) != 1 || splits[0].RangeID != rng.Metadata().RangeID {
+		t.Fatalf("expected range %d as only candidate; got %v", rng.Metadata().RangeID, splits)
+	}
+	if !bytes.Equal(splits[0].SplitKey, Key("b")) && !bytes.Equal(splits[0].SplitKey, Key("c")) {
+		t.Errorf("expected split near the middle of the range; got %q", splits[0].SplitKey)
+	}
+}
+
+// TestStoreRefreshZoneConfigs verifies only ranges overlapping zones
+// whose configs changed are reported on refresh.
+func TestStoreRefreshZoneConfigs(t *testing.T) {
+	g := gossip.New()
+	store := NewStore(NewInMem(1<<20), g)
+	defer store.Close()
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	replica := Replica{NodeID: testIdent.NodeID, StoreID: testIdent.StoreID, RangeID: 1}
+	rng, err := store.CreateRange(KeyMin, KeyMax, []Replica{replica})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Ranges: [KeyMin, "/db2"), ["/db2", KeyMax).
+	newRng, err := store.SplitRange(rng.Metadata().RangeID, Key("/db2"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids, err := store.RefreshZoneConfigs(); err != nil || len(ids) != 0 {
+		t.Errorf("expected no changes without zones; got %v, %v", ids, err)
+	}
+	zones := []*prefixConfig{
+		{KeyMin, &ZoneConfig{RangeMaxBytes: 1000}},
+		{Key("/db2"), &ZoneConfig{RangeMaxBytes: 1000}},
+	}
+	if err := g.AddInfo(gossip.KeyConfigZone, zones, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if ids, err := store.RefreshZoneConfigs(); err != nil || len(ids) != 2 {
+		t.Errorf("expected both ranges affected by new zones; got %v, %v", ids, err)
+	}
+	if ids, err := store.RefreshZoneConfigs(); err != nil || len(ids) != 0 {
+		t.Errorf("expected no changes on unchanged zones; got %v, %v", ids, err)
+	}
+	zones = []*prefixConfig{
+		{KeyMin, &ZoneConfig{RangeMaxBytes: 1000}},
+		{Key("/db2"), &ZoneConfig{RangeMaxBytes: 2000}},
+	}
+	if err := g.AddInfo(gossip.KeyConfigZone, zones, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := store.RefreshZoneConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != newRng.Metadata().RangeID {
+		t.Errorf("expected range %d as only affected range; got %v", newRng.Metadata().RangeID, ids)
+	}
+}
+
+// TestStoreReplicasOnDistinctNodes verifies a store refuses to create
+// or change to replicas of which two reside on the same node.
+func TestStoreReplicasOnDistinctNodes(t *testing.T) {
+	store := NewStore(NewInMem(1<<20), nil)
+	defer store.Close()
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	sameNode := []Replica{{NodeID: 1, StoreID: 1}, {NodeID: 1, StoreID: 2}}
+	if _, err := store.CreateReplica(Key("a"), Key("b"), sameNode); err == nil {
+		t.Error("expected error creating replica with two replicas on one node")
+	}
+	if err := verifyDistinctNodes([]Replica{{NodeID: 1, StoreID: 1}, {NodeID: 2, StoreID: 1}}); err != nil {
+		t.Errorf("expected replicas on distinct nodes to be accepted; got %v", err)
+	}
+	if err := verifyDistinctNodes(sameNode); err == nil {
+		t.Error("expected replicas on the same node to be refused")
+	}
+}
+
+// TestStoreReplicasChanged verifies the count of replicas a change
+// adds or removes, of which a store changes at most one at a time.
+func TestStoreReplicasChanged(t *testing.T) {
+	r1, r2, r3 := Replica{NodeID: 1, StoreID: 1}, Replica{NodeID: 2, StoreID: 1}, Replica{NodeID: 3, StoreID: 1}
+	testCases := []struct {
+		prev, next []Replica
+		expChanged int
+	}{
+		{[]Replica{r1, r2}, []Replica{r2, r1}, 0},
+		{[]Replica{r1}, []Replica{r1, r2}, 1},
+		{[]Replica{r1, r2}, []Replica{r1}, 1},
+		{[]Replica{r1}, []Replica{r1, r2, r3}, 2},
+		{[]Replica{r1, r2}, []Replica{r1, r3}, 2},
+	}
+	for i, test := range testCases {
+		if changed := replicasChanged(test.prev, test.next); changed != test.expChanged {
+			t.Errorf("%d: expected %d replicas changed; got %d", i, test.expChanged, changed)
+		}
+	}
+}
+
+// TestStoreSubsumedRange verifies a subsumed range refuses read-write
+// commands, including after the store restarts.
+func TestStoreSubsumedRange(t *testing.T) {
+	engine := NewInMem(1 << 20)
+	store := NewStore(engine, nil)
+	defer store.Close()
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	replica := Replica{NodeID: testIdent.NodeID, StoreID: testIdent.StoreID, RangeID: 1}
+	rng, err := store.CreateRange(KeyMin, KeyMax, []Replica{replica})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newRng, err := store.SplitRange(rng.Metadata().RangeID, Key("m"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	self := newRng.Metadata().Replicas.Replicas[0]
+	subsumeArgs := &InternalSubsumeRequest{RequestHeader: RequestHeader{Replica: self}}
+	if err := <-newRng.ReadWriteCmd("InternalSubsume", subsumeArgs, &InternalSubsumeResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if !newRng.Subsumed() {
+		t.Error("expected range to be subsumed")
+	}
+	put := &PutRequest{RequestHeader: RequestHeader{Replica: self}, Key: Key("n"), Value: Value{Bytes: []byte("value")}}
+	if err := <-newRng.ReadWriteCmd("Put", put, &PutResponse{}); err == nil {
+		t.Error("expected subsumed range to refuse put")
+	} else if _, ok := err.(*RangeSubsumedError); !ok {
+		t.Errorf("expected RangeSubsumedError; got %v", err)
+	}
+
+	store2 := NewStore(engine, nil)
+	if err := store2.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer store2.Close()
+	if r, err := store2.GetRange(newRng.Metadata().RangeID); err != nil || !r.Subsumed() {
+		t.Errorf("expected range to remain subsumed after restart: %v", err)
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// MaxTSBlockKeys bounds the keys returned by a single GetTSBlock, so
+// that reading a long time window doesn't buffer it all in one reply.
+const MaxTSBlockKeys = 1000
+
+// A TSResolution is a granularity at which time series are stored.
+// Counts are merged into slots of fixed duration, and the slots of
+// each series are stored in blocks of BlockSlots slots, one key per
+// block, so that a block is updated by a single AccumulateTS. Blocks
+// are deleted once Retention has passed since they ended.
+type TSResolution struct {
+	ID         byte          // Identifies the resolution in keys
+	Name       string        // Human-readable name, such as "10s"
+	Slot       time.Duration // Duration of each slot
+	BlockSlots int           // Slots per block
+	Retention  time.Duration // Age beyond which blocks are deleted
+}
+
+// BlockDuration returns the duration covered by each block.
+func (res TSResolution) BlockDuration() time.Duration {
+	return res.Slot * time.Duration(res.BlockSlots)
+}
+
+// BlockStart returns the start of the block containing the time ts,
+// in nanoseconds since the epoch.
+func (res TSResolution) BlockStart(ts int64) int64 {
+	return floorDiv(ts, int64(res.BlockDuration())) * int64(res.BlockDuration())
+}
+
+// SlotStart returns the start of the slot containing the time ts, in
+// nanoseconds since the epoch.
+func (res TSResolution) SlotStart(ts int64) int64 {
+	return floorDiv(ts, int64(res.Slot)) * int64(res.Slot)
+}
+
+// floorDiv returns a divided by the positive b, rounded towards
+// negative infinity.
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && a < 0 {
+		q--
+	}
+	return q
+}
+
+// TSResolutions are the resolutions at which time series are stored,
+// finest first. Each count recorded is merged into all of them, so
+// that coarser resolutions hold rollups of finer ones and outlive
+// them.
+var TSResolutions = []TSResolution{
+	{ID: 1, Name: "10s", Slot: 10 * time.Second, BlockSlots: 360, Retention: 48 * time.Hour},
+	{ID: 2, Name: "1m", Slot: 1 * time.Minute, BlockSlots: 1440, Retention: 30 * 24 * time.Hour},
+	{ID: 3, Name: "1h", Slot: 1 * time.Hour, BlockSlots: 720, Retention: 2 * 365 * 24 * time.Hour},
+}
+
+// LookupTSResolution returns the resolution with the specified name.
+func LookupTSResolution(name string) (TSResolution, error) {
+	for _, res := range TSResolutions {
+		if res.Name == name {
+			return res, nil
+		}
+	}
+	return TSResolution{}, util.Errorf("unknown time series resolution %q", name)
+}
+
+// tsSeriesPrefix returns the prefix of the keys of the blocks of the
+// time series name at resolution res.
+func tsSeriesPrefix(name string, res TSResolution) Key {
+	return MakeKey(KeyTimeSeriesPrefix, MakeKey(Key{res.ID}, MakeKey(Key(name), Key{0})))
+}
+
+// MakeTSKey returns the key of the block of the time series name at
+// resolution res which starts at blockStart, as the concatenation of
+// KeyTimeSeriesPrefix, the resolution's ID, the name, a zero byte and
+// the big-endian encoded block start. Names may not contain zero
+// bytes. Blocks of a series at a resolution sort by start time.
+func MakeTSKey(name string, res TSResolution, blockStart int64) Key {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(blockStart))
+	return MakeKey(tsSeriesPrefix(name, res), Key(buf[:]))
+}
+
+// DecodeTSKey returns the name, resolution and block start of the
+// time series block key, which was created by MakeTSKey.
+func DecodeTSKey(key Key) (string, TSResolution, int64, error) {
+	if !bytes.HasPrefix(key, KeyTimeSeriesPrefix) || len(key) < len(KeyTimeSeriesPrefix)+10 {
+		return "", TSResolution{}, 0, util.Errorf("key %q is not a time series block key", key)
+	}
+	suffix := key[len(KeyTimeSeriesPrefix):]
+	var res TSResolution
+	for _, r := range TSResolutions {
+		if r.ID == suffix[0] {
+			res = r
+		}
+	}
+	name := suffix[1 : len(suffix)-9]
+	if res.ID == 0 || suffix[len(suffix)-9] != 0 || bytes.IndexByte(name, 0) >= 0 {
+		return "", TSResolution{}, 0, util.Errorf("key %q is not a time series block key", key)
+	}
+	return string(name), res, int64(binary.BigEndian.Uint64(suffix[len(suffix)-8:])), nil
+}
+
+// encodeTSCounts encodes the counts of a time series, accumulated by
+// AccumulateTS, as a sequence of varints.
+func encodeTSCounts(counts []int64) []byte {
+	encoded := make([]byte, 0, len(counts)*binary.MaxVarintLen64)
+	buf := make([]byte, binary.MaxVarintLen64)
+	for _, c := range counts {
+		encoded = append(encoded, buf[:binary.PutVarint(buf, c)]...)
+	}
+	return encoded
+}
+
+// decodeTSCounts decodes the counts of the time series at key, which
+// were encoded by encodeTSCounts.
+func decodeTSCounts(key Key, encoded []byte) ([]int64, error) {
+	var counts []int64
+	for len(encoded) > 0 {
+		c, n := binary.Varint(encoded)
+		if n <= 0 {
+			return nil, util.Errorf("key %q is not a time series; invalid varint at offset %d", key, len(counts))
+		}
+		counts = append(counts, c)
+		encoded = encoded[n:]
+	}
+	return counts, nil
+}
+
+// pruneTimeSeries deletes the time series blocks held by the range
+// which ended more than their resolution's retention before now,
+// returning the number deleted. As a series' blocks sort by start
+// time, the scan skips to the next series at the first block
+// retained.
+func (r *Range) pruneTimeSeries(now int64) (int64, error) {
+	meta := r.Metadata()
+	start, end := KeyTimeSeriesPrefix, PrefixEndKey(KeyTimeSeriesPrefix)
+	if bytes.Compare(start, meta.StartKey) < 0 {
+		start = meta.StartKey
+	}
+	if bytes.Compare(end, meta.EndKey) > 0 {
+		end = meta.EndKey
+	}
+	var pruned int64
+	for bytes.Compare(start, end) < 0 {
+		kvs, err := r.engine.scan(start, end, gcBatchSize)
+		if err != nil {
+			return pruned, err
+		}
+		if len(kvs) == 0 {
+			break
+		}
+		next := MakeKey(kvs[len(kvs)-1].Key, Key{0})
+		for _, kv := range kvs {
+			name, res, blockStart, err := DecodeTSKey(kv.Key)
+			if err != nil {
+				continue
+			}
+			if blockStart+int64(res.BlockDuration()+res.Retention) > now {
+				next = PrefixEndKey(tsSeriesPrefix(name, res))
+				break
+			}
+			if err := r.deleteTSBlock(kv.Key); err != nil {
+				return pruned, err
+			}
+			pruned++
+		}
+		start = next
+	}
+	return pruned, nil
+}
+
+// deleteTSBlock deletes the time series block at key, excluding
+// writes meanwhile.
+func (r *Range) deleteTSBlock(key Key) error {
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+	r.usageMu.Lock()
+	defer r.usageMu.Unlock()
+	value, err := r.engine.get(key)
+	if err != nil || value.Bytes == nil {
+		return err
+	}
+	b := NewBatch(r.engine)
+	if err := b.del(key); err != nil {
+		return err
+	}
+	if err := r.commitBatch(b); err != nil {
+		return err
+	}
+	r.publishWrite(key, value, nil)
+	return nil
+}
+
+// Series returns the counts of the time series at reply.Keys[i].
+func (reply *GetTSBlockResponse) Series(i int) []int64 {
+	var start int
+	for _, l := range reply.Lengths[:i] {
+		start += int(l)
+	}
+	return reply.Counts[start : start+int(reply.Lengths[i])]
+}
@@ -0,0 +1,78 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// TestTSKeys verifies time series block keys round trip, sort by
+// block start and align blocks before the epoch.
+func TestTSKeys(t *testing.T) {
+	res := TSResolutions[0]
+	for _, blockStart := range []int64{0, int64(res.BlockDuration()), 1 << 62} {
+		name, decRes, decStart, err := DecodeTSKey(MakeTSKey("a.b", res, blockStart))
+		if err != nil || name != "a.b" || decRes != res || decStart != blockStart {
+			t.Errorf("expected a.b, %+v, %d; got %s, %+v, %d, %v", res, blockStart, name, decRes, decStart, err)
+		}
+	}
+	if bytes.Compare(MakeTSKey("a", res, 1), MakeTSKey("a", res, 2)) >= 0 {
+		t.Error("expected blocks of a series to sort by start")
+	}
+	if start := res.BlockStart(-1); start != -int64(res.BlockDuration()) {
+		t.Errorf("expected block before the epoch to start at %d; got %d", -int64(res.BlockDuration()), start)
+	}
+	for _, key := range []Key{Key("a"), KeyTimeSeriesPrefix, MakeKey(KeyTimeSeriesPrefix, Key("\x09a\x0012345678"))} {
+		if _, _, _, err := DecodeTSKey(key); err == nil {
+			t.Errorf("expected error decoding %q", key)
+		}
+	}
+}
+
+// TestRangePruneTimeSeries verifies garbage collection deletes time
+// series blocks past their resolution's retention, and only those.
+func TestRangePruneTimeSeries(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	now := time.Now().UnixNano()
+	fine, coarse := TSResolutions[0], TSResolutions[len(TSResolutions)-1]
+	old := now - int64(fine.Retention) - 2*int64(fine.BlockDuration())
+	keys := []Key{
+		MakeTSKey("a", fine, fine.BlockStart(old)),
+		MakeTSKey("a", fine, fine.BlockStart(now)),
+		MakeTSKey("b", fine, fine.BlockStart(old)),
+		MakeTSKey("b", coarse, coarse.BlockStart(old)),
+	}
+	for _, key := range keys {
+		reply := &AccumulateTSResponse{}
+		r.AccumulateTS(&AccumulateTSRequest{Key: key, Counts: []int64{1}}, reply)
+		if reply.Error != nil {
+			t.Fatal(reply.Error)
+		}
+	}
+	gc, err := r.GarbageCollect(now)
+	if err != nil || gc.TSBlocksPruned != 2 {
+		t.Fatalf("expected 2 blocks pruned; got %d, %v", gc.TSBlocksPruned, err)
+	}
+	for i, key := range keys {
+		v, _ := r.engine.get(key)
+		if exists := v.Bytes != nil; exists != (i == 1 || i == 3) {
+			t.Errorf("%d: expected block %q to exist: %t", i, key, !exists)
+		}
+	}
+}
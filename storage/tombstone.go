@@ -0,0 +1,474 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// keyRangeTombstonePrefix is the prefix for store-local keys holding
+// range tombstones. The key is the concatenation of the prefix and
+// the tombstone's start key; the value's bytes are its end key.
+var keyRangeTombstonePrefix = Key("\x00\x00\x00tombstone-")
+
+// rangeTombstoneMinRows is the number of rows beyond which
+// DeleteRange writes a range tombstone rather than deleting each row.
+// Var for testing.
+var rangeTombstoneMinRows = 1000
+
+// tombstoneScanBatch is the minimum number of rows read at a time by
+// scans which filter rows hidden by range tombstones.
+const tombstoneScanBatch = 100
+
+// rangeTombstoneKey returns the key of the range tombstone beginning
+// at start.
+func rangeTombstoneKey(start Key) Key {
+	return MakeKey(keyRangeTombstonePrefix, start)
+}
+
+// A rangeTombstone deletes the plain rows in [start, end), without
+// writing a deletion for each. Store-local keys, including the MVCC
+// versions and write intents of keys in the span, aren't affected.
+type rangeTombstone struct {
+	start, end Key
+}
+
+// contains returns whether key is within the tombstone's span.
+func (t rangeTombstone) contains(key Key) bool {
+	return bytes.Compare(t.start, key) <= 0 && bytes.Compare(key, t.end) < 0
+}
+
+// put returns the write of the tombstone.
+func (t rangeTombstone) put() engineWrite {
+	return engineWrite{key: rangeTombstoneKey(t.start), value: Value{Bytes: t.end}}
+}
+
+// del returns the deletion of the tombstone.
+func (t rangeTombstone) del() engineWrite {
+	return engineWrite{key: rangeTombstoneKey(t.start), del: true}
+}
+
+// decodeRangeTombstone decodes the range tombstone stored in kv.
+func decodeRangeTombstone(kv KeyValue) rangeTombstone {
+	return rangeTombstone{start: Key(kv.Key[len(keyRangeTombstonePrefix):]), end: kv.Value.Bytes}
+}
+
+// tombstonable returns whether the row at key is deleted by range
+// tombstones covering it: plain rows are, but store-local keys
+// aren't.
+func tombstonable(key Key) bool {
+	return !bytes.HasPrefix(key, keyLocalPrefix)
+}
+
+// rangeTombstones are sorted by start key and don't overlap.
+type rangeTombstones []rangeTombstone
+
+// loadRangeTombstones reads the range tombstones stored in engine.
+func loadRangeTombstones(engine Engine) (rangeTombstones, error) {
+	kvs, err := engine.scan(keyRangeTombstonePrefix, PrefixEndKey(keyRangeTombstonePrefix), 0)
+	if err != nil {
+		return nil, err
+	}
+	ts := make(rangeTombstones, len(kvs))
+	for i, kv := range kvs {
+		ts[i] = decodeRangeTombstone(kv)
+	}
+	return ts, nil
+}
+
+// covering returns the index of the tombstone whose span contains
+// key, or -1 if there is none.
+func (ts rangeTombstones) covering(key Key) int {
+	i := sort.Search(len(ts), func(i int) bool { return bytes.Compare(ts[i].start, key) > 0 }) - 1
+	if i >= 0 && ts[i].contains(key) {
+		return i
+	}
+	return -1
+}
+
+// hides returns whether the row at key is deleted by a tombstone.
+func (ts rangeTombstones) hides(key Key) bool {
+	return ts.covering(key) >= 0 && tombstonable(key)
+}
+
+// remove removes the tombstone at index i.
+func (ts rangeTombstones) remove(i int) rangeTombstones {
+	return append(ts[:i], ts[i+1:]...)
+}
+
+// insert adds t, which mustn't overlap another tombstone.
+func (ts rangeTombstones) insert(t rangeTombstone) rangeTombstones {
+	i := sort.Search(len(ts), func(i int) bool { return bytes.Compare(ts[i].start, t.start) > 0 })
+	ts = append(ts, rangeTombstone{})
+	copy(ts[i+1:], ts[i:])
+	ts[i] = t
+	return ts
+}
+
+// tombstoneEngine is an Engine which supports range tombstones,
+// stored as rows under keyRangeTombstonePrefix. Reads filter the rows
+// tombstones hide; writes of a hidden key split the tombstone around
+// it, and writes of overlapping or adjacent tombstones merge them.
+// The hidden rows remain in the underlying engine until removed by
+// compact.
+type tombstoneEngine struct {
+	Engine
+	// mu serializes writes, which read the tombstones they modify.
+	mu sync.Mutex
+}
+
+// newTombstoneEngine returns an engine supporting range tombstones
+// stored in engine.
+func newTombstoneEngine(engine Engine) *tombstoneEngine {
+	return &tombstoneEngine{Engine: engine}
+}
+
+// String formats the underlying engine for debug output.
+func (te *tombstoneEngine) String() string {
+	return fmt.Sprint(te.Engine)
+}
+
+// Encrypted returns whether the underlying engine encrypts data at
+// rest.
+func (te *tombstoneEngine) Encrypted() bool {
+	ee, ok := te.Engine.(EncryptedEngine)
+	return ok && ee.Encrypted()
+}
+
+// CompactRange compacts the underlying engine.
+func (te *tombstoneEngine) CompactRange(start, end Key) error {
+	return compactEngine(te.Engine, start, end)
+}
+
+// get returns the value for the given key, or nil if a tombstone
+// hides it.
+func (te *tombstoneEngine) get(key Key) (Value, error) {
+	value, err := te.Engine.get(key)
+	if err != nil || value.Bytes == nil || !tombstonable(key) {
+		return value, err
+	}
+	// The tombstone covering key, if any, is the last to start at or
+	// before it.
+	kvs, err := te.Engine.reverseScan(keyRangeTombstonePrefix, rangeTombstoneKey(MakeKey(key, Key{0})), 1)
+	if err != nil {
+		return Value{}, err
+	}
+	if len(kvs) > 0 && decodeRangeTombstone(kvs[0]).contains(key) {
+		return Value{}, nil
+	}
+	return value, nil
+}
+
+// scan returns up to max rows in [start, end) not hidden by a
+// tombstone.
+func (te *tombstoneEngine) scan(start, end Key, max int64) ([]KeyValue, error) {
+	return te.filteredScan(start, end, max, false)
+}
+
+// reverseScan is like scan, but returns rows in descending key order.
+func (te *tombstoneEngine) reverseScan(start, end Key, max int64) ([]KeyValue, error) {
+	return te.filteredScan(start, end, max, true)
+}
+
+// filteredScan scans the underlying engine, dropping the rows hidden
+// by tombstones and scanning on until max rows remain or the span is
+// exhausted.
+func (te *tombstoneEngine) filteredScan(start, end Key, max int64, reverse bool) ([]KeyValue, error) {
+	scan := te.Engine.scan
+	if reverse {
+		scan = te.Engine.reverseScan
+	}
+	ts, err := loadRangeTombstones(te.Engine)
+	if err != nil {
+		return nil, err
+	}
+	if len(ts) == 0 {
+		return scan(start, end, max)
+	}
+	kvs := []KeyValue{}
+	for {
+		want := int64(0)
+		if max > 0 {
+			if want = max - int64(len(kvs)); want < tombstoneScanBatch {
+				want = tombstoneScanBatch
+			}
+		}
+		batch, err := scan(start, end, want)
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range batch {
+			if !ts.hides(kv.Key) {
+				kvs = append(kvs, kv)
+			}
+		}
+		if max > 0 && int64(len(kvs)) >= max {
+			return kvs[:max], nil
+		}
+		if want == 0 || int64(len(batch)) < want {
+			return kvs, nil
+		}
+		if last := batch[len(batch)-1].Key; reverse {
+			end = last
+		} else {
+			start = MakeKey(last, Key{0})
+		}
+	}
+}
+
+// put writes value to key, splitting the tombstone which hides it.
+func (te *tombstoneEngine) put(key Key, value Value) error {
+	return te.writeBatch([]engineWrite{{key: key, value: value}})
+}
+
+// del deletes key.
+func (te *tombstoneEngine) del(key Key) error {
+	return te.writeBatch([]engineWrite{{key: key, del: true}})
+}
+
+// writeBatch applies writes atomically, in order. The write of a
+// tombstone is merged with the tombstones it overlaps or adjoins; the
+// write of a key a tombstone hides splits the tombstone around it, so
+// that the key is visible.
+func (te *tombstoneEngine) writeBatch(writes []engineWrite) error {
+	te.mu.Lock()
+	defer te.mu.Unlock()
+	ts, err := loadRangeTombstones(te.Engine)
+	if err != nil {
+		return err
+	}
+	applied := make([]engineWrite, 0, len(writes))
+	for _, w := range writes {
+		switch {
+		case bytes.HasPrefix(w.key, keyRangeTombstonePrefix) && w.del:
+			t := decodeRangeTombstone(KeyValue{Key: w.key})
+			if i := ts.covering(t.start); i >= 0 && bytes.Equal(ts[i].start, t.start) {
+				ts = ts.remove(i)
+			}
+			applied = append(applied, w)
+		case bytes.HasPrefix(w.key, keyRangeTombstonePrefix):
+			t := decodeRangeTombstone(KeyValue{Key: w.key, Value: w.value})
+			if bytes.Compare(t.start, t.end) >= 0 {
+				continue
+			}
+			for i := 0; i < len(ts); {
+				if bytes.Compare(ts[i].start, t.end) > 0 || bytes.Compare(ts[i].end, t.start) < 0 {
+					i++
+					continue
+				}
+				// Absorb the overlapping or adjacent tombstone.
+				if bytes.Compare(ts[i].start, t.start) < 0 {
+					t.start = ts[i].start
+				}
+				if bytes.Compare(ts[i].end, t.end) > 0 {
+					t.end = ts[i].end
+				}
+				applied = append(applied, ts[i].del())
+				ts = ts.remove(i)
+			}
+			ts = ts.insert(t)
+			applied = append(applied, t.put())
+		case !w.del && tombstonable(w.key):
+			if i := ts.covering(w.key); i >= 0 {
+				t := ts[i]
+				ts = ts.remove(i)
+				applied = append(applied, t.del())
+				if before := (rangeTombstone{t.start, w.key}); bytes.Compare(before.start, before.end) < 0 {
+					ts = ts.insert(before)
+					applied = append(applied, before.put())
+				}
+				if after := (rangeTombstone{MakeKey(w.key, Key{0}), t.end}); bytes.Compare(after.start, after.end) < 0 {
+					ts = ts.insert(after)
+					applied = append(applied, after.put())
+				}
+			}
+			applied = append(applied, w)
+		default:
+			applied = append(applied, w)
+		}
+	}
+	return te.Engine.writeBatch(applied)
+}
+
+// newSnapshot returns a snapshot of the underlying engine, whose reads
+// filter the rows hidden by the tombstones as of the snapshot.
+func (te *tombstoneEngine) newSnapshot() Snapshot {
+	snap := te.Engine.newSnapshot()
+	return &tombstoneSnapshot{tombstoneEngine: newTombstoneEngine(snap), snap: snap}
+}
+
+// newIterator returns an iterator which skips the rows hidden by
+// tombstones, as read via the iterator itself.
+func (te *tombstoneEngine) newIterator() Iterator {
+	it := te.Engine.newIterator()
+	kvs, err := iterScan(it, keyRangeTombstonePrefix, PrefixEndKey(keyRangeTombstonePrefix), 0)
+	if err != nil {
+		it.close()
+		return &sliceIterator{pos: -1, failure: err}
+	}
+	ts := make(rangeTombstones, len(kvs))
+	for i, kv := range kvs {
+		ts[i] = decodeRangeTombstone(kv)
+	}
+	return &tombstoneIterator{Iterator: it, tombstones: ts}
+}
+
+// compact deletes up to max rows hidden by the tombstones which
+// overlap [start, end), removing from the tombstones the parts of the
+// span it has cleared; parts of tombstones beyond the span are kept.
+// Reads are unaffected, as the rows deleted were hidden. Returns the
+// number of rows deleted and whether the span was cleared of
+// tombstones. max bounds the rows read, including those which
+// tombstones don't hide, and must be positive.
+func (te *tombstoneEngine) compact(start, end Key, max int64) (int64, bool, error) {
+	te.mu.Lock()
+	defer te.mu.Unlock()
+	ts, err := loadRangeTombstones(te.Engine)
+	if err != nil {
+		return 0, false, err
+	}
+	var writes []engineWrite
+	var deleted, scanned int64
+	done := true
+	for _, t := range ts {
+		lo, hi := t.start, t.end
+		if bytes.Compare(lo, start) < 0 {
+			lo = start
+		}
+		if bytes.Compare(hi, end) > 0 {
+			hi = end
+		}
+		if bytes.Compare(lo, hi) >= 0 {
+			continue
+		}
+		if scanned >= max {
+			done = false
+			break
+		}
+		kvs, err := te.Engine.scan(lo, hi, max-scanned)
+		if err != nil {
+			return 0, false, err
+		}
+		scanned += int64(len(kvs))
+		for _, kv := range kvs {
+			if tombstonable(kv.Key) {
+				writes = append(writes, engineWrite{key: kv.Key, del: true})
+				deleted++
+			}
+		}
+		resume := hi
+		if scanned >= max && len(kvs) > 0 {
+			resume = MakeKey(kvs[len(kvs)-1].Key, Key{0})
+		}
+		// Replace the tombstone with its parts outside [lo, resume).
+		writes = append(writes, t.del())
+		if bytes.Compare(t.start, lo) < 0 {
+			writes = append(writes, rangeTombstone{t.start, lo}.put())
+		}
+		if bytes.Compare(resume, t.end) < 0 {
+			writes = append(writes, rangeTombstone{resume, t.end}.put())
+		}
+		if bytes.Compare(resume, hi) < 0 {
+			done = false
+			break
+		}
+	}
+	if len(writes) == 0 {
+		return 0, done, nil
+	}
+	return deleted, done, te.Engine.writeBatch(writes)
+}
+
+// A tombstoneSnapshot is a snapshot of a tombstoneEngine.
+type tombstoneSnapshot struct {
+	*tombstoneEngine
+	snap Snapshot // Snapshot of the underlying engine
+}
+
+// close releases the snapshot of the underlying engine.
+func (s *tombstoneSnapshot) close() {
+	s.snap.close()
+}
+
+// A tombstoneIterator skips the rows hidden by tombstones.
+type tombstoneIterator struct {
+	Iterator
+	tombstones rangeTombstones
+}
+
+// seek positions the iterator at the first visible row at or after
+// key.
+func (it *tombstoneIterator) seek(key Key) {
+	it.Iterator.seek(key)
+	it.skip(false)
+}
+
+// seekToLast positions the iterator at the last visible row.
+func (it *tombstoneIterator) seekToLast() {
+	it.Iterator.seekToLast()
+	it.skip(true)
+}
+
+// next steps to the following visible row.
+func (it *tombstoneIterator) next() {
+	it.Iterator.next()
+	it.skip(false)
+}
+
+// prev steps to the preceding visible row.
+func (it *tombstoneIterator) prev() {
+	it.Iterator.prev()
+	it.skip(true)
+}
+
+// skip steps forwards, or backwards if reverse, past hidden rows.
+func (it *tombstoneIterator) skip(reverse bool) {
+	for it.Iterator.valid() && it.tombstones.hides(it.Iterator.key()) {
+		if reverse {
+			it.Iterator.prev()
+		} else {
+			it.Iterator.next()
+		}
+	}
+}
+
+// compactTombstones deletes the rows hidden by range tombstones within
+// [start, end), reading up to max rows, or all if max is zero, in
+// batches of gcBatchSize. Returns the number of rows deleted and
+// whether the span was cleared of tombstones.
+func (r *Range) compactTombstones(start, end Key, max int64) (int64, bool, error) {
+	te, ok := r.engine.(*tombstoneEngine)
+	if !ok {
+		return 0, true, nil
+	}
+	var deleted int64
+	for scanned := int64(0); max == 0 || scanned < max; {
+		batch := int64(gcBatchSize)
+		if max > 0 && max-scanned < batch {
+			batch = max - scanned
+		}
+		n, done, err := te.compact(start, end, batch)
+		deleted += n
+		scanned += batch
+		if err != nil || done {
+			return deleted, done, err
+		}
+	}
+	return deleted, false, nil
+}
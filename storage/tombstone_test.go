@@ -0,0 +1,248 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// scanKeys returns the keys of the rows of engine in [start, end),
+// reversed if reverse.
+func scanKeys(t *testing.T, engine Engine, start, end Key, reverse bool) []string {
+	scan := engine.scan
+	if reverse {
+		scan = engine.reverseScan
+	}
+	kvs, err := scan(start, end, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for _, kv := range kvs {
+		keys = append(keys, string(kv.Key))
+	}
+	return keys
+}
+
+// tombstoneSpans returns the spans of the range tombstones of engine.
+func tombstoneSpans(t *testing.T, engine Engine) []rangeTombstone {
+	ts, err := loadRangeTombstones(engine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+// TestTombstoneEngine verifies reads filter the plain rows hidden by
+// range tombstones, that writes of hidden keys split tombstones and
+// that overlapping tombstones merge.
+func TestTombstoneEngine(t *testing.T) {
+	raw := NewInMem(1 << 20)
+	te := newTombstoneEngine(raw)
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		if err := te.put(Key(key), Value{Bytes: []byte("value")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := te.put(rangeTombstoneKey(Key("b")), Value{Bytes: []byte("e")}); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []string{"a", "e"}
+	if keys := scanKeys(t, te, Key("a"), KeyMax, false); !reflect.DeepEqual(keys, exp) {
+		t.Errorf("expected keys %q; got %q", exp, keys)
+	}
+	if keys := scanKeys(t, te, Key("a"), KeyMax, true); !reflect.DeepEqual(keys, []string{"e", "a"}) {
+		t.Errorf("expected reversed keys; got %q", keys)
+	}
+	if kvs, err := te.scan(Key("a"), KeyMax, 2); err != nil || len(kvs) != 2 || string(kvs[1].Key) != "e" {
+		t.Errorf("expected 2 visible rows; got %v, %v", kvs, err)
+	}
+	for key, visible := range map[string]bool{"a": true, "b": false, "c": false, "d": false, "e": true} {
+		if value, err := te.get(Key(key)); err != nil || (value.Bytes != nil) != visible {
+			t.Errorf("%s: expected visible=%t; got %q, %v", key, visible, value.Bytes, err)
+		}
+	}
+	if value, err := raw.get(Key("c")); err != nil || value.Bytes == nil {
+		t.Errorf("expected hidden row to remain in underlying engine; got %q, %v", value.Bytes, err)
+	}
+
+	it := te.newIterator()
+	kvs, err := iterScan(it, Key("a"), KeyMax, 0)
+	it.close()
+	if err != nil || len(kvs) != len(exp) {
+		t.Errorf("expected iterator to skip hidden rows; got %v, %v", kvs, err)
+	}
+
+	// A snapshot filters the rows hidden as of its creation.
+	snap := te.newSnapshot()
+	defer snap.close()
+	if err := te.put(Key("c"), Value{Bytes: []byte("new")}); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := snap.get(Key("c")); err != nil || value.Bytes != nil {
+		t.Errorf("expected snapshot to hide c; got %q, %v", value.Bytes, err)
+	}
+	if value, err := te.get(Key("c")); err != nil || string(value.Bytes) != "new" {
+		t.Errorf("expected rewritten key visible; got %q, %v", value.Bytes, err)
+	}
+	expTS := []rangeTombstone{{Key("b"), Key("c")}, {Key("c\x00"), Key("e")}}
+	if ts := tombstoneSpans(t, raw); !reflect.DeepEqual(ts, expTS) {
+		t.Errorf("expected split tombstones %q; got %q", expTS, ts)
+	}
+
+	// Tombstones overlapping or adjoining a new one merge with it.
+	if err := te.put(rangeTombstoneKey(Key("a")), Value{Bytes: []byte("b")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := te.put(rangeTombstoneKey(Key("d")), Value{Bytes: []byte("f")}); err != nil {
+		t.Fatal(err)
+	}
+	expTS = []rangeTombstone{{Key("a"), Key("c")}, {Key("c\x00"), Key("f")}}
+	if ts := tombstoneSpans(t, raw); !reflect.DeepEqual(ts, expTS) {
+		t.Errorf("expected merged tombstones %q; got %q", expTS, ts)
+	}
+	exp = []string{"c"}
+	if keys := scanKeys(t, te, Key("a"), KeyMax, false); !reflect.DeepEqual(keys, exp) {
+		t.Errorf("expected keys %q; got %q", exp, keys)
+	}
+}
+
+// TestTombstoneEngineCompact verifies compaction deletes hidden rows
+// in bounded steps, trimming the tombstones as it goes, and leaves
+// the parts of tombstones beyond its span.
+func TestTombstoneEngineCompact(t *testing.T) {
+	raw := NewInMem(1 << 20)
+	te := newTombstoneEngine(raw)
+	for i := 0; i < 10; i++ {
+		if err := te.put(Key(fmt.Sprintf("k%d", i)), Value{Bytes: []byte("value")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := te.put(rangeTombstoneKey(Key("k")), Value{Bytes: []byte("l")}); err != nil {
+		t.Fatal(err)
+	}
+	var deleted int64
+	for steps := 0; ; steps++ {
+		if steps > 10 {
+			t.Fatal("expected compaction to finish")
+		}
+		n, done, err := te.compact(KeyMin, Key("k8"), 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deleted += n
+		if done {
+			break
+		}
+	}
+	if deleted != 8 {
+		t.Errorf("expected 8 rows deleted; got %d", deleted)
+	}
+	if keys := scanKeys(t, raw, Key("k"), Key("l"), false); !reflect.DeepEqual(keys, []string{"k8", "k9"}) {
+		t.Errorf("expected rows beyond the span to remain; got %q", keys)
+	}
+	exp := []rangeTombstone{{Key("k8"), Key("l")}}
+	if ts := tombstoneSpans(t, raw); !reflect.DeepEqual(ts, exp) {
+		t.Errorf("expected tombstones %q; got %q", exp, ts)
+	}
+	if keys := scanKeys(t, te, Key("k"), Key("l"), false); len(keys) != 0 {
+		t.Errorf("expected no visible rows; got %q", keys)
+	}
+}
+
+// TestRangeDeleteRange verifies DeleteRange deletes small spans row
+// by row and large spans with a range tombstone, keeping the range's
+// stats, and that garbage collection removes the hidden rows.
+func TestRangeDeleteRange(t *testing.T) {
+	defer func(n int) { rangeTombstoneMinRows = n }(rangeTombstoneMinRows)
+	rangeTombstoneMinRows = 5
+	defer func(n int) { gcMaxRowsPerPass = n }(gcMaxRowsPerPass)
+	gcMaxRowsPerPass = 4
+	engine := createTestEngine(t)
+	r, _ := createTestRange(engine, t)
+	defer r.Stop()
+	write := func(prefix string, n int) {
+		for i := 0; i < n; i++ {
+			pr := &PutResponse{}
+			r.Put(&PutRequest{Key: Key(fmt.Sprintf("%s%d", prefix, i)), Value: Value{Bytes: []byte("value")}}, pr)
+			if pr.Error != nil {
+				t.Fatal(pr.Error)
+			}
+		}
+	}
+	deleteRange := func(start, end string) uint64 {
+		dr := &DeleteRangeResponse{}
+		r.DeleteRange(&DeleteRangeRequest{StartKey: Key(start), EndKey: Key(end)}, dr)
+		if dr.Error != nil {
+			t.Fatal(dr.Error)
+		}
+		return dr.NumDeleted
+	}
+	write("a", 3)
+	write("b", 10)
+	verifyStats(t, r, "written")
+
+	if n := deleteRange("a", "b"); n != 3 {
+		t.Errorf("expected 3 rows deleted; got %d", n)
+	}
+	if ts := tombstoneSpans(t, engine); len(ts) != 0 {
+		t.Errorf("expected small span deleted without a tombstone; got %q", ts)
+	}
+	if n := deleteRange("b", ""); n != 10 {
+		t.Errorf("expected 10 rows deleted; got %d", n)
+	}
+	exp := []rangeTombstone{{Key("b"), KeyMax}}
+	if ts := tombstoneSpans(t, engine); !reflect.DeepEqual(ts, exp) {
+		t.Errorf("expected tombstones %q; got %q", exp, ts)
+	}
+	gr := &GetResponse{}
+	r.Get(&GetRequest{Key: Key("b1")}, gr)
+	if gr.Error != nil || gr.Value.Bytes != nil {
+		t.Errorf("expected deleted key hidden; got %q, %v", gr.Value.Bytes, gr.Error)
+	}
+	if stats := verifyStats(t, r, "deleted"); stats.KeyCount != 3 {
+		// The test engine's three configs remain.
+		t.Errorf("expected 3 keys to remain; got %d", stats.KeyCount)
+	}
+	if n := deleteRange("b", ""); n != 0 {
+		t.Errorf("expected no rows deleted again; got %d", n)
+	}
+
+	var gc GCMetadata
+	for passes := 0; passes == 0 || gc.ResumeKey != nil; passes++ {
+		if passes > 10 {
+			t.Fatal("expected garbage collection to complete")
+		}
+		var err error
+		if gc, err = r.GarbageCollect(time.Now().UnixNano()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if gc.RowsCompacted != 10 {
+		t.Errorf("expected 10 rows compacted; got %+v", gc)
+	}
+	if ts := tombstoneSpans(t, engine); len(ts) != 0 {
+		t.Errorf("expected tombstones removed; got %q", ts)
+	}
+	if keys := scanKeys(t, engine, Key("b"), KeyMax, false); len(keys) != 0 {
+		t.Errorf("expected hidden rows deleted; got %q", keys)
+	}
+	verifyStats(t, r, "compacted")
+}
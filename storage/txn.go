@@ -0,0 +1,446 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// txnResolveDelay is the age beyond which the record of a committed
+// transaction is presumed to outlive a failed resolution of its write
+// intents, which garbage collection then retries; see UnresolvedTxns.
+const txnResolveDelay = 10 * time.Minute
+
+// TxnStatus is the status of a transaction.
+type TxnStatus int
+
+// Transaction statuses.
+const (
+	// TxnPending indicates the transaction hasn't ended. Transactions
+	// without a record are pending.
+	TxnPending TxnStatus = iota
+	// TxnCommitted indicates the transaction committed; its write
+	// intents become the values of their keys when resolved.
+	TxnCommitted
+	// TxnAborted indicates the transaction was aborted, either by its
+	// client or by a conflicting transaction which pushed it; its write
+	// intents are removed when resolved.
+	TxnAborted
+)
+
+// String implements the fmt.Stringer interface.
+func (s TxnStatus) String() string {
+	switch s {
+	case TxnPending:
+		return "pending"
+	case TxnCommitted:
+		return "committed"
+	case TxnAborted:
+		return "aborted"
+	}
+	return fmt.Sprintf("TxnStatus(%d)", int(s))
+}
+
+// A Transaction is the record of a transaction, stored at
+// TxnRecordKey(ID). The record is written when the transaction ends or
+// is aborted by a push, so the outcome of a transaction whose write
+// intents remain unresolved may be determined from it.
+//
+// Records are garbage collected intentAbandonAge after they're
+// written, by when requests blocked by the transaction's intents have
+// pushed it, or would abort it as abandoned were its record absent:
+// the records of aborted transactions regardless, and those of
+// committed transactions once their intents are resolved. See
+// InternalTxnResolved and pruneTxnRecords.
+type Transaction struct {
+	ID       string    `protobuf:"1"`
+	Priority int32     `protobuf:"2"`
+	Status   TxnStatus `protobuf:"3"`
+	// Timestamp is the commit timestamp of a committed transaction,
+	// and otherwise the time the record was written.
+	Timestamp int64 `protobuf:"4"`
+	// Keys are the keys of the write intents the transaction listed
+	// when it ended, which remain to be resolved while the record
+	// exists. Unset if the transaction was aborted by a push.
+	Keys []Key `protobuf:"5"`
+}
+
+// TxnRecordKey returns the key of the record of transaction txID.
+func TxnRecordKey(txID string) Key {
+	return MakeKey(KeyTxnPrefix, Key(txID))
+}
+
+// txnRecord returns the record of transaction txID. A transaction
+// without a record is pending, and is returned with priority and
+// timestamp as its own.
+func (r *Range) txnRecord(txID string, priority int32, timestamp int64) (Transaction, error) {
+	txn := Transaction{ID: txID, Priority: priority, Timestamp: timestamp}
+	if _, _, err := getI(r.engine, TxnRecordKey(txID), &txn); err != nil {
+		return Transaction{}, err
+	}
+	return txn, nil
+}
+
+// EndTransaction either commits or aborts (rolls back) an extant
+// transaction according to the args.Commit parameter, recording the
+// outcome in the transaction's record. A transaction which was aborted
+// by a push can't commit, and fails with a TransactionAbortedError.
+// Ending a transaction which already ended the same way succeeds, so
+// that the request may be retried. The write intents listed in
+// args.Keys are recorded with the outcome and resolved asynchronously
+// by the node, which then marks them resolved; see
+// InternalResolveIntent and InternalTxnResolved.
+func (r *Range) EndTransaction(args *EndTransactionRequest, reply *EndTransactionResponse) {
+	if len(args.Keys) > MaxTxnKeys {
+		reply.Error = &TxnTooLargeError{TxID: args.TxID, Keys: len(args.Keys)}
+		return
+	}
+	if args.TxID == "" {
+		reply.Error = util.Errorf("no transaction specified")
+		return
+	}
+	txn, err := r.txnRecord(args.TxID, args.TxnPriority, args.Timestamp)
+	if err != nil {
+		reply.Error = err
+		return
+	}
+	switch {
+	case txn.Status == TxnAborted && args.Commit:
+		reply.Error = &TransactionAbortedError{TxID: args.TxID}
+		return
+	case txn.Status == TxnCommitted && !args.Commit:
+		reply.Error = util.Errorf("transaction %q already committed", args.TxID)
+		return
+	case txn.Status == TxnPending:
+		txn.Status, txn.Timestamp, txn.Keys = TxnAborted, args.Timestamp, args.Keys
+		if args.Commit {
+			txn.Status = TxnCommitted
+		}
+		if reply.Error = r.putRecord(TxnRecordKey(args.TxID), &txn); reply.Error != nil {
+			return
+		}
+	}
+	if txn.Status == TxnCommitted {
+		reply.CommitTimestamp = txn.Timestamp
+	}
+}
+
+// InternalPushTxn pushes the transaction args.PusheeTxID on behalf of
+// a request blocked by one of its write intents. A pending pushee is
+// aborted if the pusher's priority is higher, or if its intent is
+// older than intentAbandonAge, in which case it's presumed abandoned
+// by its client. Otherwise the push fails with a TransactionPushError
+// and the pusher waits for the pushee to end, retrying the push.
+func (r *Range) InternalPushTxn(args *InternalPushTxnRequest, reply *InternalPushTxnResponse) {
+	txn, err := r.txnRecord(args.PusheeTxID, args.PusheePriority, args.PusheeTimestamp)
+	if err != nil {
+		reply.Error = err
+		return
+	}
+	if txn.Status == TxnPending {
+		abandoned := args.Timestamp != 0 && args.PusheeTimestamp+int64(intentAbandonAge) <= args.Timestamp
+		if args.TxnPriority <= txn.Priority && !abandoned {
+			reply.Error = &TransactionPushError{PusheeTxID: txn.ID, PusheePriority: txn.Priority}
+			return
+		}
+		txn.Status, txn.Timestamp = TxnAborted, args.Timestamp
+		if reply.Error = r.putRecord(TxnRecordKey(txn.ID), &txn); reply.Error != nil {
+			return
+		}
+	}
+	reply.Pushee = txn
+}
+
+// InternalResolveIntent resolves the write intent on args.Key of the
+// ended transaction args.IntentTxID, if any. A committed intent
+// becomes the key's latest committed version, retaining the version
+// it supersedes for reads at earlier timestamps; see MVCC. An aborted
+// intent is removed. Resolution is idempotent.
+func (r *Range) InternalResolveIntent(args *InternalResolveIntentRequest, reply *InternalResolveIntentResponse) {
+	if reply.Error = r.recordWrites(func(b *Batch, record func(key Key, before Value, after *Value)) error {
+		mvcc := NewMVCC(b)
+		meta, ok, err := mvcc.getMetadata(args.Key)
+		if err != nil || !ok || meta.TxnID != args.IntentTxID {
+			return err
+		}
+		before, err := b.get(args.Key)
+		if err != nil {
+			return err
+		}
+		if err := mvcc.resolveWriteIntent(args.Key, args.IntentTxID, args.Commit); err != nil || !args.Commit {
+			return err
+		}
+		after, err := b.get(args.Key)
+		if err != nil {
+			return err
+		}
+		if after.Bytes == nil {
+			record(args.Key, before, nil)
+		} else {
+			record(args.Key, before, &after)
+		}
+		return nil
+	}); reply.Error != nil {
+		return
+	}
+	if args.Commit {
+		r.configChanged(args.Key)
+	}
+}
+
+// InternalTxnResolved clears the keys listed in the record of the
+// ended transaction args.TxID, once their write intents have all been
+// resolved, so that the record may be garbage collected. A no-op if
+// the transaction has no record.
+func (r *Range) InternalTxnResolved(args *InternalTxnResolvedRequest, reply *InternalTxnResolvedResponse) {
+	var txn Transaction
+	ok, _, err := getI(r.engine, TxnRecordKey(args.TxID), &txn)
+	if err != nil || !ok || len(txn.Keys) == 0 {
+		reply.Error = err
+		return
+	}
+	txn.Keys = nil
+	reply.Error = r.putRecord(TxnRecordKey(args.TxID), &txn)
+}
+
+// UnresolvedTxns returns the records held by the range of
+// transactions which committed more than txnResolveDelay before now
+// and still list keys. Keys are normally cleared once their intents
+// are resolved, so these are of transactions whose intents their node
+// failed to resolve; see Node.garbageCollectRanges.
+func (r *Range) UnresolvedTxns(now int64) ([]Transaction, error) {
+	var txns []Transaction
+	err := r.visitTxnRecords(func(_ Key, txn Transaction) error {
+		if txn.Status == TxnCommitted && len(txn.Keys) > 0 && txn.Timestamp+int64(txnResolveDelay) <= now {
+			txns = append(txns, txn)
+		}
+		return nil
+	})
+	return txns, err
+}
+
+// pruneTxnRecords deletes the records held by the range of
+// transactions which ended more than intentAbandonAge before now,
+// returning the number deleted: aborted transactions, whose remaining
+// intents are then aborted as abandoned once pushed, as if the
+// records remained, and committed transactions whose intents have
+// been resolved.
+func (r *Range) pruneTxnRecords(now int64) (int64, error) {
+	prunable := func(txn Transaction) bool {
+		return txn.Timestamp+int64(intentAbandonAge) <= now &&
+			(txn.Status == TxnAborted || txn.Status == TxnCommitted && len(txn.Keys) == 0)
+	}
+	var pruned int64
+	err := r.visitTxnRecords(func(key Key, txn Transaction) error {
+		if !prunable(txn) {
+			return nil
+		}
+		r.applyMu.Lock()
+		defer r.applyMu.Unlock()
+		// The record is read again while writes are excluded, as a
+		// retried EndTransaction may have rewritten it.
+		var current Transaction
+		if ok, _, err := getI(r.engine, key, &current); err != nil || !ok || !prunable(current) {
+			return err
+		}
+		if err := r.deleteRecord(key); err != nil {
+			return err
+		}
+		pruned++
+		return nil
+	})
+	return pruned, err
+}
+
+// visitTxnRecords invokes visit with each transaction record held by
+// the range, in key order. Rows under KeyTxnPrefix which aren't
+// records are skipped.
+func (r *Range) visitTxnRecords(visit func(key Key, txn Transaction) error) error {
+	meta := r.Metadata()
+	start, end := KeyTxnPrefix, PrefixEndKey(KeyTxnPrefix)
+	if bytes.Compare(start, meta.StartKey) < 0 {
+		start = meta.StartKey
+	}
+	if bytes.Compare(end, meta.EndKey) > 0 {
+		end = meta.EndKey
+	}
+	for bytes.Compare(start, end) < 0 {
+		kvs, err := r.engine.scan(start, end, gcBatchSize)
+		if err != nil || len(kvs) == 0 {
+			return err
+		}
+		for _, kv := range kvs {
+			var txn Transaction
+			if err := gob.NewDecoder(bytes.NewBuffer(kv.Value.Bytes)).Decode(&txn); err != nil {
+				continue
+			}
+			if err := visit(kv.Key, txn); err != nil {
+				return err
+			}
+		}
+		start = MakeKey(kvs[len(kvs)-1].Key, Key{0})
+	}
+	return nil
+}
+
+// visitIntents invokes visit with each key in [start, end) which has
+// a write intent in engine, in key order, along with the intent's
+// metadata.
+func visitIntents(engine Engine, start, end Key, visit func(key Key, meta MVCCMetadata) error) error {
+	cursor, endKey := mvccMetadataKey(start), mvccSpanEnd(end)
+	for {
+		// A key's metadata precedes its versions, which are skipped.
+		kvs, err := engine.scan(cursor, endKey, 1)
+		if err != nil || len(kvs) == 0 {
+			return err
+		}
+		key, _, err := mvccDecodeKey(kvs[0].Key)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(kvs[0].Key, mvccMetadataKey(key)) {
+			meta, err := decodeMetadata(kvs[0].Value)
+			if err != nil {
+				return err
+			}
+			if err := visit(key, meta); err != nil {
+				return err
+			}
+		}
+		cursor = mvccVersionsEnd(key)
+	}
+}
+
+// appendIntents appends the write intents in the span covered by a
+// scan, as read from engine, to the intents reported in its reply.
+// The span ends where the scan stopped, if before args.EndKey, or
+// begins there if the scan is reversed, in which case the intents are
+// reported in reverse too.
+func appendIntents(engine Engine, args *ScanRequest, reply *ScanResponse) error {
+	start, end := args.StartKey, args.EndKey
+	full := args.MaxResults > 0 && int64(len(reply.Rows)) == args.MaxResults
+	switch {
+	case reply.ResumeKey != nil && args.Reverse:
+		start = reply.ResumeKey
+	case reply.ResumeKey != nil:
+		end = reply.ResumeKey
+	case full && args.Reverse:
+		start = reply.Rows[len(reply.Rows)-1].Key
+	case full:
+		end = MakeKey(reply.Rows[len(reply.Rows)-1].Key, Key{0})
+	}
+	first := len(reply.Intents)
+	if err := visitIntents(engine, start, end, func(key Key, meta MVCCMetadata) error {
+		reply.Intents = append(reply.Intents, meta.intentInfo(key))
+		return nil
+	}); err != nil {
+		return err
+	}
+	if args.Reverse {
+		for i, j := first, len(reply.Intents)-1; i < j; i, j = i+1, j-1 {
+			reply.Intents[i], reply.Intents[j] = reply.Intents[j], reply.Intents[i]
+		}
+	}
+	return nil
+}
+
+// checkIntent returns a WriteIntentError if a write of key by
+// transaction txID, if any, conflicts with another transaction's
+// write intent.
+func (r *Range) checkIntent(key Key, txID string) error {
+	meta, ok, err := NewMVCC(r.engine).getMetadata(key)
+	if err != nil || !ok || meta.TxnID == txID {
+		return err
+	}
+	return meta.intentError(key)
+}
+
+// writeIntent lays down a write intent of the transaction in header
+// on key, with value, or deleting the key if value is nil. The value
+// is stored as is, at its timestamp, so callers store it according to
+// the key's storage policies; it becomes the key's value if
+// committed. The intent is invisible to other transactions until
+// resolved.
+func (r *Range) writeIntent(header *RequestHeader, key Key, value *Value) error {
+	return r.writeIntents(header, func(b *Batch, txn *Transaction) error {
+		timestamp := header.Timestamp
+		if value != nil {
+			timestamp = value.Timestamp
+		}
+		_, err := writeVersion(b, key, value, r.openTimestamp(timestamp), txn)
+		return err
+	})
+}
+
+// writeIntents invokes write with a batch of writes to the range's
+// engine and the transaction in header, on whose behalf write lays
+// down write intents via writeVersion, and commits the batch
+// atomically once write succeeds.
+func (r *Range) writeIntents(header *RequestHeader, write func(b *Batch, txn *Transaction) error) error {
+	r.usageMu.Lock()
+	defer r.usageMu.Unlock()
+	b := r.newBatch()
+	if err := write(b, &Transaction{ID: header.TxID, Priority: header.TxnPriority}); err != nil {
+		return err
+	}
+	return r.commitBatch(b)
+}
+
+// updateIntent implements a read-modify-write of key within the
+// transaction in header. update is invoked with the value visible to
+// the transaction, its own write intent or else the key's latest
+// committed value, and returns the value to lay down as the
+// transaction's write intent, as stored. Fails with a
+// WriteIntentError if another transaction has an intent on key.
+func (r *Range) updateIntent(header *RequestHeader, key Key, update func(before Value) (*Value, error)) error {
+	before, err := r.readValue(&RequestHeader{TxID: header.TxID}, key)
+	if err != nil {
+		return err
+	}
+	value, err := update(before)
+	if err != nil {
+		return err
+	}
+	return r.writeIntent(header, key, value)
+}
+
+// writeVersion writes value to key as a version at timestamp via
+// MVCC, or a deletion if value is nil: on behalf of txn as a write
+// intent, if non-nil, and otherwise as the key's latest committed
+// version. A write older than the key's latest committed version is
+// moved past it, as its client meant to overwrite it. Returns the
+// value as written, or nil for deletions.
+func writeVersion(b *Batch, key Key, value *Value, timestamp int64, txn *Transaction) (*Value, error) {
+	mvcc := NewMVCC(b)
+	latest, err := mvcc.latestTimestamp(key)
+	if err != nil {
+		return nil, err
+	}
+	if latest > timestamp {
+		timestamp = latest + 1
+	}
+	if value == nil {
+		return nil, mvcc.write(key, timestamp, mvccVersion{Deleted: true}, txn)
+	}
+	written := *value
+	written.Timestamp = timestamp
+	return &written, mvcc.write(key, timestamp, mvccVersion{Value: written}, txn)
+}
@@ -0,0 +1,418 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// txnHeader returns a request header for transaction txID with
+// priority.
+func txnHeader(txID string, priority int32) RequestHeader {
+	return RequestHeader{TxID: txID, TxnPriority: priority, Timestamp: 10}
+}
+
+// TestRangeWriteIntents verifies transactional writes lay down write
+// intents visible only to their transaction, which conflict with
+// other reads and writes until resolved.
+func TestRangeWriteIntents(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	for _, key := range []string{"a", "b"} {
+		pr := &PutResponse{}
+		r.Put(&PutRequest{Key: Key(key), Value: Value{Bytes: []byte("old")}}, pr)
+		if pr.Error != nil {
+			t.Fatal(pr.Error)
+		}
+	}
+	pr := &PutResponse{}
+	r.Put(&PutRequest{RequestHeader: txnHeader("txn", 1), Key: Key("a"), Value: Value{Bytes: []byte("new")}}, pr)
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	dr := &DeleteResponse{}
+	r.Delete(&DeleteRequest{RequestHeader: txnHeader("txn", 1), Key: Key("b")}, dr)
+	if dr.Error != nil {
+		t.Fatal(dr.Error)
+	}
+
+	get := func(header RequestHeader, key string) (string, error) {
+		gr := &GetResponse{}
+		r.Get(&GetRequest{RequestHeader: header, Key: Key(key)}, gr)
+		return string(gr.Value.Bytes), gr.Error
+	}
+	if value, err := get(txnHeader("txn", 1), "a"); err != nil || value != "new" {
+		t.Errorf("expected transaction to read its intent; got %q, %v", value, err)
+	}
+	if value, err := get(txnHeader("txn", 1), "b"); err != nil || value != "" {
+		t.Errorf("expected transaction to read its deletion; got %q, %v", value, err)
+	}
+	if _, err := get(RequestHeader{}, "a"); err == nil {
+		t.Error("expected write intent error reading another transaction's intent")
+	} else if wiErr, ok := err.(*WriteIntentError); !ok || wiErr.TxnID != "txn" || wiErr.TxnPriority != 1 || wiErr.Timestamp != 10 {
+		t.Errorf("unexpected error %v", err)
+	}
+	// Reads preceding the intent aren't blocked by it.
+	if value, err := get(RequestHeader{Timestamp: 5}, "a"); err != nil || value != "old" {
+		t.Errorf("expected read preceding intent to succeed; got %q, %v", value, err)
+	}
+	pr = &PutResponse{}
+	if r.Put(&PutRequest{Key: Key("a"), Value: Value{Bytes: []byte("other")}}, pr); pr.Error == nil {
+		t.Error("expected write intent error writing key with another transaction's intent")
+	}
+	pr = &PutResponse{}
+	if r.Put(&PutRequest{RequestHeader: txnHeader("other", 2), Key: Key("a"), Value: Value{Bytes: []byte("other")}}, pr); pr.Error == nil {
+		t.Error("expected write intent error writing key with another transaction's intent")
+	}
+
+	// Committing replaces the values of the intents' keys.
+	er := &EndTransactionResponse{}
+	r.EndTransaction(&EndTransactionRequest{RequestHeader: txnHeader("txn", 1), Commit: true, Keys: []Key{Key("a"), Key("b")}}, er)
+	if er.Error != nil || er.CommitTimestamp != 10 {
+		t.Fatalf("expected commit at 10; got %d, %v", er.CommitTimestamp, er.Error)
+	}
+	for _, key := range []string{"a", "b"} {
+		rr := &InternalResolveIntentResponse{}
+		r.InternalResolveIntent(&InternalResolveIntentRequest{Key: Key(key), IntentTxID: "txn", Commit: true}, rr)
+		if rr.Error != nil {
+			t.Fatal(rr.Error)
+		}
+	}
+	if value, err := get(RequestHeader{}, "a"); err != nil || value != "new" {
+		t.Errorf("expected committed value; got %q, %v", value, err)
+	}
+	if value, err := get(RequestHeader{}, "b"); err != nil || value != "" {
+		t.Errorf("expected committed deletion; got %q, %v", value, err)
+	}
+
+	// Aborted intents are removed.
+	pr = &PutResponse{}
+	r.Put(&PutRequest{RequestHeader: txnHeader("txn2", 1), Key: Key("a"), Value: Value{Bytes: []byte("aborted")}}, pr)
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	rr := &InternalResolveIntentResponse{}
+	r.InternalResolveIntent(&InternalResolveIntentRequest{Key: Key("a"), IntentTxID: "txn2"}, rr)
+	if rr.Error != nil {
+		t.Fatal(rr.Error)
+	}
+	if value, err := get(RequestHeader{}, "a"); err != nil || value != "new" {
+		t.Errorf("expected value preceding aborted intent; got %q, %v", value, err)
+	}
+}
+
+// TestRangeScanIncludeIntents verifies a scan including intents
+// reports the write intents in its span in place of the rows storing
+// them, without counting them toward MaxResults.
+func TestRangeScanIncludeIntents(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	for _, key := range []string{"a", "b", "c"} {
+		pr := &PutResponse{}
+		r.Put(&PutRequest{Key: Key(key), Value: Value{Bytes: []byte("old")}}, pr)
+		if pr.Error != nil {
+			t.Fatal(pr.Error)
+		}
+	}
+	for _, key := range []string{"a", "b"} {
+		pr := &PutResponse{}
+		r.Put(&PutRequest{RequestHeader: txnHeader("txn", 1), Key: Key(key), Value: Value{Bytes: []byte("new")}}, pr)
+		if pr.Error != nil {
+			t.Fatal(pr.Error)
+		}
+	}
+
+	sr := &ScanResponse{}
+	r.Scan(&ScanRequest{StartKey: Key("a"), EndKey: Key("d"), MaxResults: 2, IncludeIntents: true}, sr)
+	if sr.Error != nil {
+		t.Fatal(sr.Error)
+	}
+	if len(sr.Rows) != 2 || string(sr.Rows[0].Key) != "a" || string(sr.Rows[1].Key) != "b" || string(sr.Rows[1].Value.Bytes) != "old" {
+		t.Errorf("expected committed values of a and b; got %+v", sr.Rows)
+	}
+	exp := []IntentInfo{
+		{Key: Key("a"), TxnID: "txn", TxnPriority: 1, Timestamp: 10},
+		{Key: Key("b"), TxnID: "txn", TxnPriority: 1, Timestamp: 10},
+	}
+	if !reflect.DeepEqual(sr.Intents, exp) {
+		t.Errorf("expected intents %+v; got %+v", exp, sr.Intents)
+	}
+
+	sr = &ScanResponse{}
+	r.Scan(&ScanRequest{StartKey: Key("a"), EndKey: Key("d"), Reverse: true, IncludeIntents: true}, sr)
+	if sr.Error != nil || len(sr.Rows) != 3 || len(sr.Intents) != 2 || string(sr.Intents[0].Key) != "b" {
+		t.Errorf("expected reverse scan to report intents in reverse; got %+v, %+v, %v", sr.Rows, sr.Intents, sr.Error)
+	}
+	sr = &ScanResponse{}
+	r.Scan(&ScanRequest{StartKey: Key("a"), EndKey: Key("d")}, sr)
+	if sr.Error != nil || len(sr.Intents) != 0 {
+		t.Errorf("expected no intents reported by default; got %+v, %v", sr.Intents, sr.Error)
+	}
+}
+
+// TestRangePushTxn verifies pushes abort pending transactions of lower
+// priority or with abandoned intents, and that aborted transactions
+// can't commit.
+func TestRangePushTxn(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	push := func(pusherPriority int32, now int64, pushee string, pusheePriority int32) (Transaction, error) {
+		reply := &InternalPushTxnResponse{}
+		r.InternalPushTxn(&InternalPushTxnRequest{
+			RequestHeader:   RequestHeader{TxnPriority: pusherPriority, Timestamp: now},
+			Key:             TxnRecordKey(pushee),
+			PusheeTxID:      pushee,
+			PusheePriority:  pusheePriority,
+			PusheeTimestamp: 10,
+		}, reply)
+		return reply.Pushee, reply.Error
+	}
+	endTxn := func(txID string, commit bool) error {
+		reply := &EndTransactionResponse{}
+		r.EndTransaction(&EndTransactionRequest{RequestHeader: txnHeader(txID, 2), Commit: commit}, reply)
+		return reply.Error
+	}
+
+	for _, priority := range []int32{1, 2} {
+		if _, err := push(priority, 20, "txn", 2); err == nil {
+			t.Fatalf("expected push of priority %d to fail", priority)
+		} else if _, ok := err.(*TransactionPushError); !ok {
+			t.Fatalf("expected transaction push error; got %v", err)
+		}
+	}
+	if txn, err := push(3, 20, "txn", 2); err != nil || txn.Status != TxnAborted {
+		t.Fatalf("expected push to abort; got %+v, %v", txn, err)
+	}
+	if err := endTxn("txn", true); err == nil {
+		t.Error("expected aborted transaction to fail to commit")
+	} else if _, ok := err.(*TransactionAbortedError); !ok {
+		t.Errorf("expected transaction aborted error; got %v", err)
+	}
+	if err := endTxn("txn", false); err != nil {
+		t.Errorf("expected aborted transaction to abort; got %v", err)
+	}
+
+	// Pushes of committed transactions return the record.
+	if err := endTxn("txn2", true); err != nil {
+		t.Fatal(err)
+	}
+	if txn, err := push(3, 20, "txn2", 2); err != nil || txn.Status != TxnCommitted {
+		t.Errorf("expected committed transaction; got %+v, %v", txn, err)
+	}
+	if err := endTxn("txn2", false); err == nil {
+		t.Error("expected committed transaction to fail to abort")
+	}
+
+	// A transaction whose intent was abandoned is aborted regardless of
+	// priority.
+	if txn, err := push(0, 10+int64(intentAbandonAge), "txn3", 2); err != nil || txn.Status != TxnAborted {
+		t.Errorf("expected push of abandoned transaction to abort; got %+v, %v", txn, err)
+	}
+}
+
+// TestRangeScanExcludesIntentRows verifies scans without a timestamp
+// or transaction return keys' committed values, never the rows
+// storing write intents under the MVCC prefix.
+func TestRangeScanExcludesIntentRows(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	pr := &PutResponse{}
+	r.Put(&PutRequest{Key: Key("a"), Value: Value{Bytes: []byte("old")}}, pr)
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	for _, key := range []string{"a", "b"} {
+		pr := &PutResponse{}
+		r.Put(&PutRequest{RequestHeader: txnHeader("txn", 1), Key: Key(key), Value: Value{Bytes: []byte("new")}}, pr)
+		if pr.Error != nil {
+			t.Fatal(pr.Error)
+		}
+	}
+	for _, args := range []*ScanRequest{
+		{StartKey: KeyMin, EndKey: KeyMax},
+		{StartKey: KeyMin, EndKey: KeyMax, MaxBytes: 1 << 20},
+		{StartKey: KeyMin, EndKey: KeyMax, Reverse: true},
+	} {
+		sr := &ScanResponse{}
+		r.Scan(args, sr)
+		if sr.Error != nil {
+			t.Fatal(sr.Error)
+		}
+		var found bool
+		for _, row := range sr.Rows {
+			if bytes.HasPrefix(row.Key, keyMVCCPrefix) {
+				t.Errorf("scan %+v returned intent row %q", args, row.Key)
+			}
+			if string(row.Key) == "b" {
+				t.Errorf("scan %+v returned uncommitted key b", args)
+			}
+			if string(row.Key) == "a" {
+				found = true
+				if string(row.Value.Bytes) != "old" {
+					t.Errorf("scan %+v expected committed value of a; got %q", args, row.Value.Bytes)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("scan %+v didn't return a", args)
+		}
+	}
+}
+
+// TestRangeTxnReadModifyWrites verifies increments, appends, time
+// series accumulations and bulk writes within a transaction lay down
+// write intents, updating the value visible to the transaction.
+func TestRangeTxnReadModifyWrites(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	pr := &PutResponse{}
+	r.Put(&PutRequest{Key: Key("b"), Value: Value{Bytes: []byte("x")}}, pr)
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	header := txnHeader("txn", 1)
+	for i, exp := range []int64{1, 3} {
+		ir := &IncrementResponse{}
+		r.Increment(&IncrementRequest{RequestHeader: header, Key: Key("a"), Increment: int64(i + 1)}, ir)
+		if ir.Error != nil || ir.NewValue != exp {
+			t.Fatalf("expected increment to %d; got %d, %v", exp, ir.NewValue, ir.Error)
+		}
+	}
+	ar := &AppendResponse{}
+	r.Append(&AppendRequest{RequestHeader: header, Key: Key("b"), Value: Value{Bytes: []byte("y")}}, ar)
+	if ar.Error != nil || ar.NewLength != 2 {
+		t.Fatalf("expected append to committed value; got %d, %v", ar.NewLength, ar.Error)
+	}
+	tr := &AccumulateTSResponse{}
+	r.AccumulateTS(&AccumulateTSRequest{RequestHeader: header, Key: Key("c"), Counts: []int64{1, 2}}, tr)
+	if tr.Error != nil {
+		t.Fatal(tr.Error)
+	}
+	bw := &InternalBulkWriteResponse{}
+	r.InternalBulkWrite(&InternalBulkWriteRequest{RequestHeader: header, Rows: []KeyValue{
+		{Key: Key("d"), Value: Value{Bytes: []byte("d")}},
+	}}, bw)
+	if bw.Error != nil || bw.Written != 1 {
+		t.Fatalf("expected bulk write of 1 row; got %d, %v", bw.Written, bw.Error)
+	}
+
+	keys := []Key{Key("a"), Key("b"), Key("c"), Key("d")}
+	for _, key := range keys {
+		gr := &GetResponse{}
+		if r.Get(&GetRequest{Key: key}, gr); gr.Error == nil {
+			t.Errorf("expected write intent error reading %q outside the transaction", key)
+		}
+		gr = &GetResponse{}
+		if r.Get(&GetRequest{RequestHeader: RequestHeader{Timestamp: 5}, Key: key}, gr); gr.Error != nil {
+			t.Errorf("expected read of %q preceding intent to succeed; got %v", key, gr.Error)
+		}
+	}
+	bw = &InternalBulkWriteResponse{}
+	r.InternalBulkWrite(&InternalBulkWriteRequest{Rows: []KeyValue{
+		{Key: Key("d"), Value: Value{Bytes: []byte("other")}},
+	}}, bw)
+	if _, ok := bw.Error.(*WriteIntentError); !ok {
+		t.Errorf("expected bulk write over intent to fail with write intent error; got %v", bw.Error)
+	}
+
+	for _, key := range keys {
+		rr := &InternalResolveIntentResponse{}
+		r.InternalResolveIntent(&InternalResolveIntentRequest{Key: key, IntentTxID: "txn", Commit: true}, rr)
+		if rr.Error != nil {
+			t.Fatal(rr.Error)
+		}
+	}
+	ir := &IncrementResponse{}
+	if r.Increment(&IncrementRequest{Key: Key("a")}, ir); ir.Error != nil || ir.NewValue != 3 {
+		t.Errorf("expected committed increment of 3; got %d, %v", ir.NewValue, ir.Error)
+	}
+	for key, exp := range map[string]string{"b": "xy", "d": "d"} {
+		gr := &GetResponse{}
+		if r.Get(&GetRequest{Key: Key(key)}, gr); gr.Error != nil || string(gr.Value.Bytes) != exp {
+			t.Errorf("expected committed value %q of %q; got %q, %v", exp, key, gr.Value.Bytes, gr.Error)
+		}
+	}
+	gr := &GetTSBlockResponse{}
+	if r.GetTSBlock(&GetTSBlockRequest{StartKey: Key("c"), EndKey: Key("c\x00")}, gr); gr.Error != nil || !reflect.DeepEqual(gr.Counts, []int64{1, 2}) {
+		t.Errorf("expected committed counts; got %v, %v", gr.Counts, gr.Error)
+	}
+}
+
+// TestRangeTxnRecordGC verifies ended transactions record their
+// intents' keys until marked resolved, and their records are garbage
+// collected once ended for intentAbandonAge: those of committed
+// transactions only once resolved.
+func TestRangeTxnRecordGC(t *testing.T) {
+	r, _ := createTestRange(createTestEngine(t), t)
+	defer r.Stop()
+	recordExists := func(txID string) bool {
+		ok, _, err := getI(r.engine, TxnRecordKey(txID), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	gc := func(now int64) {
+		if _, err := r.GarbageCollect(now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	er := &EndTransactionResponse{}
+	r.EndTransaction(&EndTransactionRequest{RequestHeader: txnHeader("txn", 1), Commit: true, Keys: []Key{Key("a")}}, er)
+	if er.Error != nil {
+		t.Fatal(er.Error)
+	}
+	if txns, err := r.UnresolvedTxns(10); err != nil || len(txns) != 0 {
+		t.Errorf("expected recently committed transaction to be skipped; got %+v, %v", txns, err)
+	}
+	txns, err := r.UnresolvedTxns(10 + int64(txnResolveDelay))
+	if err != nil || len(txns) != 1 || txns[0].ID != "txn" || !reflect.DeepEqual(txns[0].Keys, []Key{Key("a")}) {
+		t.Fatalf("expected unresolved transaction with its keys; got %+v, %v", txns, err)
+	}
+	// An unresolved transaction's record is retained.
+	if gc(10 + int64(intentAbandonAge)); !recordExists("txn") {
+		t.Fatal("expected record of unresolved transaction to be retained")
+	}
+	rr := &InternalTxnResolvedResponse{}
+	if r.InternalTxnResolved(&InternalTxnResolvedRequest{Key: TxnRecordKey("txn"), TxID: "txn"}, rr); rr.Error != nil {
+		t.Fatal(rr.Error)
+	}
+	if txns, err := r.UnresolvedTxns(10 + int64(txnResolveDelay)); err != nil || len(txns) != 0 {
+		t.Errorf("expected no unresolved transactions; got %+v, %v", txns, err)
+	}
+	if gc(10 + int64(intentAbandonAge)); recordExists("txn") {
+		t.Error("expected record of resolved transaction to be collected")
+	}
+
+	pr := &InternalPushTxnResponse{}
+	r.InternalPushTxn(&InternalPushTxnRequest{
+		RequestHeader: RequestHeader{TxnPriority: 2, Timestamp: 20},
+		Key:           TxnRecordKey("txn2"),
+		PusheeTxID:    "txn2",
+	}, pr)
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	if gc(19 + int64(intentAbandonAge)); !recordExists("txn2") {
+		t.Error("expected record of recently aborted transaction to be retained")
+	}
+	if gc(20 + int64(intentAbandonAge)); recordExists("txn2") {
+		t.Error("expected record of aborted transaction to be collected")
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// Package encoding provides order-preserving encodings of values for
+// use in keys. The encodings of values of the same type compare, as
+// byte strings, in the order of the values, and none is a prefix of
+// another, so that a composite key built by appending the encodings
+// of its components sorts by each component in turn. Each Encode
+// function appends the encoding of a value to a buffer; the matching
+// Decode function decodes a value from the start of a buffer,
+// returning the remainder of the buffer along with it.
+package encoding
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+const (
+	// escape is the byte which introduces escape sequences in encoded
+	// strings and byte slices.
+	escape byte = 0x00
+	// escapedZero follows escape to encode a zero byte.
+	escapedZero byte = 0xff
+	// terminator follows escape to end an encoded string or byte slice.
+	terminator byte = 0x01
+)
+
+// EncodeUint64 appends the encoding of v to b: eight bytes, big
+// endian.
+func EncodeUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// DecodeUint64 decodes a value encoded by EncodeUint64 from the start
+// of b.
+func DecodeUint64(b []byte) ([]byte, uint64, error) {
+	if len(b) < 8 {
+		return nil, 0, util.Errorf("insufficient bytes to decode uint64: %q", b)
+	}
+	return b[8:], binary.BigEndian.Uint64(b), nil
+}
+
+// EncodeUint64Decreasing appends the encoding of v to b such that
+// larger values sort first, for instance to order versions newest
+// first.
+func EncodeUint64Decreasing(b []byte, v uint64) []byte {
+	return EncodeUint64(b, ^v)
+}
+
+// DecodeUint64Decreasing decodes a value encoded by
+// EncodeUint64Decreasing from the start of b.
+func DecodeUint64Decreasing(b []byte) ([]byte, uint64, error) {
+	b, v, err := DecodeUint64(b)
+	return b, ^v, err
+}
+
+// EncodeInt64 appends the encoding of v to b: that of the unsigned
+// value with the sign bit flipped, so that negative values sort
+// before positive ones.
+func EncodeInt64(b []byte, v int64) []byte {
+	return EncodeUint64(b, uint64(v)^(1<<63))
+}
+
+// DecodeInt64 decodes a value encoded by EncodeInt64 from the start
+// of b.
+func DecodeInt64(b []byte) ([]byte, int64, error) {
+	b, v, err := DecodeUint64(b)
+	return b, int64(v ^ (1 << 63)), err
+}
+
+// EncodeBytes appends the encoding of data to b: data with each zero
+// byte escaped as 0x00 0xff, followed by the terminator 0x00 0x01.
+// The terminator sorts before any escaped byte, so that a slice sorts
+// before those it prefixes.
+func EncodeBytes(b []byte, data []byte) []byte {
+	for _, c := range data {
+		b = append(b, c)
+		if c == escape {
+			b = append(b, escapedZero)
+		}
+	}
+	return append(b, escape, terminator)
+}
+
+// DecodeBytes decodes a byte slice encoded by EncodeBytes from the
+// start of b.
+func DecodeBytes(b []byte) ([]byte, []byte, error) {
+	var data []byte
+	for i := 0; i < len(b); i++ {
+		if b[i] != escape {
+			data = append(data, b[i])
+			continue
+		}
+		if i+1 >= len(b) {
+			break
+		}
+		switch b[i+1] {
+		case escapedZero:
+			data = append(data, 0)
+			i++
+			continue
+		case terminator:
+			if data == nil {
+				data = []byte{}
+			}
+			return b[i+2:], data, nil
+		}
+		return nil, nil, util.Errorf("invalid escape sequence in encoded bytes: %q", b)
+	}
+	return nil, nil, util.Errorf("unterminated encoded bytes: %q", b)
+}
+
+// EncodeString appends the encoding of s to b, as for EncodeBytes.
+func EncodeString(b []byte, s string) []byte {
+	return EncodeBytes(b, []byte(s))
+}
+
+// DecodeString decodes a string encoded by EncodeString from the
+// start of b.
+func DecodeString(b []byte) ([]byte, string, error) {
+	b, data, err := DecodeBytes(b)
+	return b, string(data), err
+}
+
+// EncodeTimestamp appends the encoding of t to b: that of its
+// nanoseconds since the epoch, as for EncodeInt64. Timestamps are
+// encoded to nanosecond precision, without their locations, and must
+// lie between the years 1678 and 2262.
+func EncodeTimestamp(b []byte, t time.Time) []byte {
+	return EncodeInt64(b, t.UnixNano())
+}
+
+// DecodeTimestamp decodes a timestamp encoded by EncodeTimestamp from
+// the start of b, returning it in UTC.
+func DecodeTimestamp(b []byte) ([]byte, time.Time, error) {
+	b, nanos, err := DecodeInt64(b)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return b, time.Unix(0, nanos).UTC(), nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package encoding
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+)
+
+// verifyOrdered verifies each encoding sorts after the one before it.
+func verifyOrdered(t *testing.T, encodings [][]byte) {
+	for i := 1; i < len(encodings); i++ {
+		if bytes.Compare(encodings[i-1], encodings[i]) >= 0 {
+			t.Errorf("%d: expected %q to sort before %q", i, encodings[i-1], encodings[i])
+		}
+	}
+}
+
+// TestEncodeUint64 verifies uint64s round trip and sort in order,
+// increasing or decreasing.
+func TestEncodeUint64(t *testing.T) {
+	values := []uint64{0, 1, 255, 256, 1 << 32, math.MaxUint64 - 1, math.MaxUint64}
+	var inc, dec [][]byte
+	for _, v := range values {
+		enc := EncodeUint64([]byte("prefix"), v)
+		rest, decoded, err := DecodeUint64(enc[len("prefix"):])
+		if err != nil || decoded != v || len(rest) != 0 {
+			t.Errorf("%d: decoded %d, %q, %v", v, decoded, rest, err)
+		}
+		inc = append(inc, enc)
+		enc = EncodeUint64Decreasing(nil, v)
+		if _, decoded, err := DecodeUint64Decreasing(enc); err != nil || decoded != v {
+			t.Errorf("%d: decoded decreasing %d, %v", v, decoded, err)
+		}
+		dec = append([][]byte{enc}, dec...)
+	}
+	verifyOrdered(t, inc)
+	verifyOrdered(t, dec)
+	if _, _, err := DecodeUint64([]byte{1, 2, 3}); err == nil {
+		t.Error("expected error decoding short buffer")
+	}
+}
+
+// TestEncodeInt64 verifies int64s round trip and sort in order, with
+// negative values first.
+func TestEncodeInt64(t *testing.T) {
+	values := []int64{math.MinInt64, math.MinInt64 + 1, -1 << 32, -256, -1, 0, 1, 256, 1 << 32, math.MaxInt64}
+	var encodings [][]byte
+	for _, v := range values {
+		enc := EncodeInt64(nil, v)
+		if _, decoded, err := DecodeInt64(enc); err != nil || decoded != v {
+			t.Errorf("%d: decoded %d, %v", v, decoded, err)
+		}
+		encodings = append(encodings, enc)
+	}
+	verifyOrdered(t, encodings)
+}
+
+// TestEncodeString verifies strings, including those containing zero
+// bytes, round trip and sort in order, before the strings they
+// prefix.
+func TestEncodeString(t *testing.T) {
+	values := []string{"", "\x00", "\x00\x00", "\x00\x01", "\x00\xff", "a", "a\x00", "a\x00b", "a\x01", "ab", "b", "\xff"}
+	var encodings [][]byte
+	for _, v := range values {
+		enc := EncodeString(nil, v)
+		rest, decoded, err := DecodeString(append(enc, "rest"...))
+		if err != nil || decoded != v || string(rest) != "rest" {
+			t.Errorf("%q: decoded %q, %q, %v", v, decoded, rest, err)
+		}
+		encodings = append(encodings, enc)
+	}
+	verifyOrdered(t, encodings)
+	for _, invalid := range []string{"a", "a\x00", "a\x00\x02"} {
+		if _, _, err := DecodeString([]byte(invalid)); err == nil {
+			t.Errorf("%q: expected decoding error", invalid)
+		}
+	}
+}
+
+// TestEncodeComposite verifies composite keys sort by each component
+// in turn.
+func TestEncodeComposite(t *testing.T) {
+	key := func(s string, v int64) []byte {
+		return EncodeInt64(EncodeString(nil, s), v)
+	}
+	verifyOrdered(t, [][]byte{key("a", -1), key("a", 0), key("a", 10), key("a\x00", -5), key("ab", -10), key("b", 0)})
+	rest, s, err := DecodeString(key("a\x00b", -7))
+	if err != nil || s != "a\x00b" {
+		t.Fatalf("decoded %q, %v", s, err)
+	}
+	if _, v, err := DecodeInt64(rest); err != nil || v != -7 {
+		t.Errorf("decoded %d, %v", v, err)
+	}
+}
+
+// TestEncodeTimestamp verifies timestamps round trip and sort in
+// order, including those before the epoch.
+func TestEncodeTimestamp(t *testing.T) {
+	values := []time.Time{
+		time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Unix(0, 0),
+		time.Unix(0, 1),
+		time.Unix(1400000000, 999999999),
+		time.Date(2200, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	var encodings [][]byte
+	for _, v := range values {
+		enc := EncodeTimestamp(nil, v)
+		if _, decoded, err := DecodeTimestamp(enc); err != nil || !decoded.Equal(v) {
+			t.Errorf("%s: decoded %s, %v", v, decoded, err)
+		}
+		encodings = append(encodings, enc)
+	}
+	verifyOrdered(t, encodings)
+}
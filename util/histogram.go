@@ -0,0 +1,101 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package util
+
+import "time"
+
+// HistogramBounds are the inclusive upper bounds of the buckets in a
+// latency Histogram, doubling from 1ms to ~33s. Durations greater
+// than the final bound are counted in an overflow bucket.
+var HistogramBounds = func() []time.Duration {
+	var bounds []time.Duration
+	for d := time.Millisecond; d <= 32*time.Second; d *= 2 {
+		bounds = append(bounds, d)
+	}
+	return bounds
+}()
+
+// A Histogram records a distribution of durations in buckets with
+// exponentially increasing bounds. It is not safe for concurrent
+// access.
+type Histogram struct {
+	Count   int64         // Number of recorded durations
+	Sum     time.Duration // Sum of recorded durations
+	Max     time.Duration // Maximum recorded duration
+	Buckets []int64       // Counts by HistogramBounds, plus overflow
+}
+
+// Record adds the duration d to the histogram.
+func (h *Histogram) Record(d time.Duration) {
+	if h.Buckets == nil {
+		h.Buckets = make([]int64, len(HistogramBounds)+1)
+	}
+	h.Count++
+	h.Sum += d
+	if d > h.Max {
+		h.Max = d
+	}
+	i := 0
+	for ; i < len(HistogramBounds); i++ {
+		if d <= HistogramBounds[i] {
+			break
+		}
+	}
+	h.Buckets[i]++
+}
+
+// Mean returns the mean of recorded durations, or zero if none have
+// been recorded.
+func (h *Histogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// Quantile returns an upper bound on the duration below which the
+// fraction q of recorded durations fall. The bound is that of the
+// bucket containing the quantile, capped by the maximum recorded
+// duration.
+func (h *Histogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	target := int64(q*float64(h.Count) + 0.5)
+	if target < 1 {
+		target = 1
+	}
+	var seen int64
+	for i, count := range h.Buckets {
+		seen += count
+		if seen >= target && i < len(HistogramBounds) {
+			if HistogramBounds[i] < h.Max {
+				return HistogramBounds[i]
+			}
+			break
+		}
+	}
+	return h.Max
+}
+
+// Copy returns a deep copy of the histogram.
+func (h *Histogram) Copy() Histogram {
+	c := *h
+	if h.Buckets != nil {
+		c.Buckets = append([]int64(nil), h.Buckets...)
+	}
+	return c
+}
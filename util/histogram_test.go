@@ -0,0 +1,68 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := &Histogram{}
+	if h.Mean() != 0 || h.Quantile(0.5) != 0 {
+		t.Errorf("expected empty histogram to have zero mean and quantiles")
+	}
+	for i := 0; i < 90; i++ {
+		h.Record(500 * time.Microsecond)
+	}
+	for i := 0; i < 10; i++ {
+		h.Record(3 * time.Millisecond)
+	}
+	h.Record(time.Minute)
+
+	if h.Count != 101 {
+		t.Errorf("expected count 101; got %d", h.Count)
+	}
+	if h.Max != time.Minute {
+		t.Errorf("expected max of 1m; got %s", h.Max)
+	}
+	testData := []struct {
+		q   float64
+		exp time.Duration
+	}{
+		{0.5, time.Millisecond},
+		{0.95, 4 * time.Millisecond},
+		{1.0, time.Minute},
+	}
+	for i, test := range testData {
+		if q := h.Quantile(test.q); q != test.exp {
+			t.Errorf("%d: expected quantile %.2f to be %s; got %s", i, test.q, test.exp, q)
+		}
+	}
+	if overflow := h.Buckets[len(h.Buckets)-1]; overflow != 1 {
+		t.Errorf("expected one value in overflow bucket; got %d", overflow)
+	}
+}
+
+func TestHistogramCopy(t *testing.T) {
+	h := &Histogram{}
+	h.Record(time.Millisecond)
+	c := h.Copy()
+	h.Record(time.Millisecond)
+	if c.Count != 1 || c.Buckets[0] != 1 {
+		t.Errorf("expected copy to be unaffected by subsequent records: %+v", c)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package util
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// UnixNano returns the local wall time in nanoseconds since the
+// epoch. It's the physical clock of nodes' hybrid logical clocks.
+func UnixNano() int64 {
+	return time.Now().UnixNano()
+}
+
+// A ClockOffsetError indicates a reading of a remote clock was further
+// ahead of the local physical clock than the maximum offset allowed.
+type ClockOffsetError struct {
+	Remote    int64         // The remote clock reading
+	Local     int64         // The local physical clock reading
+	MaxOffset time.Duration // The maximum offset allowed
+}
+
+// Error implements the error interface.
+func (e *ClockOffsetError) Error() string {
+	return fmt.Sprintf("remote clock reading %d is %s ahead of local clock reading %d; maximum offset is %s",
+		e.Remote, time.Duration(e.Remote-e.Local), e.Local, e.MaxOffset)
+}
+
+// A Clock is a hybrid logical clock. Its readings follow a physical
+// clock, but never go backwards and advance with every reading, so
+// that they order the events of a node. Readings of other nodes'
+// clocks, propagated with the messages between them, advance the
+// clock past the readings, so that an event caused by another is
+// ordered after it regardless of skew between the nodes' physical
+// clocks.
+//
+// Readings are in nanoseconds since the epoch, like those of the
+// physical clock. Rather than keep a separate logical counter, the
+// clock advances a reading by a nanosecond when the physical clock
+// hasn't passed the last reading.
+type Clock struct {
+	physicalClock func() int64
+	maxOffset     time.Duration
+
+	mu   sync.Mutex
+	last int64 // The last reading or remote reading, whichever is later
+}
+
+// NewClock creates a clock following physicalClock, which returns
+// nanoseconds since the epoch; see UnixNano. Remote readings more
+// than maxOffset ahead of the physical clock are refused, unless
+// maxOffset is zero.
+func NewClock(physicalClock func() int64, maxOffset time.Duration) *Clock {
+	return &Clock{
+		physicalClock: physicalClock,
+		maxOffset:     maxOffset,
+	}
+}
+
+// MaxOffset returns the maximum offset of remote clock readings.
+func (c *Clock) MaxOffset() time.Duration {
+	return c.maxOffset
+}
+
+// Now returns a reading of the clock, which is later than all
+// previous readings and all remote readings the clock was updated
+// with.
+func (c *Clock) Now() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if physical := c.physicalClock(); physical > c.last {
+		c.last = physical
+	} else {
+		c.last++
+	}
+	return c.last
+}
+
+// Update advances the clock to follow remote, a reading of another
+// node's clock, so that subsequent readings are later. If remote is
+// further ahead of the physical clock than the maximum offset, the
+// other node's clock is presumed faulty: the clock isn't updated and
+// a ClockOffsetError is returned.
+func (c *Clock) Update(remote int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if physical := c.physicalClock(); c.maxOffset > 0 && remote-physical > int64(c.maxOffset) {
+		return &ClockOffsetError{Remote: remote, Local: physical, MaxOffset: c.maxOffset}
+	}
+	if remote > c.last {
+		c.last = remote
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+// manualClock is a physical clock which advances only when set.
+type manualClock struct {
+	nanos int64
+}
+
+func (m *manualClock) UnixNano() int64 {
+	return m.nanos
+}
+
+// TestClockNow verifies readings follow the physical clock and
+// advance even when it doesn't.
+func TestClockNow(t *testing.T) {
+	m := &manualClock{nanos: 100}
+	c := NewClock(m.UnixNano, 0)
+	expected := []int64{100, 101, 102}
+	for i, e := range expected {
+		if now := c.Now(); now != e {
+			t.Errorf("%d: expected %d; got %d", i, e, now)
+		}
+	}
+	m.nanos = 200
+	if now := c.Now(); now != 200 {
+		t.Errorf("expected reading to follow physical clock to 200; got %d", now)
+	}
+	// The physical clock going backwards doesn't affect readings.
+	m.nanos = 150
+	if now := c.Now(); now != 201 {
+		t.Errorf("expected reading 201 after physical clock went backwards; got %d", now)
+	}
+}
+
+// TestClockUpdate verifies remote readings advance the clock, and
+// that readings too far ahead of the physical clock are refused.
+func TestClockUpdate(t *testing.T) {
+	m := &manualClock{nanos: 100}
+	c := NewClock(m.UnixNano, 50*time.Nanosecond)
+	if err := c.Update(140); err != nil {
+		t.Fatal(err)
+	}
+	if now := c.Now(); now != 141 {
+		t.Errorf("expected reading to follow remote reading; got %d", now)
+	}
+	// Earlier remote readings have no effect.
+	if err := c.Update(120); err != nil {
+		t.Fatal(err)
+	}
+	if now := c.Now(); now != 142 {
+		t.Errorf("expected reading 142; got %d", now)
+	}
+	err := c.Update(151)
+	if coe, ok := err.(*ClockOffsetError); !ok || coe.Remote != 151 || coe.Local != 100 {
+		t.Errorf("expected clock offset error; got %v", err)
+	}
+	if now := c.Now(); now != 143 {
+		t.Errorf("expected refused reading not to advance clock; got %d", now)
+	}
+}
@@ -0,0 +1,567 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+/*
+Package protobuf encodes Go structs in the protocol buffer wire
+format, so that they may be exchanged with processes not written in
+Go. The messages are described by the .proto files in the proto
+directory; the Go structs are written by hand, each exported field
+tagged with its field number:
+
+	type Value struct {
+		Bytes     []byte `protobuf:"1"`
+		Timestamp int64  `protobuf:"2"`
+	}
+
+Fields tagged "-" aren't encoded; every other exported field must
+carry a tag, and unexported fields are ignored. Fields are encoded as
+follows:
+
+	bool, signed and unsigned integers    varint (int as int64)
+	float32, float64                      fixed32, fixed64
+	string, []byte                        length-delimited
+	structs and pointers to structs       embedded messages
+	slices of the above                   repeated fields, scalars packed
+	interfaces                            embedded messages; see Register
+
+Fields holding zero values are omitted, except pointers, which are
+encoded whenever non-nil, and elements of repeated fields. Decoders
+skip fields they don't know, so that fields may be added to messages
+without breaking processes built before they were.
+*/
+package protobuf
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"strconv"
+	"sync"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// Wire types of encoded fields.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// errorMessageField is the number of the field of an encoded
+// interface holding the message of a value which is an error; see
+// Register.
+const errorMessageField = 1
+
+// An Error stands in for an error decoded from an interface field
+// whose type isn't registered with this process, as when the error
+// was sent by a process built with a newer type. It retains the
+// error's message.
+type Error struct {
+	Message string
+}
+
+// Error implements the error interface.
+func (e *Error) Error() string {
+	return e.Message
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// A field describes a tagged field of a struct.
+type field struct {
+	index int
+	num   uint64
+	name  string
+}
+
+var (
+	mu        sync.Mutex
+	fieldsOf  = map[reflect.Type][]field{}
+	typeOfNum = map[uint64]reflect.Type{}
+	numOfType = map[reflect.Type]uint64{}
+)
+
+// Register records the type of value, which must be a pointer to a
+// struct, as num in the encodings of interface fields holding it.
+// An interface field is encoded as an embedded message holding its
+// value as field num; if the value is an error, field 1 holds its
+// message as well, so that num must be greater than 1. Numbers are
+// shared by all interface fields, and must be registered alike by
+// every process exchanging them.
+func Register(num int, value interface{}) {
+	t := reflect.TypeOf(value)
+	if t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		panic("protobuf: registered value must be a pointer to a struct: " + t.String())
+	}
+	if num <= errorMessageField {
+		panic("protobuf: registered number must be greater than 1: " + t.String())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if other, ok := typeOfNum[uint64(num)]; ok && other != t {
+		panic("protobuf: " + strconv.Itoa(num) + " registered for both " + other.String() + " and " + t.String())
+	}
+	if other, ok := numOfType[t]; ok && other != uint64(num) {
+		panic("protobuf: " + t.String() + " registered as both " + strconv.FormatUint(other, 10) + " and " + strconv.Itoa(num))
+	}
+	typeOfNum[uint64(num)] = t
+	numOfType[t] = uint64(num)
+}
+
+// IsMessage returns whether v is a struct, or a pointer to one,
+// whose fields carry protobuf tags.
+func IsMessage(v interface{}) bool {
+	t := reflect.TypeOf(v)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return false
+	}
+	fields, err := structFields(t)
+	return err == nil && len(fields) > 0
+}
+
+// structFields returns the tagged fields of struct type t.
+func structFields(t reflect.Type) ([]field, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if fields, ok := fieldsOf[t]; ok {
+		return fields, nil
+	}
+	var fields []field
+	seen := map[uint64]string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("protobuf")
+		if f.PkgPath != "" || tag == "-" {
+			continue
+		}
+		if tag == "" {
+			return nil, util.Errorf("field %s.%s lacks a protobuf tag", t, f.Name)
+		}
+		num, err := strconv.ParseUint(tag, 10, 29)
+		if err != nil || num == 0 {
+			return nil, util.Errorf("field %s.%s has invalid protobuf tag %q", t, f.Name, tag)
+		}
+		if other, ok := seen[num]; ok {
+			return nil, util.Errorf("fields %s.%s and %s share protobuf tag %d", t, f.Name, other, num)
+		}
+		seen[num] = f.Name
+		fields = append(fields, field{index: i, num: num, name: f.Name})
+	}
+	fieldsOf[t] = fields
+	return fields, nil
+}
+
+// Marshal returns the encoding of v, which must be a struct or a
+// pointer to one.
+func Marshal(v interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil, util.Errorf("can't marshal nil %s", rv.Type())
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, util.Errorf("can't marshal %s: not a struct", rv.Type())
+	}
+	return appendStruct(nil, rv)
+}
+
+// appendStruct appends the encoding of struct v to b.
+func appendStruct(b []byte, v reflect.Value) ([]byte, error) {
+	fields, err := structFields(v.Type())
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range fields {
+		if b, err = appendField(b, f.num, v.Field(f.index)); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// appendField appends the encoding of field num holding v to b,
+// unless v is a zero value.
+func appendField(b []byte, num uint64, v reflect.Value) ([]byte, error) {
+	switch v.Kind() {
+	case reflect.Slice:
+		if v.Len() == 0 {
+			return b, nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return appendBytes(appendKey(b, num, wireBytes), v.Bytes()), nil
+		}
+		if wire, ok := scalarWireType(v.Type().Elem().Kind()); ok {
+			var packed []byte
+			for i := 0; i < v.Len(); i++ {
+				packed = appendScalar(packed, wire, v.Index(i))
+			}
+			return appendBytes(appendKey(b, num, wireBytes), packed), nil
+		}
+		for i := 0; i < v.Len(); i++ {
+			var err error
+			if b, err = appendValue(b, num, v.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return b, nil
+		}
+		return appendValue(b, num, v)
+	case reflect.Struct:
+		enc, err := appendStruct(nil, v)
+		if err != nil || len(enc) == 0 {
+			return b, err
+		}
+		return appendBytes(appendKey(b, num, wireBytes), enc), nil
+	case reflect.String:
+		if v.Len() == 0 {
+			return b, nil
+		}
+	default:
+		if isZeroScalar(v) {
+			return b, nil
+		}
+	}
+	return appendValue(b, num, v)
+}
+
+// appendValue appends the encoding of field num holding v to b,
+// regardless of whether v is a zero value.
+func appendValue(b []byte, num uint64, v reflect.Value) ([]byte, error) {
+	if wire, ok := scalarWireType(v.Kind()); ok {
+		return appendScalar(appendKey(b, num, wire), wire, v), nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return appendBytes(appendKey(b, num, wireBytes), []byte(v.String())), nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return appendBytes(appendKey(b, num, wireBytes), v.Bytes()), nil
+		}
+	case reflect.Ptr:
+		if v.Elem().Kind() == reflect.Struct {
+			enc, err := appendStruct(nil, v.Elem())
+			if err != nil {
+				return nil, err
+			}
+			return appendBytes(appendKey(b, num, wireBytes), enc), nil
+		}
+	case reflect.Struct:
+		enc, err := appendStruct(nil, v)
+		if err != nil {
+			return nil, err
+		}
+		return appendBytes(appendKey(b, num, wireBytes), enc), nil
+	case reflect.Interface:
+		enc, err := appendInterface(nil, v.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return appendBytes(appendKey(b, num, wireBytes), enc), nil
+	}
+	return nil, util.Errorf("can't marshal field of type %s", v.Type())
+}
+
+// appendInterface appends the encoding of v, the value of an
+// interface field, to b. See Register.
+func appendInterface(b []byte, v reflect.Value) ([]byte, error) {
+	mu.Lock()
+	num, ok := numOfType[v.Type()]
+	mu.Unlock()
+	if !ok {
+		return nil, util.Errorf("type %s isn't registered", v.Type())
+	}
+	if err, ok := v.Interface().(error); ok {
+		b = appendBytes(appendKey(b, errorMessageField, wireBytes), []byte(err.Error()))
+	}
+	return appendValue(b, num, v)
+}
+
+// scalarWireType returns the wire type of numeric and boolean kinds.
+func scalarWireType(k reflect.Kind) (int, bool) {
+	switch k {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return wireVarint, true
+	case reflect.Float32:
+		return wireFixed32, true
+	case reflect.Float64:
+		return wireFixed64, true
+	}
+	return 0, false
+}
+
+// isZeroScalar returns whether v, of a kind with a scalar wire type,
+// is zero.
+func isZeroScalar(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0 && !math.Signbit(v.Float())
+	}
+	return false
+}
+
+// appendScalar appends the encoding of scalar v, with wire type wire,
+// to b.
+func appendScalar(b []byte, wire int, v reflect.Value) []byte {
+	switch wire {
+	case wireFixed32:
+		var buf [4]byte
+		binary.LittleEndian.PutUint32(buf[:], math.Float32bits(float32(v.Float())))
+		return append(b, buf[:]...)
+	case wireFixed64:
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v.Float()))
+		return append(b, buf[:]...)
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return appendVarint(b, 1)
+		}
+		return appendVarint(b, 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendVarint(b, uint64(v.Int()))
+	}
+	return appendVarint(b, v.Uint())
+}
+
+func appendKey(b []byte, num uint64, wire int) []byte {
+	return appendVarint(b, num<<3|uint64(wire))
+}
+
+func appendVarint(b []byte, x uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], x)]...)
+}
+
+func appendBytes(b, data []byte) []byte {
+	return append(appendVarint(b, uint64(len(data))), data...)
+}
+
+// Unmarshal decodes data into the struct v points to, which is first
+// zeroed.
+func Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return util.Errorf("can't unmarshal into %T: not a pointer to a struct", v)
+	}
+	rv = rv.Elem()
+	rv.Set(reflect.Zero(rv.Type()))
+	return decodeStruct(data, rv)
+}
+
+// decodeStruct decodes data into struct v, merging it with v's
+// fields.
+func decodeStruct(data []byte, v reflect.Value) error {
+	fields, err := structFields(v.Type())
+	if err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return util.Errorf("malformed field key decoding %s", v.Type())
+		}
+		data = data[n:]
+		num, wire := key>>3, int(key&7)
+		var raw []byte
+		if raw, data, err = splitValue(data, wire); err != nil {
+			return util.Errorf("decoding %s field %d: %s", v.Type(), num, err)
+		}
+		for _, f := range fields {
+			if f.num == num {
+				if err := decodeField(raw, wire, v.Field(f.index)); err != nil {
+					return util.Errorf("decoding %s.%s: %s", v.Type(), f.name, err)
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// splitValue splits the value of wire type wire from the start of
+// data, returning it and the remainder of data. Length-delimited
+// values are returned without their length.
+func splitValue(data []byte, wire int) ([]byte, []byte, error) {
+	var size int
+	switch wire {
+	case wireVarint:
+		_, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, nil, util.Error("malformed varint")
+		}
+		size = n
+	case wireFixed64:
+		size = 8
+	case wireFixed32:
+		size = 4
+	case wireBytes:
+		l, n := binary.Uvarint(data)
+		if n <= 0 || l > uint64(len(data)-n) {
+			return nil, nil, util.Error("malformed length")
+		}
+		data = data[n:]
+		size = int(l)
+	default:
+		return nil, nil, util.Errorf("unsupported wire type %d", wire)
+	}
+	if size > len(data) {
+		return nil, nil, util.Error("truncated value")
+	}
+	return data[:size], data[size:], nil
+}
+
+// decodeField decodes raw, a value of wire type wire, into field v.
+// Repeated fields have the value appended.
+func decodeField(raw []byte, wire int, v reflect.Value) error {
+	t := v.Type()
+	if t.Kind() == reflect.Slice && t.Elem().Kind() != reflect.Uint8 {
+		elemWire, scalar := scalarWireType(t.Elem().Kind())
+		if scalar && wire == wireBytes {
+			// Packed scalars.
+			for len(raw) > 0 {
+				var elem []byte
+				var err error
+				if elem, raw, err = splitValue(raw, elemWire); err != nil {
+					return err
+				}
+				e := reflect.New(t.Elem()).Elem()
+				if err := decodeValue(elem, elemWire, e); err != nil {
+					return err
+				}
+				v.Set(reflect.Append(v, e))
+			}
+			return nil
+		}
+		e := reflect.New(t.Elem()).Elem()
+		if err := decodeValue(raw, wire, e); err != nil {
+			return err
+		}
+		v.Set(reflect.Append(v, e))
+		return nil
+	}
+	return decodeValue(raw, wire, v)
+}
+
+// decodeValue decodes raw, a value of wire type wire, into v.
+func decodeValue(raw []byte, wire int, v reflect.Value) error {
+	if expected, ok := scalarWireType(v.Kind()); ok {
+		if wire != expected {
+			return util.Errorf("wire type %d for %s", wire, v.Type())
+		}
+		switch wire {
+		case wireFixed32:
+			v.SetFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(raw))))
+			return nil
+		case wireFixed64:
+			v.SetFloat(math.Float64frombits(binary.LittleEndian.Uint64(raw)))
+			return nil
+		}
+		x, _ := binary.Uvarint(raw)
+		switch v.Kind() {
+		case reflect.Bool:
+			v.SetBool(x != 0)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			v.SetInt(int64(x))
+		default:
+			v.SetUint(x)
+		}
+		return nil
+	}
+	if wire != wireBytes {
+		return util.Errorf("wire type %d for %s", wire, v.Type())
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(string(raw))
+		return nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes(append([]byte(nil), raw...))
+			return nil
+		}
+	case reflect.Struct:
+		return decodeStruct(raw, v)
+	case reflect.Ptr:
+		if v.Type().Elem().Kind() == reflect.Struct {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			return decodeStruct(raw, v.Elem())
+		}
+	case reflect.Interface:
+		return decodeInterface(raw, v)
+	}
+	return util.Errorf("can't unmarshal field of type %s", v.Type())
+}
+
+// decodeInterface decodes raw, the encoding of an interface value,
+// into interface v. See Register.
+func decodeInterface(raw []byte, v reflect.Value) error {
+	var message string
+	for len(raw) > 0 {
+		key, n := binary.Uvarint(raw)
+		if n <= 0 {
+			return util.Error("malformed field key")
+		}
+		num, wire := key>>3, int(key&7)
+		var value []byte
+		var err error
+		if value, raw, err = splitValue(raw[n:], wire); err != nil {
+			return err
+		}
+		if num == errorMessageField {
+			message = string(value)
+			continue
+		}
+		mu.Lock()
+		t, ok := typeOfNum[num]
+		mu.Unlock()
+		if !ok {
+			continue
+		}
+		if !t.AssignableTo(v.Type()) {
+			return util.Errorf("%s registered as %d isn't assignable to %s", t, num, v.Type())
+		}
+		elem := reflect.New(t.Elem())
+		if err := decodeStruct(value, elem.Elem()); err != nil {
+			return err
+		}
+		v.Set(elem)
+		return nil
+	}
+	if v.Type() == errorType {
+		v.Set(reflect.ValueOf(&Error{Message: message}))
+		return nil
+	}
+	return util.Errorf("no registered type for %s", v.Type())
+}
@@ -0,0 +1,257 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package protobuf
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testKey []byte
+
+type testStatus int
+
+type Inner struct {
+	Name  string  `protobuf:"1"`
+	Score float64 `protobuf:"2"`
+}
+
+type testError struct {
+	Code int32 `protobuf:"1"`
+}
+
+func (e *testError) Error() string { return "test error" }
+
+type testUnregisteredError struct {
+	Code int32 `protobuf:"1"`
+}
+
+func (e *testUnregisteredError) Error() string { return "unregistered error" }
+
+type testMessage struct {
+	Inner    `protobuf:"1"`
+	Key      testKey     `protobuf:"2"`
+	Keys     []testKey   `protobuf:"3"`
+	Flag     bool        `protobuf:"4"`
+	Count    int         `protobuf:"5"`
+	Small    int32       `protobuf:"6"`
+	Negative int64       `protobuf:"7"`
+	Unsigned uint64      `protobuf:"8"`
+	Ratio    float32     `protobuf:"9"`
+	Status   testStatus  `protobuf:"10"`
+	Counts   []int64     `protobuf:"11"`
+	Ptr      *Inner      `protobuf:"12"`
+	Inners   []Inner     `protobuf:"13"`
+	Error    error       `protobuf:"14"`
+	Update   interface{} `protobuf:"15"`
+	Skipped  string      `protobuf:"-"`
+	private  string
+}
+
+func init() {
+	Register(100, &testError{})
+	Register(101, &Inner{})
+}
+
+// TestRoundTrip verifies fields of each supported type are decoded
+// as encoded, save those not encoded.
+func TestRoundTrip(t *testing.T) {
+	m := &testMessage{
+		Inner:    Inner{Name: "embedded", Score: 1.5},
+		Key:      testKey("key"),
+		Keys:     []testKey{testKey("a"), nil, testKey("c")},
+		Flag:     true,
+		Count:    1 << 40,
+		Small:    -3,
+		Negative: -1 << 50,
+		Unsigned: 1<<64 - 1,
+		Ratio:    0.25,
+		Status:   2,
+		Counts:   []int64{1, -1, 0, 300},
+		Ptr:      &Inner{},
+		Inners:   []Inner{{Name: "x"}, {}},
+		Error:    &testError{Code: 7},
+		Update:   &Inner{Name: "update"},
+		Skipped:  "skipped",
+		private:  "private",
+	}
+	data, err := Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &testMessage{Skipped: "stale", Counts: []int64{5}}
+	if err := Unmarshal(data, decoded); err != nil {
+		t.Fatal(err)
+	}
+	m.Skipped, m.private = "", ""
+	if !reflect.DeepEqual(m, decoded) {
+		t.Errorf("expected %+v; got %+v", m, decoded)
+	}
+}
+
+// TestZeroValuesOmitted verifies zero values other than non-nil
+// pointers aren't encoded.
+func TestZeroValuesOmitted(t *testing.T) {
+	if data, err := Marshal(&testMessage{}); err != nil || len(data) != 0 {
+		t.Errorf("expected empty encoding of zero message; got %x, %v", data, err)
+	}
+	data, err := Marshal(&testMessage{Ptr: &Inner{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []byte{12<<3 | wireBytes, 0}; !bytes.Equal(data, expected) {
+		t.Errorf("expected %x; got %x", expected, data)
+	}
+}
+
+// TestWireFormat verifies encodings match those of the protocol
+// buffer encoding of the equivalent message.
+func TestWireFormat(t *testing.T) {
+	data, err := Marshal(&testMessage{
+		Inner:  Inner{Name: "a"},
+		Flag:   true,
+		Small:  -1,
+		Counts: []int64{1, 300},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{
+		0x0a, 0x03, 0x0a, 0x01, 'a', // Inner: message of Name "a"
+		0x20, 0x01, // Flag: varint 1
+		0x30, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, // Small: varint -1
+		0x5a, 0x03, 0x01, 0xac, 0x02, // Counts: packed varints 1, 300
+	}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("expected %x; got %x", expected, data)
+	}
+	// Unpacked repeated scalars are decoded as well.
+	m := &testMessage{}
+	if err := Unmarshal([]byte{0x58, 0x01, 0x58, 0xac, 0x02}, m); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m.Counts, []int64{1, 300}) {
+		t.Errorf("expected counts [1 300]; got %v", m.Counts)
+	}
+}
+
+// TestUnknownFields verifies fields unknown to the decoder are
+// skipped, and errors of unregistered types are decoded with their
+// messages.
+func TestUnknownFields(t *testing.T) {
+	data, err := Marshal(&testMessage{Flag: true, Ptr: &Inner{Name: "x"}, Counts: []int64{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	older := &struct {
+		Flag bool `protobuf:"4"`
+	}{}
+	if err := Unmarshal(data, older); err != nil || !older.Flag {
+		t.Errorf("expected flag decoded, skipping unknown fields; got %+v, %v", older, err)
+	}
+
+	// An error of a type unknown to the decoder: field 200 of the
+	// encoded interface.
+	data = []byte{14<<3 | wireBytes, 6, 0x0a, 0x02, 'h', 'i', 0xc2, 0x0c, 0x00}
+	data[1] = byte(len(data) - 2)
+	m := &testMessage{}
+	if err := Unmarshal(data, m); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := m.Error.(*Error); !ok || e.Message != "hi" {
+		t.Errorf("expected generic error with message \"hi\"; got %#v", m.Error)
+	}
+
+	if _, err := Marshal(&testMessage{Error: &testUnregisteredError{}}); err == nil {
+		t.Error("expected error marshaling unregistered type")
+	}
+}
+
+// TestMissingTag verifies exported fields without tags are refused.
+func TestMissingTag(t *testing.T) {
+	m := &struct {
+		Tagged   int `protobuf:"1"`
+		Untagged int
+	}{}
+	if _, err := Marshal(m); err == nil || !strings.Contains(err.Error(), "lacks a protobuf tag") {
+		t.Errorf("expected missing tag error; got %v", err)
+	}
+	if IsMessage(m) {
+		t.Error("expected struct with untagged field not to be a message")
+	}
+	if IsMessage(&struct{ unexported int }{}) || !IsMessage(&Inner{}) {
+		t.Error("expected only structs with tagged fields to be messages")
+	}
+}
+
+const testSchema = `
+// An Inner.
+message Inner {
+  optional string name = 1;
+  optional double score = 2;
+}
+
+enum testStatus {
+  ZERO = 0;
+}
+
+message TestMessage {
+  optional Inner inner = 1;
+  optional bytes key = 2;
+  repeated bytes keys = 3;
+  optional bool flag = 4;
+  optional int64 count = 5;
+  optional int32 small = 6;
+  optional int64 negative = 7;
+  optional uint64 unsigned = 8;
+  optional float ratio = 9;
+  optional int64 status = 10;
+  repeated int64 counts = 11 [packed=true];
+  optional Inner ptr = 12;
+  repeated Inner inners = 13;
+  optional Any error = 14;
+  optional Any update = 15;
+}
+
+message Any {
+  oneof value {
+    Inner inner = 101;
+  }
+}
+`
+
+// TestCheckSchema verifies structs are checked against the messages
+// declared in a schema.
+func TestCheckSchema(t *testing.T) {
+	if err := CheckSchema(testSchema, &testMessage{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, change := range [][2]string{
+		{"name = 1", "name = 3"},
+		{"optional bool flag", "optional int32 flag"},
+		{"repeated bytes keys", "optional bytes keys"},
+		{"optional int64 negative = 7;", ""},
+		{"message Inner", "message Other"},
+		{"Inner ptr = 12", "Any ptr = 12"},
+		{"unsigned = 8", "signed = 8"},
+	} {
+		if err := CheckSchema(strings.Replace(testSchema, change[0], change[1], 1), &testMessage{}); err == nil {
+			t.Errorf("expected error replacing %q with %q", change[0], change[1])
+		}
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package protobuf
+
+import (
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// A schemaField is a field of a message declared in a .proto file.
+type schemaField struct {
+	repeated bool
+	typ      string
+	name     string
+}
+
+var (
+	commentRE = regexp.MustCompile(`//[^\n]*`)
+	blockRE   = regexp.MustCompile(`^(message|enum|oneof)\s+(\w+)\s*\{$`)
+	fieldRE   = regexp.MustCompile(`^(?:(optional|required|repeated)\s+)?([\w.]+)\s+(\w+)\s*=\s*(\d+)\s*(?:\[[^\]]*\])?;$`)
+)
+
+// parseSchema returns the fields of the messages declared in schema,
+// the text of .proto files, by message name and field number, and
+// the names of the enums declared.
+func parseSchema(schema string) (map[string]map[uint64]schemaField, map[string]bool, error) {
+	messages := map[string]map[uint64]schemaField{}
+	enums := map[string]bool{}
+	var blocks []string
+	var message string
+	text := strings.Replace(commentRE.ReplaceAllString(schema, ""), "{", "{\n", -1)
+	text = strings.Replace(strings.Replace(text, "}", "\n}\n", -1), ";", ";\n", -1)
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if m := blockRE.FindStringSubmatch(line); m != nil {
+			blocks = append(blocks, m[1])
+			switch m[1] {
+			case "message":
+				if len(blocks) > 1 {
+					return nil, nil, util.Errorf("nested message %s isn't supported", m[2])
+				}
+				message = m[2]
+				messages[message] = map[uint64]schemaField{}
+			case "enum":
+				enums[m[2]] = true
+			}
+			continue
+		}
+		if line == "}" {
+			if len(blocks) == 0 {
+				return nil, nil, util.Error("unbalanced braces")
+			}
+			blocks = blocks[:len(blocks)-1]
+			continue
+		}
+		if len(blocks) == 0 || blocks[len(blocks)-1] == "enum" {
+			continue
+		}
+		m := fieldRE.FindStringSubmatch(line)
+		if m == nil {
+			if line != "" {
+				return nil, nil, util.Errorf("unparsed line in message %s: %q", message, line)
+			}
+			continue
+		}
+		num, _ := strconv.ParseUint(m[4], 10, 29)
+		if _, ok := messages[message][num]; ok {
+			return nil, nil, util.Errorf("message %s declares field %d twice", message, num)
+		}
+		messages[message][num] = schemaField{repeated: m[1] == "repeated", typ: m[2], name: m[3]}
+	}
+	if len(blocks) != 0 {
+		return nil, nil, util.Error("unbalanced braces")
+	}
+	return messages, enums, nil
+}
+
+// scalarTypes lists the .proto types of fields of each kind.
+var scalarTypes = map[reflect.Kind]string{
+	reflect.Bool:    "bool",
+	reflect.Int:     "int64",
+	reflect.Int32:   "int32",
+	reflect.Int64:   "int64",
+	reflect.Uint32:  "uint32",
+	reflect.Uint64:  "uint64",
+	reflect.Float32: "float",
+	reflect.Float64: "double",
+	reflect.String:  "string",
+}
+
+// CheckSchema returns an error unless the structs pointed to by
+// prototypes, and those they hold, match the declarations of the
+// messages of the same names in schema, the text of .proto files,
+// unexported names being capitalized: each field must be declared
+// with the same number, an equivalent name and a compatible type, and
+// repeated if and only if it's a slice. Fields of named integer types
+// may be declared as enums of the same names, and interface fields as
+// any message.
+func CheckSchema(schema string, prototypes ...interface{}) error {
+	messages, enums, err := parseSchema(schema)
+	if err != nil {
+		return err
+	}
+	checked := map[reflect.Type]bool{}
+	for _, p := range prototypes {
+		if err := checkMessage(reflect.TypeOf(p).Elem(), messages, enums, checked); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkMessage checks struct type t, and the structs held by its
+// fields, against their declarations in messages, skipping the types
+// already checked.
+func checkMessage(t reflect.Type, messages map[string]map[uint64]schemaField, enums map[string]bool, checked map[reflect.Type]bool) error {
+	if checked[t] {
+		return nil
+	}
+	checked[t] = true
+	name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+	declared, ok := messages[name]
+	if !ok {
+		return util.Errorf("message %s isn't declared", name)
+	}
+	fields, err := structFields(t)
+	if err != nil {
+		return err
+	}
+	if len(fields) != len(declared) {
+		return util.Errorf("message %s declares %d fields; %s has %d", name, len(declared), t, len(fields))
+	}
+	for _, f := range fields {
+		d, ok := declared[f.num]
+		if !ok {
+			return util.Errorf("message %s doesn't declare field %d (%s)", name, f.num, f.name)
+		}
+		if strings.Replace(d.name, "_", "", -1) != strings.ToLower(f.name) {
+			return util.Errorf("message %s names field %d %s, not %s", name, f.num, d.name, f.name)
+		}
+		ft := t.Field(f.index).Type
+		repeated := ft.Kind() == reflect.Slice && ft.Elem().Kind() != reflect.Uint8
+		if repeated {
+			ft = ft.Elem()
+		}
+		if repeated != d.repeated {
+			return util.Errorf("message %s field %s must be repeated if and only if it's a slice", name, d.name)
+		}
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		var compatible bool
+		switch ft.Kind() {
+		case reflect.Struct:
+			if compatible = d.typ == ft.Name(); compatible {
+				if err := checkMessage(ft, messages, enums, checked); err != nil {
+					return err
+				}
+			}
+		case reflect.Interface:
+			_, compatible = messages[d.typ]
+		case reflect.Slice:
+			compatible = d.typ == "bytes" && ft.Elem().Kind() == reflect.Uint8
+		default:
+			compatible = d.typ == scalarTypes[ft.Kind()] || (enums[d.typ] && d.typ == ft.Name())
+		}
+		if !compatible {
+			return util.Errorf("message %s field %s has type %s; %s.%s is %s", name, d.name, d.typ, t, f.name, ft)
+		}
+	}
+	return nil
+}
@@ -18,6 +18,8 @@
 package util
 
 import (
+	"fmt"
+	"math/rand"
 	"time"
 
 	"github.com/golang/glog"
@@ -26,11 +28,13 @@ import (
 // RetryOptions provides control of retry loop logic via the
 // RetryWithBackoffOptions method.
 type RetryOptions struct {
-	Tag         string        // Tag for helpful logging of backoffs
-	Backoff     time.Duration // Default retry backoff interval
-	MaxBackoff  time.Duration // Maximum retry backoff interval
-	Constant    float64       // Default backoff constant
-	MaxAttempts int           // Maximum number of attempts (0 for infinite)
+	Tag         string          // Tag for helpful logging of backoffs
+	Backoff     time.Duration   // Default retry backoff interval
+	MaxBackoff  time.Duration   // Maximum retry backoff interval
+	Constant    float64         // Default backoff constant
+	MaxAttempts int             // Maximum number of attempts (0 for infinite)
+	Jitter      float64         // Fraction by which each backoff is randomly varied, in [0, 1)
+	Stopper     <-chan struct{} // If not nil, closing abandons the retry loop
 }
 
 var DefaultRetryOptions = RetryOptions{
@@ -41,30 +45,64 @@ var DefaultRetryOptions = RetryOptions{
 	MaxAttempts: 10,
 }
 
+// RetryAfter may be returned along with false by the fn passed to
+// RetryWithBackoff to retry after the specified duration, such as a
+// hint from a throttling server, instead of the loop's backoff.
+type RetryAfter time.Duration
+
+// Error implements the error interface.
+func (r RetryAfter) Error() string {
+	return fmt.Sprintf("retry after %s", time.Duration(r))
+}
+
 // RetryWithBackoff implements retry with exponential backoff using
 // the supplied options as parameters. When fn returns false and the
 // number of retry attempts haven't been exhausted, fn is
 // retried. When fn returns true, retry ends. Returns an error if the
-// maximum number of retries is exceeded or if the fn returns an
-// error.
+// maximum number of retries is exceeded, if the fn returns an error
+// other than RetryAfter or if opts.Stopper is closed while backing
+// off. If fn returns false with a RetryAfter, the next attempt waits
+// the specified duration, capped at opts.MaxBackoff, and the backoff
+// isn't increased.
 func RetryWithBackoff(opts RetryOptions, fn func() (bool, error)) error {
 	backoff := opts.Backoff
 	for count := 1; true; count++ {
-		if done, err := fn(); done || err != nil {
+		done, err := fn()
+		retryAfter, hinted := err.(RetryAfter)
+		if done || (err != nil && !hinted) {
 			return err
 		}
 		if opts.MaxAttempts > 0 && count >= opts.MaxAttempts {
 			return Errorf("exceeded maximum retry attempts: %d", opts.MaxAttempts)
 		}
-		glog.Infof("%s failed; retrying in %s", opts.Tag, backoff)
+		wait := jitter(backoff, opts.Jitter)
+		if hinted {
+			if wait = time.Duration(retryAfter); opts.MaxBackoff > 0 && wait > opts.MaxBackoff {
+				wait = opts.MaxBackoff
+			}
+		}
+		glog.Infof("%s failed; retrying in %s", opts.Tag, wait)
 		select {
-		case <-time.After(backoff):
-			// Increase backoff.
-			backoff = time.Duration(float64(backoff) * opts.Constant)
-			if backoff > opts.MaxBackoff {
-				backoff = opts.MaxBackoff
+		case <-time.After(wait):
+			// Increase backoff, unless this wait was hinted.
+			if !hinted {
+				backoff = time.Duration(float64(backoff) * opts.Constant)
+				if backoff > opts.MaxBackoff {
+					backoff = opts.MaxBackoff
+				}
 			}
+		case <-opts.Stopper:
+			return Errorf("%s stopped after %d attempts", opts.Tag, count)
 		}
 	}
 	return nil
 }
+
+// jitter returns d varied randomly by up to the fraction j in either
+// direction, so that concurrent retry loops don't retry in lockstep.
+func jitter(d time.Duration, j float64) time.Duration {
+	if j <= 0 {
+		return d
+	}
+	return time.Duration(float64(d) * (1 + j*(2*rand.Float64()-1)))
+}
@@ -24,7 +24,7 @@ import (
 )
 
 func TestRetry(t *testing.T) {
-	opts := RetryOptions{"test", time.Microsecond * 10, time.Second, 2, 10}
+	opts := RetryOptions{"test", time.Microsecond * 10, time.Second, 2, 10, 0, nil}
 	var retries int
 	err := RetryWithBackoff(opts, func() (bool, error) {
 		retries++
@@ -42,7 +42,7 @@ func TestRetryExceedsMaxBackoff(t *testing.T) {
 	timer := time.AfterFunc(time.Second, func() {
 		t.Error("max backoff not respected")
 	})
-	opts := RetryOptions{"test", time.Microsecond * 10, time.Microsecond * 10, 1000, 3}
+	opts := RetryOptions{"test", time.Microsecond * 10, time.Microsecond * 10, 1000, 3, 0, nil}
 	err := RetryWithBackoff(opts, func() (bool, error) {
 		return false, nil
 	})
@@ -54,7 +54,7 @@ func TestRetryExceedsMaxBackoff(t *testing.T) {
 
 func TestRetryExceedsMaxAttempts(t *testing.T) {
 	var retries int
-	opts := RetryOptions{"test", time.Microsecond * 10, time.Second, 2, 3}
+	opts := RetryOptions{"test", time.Microsecond * 10, time.Second, 2, 3, 0, nil}
 	err := RetryWithBackoff(opts, func() (bool, error) {
 		retries++
 		return false, nil
@@ -65,7 +65,7 @@ func TestRetryExceedsMaxAttempts(t *testing.T) {
 }
 
 func TestRetryFunctionReturnsError(t *testing.T) {
-	opts := RetryOptions{"test", time.Microsecond * 10, time.Second, 2, 0 /* indefinite */}
+	opts := RetryOptions{"test", time.Microsecond * 10, time.Second, 2, 0 /* indefinite */, 0, nil}
 	err := RetryWithBackoff(opts, func() (bool, error) {
 		return false, fmt.Errorf("something went wrong")
 	})
@@ -73,3 +73,50 @@ func TestRetryFunctionReturnsError(t *testing.T) {
 		t.Error("expected an error")
 	}
 }
+
+func TestRetryAfterHint(t *testing.T) {
+	timer := time.AfterFunc(time.Second, func() {
+		t.Error("retry after hint not respected")
+	})
+	defer timer.Stop()
+	opts := RetryOptions{"test", time.Hour, time.Hour, 2, 0 /* indefinite */, 0, nil}
+	var retries int
+	start := time.Now()
+	err := RetryWithBackoff(opts, func() (bool, error) {
+		if retries++; retries >= 3 {
+			return true, nil
+		}
+		return false, RetryAfter(5 * time.Millisecond)
+	})
+	if err != nil || retries != 3 {
+		t.Errorf("expected 3 retries; got %d, %v", retries, err)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("expected retries to wait for hint; elapsed %s", elapsed)
+	}
+}
+
+func TestRetryStopper(t *testing.T) {
+	stopper := make(chan struct{})
+	opts := RetryOptions{"test", time.Hour, time.Hour, 2, 0 /* indefinite */, 0, stopper}
+	var retries int
+	time.AfterFunc(10*time.Millisecond, func() { close(stopper) })
+	err := RetryWithBackoff(opts, func() (bool, error) {
+		retries++
+		return false, nil
+	})
+	if err == nil || retries != 1 {
+		t.Errorf("expected stop after 1 attempt; got %d, %v", retries, err)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	if d := jitter(time.Second, 0); d != time.Second {
+		t.Errorf("expected no jitter; got %s", d)
+	}
+	for i := 0; i < 100; i++ {
+		if d := jitter(time.Second, 0.5); d < 500*time.Millisecond || d > 1500*time.Millisecond {
+			t.Fatalf("expected backoff within 50%% of 1s; got %s", d)
+		}
+	}
+}